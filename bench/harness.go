@@ -0,0 +1,260 @@
+// Package bench contains a load generation harness for the proxy data path in
+// pkg/relay. It simulates both ends of a proxied session, a CDP client talking
+// to a Chrome like echo upstream and a noVNC client reading from an RFB like
+// stream, so throughput, latency and allocations can be measured without VMs.
+//
+// Benchmarks live in this package's _test.go files and can be run with
+// `make bench`.
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/relay"
+)
+
+// cdpCommand mirrors the shape of a CDP command or response message.
+type cdpCommand struct {
+	ID     int                    `json:"id"`
+	Method string                 `json:"method,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+	Result map[string]interface{} `json:"result,omitempty"`
+}
+
+// CDPCommand returns an encoded CDP command with id and a payload of roughly
+// payloadSize bytes, similar to a Runtime.evaluate call.
+func CDPCommand(id int, payloadSize int) []byte {
+	msg := cdpCommand{
+		ID:     id,
+		Method: "Runtime.evaluate",
+		Params: map[string]interface{}{
+			"expression":    strings.Repeat("x", payloadSize),
+			"returnByValue": true,
+		},
+	}
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+	EnableCompression: true,
+}
+
+func wsURL(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// StartCDPUpstream starts a fake Chrome DevTools endpoint that answers every
+// command with a response carrying the same id.
+func StartCDPUpstream() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var cmd cdpCommand
+			if err := json.Unmarshal(data, &cmd); err != nil {
+				return
+			}
+			resp, _ := json.Marshal(cdpCommand{ID: cmd.ID, Result: map[string]interface{}{}})
+			if err := conn.WriteMessage(messageType, resp); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+// StartCDPProxy starts a proxy in front of upstreamURL using the same relay as
+// cdpserver, with the given compression settings.
+func StartCDPProxy(upstreamURL string, compression config.CompressionConfig) *httptest.Server {
+	proxyUpgrader := websocket.Upgrader{
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		EnableCompression: compression.Enabled,
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = compression.Enabled &&
+		compression.Upstream == config.CompressionUpstreamPassthrough
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientConn, err := proxyUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer clientConn.Close()
+
+		upstreamConn, _, err := dialer.Dial(upstreamURL, nil)
+		if err != nil {
+			return
+		}
+		defer upstreamConn.Close()
+
+		relay.WebSockets(clientConn, upstreamConn, nil)
+	}))
+}
+
+// StartRFBUpstream starts a TCP server that, once a client connects, streams
+// framebuffer update sized writes of updateSize bytes back to back until the
+// client disconnects. It returns the listener address.
+func StartRFBUpstream(updateSize int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	update := make([]byte, updateSize)
+	for i := range update {
+		update[i] = byte(i)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					if _, err := conn.Write(update); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener, nil
+}
+
+// StartVNCProxy starts a websockify style proxy in front of vncAddr using the
+// same relay as novncserver.
+func StartVNCProxy(vncAddr string, batching config.BatchingConfig) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		vncConn, err := net.Dial("tcp", vncAddr)
+		if err != nil {
+			return
+		}
+		defer vncConn.Close()
+
+		relay.VNC(conn, vncConn, batching, nil)
+	}))
+}
+
+// Dial opens a client WebSocket to a server started by this package.
+func Dial(server *httptest.Server, compression bool) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = compression
+	conn, _, err := dialer.Dial(wsURL(server), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", server.URL, err)
+	}
+	return conn, nil
+}
+
+// LoadResult summarizes a load run.
+type LoadResult struct {
+	Messages int
+	Bytes    int64
+	Elapsed  time.Duration
+	P50      time.Duration
+	P99      time.Duration
+}
+
+func (r LoadResult) String() string {
+	return fmt.Sprintf("messages=%d bytes=%d elapsed=%s msgs/s=%.0f p50=%s p99=%s",
+		r.Messages, r.Bytes, r.Elapsed, float64(r.Messages)/r.Elapsed.Seconds(), r.P50, r.P99)
+}
+
+// RunCDPLoad drives a CDP proxy with concurrency clients until messages
+// round trips have completed in total. Each client sends a command and waits
+// for its response before sending the next, which is how automation libraries
+// typically use a session.
+func RunCDPLoad(proxy *httptest.Server, concurrency int, messages int, payloadSize int, compression bool) (LoadResult, error) {
+	var (
+		lock      sync.Mutex
+		result    LoadResult
+		latencies []time.Duration
+		firstErr  error
+		wg        sync.WaitGroup
+	)
+
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		count := messages / concurrency
+		if i < messages%concurrency {
+			count++
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := Dial(proxy, compression)
+			if err != nil {
+				lock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				lock.Unlock()
+				return
+			}
+			defer conn.Close()
+
+			var local []time.Duration
+			var bytes int64
+			for id := 1; id <= count; id++ {
+				cmd := CDPCommand(id, payloadSize)
+				sent := time.Now()
+				if err := conn.WriteMessage(websocket.TextMessage, cmd); err != nil {
+					break
+				}
+				_, resp, err := conn.ReadMessage()
+				if err != nil {
+					break
+				}
+				local = append(local, time.Since(sent))
+				bytes += int64(len(cmd) + len(resp))
+			}
+
+			lock.Lock()
+			latencies = append(latencies, local...)
+			result.Bytes += bytes
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+	result.Messages = len(latencies)
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		result.P50 = latencies[len(latencies)/2]
+		result.P99 = latencies[len(latencies)*99/100]
+	}
+	return result, firstErr
+}
@@ -0,0 +1,144 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+func TestMain(m *testing.M) {
+	// Connection teardown at the end of every benchmark is logged by the relay
+	// and would otherwise drown out the results.
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+var compressionModes = []struct {
+	name   string
+	config config.CompressionConfig
+}{
+	{"plain", config.CompressionConfig{}},
+	{"recompress", config.CompressionConfig{Enabled: true, Level: 1, Upstream: config.CompressionUpstreamRecompress}},
+	{"passthrough", config.CompressionConfig{Enabled: true, Level: 1, Upstream: config.CompressionUpstreamPassthrough}},
+}
+
+// BenchmarkCDPRoundTrip measures a single command/response round trip through
+// the CDP relay. ns/op is the per message latency.
+func BenchmarkCDPRoundTrip(b *testing.B) {
+	upstream := StartCDPUpstream()
+	defer upstream.Close()
+
+	for _, mode := range compressionModes {
+		for _, payloadSize := range []int{64, 4096, 65536} {
+			b.Run(fmt.Sprintf("%s/%dB", mode.name, payloadSize), func(b *testing.B) {
+				proxy := StartCDPProxy(wsURL(upstream), mode.config)
+				defer proxy.Close()
+
+				conn, err := Dial(proxy, mode.config.Enabled)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer conn.Close()
+
+				cmd := CDPCommand(1, payloadSize)
+				b.SetBytes(int64(len(cmd)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := conn.WriteMessage(websocket.TextMessage, cmd); err != nil {
+						b.Fatal(err)
+					}
+					if _, _, err := conn.ReadMessage(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkCDPLoad runs b.N round trips spread over several concurrent
+// sessions and reports tail latencies alongside throughput.
+func BenchmarkCDPLoad(b *testing.B) {
+	upstream := StartCDPUpstream()
+	defer upstream.Close()
+
+	for _, concurrency := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("sessions=%d", concurrency), func(b *testing.B) {
+			proxy := StartCDPProxy(wsURL(upstream), config.CompressionConfig{})
+			defer proxy.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			result, err := RunCDPLoad(proxy, concurrency, b.N, 256, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(result.P50.Microseconds()), "p50-us")
+			b.ReportMetric(float64(result.P99.Microseconds()), "p99-us")
+			b.ReportMetric(float64(result.Messages)/result.Elapsed.Seconds(), "msgs/s")
+		})
+	}
+}
+
+// BenchmarkVNCStream measures how fast an RFB stream is delivered to a noVNC
+// client with and without frame batching. frames/op shows how many WebSocket
+// frames each update turned into.
+func BenchmarkVNCStream(b *testing.B) {
+	const updateSize = 512
+
+	rfb, err := StartRFBUpstream(updateSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer rfb.Close()
+
+	batchings := []struct {
+		name   string
+		config config.BatchingConfig
+	}{
+		{"unbatched", config.BatchingConfig{}},
+		{"batched-1ms", config.BatchingConfig{FlushInterval: time.Millisecond, MaxBatchBytes: 64 * 1024}},
+		{"batched-5ms", config.BatchingConfig{FlushInterval: 5 * time.Millisecond, MaxBatchBytes: 64 * 1024}},
+	}
+	for _, batching := range batchings {
+		b.Run(batching.name, func(b *testing.B) {
+			proxy := StartVNCProxy(rfb.Addr().String(), batching.config)
+			defer proxy.Close()
+
+			conn, err := Dial(proxy, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			b.SetBytes(updateSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			want := int64(b.N) * updateSize
+			var got int64
+			frames := 0
+			for got < want {
+				_, r, err := conn.NextReader()
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, r)
+				if err != nil {
+					b.Fatal(err)
+				}
+				got += n
+				frames++
+			}
+			b.ReportMetric(float64(frames)/float64(b.N), "frames/op")
+		})
+	}
+}
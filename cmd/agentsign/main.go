@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/abshkbh/arrakis/pkg/agentupdate"
+)
+
+func generateKey(ctx *cli.Context) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+
+	privatePath := ctx.String("out")
+	publicPath := privatePath + ".pub"
+	if err := os.WriteFile(privatePath, []byte(base64.StdEncoding.EncodeToString(privateKey)+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(publicPath, []byte(base64.StdEncoding.EncodeToString(publicKey)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write public key: %v", err)
+	}
+	log.Infof("Wrote private key to %s and public key to %s", privatePath, publicPath)
+	log.Info("Install the public key in the guest rootfs as /etc/arrakis/agent-update.pub")
+	return nil
+}
+
+func sign(ctx *cli.Context) error {
+	data, err := os.ReadFile(ctx.String("key"))
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid private key in %s", ctx.String("key"))
+	}
+
+	binary, err := os.ReadFile(ctx.String("binary"))
+	if err != nil {
+		return fmt.Errorf("failed to read binary: %v", err)
+	}
+	fmt.Println(agentupdate.Sign(ed25519.PrivateKey(key), ctx.String("agent"), ctx.String("version"), binary))
+	return nil
+}
+
+func main() {
+	app := &cli.App{
+		Name:  "arrakis-agentsign",
+		Usage: "Sign guest agent binaries for in-place agent updates",
+		Commands: []*cli.Command{
+			{
+				Name:  "keygen",
+				Usage: "Generate an ed25519 signing key pair",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "out",
+						Aliases: []string{"o"},
+						Usage:   "Path of the private key, the public key is written to <out>.pub",
+						Value:   "agent-update.key",
+					},
+				},
+				Action: generateKey,
+			},
+			{
+				Name:  "sign",
+				Usage: "Print the base64 signature of a version of an agent binary",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "key",
+						Aliases:  []string{"k"},
+						Usage:    "Path to the private key",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "binary",
+						Aliases:  []string{"b"},
+						Usage:    "Path to the agent binary",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "agent",
+						Aliases: []string{"a"},
+						Usage:   "Agent the binary may only be installed as",
+						Value:   agentupdate.DefaultAgent,
+					},
+					&cli.StringFlag{
+						Name:     "version",
+						Usage:    "Version of the binary, as it reports it with --version",
+						Required: true,
+					},
+				},
+				Action: sign,
+			},
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.WithError(err).Fatal("agentsign failed")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/listener"
+)
+
+// cdpGrant is what the token of a request opens.
+type cdpGrant struct {
+	all bool
+	vms map[string]bool
+}
+
+type grantKey struct{}
+
+// grantFromContext returns the grant of a request authenticated by
+// requireAuth, nil if tokens aren't required.
+func grantFromContext(ctx context.Context) *cdpGrant {
+	grant, _ := ctx.Value(grantKey{}).(*cdpGrant)
+	return grant
+}
+
+// authorize returns the VM a request for vmName may be routed to. A request
+// naming no VM, which goes to the first running one, is only routed for a
+// token scoped to a single VM, to that VM.
+func (g *cdpGrant) authorize(vmName string) (string, error) {
+	if g == nil || g.all || g.vms[vmName] {
+		return vmName, nil
+	}
+	if vmName != "" {
+		return "", fmt.Errorf("the token doesn't open VM %s", vmName)
+	}
+	if len(g.vms) == 1 {
+		for vm := range g.vms {
+			return vm, nil
+		}
+	}
+	return "", fmt.Errorf("the token opens several VMs, name one with /vm/<name>/ or ?vm=<name>")
+}
+
+// validateAuth checks the tokens of auth before they are used.
+func validateAuth(auth config.CDPAuthConfig) error {
+	for i, t := range auth.VMTokens {
+		if t.Token == "" || len(t.VMs) == 0 {
+			return fmt.Errorf("auth.vm_tokens[%d] needs a token and vms", i)
+		}
+	}
+	return nil
+}
+
+// grantFor returns what token opens under auth.
+func grantFor(auth config.CDPAuthConfig, token string) (*cdpGrant, bool) {
+	if token == "" {
+		return nil, false
+	}
+	for _, t := range auth.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return &cdpGrant{all: true}, true
+		}
+	}
+	for _, t := range auth.VMTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+			grant := &cdpGrant{vms: make(map[string]bool)}
+			for _, vm := range t.VMs {
+				grant.vms[vm] = true
+			}
+			return grant, true
+		}
+	}
+	return nil, false
+}
+
+// requireAuth only passes requests carrying one of the configured tokens, as
+// a bearer token or a `token` query parameter, on to next, with the grant of
+// their token in their context. Everything passes while no token is
+// configured.
+func (s *cdpServer) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		var auth config.CDPAuthConfig
+		if s.cfg != nil {
+			auth = s.cfg.Auth
+		}
+		s.mu.RUnlock()
+		if !auth.Enabled() {
+			next(w, r)
+			return
+		}
+
+		grant, ok := grantFor(auth, listener.RequestToken(r))
+		if !ok {
+			log.Warnf("Rejected unauthenticated DevTools request from %s for %s", r.RemoteAddr, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), grantKey{}, grant)))
+	}
+}
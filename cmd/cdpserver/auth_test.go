@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestAuth(t *testing.T) {
+	chrome1 := testharness.NewFakeChromeWithTarget("one")
+	defer chrome1.Close()
+	chrome2 := testharness.NewFakeChromeWithTarget("two")
+	defer chrome2.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome1), testharness.RunningVM("vm2", chrome2))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{Auth: config.CDPAuthConfig{
+		Tokens:   []string{"all"},
+		VMTokens: []config.VMTokenConfig{{Token: "scoped", VMs: []string{"vm2"}}},
+	}})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	get := func(path string, bearer string) (int, string) {
+		req, _ := http.NewRequest("GET", proxy.URL+path, nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, tc := range []struct {
+		path   string
+		bearer string
+		status int
+		// want is in the body of successful requests, telling which VM
+		// answered.
+		want string
+	}{
+		{"/health", "", http.StatusOK, ""},
+		{"/json/version", "", http.StatusUnauthorized, ""},
+		{"/json/version", "wrong", http.StatusUnauthorized, ""},
+		{"/vm/vm1/json/version", "all", http.StatusOK, "one-browser"},
+		{"/vm/vm2/json/version?token=scoped", "", http.StatusOK, "two-browser"},
+		{"/vm/vm1/json/version", "scoped", http.StatusForbidden, ""},
+		{"/json/version?vm=vm1", "scoped", http.StatusForbidden, ""},
+		// The only VM the token opens.
+		{"/json/version", "scoped", http.StatusOK, "two-browser"},
+		{"/vm/vm1/json/list", "all", http.StatusOK, "one-page"},
+	} {
+		status, body := get(tc.path, tc.bearer)
+		if status != tc.status || !strings.Contains(body, tc.want) {
+			t.Errorf("GET %s with %q = %d %q, want %d with %q", tc.path, tc.bearer, status, body, tc.status, tc.want)
+		}
+	}
+
+	// WebSocket upgrades too, including to targets routed to another VM.
+	wsURL := testharness.WebSocketURL(proxy.URL)
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/devtools/page/one-page", http.StatusUnauthorized},
+		{"/devtools/page/one-page?token=scoped", http.StatusForbidden},
+		{"/vm/vm2/devtools/page/two-page?token=scoped", http.StatusSwitchingProtocols},
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL+tc.path, nil)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil || resp.StatusCode != tc.status {
+			t.Errorf("dial %s = %v, %v, want status %d", tc.path, resp, err, tc.status)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	scoped := &cdpGrant{vms: map[string]bool{"vm1": true, "vm2": true}}
+	if _, err := scoped.authorize(""); err == nil {
+		t.Errorf("token of two VMs authorized the first running VM")
+	}
+	if vm, err := scoped.authorize("vm2"); err != nil || vm != "vm2" {
+		t.Errorf("authorize(vm2) = %s, %v", vm, err)
+	}
+	var none *cdpGrant
+	if vm, err := none.authorize(""); err != nil || vm != "" {
+		t.Errorf("authorize without auth = %s, %v", vm, err)
+	}
+	if err := validateAuth(config.CDPAuthConfig{VMTokens: []config.VMTokenConfig{{Token: "t"}}}); err == nil {
+		t.Errorf("validateAuth accepted a VM token without VMs")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultDrainTimeout bounds how long active sessions may run on shutdown,
+// unless configured otherwise.
+const defaultDrainTimeout = 30 * time.Second
+
+// closeFrameTimeout bounds writing a close frame to a peer that may not be
+// reading anymore.
+const closeFrameTimeout = time.Second
+
+// drainCloseReason is sent to the clients whose sessions are closed when
+// draining, so that automation frameworks can tell a proxy rotation from a
+// crashed browser and reconnect.
+const drainCloseReason = "cdpserver draining"
+
+// closeWithFrame sends conn a close frame with code and text, then closes
+// it. The frame is best effort: the peer may already be gone.
+func closeWithFrame(conn *websocket.Conn, code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeFrameTimeout)); err != nil {
+		log.Debugf("Failed to send close frame to %s: %v", conn.RemoteAddr(), err)
+	}
+	conn.Close()
+}
+
+// muxClients tracks the client connections of the multiplexed sessions,
+// which aren't relayed to a single VM, to close them when draining.
+type muxClients struct {
+	mu    sync.Mutex
+	conns map[*websocket.Conn]struct{}
+}
+
+func newMuxClients() *muxClients {
+	return &muxClients{conns: make(map[*websocket.Conn]struct{})}
+}
+
+// track records conn until the returned func is called.
+func (m *muxClients) track(conn *websocket.Conn) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns[conn] = struct{}{}
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.conns, conn)
+	}
+}
+
+// closeAll closes the tracked connections with code and text, returning how
+// many. Their sessions detach their targets once closed.
+func (m *muxClients) closeAll(code int, text string) int {
+	m.mu.Lock()
+	conns := make([]*websocket.Conn, 0, len(m.conns))
+	for conn := range m.conns {
+		conns = append(conns, conn)
+	}
+	m.mu.Unlock()
+	for _, conn := range conns {
+		closeWithFrame(conn, code, text)
+	}
+	return len(conns)
+}
+
+// CloseSessions closes the DevTools sessions still active once a drain timed
+// out. Clients get a "going away" close frame and Chrome a normal one, rather
+// than connections torn down mid-message. Takeovers end first so that the
+// sessions they hold can finish.
+func (s *cdpServer) CloseSessions() int {
+	s.handoffs.resumeTakeovers(time.Now())
+	return s.routes.closeAll(websocket.CloseGoingAway, drainCloseReason) +
+		s.muxClients.closeAll(websocket.CloseGoingAway, drainCloseReason)
+}
+
+// drainTimeout returns how long active sessions may run on shutdown.
+func (s *cdpServer) drainTimeout() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cfg == nil || s.cfg.DrainTimeout <= 0 {
+		return defaultDrainTimeout
+	}
+	return s.cfg.DrainTimeout
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/admin"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestDrainClosesSessions(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{Multiplex: config.MultiplexConfig{Enabled: true}})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+	wsURL := testharness.WebSocketURL(proxy.URL)
+
+	direct, _, err := websocket.DefaultDialer.Dial(wsURL+"/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer direct.Close()
+	muxed, _, err := websocket.DefaultDialer.Dial(wsURL+"/mux", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muxed.Close()
+	// Both are tracked once upgraded, after the client saw the handshake.
+	muxClients := func() int {
+		s.muxClients.mu.Lock()
+		defer s.muxClients.mu.Unlock()
+		return len(s.muxClients.conns)
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.routes.connections("vm1") != 1 || muxClients() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions not tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if closed := admin.Drain(&s.sessions, s, 10*time.Millisecond); closed != 2 {
+		t.Errorf("Drain closed %d sessions, want 2", closed)
+	}
+	for name, conn := range map[string]*websocket.Conn{"direct": direct, "muxed": muxed} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != drainCloseReason {
+			t.Errorf("%s session ended with %v, want a going away close frame", name, err)
+		}
+	}
+	if active := s.sessions.Active(); active != 0 {
+		t.Errorf("%d sessions still active", active)
+	}
+
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL+"/devtools/page/fake-page", nil); err == nil {
+		t.Error("new session accepted while draining")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/metrics"
+	"github.com/abshkbh/arrakis/pkg/relay"
+	"github.com/abshkbh/arrakis/pkg/sink"
+)
+
+const defaultEventSubject = "arrakis.cdp.events"
+
+// Categories of the events forwarded to sinks.
+const (
+	eventConsole        = "console"
+	eventException      = "exception"
+	eventNetworkFailure = "network_failure"
+	eventSecurity       = "security"
+	// eventOther is the category of the methods configured by name.
+	eventOther = "other"
+)
+
+// eventCategories are the CDP methods of each category.
+var eventCategories = map[string][]string{
+	eventConsole:        {"Runtime.consoleAPICalled", "Log.entryAdded"},
+	eventException:      {"Runtime.exceptionThrown"},
+	eventNetworkFailure: {"Network.loadingFailed"},
+	eventSecurity:       {"Security.visibleSecurityStateChanged", "Security.securityStateChanged", "Security.certificateError"},
+}
+
+// eventCategory returns the category of a CDP method.
+func eventCategory(method string) string {
+	for category, methods := range eventCategories {
+		if slices.Contains(methods, method) {
+			return category
+		}
+	}
+	return eventOther
+}
+
+// cdpEvent is what sinks receive of an event a VM's browser sent.
+type cdpEvent struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	VM       string    `json:"vm"`
+	Target   string    `json:"target,omitempty"`
+	Category string    `json:"category"`
+	Method   string    `json:"method"`
+	// SessionID is the flattened session of the target that sent the event,
+	// e.g. of an iframe of the page.
+	SessionID string          `json:"sessionId,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+}
+
+// eventSink forwards the events of some methods and VMs to a sink.
+type eventSink struct {
+	name      string
+	methods   map[string]bool
+	vms       []string // Every VM's if empty
+	out       sink.Sink
+	opts      sink.ForwarderOptions
+	forwarder *sink.Forwarder // nil until started
+}
+
+func (e *eventSink) matches(vmName string, method string) bool {
+	return e.methods[method] && (len(e.vms) == 0 || slices.Contains(e.vms, vmName))
+}
+
+// compileEventSinks returns the sinks of cfgs, which don't forward until
+// started.
+func compileEventSinks(cfgs []config.CDPEventSinkConfig) ([]*eventSink, error) {
+	var sinks []*eventSink
+	names := make(map[string]bool)
+	for i, cfg := range cfgs {
+		name := cfg.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", cfg.Type, i)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("event_sinks[%d]: duplicate name %q", i, name)
+		}
+		names[name] = true
+		subject := cfg.Subject
+		if subject == "" {
+			subject = defaultEventSubject
+		}
+		out, err := sink.New(sink.Options{
+			Type:    cfg.Type,
+			URL:     cfg.URL,
+			Headers: cfg.Headers,
+			Topic:   cfg.Topic,
+			Subject: subject,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("event_sinks[%d]: %v", i, err)
+		}
+		events := cfg.Events
+		if len(events) == 0 {
+			events = []string{eventConsole, eventException, eventNetworkFailure, eventSecurity}
+		}
+		methods := make(map[string]bool)
+		for _, event := range events {
+			if categoryMethods, ok := eventCategories[event]; ok {
+				for _, method := range categoryMethods {
+					methods[method] = true
+				}
+				continue
+			}
+			domain, method, ok := strings.Cut(event, ".")
+			if !ok || domain == "" || method == "" || strings.ContainsAny(event, " \t\"") {
+				return nil, fmt.Errorf("event_sinks[%d]: unknown event %q, want a category or a CDP method", i, event)
+			}
+			methods[event] = true
+		}
+		sinks = append(sinks, &eventSink{
+			name:    name,
+			methods: methods,
+			vms:     cfg.VMs,
+			out:     out,
+			opts: sink.ForwarderOptions{
+				Name:          name,
+				BatchSize:     cfg.BatchSize,
+				FlushInterval: cfg.FlushInterval,
+				QueueSize:     cfg.QueueSize,
+			},
+		})
+	}
+	return sinks, nil
+}
+
+// validateEventSinks checks the config of the event sinks.
+func validateEventSinks(cfgs []config.CDPEventSinkConfig) error {
+	_, err := compileEventSinks(cfgs)
+	return err
+}
+
+// setEventSinks starts forwarding events to the sinks of cfgs, unless they
+// already do, and closes the sinks they replace in the background, after
+// sending the events queued for them. The caller must hold mu.
+func (s *cdpServer) setEventSinks(cfgs []config.CDPEventSinkConfig) {
+	if s.cfg != nil && reflect.DeepEqual(s.cfg.EventSinks, cfgs) {
+		return
+	}
+	// The sinks were validated with the config.
+	sinks, err := compileEventSinks(cfgs)
+	if err != nil {
+		log.WithError(err).Error("Invalid event sinks")
+	}
+	for _, es := range sinks {
+		es.forwarder = sink.NewForwarder(es.out, es.opts)
+	}
+	old := s.eventSinks
+	s.eventSinks = sinks
+	go closeEventSinks(old)
+}
+
+func closeEventSinks(sinks []*eventSink) {
+	for _, es := range sinks {
+		es.forwarder.Close()
+	}
+}
+
+// closeEventSinks sends the events queued for the sinks and closes them, on
+// shutdown.
+func (s *cdpServer) closeEventSinks() {
+	s.mu.Lock()
+	sinks := s.eventSinks
+	s.eventSinks = nil
+	s.mu.Unlock()
+	closeEventSinks(sinks)
+}
+
+// eventTap returns a tap forwarding the events the browser of vmName sends
+// over a session with target to the sinks configured for them. The sinks are
+// looked up for every event, so that sessions in progress follow reloads.
+func (s *cdpServer) eventTap(vmName string, target string) relay.Tap {
+	host, _ := os.Hostname()
+	return func(direction relay.Direction, messageType int, data []byte) {
+		if direction != relay.ToClient || messageType != websocket.TextMessage {
+			return
+		}
+		method, ok := eventMethod(data)
+		if !ok {
+			return
+		}
+		s.mu.RLock()
+		sinks, redactor := s.eventSinks, s.redactor
+		s.mu.RUnlock()
+
+		var value []byte
+		for _, es := range sinks {
+			if !es.matches(vmName, method) {
+				continue
+			}
+			if value == nil {
+				var msg struct {
+					Params    json.RawMessage `json:"params"`
+					SessionID string          `json:"sessionId"`
+				}
+				if err := json.Unmarshal(data, &msg); err != nil {
+					return
+				}
+				event, err := json.Marshal(cdpEvent{
+					Time:      time.Now().UTC(),
+					Host:      host,
+					VM:        vmName,
+					Target:    target,
+					Category:  eventCategory(method),
+					Method:    method,
+					SessionID: msg.SessionID,
+					Params:    msg.Params,
+				})
+				if err != nil {
+					return
+				}
+				value = redactor.Bytes(event)
+			}
+			es.forwarder.Forward(sink.Record{Key: vmName, Value: value})
+		}
+	}
+}
+
+// eventPrefix starts the events browsers send, which unlike the replies to
+// commands have no id.
+var eventPrefix = []byte(`{"method":"`)
+
+// eventMethod returns the method of a CDP event without decoding it.
+func eventMethod(data []byte) (string, bool) {
+	if !bytes.HasPrefix(data, eventPrefix) {
+		return "", false
+	}
+	rest := data[len(eventPrefix):]
+	end := bytes.IndexByte(rest, '"')
+	if end <= 0 {
+		return "", false
+	}
+	return string(rest[:end]), true
+}
+
+// eventSinkMetrics returns the counts of the events of each sink.
+func (s *cdpServer) eventSinkMetrics() []metrics.Gauge {
+	s.mu.RLock()
+	sinks := s.eventSinks
+	s.mu.RUnlock()
+	if len(sinks) == 0 {
+		return nil
+	}
+	forwarded := metrics.Gauge{
+		Name: "arrakis_cdp_event_sink_forwarded",
+		Help: "CDP events sent to the sink.",
+	}
+	dropped := metrics.Gauge{
+		Name: "arrakis_cdp_event_sink_dropped",
+		Help: "CDP events dropped because the sink's queue was full.",
+	}
+	failed := metrics.Gauge{
+		Name: "arrakis_cdp_event_sink_failed",
+		Help: "CDP events the sink failed to receive.",
+	}
+	for _, es := range sinks {
+		stats := es.forwarder.Stats()
+		labels := map[string]string{"sink": es.name}
+		forwarded.Samples = append(forwarded.Samples, metrics.Sample{Labels: labels, Value: float64(stats.Forwarded)})
+		dropped.Samples = append(dropped.Samples, metrics.Sample{Labels: labels, Value: float64(stats.Dropped)})
+		failed.Samples = append(failed.Samples, metrics.Sample{Labels: labels, Value: float64(stats.Failed)})
+	}
+	return []metrics.Gauge{forwarded, dropped, failed}
+}
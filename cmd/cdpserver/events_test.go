@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/metrics"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestEventSinks(t *testing.T) {
+	received := make(chan []cdpEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var events []cdpEvent
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		received <- events
+	}))
+	defer webhook.Close()
+
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{EventSinks: []config.CDPEventSinkConfig{
+		{
+			Name:          "monitoring",
+			Type:          "webhook",
+			URL:           webhook.URL,
+			Events:        []string{eventConsole, eventSecurity, "Page.javascriptDialogOpening"},
+			FlushInterval: 10 * time.Millisecond,
+		},
+		{
+			Type: "webhook",
+			URL:  webhook.URL,
+			VMs:  []string{"vm2"},
+		},
+	}})
+	defer s.closeEventSinks()
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The fake Chrome echoes the messages, as if its page sent them.
+	for _, msg := range []string{
+		`{"method":"Runtime.consoleAPICalled","params":{"type":"log","args":[{"type":"string","value":"hello"}]},"sessionId":"S1"}`,
+		`{"id":1,"result":{}}`,
+		`{"method":"Network.loadingFailed","params":{"requestId":"1","errorText":"net::ERR_FAILED"}}`,
+		`{"method":"Page.javascriptDialogOpening","params":{"message":"Authorization: Bearer s3cret"}}`,
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != msg {
+			t.Fatalf("received %q, %v, want %s", data, err, msg)
+		}
+	}
+
+	var events []cdpEvent
+	for deadline := time.After(5 * time.Second); len(events) < 2; {
+		select {
+		case batch := <-received:
+			events = append(events, batch...)
+		case <-deadline:
+			t.Fatalf("received %+v, want 2 events", events)
+		}
+	}
+	console, dialog := events[0], events[1]
+	if console.VM != "vm1" || console.Target != "fake-page" || console.Category != eventConsole ||
+		console.Method != "Runtime.consoleAPICalled" || console.SessionID != "S1" || console.Host == "" || console.Time.IsZero() {
+		t.Errorf("console event = %+v", console)
+	}
+	if dialog.Category != eventOther || dialog.Method != "Page.javascriptDialogOpening" {
+		t.Errorf("dialog event = %+v", dialog)
+	}
+	if string(dialog.Params) == `{"message":"Authorization: Bearer s3cret"}` {
+		t.Errorf("credentials forwarded: %s", dialog.Params)
+	}
+
+	// The batch is counted once the webhook answered.
+	var gauges []metrics.Gauge
+	var forwarded metrics.Gauge
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		gauges, _ = s.Metrics()
+		forwarded = gauges[len(gauges)-3]
+		if len(forwarded.Samples) == 2 && forwarded.Samples[0].Value == 2 {
+			break
+		}
+	}
+	if forwarded.Name != "arrakis_cdp_event_sink_forwarded" || len(forwarded.Samples) != 2 ||
+		forwarded.Samples[0].Labels["sink"] != "monitoring" || forwarded.Samples[0].Value != 2 ||
+		forwarded.Samples[1].Labels["sink"] != "webhook-1" || forwarded.Samples[1].Value != 0 {
+		t.Errorf("metrics = %+v", gauges)
+	}
+}
+
+func TestCompileEventSinks(t *testing.T) {
+	for name, cfgs := range map[string][]config.CDPEventSinkConfig{
+		"unknown type":     {{Type: "syslog", URL: "http://host"}},
+		"kafka sans topic": {{Type: "kafka", URL: "http://host"}},
+		"unknown event":    {{Type: "webhook", URL: "http://host", Events: []string{"crashes"}}},
+		"duplicate name":   {{Type: "webhook", URL: "http://a"}, {Name: "webhook-0", Type: "webhook", URL: "http://b"}},
+	} {
+		if err := validateEventSinks(cfgs); err == nil {
+			t.Errorf("%s: validated", name)
+		}
+	}
+
+	sinks, err := compileEventSinks([]config.CDPEventSinkConfig{{Type: "nats", URL: "nats://host:4222", Events: []string{eventNetworkFailure, "Inspector.targetCrashed"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sinks) != 1 || len(sinks[0].methods) != 2 || !sinks[0].matches("vm1", "Inspector.targetCrashed") || sinks[0].matches("vm1", "Runtime.consoleAPICalled") {
+		t.Errorf("sinks = %+v", sinks)
+	}
+
+	for data, want := range map[string]string{
+		`{"method":"Log.entryAdded","params":{}}`: "Log.entryAdded",
+		`{"id":1,"method":"Log.enable"}`:          "",
+		`{"method":""}`:                           "",
+	} {
+		if got, _ := eventMethod([]byte(data)); got != want {
+			t.Errorf("eventMethod(%s) = %q, want %q", data, got, want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fleetListTimeout bounds listing the targets of one browser for
+// /all/json/list, so that a hung Chrome doesn't hold up the whole fleet.
+const fleetListTimeout = 5 * time.Second
+
+// fleetTarget is a target listed by /all/json/list, along with the VM and
+// browser it belongs to.
+type fleetTarget struct {
+	devtoolsTarget
+	VM string `json:"vm"`
+	// Browser is "" for the VM's default browser.
+	Browser string `json:"browser,omitempty"`
+}
+
+// allListHandler serves GET /all/json/list, the targets of every browser of
+// every running VM the token opens, with their URLs rewritten to the paths of
+// their VM. VMs whose Chrome doesn't answer are left out rather than failing
+// the list.
+func (s *cdpServer) allListHandler(w http.ResponseWriter, r *http.Request) {
+	vms, err := s.lookupVMs("")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("503 Service Unavailable - %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	grant := grantFromContext(r.Context())
+	hostURL := r.Host
+	if hostURL == "" {
+		hostURL = fmt.Sprintf("localhost:%s", s.port)
+	}
+
+	type browser struct {
+		vm VM
+		id string
+	}
+	var browsers []browser
+	for _, vm := range vms.vms {
+		if vm.Status != "RUNNING" {
+			continue
+		}
+		if _, err := grant.authorize(vm.VMName); err != nil {
+			continue
+		}
+		for _, id := range vm.browsers() {
+			browsers = append(browsers, browser{vm: vm, id: id})
+		}
+	}
+
+	// Lists are merged in the order of the VMs and their browsers.
+	lists := make([][]fleetTarget, len(browsers))
+	var wg sync.WaitGroup
+	for i, b := range browsers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pf, _ := b.vm.browserPort(b.id)
+			ctx, cancel := context.WithTimeout(r.Context(), fleetListTimeout)
+			defer cancel()
+			targets, err := s.listTargets(r.WithContext(ctx), pf.HostPort, b.vm, b.id)
+			if err != nil {
+				log.Warnf("Leaving VM '%s' out of /all/json/list, failed to list its targets: %v", b.vm.VMName, err)
+				return
+			}
+			rewriter := urlRewriter{scheme: wsScheme(r), host: hostURL, vmName: b.vm.VMName, browserID: b.id}
+			for _, target := range targets {
+				target.WebSocketDebuggerURL = rewriter.webSocketURL(target.WebSocketDebuggerURL)
+				target.DevtoolsFrontendURL = rewriter.frontendURL(target.DevtoolsFrontendURL)
+				lists[i] = append(lists[i], fleetTarget{devtoolsTarget: target, VM: b.vm.VMName, Browser: b.id})
+			}
+		}()
+	}
+	wg.Wait()
+
+	all := []fleetTarget{}
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	body, err := encodeJSON(all)
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestAllJSONList(t *testing.T) {
+	chrome1 := testharness.NewFakeChromeWithTarget("one")
+	defer chrome1.Close()
+	chrome2 := testharness.NewFakeChromeWithTarget("two")
+	defer chrome2.Close()
+	down := testharness.NewStoppedFakeChrome()
+	defer down.Close()
+	stopped := testharness.RunningVM("stopped", chrome1)
+	stopped.Status = "STOPPED"
+	proxy, _ := newTestProxy(t, testharness.RunningVM("vm1", chrome1), testharness.RunningVM("vm2", chrome2),
+		testharness.RunningVM("vm3", down), stopped)
+
+	resp, err := http.Get(proxy.URL + "/all/json/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var targets []fleetTarget
+	if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(targets) != 2 {
+		t.Fatalf("GET /all/json/list = %d %+v, want the targets of vm1 and vm2", resp.StatusCode, targets)
+	}
+	for i, want := range []struct{ vm, id string }{{"vm1", "one-page"}, {"vm2", "two-page"}} {
+		target := targets[i]
+		if target.VM != want.vm || target.ID != want.id {
+			t.Errorf("target %d = %s/%s, want %s/%s", i, target.VM, target.ID, want.vm, want.id)
+		}
+		if !strings.HasPrefix(target.WebSocketDebuggerURL, testharness.WebSocketURL(proxy.URL)+"/vm/"+want.vm+"/devtools/") {
+			t.Errorf("target %d is not on the path of %s: %s", i, want.vm, target.WebSocketDebuggerURL)
+		}
+	}
+
+	// Targets listed are routed back to their VM.
+	resp, err = http.Get(proxy.URL + "/devtools/page/two-page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if path, _ := chrome2.LastRequest(); path != "/devtools/page/two-page" {
+		t.Errorf("vm2's Chrome last got %q, want the page it listed", path)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultHandoffTTL is how long a session stays parked unless configured
+// otherwise.
+const defaultHandoffTTL = time.Hour
+
+// States of a parked session. Takeovers are paused rather than parked.
+const (
+	handoffParked  = "parked"
+	handoffPaused  = "paused"
+	handoffResumed = "resumed"
+)
+
+// Modes of a takeover, for the commands the VM's DevTools clients send while
+// it lasts.
+const (
+	// takeoverBuffer holds the commands until the session is resumed.
+	takeoverBuffer = "buffer"
+	// takeoverReject answers the commands with an error.
+	takeoverReject = "reject"
+)
+
+var (
+	errHandoffNotFound = errors.New("session not found")
+	errHandoffResumed  = errors.New("session was already resumed")
+)
+
+// handoffTarget is a DevTools target of a parked session.
+type handoffTarget struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+	// WebSocketDebuggerURL is on the proxy, on the path of the session's VM
+	// and browser.
+	WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+
+	// devtoolsPath is the target's path on Chrome.
+	devtoolsPath string
+}
+
+// handoffSession is a browser session a DevTools client parked, its targets
+// kept alive and out of reach of other clients, until another client resumes
+// it with its handle, e.g. a human taking over from an agent stuck on a
+// CAPTCHA.
+type handoffSession struct {
+	Handle  string `json:"handle"`
+	VM      string `json:"vm"`
+	Browser string `json:"browser,omitempty"`
+	// Label and Metadata describe the state the session was parked in, for
+	// whoever resumes it.
+	Label     string            `json:"label,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Targets   []handoffTarget   `json:"targets"`
+	State     string            `json:"state"`
+	ParkedAt  time.Time         `json:"parkedAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+	ResumedAt *time.Time        `json:"resumedAt,omitempty"`
+	// Takeover is the mode of a session pausing the VM's DevTools clients
+	// while a human drives the browser over VNC, "" for parked sessions.
+	// The clients stay connected and pick up where they left off once it is
+	// resumed.
+	Takeover string `json:"takeover,omitempty"`
+
+	// released is closed once a takeover ends.
+	released chan struct{}
+}
+
+// parkRequest is the body of POST /v1/cdp/sessions.
+type parkRequest struct {
+	VM       string            `json:"vm"`
+	Browser  string            `json:"browser,omitempty"`
+	Label    string            `json:"label,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Targets are the IDs of the targets to park, every page of the
+	// browser if empty.
+	Targets []string `json:"targets,omitempty"`
+	// Takeover, "buffer" or "reject", pauses the clients of the VM instead
+	// of parking targets.
+	Takeover string `json:"takeover,omitempty"`
+}
+
+// handoffs are the sessions parked and resumed, kept until they expire.
+type handoffs struct {
+	mu        sync.Mutex
+	sessions  map[string]*handoffSession // By handle
+	parked    map[string]string          // Handle by parked target ID
+	takeovers map[string]string          // Handle by VM taken over
+}
+
+func newHandoffs() *handoffs {
+	return &handoffs{
+		sessions:  make(map[string]*handoffSession),
+		parked:    make(map[string]string),
+		takeovers: make(map[string]string),
+	}
+}
+
+// expire drops the sessions that expired, releasing their targets. The
+// caller must hold mu.
+func (h *handoffs) expire(now time.Time) {
+	for handle, sess := range h.sessions {
+		if now.Before(sess.ExpiresAt) {
+			continue
+		}
+		if sess.State == handoffParked {
+			log.Infof("Parked session %q of VM %s expired, releasing its targets", sess.Label, sess.VM)
+		} else if sess.State == handoffPaused {
+			log.Infof("Takeover %q of VM %s expired, resuming its clients", sess.Label, sess.VM)
+		}
+		h.release(sess)
+		delete(h.sessions, handle)
+	}
+}
+
+// release makes the targets of sess reachable again, or ends its takeover.
+// The caller must hold mu.
+func (h *handoffs) release(sess *handoffSession) {
+	for _, t := range sess.Targets {
+		if h.parked[t.ID] == sess.Handle {
+			delete(h.parked, t.ID)
+		}
+	}
+	if sess.Takeover != "" && h.takeovers[sess.VM] == sess.Handle {
+		delete(h.takeovers, sess.VM)
+		close(sess.released)
+	}
+}
+
+// park records sess as parked, or paused if it is a takeover, under a new
+// handle. Targets can only be parked in one session at a time, and VMs taken
+// over by one.
+func (h *handoffs) park(sess handoffSession, now time.Time) (handoffSession, error) {
+	handle := make([]byte, 16)
+	if _, err := rand.Read(handle); err != nil {
+		return handoffSession{}, err
+	}
+	sess.Handle = hex.EncodeToString(handle)
+	sess.State = handoffParked
+	sess.ParkedAt = now
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now)
+	if sess.Takeover != "" {
+		if other, ok := h.takeovers[sess.VM]; ok {
+			return handoffSession{}, fmt.Errorf("VM %s is already taken over in session %q", sess.VM, h.sessions[other].Label)
+		}
+		sess.State = handoffPaused
+		sess.released = make(chan struct{})
+		h.takeovers[sess.VM] = sess.Handle
+		h.sessions[sess.Handle] = &sess
+		return sess, nil
+	}
+	for _, t := range sess.Targets {
+		if other, ok := h.parked[t.ID]; ok {
+			return handoffSession{}, fmt.Errorf("target %s is already parked in session %q", t.ID, h.sessions[other].Label)
+		}
+	}
+	for _, t := range sess.Targets {
+		h.parked[t.ID] = sess.Handle
+	}
+	h.sessions[sess.Handle] = &sess
+	return sess, nil
+}
+
+// get returns the session of handle.
+func (h *handoffs) get(handle string, now time.Time) (handoffSession, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now)
+	sess, ok := h.sessions[handle]
+	if !ok {
+		return handoffSession{}, false
+	}
+	return *sess, true
+}
+
+// list returns the sessions, oldest first.
+func (h *handoffs) list(now time.Time) []handoffSession {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now)
+	sessions := make([]handoffSession, 0, len(h.sessions))
+	for _, sess := range h.sessions {
+		sessions = append(sessions, *sess)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ParkedAt.Before(sessions[j].ParkedAt) })
+	return sessions
+}
+
+// resume releases the targets of the parked session of handle for the
+// client resuming it, or the clients paused by a takeover. A session is only
+// resumed once.
+func (h *handoffs) resume(handle string, now time.Time) (handoffSession, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now)
+	sess, ok := h.sessions[handle]
+	if !ok {
+		return handoffSession{}, errHandoffNotFound
+	}
+	if sess.State == handoffResumed {
+		return *sess, errHandoffResumed
+	}
+	h.release(sess)
+	sess.State = handoffResumed
+	sess.ResumedAt = &now
+	return *sess, nil
+}
+
+// discard drops the session of handle, releasing its targets.
+func (h *handoffs) discard(handle string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sess, ok := h.sessions[handle]
+	if ok {
+		h.release(sess)
+		delete(h.sessions, handle)
+	}
+	return ok
+}
+
+// parkedIn returns the session the target of a DevTools path is parked in.
+func (h *handoffs) parkedIn(devtoolsPath string, now time.Time) (handoffSession, bool) {
+	id := targetID(devtoolsPath)
+	if id == "" {
+		return handoffSession{}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now)
+	handle, ok := h.parked[id]
+	if !ok {
+		return handoffSession{}, false
+	}
+	return *h.sessions[handle], true
+}
+
+// takenOver returns the takeover in progress of vm.
+func (h *handoffs) takenOver(vm string, now time.Time) (handoffSession, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now)
+	handle, ok := h.takeovers[vm]
+	if !ok {
+		return handoffSession{}, false
+	}
+	return *h.sessions[handle], true
+}
+
+// resumeTakeovers ends every takeover, e.g. so that the clients they hold
+// can be closed when draining.
+func (h *handoffs) resumeTakeovers(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, handle := range h.takeovers {
+		sess := h.sessions[handle]
+		h.release(sess)
+		sess.State = handoffResumed
+		sess.ResumedAt = &now
+	}
+}
+
+// handoffTTL returns how long sessions stay parked.
+func (s *cdpServer) handoffTTL() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cfg == nil || s.cfg.Handoff.TTL <= 0 {
+		return defaultHandoffTTL
+	}
+	return s.cfg.Handoff.TTL
+}
+
+// sessionView returns sess with the WebSocket URLs of its targets on the
+// proxy as r reached it.
+func sessionView(sess handoffSession, r *http.Request) handoffSession {
+	rewriter := urlRewriter{scheme: wsScheme(r), host: r.Host, vmName: sess.VM, browserID: sess.Browser}
+	targets := make([]handoffTarget, len(sess.Targets))
+	for i, t := range sess.Targets {
+		t.WebSocketDebuggerURL = rewriter.webSocketURL("ws://127.0.0.1" + t.devtoolsPath)
+		targets[i] = t
+	}
+	sess.Targets = targets
+	return sess
+}
+
+func writeSession(w http.ResponseWriter, r *http.Request, statusCode int, sess handoffSession) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(sessionView(sess, r))
+}
+
+// parkHandler serves POST /v1/cdp/sessions, parking targets of a VM's
+// browser. Connections already relayed to them are closed, and new ones
+// refused until the session is resumed.
+func (s *cdpServer) parkHandler(w http.ResponseWriter, r *http.Request) {
+	var req parkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("400 Bad Request - invalid session: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Takeover != "" && req.Takeover != takeoverBuffer && req.Takeover != takeoverReject {
+		http.Error(w, fmt.Sprintf("400 Bad Request - takeover must be %s or %s", takeoverBuffer, takeoverReject), http.StatusBadRequest)
+		return
+	}
+	vmName, err := grantFromContext(r.Context()).authorize(req.VM)
+	if err != nil {
+		http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
+		return
+	}
+	hostPort, vm, err := s.discoverCDPPort(vmName, req.Browser)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("503 Service Unavailable - %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	if req.Takeover != "" {
+		s.takeOver(w, r, req, vm)
+		return
+	}
+
+	listed, err := s.listTargets(r, hostPort, vm, req.Browser)
+	if err != nil {
+		log.Errorf("Failed to list the targets of VM %s to park: %v", vm.VMName, err)
+		s.chromeUnavailable(w, r, vm, req.Browser, err)
+		return
+	}
+	sess := handoffSession{
+		VM:        vm.VMName,
+		Browser:   req.Browser,
+		Label:     req.Label,
+		Metadata:  req.Metadata,
+		Targets:   []handoffTarget{},
+		ExpiresAt: time.Now().Add(s.handoffTTL()),
+	}
+	wanted := make(map[string]bool)
+	for _, id := range req.Targets {
+		wanted[id] = true
+	}
+	for _, t := range listed {
+		if (len(wanted) == 0 && t.Type == "page") || wanted[t.ID] {
+			// Chrome doesn't list the URL of targets a client is attached
+			// to, which are served on /devtools/page/ as well.
+			devtoolsPath := "/devtools/page/" + t.ID
+			if u, err := url.Parse(t.WebSocketDebuggerURL); err == nil && strings.HasPrefix(u.Path, "/devtools/") {
+				devtoolsPath = u.Path
+			}
+			sess.Targets = append(sess.Targets, handoffTarget{ID: t.ID, Type: t.Type, Title: t.Title, URL: t.URL, devtoolsPath: devtoolsPath})
+			delete(wanted, t.ID)
+		}
+	}
+	if len(wanted) > 0 {
+		missing := make([]string, 0, len(wanted))
+		for id := range wanted {
+			missing = append(missing, id)
+		}
+		sort.Strings(missing)
+		http.Error(w, fmt.Sprintf("400 Bad Request - no such targets: %v", missing), http.StatusBadRequest)
+		return
+	}
+	if len(sess.Targets) == 0 {
+		http.Error(w, "400 Bad Request - no targets to park", http.StatusBadRequest)
+		return
+	}
+
+	sess, err = s.handoffs.park(sess, time.Now())
+	if err != nil {
+		http.Error(w, "409 Conflict - "+err.Error(), http.StatusConflict)
+		return
+	}
+	ids := make(map[string]bool)
+	for _, t := range sess.Targets {
+		ids[t.ID] = true
+	}
+	closed := s.routes.closeTargets(vm.VMName, ids)
+	log.Infof("Parked %d targets of VM %s as %q for %s, closed %d connections", len(sess.Targets), vm.VMName, sess.Label, r.RemoteAddr, closed)
+	writeSession(w, r, http.StatusCreated, sess)
+}
+
+// listTargets returns the targets the browser browserID of vm lists, which
+// are also learnt as routes.
+func (s *cdpServer) listTargets(r *http.Request, hostPort string, vm VM, browserID string) ([]devtoolsTarget, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, fmt.Sprintf("http://127.0.0.1:%s/json/list", hostPort), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing targets failed with status %d", resp.StatusCode)
+	}
+	var targets []devtoolsTarget
+	if err := json.Unmarshal(body, &targets); err != nil {
+		return nil, err
+	}
+	s.routes.learn(vm.VMName, browserID, "/json/list", body)
+	return targets, nil
+}
+
+// sessionsHandler serves GET /v1/cdp/sessions, the sessions parked and
+// resumed, of one VM with ?vm=<name>.
+func (s *cdpServer) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	grant := grantFromContext(r.Context())
+	vmName := r.URL.Query().Get("vm")
+	if vmName != "" {
+		if _, err := grant.authorize(vmName); err != nil {
+			http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	sessions := []handoffSession{}
+	for _, sess := range s.handoffs.list(time.Now()) {
+		if _, err := grant.authorize(sess.VM); err != nil || (vmName != "" && sess.VM != vmName) {
+			continue
+		}
+		sessions = append(sessions, sessionView(sess, r))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Sessions []handoffSession `json:"sessions"`
+	}{sessions})
+}
+
+// authorizedSession returns the session of the request's handle, answering
+// the request itself if there is none or its token doesn't open the
+// session's VM.
+func (s *cdpServer) authorizedSession(w http.ResponseWriter, r *http.Request) (handoffSession, bool) {
+	sess, ok := s.handoffs.get(mux.Vars(r)["handle"], time.Now())
+	if !ok {
+		http.Error(w, "404 Not Found - "+errHandoffNotFound.Error(), http.StatusNotFound)
+		return handoffSession{}, false
+	}
+	if _, err := grantFromContext(r.Context()).authorize(sess.VM); err != nil {
+		http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
+		return handoffSession{}, false
+	}
+	return sess, true
+}
+
+// sessionHandler serves GET /v1/cdp/sessions/{handle}.
+func (s *cdpServer) sessionHandler(w http.ResponseWriter, r *http.Request) {
+	if sess, ok := s.authorizedSession(w, r); ok {
+		writeSession(w, r, http.StatusOK, sess)
+	}
+}
+
+// resumeHandler serves POST /v1/cdp/sessions/{handle}/resume, handing the
+// targets of a parked session to the client resuming it.
+func (s *cdpServer) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.authorizedSession(w, r)
+	if !ok {
+		return
+	}
+	sess, err := s.handoffs.resume(sess.Handle, time.Now())
+	switch {
+	case errors.Is(err, errHandoffNotFound):
+		http.Error(w, "404 Not Found - "+err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errHandoffResumed):
+		http.Error(w, "409 Conflict - "+err.Error(), http.StatusConflict)
+		return
+	}
+	log.Infof("Resumed session %q of VM %s for %s", sess.Label, sess.VM, r.RemoteAddr)
+	writeSession(w, r, http.StatusOK, sess)
+}
+
+// discardSessionHandler serves DELETE /v1/cdp/sessions/{handle}, releasing
+// the targets of a session nobody is going to resume.
+func (s *cdpServer) discardSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.authorizedSession(w, r)
+	if !ok {
+		return
+	}
+	s.handoffs.discard(sess.Handle)
+	w.WriteHeader(http.StatusNoContent)
+}
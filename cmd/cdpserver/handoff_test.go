@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func postSession(t *testing.T, target string, body string) (*http.Response, handoffSession) {
+	t.Helper()
+	resp, err := http.Post(target, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var sess handoffSession
+	if resp.StatusCode < http.StatusBadRequest {
+		if err := json.NewDecoder(resp.Body).Decode(&sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp, sess
+}
+
+func TestSessionHandoff(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	proxy, _ := newTestProxy(t, testharness.RunningVM("vm1", chrome))
+	wsURL := testharness.WebSocketURL(proxy.URL)
+
+	// The agent drives the page until it parks it.
+	agent, _, err := websocket.DefaultDialer.Dial(wsURL+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	resp, parked := postSession(t, proxy.URL+"/v1/cdp/sessions", `{"vm":"vm1","label":"captcha","metadata":{"step":"login"}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("park = %d", resp.StatusCode)
+	}
+	if parked.Handle == "" || parked.State != handoffParked || parked.Label != "captcha" || parked.Metadata["step"] != "login" {
+		t.Errorf("parked = %+v", parked)
+	}
+	if len(parked.Targets) != 1 || parked.Targets[0].ID != "fake-page" {
+		t.Fatalf("targets = %+v, want the page", parked.Targets)
+	}
+	if want := wsURL + "/vm/vm1/devtools/page/fake-page"; parked.Targets[0].WebSocketDebuggerURL != want {
+		t.Errorf("webSocketDebuggerUrl = %q, want %q", parked.Targets[0].WebSocketDebuggerURL, want)
+	}
+
+	agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := agent.ReadMessage(); err == nil {
+		t.Error("connection of the agent left open once parked")
+	}
+	_, dialResp, err := websocket.DefaultDialer.Dial(wsURL+"/devtools/page/fake-page", nil)
+	if err == nil || dialResp == nil || dialResp.StatusCode != http.StatusLocked {
+		t.Fatalf("dial of a parked target = %v, %v, want 423", dialResp, err)
+	}
+	if resp, _ := postSession(t, proxy.URL+"/v1/cdp/sessions", `{"vm":"vm1","targets":["fake-page"]}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("parking again = %d, want 409", resp.StatusCode)
+	}
+
+	listResp, err := http.Get(proxy.URL + "/v1/cdp/sessions?vm=vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		Sessions []handoffSession `json:"sessions"`
+	}
+	json.NewDecoder(listResp.Body).Decode(&list)
+	listResp.Body.Close()
+	if len(list.Sessions) != 1 || list.Sessions[0].Handle != parked.Handle {
+		t.Errorf("sessions = %+v", list.Sessions)
+	}
+
+	resp, resumed := postSession(t, proxy.URL+"/v1/cdp/sessions/"+parked.Handle+"/resume", "")
+	if resp.StatusCode != http.StatusOK || resumed.State != handoffResumed || resumed.ResumedAt == nil {
+		t.Fatalf("resume = %d %+v", resp.StatusCode, resumed)
+	}
+	if resp, _ := postSession(t, proxy.URL+"/v1/cdp/sessions/"+parked.Handle+"/resume", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("resuming again = %d, want 409", resp.StatusCode)
+	}
+
+	human, _, err := websocket.DefaultDialer.Dial(resumed.Targets[0].WebSocketDebuggerURL, nil)
+	if err != nil {
+		t.Fatalf("dial of a resumed target: %v", err)
+	}
+	human.Close()
+}
+
+func TestParkRejects(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	proxy, _ := newTestProxy(t, testharness.RunningVM("vm1", chrome))
+
+	for body, want := range map[string]int{
+		`{"vm":"vm1","targets":["nope"]}`: http.StatusBadRequest,
+		`{"vm":"vm2"}`:                    http.StatusServiceUnavailable,
+		`not json`:                        http.StatusBadRequest,
+	} {
+		if resp, _ := postSession(t, proxy.URL+"/v1/cdp/sessions", body); resp.StatusCode != want {
+			t.Errorf("park %s = %d, want %d", body, resp.StatusCode, want)
+		}
+	}
+	if resp, _ := postSession(t, proxy.URL+"/v1/cdp/sessions/nope/resume", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("resume of an unknown session = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestHandoffsExpire(t *testing.T) {
+	h := newHandoffs()
+	now := time.Now()
+	sess, err := h.park(handoffSession{
+		VM:        "vm1",
+		Targets:   []handoffTarget{{ID: "page1"}},
+		ExpiresAt: now.Add(time.Minute),
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.parkedIn("/devtools/page/page1", now); !ok {
+		t.Fatal("target not parked")
+	}
+	if _, ok := h.parkedIn("/devtools/page/page1", now.Add(time.Minute)); ok {
+		t.Error("target still parked once expired")
+	}
+	if _, ok := h.get(sess.Handle, now.Add(time.Minute)); ok {
+		t.Error("expired session kept")
+	}
+}
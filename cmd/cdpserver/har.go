@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/relay"
+	"github.com/abshkbh/arrakis/pkg/version"
+)
+
+const (
+	defaultHARMaxEntries = 10000
+	defaultHARTTL        = time.Hour
+	// harCommandIDBase is the id of the first Network.enable a capture
+	// sends, above the ids of the latency probes.
+	harCommandIDBase = 3 << 29
+	// harSessionHeader tells the client of a captured session its ID.
+	harSessionHeader = "X-Arrakis-Session-Id"
+)
+
+// harTargetTypes are the types of the targets whose requests are captured
+// once a client of the browser attaches to them.
+var harTargetTypes = map[string]bool{
+	"page":           true,
+	"iframe":         true,
+	"worker":         true,
+	"shared_worker":  true,
+	"service_worker": true,
+}
+
+// harNameValue is a header or query parameter of a HAR entry.
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// harTimings are in milliseconds. Chrome's Network events don't tell the
+// phases of sending a request apart, so they are all counted as waiting.
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harEntry is a request of a captured session, in HAR 1.2.
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	// ResourceType is Chrome's, e.g. "Document" or "XHR".
+	ResourceType string `json:"_resourceType,omitempty"`
+	// Error is why the request failed, e.g. "net::ERR_NAME_NOT_RESOLVED".
+	Error string `json:"_error,omitempty"`
+}
+
+// har is the HAR file of a captured session.
+type har struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Comment string      `json:"comment,omitempty"`
+		Entries []*harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+// Params of the Network events a capture reads.
+type (
+	cdpNetworkResponse struct {
+		URL               string            `json:"url"`
+		Status            int               `json:"status"`
+		StatusText        string            `json:"statusText"`
+		Headers           map[string]string `json:"headers"`
+		MimeType          string            `json:"mimeType"`
+		RemoteIPAddress   string            `json:"remoteIPAddress"`
+		Protocol          string            `json:"protocol"`
+		EncodedDataLength float64           `json:"encodedDataLength"`
+	}
+	cdpRequestWillBeSent struct {
+		RequestID string `json:"requestId"`
+		Request   struct {
+			URL         string            `json:"url"`
+			URLFragment string            `json:"urlFragment"`
+			Method      string            `json:"method"`
+			Headers     map[string]string `json:"headers"`
+			PostData    string            `json:"postData"`
+		} `json:"request"`
+		Timestamp        float64             `json:"timestamp"`
+		WallTime         float64             `json:"wallTime"`
+		Type             string              `json:"type"`
+		RedirectResponse *cdpNetworkResponse `json:"redirectResponse"`
+	}
+	cdpResponseReceived struct {
+		RequestID string             `json:"requestId"`
+		Timestamp float64            `json:"timestamp"`
+		Response  cdpNetworkResponse `json:"response"`
+	}
+	cdpLoadingFinished struct {
+		RequestID         string  `json:"requestId"`
+		Timestamp         float64 `json:"timestamp"`
+		EncodedDataLength float64 `json:"encodedDataLength"`
+	}
+	cdpLoadingFailed struct {
+		RequestID string  `json:"requestId"`
+		Timestamp float64 `json:"timestamp"`
+		ErrorText string  `json:"errorText"`
+	}
+	cdpAttachedToTarget struct {
+		SessionID  string `json:"sessionId"`
+		TargetInfo struct {
+			Type string `json:"type"`
+		} `json:"targetInfo"`
+	}
+)
+
+// harRequestState is a request whose entry is still being filled in.
+type harRequestState struct {
+	entry *harEntry
+	// Chrome's monotonic timestamps, in seconds.
+	started   float64
+	responded float64
+}
+
+// harSession describes a captured session.
+type harSession struct {
+	ID string `json:"id"`
+	VM string `json:"vm"`
+	// Target is the DevTools target the client connected to.
+	Target  string     `json:"target,omitempty"`
+	Remote  string     `json:"remote"`
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"`
+	Entries int        `json:"entries"`
+	// Dropped are the requests over the max_entries of the session.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// harCapture assembles the HAR of a session from the Network events of its
+// targets: it enables the Network domain on the page the client connected
+// to, or on the targets a client of the browser attaches to, and records
+// the requests of every event, which the client still receives.
+type harCapture struct {
+	session    harSession
+	page       bool // Whether the client connected to a page
+	maxEntries int
+	// attached are the sessions of the targets to enable the Network domain
+	// on, sent by Consume to Run.
+	attached chan string
+
+	mu      sync.Mutex
+	sent    int
+	entries []*harEntry
+	pending map[string]*harRequestState // By session and request ID
+}
+
+// Run enables the Network domain on the page of the session, then on every
+// target attached to.
+func (c *harCapture) Run(send func(messageType int, data []byte) error, stop <-chan struct{}) {
+	if c.page && c.enableNetwork(send, "") != nil {
+		return
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case sessionID := <-c.attached:
+			if c.enableNetwork(send, sessionID) != nil {
+				return
+			}
+		}
+	}
+}
+
+// enableNetwork sends Network.enable to the target of sessionID, the page
+// of the connection if empty.
+func (c *harCapture) enableNetwork(send func(messageType int, data []byte) error, sessionID string) error {
+	c.mu.Lock()
+	cmd := map[string]any{"id": harCommandIDBase + c.sent, "method": "Network.enable"}
+	c.sent++
+	c.mu.Unlock()
+	if sessionID != "" {
+		cmd["sessionId"] = sessionID
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return send(websocket.TextMessage, data)
+}
+
+// Consume swallows the replies to the capture's Network.enable and records
+// the Network events, passing them on.
+func (c *harCapture) Consume(messageType int, data []byte) bool {
+	if id, ok := replyID(data); ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return id >= harCommandIDBase && id < harCommandIDBase+c.sent
+	}
+	if !bytes.Contains(data, []byte(`"method":"Network.`)) && !bytes.Contains(data, []byte(`"method":"Target.attachedToTarget"`)) {
+		return false
+	}
+	var event struct {
+		Method    string          `json:"method"`
+		Params    json.RawMessage `json:"params"`
+		SessionID string          `json:"sessionId"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return false
+	}
+	c.observe(event.Method, event.Params, event.SessionID)
+	return false
+}
+
+// Relayed is a no-op, the capture only reads upstream's messages.
+func (c *harCapture) Relayed(time.Duration) {}
+
+// observe records a Network event of the target of sessionID.
+func (c *harCapture) observe(method string, params json.RawMessage, sessionID string) {
+	switch method {
+	case "Target.attachedToTarget":
+		var p cdpAttachedToTarget
+		if json.Unmarshal(params, &p) != nil || p.SessionID == "" || !harTargetTypes[p.TargetInfo.Type] {
+			return
+		}
+		select {
+		case c.attached <- p.SessionID:
+		default:
+			log.Warnf("Not capturing the requests of target session %s of VM %s: too many attached at once", p.SessionID, c.session.VM)
+		}
+	case "Network.requestWillBeSent":
+		var p cdpRequestWillBeSent
+		if json.Unmarshal(params, &p) == nil {
+			c.requestWillBeSent(sessionID, p)
+		}
+	case "Network.responseReceived":
+		var p cdpResponseReceived
+		if json.Unmarshal(params, &p) != nil {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if state, ok := c.pending[sessionID+"/"+p.RequestID]; ok {
+			state.responded = p.Timestamp
+			state.entry.Response = harResponseOf(p.Response)
+			state.entry.Request.HTTPVersion = p.Response.Protocol
+			state.entry.ServerIPAddress = strings.Trim(p.Response.RemoteIPAddress, "[]")
+		}
+	case "Network.loadingFinished":
+		var p cdpLoadingFinished
+		if json.Unmarshal(params, &p) != nil {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if state, ok := c.pending[sessionID+"/"+p.RequestID]; ok {
+			state.entry.Response.BodySize = int64(p.EncodedDataLength)
+			state.entry.Response.Content.Size = int64(p.EncodedDataLength)
+			c.finish(sessionID+"/"+p.RequestID, state, p.Timestamp)
+		}
+	case "Network.loadingFailed":
+		var p cdpLoadingFailed
+		if json.Unmarshal(params, &p) != nil {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if state, ok := c.pending[sessionID+"/"+p.RequestID]; ok {
+			state.entry.Error = p.ErrorText
+			c.finish(sessionID+"/"+p.RequestID, state, p.Timestamp)
+		}
+	}
+}
+
+// requestWillBeSent adds the entry of a request, completing that of the
+// request it was redirected from.
+func (c *harCapture) requestWillBeSent(sessionID string, p cdpRequestWillBeSent) {
+	key := sessionID + "/" + p.RequestID
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state, ok := c.pending[key]; ok && p.RedirectResponse != nil {
+		state.responded = p.Timestamp
+		state.entry.Response = harResponseOf(*p.RedirectResponse)
+		state.entry.Response.RedirectURL = p.Request.URL
+		state.entry.Request.HTTPVersion = p.RedirectResponse.Protocol
+		state.entry.ServerIPAddress = strings.Trim(p.RedirectResponse.RemoteIPAddress, "[]")
+		c.finish(key, state, p.Timestamp)
+	}
+	if len(c.entries) >= c.maxEntries {
+		c.session.Dropped++
+		return
+	}
+
+	started := time.UnixMicro(int64(p.WallTime * 1e6)).UTC()
+	entry := &harEntry{
+		StartedDateTime: started.Format("2006-01-02T15:04:05.000Z07:00"),
+		Request: harRequest{
+			Method:      p.Request.Method,
+			URL:         p.Request.URL + p.Request.URLFragment,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(p.Request.Headers),
+			QueryString: harQueryString(p.Request.URL),
+			HeadersSize: -1,
+			BodySize:    len(p.Request.PostData),
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		ResourceType: p.Type,
+	}
+	if p.Request.PostData != "" {
+		entry.Request.PostData = &harPostData{MimeType: p.Request.Headers["Content-Type"], Text: p.Request.PostData}
+	}
+	c.entries = append(c.entries, entry)
+	c.pending[key] = &harRequestState{entry: entry, started: p.Timestamp}
+}
+
+// finish sets the timings of the request of key, which ended at timestamp.
+// The caller must hold mu.
+func (c *harCapture) finish(key string, state *harRequestState, timestamp float64) {
+	delete(c.pending, key)
+	responded := state.responded
+	if responded == 0 {
+		responded = timestamp
+	}
+	state.entry.Timings = harTimings{
+		Wait:    max(0, (responded-state.started)*1000),
+		Receive: max(0, (timestamp-responded)*1000),
+	}
+	state.entry.Time = state.entry.Timings.Wait + state.entry.Timings.Receive
+}
+
+// ended marks the session as over.
+func (c *harCapture) ended(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.session.End = &now
+}
+
+// view returns the description of the session.
+func (c *harCapture) view() harSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	session := c.session
+	session.Entries = len(c.entries)
+	return session
+}
+
+// har returns the HAR of the requests captured so far.
+func (c *harCapture) har() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var h har
+	h.Log.Version = "1.2"
+	h.Log.Creator.Name = "arrakis-cdpserver"
+	h.Log.Creator.Version = version.Version
+	h.Log.Entries = c.entries
+	if h.Log.Entries == nil {
+		h.Log.Entries = []*harEntry{}
+	}
+	if c.session.Dropped > 0 {
+		h.Log.Comment = strconv.Itoa(c.session.Dropped) + " requests over max_entries were dropped"
+	}
+	return json.Marshal(h)
+}
+
+func harResponseOf(r cdpNetworkResponse) harResponse {
+	return harResponse{
+		Status:      r.Status,
+		StatusText:  r.StatusText,
+		HTTPVersion: r.Protocol,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(r.Headers),
+		Content:     harContent{MimeType: r.MimeType},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+}
+
+// harHeaders returns Chrome's headers, whose repeated values are joined by
+// newlines, sorted by name.
+func harHeaders(headers map[string]string) []harNameValue {
+	list := []harNameValue{}
+	for name, values := range headers {
+		for _, value := range strings.Split(values, "\n") {
+			list = append(list, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func harQueryString(rawURL string) []harNameValue {
+	list := []harNameValue{}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return list
+	}
+	for name, values := range u.Query() {
+		for _, value := range values {
+			list = append(list, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// harCaptures are the captured sessions, kept until their TTL passed once
+// they ended.
+type harCaptures struct {
+	mu       sync.Mutex
+	sessions map[string]*harCapture // By ID
+}
+
+func newHARCaptures() *harCaptures {
+	return &harCaptures{sessions: make(map[string]*harCapture)}
+}
+
+// expire drops the sessions that ended more than ttl ago. The caller must
+// hold mu.
+func (h *harCaptures) expire(now time.Time, ttl time.Duration) {
+	for id, c := range h.sessions {
+		if end := c.view().End; end != nil && now.Sub(*end) > ttl {
+			delete(h.sessions, id)
+		}
+	}
+}
+
+func (h *harCaptures) add(c *harCapture, now time.Time, ttl time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now, ttl)
+	h.sessions[c.session.ID] = c
+}
+
+func (h *harCaptures) get(id string, now time.Time, ttl time.Duration) (*harCapture, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now, ttl)
+	c, ok := h.sessions[id]
+	return c, ok
+}
+
+// list returns the sessions of vmName, oldest first.
+func (h *harCaptures) list(vmName string, now time.Time, ttl time.Duration) []harSession {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expire(now, ttl)
+	sessions := []harSession{}
+	for _, c := range h.sessions {
+		if session := c.view(); session.VM == vmName {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Start.Before(sessions[j].Start) })
+	return sessions
+}
+
+// harConfig returns the configured captures, with defaults applied.
+func (s *cdpServer) harConfig() config.CDPHARConfig {
+	s.mu.RLock()
+	var cfg config.CDPHARConfig
+	if s.cfg != nil {
+		cfg = s.cfg.HAR
+	}
+	s.mu.RUnlock()
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = defaultHARMaxEntries
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultHARTTL
+	}
+	return cfg
+}
+
+// startHAR starts capturing the requests of a session with the target at
+// devtools of vmName, if the client asked for it with ?har=true or the
+// config does. It returns nil otherwise.
+func (s *cdpServer) startHAR(r *http.Request, vmName string, devtools string) *harCapture {
+	cfg := s.harConfig()
+	requested, _ := strconv.ParseBool(r.URL.Query().Get("har"))
+	configured := cfg.Enabled && (len(cfg.VMs) == 0 || slices.Contains(cfg.VMs, vmName))
+	if !requested && !configured {
+		return nil
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Warnf("Not capturing the requests of a session of VM %s: %v", vmName, err)
+		return nil
+	}
+	now := time.Now()
+	c := &harCapture{
+		session: harSession{
+			ID:     hex.EncodeToString(id),
+			VM:     vmName,
+			Target: targetID(devtools),
+			Remote: r.RemoteAddr,
+			Start:  now,
+		},
+		page:       strings.HasPrefix(devtools, "/devtools/page/"),
+		maxEntries: cfg.MaxEntries,
+		attached:   make(chan string, 64),
+		pending:    make(map[string]*harRequestState),
+	}
+	s.hars.add(c, now, cfg.TTL)
+	return c
+}
+
+// prober returns c as the prober of its session, nil if c is.
+func (c *harCapture) prober() relay.Prober {
+	if c == nil {
+		return nil
+	}
+	return c
+}
+
+// harSessionsHandler serves GET /vm/{vmName}/sessions, the captured sessions
+// of a VM.
+func (s *cdpServer) harSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	vmName, err := grantFromContext(r.Context()).authorize(mux.Vars(r)["vmName"])
+	if err != nil {
+		http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
+		return
+	}
+	sessions := s.hars.list(vmName, time.Now(), s.harConfig().TTL)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Sessions []harSession `json:"sessions"`
+	}{sessions})
+}
+
+// harHandler serves GET /vm/{vmName}/sessions/{id}/har, the HAR of a captured
+// session, with its credentials masked as in the logs.
+func (s *cdpServer) harHandler(w http.ResponseWriter, r *http.Request) {
+	vmName, err := grantFromContext(r.Context()).authorize(mux.Vars(r)["vmName"])
+	if err != nil {
+		http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
+		return
+	}
+	c, ok := s.hars.get(mux.Vars(r)["id"], time.Now(), s.harConfig().TTL)
+	if !ok || c.session.VM != vmName {
+		http.Error(w, "404 Not Found - session not found", http.StatusNotFound)
+		return
+	}
+	data, err := c.har()
+	if err != nil {
+		log.Errorf("Failed to encode the HAR of session %s: %v", c.session.ID, err)
+		http.Error(w, "500 Internal Server Error - failed to encode the HAR", http.StatusInternalServerError)
+		return
+	}
+	s.mu.RLock()
+	redactor := s.redactor
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+vmName+"-"+c.session.ID+`.har"`)
+	w.Write(redactor.Bytes(data))
+}
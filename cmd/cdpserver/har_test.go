@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+// harEvents are Network events of a page navigating to example.com,
+// redirected once, and failing to load a script. The fake Chrome echoes
+// them, as if its page sent them.
+var harEvents = []string{
+	`{"method":"Network.requestWillBeSent","params":{"requestId":"1","request":{"url":"http://example.com/?q=a","method":"GET","headers":{"Authorization":"Bearer s3cret","Accept":"text/html"}},"timestamp":100,"wallTime":1700000000,"type":"Document"}}`,
+	`{"method":"Network.requestWillBeSent","params":{"requestId":"1","request":{"url":"https://example.com/","method":"GET","headers":{}},"timestamp":100.05,"wallTime":1700000000.05,"type":"Document","redirectResponse":{"url":"http://example.com/?q=a","status":301,"statusText":"Moved Permanently","headers":{"Location":"https://example.com/"},"protocol":"http/1.1","remoteIPAddress":"93.184.216.34"}}}`,
+	`{"method":"Network.responseReceived","params":{"requestId":"1","timestamp":100.15,"response":{"url":"https://example.com/","status":200,"statusText":"","headers":{"Content-Type":"text/html","Set-Cookie":"a=1\nb=2"},"mimeType":"text/html","protocol":"h2","remoteIPAddress":"[2606:2800:220:1::]"}}}`,
+	`{"method":"Network.loadingFinished","params":{"requestId":"1","timestamp":100.2,"encodedDataLength":1256}}`,
+	`{"method":"Network.requestWillBeSent","params":{"requestId":"2","request":{"url":"https://cdn.example.com/app.js","method":"POST","headers":{"Content-Type":"text/plain"},"postData":"hi"},"timestamp":100.3,"wallTime":1700000000.3,"type":"Script"},"sessionId":"S1"}`,
+	`{"method":"Network.loadingFailed","params":{"requestId":"2","timestamp":100.4,"errorText":"net::ERR_NAME_NOT_RESOLVED"},"sessionId":"S1"}`,
+	`{"method":"Target.attachedToTarget","params":{"sessionId":"S1","targetInfo":{"type":"iframe"}}}`,
+}
+
+func TestHARCapture(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/devtools/page/fake-page?har=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Header.Get(harSessionHeader)
+	if id == "" {
+		t.Fatal("no session ID")
+	}
+	if path, _ := chrome.LastRequest(); strings.Contains(path, "har") {
+		t.Errorf("Chrome was asked for %s", path)
+	}
+	for _, event := range harEvents {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(event)); err != nil {
+			t.Fatal(err)
+		}
+		// The client still receives the events, and only them.
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != event {
+			t.Fatalf("received %q, %v, want %s", data, err, event)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(chrome.NetworkEnabled()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if enabled := chrome.NetworkEnabled(); len(enabled) != 2 || enabled[0] != "" || enabled[1] != "S1" {
+		t.Errorf("Network enabled on %q, want the page and S1", enabled)
+	}
+	conn.Close()
+
+	var sessions struct {
+		Sessions []harSession `json:"sessions"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(proxy.URL + "/vm/vm1/sessions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&sessions)
+		resp.Body.Close()
+		if len(sessions.Sessions) == 1 && sessions.Sessions[0].End != nil {
+			break
+		}
+	}
+	if len(sessions.Sessions) != 1 || sessions.Sessions[0].ID != id || sessions.Sessions[0].Target != "fake-page" ||
+		sessions.Sessions[0].Entries != 3 || sessions.Sessions[0].End == nil {
+		t.Fatalf("sessions = %+v", sessions.Sessions)
+	}
+
+	resp, err = http.Get(proxy.URL + "/vm/vm1/sessions/" + id + "/har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var h har
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Log.Version != "1.2" || len(h.Log.Entries) != 3 {
+		t.Fatalf("HAR = %+v", h.Log)
+	}
+	redirect, page, script := h.Log.Entries[0], h.Log.Entries[1], h.Log.Entries[2]
+	if redirect.Response.Status != 301 || redirect.Response.RedirectURL != "https://example.com/" ||
+		redirect.StartedDateTime != "2023-11-14T22:13:20.000Z" || len(redirect.Request.QueryString) != 1 {
+		t.Errorf("redirect = %+v", redirect)
+	}
+	for _, header := range redirect.Request.Headers {
+		if header.Name == "Authorization" && strings.Contains(header.Value, "s3cret") {
+			t.Errorf("Authorization header not masked: %q", header.Value)
+		}
+	}
+	if page.Response.Status != 200 || page.Response.BodySize != 1256 || page.Request.HTTPVersion != "h2" ||
+		page.ServerIPAddress != "2606:2800:220:1::" || len(page.Response.Headers) != 3 || page.Time < 149 || page.Time > 151 {
+		t.Errorf("page = %+v", page)
+	}
+	if script.Error != "net::ERR_NAME_NOT_RESOLVED" || script.Request.PostData == nil || script.Request.PostData.Text != "hi" || script.ResourceType != "Script" {
+		t.Errorf("script = %+v", script)
+	}
+
+	for path, want := range map[string]int{
+		"/vm/vm1/sessions/unknown/har":    http.StatusNotFound,
+		"/vm/vm2/sessions/" + id + "/har": http.StatusNotFound,
+	} {
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestHARCaptureLimits(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{HAR: config.CDPHARConfig{Enabled: true, VMs: []string{"vm1"}, MaxEntries: 1}})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	// Captured without asking for it, as configured for vm1, keeping the
+	// first request only, not its redirect nor the script.
+	conn, resp, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	id := resp.Header.Get(harSessionHeader)
+	for _, event := range harEvents[:5] {
+		conn.WriteMessage(websocket.TextMessage, []byte(event))
+		conn.ReadMessage()
+	}
+	c, ok := s.hars.get(id, time.Now(), time.Hour)
+	if !ok {
+		t.Fatalf("session %q not captured", id)
+	}
+	if session := c.view(); session.Entries != 1 || session.Dropped != 2 || session.End != nil {
+		t.Errorf("session = %+v", session)
+	}
+
+	// Sessions that ended are dropped once their TTL passed.
+	c.ended(time.Now().Add(-2 * time.Hour))
+	if _, ok := s.hars.get(id, time.Now(), time.Hour); ok {
+		t.Error("expired session still served")
+	}
+}
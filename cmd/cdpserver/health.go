@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// healthProbeTimeout bounds asking one browser for its version in a deep
+// health check.
+const healthProbeTimeout = 2 * time.Second
+
+// maxHealthProbes bounds the browsers a deep health check asks at once.
+const maxHealthProbes = 8
+
+// Statuses of a health check.
+const (
+	healthHealthy   = "healthy"
+	healthDegraded  = "degraded"
+	healthUnhealthy = "unhealthy"
+)
+
+// deepHealth is the answer of /health?deep=true.
+type deepHealth struct {
+	Status  string `json:"status"`
+	Service string `json:"service"`
+	// RESTAPI is whether the VM list could be fetched.
+	RESTAPI componentHealth `json:"restApi"`
+	// Browsers are those of every running VM.
+	Browsers []browserHealth `json:"browsers"`
+}
+
+type componentHealth struct {
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// browserHealth is whether a browser of a VM answered on its CDP port.
+type browserHealth struct {
+	VM string `json:"vm"`
+	// Browser is "" for the VM's default browser.
+	Browser  string `json:"browser,omitempty"`
+	HostPort string `json:"hostPort"`
+	Ready    bool   `json:"ready"`
+	Error    string `json:"error,omitempty"`
+}
+
+// healthCheck serves /health: whether the proxy serves at all or, with
+// ?deep=true, whether it can route anywhere. The deep check lists VMs and
+// their ports, so it needs a token like the proxied routes.
+func (s *cdpServer) healthCheck(w http.ResponseWriter, r *http.Request) {
+	if deep, _ := strconv.ParseBool(r.URL.Query().Get("deep")); deep {
+		s.requireAuth(s.deepHealthCheck)(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"status": "healthy", "service": "cdp"}`)
+}
+
+// deepHealthCheck fetches the VM list from the REST API and asks every
+// browser of every running VM the request's token opens for its version. It
+// answers 503 if the REST API can't be reached or no browser is ready, so
+// that load balancers and probes stop sending clients here, and reports
+// "degraded" while only some browsers are ready.
+func (s *cdpServer) deepHealthCheck(w http.ResponseWriter, r *http.Request) {
+	grant := grantFromContext(r.Context())
+	health := deepHealth{Service: "cdp", Browsers: []browserHealth{}}
+	if err := s.refreshVMs(); err != nil {
+		health.RESTAPI.Error = err.Error()
+	} else {
+		health.RESTAPI.Reachable = true
+		vms, _ := s.vms.current()
+		for _, vm := range vms.vms {
+			if vm.Status != "RUNNING" {
+				continue
+			}
+			if _, err := grant.authorize(vm.VMName); err != nil {
+				continue
+			}
+			for _, id := range vm.browsers() {
+				pf, _ := vm.browserPort(id)
+				health.Browsers = append(health.Browsers, browserHealth{VM: vm.VMName, Browser: id, HostPort: pf.HostPort})
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	probes := make(chan struct{}, maxHealthProbes)
+	for i := range health.Browsers {
+		wg.Add(1)
+		probes <- struct{}{}
+		go func() {
+			defer func() {
+				<-probes
+				wg.Done()
+			}()
+			b := &health.Browsers[i]
+			if err := probeBrowser(r.Context(), b.HostPort); err != nil {
+				b.Error = err.Error()
+				return
+			}
+			b.Ready = true
+		}()
+	}
+	wg.Wait()
+
+	ready := 0
+	for _, b := range health.Browsers {
+		if b.Ready {
+			ready++
+		}
+	}
+	code := http.StatusOK
+	switch {
+	case !health.RESTAPI.Reachable || ready == 0:
+		health.Status = healthUnhealthy
+		code = http.StatusServiceUnavailable
+	case ready < len(health.Browsers):
+		health.Status = healthDegraded
+	default:
+		health.Status = healthHealthy
+	}
+	body, err := encodeJSON(health)
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// probeBrowser asks the browser forwarded to hostPort for its version.
+func probeBrowser(ctx context.Context, hostPort string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%s/json/version", hostPort), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("version request failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
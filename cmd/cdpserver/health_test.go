@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestDeepHealth(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	crashed := testharness.NewStoppedFakeChrome()
+	defer crashed.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	check := func(query string) (int, deepHealth) {
+		t.Helper()
+		resp, err := http.Get(proxy.URL + "/health" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var health deepHealth
+		json.NewDecoder(resp.Body).Decode(&health)
+		return resp.StatusCode, health
+	}
+
+	code, health := check("?deep=true")
+	if code != http.StatusOK || health.Status != healthHealthy || !health.RESTAPI.Reachable ||
+		len(health.Browsers) != 1 || !health.Browsers[0].Ready || health.Browsers[0].VM != "vm1" {
+		t.Errorf("deep health = %d %+v", code, health)
+	}
+
+	api.SetVMs(testharness.RunningVM("vm1", chrome), testharness.RunningVM("vm2", crashed))
+	code, health = check("?deep=1")
+	if code != http.StatusOK || health.Status != healthDegraded || len(health.Browsers) != 2 {
+		t.Fatalf("deep health = %d %+v, want degraded", code, health)
+	}
+	for _, b := range health.Browsers {
+		if b.Ready != (b.VM == "vm1") || (b.Error == "") != b.Ready {
+			t.Errorf("browser = %+v", b)
+		}
+	}
+
+	// No browser ready.
+	api.SetVMs(testharness.RunningVM("vm2", crashed))
+	if code, health = check("?deep=true"); code != http.StatusServiceUnavailable || health.Status != healthUnhealthy {
+		t.Errorf("deep health = %d %+v, want unhealthy", code, health)
+	}
+
+	// The REST API down, even though the last list still routes.
+	api.SetVMs(testharness.RunningVM("vm1", chrome))
+	check("?deep=true")
+	api.Close()
+	code, health = check("?deep=true")
+	if code != http.StatusServiceUnavailable || health.Status != healthUnhealthy || health.RESTAPI.Reachable || health.RESTAPI.Error == "" {
+		t.Errorf("deep health = %d %+v, want the REST API unreachable", code, health)
+	}
+	if code, health = check(""); code != http.StatusOK || health.Status != healthHealthy {
+		t.Errorf("shallow health = %d %+v, want healthy", code, health)
+	}
+}
+
+func TestDeepHealthAuth(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome), testharness.RunningVM("vm2", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{Auth: config.CDPAuthConfig{
+		Tokens:   []string{"secret"},
+		VMTokens: []config.VMTokenConfig{{Token: "scoped", VMs: []string{"vm2"}}},
+	}})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	check := func(query string) (int, deepHealth) {
+		t.Helper()
+		resp, err := http.Get(proxy.URL + "/health" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var health deepHealth
+		json.NewDecoder(resp.Body).Decode(&health)
+		return resp.StatusCode, health
+	}
+
+	// Load balancers can still tell that the proxy serves.
+	if code, _ := check(""); code != http.StatusOK {
+		t.Errorf("shallow health without a token = %d, want 200", code)
+	}
+	if code, health := check("?deep=true"); code != http.StatusUnauthorized || len(health.Browsers) != 0 {
+		t.Errorf("deep health without a token = %d %+v, want 401", code, health)
+	}
+	if code, health := check("?deep=true&token=secret"); code != http.StatusOK || len(health.Browsers) != 2 {
+		t.Errorf("deep health = %d %+v, want both VMs", code, health)
+	}
+	code, health := check("?deep=true&token=scoped")
+	if code != http.StatusOK || len(health.Browsers) != 1 || health.Browsers[0].VM != "vm2" {
+		t.Errorf("deep health with a scoped token = %d %+v, want vm2 alone", code, health)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/tracing"
+)
+
+// chromeResponseTimeout bounds how long Chrome may take to answer an HTTP
+// request. Bodies aren't bounded, they stream for as long as Chrome sends them.
+const chromeResponseTimeout = 30 * time.Second
+
+// chromeTransport reaches the port forwards of the VMs' browsers.
+var chromeTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = chromeResponseTimeout
+	return t
+}()
+
+// errUnreadableBody is returned when the body of a /json response, which is
+// rewritten, could not be read from Chrome.
+var errUnreadableBody = errors.New("failed to read response body")
+
+// relaunchingTransport retries the requests the browser browserID of vm
+// couldn't be reached for, once relaunchChrome restarted it if enabled.
+type relaunchingTransport struct {
+	s         *cdpServer
+	vm        VM
+	browserID string
+}
+
+func (t relaunchingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.s.currentTracer().Start(req.Context(), spanUpstream, tracing.KindClient)
+	defer span.End()
+	if span != nil {
+		// The request carries the trace context on to the browser.
+		req = req.Clone(ctx)
+		tracing.Inject(ctx, req.Header)
+	}
+	resp, err := chromeTransport.RoundTrip(req)
+	if err != nil {
+		err = t.s.relaunchChrome(req.Context(), t.vm, t.browserID, err, func() error {
+			var doErr error
+			resp, doErr = chromeTransport.RoundTrip(req.Clone(req.Context()))
+			return doErr
+		})
+	}
+	span.SetError(err)
+	if err == nil {
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+	}
+	return resp, err
+}
+
+// httpProxy proxies the HTTP request r to the VM's browser browserID, on
+// hostPort, streaming the response as Chrome sends it. Only the /json
+// responses, whose URLs are rewritten to the proxy, are read whole.
+func (s *cdpServer) httpProxy(r *http.Request, hostPort string, vm VM, browserID string) *httputil.ReverseProxy {
+	upstream := upstreamPath(r)
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = "127.0.0.1:" + hostPort
+			pr.Out.URL.Path, pr.Out.URL.RawQuery, _ = strings.Cut(upstream, "?")
+			pr.Out.URL.RawPath = ""
+			// Chrome only answers requests for an IP address or localhost.
+			pr.Out.Host = ""
+			log.Infof("Proxying HTTP request via port forward: %s (VM: %s)", pr.Out.URL, vm.VMName)
+		},
+		Transport: relaunchingTransport{s: s, vm: vm, browserID: browserID},
+		ModifyResponse: func(resp *http.Response) error {
+			return s.rewriteResponse(r, resp, upstream, vm, browserID)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Errorf("Failed to proxy request to VM %s: %v", vm.VMName, err)
+			tracing.FromContext(r.Context()).SetError(err)
+			if errors.Is(err, errUnreadableBody) {
+				http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			s.chromeUnavailable(w, r, vm, browserID, err)
+		},
+	}
+}
+
+// rewriteResponse learns the targets of Chrome's response to the /json
+// request r and points their WebSocket URLs at our CDP server, on the path of
+// the VM they came from. Other responses are passed on untouched.
+func (s *cdpServer) rewriteResponse(r *http.Request, resp *http.Response, upstream string, vm VM, browserID string) error {
+	if resp.StatusCode != http.StatusOK || !rewritesJSON(upstream) {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnreadableBody, err)
+	}
+	log.Infof("Received response from Chrome: %d bytes", len(body))
+	s.routes.learn(vm.VMName, browserID, upstream, body)
+
+	hostURL := r.Host
+	if hostURL == "" {
+		// If no Host header, use localhost with our CDP server port
+		hostURL = fmt.Sprintf("localhost:%s", s.port)
+	}
+	rewriter := urlRewriter{scheme: wsScheme(r), host: hostURL, vmName: vm.VMName, browserID: browserID}
+	if rewritten, err := rewriter.rewriteJSON(upstream, body); err != nil {
+		log.Warnf("Passing the response of %s on as is, failed to rewrite it: %v", upstream, err)
+	} else {
+		body = rewritten
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Transfer-Encoding")
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestHTTPProxyStreams(t *testing.T) {
+	release := make(chan struct{})
+	chrome := &testharness.FakeChrome{Server: httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	}))}
+	defer chrome.Close()
+	defer close(release)
+	proxy, _ := newTestProxy(t, testharness.RunningVM("vm1", chrome))
+
+	resp, err := http.Get(proxy.URL + "/vm/vm1/devtools/inspector.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !reflect.DeepEqual(resp.TransferEncoding, []string{"chunked"}) {
+		t.Errorf("transfer encoding = %q, want Chrome's chunked response", resp.TransferEncoding)
+	}
+
+	// The first chunk arrives while Chrome is still writing the response.
+	lines := make(chan string)
+	go func() {
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	select {
+	case line := <-lines:
+		if line != "first\n" {
+			t.Fatalf("read %q, want the first chunk", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("response buffered until Chrome finished it")
+	}
+	release <- struct{}{}
+	if line := <-lines; line != "second\n" {
+		t.Errorf("read %q, want the second chunk", line)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/metrics"
+	"github.com/abshkbh/arrakis/pkg/relay"
+)
+
+const (
+	defaultProbeInterval    = 30 * time.Second
+	defaultProbeTimeout     = 5 * time.Second
+	defaultLatencyTarget    = 100 * time.Millisecond
+	defaultLatencyObjective = 0.99
+	// probeIDBase is the id of the first probe of a session. CDP ids are
+	// 32-bit and clients count theirs up from 1, so replies with higher ids
+	// answer probes.
+	probeIDBase = 1 << 30
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms,
+// from the proxy's own overhead to browsers that barely answer.
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// latencyHistogram counts durations in latencyBuckets.
+type latencyHistogram struct {
+	counts []uint64 // Per bucket, not cumulative, with +Inf's last
+	count  uint64
+	sum    float64 // In seconds
+}
+
+func newLatencyHistogram() latencyHistogram {
+	return latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	secs := d.Seconds()
+	h.counts[sort.SearchFloat64s(latencyBuckets, secs)]++
+	h.count++
+	h.sum += secs
+}
+
+// quantile estimates the q-quantile of the durations, interpolating within
+// its bucket. Durations beyond the last bucket count as its bound.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	rank := q * float64(h.count)
+	var seen float64
+	for i, c := range h.counts {
+		if c == 0 || seen+float64(c) < rank {
+			seen += float64(c)
+			continue
+		}
+		if i == len(latencyBuckets) {
+			break
+		}
+		var lower float64
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		return secondsDuration(lower + (latencyBuckets[i]-lower)*(rank-seen)/float64(c))
+	}
+	return secondsDuration(latencyBuckets[len(latencyBuckets)-1])
+}
+
+func (h *latencyHistogram) mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return secondsDuration(h.sum / float64(h.count))
+}
+
+func (h *latencyHistogram) sample(labels map[string]string) metrics.HistogramSample {
+	buckets := make([]metrics.Bucket, len(latencyBuckets))
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		buckets[i] = metrics.Bucket{UpperBound: bound, Count: cumulative}
+	}
+	return metrics.HistogramSample{Labels: labels, Buckets: buckets, Count: h.count, Sum: h.sum}
+}
+
+func secondsDuration(secs float64) time.Duration {
+	return time.Duration(secs * float64(time.Second))
+}
+
+// vmLatency is the latency measured in the sessions of a VM.
+type vmLatency struct {
+	// probes are the round-trips of the probes answered in time.
+	probes latencyHistogram
+	// overhead is the time the relay held the clients' messages.
+	overhead latencyHistogram
+	// failures are the probes answered late, or with an error.
+	failures uint64
+	// good are the probes answered within the SLO target in effect then.
+	good uint64
+}
+
+// latencyStats is the latency measured in the sessions of each VM, since the
+// proxy started or the VM did.
+type latencyStats struct {
+	mu  sync.Mutex
+	vms map[string]*vmLatency
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{vms: make(map[string]*vmLatency)}
+}
+
+// vm returns the latency of vmName. The caller must hold mu.
+func (l *latencyStats) vm(vmName string) *vmLatency {
+	v, ok := l.vms[vmName]
+	if !ok {
+		v = &vmLatency{probes: newLatencyHistogram(), overhead: newLatencyHistogram()}
+		l.vms[vmName] = v
+	}
+	return v
+}
+
+// probed records a probe of vmName answered after d.
+func (l *latencyStats) probed(vmName string, d time.Duration, target time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	v := l.vm(vmName)
+	v.probes.observe(d)
+	if d <= target {
+		v.good++
+	}
+}
+
+// failed records a probe of vmName that wasn't answered in time.
+func (l *latencyStats) failed(vmName string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.vm(vmName).failures++
+}
+
+// relayed records a client's message to vmName held for d by the relay.
+func (l *latencyStats) relayed(vmName string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.vm(vmName).overhead.observe(d)
+}
+
+// prune drops the latency of the VMs that aren't running.
+func (l *latencyStats) prune(running map[string]bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for vmName := range l.vms {
+		if !running[vmName] {
+			delete(l.vms, vmName)
+		}
+	}
+}
+
+// names returns the VMs with measured latency, sorted. The caller must hold
+// mu.
+func (l *latencyStats) names() []string {
+	names := make([]string, 0, len(l.vms))
+	for vmName := range l.vms {
+		names = append(names, vmName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// latencyPercentiles summarizes a latency histogram, in milliseconds.
+type latencyPercentiles struct {
+	Count  uint64  `json:"count"`
+	MeanMs float64 `json:"meanMs"`
+	P50Ms  float64 `json:"p50Ms"`
+	P90Ms  float64 `json:"p90Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+}
+
+func percentilesOf(h *latencyHistogram) latencyPercentiles {
+	p := latencyPercentiles{Count: h.count}
+	if h.count > 0 {
+		p.MeanMs = milliseconds(h.mean())
+		p.P50Ms = milliseconds(h.quantile(0.5))
+		p.P90Ms = milliseconds(h.quantile(0.9))
+		p.P99Ms = milliseconds(h.quantile(0.99))
+	}
+	return p
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// vmLatencySummary is the latency of a VM's sessions against the SLO.
+type vmLatencySummary struct {
+	VM string `json:"vm"`
+	// Probes are the round-trips to the VM's browser through the proxy.
+	Probes   latencyPercentiles `json:"probes"`
+	Failures uint64             `json:"failures"`
+	// WithinTarget are the probes answered within the SLO's target.
+	WithinTarget uint64 `json:"withinTarget"`
+	// Attainment is the share of probes within the target, failures
+	// included. Absent before the first probe.
+	Attainment *float64 `json:"attainment,omitempty"`
+	Met        bool     `json:"met"`
+	// RelayOverhead is the time the proxy held the clients' messages.
+	RelayOverhead latencyPercentiles `json:"relayOverhead"`
+}
+
+// latencySummary is the response of GET /v1/cdp/latency.
+type latencySummary struct {
+	Enabled   bool               `json:"enabled"`
+	Interval  string             `json:"interval"`
+	Target    string             `json:"target"`
+	Objective float64            `json:"objective"`
+	VMs       []vmLatencySummary `json:"vms"`
+}
+
+// summary returns the latency of the VMs allowed, against objective.
+func (l *latencyStats) summary(objective float64, allowed func(vmName string) bool) []vmLatencySummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	summaries := []vmLatencySummary{}
+	for _, vmName := range l.names() {
+		if !allowed(vmName) {
+			continue
+		}
+		v := l.vms[vmName]
+		summary := vmLatencySummary{
+			VM:            vmName,
+			Probes:        percentilesOf(&v.probes),
+			Failures:      v.failures,
+			WithinTarget:  v.good,
+			Met:           true,
+			RelayOverhead: percentilesOf(&v.overhead),
+		}
+		if total := v.probes.count + v.failures; total > 0 {
+			attainment := float64(v.good) / float64(total)
+			summary.Attainment = &attainment
+			summary.Met = attainment >= objective
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+// metrics returns the latency of every VM for Prometheus.
+func (l *latencyStats) metrics() ([]metrics.Gauge, []metrics.Histogram) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures := metrics.Gauge{
+		Name: "arrakis_cdp_probe_failures",
+		Help: "Latency probes of the VM's sessions not answered in time.",
+	}
+	probes := metrics.Histogram{
+		Name: "arrakis_cdp_probe_latency_seconds",
+		Help: "Round-trips of the latency probes to the VM's browser through the proxy.",
+	}
+	overhead := metrics.Histogram{
+		Name: "arrakis_cdp_relay_overhead_seconds",
+		Help: "Time the proxy held the clients' messages to the VM's browser.",
+	}
+	for _, vmName := range l.names() {
+		v := l.vms[vmName]
+		labels := map[string]string{"vm": vmName}
+		failures.Samples = append(failures.Samples, metrics.Sample{Labels: labels, Value: float64(v.failures)})
+		probes.Samples = append(probes.Samples, v.probes.sample(labels))
+		overhead.Samples = append(overhead.Samples, v.overhead.sample(labels))
+	}
+	return []metrics.Gauge{failures}, []metrics.Histogram{probes, overhead}
+}
+
+// latencyProber probes the latency of a session with a VM's browser,
+// sending Browser.getVersion every interval and swallowing the replies, and
+// times how long the relay holds the client's messages.
+type latencyProber struct {
+	stats  *latencyStats
+	vmName string
+	cfg    config.CDPLatencyProbeConfig
+
+	mu      sync.Mutex
+	sent    int
+	pending map[int]time.Time // Send times of the probes awaiting replies
+}
+
+var _ relay.Prober = (*latencyProber)(nil)
+
+// latencyProber returns the prober of a session with vmName, nil unless
+// latency probes are enabled.
+func (s *cdpServer) latencyProber(vmName string) relay.Prober {
+	cfg := s.latencyProbeConfig()
+	if !cfg.Enabled {
+		return nil
+	}
+	return &latencyProber{stats: s.latency, vmName: vmName, cfg: cfg, pending: make(map[int]time.Time)}
+}
+
+// Run sends a probe when the session starts, then every interval.
+func (p *latencyProber) Run(send func(messageType int, data []byte) error, stop <-chan struct{}) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		p.expire()
+		p.mu.Lock()
+		id := probeIDBase + p.sent
+		p.sent++
+		p.pending[id] = time.Now()
+		p.mu.Unlock()
+		if err := send(websocket.TextMessage, []byte(fmt.Sprintf(`{"id":%d,"method":"Browser.getVersion"}`, id))); err != nil {
+			return
+		}
+		select {
+		case <-stop:
+			p.expire()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expire counts the probes waiting for longer than the timeout as failed.
+func (p *latencyProber) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, sent := range p.pending {
+		if time.Since(sent) > p.cfg.Timeout {
+			delete(p.pending, id)
+			p.stats.failed(p.vmName)
+		}
+	}
+}
+
+// Consume swallows the replies to probes, including those that came too
+// late, which were already counted as failed.
+func (p *latencyProber) Consume(messageType int, data []byte) bool {
+	id, ok := replyID(data)
+	if !ok || id < probeIDBase {
+		return false
+	}
+	p.mu.Lock()
+	sent, pending := p.pending[id]
+	delete(p.pending, id)
+	probed := id < probeIDBase+p.sent
+	p.mu.Unlock()
+	if !pending {
+		return probed
+	}
+	d := time.Since(sent)
+	if d > p.cfg.Timeout || bytes.Contains(data, []byte(`"error":`)) {
+		p.stats.failed(p.vmName)
+	} else {
+		p.stats.probed(p.vmName, d, p.cfg.SLO.Target)
+	}
+	return true
+}
+
+// Relayed records the time the relay held a message of the client.
+func (p *latencyProber) Relayed(d time.Duration) {
+	p.stats.relayed(p.vmName, d)
+}
+
+// replyID returns the id of a reply of Chrome, which always starts with it,
+// without decoding the rest of the message.
+func replyID(data []byte) (int, bool) {
+	rest, ok := bytes.CutPrefix(data, []byte(`{"id":`))
+	if !ok {
+		return 0, false
+	}
+	end := bytes.IndexByte(rest, ',')
+	if end < 0 {
+		return 0, false
+	}
+	id, err := strconv.Atoi(string(rest[:end]))
+	return id, err == nil
+}
+
+// latencyProbeConfig returns the configured latency probes, with defaults
+// applied.
+func (s *cdpServer) latencyProbeConfig() config.CDPLatencyProbeConfig {
+	s.mu.RLock()
+	var cfg config.CDPLatencyProbeConfig
+	if s.cfg != nil {
+		cfg = s.cfg.LatencyProbe
+	}
+	s.mu.RUnlock()
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultProbeInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultProbeTimeout
+	}
+	if cfg.SLO.Target <= 0 {
+		cfg.SLO.Target = defaultLatencyTarget
+	}
+	if cfg.SLO.Objective <= 0 {
+		cfg.SLO.Objective = defaultLatencyObjective
+	}
+	return cfg
+}
+
+// validateLatencyProbe checks the SLO of the latency probes.
+func validateLatencyProbe(cfg config.CDPLatencyProbeConfig) error {
+	if cfg.SLO.Objective < 0 || cfg.SLO.Objective > 1 {
+		return errors.New("latency_probe: slo objective must be between 0 and 1")
+	}
+	return nil
+}
+
+// Metrics exports the latency of the sessions, and the events forwarded to
+// sinks, along the admin metrics.
+func (s *cdpServer) Metrics() ([]metrics.Gauge, []metrics.Histogram) {
+	gauges, histograms := s.latency.metrics()
+	return append(gauges, s.eventSinkMetrics()...), histograms
+}
+
+// latencyHandler serves GET /v1/cdp/latency, the latency of the sessions of
+// the VMs the token opens against the SLO.
+func (s *cdpServer) latencyHandler(w http.ResponseWriter, r *http.Request) {
+	grant := grantFromContext(r.Context())
+	cfg := s.latencyProbeConfig()
+	summary := latencySummary{
+		Enabled:   cfg.Enabled,
+		Interval:  cfg.Interval.String(),
+		Target:    cfg.SLO.Target.String(),
+		Objective: cfg.SLO.Objective,
+		VMs: s.latency.summary(cfg.SLO.Objective, func(vmName string) bool {
+			_, err := grant.authorize(vmName)
+			return err == nil
+		}),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func fetchLatency(t *testing.T, url string) latencySummary {
+	t.Helper()
+	resp, err := http.Get(url + "/v1/cdp/latency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var summary latencySummary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	return summary
+}
+
+func TestLatencyProbes(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{LatencyProbe: config.CDPLatencyProbeConfig{
+		Enabled:  true,
+		Interval: 10 * time.Millisecond,
+		SLO:      config.CDPLatencySLOConfig{Target: time.Second},
+	}})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"id":1,"method":"Runtime.enable"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != `{"id":1,"method":"Runtime.enable"}` {
+		t.Fatalf("reply = %q, %v", data, err)
+	}
+
+	var summary latencySummary
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		summary = fetchLatency(t, proxy.URL)
+		if len(summary.VMs) == 1 && summary.VMs[0].Probes.Count >= 3 {
+			break
+		}
+	}
+	if !summary.Enabled || summary.Target != "1s" || summary.Objective != defaultLatencyObjective || len(summary.VMs) != 1 {
+		t.Fatalf("summary = %+v", summary)
+	}
+	vm := summary.VMs[0]
+	if vm.VM != "vm1" || vm.Probes.Count < 3 || vm.Failures != 0 || vm.WithinTarget != vm.Probes.Count ||
+		vm.Attainment == nil || *vm.Attainment != 1 || !vm.Met || vm.RelayOverhead.Count != 1 {
+		t.Errorf("latency of vm1 = %+v", vm)
+	}
+
+	// The replies to the probes aren't relayed to the client.
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Errorf("client received %q", data)
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("read = %v, want a timeout", err)
+	}
+
+	gauges, histograms := s.Metrics()
+	if len(gauges) != 1 || len(histograms) != 2 || len(histograms[0].Samples) != 1 ||
+		histograms[0].Samples[0].Labels["vm"] != "vm1" || histograms[0].Samples[0].Count < 3 {
+		t.Errorf("metrics = %+v %+v", gauges, histograms)
+	}
+}
+
+func TestLatencyProberFailures(t *testing.T) {
+	stats := newLatencyStats()
+	p := &latencyProber{
+		stats:  stats,
+		vmName: "vm1",
+		cfg: config.CDPLatencyProbeConfig{
+			Timeout: 10 * time.Millisecond,
+			SLO:     config.CDPLatencySLOConfig{Target: time.Second},
+		},
+		sent: 3,
+		pending: map[int]time.Time{
+			probeIDBase:     time.Now().Add(-time.Second),
+			probeIDBase + 1: time.Now(),
+			probeIDBase + 2: time.Now(),
+		},
+	}
+	p.expire()
+
+	for data, want := range map[string]bool{
+		fmt.Sprintf(`{"id":%d,"result":{}}`, probeIDBase):             true,  // Late
+		fmt.Sprintf(`{"id":%d,"result":{}}`, probeIDBase+1):           true,  // In time
+		fmt.Sprintf(`{"id":%d,"error":{}}`, probeIDBase+2):            true,  // Failed
+		fmt.Sprintf(`{"id":%d,"result":{}}`, probeIDBase+3):           false, // Never sent
+		`{"id":7,"result":{}}`:                                        false,
+		`{"method":"Page.loadEventFired","params":{"id":2000000000}}`: false,
+	} {
+		if got := p.Consume(websocket.TextMessage, []byte(data)); got != want {
+			t.Errorf("Consume(%s) = %t, want %t", data, got, want)
+		}
+	}
+
+	summary := stats.summary(0.99, func(string) bool { return true })
+	if len(summary) != 1 {
+		t.Fatalf("summary = %+v", summary)
+	}
+	vm := summary[0]
+	if vm.Probes.Count != 1 || vm.Failures != 2 || vm.WithinTarget != 1 || vm.Attainment == nil || *vm.Attainment != 1.0/3 || vm.Met {
+		t.Errorf("latency of vm1 = %+v", vm)
+	}
+	if summary := stats.summary(0.99, func(string) bool { return false }); len(summary) != 0 {
+		t.Errorf("summary of no VM = %+v", summary)
+	}
+
+	stats.prune(map[string]bool{"vm2": true})
+	if summary := stats.summary(0.99, func(string) bool { return true }); len(summary) != 0 {
+		t.Errorf("summary after vm1 stopped = %+v", summary)
+	}
+}
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+	h := newLatencyHistogram()
+	for i := 0; i < 98; i++ {
+		h.observe(3 * time.Millisecond)
+	}
+	h.observe(200 * time.Millisecond)
+	h.observe(time.Minute)
+
+	if p50 := h.quantile(0.5); p50 <= 2500*time.Microsecond || p50 > 5*time.Millisecond {
+		t.Errorf("p50 = %s, want within the 3ms bucket", p50)
+	}
+	if p99 := h.quantile(0.99); p99 <= 100*time.Millisecond || p99 > 250*time.Millisecond {
+		t.Errorf("p99 = %s, want within the 200ms bucket", p99)
+	}
+	if max := h.quantile(1); max != 5*time.Second {
+		t.Errorf("p100 = %s, want the last bucket's bound", max)
+	}
+	sample := h.sample(nil)
+	if last := sample.Buckets[len(sample.Buckets)-1]; last.Count != 99 || sample.Count != 100 {
+		t.Errorf("sample = %+v", sample)
+	}
+}
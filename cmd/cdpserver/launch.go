@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const (
+	defaultChromeLaunchTimeout  = 30 * time.Second
+	defaultChromeLaunchCooldown = time.Minute
+	// Bounds the backoff between retries to reach a restarted browser.
+	chromeRetryInitialBackoff = 250 * time.Millisecond
+	chromeRetryMaxBackoff     = 4 * time.Second
+)
+
+// chromeLaunches remembers when the browsers of the VMs were restarted, so
+// that the clients of a browser that is still starting don't restart it
+// again.
+type chromeLaunches struct {
+	mu        sync.Mutex
+	restarted map[string]time.Time // By VM and browser
+}
+
+func newChromeLaunches() *chromeLaunches {
+	return &chromeLaunches{restarted: make(map[string]time.Time)}
+}
+
+// claim reports whether the browser browserID of vmName is due a restart,
+// i.e. it wasn't restarted within cooldown, and records the restart if so.
+func (l *chromeLaunches) claim(vmName string, browserID string, cooldown time.Duration, now time.Time) bool {
+	key := vmName + "/" + browserID
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.restarted[key]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	l.restarted[key] = now
+	return true
+}
+
+// chromeLaunchConfig returns the settings of restarting unreachable browsers.
+func (s *cdpServer) chromeLaunchConfig() config.ChromeLaunchConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cfg == nil {
+		return config.ChromeLaunchConfig{}
+	}
+	launch := s.cfg.ChromeLaunch
+	if launch.Timeout <= 0 {
+		launch.Timeout = defaultChromeLaunchTimeout
+	}
+	if launch.Cooldown <= 0 {
+		launch.Cooldown = defaultChromeLaunchCooldown
+	}
+	return launch
+}
+
+// relaunchChrome is called once the browser browserID of vm couldn't be
+// reached, failing with cause. When enabled it restarts the browser through
+// the REST API, unless it was just restarted, and retries reaching it with
+// exponential backoff until retry succeeds or the timeout. It returns the
+// last error, nil once reached.
+func (s *cdpServer) relaunchChrome(ctx context.Context, vm VM, browserID string, cause error, retry func() error) error {
+	launch := s.chromeLaunchConfig()
+	if !launch.Enabled {
+		return cause
+	}
+
+	if s.launches.claim(vm.VMName, browserID, launch.Cooldown, time.Now()) {
+		log.Infof("Chrome of VM %s (browser %q) not available: %v, restarting it", vm.VMName, browserID, cause)
+		restartURL := fmt.Sprintf("%s/v1/vms/%s/browser/restart", s.restAPIURL, url.PathEscape(vm.VMName))
+		if err := cmdserver.RestartBrowser(ctx, s.restClient, restartURL, browserID); err != nil {
+			log.Warnf("Failed to restart Chrome of VM %s (browser %q): %v", vm.VMName, browserID, err)
+			return cause
+		}
+	}
+
+	deadline := time.NewTimer(launch.Timeout)
+	defer deadline.Stop()
+	backoff := chromeRetryInitialBackoff
+	err := cause
+	for {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-deadline.C:
+			log.Warnf("Chrome of VM %s (browser %q) still not available after %s: %v", vm.VMName, browserID, launch.Timeout, err)
+			return err
+		case <-time.After(backoff):
+		}
+		if err = retry(); err == nil {
+			log.Infof("Chrome of VM %s (browser %q) is available again", vm.VMName, browserID)
+			return nil
+		}
+		backoff = min(2*backoff, chromeRetryMaxBackoff)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestChromeLaunchesCooldown(t *testing.T) {
+	l := newChromeLaunches()
+	now := time.Now()
+	if !l.claim("vm1", "", time.Minute, now) {
+		t.Fatal("first restart not claimed")
+	}
+	if l.claim("vm1", "", time.Minute, now.Add(30*time.Second)) {
+		t.Error("restart claimed again within the cooldown")
+	}
+	if !l.claim("vm1", "profile2", time.Minute, now) || !l.claim("vm2", "", time.Minute, now) {
+		t.Error("restarts of other browsers not claimed")
+	}
+	if !l.claim("vm1", "", time.Minute, now.Add(time.Minute)) {
+		t.Error("restart not claimed after the cooldown")
+	}
+}
+
+// newLaunchingProxy starts a cdpServer restarting the unreachable browsers of
+// vm1, whose Chrome only comes up once restarted.
+func newLaunchingProxy(t *testing.T, enabled bool) (*httptest.Server, *testharness.FakeRESTAPI, *testharness.FakeChrome) {
+	t.Helper()
+	chrome := testharness.NewStoppedFakeChrome()
+	t.Cleanup(chrome.Close)
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	t.Cleanup(api.Close)
+	api.OnBrowserRestart(func(vmName string, browserID string) {
+		chrome.Start()
+	})
+
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.cfg = &config.CDPServerConfig{
+		ChromeLaunch: config.ChromeLaunchConfig{Enabled: enabled, Timeout: 5 * time.Second},
+	}
+	proxy := httptest.NewServer(s.router())
+	t.Cleanup(proxy.Close)
+	return proxy, api, chrome
+}
+
+func TestRelaunchChrome(t *testing.T) {
+	proxy, api, chrome := newLaunchingProxy(t, true)
+
+	resp, err := http.Get(proxy.URL + "/json/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /json/version = %d, want Chrome restarted", resp.StatusCode)
+	}
+	if got := api.BrowserRestarts("vm1"); !reflect.DeepEqual(got, []string{""}) {
+		t.Errorf("restarts = %q, want the default browser once", got)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/devtools/browser/x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if chrome.Connections() != 1 {
+		t.Errorf("connections = %d", chrome.Connections())
+	}
+	if got := api.BrowserRestarts("vm1"); len(got) != 1 {
+		t.Errorf("restarts = %q, want no restart of a reachable Chrome", got)
+	}
+}
+
+func TestRelaunchChromeDisabled(t *testing.T) {
+	proxy, api, _ := newLaunchingProxy(t, false)
+
+	resp, err := http.Get(proxy.URL + "/json/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET /json/version = %d, want 503", resp.StatusCode)
+	}
+	if got := api.BrowserRestarts("vm1"); len(got) != 0 {
+		t.Errorf("restarts = %q, want none", got)
+	}
+}
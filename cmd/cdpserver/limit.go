@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+// defaultSessionQueueTimeout bounds how long a session waits for a slot of
+// its VM unless configured otherwise.
+const defaultSessionQueueTimeout = 30 * time.Second
+
+// sessionLimitRetryAfter is the Retry-After, in seconds, of the 429s answered
+// when a VM has no slot for a session.
+const sessionLimitRetryAfter = "1"
+
+var (
+	// errSessionQueueFull is returned when a VM's sessions and queue are
+	// full.
+	errSessionQueueFull = errors.New("too many sessions with the VM's browser")
+	// errSessionQueueTimeout is returned when a session waited for a slot
+	// for too long.
+	errSessionQueueTimeout = errors.New("timed out waiting for a session with the VM's browser to end")
+)
+
+// vmSlots are the sessions of a VM and those waiting for one to end, in
+// arrival order.
+type vmSlots struct {
+	active int
+	queue  []chan struct{}
+}
+
+// sessionLimiter bounds the concurrent sessions of each VM, as configured
+// when they start or end.
+type sessionLimiter struct {
+	limit func() config.CDPSessionLimitConfig
+
+	mu  sync.Mutex
+	vms map[string]*vmSlots
+}
+
+func newSessionLimiter(limit func() config.CDPSessionLimitConfig) *sessionLimiter {
+	return &sessionLimiter{limit: limit, vms: make(map[string]*vmSlots)}
+}
+
+// acquire takes a slot for a session of vmName, waiting in the VM's queue
+// while it is full, and returns the function releasing it. It fails once
+// the queue is full, its timeout passed or ctx is done.
+func (l *sessionLimiter) acquire(ctx context.Context, vmName string) (func(), error) {
+	limit := l.limit()
+	l.mu.Lock()
+	v, ok := l.vms[vmName]
+	if !ok {
+		v = &vmSlots{}
+		l.vms[vmName] = v
+	}
+	// The limit may have been raised since the queue filled up.
+	l.dispatch(v, limit.MaxPerVM)
+	if len(v.queue) == 0 && (limit.MaxPerVM <= 0 || v.active < limit.MaxPerVM) {
+		v.active++
+		l.mu.Unlock()
+		return l.releaser(vmName), nil
+	}
+	if len(v.queue) >= limit.QueueSize {
+		l.mu.Unlock()
+		return nil, errSessionQueueFull
+	}
+	ready := make(chan struct{})
+	v.queue = append(v.queue, ready)
+	l.mu.Unlock()
+
+	timeout := limit.QueueTimeout
+	if timeout <= 0 {
+		timeout = defaultSessionQueueTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return l.releaser(vmName), nil
+	case <-timer.C:
+		err = errSessionQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range v.queue {
+		if w == ready {
+			v.queue = append(v.queue[:i], v.queue[i+1:]...)
+			l.forget(vmName, v)
+			return nil, err
+		}
+	}
+	// The slot was handed over meanwhile.
+	return l.releaser(vmName), nil
+}
+
+// releaser returns the function releasing a slot of vmName, once.
+func (l *sessionLimiter) releaser(vmName string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limit := l.limit()
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			v := l.vms[vmName]
+			v.active--
+			l.dispatch(v, limit.MaxPerVM)
+			l.forget(vmName, v)
+		})
+	}
+}
+
+// dispatch hands the free slots of v to the sessions waiting first. The
+// caller must hold mu.
+func (l *sessionLimiter) dispatch(v *vmSlots, max int) {
+	for len(v.queue) > 0 && (max <= 0 || v.active < max) {
+		close(v.queue[0])
+		v.queue = v.queue[1:]
+		v.active++
+	}
+}
+
+// forget drops the slots of a VM without sessions. The caller must hold mu.
+func (l *sessionLimiter) forget(vmName string, v *vmSlots) {
+	if v.active == 0 && len(v.queue) == 0 {
+		delete(l.vms, vmName)
+	}
+}
+
+// sessionLimit returns the configured session limit.
+func (s *cdpServer) sessionLimit() config.CDPSessionLimitConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cfg == nil {
+		return config.CDPSessionLimitConfig{}
+	}
+	return s.cfg.SessionLimit
+}
+
+// tooManySessions answers a session refused by the limiter with a 429.
+func tooManySessions(w http.ResponseWriter, vm VM, err error) {
+	w.Header().Set("Retry-After", sessionLimitRetryAfter)
+	http.Error(w, fmt.Sprintf("429 Too Many Requests - %v (VM: %s)", err, vm.VMName), http.StatusTooManyRequests)
+}
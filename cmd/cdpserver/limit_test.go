@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestSessionLimiterQueues(t *testing.T) {
+	limit := config.CDPSessionLimitConfig{MaxPerVM: 1, QueueSize: 2, QueueTimeout: time.Minute}
+	l := newSessionLimiter(func() config.CDPSessionLimitConfig { return limit })
+
+	release, err := l.acquire(context.Background(), "vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other VMs have slots of their own.
+	releaseOther, err := l.acquire(context.Background(), "vm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseOther()
+
+	// Waiting sessions are served in arrival order.
+	order := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		go func() {
+			release, err := l.acquire(context.Background(), "vm1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			release()
+		}()
+		waitForQueue(t, l, "vm1", i)
+	}
+	if _, err := l.acquire(context.Background(), "vm1"); !errors.Is(err, errSessionQueueFull) {
+		t.Fatalf("acquire with a full queue = %v, want errSessionQueueFull", err)
+	}
+
+	release()
+	release() // Releasing twice frees one slot only.
+	for want := 1; want <= 2; want++ {
+		if got := <-order; got != want {
+			t.Fatalf("session %d served before %d", got, want)
+		}
+	}
+	waitForQueue(t, l, "vm1", 0)
+}
+
+func TestSessionLimiterTimeout(t *testing.T) {
+	limit := config.CDPSessionLimitConfig{MaxPerVM: 1, QueueSize: 1, QueueTimeout: 10 * time.Millisecond}
+	l := newSessionLimiter(func() config.CDPSessionLimitConfig { return limit })
+	release, err := l.acquire(context.Background(), "vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(context.Background(), "vm1"); !errors.Is(err, errSessionQueueTimeout) {
+		t.Fatalf("acquire = %v, want errSessionQueueTimeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.acquire(ctx, "vm1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire = %v, want context.Canceled", err)
+	}
+
+	// Raising the limit on reload lets sessions in right away.
+	limit.MaxPerVM = 2
+	release2, err := l.acquire(context.Background(), "vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	release2()
+	if len(l.vms) != 0 {
+		t.Errorf("slots of idle VMs kept: %v", l.vms)
+	}
+}
+
+// waitForQueue waits until n sessions of vmName are queued.
+func waitForQueue(t *testing.T, l *sessionLimiter, vmName string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		var queued int
+		if v, ok := l.vms[vmName]; ok {
+			queued = len(v.queue)
+		}
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+	}
+	t.Fatalf("%d sessions of %s never queued", n, vmName)
+}
+
+func TestWebSocketProxySessionLimit(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{SessionLimit: config.CDPSessionLimitConfig{MaxPerVM: 1}})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	url := testharness.WebSocketURL(proxy.URL) + "/vm/vm1/devtools/page/fake-page"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second session = %v, %v, want a 429", resp, err)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+
+	// The slot is free again once the first session ended.
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial after the first session ended: %v", err)
+		}
+	}
+}
@@ -3,14 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -18,61 +20,161 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 
+	"github.com/abshkbh/arrakis/pkg/admin"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
 	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/handover"
+	"github.com/abshkbh/arrakis/pkg/listener"
+	"github.com/abshkbh/arrakis/pkg/mtls"
+	"github.com/abshkbh/arrakis/pkg/redact"
+	"github.com/abshkbh/arrakis/pkg/relay"
+	"github.com/abshkbh/arrakis/pkg/sdnotify"
+	"github.com/abshkbh/arrakis/pkg/tracing"
+	"github.com/abshkbh/arrakis/pkg/version"
 )
 
 const (
-	baseDir = "/tmp/cdpserver"
+	// Bounds the service health lookup when Chrome is unreachable.
+	serviceLookupTimeout = 2 * time.Second
+	// Bounds reporting a finished session for usage accounting.
+	sessionReportTimeout = 2 * time.Second
+	defaultRestAPIURL    = "http://127.0.0.1:7000"
 )
 
 type cdpServer struct {
-	port       string  // External port for our CDP server
-	restAPIURL string  // REST API URL to query VM info
+	port       string // External port for our CDP server
+	restAPIURL string // REST API URL to query VM info
+	restClient *http.Client
+	configFile string // Re-read on /admin/reload
+	sessions   admin.Sessions
+	routes     *routeTable
+	vms        *vmRegistry
+	launches   *chromeLaunches
+	handoffs   *handoffs
+	muxClients *muxClients
+	limits     *sessionLimiter
+	latency    *latencyStats
+	hars       *harCaptures
+
+	// The last VM list and its ETag, revalidated once the registry's copy
+	// expires so that it is only transferred again once it changed.
+	vmListMu   sync.Mutex
+	vmListETag string
+	vmListBody []byte
+
+	// logRedaction masks credentials in the logs, nil in tests.
+	logRedaction *redact.Hook
+
+	// Settings below can change on reload and are guarded by mu.
+	mu          sync.RWMutex
+	compression config.CompressionConfig
+	upgrader    websocket.Upgrader
+	dialer      websocket.Dialer
+	chaos       *relay.Chaos // Developer-only fault injection, nil when disabled
+	policies    *cdpPolicies
+	cfg         *config.CDPServerConfig
+	// redactor masks credentials in recorded sessions.
+	redactor *redact.Redactor
+	// eventSinks forward the events of the sessions off-box.
+	eventSinks []*eventSink
+	// tracer exports spans of the requests proxied, nil if disabled.
+	tracer *tracing.Tracer
 }
 
 // VM represents a VM from the REST API
 type VM struct {
+	VMID         string        `json:"vmId"`
 	VMName       string        `json:"vmName"`
 	Status       string        `json:"status"`
+	Owner        string        `json:"owner"`
 	IP           string        `json:"ip"`
 	PortForwards []PortForward `json:"portForwards"`
 }
 
 type PortForward struct {
-	Description string `json:"description"`
-	GuestPort   string `json:"guestPort"`
-	HostPort    string `json:"hostPort"`
+	Description string              `json:"description"`
+	GuestPort   string              `json:"guestPort"`
+	HostPort    string              `json:"hostPort"`
+	Service     *PortForwardService `json:"service"`
 }
 
-type VMResponse struct {
-	VMs []VM `json:"vms"`
+// PortForwardService is the guest service a port forward reaches, as the
+// restserver's port forwards declare it.
+type PortForwardService struct {
+	Name      string `json:"name"`
+	Protocol  string `json:"protocol"`
+	GuestPort string `json:"guestPort"`
+	Proxy     string `json:"proxy"`
 }
 
-// discoverCDPPort queries the REST API to find the dynamic CDP port for any running VM
-// If vmName is provided, it looks for that specific VM. Otherwise, returns the first available VM.
-func (s *cdpServer) discoverCDPPort(vmName string) (string, VM, error) {
-	resp, err := http.Get(s.restAPIURL + "/v1/vms")
-	if err != nil {
-		return "", VM{}, fmt.Errorf("failed to query VM API: %v", err)
+// browserID returns the ID of the browser the port forward reaches, "" being
+// the default one, and whether it reaches a browser to proxy.
+func (pf PortForward) browserID() (string, bool) {
+	if pf.Service == nil || pf.Service.Proxy != config.ServiceProxyCDP {
+		return "", false
 	}
-	defer resp.Body.Close()
+	if pf.Service.Name == config.DefaultBrowserService {
+		return "", true
+	}
+	return pf.Service.Name, true
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", VM{}, fmt.Errorf("failed to read response: %v", err)
+// errNoRunningVM is returned when a request names no VM and none is running
+// with CDP forwarded.
+var errNoRunningVM = errors.New("no running VM found with CDP port forwarding")
+
+// browserPort returns the port forward of the VM's browser browserID, ""
+// being the default browser.
+func (vm VM) browserPort(browserID string) (PortForward, bool) {
+	for _, pf := range vm.PortForwards {
+		log.Debugf("Port forward: guest:%s -> host:%s (%s)", pf.GuestPort, pf.HostPort, pf.Description)
+		if id, ok := pf.browserID(); ok && id == browserID {
+			return pf, true
+		}
 	}
+	return PortForward{}, false
+}
 
-	log.Debugf("VM API response: %s", string(body))
+// browsers returns the IDs of the VM's browsers, "" being the default one.
+func (vm VM) browsers() []string {
+	var ids []string
+	for _, pf := range vm.PortForwards {
+		if id, ok := pf.browserID(); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
 
-	var vmResponse VMResponse
-	if err := json.Unmarshal(body, &vmResponse); err != nil {
-		return "", VM{}, fmt.Errorf("failed to parse VM response: %v", err)
+type VMResponse struct {
+	VMs      []VM   `json:"vms"`
+	Revision string `json:"revision"`
+	// Delta is set when VMs only lists the VMs changed since a revision, and
+	// Removed the IDs of those removed.
+	Delta   bool     `json:"delta"`
+	Removed []string `json:"removed"`
+}
+
+// discoverCDPPort looks up the dynamic CDP port for any running VM in the VM registry
+// If vmName is provided, it looks for that specific VM. Otherwise, returns the first available VM.
+// browserID selects one of the VM's browsers, "" being the default one.
+func (s *cdpServer) discoverCDPPort(vmName string, browserID string) (string, VM, error) {
+	vms, err := s.lookupVMs(vmName)
+	if err != nil {
+		return "", VM{}, err
 	}
 
-	log.Infof("Found %d VMs in response", len(vmResponse.VMs))
+	candidates := vms.vms
+	if vmName != "" {
+		candidates = nil
+		if vm, ok := vms.byName[vmName]; ok {
+			candidates = []VM{vm}
+		}
+	}
+	log.Debugf("Found %d VMs in registry", len(vms.vms))
 
 	// Find the requested VM or first running VM with CDP port forwarding
-	for _, vm := range vmResponse.VMs {
+	for _, vm := range candidates {
 		log.Infof("Checking VM '%s' with status '%s'", vm.VMName, vm.Status)
 		if vm.Status == "RUNNING" {
 			// If specific VM requested, skip others
@@ -81,65 +183,290 @@ func (s *cdpServer) discoverCDPPort(vmName string) (string, VM, error) {
 			}
 			
 			log.Infof("VM '%s' has %d port forwards", vm.VMName, len(vm.PortForwards))
-			for _, pf := range vm.PortForwards {
-				log.Debugf("Port forward: guest:%s -> host:%s (%s)", pf.GuestPort, pf.HostPort, pf.Description)
-				if pf.GuestPort == "9223" && pf.Description == "cdp" {
-					log.Infof("Found running VM '%s' with CDP port forwarded from guest:%s to host:%s", 
-						vm.VMName, pf.GuestPort, pf.HostPort)
-					return pf.HostPort, vm, nil
-				}
+			if pf, ok := vm.browserPort(browserID); ok {
+				log.Infof("Found running VM '%s' with CDP port forwarded from guest:%s to host:%s", 
+					vm.VMName, pf.GuestPort, pf.HostPort)
+				return pf.HostPort, vm, nil
 			}
 		}
 	}
 
+	if browserID != "" {
+		if vmName != "" {
+			return "", VM{}, fmt.Errorf("VM '%s' not found or not running with browser '%s'", vmName, browserID)
+		}
+		return "", VM{}, fmt.Errorf("no running VM found with browser '%s'", browserID)
+	}
 	if vmName != "" {
 		return "", VM{}, fmt.Errorf("VM '%s' not found or not running with CDP", vmName)
 	}
-	return "", VM{}, fmt.Errorf("no running VM found with CDP port forwarding")
+	return "", VM{}, errNoRunningVM
+}
+
+// fetchVMList returns the VM list of the REST API, reusing the last one while
+// its ETag still matches.
+func (s *cdpServer) fetchVMList() ([]byte, error) {
+	timeout, _, _ := s.discoveryConfig()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", s.restAPIURL+"/v1/vms", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create VM API request: %v", err)
+	}
+	s.vmListMu.Lock()
+	etag, cached := s.vmListETag, s.vmListBody
+	s.vmListMu.Unlock()
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := s.restClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query VM API: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("VM API responded with status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		s.vmListMu.Lock()
+		s.vmListETag, s.vmListBody = etag, body
+		s.vmListMu.Unlock()
+	}
+	return body, nil
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for development
-	},
+// newCDPServer creates a CDP proxy whose client and upstream WebSocket legs are
+// configured according to the given compression settings.
+func newCDPServer(port string, restAPIURL string, compression config.CompressionConfig) *cdpServer {
+	s := &cdpServer{
+		port:       port,
+		restAPIURL: restAPIURL,
+		restClient: http.DefaultClient,
+		routes:     newRouteTable(),
+		vms:        newVMRegistry(),
+		launches:   newChromeLaunches(),
+		handoffs:   newHandoffs(),
+		muxClients: newMuxClients(),
+		latency:    newLatencyStats(),
+		hars:       newHARCaptures(),
+	}
+	s.limits = newSessionLimiter(s.sessionLimit)
+	s.setCompression(compression)
+	return s
 }
 
-// WebSocket proxy handler for DevTools connections
-func (s *cdpServer) websocketProxy(w http.ResponseWriter, r *http.Request, hostPort string, vm VM) {
-	log.Infof("WebSocket connection request: %s", r.URL.Path)
-	
-	// Upgrade the HTTP connection to WebSocket
-	clientConn, err := upgrader.Upgrade(w, r, nil)
+// setCompression rebuilds the upgrader and dialer for compression. The caller
+// must hold mu if the server is already serving.
+func (s *cdpServer) setCompression(compression config.CompressionConfig) {
+	dialer := *websocket.DefaultDialer
+	// With "passthrough" Chrome is asked for permessage-deflate too. With
+	// "recompress" the upstream leg stays plain and only the client leg is
+	// compressed by us.
+	dialer.EnableCompression = compression.Enabled &&
+		compression.Upstream == config.CompressionUpstreamPassthrough
+
+	s.compression = compression
+	s.upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true // Allow all origins for development
+		},
+		EnableCompression: compression.Enabled,
+	}
+	s.dialer = dialer
+}
+
+// applyConfig installs the settings of cfg that can change while serving.
+// Sessions already in progress keep the settings they started with.
+func (s *cdpServer) applyConfig(cfg *config.CDPServerConfig) {
+	chaos := relay.NewChaos(cfg.Chaos)
+	// The policies were validated with the config.
+	policies, err := compilePolicies(cfg.Policies, cfg.Tenants)
 	if err != nil {
-		log.Errorf("Failed to upgrade WebSocket: %v", err)
+		log.WithError(err).Error("Invalid CDP policies")
+	}
+	// So were the redaction patterns.
+	redactor, err := redact.New(cfg.Redaction)
+	if err != nil {
+		log.WithError(err).Error("Invalid redaction patterns")
+	} else if s.logRedaction != nil {
+		s.logRedaction.Set(redactor)
+	}
+
+	s.vms.setTTL(cfg.VMCache.TTL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setCompression(cfg.Compression)
+	s.chaos = chaos
+	s.policies = policies
+	s.setEventSinks(cfg.EventSinks)
+	s.setTracer(cfg.Tracing)
+	s.cfg = cfg
+	s.redactor = redactor
+}
+
+// Reload re-reads the config file. The port and listeners are bound at startup
+// and changes to them only take effect after a restart.
+func (s *cdpServer) Reload() error {
+	cfg, err := config.GetCDPServerConfig(s.configFile)
+	if err != nil {
+		return err
+	}
+	if err := validateAuth(cfg.Auth); err != nil {
+		return err
+	}
+	if _, err := compilePolicies(cfg.Policies, cfg.Tenants); err != nil {
+		return err
+	}
+	if err := validateNoVMFallback(cfg.NoVMFallback); err != nil {
+		return err
+	}
+	if err := validateRecording(cfg); err != nil {
+		return err
+	}
+	if err := validateLatencyProbe(cfg.LatencyProbe); err != nil {
+		return err
+	}
+	if err := validateEventSinks(cfg.EventSinks); err != nil {
+		return err
+	}
+	if err := validateTracing(cfg.Tracing); err != nil {
+		return err
+	}
+	if err := validateDiscovery(cfg); err != nil {
+		return err
+	}
+	if _, err := redact.New(cfg.Redaction); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	current := s.cfg
+	s.mu.RUnlock()
+	if current != nil && (cfg.Port != current.Port || cfg.Host != current.Host ||
+		cfg.Interface != current.Interface || cfg.TLS != current.TLS ||
+		fmt.Sprint(cfg.Listeners) != fmt.Sprint(current.Listeners) ||
+		fmt.Sprint(cfg.Admin.Tokens) != fmt.Sprint(current.Admin.Tokens) ||
+		cfg.VMCache.Watch != current.VMCache.Watch || cfg.RestAPIURL != current.RestAPIURL ||
+		fmt.Sprint(cfg.MTLS) != fmt.Sprint(current.MTLS)) {
+		log.Warn("Address, listener, TLS, admin, VM watch and REST API changes need a restart and were not applied")
+	}
+
+	s.applyConfig(cfg)
+	log.Infof("cdp server config reloaded: %v", cfg)
+	return nil
+}
+
+// Config describes the settings in effect.
+func (s *cdpServer) Config() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cfg == nil {
+		return fmt.Sprintf("{Compression: %v}", s.compression)
+	}
+	return s.cfg.String()
+}
+
+// configureCompression applies the configured compression level to a
+// connection. It is a no-op unless permessage-deflate was negotiated.
+func configureCompression(conn *websocket.Conn, compression config.CompressionConfig) {
+	if !compression.Enabled || compression.Level == 0 {
 		return
 	}
-	defer func() {
-		if err := clientConn.Close(); err != nil {
-			log.Debugf("Error closing client connection: %v", err)
-		}
-	}()
+	if err := conn.SetCompressionLevel(compression.Level); err != nil {
+		log.Warnf("Invalid compression level %d: %v", compression.Level, err)
+	}
+}
 
-	// Extract the target path - Chrome expects the same path structure
-	targetPath := r.URL.Path
+// upstreamPath returns the path and query to request from Chrome. The
+// "/vm/{vmName}" and "/browser/{browserId}" route prefixes and the "vm" and
+// "browser" query parameters only select the VM and its browser and are not
+// forwarded.
+func upstreamPath(r *http.Request) string {
+	path := r.URL.Path
+	if vmName, ok := mux.Vars(r)["vmName"]; ok {
+		path = strings.TrimPrefix(path, "/vm/"+vmName)
+	}
+	if browserID, ok := mux.Vars(r)["browserId"]; ok {
+		path = strings.TrimPrefix(path, "/browser/"+browserID)
+	}
 	if r.URL.RawQuery != "" {
-		// Remove vm parameter from forwarded query string
+		// Remove the vm and browser parameters and the listener auth token from forwarded query string
 		values := r.URL.Query()
 		values.Del("vm")
+		values.Del("browser")
+		values.Del("token")
+		values.Del("har")
 		if len(values) > 0 {
-			targetPath += "?" + values.Encode()
+			path += "?" + values.Encode()
 		}
 	}
+	return path
+}
+
+// WebSocket proxy handler for DevTools connections
+func (s *cdpServer) websocketProxy(w http.ResponseWriter, r *http.Request, hostPort string, vm VM, browserID string) {
+	log.Infof("WebSocket connection request: %s", r.URL.Path)
+
+	if !s.sessions.Enter() {
+		log.Infof("Draining, refusing WebSocket session from %s", r.RemoteAddr)
+		http.Error(w, "503 Service Unavailable - draining", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.sessions.Leave()
+
+	release, err := s.limits.acquire(r.Context(), vm.VMName)
+	if err != nil {
+		log.Infof("Refusing WebSocket session from %s with VM %s: %v", r.RemoteAddr, vm.VMName, err)
+		tooManySessions(w, vm, err)
+		return
+	}
+	defer release()
+
+	s.mu.RLock()
+	upgrader, dialer, compression, chaos, tracer := s.upgrader, s.dialer, s.compression, s.chaos, s.tracer
+	var keepalive config.CDPKeepaliveConfig
+	if s.cfg != nil {
+		keepalive = s.cfg.Keepalive
+	}
+	s.mu.RUnlock()
+
+	// Extract the target path - Chrome expects the same path structure
+	targetPath := upstreamPath(r)
 
 	// Use the discovered host port forward for consistent routing
 	chromeURL := fmt.Sprintf("ws://127.0.0.1:%s%s", hostPort, targetPath)
 	log.Infof("Proxying WebSocket via port forward: %s (VM: %s)", chromeURL, vm.VMName)
 
-	chromeConn, _, err := websocket.DefaultDialer.Dial(chromeURL, nil)
+	// Connect to Chrome before upgrading so that failures can still be
+	// reported as a plain HTTP error. The handshake carries the trace
+	// context on to the browser.
+	dialCtx, dialSpan := tracer.Start(r.Context(), spanDial, tracing.KindClient)
+	dialHeader := http.Header{}
+	tracing.Inject(dialCtx, dialHeader)
+	chromeConn, _, err := dialer.Dial(chromeURL, dialHeader)
+	if err != nil {
+		err = s.relaunchChrome(r.Context(), vm, browserID, err, func() error {
+			var dialErr error
+			chromeConn, _, dialErr = dialer.Dial(chromeURL, dialHeader)
+			return dialErr
+		})
+	}
+	dialSpan.SetError(err)
+	dialSpan.End()
 	if err != nil {
 		log.Errorf("Failed to connect to Chrome DevTools at %s: %v", chromeURL, err)
-		// Send close message to client instead of just returning
-		clientConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1002, "Chrome not available"))
+		tracing.FromContext(r.Context()).SetError(err)
+		s.chromeUnavailable(w, r, vm, browserID, err)
 		return
 	}
 	defer func() {
@@ -147,89 +474,156 @@ func (s *cdpServer) websocketProxy(w http.ResponseWriter, r *http.Request, hostP
 			log.Debugf("Error closing Chrome connection: %v", err)
 		}
 	}()
+	configureCompression(chromeConn, compression)
+	defer relay.Keepalive(chromeConn, keepalive.Chrome)()
+
+	devtools, _, _ := strings.Cut(targetPath, "?")
+	har := s.startHAR(r, vm.VMName, devtools)
+	var header http.Header
+	if har != nil {
+		defer func() { har.ended(time.Now()) }()
+		header = http.Header{harSessionHeader: {har.session.ID}}
+	}
 
-	log.Infof("Successfully connected to Chrome DevTools, starting proxy")
-
-	// Proxy messages in both directions
-	done := make(chan struct{})
-	var doneOnce sync.Once // Ensure channel is closed only once
-
-	// Client -> Chrome
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Errorf("Panic in client->chrome proxy: %v", r)
-			}
-			doneOnce.Do(func() { close(done) })
-		}()
-		for {
-			messageType, data, err := clientConn.ReadMessage()
-			if err != nil {
-				log.Debugf("Client connection closed: %v", err)
-				return
-			}
-			if err := chromeConn.WriteMessage(messageType, data); err != nil {
-				log.Debugf("Failed to write to Chrome: %v", err)
-				return
-			}
+	// Upgrade the HTTP connection to WebSocket
+	clientConn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		log.Errorf("Failed to upgrade WebSocket: %v", err)
+		return
+	}
+	defer func() {
+		if err := clientConn.Close(); err != nil {
+			log.Debugf("Error closing client connection: %v", err)
 		}
 	}()
+	configureCompression(clientConn, compression)
+	defer relay.Keepalive(clientConn, keepalive.Client)()
 
-	// Chrome -> Client
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Errorf("Panic in chrome->client proxy: %v", r)
-			}
-			doneOnce.Do(func() { close(done) })
-		}()
-		for {
-			messageType, data, err := chromeConn.ReadMessage()
-			if err != nil {
-				log.Debugf("Chrome connection closed: %v", err)
-				return
-			}
-			if err := clientConn.WriteMessage(messageType, data); err != nil {
-				log.Debugf("Failed to write to client: %v", err)
-				return
-			}
-		}
-	}()
+	log.Infof("Successfully connected to Chrome DevTools, starting proxy")
 
-	// Wait for either connection to close
-	<-done
+	start := time.Now()
+	untrack := s.routes.track(vm.VMName, &routedConn{
+		target: targetID(devtools),
+		remote: r.RemoteAddr,
+		start:  start,
+		close: func(code int, text string) {
+			closeWithFrame(clientConn, code, text)
+			closeWithFrame(chromeConn, websocket.CloseNormalClosure, "")
+		},
+	})
+	defer untrack()
+	recorder := s.startRecording(vm.VMName, targetID(devtools))
+	defer recorder.close()
+	_, sessionSpan := tracer.Start(r.Context(), spanSession, tracing.KindInternal)
+	sessionSpan.SetAttribute("cdp.target", targetID(devtools))
+	defer sessionSpan.End()
+	relay.ProbedWebSockets(clientConn, chromeConn, chaos, s.sessionFilter(vm.VMName, r.RemoteAddr, clientConn), relay.Taps(s.eventTap(vm.VMName, targetID(devtools)), recorder.tap()), relay.Probers(s.latencyProber(vm.VMName), har.prober()))
 	log.Debug("WebSocket proxy connection closed")
+	s.reportSession(vm, time.Since(start))
 }
 
-// Health check endpoint
-func (s *cdpServer) healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"status": "healthy", "service": "cdp"}`)
+// reportSession tells the REST API how long a CDP session lasted so that it is
+// accounted to the VM.
+func (s *cdpServer) reportSession(vm VM, d time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionReportTimeout)
+	defer cancel()
+	sessionsURL := fmt.Sprintf("%s/v1/vms/%s/sessions", s.restAPIURL, url.PathEscape(vm.VMName))
+	if err := cmdserver.ReportSession(ctx, s.restClient, sessionsURL, cmdserver.SessionCDP, d); err != nil {
+		log.Warnf("Failed to report CDP session of VM %s: %v", vm.VMName, err)
+	}
+}
+
+// chromeUnavailable answers a request the VM's browser browserID could not be
+// reached for with a 503. The reason is the browser service's health as
+// reported by the guest, e.g. "browser: starting", falling back to the
+// connection error.
+func (s *cdpServer) chromeUnavailable(w http.ResponseWriter, r *http.Request, vm VM, browserID string, err error) {
+	reason := fmt.Sprintf("Chrome not available: %v", err)
+	var guestPort int
+	if pf, ok := vm.browserPort(browserID); ok {
+		if port, err := strconv.Atoi(pf.GuestPort); err == nil {
+			guestPort = port
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), serviceLookupTimeout)
+	defer cancel()
+	servicesURL := fmt.Sprintf("%s/v1/vms/%s/services", s.restAPIURL, url.PathEscape(vm.VMName))
+	services, lookupErr := cmdserver.FetchServices(ctx, s.restClient, servicesURL)
+	if lookupErr != nil {
+		log.Debugf("Failed to look up services of VM %s: %v", vm.VMName, lookupErr)
+	} else if h, ok := cmdserver.ServiceOnPort(services, guestPort); ok && h.State != cmdserver.ServiceUp {
+		reason = h.String()
+	}
+	http.Error(w, "503 Service Unavailable - "+reason, http.StatusServiceUnavailable)
 }
 
 // proxyHandler handles all CDP requests and proxies them to the appropriate VM
 func (s *cdpServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract VM name from URL path if present
-	var vmName string
+	// Traced as part of the client's trace, if it sent one.
+	tracer := s.currentTracer()
+	ctx, span := tracer.Start(tracing.Extract(r.Context(), r.Header), spanProxy, tracing.KindServer)
+	defer span.End()
+	r = r.WithContext(ctx)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("cdp.websocket", websocket.IsWebSocketUpgrade(r))
+
+	// Extract VM name and browser from URL path if present
+	var vmName, browserID string
 	vars := mux.Vars(r)
 	if name, exists := vars["vmName"]; exists {
 		vmName = name
 	}
+	if id, exists := vars["browserId"]; exists {
+		browserID = id
+	}
 	
-	// Also check for VM in query parameters
+	// Also check for VM and browser in query parameters
 	if vmQuery := r.URL.Query().Get("vm"); vmQuery != "" {
 		vmName = vmQuery
 	}
+	if browserQuery := r.URL.Query().Get("browser"); browserQuery != "" {
+		browserID = browserQuery
+	}
+
+	// Targets listed by a VM's Chrome are routed back to that VM and
+	// browser, as their webSocketDebuggerUrl doesn't name them.
+	if vmName == "" && browserID == "" {
+		if routed, ok := s.routes.lookup(r.URL.Path); ok {
+			vmName, browserID = routed.vm, routed.browserID
+		}
+	}
+	vmName, err := grantFromContext(r.Context()).authorize(vmName)
+	if err != nil {
+		span.SetError(err)
+		log.Warnf("Rejected DevTools request from %s for %s: %v", r.RemoteAddr, r.URL.Path, err)
+		http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
+		return
+	}
 
 	// Discover the CDP port for the VM
-	hostPort, vm, err := s.discoverCDPPort(vmName)
+	_, discovery := tracer.Start(ctx, spanDiscovery, tracing.KindInternal)
+	hostPort, vm, err := s.discoverCDPPort(vmName, browserID)
+	discovery.SetError(err)
+	discovery.End()
+	span.SetError(err)
+	if errors.Is(err, errNoRunningVM) {
+		log.Debugf("No running VM for %s", r.URL.Path)
+		s.noVMFallback(w, r, err)
+		return
+	}
 	if err != nil {
 		log.Errorf("Failed to discover CDP port: %v", err)
 		http.Error(w, fmt.Sprintf("503 Service Unavailable - %v", err), http.StatusServiceUnavailable)
 		return
 	}
 
+	span.SetAttribute("vm.name", vm.VMName)
+	if browserID != "" {
+		span.SetAttribute("cdp.browser", browserID)
+	}
+	span.SetAttribute("cdp.host_port", hostPort)
 	if vmName != "" {
 		log.Infof("Proxying request to VM '%s' via port forward %s", vmName, hostPort)
 	} else {
@@ -238,157 +632,184 @@ func (s *cdpServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Handle WebSocket upgrade
 	if websocket.IsWebSocketUpgrade(r) {
-		s.websocketProxy(w, r, hostPort, vm)
+		if sess, ok := s.handoffs.parkedIn(r.URL.Path, time.Now()); ok {
+			log.Infof("Refused DevTools connection from %s to %s, parked in session %q", r.RemoteAddr, r.URL.Path, sess.Label)
+			span.SetAttribute("cdp.parked", true)
+			http.Error(w, fmt.Sprintf("423 Locked - the target is parked in session %q until resumed", sess.Label), http.StatusLocked)
+			return
+		}
+		s.websocketProxy(w, r, hostPort, vm, browserID)
 		return
 	}
 
 	// Handle HTTP requests - Use port forward for consistent routing
 	// The forwarder service makes Chrome's 9222 available on 9223 with 0.0.0.0 binding
-	targetURL := fmt.Sprintf("http://127.0.0.1:%s%s", hostPort, r.URL.Path)
-	if r.URL.RawQuery != "" {
-		// Remove vm parameter from forwarded query string
-		values := r.URL.Query()
-		values.Del("vm")
-		if len(values) > 0 {
-			targetURL += "?" + values.Encode()
-		}
-	}
-	
-	log.Infof("Proxying HTTP request via port forward: %s (VM: %s)", targetURL, vm.VMName)
-	
-	// Create HTTP request to the port-forwarded Chrome instance
-	req, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		log.Errorf("Failed to create proxy request: %v", err)
-		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
-		return
-	}
-	
-	// Copy headers (excluding Host)
-	for key, values := range r.Header {
-		if key != "Host" {
-			for _, value := range values {
-				req.Header.Add(key, value)
-			}
-		}
-	}
-	
-	// Execute the request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	s.httpProxy(r, hostPort, vm, browserID).ServeHTTP(w, r)
+}
+
+// browserInfo is a browser of a VM listed by /vm/{vmName}/browsers.
+type browserInfo struct {
+	// ID is "" for the default browser, served on the VM's own routes.
+	ID        string `json:"id"`
+	GuestPort string `json:"guestPort"`
+	HostPort  string `json:"hostPort"`
+	// Path is the prefix of the browser's DevTools routes.
+	Path string `json:"path"`
+}
+
+// browsersHandler lists the browsers of a VM.
+func (s *cdpServer) browsersHandler(w http.ResponseWriter, r *http.Request) {
+	vmName, err := grantFromContext(r.Context()).authorize(mux.Vars(r)["vmName"])
 	if err != nil {
-		log.Errorf("Failed to proxy request to VM %s: %v", vm.VMName, err)
-		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
 		return
 	}
-	defer resp.Body.Close()
-	
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	_, vm, err := s.discoverCDPPort(vmName, "")
 	if err != nil {
-		log.Errorf("Failed to read response body: %v", err)
-		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
-		return
+		// The VM may only run named browsers.
+		vms, lookupErr := s.lookupVMs(vmName)
+		if lookupErr != nil {
+			http.Error(w, fmt.Sprintf("503 Service Unavailable - %v", lookupErr), http.StatusServiceUnavailable)
+			return
+		}
+		var ok bool
+		if vm, ok = vms.byName[vmName]; !ok || vm.Status != "RUNNING" {
+			http.Error(w, fmt.Sprintf("404 Not Found - VM '%s' not found or not running", vmName), http.StatusNotFound)
+			return
+		}
 	}
-	
-	log.Infof("Received response from Chrome: %d bytes", len(body))
 
-	// Fix WebSocket URLs in the JSON to point to our CDP server for external access
-	// Replace Chrome's internal URLs with our proxy URLs
-	hostURL := r.Host
-	if hostURL == "" {
-		// If no Host header, use localhost with our CDP server port
-		hostURL = fmt.Sprintf("localhost:%s", s.port)
-	}
-	
-	// Get the response as string and rewrite URLs
-	jsonOutput := string(body)
-	
-	// Find the forwarded port for URL rewriting
-	// Chrome runs on 9222, but forwarder makes it accessible on 9223
-	// Chrome's JSON responses will contain the forwarded port (9223) in WebSocket URLs
-	forwardedPort := "9223"
-	for _, pf := range vm.PortForwards {
-		if pf.Description == "cdp" {
-			forwardedPort = pf.GuestPort // This will be 9223 (the forwarded port)
-			break
-		}
+	browsers := []browserInfo{}
+	for _, id := range vm.browsers() {
+		pf, _ := vm.browserPort(id)
+		rewriter := urlRewriter{vmName: vm.VMName, browserID: id}
+		browsers = append(browsers, browserInfo{ID: id, GuestPort: pf.GuestPort, HostPort: pf.HostPort, Path: rewriter.vmPath("")})
 	}
-	
-	// Replace Chrome's WebSocket URLs with our CDP server URLs
-	// Handle both /devtools/ and /devtools/browser/ patterns dynamically
-	// Chrome responses will contain URLs with the forwarded port (9223), not the original port (9222)
-	chromePattern := fmt.Sprintf("127.0.0.1:%s", forwardedPort)
-	jsonOutput = strings.ReplaceAll(jsonOutput, fmt.Sprintf("ws://%s/devtools/", chromePattern), fmt.Sprintf("ws://%s/devtools/", hostURL))
-	jsonOutput = strings.ReplaceAll(jsonOutput, fmt.Sprintf("\"ws=%s/devtools/", chromePattern), fmt.Sprintf("\"ws=%s/devtools/", hostURL))
-	// Also replace the full pattern for any WebSocket URLs
-	jsonOutput = strings.ReplaceAll(jsonOutput, fmt.Sprintf("ws://%s", chromePattern), fmt.Sprintf("ws://%s", hostURL))
-	// Fix DevTools frontend URLs in query parameters
-	jsonOutput = strings.ReplaceAll(jsonOutput, fmt.Sprintf("?ws=%s/devtools/", chromePattern), fmt.Sprintf("?ws=%s/devtools/", hostURL))
-	
-	log.Infof("Rewritten JSON for external access: %q", jsonOutput)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(browsers)
+}
 
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+// wsScheme returns the scheme of the WebSocket URLs clients reach the proxy
+// with: wss when TLS is terminated here or, as X-Forwarded-Proto says, by a
+// proxy in front, ws otherwise.
+func wsScheme(r *http.Request) string {
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		return "wss"
 	}
-	
-	// Set status code and write response
-	w.WriteHeader(resp.StatusCode)
-	w.Write([]byte(jsonOutput))
+	return "ws"
 }
 
-// CDP endpoints proxy
-func (s *cdpServer) versionHandler(w http.ResponseWriter, r *http.Request) {
-	host := r.Host
-	if host == "" {
-		host = fmt.Sprintf("localhost:%s", s.port) // Use configured port
+// noVMRetryAfter is the Retry-After, in seconds, of the 503s answered while
+// no VM is running.
+const noVMRetryAfter = "5"
+
+// validateNoVMFallback checks the no_vm_fallback mode of the config.
+func validateNoVMFallback(mode string) error {
+	switch mode {
+	case "", config.CDPNoVMUnavailable, config.CDPNoVMEmpty:
+		return nil
 	}
-	
-	response := map[string]interface{}{
-		"Browser":              "Chromium/120.0.0.0",
-		"Protocol-Version":     "1.3",
-		"User-Agent":           "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36",
-		"V8-Version":           "12.0.267.17",
-		"WebKit-Version":       "537.36",
-		"webSocketDebuggerUrl": fmt.Sprintf("ws://%s/devtools/browser/", host),
+	return fmt.Errorf("no_vm_fallback must be %s or %s", config.CDPNoVMUnavailable, config.CDPNoVMEmpty)
+}
+
+// noVMFallback answers a request naming no VM while no VM is running, as
+// configured: a 503 clients can retry after a while or, in "empty" mode, no
+// targets for /json and /json/list, so that clients polling for targets
+// wait for one rather than fail. Nothing is made up about a browser that
+// isn't there: /json/version, which clients negotiate the protocol with, is
+// always a 503.
+func (s *cdpServer) noVMFallback(w http.ResponseWriter, r *http.Request, err error) {
+	s.mu.RLock()
+	var mode string
+	if s.cfg != nil {
+		mode = s.cfg.NoVMFallback
 	}
+	s.mu.RUnlock()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	p, _, _ := strings.Cut(upstreamPath(r), "?")
+	if mode == config.CDPNoVMEmpty && !websocket.IsWebSocketUpgrade(r) && (p == "/json" || p == "/json/list") {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]\n"))
+		return
+	}
+	w.Header().Set("Retry-After", noVMRetryAfter)
+	http.Error(w, fmt.Sprintf("503 Service Unavailable - %v", err), http.StatusServiceUnavailable)
 }
 
-func (s *cdpServer) listHandler(w http.ResponseWriter, r *http.Request) {
-	host := r.Host
-	if host == "" {
-		host = fmt.Sprintf("localhost:%s", s.port) // Use configured port consistently
-	}
-	
-	response := []map[string]interface{}{
-		{
-			"description":          "",
-			"devtoolsFrontendUrl":  fmt.Sprintf("/devtools/inspector.html?ws=%s/devtools/page/", host),
-			"id":                   "page_1",
-			"title":                "New Tab",
-			"type":                 "page",
-			"url":                  "about:blank",
-			"webSocketDebuggerUrl": fmt.Sprintf("ws://%s/devtools/page/page_1", host),
-		},
+// router registers all CDP routes with VM selection support.
+func (s *cdpServer) router() *mux.Router {
+	r := mux.NewRouter()
+	r.StrictSlash(true) // Automatically handle trailing slashes
+
+	// Register CDP routes with VM selection support
+	r.HandleFunc("/health", s.healthCheck).Methods("GET")
+
+	// Runtime control, only enabled with admin tokens configured
+	if s.cfg != nil {
+		admin.Register(r, s.cfg.Admin, "cdp", s, &s.sessions)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	// DevTools endpoints, requiring a token when auth is configured
+	proxy := s.requireAuth(s.proxyHandler)
+
+	// Several targets over one WebSocket, only served when enabled
+	r.HandleFunc("/mux", s.requireAuth(s.muxHandler)).Methods("GET")
+	
+	// VM-specific routes (e.g., /vm/testsandbox/json/version)
+	r.HandleFunc("/vm/{vmName}/json/version", proxy).Methods("GET")
+	r.HandleFunc("/vm/{vmName}/json", proxy).Methods("GET")
+	r.HandleFunc("/vm/{vmName}/json/list", proxy).Methods("GET")
+	r.PathPrefix("/vm/{vmName}/devtools/").HandlerFunc(proxy)
+
+	// Screenshots of a VM's page, over a DevTools session of their own
+	r.HandleFunc("/vm/{vmName}/screenshot", s.requireAuth(s.screenshotHandler)).Methods("GET")
+
+	// Network requests of the VM's sessions captured as HAR files
+	r.HandleFunc("/vm/{vmName}/sessions", s.requireAuth(s.harSessionsHandler)).Methods("GET")
+	r.HandleFunc("/vm/{vmName}/sessions/{id}/har", s.requireAuth(s.harHandler)).Methods("GET")
+
+	// Routes of one of several browsers of a VM, forwarded as
+	// "cdp:<browserId>" (e.g., /vm/testsandbox/browser/profile2/json/version)
+	r.HandleFunc("/vm/{vmName}/browsers", s.requireAuth(s.browsersHandler)).Methods("GET")
+	r.HandleFunc("/vm/{vmName}/browser/{browserId}/json/version", proxy).Methods("GET")
+	r.HandleFunc("/vm/{vmName}/browser/{browserId}/json", proxy).Methods("GET")
+	r.HandleFunc("/vm/{vmName}/browser/{browserId}/json/list", proxy).Methods("GET")
+	r.PathPrefix("/vm/{vmName}/browser/{browserId}/devtools/").HandlerFunc(proxy)
+	
+	// Default routes (first available VM)
+	r.HandleFunc("/json/version", proxy).Methods("GET")
+	r.HandleFunc("/json", proxy).Methods("GET")
+	r.HandleFunc("/json/list", proxy).Methods("GET")
+	r.PathPrefix("/devtools/").HandlerFunc(proxy)
+
+	// Targets of every running VM, for dashboards of the whole fleet
+	r.HandleFunc("/all/json/list", s.requireAuth(s.allListHandler)).Methods("GET")
+
+	// Sessions parked by a client for another to resume
+	r.HandleFunc("/v1/cdp/sessions", s.requireAuth(s.parkHandler)).Methods("POST")
+	r.HandleFunc("/v1/cdp/sessions", s.requireAuth(s.sessionsHandler)).Methods("GET")
+	r.HandleFunc("/v1/cdp/sessions/{handle}", s.requireAuth(s.sessionHandler)).Methods("GET")
+	r.HandleFunc("/v1/cdp/sessions/{handle}", s.requireAuth(s.discardSessionHandler)).Methods("DELETE")
+	r.HandleFunc("/v1/cdp/sessions/{handle}/resume", s.requireAuth(s.resumeHandler)).Methods("POST")
+
+	// Recorded sessions
+	r.HandleFunc("/v1/cdp/recordings", s.requireAuth(s.recordingsHandler)).Methods("GET")
+	r.HandleFunc("/v1/cdp/recordings/{vmName}/{recording}", s.requireAuth(s.recordingHandler)).Methods("GET")
+
+	// Latency of the sessions against the SLO, measured by the probes
+	r.HandleFunc("/v1/cdp/latency", s.requireAuth(s.latencyHandler)).Methods("GET")
+	return r
 }
 
 func main() {
 	var cdpConfig *config.CDPServerConfig
+	var logRedaction *redact.Hook
 	var configFile string
 
 	app := &cli.App{
-		Name:  "arrakis-cdpserver",
-		Usage: "Chrome DevTools Protocol server for browser automation",
+		Name:    "arrakis-cdpserver",
+		Usage:   "Chrome DevTools Protocol server for browser automation",
+		Version: version.Version,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "config",
@@ -398,12 +819,43 @@ func main() {
 				Value:       "./config.yaml",
 			},
 		},
+		Commands: []*cli.Command{replayCommand()},
 		Action: func(ctx *cli.Context) error {
 			var err error
 			cdpConfig, err = config.GetCDPServerConfig(configFile)
 			if err != nil {
 				return fmt.Errorf("cdp server config not found: %v", err)
 			}
+			if err := validateAuth(cdpConfig.Auth); err != nil {
+				return err
+			}
+			if _, err := compilePolicies(cdpConfig.Policies, cdpConfig.Tenants); err != nil {
+				return err
+			}
+			if err := validateNoVMFallback(cdpConfig.NoVMFallback); err != nil {
+				return err
+			}
+			if err := validateRecording(cdpConfig); err != nil {
+				return err
+			}
+			if err := validateLatencyProbe(cdpConfig.LatencyProbe); err != nil {
+				return err
+			}
+			if err := validateEventSinks(cdpConfig.EventSinks); err != nil {
+				return err
+			}
+			if err := validateTracing(cdpConfig.Tracing); err != nil {
+				return err
+			}
+			if err := validateDiscovery(cdpConfig); err != nil {
+				return err
+			}
+			redactor, err := redact.New(cdpConfig.Redaction)
+			if err != nil {
+				return fmt.Errorf("redaction: %v", err)
+			}
+			logRedaction = redact.NewHook(redactor)
+			log.AddHook(logRedaction)
 			log.Infof("cdp server config: %v", cdpConfig)
 			return nil
 		},
@@ -413,18 +865,33 @@ func main() {
 	if err != nil {
 		log.WithError(err).Fatal("cdp server exited with error")
 	}
+	if cdpConfig == nil {
+		// --help, --version or a subcommand was handled by the CLI.
+		return
+	}
 
-	// Ensure base directory exists
-	err = os.MkdirAll(baseDir, os.ModePerm)
-	if err != nil {
-		log.Fatalf("Failed to create base directory: %v", err)
+	restAPIURL := cdpConfig.RestAPIURL
+	if restAPIURL == "" {
+		restAPIURL = defaultRestAPIURL
 	}
 
 	// Create CDP server
-	s := &cdpServer{
-		port:       cdpConfig.Port,            // Use configured port (from config.yaml)
-		restAPIURL: "http://127.0.0.1:7000",  // REST API to query VM port mappings
+	s := newCDPServer(
+		cdpConfig.Port, // Use configured port (from config.yaml)
+		restAPIURL,     // REST API to query VM port mappings
+		cdpConfig.Compression,
+	)
+	s.configFile = configFile
+	if cdpConfig.MTLS.Enabled() {
+		transport, err := mtls.Transport(cdpConfig.MTLS, mtls.ServiceCDPServer, mtls.ServiceRESTServer)
+		if err != nil {
+			log.Fatalf("Failed to set up mutual TLS: %v", err)
+		}
+		s.restClient = &http.Client{Transport: transport}
+		log.Infof("Calling the REST API at %s with mutual TLS", restAPIURL)
 	}
+	s.logRedaction = logRedaction
+	s.applyConfig(cdpConfig)
 
 	// NOTE: Chrome should be running inside guest VMs with dynamic port forwarding
 	log.Info("CDP server will proxy to Chrome running in guest VMs via dynamic port discovery")
@@ -432,49 +899,65 @@ func main() {
 	// Give guest VM time to start Chrome (if needed)
 	time.Sleep(2 * time.Second)
 
-	r := mux.NewRouter()
-	r.StrictSlash(true) // Automatically handle trailing slashes
-
-	// Register CDP routes with VM selection support
-	r.HandleFunc("/health", s.healthCheck).Methods("GET")
-	
-	// VM-specific routes (e.g., /vm/testsandbox/json/version)
-	r.HandleFunc("/vm/{vmName}/json/version", s.proxyHandler).Methods("GET")
-	r.HandleFunc("/vm/{vmName}/json", s.proxyHandler).Methods("GET")
-	r.HandleFunc("/vm/{vmName}/json/list", s.proxyHandler).Methods("GET")
-	r.PathPrefix("/vm/{vmName}/devtools/").HandlerFunc(s.proxyHandler)
-	
-	// Default routes (first available VM)
-	r.HandleFunc("/json/version", s.proxyHandler).Methods("GET")
-	r.HandleFunc("/json", s.proxyHandler).Methods("GET")
-	r.HandleFunc("/json/list", s.proxyHandler).Methods("GET")
-	r.PathPrefix("/devtools/").HandlerFunc(s.proxyHandler)
-
-	// Start HTTP server
-	srv := &http.Server{
-		Addr:    ":" + cdpConfig.Port,
-		Handler: r,
+	// Start HTTP servers on every configured listener. Listeners may be
+	// inherited from a previous instance during a zero-downtime restart.
+	listenerConfigs := listener.Defaults(cdpConfig.Listeners, "tcp", net.JoinHostPort(cdpConfig.Host, cdpConfig.Port), cdpConfig.Interface)
+	if len(cdpConfig.Listeners) == 0 {
+		listenerConfigs[0].TLS = cdpConfig.TLS
+	} else if cdpConfig.TLS.Enabled() {
+		log.Warn("tls only applies to port, set it on each of the listeners instead")
 	}
+	listeners, err := listener.Open(listenerConfigs)
+	if err != nil {
+		log.Fatalf("Failed to create listeners: %v", err)
+	}
+	listeners.Serve(s.router())
+	log.Printf("CDP server listening on: %s", listeners)
 
-	go func() {
-		log.Printf("CDP server listening on port: %s", cdpConfig.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start cdp server: %v", err)
-		}
-	}()
+	sdnotify.Ready(fmt.Sprintf("serving on %s", listeners))
+	var healthCheck func(context.Context) error
+	if url := listeners.LocalURL(); url != "" {
+		healthCheck = sdnotify.HTTPCheck(url + "/health")
+	}
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	sdnotify.Watchdog(watchdogCtx, healthCheck)
+	pruneCtx, stopPruning := context.WithCancel(context.Background())
+	go s.pruneRoutesPeriodically(pruneCtx)
+	if cdpConfig.VMCache.Watch {
+		go s.watchVMs(pruneCtx)
+	}
 
-	// Set up signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	// Wait for a shutdown or restart (SIGUSR2) request
+	handedOver := handover.WaitForSignal(listeners.Listeners()...)
+	stopWatchdog()
+	stopPruning()
 
 	log.Info("Shutting down CDP server...")
+	sdnotify.Stopping("shutting down")
+	s.sessions.SetDraining(true)
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := listeners.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	// Shutdown does not wait for hijacked WebSocket connections. After a
+	// handover let them run to completion so no session is dropped.
+	// Otherwise give them the drain timeout to finish, then close them with
+	// a close frame rather than mid-message.
+	if handedOver {
+		log.Info("Waiting for active sessions to finish")
+		sdnotify.Status("handed over, waiting for active sessions to finish")
+		s.sessions.Wait()
+	} else if active := s.sessions.Active(); active > 0 {
+		timeout := s.drainTimeout()
+		log.Infof("Waiting up to %s for %d active sessions to finish", timeout, active)
+		sdnotify.Status(fmt.Sprintf("draining %d active sessions", active))
+		admin.Drain(&s.sessions, s, timeout)
+	}
+	s.closeEventSinks()
+	s.closeTracer()
+
 	log.Info("CDP server exited")
 }
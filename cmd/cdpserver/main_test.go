@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+// newTestProxy starts a cdpServer backed by a fake REST API listing the given
+// VMs.
+func newTestProxy(t *testing.T, vms ...testharness.VM) (*httptest.Server, *testharness.FakeRESTAPI) {
+	t.Helper()
+	api := testharness.NewFakeRESTAPI(vms...)
+	t.Cleanup(api.Close)
+
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	proxy := httptest.NewServer(s.router())
+	t.Cleanup(proxy.Close)
+	return proxy, api
+}
+
+func TestDiscoverCDPPort(t *testing.T) {
+	chrome1 := testharness.NewFakeChrome()
+	defer chrome1.Close()
+	chrome2 := testharness.NewFakeChrome()
+	defer chrome2.Close()
+
+	stopped := testharness.RunningVM("stopped", chrome1)
+	stopped.Status = "STOPPED"
+	api := testharness.NewFakeRESTAPI(stopped, testharness.RunningVM("vm1", chrome1), testharness.RunningVM("vm2", chrome2))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+
+	port, vm, err := s.discoverCDPPort("", "")
+	if err != nil {
+		t.Fatalf("discoverCDPPort: %v", err)
+	}
+	if vm.VMName != "vm1" || port != chrome1.Port() {
+		t.Errorf("default VM = %s:%s, want vm1:%s", vm.VMName, port, chrome1.Port())
+	}
+
+	port, vm, err = s.discoverCDPPort("vm2", "")
+	if err != nil {
+		t.Fatalf("discoverCDPPort(vm2): %v", err)
+	}
+	if vm.VMName != "vm2" || port != chrome2.Port() {
+		t.Errorf("vm2 = %s:%s, want vm2:%s", vm.VMName, port, chrome2.Port())
+	}
+
+	if _, _, err := s.discoverCDPPort("stopped", ""); err == nil {
+		t.Errorf("discoverCDPPort(stopped) succeeded, want error")
+	}
+}
+
+// browserVM returns a running VM with a default browser and a browser
+// profile2 on another guest port.
+func browserVM(name string, chrome *testharness.FakeChrome, profile2 *testharness.FakeChrome) testharness.VM {
+	vm := testharness.RunningVM(name, chrome)
+	vm.PortForwards = append(vm.PortForwards, testharness.BrowserPortForward("profile2", "9224", profile2))
+	return vm
+}
+
+func TestDiscoverCDPPortOfBrowser(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	profile2 := testharness.NewFakeChrome()
+	defer profile2.Close()
+	api := testharness.NewFakeRESTAPI(browserVM("vm1", chrome, profile2))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+
+	if port, _, err := s.discoverCDPPort("vm1", ""); err != nil || port != chrome.Port() {
+		t.Errorf("discoverCDPPort(vm1) = %s, %v, want the default browser %s", port, err, chrome.Port())
+	}
+	if port, _, err := s.discoverCDPPort("vm1", "profile2"); err != nil || port != profile2.Port() {
+		t.Errorf("discoverCDPPort(vm1, profile2) = %s, %v, want %s", port, err, profile2.Port())
+	}
+	if port, _, err := s.discoverCDPPort("", "profile2"); err != nil || port != profile2.Port() {
+		t.Errorf("discoverCDPPort(profile2) = %s, %v, want %s", port, err, profile2.Port())
+	}
+	if _, _, err := s.discoverCDPPort("vm1", "profile3"); err == nil {
+		t.Errorf("discoverCDPPort(vm1, profile3) succeeded, want error")
+	}
+}
+
+func TestDiscoverCDPPortByService(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	other := testharness.NewFakeChrome()
+	defer other.Close()
+	// The default browser on another guest port, and a port forward described
+	// as "cdp" that isn't a browser.
+	vm := testharness.RunningVM("vm1", other)
+	vm.PortForwards = []testharness.PortForward{
+		{Description: "cdp", GuestPort: "9223", HostPort: other.Port()},
+		testharness.BrowserPortForward(config.DefaultBrowserService, "9300", chrome),
+	}
+	vm.PortForwards[1].Description = "chromium"
+	api := testharness.NewFakeRESTAPI(vm)
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+
+	if port, _, err := s.discoverCDPPort("vm1", ""); err != nil || port != chrome.Port() {
+		t.Errorf("discoverCDPPort(vm1) = %s, %v, want the browser service %s", port, err, chrome.Port())
+	}
+	if _, vm, _ := s.discoverCDPPort("vm1", ""); len(vm.browsers()) != 1 {
+		t.Errorf("browsers() = %q, want the default browser only", vm.browsers())
+	}
+}
+
+func TestDiscoverCDPPortRevalidates(t *testing.T) {
+	chrome1 := testharness.NewFakeChrome()
+	defer chrome1.Close()
+	chrome2 := testharness.NewFakeChrome()
+	defer chrome2.Close()
+	api := testharness.NewFakeRESTAPI()
+	defer api.Close()
+	api.SetVMs(testharness.RunningVM("vm1", chrome1))
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	// Expire the registry's list at once.
+	s.vms.ttl = 0
+
+	for i := 0; i < 2; i++ {
+		if _, vm, err := s.discoverCDPPort("vm1", ""); err != nil || vm.VMName != "vm1" {
+			t.Fatalf("discoverCDPPort(vm1) = %s, %v", vm.VMName, err)
+		}
+	}
+	if api.NotModified() != 1 {
+		t.Errorf("%d lookups answered with a 304, want the second", api.NotModified())
+	}
+
+	api.SetVMs(testharness.RunningVM("vm1", chrome1), testharness.RunningVM("vm2", chrome2))
+	if port, _, err := s.discoverCDPPort("vm2", ""); err != nil || port != chrome2.Port() {
+		t.Errorf("discoverCDPPort(vm2) after the list changed = %s, %v", port, err)
+	}
+}
+
+func TestNoRunningVM(t *testing.T) {
+	proxy, _ := newTestProxy(t)
+
+	resp, err := http.Get(proxy.URL + "/json/version")
+	if err != nil {
+		t.Fatalf("GET /json/version: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("503 without Retry-After")
+	}
+}
+
+func TestNoRunningVMEmpty(t *testing.T) {
+	api := testharness.NewFakeRESTAPI()
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{NoVMFallback: config.CDPNoVMEmpty})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	for path, want := range map[string]int{
+		"/json/list":         http.StatusOK,
+		"/json":              http.StatusOK,
+		"/json/version":      http.StatusServiceUnavailable,
+		"/vm/vm1/json/list":  http.StatusServiceUnavailable,
+		"/devtools/page/xyz": http.StatusServiceUnavailable,
+	} {
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s = %d, want %d", path, resp.StatusCode, want)
+		}
+		if want == http.StatusOK && strings.TrimSpace(string(body)) != "[]" {
+			t.Errorf("GET %s = %s, want no targets", path, body)
+		}
+	}
+
+	if err := validateNoVMFallback("fake"); err == nil {
+		t.Error("unknown no_vm_fallback accepted")
+	}
+}
+
+func TestJSONRewritesWebSocketURLs(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	proxy, _ := newTestProxy(t, testharness.RunningVM("vm1", chrome))
+	proxyHost := strings.TrimPrefix(proxy.URL, "http://")
+
+	for _, path := range []string{"/json/version", "/json/list", "/vm/vm1/json/list"} {
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s status = %d, want 200", path, resp.StatusCode)
+		}
+		if strings.Contains(string(body), "127.0.0.1:"+testharness.ChromeForwardedPort) {
+			t.Errorf("GET %s still contains the guest address: %s", path, body)
+		}
+		if !strings.Contains(string(body), "ws://"+proxyHost+"/vm/vm1/devtools/") {
+			t.Errorf("GET %s does not point at the proxy on the VM's path: %s", path, body)
+		}
+	}
+}
+
+func TestJSONRewritesToSecureWebSockets(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	proxy := httptest.NewTLSServer(s.router())
+	defer proxy.Close()
+	proxyHost := strings.TrimPrefix(proxy.URL, "https://")
+
+	resp, err := proxy.Client().Get(proxy.URL + "/json/list")
+	if err != nil {
+		t.Fatalf("GET /json/list: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("reading /json/list: %v", err)
+	}
+	if strings.Contains(string(body), "ws://") || strings.Contains(string(body), "?ws=") {
+		t.Errorf("GET /json/list over TLS has plain WebSocket URLs: %s", body)
+	}
+	if !strings.Contains(string(body), "wss://"+proxyHost+"/vm/vm1/devtools/") || !strings.Contains(string(body), "?wss="+proxyHost+"/vm/vm1/devtools/") {
+		t.Errorf("GET /json/list over TLS does not point at the proxy with wss: %s", body)
+	}
+
+	dialer := websocket.Dialer{TLSClientConfig: proxy.Client().Transport.(*http.Transport).TLSClientConfig}
+	conn, _, err := dialer.Dial("wss://"+proxyHost+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatalf("dial wss: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"id":1,"method":"Page.enable"}`)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Errorf("read over wss: %v", err)
+	}
+
+	// Behind a proxy terminating TLS.
+	req, _ := http.NewRequest("GET", proxy.URL+"/json/version", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp, err = proxy.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET /json/version: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "wss://") {
+		t.Errorf("GET /json/version behind a TLS proxy = %s, want wss URLs", body)
+	}
+}
+
+func TestUpstreamPath(t *testing.T) {
+	for _, tc := range []struct {
+		target string
+		vmName string
+		want   string
+	}{
+		{target: "/json/version", want: "/json/version"},
+		{target: "/vm/vm1/json/list", vmName: "vm1", want: "/json/list"},
+		{target: "/vm/vm1/devtools/page/fake-page", vmName: "vm1", want: "/devtools/page/fake-page"},
+		{target: "/devtools/page/fake-page?vm=vm1", want: "/devtools/page/fake-page"},
+		{target: "/json/list?vm=vm1&t=1", want: "/json/list?t=1"},
+		// Only the route's own prefix is stripped.
+		{target: "/vm/vm2/json/list", vmName: "vm1", want: "/vm/vm2/json/list"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		if tc.vmName != "" {
+			r = mux.SetURLVars(r, map[string]string{"vmName": tc.vmName})
+		}
+		if got := upstreamPath(r); got != tc.want {
+			t.Errorf("%s: upstreamPath() = %q, want %q", tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	proxy, _ := newTestProxy(t, testharness.RunningVM("vm1", chrome))
+
+	for _, path := range []string{"/devtools/page/fake-page?vm=vm1", "/vm/vm1/devtools/page/fake-page"} {
+		url := testharness.WebSocketURL(proxy.URL) + path
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial %s: %v", url, err)
+		}
+		defer conn.Close()
+
+		msg := `{"id":1,"method":"Page.navigate","params":{"url":"about:blank"}}`
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(got) != msg {
+			t.Errorf("echo = %q, want %q", got, msg)
+		}
+
+		upstream, _ := chrome.LastRequest()
+		if upstream != "/devtools/page/fake-page" {
+			t.Errorf("%s: upstream path = %q, want VM selection stripped", path, upstream)
+		}
+	}
+}
+
+func TestBrowserRoutes(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	profile2 := testharness.NewFakeChrome()
+	defer profile2.Close()
+	proxy, _ := newTestProxy(t, browserVM("vm1", chrome, profile2))
+	proxyHost := strings.TrimPrefix(proxy.URL, "http://")
+
+	resp, err := http.Get(proxy.URL + "/vm/vm1/browser/profile2/json/list")
+	if err != nil {
+		t.Fatalf("GET /json/list of profile2: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "ws://"+proxyHost+"/vm/vm1/browser/profile2/devtools/") {
+		t.Errorf("/json/list of profile2 does not point at the browser's path: %s", body)
+	}
+	if upstream, _ := profile2.LastRequest(); upstream != "/json/list" {
+		t.Errorf("profile2 upstream path = %q, want /json/list", upstream)
+	}
+
+	for _, path := range []string{"/vm/vm1/browser/profile2/devtools/page/fake-page", "/devtools/page/fake-page?vm=vm1&browser=profile2"} {
+		conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+path, nil)
+		if err != nil {
+			t.Fatalf("dial %s: %v", path, err)
+		}
+		conn.Close()
+		if upstream, _ := profile2.LastRequest(); upstream != "/devtools/page/fake-page" {
+			t.Errorf("%s: profile2 upstream path = %q, want VM and browser selection stripped", path, upstream)
+		}
+	}
+	if chrome.Connections() != 0 {
+		t.Errorf("default browser got %d connections, want none", chrome.Connections())
+	}
+
+	resp, err = http.Get(proxy.URL + "/vm/vm1/browsers")
+	if err != nil {
+		t.Fatalf("GET /vm/vm1/browsers: %v", err)
+	}
+	var browsers []browserInfo
+	json.NewDecoder(resp.Body).Decode(&browsers)
+	resp.Body.Close()
+	want := []browserInfo{
+		{ID: "", GuestPort: testharness.ChromeForwardedPort, HostPort: chrome.Port(), Path: "/vm/vm1"},
+		{ID: "profile2", GuestPort: "9224", HostPort: profile2.Port(), Path: "/vm/vm1/browser/profile2"},
+	}
+	if !reflect.DeepEqual(browsers, want) {
+		t.Errorf("browsers = %+v, want %+v", browsers, want)
+	}
+}
+
+func TestWebSocketProxyReportsSession(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	proxy, api := newTestProxy(t, testharness.RunningVM("vm1", chrome))
+
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(api.Sessions("vm1")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sessions := api.Sessions("vm1")
+	if len(sessions) != 1 || sessions[0].Kind != cmdserver.SessionCDP {
+		t.Errorf("Reported sessions = %+v, want one CDP session", sessions)
+	}
+}
+
+func TestWebSocketProxyChromeUnavailable(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	vm := testharness.RunningVM("vm1", chrome)
+	chrome.Close()
+
+	for _, tc := range []struct {
+		name     string
+		services []cmdserver.ServiceHealth
+		want     string
+	}{
+		{
+			name: "no service health",
+			want: "Chrome not available",
+		},
+		{
+			name:     "browser starting",
+			services: []cmdserver.ServiceHealth{{Name: "browser", Port: 9223, State: cmdserver.ServiceStarting}},
+			want:     "browser: starting",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy, api := newTestProxy(t, vm)
+			if tc.services != nil {
+				api.SetServices("vm1", tc.services...)
+			}
+
+			_, resp, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/devtools/browser/x", nil)
+			if err == nil || resp == nil {
+				t.Fatalf("dial succeeded without Chrome, err = %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), tc.want) {
+				t.Errorf("response = %d %q, want 503 mentioning %q", resp.StatusCode, body, tc.want)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	proxy := httptest.NewUnstartedServer(s.router())
+	proxy.Start()
+	srv := proxy.Config
+
+	resp, err := http.Get(proxy.URL + "/health")
+	if err != nil {
+		t.Fatalf("GET /health: %v", err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := http.Get(proxy.URL + "/health"); err == nil {
+		t.Errorf("GET /health after shutdown succeeded, want error")
+	}
+}
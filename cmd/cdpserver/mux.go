@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/relay"
+)
+
+// defaultMaxMuxTargets bounds the targets of a multiplexed connection unless
+// configured otherwise.
+const defaultMaxMuxTargets = 64
+
+// Types of the envelopes exchanged over a multiplexed connection. The client
+// sends attach, message and detach; the proxy answers with attached, message,
+// detached and error.
+const (
+	muxAttach   = "attach"
+	muxAttached = "attached"
+	muxMessage  = "message"
+	muxDetach   = "detach"
+	muxDetached = "detached"
+	muxError    = "error"
+)
+
+// muxEnvelope wraps every message of a multiplexed connection. Target is an
+// id the client picks for each DevTools target it attaches to.
+type muxEnvelope struct {
+	Type   string `json:"type"`
+	Target string `json:"target,omitempty"`
+	// VM, Browser and Path select what an attach connects to, e.g.
+	// "/devtools/page/<id>" of a VM. An empty VM is the first running one
+	// and an empty Browser its default browser.
+	VM      string `json:"vm,omitempty"`
+	Browser string `json:"browser,omitempty"`
+	Path    string `json:"path,omitempty"`
+	// Data is a CDP message, relayed as is.
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// muxTarget is a DevTools target attached over a multiplexed connection. Its
+// conn is nil while it is being attached.
+type muxTarget struct {
+	conn     *websocket.Conn
+	start    time.Time
+	vmName   string
+	policy   *cdpPolicy   // nil if the VM's commands aren't restricted
+	recorder *cdpRecorder // nil unless the session is recorded
+	events   relay.Tap    // Forwards the events to the sinks
+}
+
+// muxSession relays the targets of one multiplexed client connection.
+type muxSession struct {
+	s           *cdpServer
+	client      *websocket.Conn
+	dialer      websocket.Dialer
+	compression config.CompressionConfig
+	keepalive   config.WebSocketKeepaliveConfig // Of the Chrome leg
+	maxTargets  int
+	grant       *cdpGrant // Of the client's token, nil without auth
+
+	writeMu sync.Mutex // serializes writes to client
+
+	mu      sync.Mutex
+	targets map[string]*muxTarget
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// muxHandler serves /mux, over which a client attaches to any number of
+// DevTools targets of any VM and exchanges their messages wrapped in
+// envelopes, instead of opening a WebSocket per target. Chaos isn't applied
+// to multiplexed connections.
+func (s *cdpServer) muxHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	upgrader, dialer, compression, cfg := s.upgrader, s.dialer, s.compression, s.cfg
+	s.mu.RUnlock()
+	if cfg == nil || !cfg.Multiplex.Enabled {
+		http.Error(w, "404 Not Found - multiplexing is disabled", http.StatusNotFound)
+		return
+	}
+	maxTargets := cfg.Multiplex.MaxTargets
+	if maxTargets <= 0 {
+		maxTargets = defaultMaxMuxTargets
+	}
+
+	if !s.sessions.Enter() {
+		log.Infof("Draining, refusing multiplexed session from %s", r.RemoteAddr)
+		http.Error(w, "503 Service Unavailable - draining", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.sessions.Leave()
+
+	clientConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("Failed to upgrade WebSocket: %v", err)
+		return
+	}
+	defer func() {
+		if err := clientConn.Close(); err != nil {
+			log.Debugf("Error closing client connection: %v", err)
+		}
+	}()
+	configureCompression(clientConn, compression)
+	defer relay.Keepalive(clientConn, cfg.Keepalive.Client)()
+	defer s.muxClients.track(clientConn)()
+
+	log.Infof("Multiplexed session from %s started", r.RemoteAddr)
+	m := &muxSession{
+		s:           s,
+		client:      clientConn,
+		dialer:      dialer,
+		compression: compression,
+		keepalive:   cfg.Keepalive.Chrome,
+		maxTargets:  maxTargets,
+		grant:       grantFromContext(r.Context()),
+		targets:     make(map[string]*muxTarget),
+	}
+	m.serve()
+	log.Infof("Multiplexed session from %s closed", r.RemoteAddr)
+}
+
+// serve handles the client's envelopes until it disconnects, then detaches
+// all of its targets.
+func (m *muxSession) serve() {
+	defer m.close()
+	for {
+		_, data, err := m.client.ReadMessage()
+		if err != nil {
+			return
+		}
+		var env muxEnvelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			m.send(muxEnvelope{Type: muxError, Error: fmt.Sprintf("invalid envelope: %v", err)})
+			continue
+		}
+		if env.Target == "" {
+			m.send(muxEnvelope{Type: muxError, Error: "target is required"})
+			continue
+		}
+		switch env.Type {
+		case muxAttach:
+			m.attach(env)
+		case muxMessage:
+			m.relay(env)
+		case muxDetach:
+			m.detach(env.Target)
+		default:
+			m.send(muxEnvelope{Type: muxError, Target: env.Target, Error: fmt.Sprintf("unknown type %q", env.Type)})
+		}
+	}
+}
+
+// send writes an envelope to the client. Errors surface as the client's
+// connection failing in serve.
+func (m *muxSession) send(env muxEnvelope) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Errorf("Failed to marshal envelope: %v", err)
+		return
+	}
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.client.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Debugf("Failed to write to multiplexed client: %v", err)
+	}
+}
+
+// attach reserves the target and connects to it in the background, so that
+// a slow VM doesn't hold up the other targets.
+func (m *muxSession) attach(env muxEnvelope) {
+	if !strings.HasPrefix(env.Path, "/devtools/") {
+		m.send(muxEnvelope{Type: muxError, Target: env.Target, Error: "path must start with /devtools/"})
+		return
+	}
+	if env.VM == "" && env.Browser == "" {
+		if routed, ok := m.s.routes.lookup(env.Path); ok {
+			env.VM, env.Browser = routed.vm, routed.browserID
+		}
+	}
+	vm, err := m.grant.authorize(env.VM)
+	if err != nil {
+		m.send(muxEnvelope{Type: muxError, Target: env.Target, Error: err.Error()})
+		return
+	}
+	if sess, ok := m.s.handoffs.parkedIn(env.Path, time.Now()); ok {
+		m.send(muxEnvelope{Type: muxError, Target: env.Target, Error: fmt.Sprintf("the target is parked in session %q until resumed", sess.Label)})
+		return
+	}
+	env.VM = vm
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.targets[env.Target]; ok {
+		m.send(muxEnvelope{Type: muxError, Target: env.Target, Error: "target is already attached"})
+		return
+	}
+	if len(m.targets) >= m.maxTargets {
+		m.send(muxEnvelope{Type: muxError, Target: env.Target, Error: fmt.Sprintf("at most %d targets can be attached", m.maxTargets)})
+		return
+	}
+	t := &muxTarget{}
+	m.targets[env.Target] = t
+	m.wg.Add(1)
+	go m.connect(env, t)
+}
+
+// connect dials the target and relays what it sends to the client until
+// either side closes it.
+func (m *muxSession) connect(env muxEnvelope, t *muxTarget) {
+	defer m.wg.Done()
+
+	hostPort, vm, err := m.s.discoverCDPPort(env.VM, env.Browser)
+	if err == nil {
+		var release func()
+		if release, err = m.s.limits.acquire(context.Background(), vm.VMName); err == nil {
+			defer release()
+		}
+	}
+	var conn *websocket.Conn
+	if err == nil {
+		chromeURL := fmt.Sprintf("ws://127.0.0.1:%s%s", hostPort, env.Path)
+		log.Infof("Attaching multiplexed target %s to %s (VM: %s)", env.Target, chromeURL, vm.VMName)
+		conn, _, err = m.dialer.Dial(chromeURL, nil)
+		if err != nil {
+			err = m.s.relaunchChrome(context.Background(), vm, env.Browser, err, func() error {
+				var dialErr error
+				conn, _, dialErr = m.dialer.Dial(chromeURL, nil)
+				return dialErr
+			})
+		}
+	}
+	if errors.Is(err, errSessionQueueFull) || errors.Is(err, errSessionQueueTimeout) {
+		if m.remove(env.Target, t) {
+			m.send(muxEnvelope{Type: muxError, Target: env.Target, Error: err.Error()})
+		}
+		return
+	}
+	if err != nil {
+		if m.remove(env.Target, t) {
+			m.send(muxEnvelope{Type: muxError, Target: env.Target, Error: fmt.Sprintf("Chrome not available: %v", err)})
+		}
+		return
+	}
+	configureCompression(conn, m.compression)
+	defer relay.Keepalive(conn, m.keepalive)()
+
+	m.mu.Lock()
+	if m.closed || m.targets[env.Target] != t {
+		// Detached while connecting.
+		m.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.conn, t.start = conn, time.Now()
+	t.vmName, t.policy = vm.VMName, m.s.policyFor(vm.VMName)
+	t.recorder = m.s.startRecording(vm.VMName, targetID(env.Path))
+	t.events = m.s.eventTap(vm.VMName, targetID(env.Path))
+	m.mu.Unlock()
+	defer t.recorder.close()
+	untrack := m.s.routes.track(vm.VMName, &routedConn{
+		target: targetID(env.Path),
+		remote: m.client.RemoteAddr().String(),
+		start:  t.start,
+		close: func(int, string) {
+			closeWithFrame(conn, websocket.CloseNormalClosure, "")
+		},
+		muxed: true,
+	})
+	defer untrack()
+	m.send(muxEnvelope{Type: muxAttached, Target: env.Target, VM: vm.VMName})
+
+	var reason string
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) && !m.isDetached(env.Target, t) {
+				reason = err.Error()
+			}
+			break
+		}
+		t.recorder.record(relay.ToClient, websocket.TextMessage, data)
+		t.events(relay.ToClient, websocket.TextMessage, data)
+		msg := json.RawMessage(data)
+		if !json.Valid(data) {
+			msg, _ = json.Marshal(string(data))
+		}
+		m.send(muxEnvelope{Type: muxMessage, Target: env.Target, Data: msg})
+	}
+	conn.Close()
+	m.remove(env.Target, t)
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if !closed {
+		m.send(muxEnvelope{Type: muxDetached, Target: env.Target, Error: reason})
+	}
+	m.s.reportSession(vm, time.Since(t.start))
+}
+
+// relay forwards a CDP message of the client to its target, unless the
+// target's policy denies it.
+func (m *muxSession) relay(env muxEnvelope) {
+	var conn *websocket.Conn
+	var vmName string
+	var policy *cdpPolicy
+	var recorder *cdpRecorder
+	m.mu.Lock()
+	if t, ok := m.targets[env.Target]; ok {
+		conn, vmName, policy, recorder = t.conn, t.vmName, t.policy, t.recorder
+	}
+	m.mu.Unlock()
+	if conn == nil {
+		m.send(muxEnvelope{Type: muxError, Target: env.Target, Error: "target is not attached"})
+		return
+	}
+	recorder.record(relay.FromClient, websocket.TextMessage, env.Data)
+	// Holding blocks the client's other targets too, as their messages are
+	// read in order.
+	if reply, ok := m.s.holdForTakeover(vmName, env.Data, m.client); !ok {
+		recorder.record(relay.ToClient, websocket.TextMessage, reply)
+		m.send(muxEnvelope{Type: muxMessage, Target: env.Target, Data: reply})
+		return
+	}
+	if policy != nil {
+		if reply, ok := policy.enforce(env.Data, vmName, m.client.RemoteAddr().String()); !ok {
+			recorder.record(relay.ToClient, websocket.TextMessage, reply)
+			m.send(muxEnvelope{Type: muxMessage, Target: env.Target, Data: reply})
+			return
+		}
+	}
+	// Only serve writes to targets, so no lock is needed.
+	if err := conn.WriteMessage(websocket.TextMessage, env.Data); err != nil {
+		log.Debugf("Failed to write to multiplexed target %s: %v", env.Target, err)
+	}
+}
+
+// detach closes a target. Its relay sends detached once it stopped, or, if
+// it is still connecting, detach does.
+func (m *muxSession) detach(target string) {
+	m.mu.Lock()
+	t, ok := m.targets[target]
+	var conn *websocket.Conn
+	if ok {
+		conn = t.conn
+		delete(m.targets, target)
+	}
+	m.mu.Unlock()
+	if !ok {
+		m.send(muxEnvelope{Type: muxError, Target: target, Error: "target is not attached"})
+		return
+	}
+	if conn == nil {
+		m.send(muxEnvelope{Type: muxDetached, Target: target})
+		return
+	}
+	conn.Close()
+}
+
+// isDetached reports whether t was detached by the client rather than closed
+// by Chrome.
+func (m *muxSession) isDetached(target string, t *muxTarget) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed || m.targets[target] != t
+}
+
+// remove forgets t unless it was detached already, which it reports.
+func (m *muxSession) remove(target string, t *muxTarget) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || m.targets[target] != t {
+		return false
+	}
+	delete(m.targets, target)
+	return true
+}
+
+// close closes all targets once the client is gone and waits for their
+// relays.
+func (m *muxSession) close() {
+	m.mu.Lock()
+	m.closed = true
+	for _, t := range m.targets {
+		if t.conn != nil {
+			t.conn.Close()
+		}
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
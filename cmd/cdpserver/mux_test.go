@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+// newMuxProxy starts a cdpServer with multiplexing enabled and dials /mux.
+func newMuxProxy(t *testing.T, maxTargets int, vms ...testharness.VM) *websocket.Conn {
+	t.Helper()
+	api := testharness.NewFakeRESTAPI(vms...)
+	t.Cleanup(api.Close)
+
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{Multiplex: config.MultiplexConfig{Enabled: true, MaxTargets: maxTargets}})
+	proxy := httptest.NewServer(s.router())
+	t.Cleanup(proxy.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/mux", nil)
+	if err != nil {
+		t.Fatalf("dial /mux: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readEnvelope(t *testing.T, conn *websocket.Conn) muxEnvelope {
+	t.Helper()
+	var env muxEnvelope
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatalf("read envelope: %v", err)
+	}
+	return env
+}
+
+func TestMuxMultipleVMs(t *testing.T) {
+	chrome1 := testharness.NewFakeChrome()
+	defer chrome1.Close()
+	chrome2 := testharness.NewFakeChrome()
+	defer chrome2.Close()
+	conn := newMuxProxy(t, 0, testharness.RunningVM("vm1", chrome1), testharness.RunningVM("vm2", chrome2))
+
+	conn.WriteJSON(muxEnvelope{Type: muxAttach, Target: "a", VM: "vm1", Path: "/devtools/page/one"})
+	if env := readEnvelope(t, conn); env.Type != muxAttached || env.Target != "a" || env.VM != "vm1" {
+		t.Fatalf("attach a = %+v", env)
+	}
+	conn.WriteJSON(muxEnvelope{Type: muxAttach, Target: "b", VM: "vm2", Path: "/devtools/page/two"})
+	if env := readEnvelope(t, conn); env.Type != muxAttached || env.Target != "b" || env.VM != "vm2" {
+		t.Fatalf("attach b = %+v", env)
+	}
+	if upstream, _ := chrome2.LastRequest(); upstream != "/devtools/page/two" {
+		t.Errorf("vm2 upstream path = %q", upstream)
+	}
+
+	for _, target := range []string{"b", "a"} {
+		msg := `{"id":1,"method":"Runtime.evaluate","params":{"expression":"` + target + `"}}`
+		conn.WriteJSON(muxEnvelope{Type: muxMessage, Target: target, Data: []byte(msg)})
+		env := readEnvelope(t, conn)
+		if env.Type != muxMessage || env.Target != target || string(env.Data) != msg {
+			t.Errorf("echo of %s = %+v %s", target, env, env.Data)
+		}
+	}
+
+	conn.WriteJSON(muxEnvelope{Type: muxDetach, Target: "a"})
+	if env := readEnvelope(t, conn); env.Type != muxDetached || env.Target != "a" || env.Error != "" {
+		t.Errorf("detach a = %+v", env)
+	}
+	conn.WriteJSON(muxEnvelope{Type: muxMessage, Target: "a", Data: []byte(`{}`)})
+	if env := readEnvelope(t, conn); env.Type != muxError || env.Target != "a" {
+		t.Errorf("message to detached target = %+v", env)
+	}
+}
+
+func TestMuxRejects(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	conn := newMuxProxy(t, 1, testharness.RunningVM("vm1", chrome))
+
+	conn.WriteJSON(muxEnvelope{Type: muxAttach, Target: "a", Path: "/devtools/page/one"})
+	if env := readEnvelope(t, conn); env.Type != muxAttached {
+		t.Fatalf("attach = %+v", env)
+	}
+	check := func(name string, env muxEnvelope) {
+		t.Helper()
+		conn.WriteJSON(env)
+		if got := readEnvelope(t, conn); got.Type != muxError {
+			t.Errorf("%s: got %+v, want an error", name, got)
+		}
+	}
+	check("same target", muxEnvelope{Type: muxAttach, Target: "a", Path: "/devtools/page/one"})
+	check("too many", muxEnvelope{Type: muxAttach, Target: "b", Path: "/devtools/page/two"})
+	check("other path", muxEnvelope{Type: muxAttach, Target: "c", Path: "/json/list"})
+	check("unknown type", muxEnvelope{Type: "hello", Target: "a"})
+	check("missing target", muxEnvelope{Type: muxAttach, Path: "/devtools/page/one"})
+
+	conn.WriteJSON(muxEnvelope{Type: muxDetach, Target: "a"})
+	readEnvelope(t, conn)
+	check("unknown vm", muxEnvelope{Type: muxAttach, Target: "d", VM: "nope", Path: "/devtools/page/one"})
+}
+
+func TestMuxDisabled(t *testing.T) {
+	proxy, _ := newTestProxy(t)
+	_, resp, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/mux", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("dial /mux without multiplexing = %v, want 404", err)
+	}
+}
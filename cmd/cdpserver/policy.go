@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+// cdpErrorServerError is the JSON-RPC error code Chrome answers failed
+// commands with.
+const cdpErrorServerError = -32000
+
+// cdpRule is a compiled config.CDPRuleConfig.
+type cdpRule struct {
+	index  int
+	allow  bool
+	method string
+	params map[string]string
+}
+
+// cdpPolicy decides which CDP commands clients may send to a VM's browser.
+type cdpPolicy struct {
+	rules []cdpRule
+	allow bool // for commands no rule matches
+}
+
+// cdpPolicies are the compiled policies of the config.
+type cdpPolicies struct {
+	byVM     map[string]*cdpPolicy
+	byOwner  map[string]*cdpPolicy // of the tenants' bundles restricting CDP
+	fallback *cdpPolicy            // of the VMs no policy lists, nil if unrestricted
+}
+
+// cdpCommand is what policies inspect of a client's message.
+type cdpCommand struct {
+	ID        json.RawMessage            `json:"id"`
+	Method    string                     `json:"method"`
+	Params    map[string]json.RawMessage `json:"params"`
+	SessionID string                     `json:"sessionId,omitempty"`
+}
+
+// compilePolicies checks and compiles the policies of the config, and the
+// CDP rules of the tenants' bundles.
+func compilePolicies(cfgs []config.CDPPolicyConfig, tenants []config.TenantPolicyConfig) (*cdpPolicies, error) {
+	policies := &cdpPolicies{byVM: make(map[string]*cdpPolicy), byOwner: make(map[string]*cdpPolicy)}
+	for i, cfg := range cfgs {
+		where := fmt.Sprintf("policies[%d]", i)
+		policy, err := compilePolicy(cfg.Rules, cfg.Default, where+".rules", where+".default")
+		if err != nil {
+			return nil, err
+		}
+
+		if len(cfg.VMs) == 0 {
+			if policies.fallback != nil {
+				return nil, fmt.Errorf("policies[%d] lists no VMs, like another policy", i)
+			}
+			policies.fallback = policy
+			continue
+		}
+		for _, vm := range cfg.VMs {
+			if _, ok := policies.byVM[vm]; ok {
+				return nil, fmt.Errorf("policies[%d] lists VM %s, like another policy", i, vm)
+			}
+			policies.byVM[vm] = policy
+		}
+	}
+	for i, tenant := range tenants {
+		if len(tenant.CDPRules) == 0 && tenant.CDPDefault == "" {
+			continue
+		}
+		where := fmt.Sprintf("tenants[%d]", i)
+		policy, err := compilePolicy(tenant.CDPRules, tenant.CDPDefault, where+".cdp_rules", where+".cdp_default")
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := policies.byOwner[tenant.Tenant]; ok {
+			return nil, fmt.Errorf("%s names tenant %s, like another bundle", where, tenant.Tenant)
+		}
+		policies.byOwner[tenant.Tenant] = policy
+	}
+	return policies, nil
+}
+
+// compilePolicy compiles the rules and default of a policy, found at
+// rulesKey and defaultKey in the config.
+func compilePolicy(rules []config.CDPRuleConfig, def string, rulesKey, defaultKey string) (*cdpPolicy, error) {
+	policy := &cdpPolicy{allow: true}
+	switch strings.ToLower(def) {
+	case "", config.CDPPolicyAllow:
+	case config.CDPPolicyDeny:
+		policy.allow = false
+	default:
+		return nil, fmt.Errorf("%s must be %s or %s", defaultKey, config.CDPPolicyAllow, config.CDPPolicyDeny)
+	}
+	for j, r := range rules {
+		rule := cdpRule{
+			index:  j,
+			method: strings.ToLower(r.Method),
+			params: make(map[string]string, len(r.Params)),
+		}
+		switch strings.ToLower(r.Action) {
+		case config.CDPPolicyAllow:
+			rule.allow = true
+		case config.CDPPolicyDeny:
+		default:
+			return nil, fmt.Errorf("%s[%d].action must be %s or %s", rulesKey, j, config.CDPPolicyAllow, config.CDPPolicyDeny)
+		}
+		if rule.method == "" {
+			return nil, fmt.Errorf("%s[%d] needs a method", rulesKey, j)
+		}
+		for name, pattern := range r.Params {
+			rule.params[strings.ToLower(name)] = strings.ToLower(pattern)
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+	return policy, nil
+}
+
+// forVM returns the policy of a VM of owner, nil if its commands aren't
+// restricted. A policy listing the VM comes first, then the bundle of its
+// owner.
+func (p *cdpPolicies) forVM(vmName string, owner string) *cdpPolicy {
+	if p == nil {
+		return nil
+	}
+	if policy, ok := p.byVM[vmName]; ok {
+		return policy
+	}
+	if policy, ok := p.byOwner[owner]; ok && owner != "" {
+		return policy
+	}
+	return p.fallback
+}
+
+// check decides whether a message of a client may be relayed. Messages that
+// aren't commands are. A denied command is described by reason.
+func (p *cdpPolicy) check(data []byte) (cmd cdpCommand, allowed bool, reason string) {
+	if p == nil {
+		return cmd, true, ""
+	}
+	if err := json.Unmarshal(data, &cmd); err != nil || cmd.Method == "" {
+		// Chrome rejects what isn't a command itself.
+		return cmd, true, ""
+	}
+	method := strings.ToLower(cmd.Method)
+	for _, rule := range p.rules {
+		if rule.matches(method, cmd.Params) {
+			return cmd, rule.allow, fmt.Sprintf("rule %d", rule.index)
+		}
+	}
+	return cmd, p.allow, "the default"
+}
+
+func (r cdpRule) matches(method string, params map[string]json.RawMessage) bool {
+	if !matchGlob(r.method, method) {
+		return false
+	}
+	for name, pattern := range r.params {
+		value, ok := paramValue(params, name)
+		if !ok || !matchGlob(pattern, strings.ToLower(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// paramValue returns the top-level parameter name, named case-insensitively,
+// as text: strings as they are, other values as JSON.
+func paramValue(params map[string]json.RawMessage, name string) (string, bool) {
+	for key, raw := range params {
+		if strings.ToLower(key) != name {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			return strings.TrimSpace(s), true
+		}
+		return string(raw), true
+	}
+	return "", false
+}
+
+// matchGlob reports whether s matches pattern, in which "*" matches any
+// text, including none.
+func matchGlob(pattern string, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// deniedReply is the error Chrome would answer cmd with, so that clients
+// fail the command rather than wait for it.
+func deniedReply(cmd cdpCommand) []byte {
+	return errorReply(cmd, fmt.Sprintf("%s is not allowed by the proxy's policy", cmd.Method))
+}
+
+// errorReply answers cmd with an error as Chrome would.
+func errorReply(cmd cdpCommand, message string) []byte {
+	reply := struct {
+		ID    json.RawMessage `json:"id,omitempty"`
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+		SessionID string `json:"sessionId,omitempty"`
+	}{ID: cmd.ID, SessionID: cmd.SessionID}
+	reply.Error.Code = cdpErrorServerError
+	reply.Error.Message = message
+	data, _ := json.Marshal(reply)
+	return data
+}
+
+// policyFor returns the policy the commands of a new session with vmName
+// are checked against, nil if they aren't restricted.
+func (s *cdpServer) policyFor(vmName string) *cdpPolicy {
+	owner := s.ownerOf(vmName)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.policies.forVM(vmName, owner)
+}
+
+// enforce checks a command a client at remote sends to vmName against policy,
+// logging it if it's denied, and returns the reply to the client then.
+func (p *cdpPolicy) enforce(data []byte, vmName string, remote string) ([]byte, bool) {
+	cmd, allowed, reason := p.check(data)
+	if allowed {
+		return nil, true
+	}
+	log.WithFields(log.Fields{
+		"vmName":    vmName,
+		"method":    cmd.Method,
+		"remote":    remote,
+		"decidedBy": reason,
+	}).Warn("Blocked CDP command")
+	return deniedReply(cmd), false
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+var testPolicies = []config.CDPPolicyConfig{
+	{
+		VMs: []string{"vm1"},
+		Rules: []config.CDPRuleConfig{
+			{Action: "deny", Method: "Browser.setDownloadBehavior"},
+			{Action: "deny", Method: "Page.navigate", Params: map[string]string{"url": "file://*"}},
+			{Action: "deny", Method: "Network.setCookie", Params: map[string]string{"domain": "*.bank.example"}},
+		},
+	},
+	{
+		// Of every other VM.
+		Rules: []config.CDPRuleConfig{
+			{Action: "allow", Method: "Runtime.*"},
+		},
+		Default: "deny",
+	},
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policies, err := compilePolicies(testPolicies, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		vm      string
+		msg     string
+		allowed bool
+	}{
+		{"vm1", `{"id":1,"method":"Page.navigate","params":{"url":"https://example.com"}}`, true},
+		{"vm1", `{"id":2,"method":"Page.navigate","params":{"url":"file:///etc/passwd"}}`, false},
+		{"vm1", `{"id":3,"method":"Page.navigate","params":{"url":" FILE:///etc/passwd"}}`, false},
+		{"vm1", `{"id":4,"method":"Browser.setDownloadBehavior","params":{"behavior":"allow"}}`, false},
+		{"vm1", `{"id":5,"method":"Network.setCookie","params":{"name":"a","domain":"login.bank.example"}}`, false},
+		{"vm1", `{"id":6,"method":"Network.setCookie","params":{"name":"a","domain":"example.com"}}`, true},
+		{"vm1", `not json`, true},
+		{"vm2", `{"id":7,"method":"Runtime.evaluate","params":{"expression":"1"}}`, true},
+		{"vm2", `{"id":8,"method":"Page.navigate","params":{"url":"https://example.com"}}`, false},
+	}
+	for _, tt := range tests {
+		_, allowed, reason := policies.forVM(tt.vm, "").check([]byte(tt.msg))
+		if allowed != tt.allowed {
+			t.Errorf("%s: check(%s) = %t by %s, want %t", tt.vm, tt.msg, allowed, reason, tt.allowed)
+		}
+	}
+
+	if (*cdpPolicies)(nil).forVM("vm1", "") != nil {
+		t.Errorf("a VM is restricted without policies")
+	}
+}
+
+func TestCompilePoliciesRejects(t *testing.T) {
+	for _, policies := range [][]config.CDPPolicyConfig{
+		{{Default: "block"}},
+		{{Rules: []config.CDPRuleConfig{{Action: "deny"}}}},
+		{{Rules: []config.CDPRuleConfig{{Action: "drop", Method: "Page.navigate"}}}},
+		{{VMs: []string{"vm1"}}, {VMs: []string{"vm1"}}},
+		{{}, {}},
+	} {
+		if _, err := compilePolicies(policies, nil); err == nil {
+			t.Errorf("compilePolicies(%v) succeeded, want an error", policies)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"page.navigate", "page.navigate", true},
+		{"page.*", "page.navigate", true},
+		{"*", "", true},
+		{"file://*", "file:///etc/passwd", true},
+		{"file://*", "https://file://", false},
+		{"*.bank.*", "login.bank.example", true},
+		{"a*a", "a", false},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %t, want %t", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestWebSocketProxyEnforcesPolicy(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{Policies: testPolicies})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	denied := `{"id":1,"method":"Page.navigate","params":{"url":"file:///etc/passwd"},"sessionId":"s1"}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(denied)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var reply struct {
+		ID    int `json:"id"`
+		Error struct {
+			Code int `json:"code"`
+		} `json:"error"`
+		SessionID string `json:"sessionId"`
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := json.Unmarshal(data, &reply); err != nil || reply.ID != 1 || reply.Error.Code != cdpErrorServerError || reply.SessionID != "s1" {
+		t.Errorf("reply to a denied command = %s", data)
+	}
+
+	// Allowed commands still reach Chrome, which echoes them.
+	allowed := `{"id":2,"method":"Page.navigate","params":{"url":"https://example.com"}}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(allowed)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != allowed {
+		t.Errorf("echo = %q, %v, want %q", data, err, allowed)
+	}
+}
+
+func TestMuxEnforcesPolicy(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm2", chrome))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{
+		Multiplex: config.MultiplexConfig{Enabled: true},
+		Policies:  testPolicies,
+	})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/mux", nil)
+	if err != nil {
+		t.Fatalf("dial /mux: %v", err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(muxEnvelope{Type: muxAttach, Target: "a", VM: "vm2", Path: "/devtools/page/one"})
+	if env := readEnvelope(t, conn); env.Type != muxAttached {
+		t.Fatalf("attach = %+v", env)
+	}
+	conn.WriteJSON(muxEnvelope{Type: muxMessage, Target: "a", Data: []byte(`{"id":1,"method":"Page.navigate","params":{"url":"https://example.com"}}`)})
+	env := readEnvelope(t, conn)
+	var reply struct {
+		ID    int             `json:"id"`
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(env.Data, &reply); env.Type != muxMessage || err != nil || reply.ID != 1 || reply.Error == nil {
+		t.Errorf("reply to a denied command = %+v %s", env, env.Data)
+	}
+}
+
+func TestTenantPolicies(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	vm1 := testharness.RunningVM("vm1", chrome)
+	vm1.Owner = "acme"
+	vm2 := testharness.RunningVM("vm2", chrome)
+	vm2.Owner = "acme"
+	api := testharness.NewFakeRESTAPI(vm1, vm2)
+	defer api.Close()
+	dir := t.TempDir()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{
+		Recording: config.CDPRecordingConfig{Dir: dir},
+		// A policy listing a VM comes before its owner's bundle.
+		Policies: []config.CDPPolicyConfig{{VMs: []string{"vm2"}}},
+		Tenants: []config.TenantPolicyConfig{{
+			Tenant:         "acme",
+			CDPRules:       []config.CDPRuleConfig{{Action: "deny", Method: "Page.navigate", Params: map[string]string{"url": "file://*"}}},
+			RecordSessions: true,
+		}},
+	})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	denied := `{"id":1,"method":"Page.navigate","params":{"url":"file:///etc/passwd"}}`
+	for vm, allowed := range map[string]bool{"vm1": false, "vm2": true} {
+		conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/"+vm+"/devtools/page/fake-page", nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(denied)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_, reply, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if got := !strings.Contains(string(reply), `"error"`); got != allowed {
+			t.Errorf("%s: %s answered %s, want allowed %t", vm, denied, reply, allowed)
+		}
+		conn.Close()
+	}
+
+	// Recorded although recording isn't enabled.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		recordings, err := listRecordings(recordingDirs{dir: dir}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recordings) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recordings = %+v, want the sessions of both VMs", recordings)
+		}
+	}
+
+	if _, err := compilePolicies(nil, []config.TenantPolicyConfig{{Tenant: "acme", CDPDefault: "block"}}); err == nil {
+		t.Error("compilePolicies accepted an invalid tenant default")
+	}
+	if err := validateRecording(&config.CDPServerConfig{Tenants: []config.TenantPolicyConfig{{Tenant: "acme", RecordSessions: true}}}); err == nil {
+		t.Error("validateRecording accepted recording sessions nowhere")
+	}
+}
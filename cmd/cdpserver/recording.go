@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/redact"
+	"github.com/abshkbh/arrakis/pkg/relay"
+	"github.com/abshkbh/arrakis/pkg/server/workdir"
+)
+
+const (
+	// recordingExt is the extension of the NDJSON files sessions are
+	// recorded to.
+	recordingExt = ".ndjson"
+	// recordingTimeFormat names recordings by when their session started, so
+	// that they sort chronologically.
+	recordingTimeFormat = "20060102T150405.000000000Z"
+)
+
+// Directions of recorded frames, as the client sees them.
+const (
+	frameSent     = "sent"
+	frameReceived = "received"
+)
+
+// cdpFrame is a line of a recording: a message of a session.
+type cdpFrame struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	// Data holds text messages that are JSON, as CDP messages are, Text
+	// other text messages and Binary binary ones.
+	Data   json.RawMessage `json:"data,omitempty"`
+	Text   string          `json:"text,omitempty"`
+	Binary []byte          `json:"binary,omitempty"`
+}
+
+func newFrame(t time.Time, direction relay.Direction, messageType int, data []byte) cdpFrame {
+	frame := cdpFrame{Time: t, Direction: frameSent}
+	if direction == relay.ToClient {
+		frame.Direction = frameReceived
+	}
+	switch {
+	case messageType == websocket.BinaryMessage:
+		frame.Binary = append([]byte(nil), data...)
+	case json.Valid(data):
+		frame.Data = append(json.RawMessage(nil), data...)
+	default:
+		frame.Text = string(data)
+	}
+	return frame
+}
+
+// message returns the WebSocket message of the frame.
+func (f cdpFrame) message() (int, []byte) {
+	switch {
+	case f.Binary != nil:
+		return websocket.BinaryMessage, f.Binary
+	case f.Data != nil:
+		return websocket.TextMessage, f.Data
+	}
+	return websocket.TextMessage, []byte(f.Text)
+}
+
+// cdpRecorder records the messages of a session to a file.
+type cdpRecorder struct {
+	mu     sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	failed bool
+	// redactor masks credentials in text messages before they are written.
+	redactor *redact.Redactor
+}
+
+// recordingDirs locate the recordings of each VM: in a directory per VM of
+// dir if set, otherwise in the VMs' working directories in stateDir.
+type recordingDirs struct {
+	dir      string
+	stateDir string
+}
+
+// vm returns the directory of the recordings of vmName.
+func (d recordingDirs) vm(vmName string) string {
+	if d.dir != "" {
+		return filepath.Join(d.dir, vmName)
+	}
+	return filepath.Join(workdir.New(d.stateDir, vmName).Dir(workdir.Recordings), "cdp")
+}
+
+// vms returns the VMs that may have recordings.
+func (d recordingDirs) vms() ([]string, error) {
+	root := d.dir
+	if root == "" {
+		root = d.stateDir
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var vms []string
+	for _, e := range entries {
+		if e.IsDir() {
+			vms = append(vms, e.Name())
+		}
+	}
+	return vms, nil
+}
+
+// recordingDirs returns where sessions are recorded.
+func (s *cdpServer) recordingDirs() recordingDirs {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cfg == nil {
+		return recordingDirs{}
+	}
+	return recordingDirs{dir: s.cfg.Recording.Dir, stateDir: s.cfg.StateDir}
+}
+
+// validateRecording checks that recorded sessions have somewhere to go.
+func validateRecording(cfg *config.CDPServerConfig) error {
+	recorded := cfg.Recording.Enabled || slices.ContainsFunc(cfg.Tenants, func(t config.TenantPolicyConfig) bool { return t.RecordSessions })
+	if recorded && cfg.Recording.Dir == "" && cfg.StateDir == "" {
+		return errors.New("recording: set dir, or state_dir to record in the working directories of the VMs")
+	}
+	return nil
+}
+
+// recorded reports whether the sessions of vmName are to be recorded: if
+// recording is enabled for the VM, or its owner's bundle requires it.
+func recorded(cfg *config.CDPServerConfig, vmName string, owner string) bool {
+	if cfg.Recording.Enabled && (len(cfg.Recording.VMs) == 0 || slices.Contains(cfg.Recording.VMs, vmName)) {
+		return true
+	}
+	return owner != "" && slices.ContainsFunc(cfg.Tenants, func(t config.TenantPolicyConfig) bool {
+		return t.Tenant == owner && t.RecordSessions
+	})
+}
+
+// startRecording starts recording a session with target of vmName, returning
+// nil unless its sessions are recorded.
+func (s *cdpServer) startRecording(vmName string, target string) *cdpRecorder {
+	owner := s.ownerOf(vmName)
+	s.mu.RLock()
+	cfg, redactor := s.cfg, s.redactor
+	s.mu.RUnlock()
+	if cfg == nil || !recorded(cfg, vmName, owner) {
+		return nil
+	}
+
+	dir := s.recordingDirs().vm(vmName)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Warnf("Not recording the session of VM %s: %v", vmName, err)
+		return nil
+	}
+	name := time.Now().UTC().Format(recordingTimeFormat)
+	if target != "" {
+		name += "-" + target
+	}
+	file, err := os.OpenFile(filepath.Join(dir, name+recordingExt), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		log.Warnf("Not recording the session of VM %s: %v", vmName, err)
+		return nil
+	}
+	log.Infof("Recording the session of VM %s to %s", vmName, file.Name())
+	return &cdpRecorder{file: file, enc: json.NewEncoder(file), redactor: redactor}
+}
+
+// record appends a message to the recording. Once writing fails the
+// recording stops, the session goes on.
+func (r *cdpRecorder) record(direction relay.Direction, messageType int, data []byte) {
+	if r == nil {
+		return
+	}
+	if messageType == websocket.TextMessage {
+		data = r.redactor.Bytes(data)
+	}
+	frame := newFrame(time.Now(), direction, messageType, data)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed {
+		return
+	}
+	if err := r.enc.Encode(frame); err != nil {
+		log.Warnf("Stopped recording to %s: %v", r.file.Name(), err)
+		r.failed = true
+	}
+}
+
+// tap records the messages of a relay, nil if r is.
+func (r *cdpRecorder) tap() relay.Tap {
+	if r == nil {
+		return nil
+	}
+	return r.record
+}
+
+func (r *cdpRecorder) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.file.Close(); err != nil {
+		log.Warnf("Failed to close recording %s: %v", r.file.Name(), err)
+	}
+}
+
+// cdpRecording describes a recorded session.
+type cdpRecording struct {
+	// ID is the recording's name under its VM.
+	ID     string    `json:"id"`
+	VM     string    `json:"vm"`
+	Target string    `json:"target,omitempty"`
+	Start  time.Time `json:"start"`
+	Size   int64     `json:"size"`
+}
+
+// listRecordings returns the recordings of vmName, or of every VM if it's
+// empty, oldest first.
+func listRecordings(dirs recordingDirs, vmName string) ([]cdpRecording, error) {
+	vms := []string{vmName}
+	if vmName == "" {
+		var err error
+		if vms, err = dirs.vms(); err != nil {
+			return nil, err
+		}
+	}
+
+	recordings := []cdpRecording{}
+	for _, vm := range vms {
+		entries, err := os.ReadDir(dirs.vm(vm))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			id, ok := strings.CutSuffix(e.Name(), recordingExt)
+			if !ok || e.IsDir() {
+				continue
+			}
+			stamp, target, _ := strings.Cut(id, "-")
+			start, err := time.Parse(recordingTimeFormat, stamp)
+			if err != nil {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			recordings = append(recordings, cdpRecording{
+				ID:     id,
+				VM:     vm,
+				Target: target,
+				Start:  start,
+				Size:   info.Size(),
+			})
+		}
+	}
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].Start.Before(recordings[j].Start)
+	})
+	return recordings, nil
+}
+
+// recordingsHandler serves GET /v1/cdp/recordings, listing the recorded
+// sessions of the VMs the request's token opens, of the vm query parameter's
+// only if it is set.
+func (s *cdpServer) recordingsHandler(w http.ResponseWriter, r *http.Request) {
+	grant := grantFromContext(r.Context())
+	vmName := r.URL.Query().Get("vm")
+	if vmName != "" {
+		if _, err := grant.authorize(vmName); err != nil {
+			http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
+			return
+		}
+		if !validPathElement(vmName) {
+			http.Error(w, "400 Bad Request - invalid vm", http.StatusBadRequest)
+			return
+		}
+	}
+	recordings, err := listRecordings(s.recordingDirs(), vmName)
+	if err != nil {
+		log.Errorf("Failed to list recordings: %v", err)
+		http.Error(w, "500 Internal Server Error - failed to list recordings", http.StatusInternalServerError)
+		return
+	}
+	allowed := recordings[:0]
+	for _, rec := range recordings {
+		if _, err := grant.authorize(rec.VM); err == nil {
+			allowed = append(allowed, rec)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Recordings []cdpRecording `json:"recordings"`
+	}{allowed})
+}
+
+// recordingHandler serves GET /v1/cdp/recordings/{vmName}/{recording}, the
+// NDJSON of a recorded session.
+func (s *cdpServer) recordingHandler(w http.ResponseWriter, r *http.Request) {
+	vmName, id := mux.Vars(r)["vmName"], mux.Vars(r)["recording"]
+	if _, err := grantFromContext(r.Context()).authorize(vmName); err != nil {
+		http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if !validPathElement(vmName) || !validPathElement(id) {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(filepath.Join(s.recordingDirs().vm(vmName), id+recordingExt))
+	if err != nil {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	io.Copy(w, file)
+}
+
+// validPathElement reports whether name names a file within a directory.
+func validPathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// readRecording returns the frames of a recording.
+func readRecording(r io.Reader) ([]cdpFrame, error) {
+	var frames []cdpFrame
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(data))) > 0 {
+			var frame cdpFrame
+			if err := json.Unmarshal(data, &frame); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			frames = append(frames, frame)
+		}
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// replay sends what the client sent in frames to conn, spaced as recorded
+// divided by speed, or back to back if speed is 0, and writes the messages
+// conn sends back to out as frames. It returns once conn was quiet for idle
+// after the last message was sent, or closed.
+func replay(conn *websocket.Conn, frames []cdpFrame, speed float64, idle time.Duration, out io.Writer) error {
+	activity := make(chan struct{}, 1)
+	readDone := make(chan error, 1)
+	go func() {
+		enc := json.NewEncoder(out)
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				readDone <- err
+				return
+			}
+			if err := enc.Encode(newFrame(time.Now(), relay.ToClient, messageType, data)); err != nil {
+				readDone <- err
+				return
+			}
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	var first time.Time
+	start := time.Now()
+	for _, frame := range frames {
+		if frame.Direction != frameSent {
+			continue
+		}
+		if first.IsZero() {
+			first = frame.Time
+		}
+		if speed > 0 {
+			at := start.Add(time.Duration(float64(frame.Time.Sub(first)) / speed))
+			select {
+			case <-time.After(time.Until(at)):
+			case err := <-readDone:
+				return fmt.Errorf("connection closed while replaying: %w", err)
+			}
+		}
+		if err := conn.WriteMessage(frame.message()); err != nil {
+			return fmt.Errorf("failed to send: %w", err)
+		}
+	}
+
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-activity:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(idle)
+		case <-timer.C:
+			return nil
+		case err := <-readDone:
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// replayCommand replays the messages a client sent in a recorded session to a
+// DevTools WebSocket, e.g. of a fresh VM, printing what it answers in the
+// recording's format, to reproduce flaky automation runs.
+func replayCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "replay",
+		Usage:     "Replay a recorded CDP session to a DevTools WebSocket URL",
+		ArgsUsage: "<recording.ndjson>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "url",
+				Usage:    "DevTools WebSocket URL to replay to, e.g. ws://127.0.0.1:3003/vm/<name>/devtools/page/<id>",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "token",
+				Usage: "Bearer token of the CDP server",
+			},
+			&cli.Float64Flag{
+				Name:  "speed",
+				Usage: "Replay speed relative to the recording, 0 sends the messages back to back",
+				Value: 1,
+			},
+			&cli.DurationFlag{
+				Name:  "idle",
+				Usage: "How long to wait for answers after the last message",
+				Value: 5 * time.Second,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() != 1 {
+				return fmt.Errorf("expected the recording to replay")
+			}
+			file, err := os.Open(ctx.Args().First())
+			if err != nil {
+				return err
+			}
+			frames, err := readRecording(file)
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("failed to read recording: %w", err)
+			}
+
+			header := http.Header{}
+			if token := ctx.String("token"); token != "" {
+				header.Set("Authorization", "Bearer "+token)
+			}
+			conn, _, err := websocket.DefaultDialer.Dial(ctx.String("url"), header)
+			if err != nil {
+				return fmt.Errorf("failed to connect to %s: %w", ctx.String("url"), err)
+			}
+			defer conn.Close()
+			return replay(conn, frames, ctx.Float64("speed"), ctx.Duration("idle"), os.Stdout)
+		},
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/relay"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestWebSocketProxyRecords(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	dir := t.TempDir()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{
+		Recording: config.CDPRecordingConfig{Enabled: true, Dir: dir},
+		Policies:  testPolicies,
+	})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messages := []string{
+		`{"id":1,"method":"Page.navigate","params":{"url":"https://example.com"}}`,
+		`{"id":2,"method":"Page.navigate","params":{"url":"file:///etc/passwd"}}`,
+	}
+	for _, msg := range messages {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	conn.Close()
+
+	// The recording is closed once the relay noticed.
+	var recordings []cdpRecording
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		recordings, err = listRecordings(recordingDirs{dir: dir}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recordings) == 1 && recordings[0].Size > 0 {
+			break
+		}
+	}
+	if len(recordings) != 1 || recordings[0].VM != "vm1" || recordings[0].Target != "fake-page" {
+		t.Fatalf("recordings = %+v", recordings)
+	}
+
+	resp, err := http.Get(proxy.URL + "/v1/cdp/recordings/vm1/" + recordings[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	frames, err := readRecording(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both commands, Chrome's echo of the first and the policy's reply to
+	// the second.
+	want := []string{frameSent, frameReceived, frameSent, frameReceived}
+	if len(frames) != len(want) {
+		t.Fatalf("frames = %+v", frames)
+	}
+	for i, f := range frames {
+		if f.Direction != want[i] {
+			t.Errorf("frames[%d].Direction = %s, want %s", i, f.Direction, want[i])
+		}
+	}
+	if string(frames[2].Data) != messages[1] {
+		t.Errorf("frames[2].Data = %s, want %s", frames[2].Data, messages[1])
+	}
+}
+
+func TestRecordingsHandler(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{
+		"vm1/20240101T000000.000000000Z-page1.ndjson",
+		"vm2/20240102T000000.000000000Z.ndjson",
+		"vm2/notes.txt",
+	} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0o700)
+		os.WriteFile(filepath.Join(dir, path), []byte("{}\n"), 0o600)
+	}
+	s := newCDPServer("0", "http://127.0.0.1:1", config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{
+		Recording: config.CDPRecordingConfig{Dir: dir},
+		Auth: config.CDPAuthConfig{
+			Tokens:   []string{"admin"},
+			VMTokens: []config.VMTokenConfig{{Token: "vm2-token", VMs: []string{"vm2"}}},
+		},
+	})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	list := func(token string, query string) (int, []cdpRecording) {
+		req, _ := http.NewRequest("GET", proxy.URL+"/v1/cdp/recordings"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Recordings []cdpRecording `json:"recordings"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Recordings
+	}
+
+	if code, recordings := list("admin", ""); code != http.StatusOK || len(recordings) != 2 || recordings[0].VM != "vm1" || recordings[0].Target != "page1" {
+		t.Errorf("list = %d %+v", code, recordings)
+	}
+	if code, recordings := list("vm2-token", ""); code != http.StatusOK || len(recordings) != 1 || recordings[0].VM != "vm2" {
+		t.Errorf("list with a VM token = %d %+v", code, recordings)
+	}
+	if code, _ := list("vm2-token", "?vm=vm1"); code != http.StatusForbidden {
+		t.Errorf("list of another VM = %d, want %d", code, http.StatusForbidden)
+	}
+	if code, _ := list("", ""); code != http.StatusUnauthorized {
+		t.Errorf("list without a token = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:"+chrome.Port()+"/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	recording := []cdpFrame{
+		{Time: start, Direction: frameSent, Data: json.RawMessage(`{"id":1,"method":"Page.enable"}`)},
+		{Time: start.Add(time.Millisecond), Direction: frameReceived, Data: json.RawMessage(`{"id":1,"result":{}}`)},
+		{Time: start.Add(50 * time.Millisecond), Direction: frameSent, Text: "not json"},
+	}
+	var out bytes.Buffer
+	if err := replay(conn, recording, 1, 200*time.Millisecond, &out); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("replay took %s, want the recorded spacing", elapsed)
+	}
+	frames, err := readRecording(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Chrome echoes what was sent.
+	if len(frames) != 2 || string(frames[0].Data) != `{"id":1,"method":"Page.enable"}` || frames[1].Text != "not json" {
+		t.Errorf("replayed frames = %+v", frames)
+	}
+}
+
+func TestRecordingRedacts(t *testing.T) {
+	dir := t.TempDir()
+	s := newCDPServer("0", "http://127.0.0.1:0", config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{
+		Recording: config.CDPRecordingConfig{Enabled: true, Dir: dir},
+		Redaction: config.RedactionConfig{Patterns: []string{`"password":"([^"]*)"`}},
+	})
+	rec := s.startRecording("vm1", "page1")
+	rec.record(relay.ToClient, websocket.TextMessage, []byte(`{"method":"Network.requestWillBeSentExtraInfo","params":{"headers":{"Cookie":"sid=s3cret","Accept":"*/*"}}}`))
+	rec.record(relay.FromClient, websocket.TextMessage, []byte(`{"id":1,"method":"Runtime.evaluate","params":{"password":"hunter2"}}`))
+	rec.close()
+
+	recordings, err := listRecordings(recordingDirs{dir: dir}, "vm1")
+	if err != nil || len(recordings) != 1 {
+		t.Fatalf("recordings = %+v, %v", recordings, err)
+	}
+	file, err := os.Open(filepath.Join(dir, "vm1", recordings[0].ID+recordingExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	frames, err := readRecording(file)
+	if err != nil || len(frames) != 2 {
+		t.Fatalf("frames = %+v, %v", frames, err)
+	}
+	// Redacted messages are still JSON.
+	for i, want := range []string{
+		`{"method":"Network.requestWillBeSentExtraInfo","params":{"headers":{"Cookie":"[REDACTED]","Accept":"*/*"}}}`,
+		`{"id":1,"method":"Runtime.evaluate","params":{"password":"[REDACTED]"}}`,
+	} {
+		if string(frames[i].Data) != want {
+			t.Errorf("frames[%d].Data = %s, want %s", i, frames[i].Data, want)
+		}
+	}
+}
+
+func TestRecordingsInStateDir(t *testing.T) {
+	stateDir := t.TempDir()
+	dirs := recordingDirs{stateDir: stateDir}
+	if got, want := dirs.vm("vm1"), filepath.Join(stateDir, "vm1", "recordings", "cdp"); got != want {
+		t.Fatalf("vm(vm1) = %s, want %s", got, want)
+	}
+	os.MkdirAll(dirs.vm("vm1"), 0o700)
+	os.WriteFile(filepath.Join(dirs.vm("vm1"), "20240101T000000.000000000Z-page1.ndjson"), []byte("{}\n"), 0o600)
+	// Working directories without recordings and other files of the state
+	// dir are skipped.
+	os.MkdirAll(filepath.Join(stateDir, "vm2", "logs"), 0o700)
+	os.WriteFile(filepath.Join(stateDir, "store.json"), []byte("{}"), 0o600)
+
+	recordings, err := listRecordings(dirs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) != 1 || recordings[0].VM != "vm1" || recordings[0].Target != "page1" {
+		t.Fatalf("recordings = %+v", recordings)
+	}
+
+	if err := validateRecording(&config.CDPServerConfig{Recording: config.CDPRecordingConfig{Enabled: true}}); err == nil {
+		t.Error("recording without dir or state_dir was accepted")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const (
+	// defaultVMCacheTTL is how long the VM list is routed with before it is
+	// revalidated, unless watched.
+	defaultVMCacheTTL = 2 * time.Second
+	// refreshRetryInterval is how long the last list is used as is after a
+	// refresh failed, rather than trying again on every request.
+	refreshRetryInterval = time.Second
+	// vmWatchWait is how long one long-poll of the VM list waits for a change.
+	vmWatchWait = 30 * time.Second
+	// Bounds the backoff between failed long-polls.
+	vmWatchMinRetry = time.Second
+	vmWatchMaxRetry = 30 * time.Second
+	// Defaults of the discovery of VMs and of their browsers.
+	defaultDiscoveryTimeout = 10 * time.Second
+	defaultCDPDescription   = "cdp"
+	defaultCDPGuestPort     = "9223"
+)
+
+// vmSnapshot is a VM list, never modified once published.
+type vmSnapshot struct {
+	vms    []VM          // Ordered like the REST API lists them, by ID
+	byName map[string]VM // Only the running ones
+	// revision is the REST API's revision of the list, "" if unknown.
+	revision string
+}
+
+// newVMSnapshot indexes vms, keyed by ID or, without one, by name.
+func newVMSnapshot(byKey map[string]VM, revision string) *vmSnapshot {
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	snapshot := &vmSnapshot{byName: make(map[string]VM), revision: revision}
+	for _, key := range keys {
+		vm := byKey[key]
+		snapshot.vms = append(snapshot.vms, vm)
+		if vm.Status == "RUNNING" {
+			snapshot.byName[vm.VMName] = vm
+		}
+	}
+	return snapshot
+}
+
+func vmKey(vm VM) string {
+	if vm.VMID != "" {
+		return vm.VMID
+	}
+	return vm.VMName
+}
+
+// vmRegistry caches the VM list of the REST API, so that routing a request
+// doesn't query it every time. The list is revalidated once older than ttl
+// or, while watched, kept current by long-polling the REST API for changes.
+// The last list keeps being used while the REST API can't be reached.
+type vmRegistry struct {
+	// refreshMu serializes refreshes, so that the requests finding the list
+	// stale wait for one refresh rather than each making their own.
+	refreshMu sync.Mutex
+
+	mu        sync.Mutex
+	snapshot  *vmSnapshot // nil until first fetched
+	fetchedAt time.Time
+	failedAt  time.Time // Of the last failed refresh
+	ttl       time.Duration
+	// watching is set while long-polls succeed, the list is then current.
+	watching bool
+}
+
+func newVMRegistry() *vmRegistry {
+	return &vmRegistry{ttl: defaultVMCacheTTL}
+}
+
+// setTTL sets the time the list is used for, the default if ttl isn't
+// positive.
+func (r *vmRegistry) setTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultVMCacheTTL
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ttl = ttl
+}
+
+// current returns the list and whether it can be routed with as is.
+func (r *vmRegistry) current() (*vmSnapshot, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fresh := r.snapshot != nil && (r.watching || time.Since(r.fetchedAt) < r.ttl)
+	return r.snapshot, fresh
+}
+
+// age returns how long ago the list was fetched.
+func (r *vmRegistry) age() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Since(r.fetchedAt)
+}
+
+// recentlyFailed reports whether a refresh failed less than
+// refreshRetryInterval ago.
+func (r *vmRegistry) recentlyFailed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Since(r.failedAt) < refreshRetryInterval
+}
+
+func (r *vmRegistry) refreshFailed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failedAt = time.Now()
+}
+
+// isWatching reports whether the list is kept current by long-polls.
+func (r *vmRegistry) isWatching() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.watching
+}
+
+func (r *vmRegistry) setWatching(watching bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.watching = watching
+}
+
+// replace installs a full list.
+func (r *vmRegistry) replace(vms []VM, revision string) {
+	byKey := make(map[string]VM, len(vms))
+	for _, vm := range vms {
+		byKey[vmKey(vm)] = vm
+	}
+	snapshot := newVMSnapshot(byKey, revision)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.snapshot = snapshot
+	r.fetchedAt = time.Now()
+}
+
+// apply installs the changes of a `?since=` listing, or its full list if it
+// isn't a delta. A delta racing with a refresh may undo changes the refresh
+// saw, the next delta brings them back.
+func (r *vmRegistry) apply(resp VMResponse) {
+	if !resp.Delta {
+		r.replace(resp.VMs, resp.Revision)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.snapshot == nil {
+		return
+	}
+	byKey := make(map[string]VM, len(r.snapshot.vms))
+	for _, vm := range r.snapshot.vms {
+		byKey[vmKey(vm)] = vm
+	}
+	for _, vm := range resp.VMs {
+		byKey[vmKey(vm)] = vm
+	}
+	for _, id := range resp.Removed {
+		delete(byKey, id)
+	}
+	r.snapshot = newVMSnapshot(byKey, resp.Revision)
+	r.fetchedAt = time.Now()
+}
+
+// refreshVMs fetches the full VM list into the registry.
+func (s *cdpServer) refreshVMs() error {
+	body, err := s.fetchVMList()
+	if err != nil {
+		return err
+	}
+	var vmResponse VMResponse
+	if err := json.Unmarshal(body, &vmResponse); err != nil {
+		return fmt.Errorf("failed to parse VM response: %v", err)
+	}
+	s.declareBrowsers(vmResponse.VMs)
+	s.vms.replace(vmResponse.VMs, vmResponse.Revision)
+	return nil
+}
+
+// ownerOf returns the owner of the running VM vmName as last listed, "" if
+// unknown.
+func (s *cdpServer) ownerOf(vmName string) string {
+	snapshot, _ := s.vms.current()
+	if snapshot == nil {
+		return ""
+	}
+	return snapshot.byName[vmName].Owner
+}
+
+// discoveryConfig returns how VMs and their browsers are discovered, with
+// defaults applied.
+func (s *cdpServer) discoveryConfig() (timeout time.Duration, description, guestPort string) {
+	s.mu.RLock()
+	if s.cfg != nil {
+		timeout, description, guestPort = s.cfg.DiscoveryTimeout, s.cfg.CDPDescription, s.cfg.CDPGuestPort
+	}
+	s.mu.RUnlock()
+	if timeout <= 0 {
+		timeout = defaultDiscoveryTimeout
+	}
+	if description == "" {
+		description = defaultCDPDescription
+	}
+	if guestPort == "" {
+		guestPort = defaultCDPGuestPort
+	}
+	return timeout, description, guestPort
+}
+
+// validateDiscovery checks the REST API URL and the browser discovery
+// settings of the config.
+func validateDiscovery(cfg *config.CDPServerConfig) error {
+	if cfg.RestAPIURL != "" {
+		u, err := url.Parse(cfg.RestAPIURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("rest_api_url must be an http or https URL, got %q", cfg.RestAPIURL)
+		}
+	}
+	if cfg.DiscoveryTimeout < 0 {
+		return fmt.Errorf("discovery_timeout must not be negative")
+	}
+	if strings.Contains(cfg.CDPDescription, ":") {
+		return fmt.Errorf("cdp_description must not contain ':'")
+	}
+	if cfg.CDPGuestPort != "" {
+		if port, err := strconv.Atoi(cfg.CDPGuestPort); err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("cdp_guest_port must be a port number, got %q", cfg.CDPGuestPort)
+		}
+	}
+	return nil
+}
+
+// declareBrowsers declares the browser services of the VMs whose port
+// forwards declare no service, as a restserver predating services lists
+// them: by the configured description, or guest port for the default
+// browser. VMs declaring services are left as is.
+func (s *cdpServer) declareBrowsers(vms []VM) {
+	_, description, guestPort := s.discoveryConfig()
+	for i := range vms {
+		pfs := vms[i].PortForwards
+		if slices.ContainsFunc(pfs, func(pf PortForward) bool { return pf.Service != nil }) {
+			continue
+		}
+		hasDefault := slices.ContainsFunc(pfs, func(pf PortForward) bool { return pf.Description == description })
+		for j, pf := range pfs {
+			name := ""
+			if pf.Description == description || (!hasDefault && pf.GuestPort == guestPort) {
+				name = config.DefaultBrowserService
+			} else if id, ok := strings.CutPrefix(pf.Description, description+":"); ok && id != "" {
+				name = id
+			}
+			if name != "" {
+				pfs[j].Service = &PortForwardService{Name: name, Protocol: "cdp", GuestPort: pf.GuestPort, Proxy: config.ServiceProxyCDP}
+			}
+		}
+	}
+}
+
+// lookupVMs returns the VMs to route a request for vmName ("" for any) with,
+// refreshed first if stale or if vmName isn't known, e.g. as it just
+// started. Without the REST API, the last list fetched is returned.
+func (s *cdpServer) lookupVMs(vmName string) (*vmSnapshot, error) {
+	snapshot, fresh := s.vms.current()
+	if fresh {
+		if _, known := snapshot.byName[vmName]; vmName == "" || known {
+			return snapshot, nil
+		}
+	}
+	if snapshot != nil && s.vms.recentlyFailed() {
+		return snapshot, nil
+	}
+
+	s.vms.refreshMu.Lock()
+	defer s.vms.refreshMu.Unlock()
+	// Another request may have refreshed the list while this one waited.
+	if refreshed, _ := s.vms.current(); refreshed != snapshot {
+		return refreshed, nil
+	}
+	if err := s.refreshVMs(); err != nil {
+		s.vms.refreshFailed()
+		if snapshot == nil {
+			return nil, err
+		}
+		log.Warnf("Routing with the VM list of %s ago: %v", s.vms.age().Round(time.Second), err)
+		return snapshot, nil
+	}
+	snapshot, _ = s.vms.current()
+	return snapshot, nil
+}
+
+// pollVMChanges waits for the VMs to change after the registry's revision,
+// and applies the changes.
+func (s *cdpServer) pollVMChanges(ctx context.Context) error {
+	snapshot, _ := s.vms.current()
+	if snapshot == nil || snapshot.revision == "" {
+		return s.refreshVMs()
+	}
+
+	// Bounded in case the connection hangs, the list would then look current
+	// while it isn't.
+	ctx, cancel := context.WithTimeout(ctx, vmWatchWait+vmWatchMaxRetry)
+	defer cancel()
+	query := url.Values{"since": {snapshot.revision}, "wait": {vmWatchWait.String()}}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.restAPIURL+"/v1/vms?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create VM API request: %v", err)
+	}
+	start := time.Now()
+	resp, err := s.restClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query VM API: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		// The revision wasn't accepted, start over from a full list.
+		if err := s.refreshVMs(); err != nil {
+			return err
+		}
+		return fmt.Errorf("VM API rejected revision %s", snapshot.revision)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("VM API returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	var vmResponse VMResponse
+	if err := json.Unmarshal(body, &vmResponse); err != nil {
+		return fmt.Errorf("failed to parse VM response: %v", err)
+	}
+	s.declareBrowsers(vmResponse.VMs)
+	s.vms.apply(vmResponse)
+
+	// A REST API that doesn't support waiting answers at once, don't spin.
+	if vmResponse.Revision == snapshot.revision && time.Since(start) < vmWatchMinRetry {
+		select {
+		case <-ctx.Done():
+		case <-time.After(vmWatchMinRetry):
+		}
+	}
+	return nil
+}
+
+// watchVMs keeps the registry current by long-polling the REST API until ctx
+// is done. While polls fail, the registry falls back to its TTL.
+func (s *cdpServer) watchVMs(ctx context.Context) {
+	retry := vmWatchMinRetry
+	for ctx.Err() == nil {
+		if err := s.pollVMChanges(ctx); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			s.vms.setWatching(false)
+			log.Warnf("Failed to watch the VM list, retrying in %s: %v", retry, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retry):
+			}
+			retry = min(2*retry, vmWatchMaxRetry)
+			continue
+		}
+		retry = vmWatchMinRetry
+		s.vms.setWatching(true)
+	}
+	s.vms.setWatching(false)
+}
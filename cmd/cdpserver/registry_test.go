@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestVMRegistryCaches(t *testing.T) {
+	chrome1 := testharness.NewFakeChrome()
+	defer chrome1.Close()
+	chrome2 := testharness.NewFakeChrome()
+	defer chrome2.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome1))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.vms.setTTL(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if _, vm, err := s.discoverCDPPort("", ""); err != nil || vm.VMName != "vm1" {
+			t.Fatalf("discoverCDPPort = %s, %v", vm.VMName, err)
+		}
+	}
+	if api.Requests() != 1 {
+		t.Errorf("%d VM list queries, want 1", api.Requests())
+	}
+
+	// A VM that isn't known yet is looked up at once.
+	api.SetVMs(testharness.RunningVM("vm1", chrome1), testharness.RunningVM("vm2", chrome2))
+	if port, _, err := s.discoverCDPPort("vm2", ""); err != nil || port != chrome2.Port() {
+		t.Errorf("discoverCDPPort(vm2) = %s, %v", port, err)
+	}
+
+	// The last list keeps being used without the REST API.
+	s.vms.ttl = 0
+	api.Close()
+	if port, _, err := s.discoverCDPPort("vm2", ""); err != nil || port != chrome2.Port() {
+		t.Errorf("discoverCDPPort(vm2) without the REST API = %s, %v", port, err)
+	}
+}
+
+func TestVMRegistryWatches(t *testing.T) {
+	chrome1 := testharness.NewFakeChrome()
+	defer chrome1.Close()
+	chrome2 := testharness.NewFakeChrome()
+	defer chrome2.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome1))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.vms.setTTL(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.watchVMs(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.vms.isWatching() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !s.vms.isWatching() {
+		t.Fatal("registry isn't watching the VM list")
+	}
+
+	// vm1 stopping is seen without a lookup.
+	api.SetVMs(testharness.RunningVM("vm2", chrome2))
+	for time.Now().Before(deadline) {
+		if vms, _ := s.vms.current(); vms != nil && len(vms.byName) == 1 && vms.byName["vm2"].VMName == "vm2" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	requests := api.Requests()
+	if _, vm, err := s.discoverCDPPort("", ""); err != nil || vm.VMName != "vm2" {
+		t.Errorf("discoverCDPPort after vm1 stopped = %s, %v", vm.VMName, err)
+	}
+	if _, _, err := s.discoverCDPPort("vm1", ""); err == nil {
+		t.Errorf("discoverCDPPort(vm1) of stopped VM succeeded")
+	}
+	// Only the lookup of the unknown vm1 queried the REST API.
+	if got := api.Requests() - requests; got != 1 {
+		t.Errorf("%d VM list queries during lookups, want 1", got)
+	}
+}
+
+func TestVMRegistryAppliesDeltas(t *testing.T) {
+	r := newVMRegistry()
+	r.replace([]VM{
+		{VMID: "a", VMName: "vm1", Status: "RUNNING"},
+		{VMID: "b", VMName: "vm2", Status: "RUNNING"},
+	}, "1")
+	r.apply(VMResponse{
+		VMs:      []VM{{VMID: "a", VMName: "vm1", Status: "STOPPED"}, {VMID: "c", VMName: "vm3", Status: "RUNNING"}},
+		Removed:  []string{"b"},
+		Revision: "2",
+		Delta:    true,
+	})
+	vms, _ := r.current()
+	if vms.revision != "2" || len(vms.vms) != 2 || len(vms.byName) != 1 || vms.byName["vm3"].VMID != "c" {
+		t.Errorf("after delta: %+v", vms)
+	}
+}
+
+func TestDiscoverUndeclaredBrowsers(t *testing.T) {
+	chrome1 := testharness.NewFakeChrome()
+	defer chrome1.Close()
+	chrome2 := testharness.NewFakeChrome()
+	defer chrome2.Close()
+	// A restserver predating services, with customized port forward naming.
+	vm1 := testharness.RunningVM("vm1", chrome1)
+	vm1.PortForwards = []testharness.PortForward{
+		{Description: "devtools", GuestPort: "9300", HostPort: chrome1.Port()},
+		{Description: "devtools:second", GuestPort: "9301", HostPort: chrome2.Port()},
+		{Description: "novnc", GuestPort: "6080", HostPort: "1"},
+	}
+	vm2 := testharness.RunningVM("vm2", chrome2)
+	vm2.PortForwards = []testharness.PortForward{
+		{Description: "chromium", GuestPort: "9300", HostPort: chrome2.Port()},
+	}
+	api := testharness.NewFakeRESTAPI(vm1, vm2)
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{CDPDescription: "devtools", CDPGuestPort: "9300"})
+
+	if port, vm, err := s.discoverCDPPort("vm1", ""); err != nil || port != chrome1.Port() || len(vm.browsers()) != 2 {
+		t.Errorf("discoverCDPPort(vm1) = %s, %q, %v, want %s and 2 browsers", port, vm.browsers(), err, chrome1.Port())
+	}
+	if port, _, err := s.discoverCDPPort("vm1", "second"); err != nil || port != chrome2.Port() {
+		t.Errorf("discoverCDPPort(vm1, second) = %s, %v, want %s", port, err, chrome2.Port())
+	}
+	if port, _, err := s.discoverCDPPort("vm2", ""); err != nil || port != chrome2.Port() {
+		t.Errorf("discoverCDPPort(vm2) = %s, %v, want the guest port's %s", port, err, chrome2.Port())
+	}
+}
+
+func TestDiscoveryTimeout(t *testing.T) {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	s := newCDPServer("0", hung.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{DiscoveryTimeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	if err := s.refreshVMs(); err == nil {
+		t.Fatal("refreshVMs succeeded against a hung REST API")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("refreshVMs took %v, want the discovery timeout", elapsed)
+	}
+}
+
+func TestValidateDiscovery(t *testing.T) {
+	for i, tc := range []struct {
+		cfg config.CDPServerConfig
+		ok  bool
+	}{
+		{config.CDPServerConfig{}, true},
+		{config.CDPServerConfig{RestAPIURL: "https://restserver:7000", CDPDescription: "devtools", CDPGuestPort: "9222"}, true},
+		{config.CDPServerConfig{RestAPIURL: "restserver:7000"}, false},
+		{config.CDPServerConfig{CDPDescription: "cdp:main"}, false},
+		{config.CDPServerConfig{CDPGuestPort: "devtools"}, false},
+		{config.CDPServerConfig{DiscoveryTimeout: -time.Second}, false},
+	} {
+		if err := validateDiscovery(&tc.cfg); (err == nil) != tc.ok {
+			t.Errorf("case %d: validateDiscovery = %v, want ok %v", i, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// devtoolsTarget is a target of Chrome's /json and /json/list responses.
+type devtoolsTarget struct {
+	Description          string `json:"description"`
+	DevtoolsFrontendURL  string `json:"devtoolsFrontendUrl,omitempty"`
+	FaviconURL           string `json:"faviconUrl,omitempty"`
+	ID                   string `json:"id"`
+	ParentID             string `json:"parentId,omitempty"`
+	Title                string `json:"title"`
+	Type                 string `json:"type"`
+	URL                  string `json:"url"`
+	WebSocketDebuggerURL string `json:"webSocketDebuggerUrl,omitempty"`
+}
+
+// browserVersion is Chrome's /json/version response.
+type browserVersion struct {
+	AndroidPackage       string `json:"Android-Package,omitempty"`
+	Browser              string `json:"Browser"`
+	ProtocolVersion      string `json:"Protocol-Version"`
+	UserAgent            string `json:"User-Agent"`
+	V8Version            string `json:"V8-Version,omitempty"`
+	WebKitVersion        string `json:"WebKit-Version,omitempty"`
+	WebSocketDebuggerURL string `json:"webSocketDebuggerUrl,omitempty"`
+}
+
+// urlRewriter points the WebSocket URLs of a VM's Chrome at the proxy, on the
+// VM's path, so that connecting to them reaches that VM whichever port or
+// address its Chrome reported.
+type urlRewriter struct {
+	// scheme is "ws" or "wss", as clients reach the proxy.
+	scheme string
+	// host and port clients reach the proxy on.
+	host   string
+	vmName string
+	// browserID is the VM's browser the URLs are of, "" for the default
+	// one.
+	browserID string
+}
+
+// rewritesJSON reports whether rewriteJSON rewrites the response of Chrome to
+// upstreamPath.
+func rewritesJSON(upstreamPath string) bool {
+	switch p, _, _ := strings.Cut(upstreamPath, "?"); p {
+	case "/json", "/json/list", "/json/version":
+		return true
+	}
+	return false
+}
+
+// rewriteJSON rewrites the URLs of the response of Chrome to upstreamPath,
+// returning other responses as they are.
+func (u urlRewriter) rewriteJSON(upstreamPath string, body []byte) ([]byte, error) {
+	p, _, _ := strings.Cut(upstreamPath, "?")
+	switch p {
+	case "/json", "/json/list":
+		var targets []devtoolsTarget
+		if err := json.Unmarshal(body, &targets); err != nil {
+			return nil, err
+		}
+		for i := range targets {
+			targets[i].WebSocketDebuggerURL = u.webSocketURL(targets[i].WebSocketDebuggerURL)
+			targets[i].DevtoolsFrontendURL = u.frontendURL(targets[i].DevtoolsFrontendURL)
+		}
+		return encodeJSON(targets)
+	case "/json/version":
+		var version browserVersion
+		if err := json.Unmarshal(body, &version); err != nil {
+			return nil, err
+		}
+		version.WebSocketDebuggerURL = u.webSocketURL(version.WebSocketDebuggerURL)
+		return encodeJSON(version)
+	default:
+		return body, nil
+	}
+}
+
+// encodeJSON encodes v indented like Chrome, leaving the & of URLs as is.
+func encodeJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "   ")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// vmPath returns the path of a DevTools path on the route of the VM's
+// browser.
+func (u urlRewriter) vmPath(devtoolsPath string) string {
+	if u.browserID != "" {
+		return "/vm/" + u.vmName + "/browser/" + u.browserID + devtoolsPath
+	}
+	return "/vm/" + u.vmName + devtoolsPath
+}
+
+// webSocketURL rewrites a ws:// or wss:// URL of Chrome, e.g.
+// "ws://127.0.0.1:9223/devtools/page/<id>".
+func (u urlRewriter) webSocketURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "ws" && parsed.Scheme != "wss") {
+		return raw
+	}
+	parsed.Scheme = u.scheme
+	parsed.Host = u.host
+	parsed.Path = u.vmPath(parsed.Path)
+	parsed.RawPath = ""
+	return parsed.String()
+}
+
+// frontendURL rewrites the ws= or wss= parameter, "<host>/devtools/...", of
+// a DevTools frontend URL, and the path of the frontend Chrome serves itself,
+// e.g. "/devtools/inspector.html?ws=127.0.0.1:9223/devtools/page/<id>".
+// Parameters are kept unescaped and in order, as Chrome writes them.
+func (u urlRewriter) frontendURL(raw string) string {
+	base, query, ok := strings.Cut(raw, "?")
+	if !ok {
+		return raw
+	}
+	params := strings.Split(query, "&")
+	rewritten := false
+	for i, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+		if name != "ws" && name != "wss" {
+			continue
+		}
+		slash := strings.Index(value, "/")
+		if slash < 0 {
+			continue
+		}
+		params[i] = u.scheme + "=" + u.host + u.vmPath(value[slash:])
+		rewritten = true
+	}
+	if !rewritten {
+		return raw
+	}
+	if strings.HasPrefix(base, "/devtools/") {
+		base = u.vmPath(base)
+	}
+	return base + "?" + strings.Join(params, "&")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteJSON(t *testing.T) {
+	u := urlRewriter{scheme: "wss", host: "cdp.example.com", vmName: "vm1"}
+
+	// Chrome on a nonstandard port, formatted differently than usual.
+	list := `[{"description":"","devtoolsFrontendUrl":"/devtools/inspector.html?ws=10.20.1.2:9333/devtools/page/P1&panel=console",
+		"id":"P1","title":"Example","type":"page","url":"https://example.com/?a=1&b=2",
+		"webSocketDebuggerUrl":"ws://10.20.1.2:9333/devtools/page/P1"},
+		{"id":"W1","type":"service_worker","title":"sw","url":"https://example.com/sw.js",
+		"devtoolsFrontendUrl":"https://chrome-devtools-frontend.appspot.com/serve_rev/@abc/inspector.html?ws=localhost:9222/devtools/page/W1",
+		"webSocketDebuggerUrl":"ws://localhost:9222/devtools/page/W1"}]`
+	body, err := u.rewriteJSON("/json/list", []byte(list))
+	if err != nil {
+		t.Fatalf("rewriteJSON(/json/list) = %v", err)
+	}
+	var targets []devtoolsTarget
+	if err := json.Unmarshal(body, &targets); err != nil {
+		t.Fatal(err)
+	}
+	want := []devtoolsTarget{
+		{
+			DevtoolsFrontendURL:  "/vm/vm1/devtools/inspector.html?wss=cdp.example.com/vm/vm1/devtools/page/P1&panel=console",
+			ID:                   "P1",
+			Title:                "Example",
+			Type:                 "page",
+			URL:                  "https://example.com/?a=1&b=2",
+			WebSocketDebuggerURL: "wss://cdp.example.com/vm/vm1/devtools/page/P1",
+		},
+		{
+			DevtoolsFrontendURL:  "https://chrome-devtools-frontend.appspot.com/serve_rev/@abc/inspector.html?wss=cdp.example.com/vm/vm1/devtools/page/W1",
+			ID:                   "W1",
+			Title:                "sw",
+			Type:                 "service_worker",
+			URL:                  "https://example.com/sw.js",
+			WebSocketDebuggerURL: "wss://cdp.example.com/vm/vm1/devtools/page/W1",
+		},
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("rewriteJSON(/json/list) = %+v, want %+v", targets, want)
+	}
+
+	body, err = u.rewriteJSON("/json/version", []byte(`{"Browser": "Chrome/120", "webSocketDebuggerUrl": "ws://127.0.0.1:40000/devtools/browser/B1"}`))
+	if err != nil {
+		t.Fatalf("rewriteJSON(/json/version) = %v", err)
+	}
+	var version browserVersion
+	if err := json.Unmarshal(body, &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Browser != "Chrome/120" || version.WebSocketDebuggerURL != "wss://cdp.example.com/vm/vm1/devtools/browser/B1" {
+		t.Errorf("rewriteJSON(/json/version) = %+v", version)
+	}
+
+	if _, err := u.rewriteJSON("/json/list", []byte("<html>")); err == nil {
+		t.Error("rewriteJSON accepted a response that isn't JSON")
+	}
+	if body, err := u.rewriteJSON("/devtools/inspector.html", []byte("<html>")); err != nil || string(body) != "<html>" {
+		t.Errorf("rewriteJSON(/devtools/inspector.html) = %q, %v, want it as is", body, err)
+	}
+}
+
+func TestRewriteJSONOfBrowser(t *testing.T) {
+	u := urlRewriter{scheme: "ws", host: "cdp.example.com", vmName: "vm1", browserID: "profile2"}
+	body, err := u.rewriteJSON("/json/version", []byte(`{"Browser":"Chrome/120","webSocketDebuggerUrl":"ws://127.0.0.1:9224/devtools/browser/B1"}`))
+	if err != nil {
+		t.Fatalf("rewriteJSON(/json/version) = %v", err)
+	}
+	var version browserVersion
+	if err := json.Unmarshal(body, &version); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ws://cdp.example.com/vm/vm1/browser/profile2/devtools/browser/B1"; version.WebSocketDebuggerURL != want {
+		t.Errorf("webSocketDebuggerUrl = %q, want %q", version.WebSocketDebuggerURL, want)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// routePruneInterval is how often the VM list is checked for VMs that
+// stopped, whose routes and connections are then dropped.
+const routePruneInterval = 5 * time.Second
+
+// targetRoute is the VM and browser a DevTools target was seen on.
+type targetRoute struct {
+	vm string
+	// browserID is the VM's browser, "" for the default one.
+	browserID string
+	// browser targets aren't listed by /json/list, so they are only dropped
+	// along with their VM.
+	browser bool
+}
+
+// routedConn is a DevTools connection being relayed to a VM.
+type routedConn struct {
+	target string
+	remote string
+	start  time.Time
+	// close ends the relay, e.g. when the VM stopped, telling the client why
+	// with a close frame.
+	close func(code int, text string)
+	// muxed connections are closed along with their multiplexed client
+	// connection when draining.
+	muxed bool
+}
+
+// routeTable maps the DevTools targets listed by the VMs' Chrome to their VM,
+// so that a client connecting to a target's webSocketDebuggerUrl, which
+// doesn't name the VM, reaches the VM that listed it rather than the first
+// running one. It also tracks the connections relayed to each VM, to close
+// them once it stops.
+type routeTable struct {
+	mu      sync.Mutex
+	targets map[string]targetRoute
+	conns   map[string]map[*routedConn]struct{} // By VM
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		targets: make(map[string]targetRoute),
+		conns:   make(map[string]map[*routedConn]struct{}),
+	}
+}
+
+// targetID returns the target a DevTools path such as "/devtools/page/<id>"
+// connects to, or "" for other paths.
+func targetID(devtoolsPath string) string {
+	parts := strings.Split(strings.TrimPrefix(devtoolsPath, "/devtools/"), "/")
+	if !strings.HasPrefix(devtoolsPath, "/devtools/") || len(parts) != 2 || parts[1] == "" {
+		return ""
+	}
+	return parts[1]
+}
+
+// learn records the targets of a /json, /json/list, /json/new or
+// /json/version response of the browser browserID of vm. A full list
+// replaces the page targets of that browser seen before, except those still
+// connected.
+func (t *routeTable) learn(vm string, browserID string, upstreamPath string, body []byte) {
+	type target struct {
+		ID                   string `json:"id"`
+		WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+	}
+	var targets []target
+	if err := json.Unmarshal(body, &targets); err != nil {
+		var single target
+		if err := json.Unmarshal(body, &single); err != nil {
+			return
+		}
+		targets = []target{single}
+	}
+	p, _, _ := strings.Cut(upstreamPath, "?")
+	full := p == "/json" || p == "/json/list"
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if full {
+		connected := make(map[string]bool)
+		for c := range t.conns[vm] {
+			connected[c.target] = true
+		}
+		for id, route := range t.targets {
+			if route.vm == vm && route.browserID == browserID && !route.browser && !connected[id] {
+				delete(t.targets, id)
+			}
+		}
+	}
+	for _, target := range targets {
+		id := target.ID
+		wsPath := target.WebSocketDebuggerURL
+		if i := strings.Index(wsPath, "/devtools/"); i >= 0 {
+			wsPath = wsPath[i:]
+		}
+		browser := strings.HasPrefix(wsPath, "/devtools/browser/")
+		if id == "" {
+			id = targetID(wsPath)
+		}
+		if id == "" {
+			continue
+		}
+		if route, ok := t.targets[id]; ok && route.vm != vm {
+			log.Warnf("DevTools target %s of VM %s is also listed by VM %s, routing it to %s", id, route.vm, vm, vm)
+		}
+		t.targets[id] = targetRoute{vm: vm, browserID: browserID, browser: browser}
+	}
+}
+
+// lookup returns the VM and browser the target of a DevTools path was listed
+// by.
+func (t *routeTable) lookup(devtoolsPath string) (targetRoute, bool) {
+	id := targetID(devtoolsPath)
+	if id == "" {
+		return targetRoute{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	route, ok := t.targets[id]
+	return route, ok
+}
+
+// track records a connection relayed to vm until the returned func is
+// called.
+func (t *routeTable) track(vm string, c *routedConn) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[vm] == nil {
+		t.conns[vm] = make(map[*routedConn]struct{})
+	}
+	t.conns[vm][c] = struct{}{}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.conns[vm], c)
+		if len(t.conns[vm]) == 0 {
+			delete(t.conns, vm)
+		}
+	}
+}
+
+// closeTargets closes the connections relayed to the targets ids of vm,
+// returning how many.
+func (t *routeTable) closeTargets(vm string, ids map[string]bool) int {
+	var closing []*routedConn
+	t.mu.Lock()
+	for c := range t.conns[vm] {
+		if ids[c.target] {
+			closing = append(closing, c)
+		}
+	}
+	t.mu.Unlock()
+	// The relays untrack their connections once closed.
+	for _, c := range closing {
+		c.close(websocket.CloseNormalClosure, "session parked")
+	}
+	return len(closing)
+}
+
+// closeAll closes the connections relayed to every VM, other than muxed
+// ones, with code and text, returning how many.
+func (t *routeTable) closeAll(code int, text string) int {
+	var closing []*routedConn
+	t.mu.Lock()
+	for _, conns := range t.conns {
+		for c := range conns {
+			if !c.muxed {
+				closing = append(closing, c)
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range closing {
+		c.close(code, text)
+	}
+	return len(closing)
+}
+
+// connections returns how many connections are relayed to vm.
+func (t *routeTable) connections(vm string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns[vm])
+}
+
+// prune drops the targets of the VMs that aren't running anymore and closes
+// their connections.
+func (t *routeTable) prune(running map[string]bool) {
+	var stale []*routedConn
+	t.mu.Lock()
+	for id, route := range t.targets {
+		if !running[route.vm] {
+			delete(t.targets, id)
+		}
+	}
+	for vm, conns := range t.conns {
+		if running[vm] {
+			continue
+		}
+		for c := range conns {
+			log.Infof("Closing DevTools connection of %s to target %s of stopped VM %s, open since %s",
+				c.remote, c.target, vm, c.start.Format(time.RFC3339))
+			stale = append(stale, c)
+		}
+	}
+	t.mu.Unlock()
+	// The relays untrack their connections once closed.
+	for _, c := range stale {
+		c.close(websocket.CloseGoingAway, "VM stopped")
+	}
+}
+
+// pruneRoutes drops the routes, connections and latency of the VMs that
+// stopped, revalidating the VM registry first unless it is watched. The
+// routes are kept when the VM list can't be fetched.
+func (s *cdpServer) pruneRoutes() {
+	vms, _ := s.vms.current()
+	if !s.vms.isWatching() || vms == nil {
+		if err := s.refreshVMs(); err != nil {
+			log.Debugf("Failed to fetch the VM list to prune routes: %v", err)
+			return
+		}
+		vms, _ = s.vms.current()
+	}
+	running := make(map[string]bool)
+	for name := range vms.byName {
+		running[name] = true
+	}
+	s.routes.prune(running)
+	s.latency.prune(running)
+}
+
+// pruneRoutesPeriodically prunes the routes every routePruneInterval until
+// ctx is done.
+func (s *cdpServer) pruneRoutesPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(routePruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.pruneRoutes()
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestRoutesTargetsToTheirVM(t *testing.T) {
+	chrome1 := testharness.NewFakeChromeWithTarget("one")
+	defer chrome1.Close()
+	chrome2 := testharness.NewFakeChromeWithTarget("two")
+	defer chrome2.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome1), testharness.RunningVM("vm2", chrome2))
+	defer api.Close()
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	for _, path := range []string{"/vm/vm2/json/list", "/vm/vm2/json/version"} {
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	// The targets' webSocketDebuggerUrl doesn't name the VM.
+	var conns []*websocket.Conn
+	for _, path := range []string{"/devtools/page/two-page", "/devtools/browser/two-browser"} {
+		conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+path, nil)
+		if err != nil {
+			t.Fatalf("dial %s: %v", path, err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	if chrome2.Connections() != 2 || chrome1.Connections() != 0 {
+		t.Errorf("connections = vm1: %d, vm2: %d, want both on vm2", chrome1.Connections(), chrome2.Connections())
+	}
+	if got := s.routes.connections("vm2"); got != 2 {
+		t.Errorf("tracked connections of vm2 = %d, want 2", got)
+	}
+
+	// Once vm2 stops its connections are closed and its targets forgotten.
+	api.SetVMs(testharness.RunningVM("vm1", chrome1))
+	s.pruneRoutes()
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); err == nil {
+			t.Errorf("connection to stopped VM still open")
+		}
+	}
+	if route, ok := s.routes.lookup("/devtools/page/two-page"); ok {
+		t.Errorf("target of stopped VM still routed to %s", route.vm)
+	}
+}
+
+func TestRouteTableLearn(t *testing.T) {
+	routes := newRouteTable()
+	routes.learn("vm1", "", "/json/version", []byte(`{"webSocketDebuggerUrl": "ws://127.0.0.1:9223/devtools/browser/b1"}`))
+	routes.learn("vm1", "", "/json/list", []byte(`[{"id": "p1"}, {"id": "p2"}]`))
+	untrack := routes.track("vm1", &routedConn{target: "p2", close: func(int, string) {}})
+	defer untrack()
+	// A later list no longer showing a page drops it, unless connected.
+	routes.learn("vm1", "", "/json/list", []byte(`[{"id": "p3"}]`))
+
+	for path, want := range map[string]bool{
+		"/devtools/browser/b1": true,
+		"/devtools/page/p1":    false,
+		"/devtools/page/p2":    true,
+		"/devtools/page/p3":    true,
+		"/devtools/page/":      false,
+		"/json/list":           false,
+	} {
+		if route, ok := routes.lookup(path); ok != want || (ok && route.vm != "vm1") {
+			t.Errorf("lookup(%s) = %q, %t, want %t", path, route.vm, ok, want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// screenshotTimeout bounds capturing a screenshot, full pages included.
+const screenshotTimeout = 30 * time.Second
+
+// screenshotOptions are the query parameters of /vm/{vmName}/screenshot.
+type screenshotOptions struct {
+	// target is the ID of the page to capture, the first page if empty.
+	target string
+	// format is "png" or "jpeg".
+	format string
+	// quality is the JPEG quality, from 0 to 100, Chrome's default if nil.
+	quality *int
+	// fullPage captures the whole page rather than its viewport.
+	fullPage bool
+}
+
+// parseScreenshotOptions reads and checks the options of a screenshot
+// request.
+func parseScreenshotOptions(query url.Values) (screenshotOptions, error) {
+	opts := screenshotOptions{target: query.Get("target"), format: "png"}
+	switch format := query.Get("format"); format {
+	case "", "png":
+	case "jpeg", "jpg":
+		opts.format = "jpeg"
+	default:
+		return opts, fmt.Errorf("unsupported format %q, want png or jpeg", format)
+	}
+	if v := query.Get("quality"); v != "" {
+		quality, err := strconv.Atoi(v)
+		if err != nil || quality < 0 || quality > 100 {
+			return opts, fmt.Errorf("invalid quality %q, want 0 to 100", v)
+		}
+		if opts.format != "jpeg" {
+			return opts, errors.New("quality only applies to jpeg screenshots")
+		}
+		opts.quality = &quality
+	}
+	if v := query.Get("fullPage"); v != "" {
+		fullPage, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid fullPage %q", v)
+		}
+		opts.fullPage = fullPage
+	}
+	return opts, nil
+}
+
+// screenshotHandler answers with a screenshot of a page of a VM's browser,
+// taken over a DevTools session of its own, for clients that only need a
+// picture, e.g. monitoring dashboards.
+func (s *cdpServer) screenshotHandler(w http.ResponseWriter, r *http.Request) {
+	vmName, err := grantFromContext(r.Context()).authorize(mux.Vars(r)["vmName"])
+	if err != nil {
+		http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
+		return
+	}
+	opts, err := parseScreenshotOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, "400 Bad Request - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	browserID := r.URL.Query().Get("browser")
+	hostPort, vm, err := s.discoverCDPPort(vmName, browserID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("503 Service Unavailable - %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	if !s.sessions.Enter() {
+		http.Error(w, "503 Service Unavailable - draining", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.sessions.Leave()
+	release, err := s.limits.acquire(r.Context(), vm.VMName)
+	if err != nil {
+		tooManySessions(w, vm, err)
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), screenshotTimeout)
+	defer cancel()
+	start := time.Now()
+	image, err := s.captureScreenshot(ctx, hostPort, vm, opts)
+	var denied *deniedCommandError
+	switch {
+	case errors.As(err, &denied):
+		http.Error(w, "403 Forbidden - "+err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, errTargetNotFound):
+		http.Error(w, "404 Not Found - "+err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Errorf("Failed to capture screenshot of VM %s: %v", vm.VMName, err)
+		s.chromeUnavailable(w, r, vm, browserID, err)
+		return
+	}
+	s.reportSession(vm, time.Since(start))
+
+	w.Header().Set("Content-Type", "image/"+opts.format)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(image)
+}
+
+// errTargetNotFound is returned when the page to capture isn't open.
+var errTargetNotFound = errors.New("page not found")
+
+// deniedCommandError is returned when the VM's policy denies a command a
+// screenshot needs.
+type deniedCommandError struct {
+	method string
+}
+
+func (e *deniedCommandError) Error() string {
+	return fmt.Sprintf("%s is denied by the VM's policy", e.method)
+}
+
+// captureScreenshot returns a screenshot of a page of the browser at hostPort
+// of vm, encoded as opts.format.
+func (s *cdpServer) captureScreenshot(ctx context.Context, hostPort string, vm VM, opts screenshotOptions) ([]byte, error) {
+	target, err := s.screenshotTarget(ctx, hostPort, opts.target)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	dialer := s.dialer
+	s.mu.RUnlock()
+	conn, _, err := dialer.DialContext(ctx, fmt.Sprintf("ws://127.0.0.1:%s/devtools/page/%s", hostPort, url.PathEscape(target)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to page %s: %v", target, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+
+	policy := s.policyFor(vm.VMName)
+	nextID := 0
+	call := func(method string, params map[string]any, result any) error {
+		nextID++
+		data, err := json.Marshal(map[string]any{"id": nextID, "method": method, "params": params})
+		if err != nil {
+			return err
+		}
+		if _, allowed := policy.enforce(data, vm.VMName, "screenshot"); !allowed {
+			return &deniedCommandError{method: method}
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return err
+		}
+		for {
+			var reply struct {
+				ID     int             `json:"id"`
+				Result json.RawMessage `json:"result"`
+				Error  *struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			if err := conn.ReadJSON(&reply); err != nil {
+				return err
+			}
+			// Skip the events the page sends meanwhile.
+			if reply.ID != nextID {
+				continue
+			}
+			if reply.Error != nil {
+				return fmt.Errorf("%s failed: %s", method, reply.Error.Message)
+			}
+			return json.Unmarshal(reply.Result, result)
+		}
+	}
+
+	params := map[string]any{"format": opts.format}
+	if opts.quality != nil {
+		params["quality"] = *opts.quality
+	}
+	if opts.fullPage {
+		var metrics struct {
+			CSSContentSize struct {
+				Width  float64 `json:"width"`
+				Height float64 `json:"height"`
+			} `json:"cssContentSize"`
+		}
+		if err := call("Page.getLayoutMetrics", nil, &metrics); err != nil {
+			return nil, err
+		}
+		params["captureBeyondViewport"] = true
+		params["clip"] = map[string]any{
+			"x":      0,
+			"y":      0,
+			"width":  metrics.CSSContentSize.Width,
+			"height": metrics.CSSContentSize.Height,
+			"scale":  1,
+		}
+	}
+	var screenshot struct {
+		Data string `json:"data"`
+	}
+	if err := call("Page.captureScreenshot", params, &screenshot); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(screenshot.Data)
+}
+
+// screenshotTarget returns the ID of the page to capture: target if the
+// browser at hostPort lists it, its first page if target is empty.
+func (s *cdpServer) screenshotTarget(ctx context.Context, hostPort string, target string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://127.0.0.1:%s/json/list", hostPort), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("listing targets failed with status %d", resp.StatusCode)
+	}
+	var targets []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil {
+		return "", fmt.Errorf("failed to decode targets: %v", err)
+	}
+	for _, t := range targets {
+		if t.Type == "page" && (target == "" || t.ID == target) {
+			return t.ID, nil
+		}
+	}
+	if target == "" {
+		return "", fmt.Errorf("%w: no page is open", errTargetNotFound)
+	}
+	return "", fmt.Errorf("%w: %s", errTargetNotFound, target)
+}
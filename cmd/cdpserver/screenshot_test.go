@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func newScreenshotProxy(t *testing.T, cfg *config.CDPServerConfig) (*httptest.Server, *testharness.FakeChrome) {
+	t.Helper()
+	chrome := testharness.NewFakeChrome()
+	t.Cleanup(chrome.Close)
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	t.Cleanup(api.Close)
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(cfg)
+	proxy := httptest.NewServer(s.router())
+	t.Cleanup(proxy.Close)
+	return proxy, chrome
+}
+
+func TestScreenshot(t *testing.T) {
+	proxy, chrome := newScreenshotProxy(t, &config.CDPServerConfig{})
+
+	resp, err := http.Get(proxy.URL + "/vm/vm1/screenshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" || !bytes.Equal(body, testharness.FakeScreenshot) {
+		t.Fatalf("screenshot = %d %s %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	resp, err = http.Get(proxy.URL + "/vm/vm1/screenshot?target=fake-page&format=jpeg&quality=80&fullPage=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("full page screenshot = %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	screenshots := chrome.Screenshots()
+	if len(screenshots) != 2 {
+		t.Fatalf("captured %d screenshots, want 2", len(screenshots))
+	}
+	if got := screenshots[0]["format"]; got != "png" {
+		t.Errorf("format = %v, want png", got)
+	}
+	params := screenshots[1]
+	clip, _ := params["clip"].(map[string]any)
+	if params["format"] != "jpeg" || params["quality"] != 80.0 || params["captureBeyondViewport"] != true ||
+		clip["width"] != float64(testharness.FakePageSize.X) || clip["height"] != float64(testharness.FakePageSize.Y) {
+		t.Errorf("full page params = %v", params)
+	}
+}
+
+func TestScreenshotRejects(t *testing.T) {
+	proxy, chrome := newScreenshotProxy(t, &config.CDPServerConfig{Policies: []config.CDPPolicyConfig{{
+		VMs:   []string{"vm1"},
+		Rules: []config.CDPRuleConfig{{Action: "deny", Method: "Page.getLayoutMetrics"}},
+	}}})
+
+	for query, want := range map[string]int{
+		"?format=gif":              http.StatusBadRequest,
+		"?quality=101&format=jpeg": http.StatusBadRequest,
+		"?quality=50":              http.StatusBadRequest,
+		"?fullPage=maybe":          http.StatusBadRequest,
+		"?target=closed-page":      http.StatusNotFound,
+		"?fullPage=true":           http.StatusForbidden,
+	} {
+		resp, err := http.Get(proxy.URL + "/vm/vm1/screenshot" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("screenshot%s = %d, want %d", query, resp.StatusCode, want)
+		}
+	}
+	if n := len(chrome.Screenshots()); n != 0 {
+		t.Errorf("captured %d screenshots, want none", n)
+	}
+
+	resp, err := http.Get(proxy.URL + "/vm/vm2/screenshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("screenshot of a missing VM = %d, want 503", resp.StatusCode)
+	}
+}
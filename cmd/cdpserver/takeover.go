@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/relay"
+)
+
+// takeOver serves a POST /v1/cdp/sessions asking for a takeover of vm: its
+// DevTools clients, e.g. an agent, stay connected but their commands are
+// held or rejected until the session is resumed, while a human drives the
+// browser over noVNC.
+func (s *cdpServer) takeOver(w http.ResponseWriter, r *http.Request, req parkRequest, vm VM) {
+	sess, err := s.handoffs.park(handoffSession{
+		VM:        vm.VMName,
+		Label:     req.Label,
+		Metadata:  req.Metadata,
+		Targets:   []handoffTarget{},
+		Takeover:  req.Takeover,
+		ExpiresAt: time.Now().Add(s.handoffTTL()),
+	}, time.Now())
+	if err != nil {
+		http.Error(w, "409 Conflict - "+err.Error(), http.StatusConflict)
+		return
+	}
+	log.Infof("VM %s taken over as %q by %s, %s commands of its %d DevTools connections",
+		vm.VMName, sess.Label, r.RemoteAddr, takeoverVerb(sess.Takeover), s.routes.connections(vm.VMName))
+	writeSession(w, r, http.StatusCreated, sess)
+}
+
+func takeoverVerb(mode string) string {
+	if mode == takeoverReject {
+		return "rejecting"
+	}
+	return "holding"
+}
+
+// holdForTakeover is called with each message a client sends to vmName. While
+// the VM is taken over in buffer mode it blocks until the takeover ends, so
+// that the client's commands reach Chrome in order once it is resumed. In
+// reject mode commands are answered with an error instead. client is the
+// connection the message was read from; its read deadline is lifted while
+// holding, since the keepalive's pongs aren't read meanwhile, and set again
+// by the first pong read once released.
+func (s *cdpServer) holdForTakeover(vmName string, data []byte, client *websocket.Conn) ([]byte, bool) {
+	held := false
+	for {
+		sess, ok := s.handoffs.takenOver(vmName, time.Now())
+		if !ok {
+			if held {
+				log.Debugf("Releasing command held for the takeover of VM %s", vmName)
+			}
+			return nil, true
+		}
+		if sess.Takeover == takeoverReject {
+			var cmd cdpCommand
+			if err := json.Unmarshal(data, &cmd); err != nil || cmd.Method == "" {
+				return nil, true
+			}
+			return errorReply(cmd, fmt.Sprintf("%s was rejected: VM %s is taken over by a human", cmd.Method, vmName)), false
+		}
+		if !held {
+			client.SetReadDeadline(time.Time{})
+			held = true
+		}
+		timer := time.NewTimer(time.Until(sess.ExpiresAt))
+		select {
+		case <-sess.released:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// sessionFilter returns the filter of a DevTools session of client with
+// vmName: commands are held or rejected during takeovers, then checked
+// against the VM's policy.
+func (s *cdpServer) sessionFilter(vmName string, remote string, client *websocket.Conn) relay.Filter {
+	policy := s.policyFor(vmName)
+	return func(messageType int, data []byte) ([]byte, bool) {
+		if reply, ok := s.holdForTakeover(vmName, data, client); !ok {
+			return reply, false
+		}
+		return policy.enforce(data, vmName, remote)
+	}
+}
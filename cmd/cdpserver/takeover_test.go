@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func TestTakeoverHoldsCommands(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	proxy, _ := newTestProxy(t, testharness.RunningVM("vm1", chrome))
+
+	agent, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	resp, sess := postSession(t, proxy.URL+"/v1/cdp/sessions", `{"vm":"vm1","takeover":"buffer","label":"login"}`)
+	if resp.StatusCode != http.StatusCreated || sess.State != handoffPaused || sess.Takeover != takeoverBuffer {
+		t.Fatalf("takeover = %d %+v", resp.StatusCode, sess)
+	}
+	if resp, _ := postSession(t, proxy.URL+"/v1/cdp/sessions", `{"vm":"vm1","takeover":"reject"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("second takeover = %d, want 409", resp.StatusCode)
+	}
+
+	// Fake Chrome echoes commands, which are held until the session is
+	// resumed.
+	cmd := `{"id":1,"method":"Page.reload"}`
+	agent.WriteMessage(websocket.TextMessage, []byte(cmd))
+	echoed := make(chan string, 1)
+	go func() {
+		agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, _ := agent.ReadMessage()
+		echoed <- string(data)
+	}()
+	select {
+	case data := <-echoed:
+		t.Fatalf("command relayed during the takeover: %s", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+	resp, resumed := postSession(t, proxy.URL+"/v1/cdp/sessions/"+sess.Handle+"/resume", "")
+	if resp.StatusCode != http.StatusOK || resumed.State != handoffResumed {
+		t.Fatalf("resume = %d %+v", resp.StatusCode, resumed)
+	}
+	if data := <-echoed; data != cmd {
+		t.Errorf("after resuming read %q, want the held command echoed", data)
+	}
+}
+
+func TestTakeoverRejectsCommands(t *testing.T) {
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	proxy, _ := newTestProxy(t, testharness.RunningVM("vm1", chrome))
+
+	agent, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	_, sess := postSession(t, proxy.URL+"/v1/cdp/sessions", `{"vm":"vm1","takeover":"reject"}`)
+
+	agent.WriteMessage(websocket.TextMessage, []byte(`{"id":7,"method":"Page.reload"}`))
+	agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := agent.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply struct {
+		ID    int `json:"id"`
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil || reply.ID != 7 || reply.Error.Code != cdpErrorServerError || !strings.Contains(reply.Error.Message, "taken over") {
+		t.Errorf("reply = %s, want an error for command 7", data)
+	}
+
+	if resp, _ := postSession(t, proxy.URL+"/v1/cdp/sessions", `{"vm":"vm1","takeover":"pause"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("takeover with an unknown mode = %d, want 400", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, proxy.URL+"/v1/cdp/sessions/"+sess.Handle, nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("discard = %v, %v", resp, err)
+	}
+	agent.WriteMessage(websocket.TextMessage, []byte(`{"id":8,"method":"Page.reload"}`))
+	if _, data, err := agent.ReadMessage(); err != nil || !strings.Contains(string(data), `"id":8,"method"`) {
+		t.Errorf("after discarding read %s, %v, want the command echoed", data, err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/tracing"
+)
+
+// defaultTracingService is the service.name of the spans of the proxy.
+const defaultTracingService = "arrakis-cdpserver"
+
+// Names of the spans of a proxied request.
+const (
+	// spanProxy covers serving the request, from the client's point of view.
+	spanProxy = "cdp.proxy"
+	// spanDiscovery covers looking up the VM and browser to route to.
+	spanDiscovery = "cdp.discovery"
+	// spanDial covers connecting to the browser, relaunching it if it can't
+	// be reached, for WebSocket sessions.
+	spanDial = "cdp.dial"
+	// spanSession covers relaying a WebSocket session.
+	spanSession = "cdp.session"
+	// spanUpstream covers an HTTP request to the browser, until its
+	// response headers.
+	spanUpstream = "cdp.upstream"
+)
+
+// tracingOptions returns the options of the tracer of cfg.
+func tracingOptions(cfg config.TracingConfig) tracing.Options {
+	opts := tracing.Options{
+		Endpoint:    cfg.Endpoint,
+		Headers:     cfg.Headers,
+		ServiceName: cfg.ServiceName,
+		SampleRatio: cfg.SampleRatio,
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = defaultTracingService
+	}
+	if opts.SampleRatio == 0 {
+		opts.SampleRatio = 1
+	}
+	return opts
+}
+
+// validateTracing checks the tracing config, if enabled.
+func validateTracing(cfg config.TracingConfig) error {
+	if !cfg.Enabled() {
+		return nil
+	}
+	return tracingOptions(cfg).Validate()
+}
+
+// setTracer starts exporting spans as cfg configures, unless it already
+// does, and closes the tracer it replaces in the background, after exporting
+// its spans. The caller must hold mu.
+func (s *cdpServer) setTracer(cfg config.TracingConfig) {
+	if s.cfg != nil && reflect.DeepEqual(s.cfg.Tracing, cfg) {
+		return
+	}
+	var tracer *tracing.Tracer
+	if cfg.Enabled() {
+		// The config was validated.
+		var err error
+		if tracer, err = tracing.New(tracingOptions(cfg)); err != nil {
+			log.WithError(err).Error("Invalid tracing config")
+		}
+	}
+	old := s.tracer
+	s.tracer = tracer
+	go old.Close()
+}
+
+// currentTracer returns the tracer of the config in effect, nil if tracing
+// is disabled.
+func (s *cdpServer) currentTracer() *tracing.Tracer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tracer
+}
+
+// closeTracer exports the spans ended and stops tracing, on shutdown.
+func (s *cdpServer) closeTracer() {
+	s.mu.Lock()
+	tracer := s.tracer
+	s.tracer = nil
+	s.mu.Unlock()
+	tracer.Close()
+}
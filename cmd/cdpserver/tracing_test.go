@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+	"github.com/abshkbh/arrakis/pkg/tracing"
+)
+
+// exportedSpan is what the tests read of the spans exported.
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	} `json:"attributes"`
+	Status *struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+// attribute returns the string value of the attribute key.
+func (s exportedSpan) attribute(key string) string {
+	for _, attr := range s.Attributes {
+		if attr.Key == key {
+			v, _ := attr.Value["stringValue"].(string)
+			return v
+		}
+	}
+	return ""
+}
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var spans []exportedSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []exportedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	chrome := testharness.NewFakeChrome()
+	defer chrome.Close()
+	api := testharness.NewFakeRESTAPI(testharness.RunningVM("vm1", chrome))
+	defer api.Close()
+	if err := validateTracing(config.TracingConfig{Endpoint: "collector:4318"}); err == nil {
+		t.Error("tracing to an endpoint without a scheme validated")
+	}
+	s := newCDPServer("0", api.URL, config.CompressionConfig{})
+	s.applyConfig(&config.CDPServerConfig{Tracing: config.TracingConfig{Endpoint: collector.URL}})
+	proxy := httptest.NewServer(s.router())
+
+	const clientTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("GET", proxy.URL+"/vm/vm1/json/version", nil)
+	req.Header.Set(tracing.TraceparentHeader, "00-"+clientTrace+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	_, header := chrome.LastRequest()
+	if sc, ok := tracing.ParseTraceparent(header.Get(tracing.TraceparentHeader)); !ok || sc.Traceparent()[3:35] != clientTrace {
+		t.Errorf("Chrome got traceparent %q, want the client's trace", header.Get(tracing.TraceparentHeader))
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/devtools/page/fake-page", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	s.sessions.Wait()
+	// A request routed nowhere.
+	resp, err = http.Get(proxy.URL + "/vm/vm2/json/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	proxy.Close()
+	s.closeTracer()
+
+	mu.Lock()
+	defer mu.Unlock()
+	byName := map[string][]exportedSpan{}
+	proxied := map[string]exportedSpan{}
+	for _, span := range spans {
+		byName[span.Name] = append(byName[span.Name], span)
+		if span.Name == spanProxy {
+			proxied[span.attribute("url.path")] = span
+		}
+	}
+	if len(byName[spanProxy]) != 3 || len(byName[spanDiscovery]) != 3 || len(byName[spanUpstream]) != 1 ||
+		len(byName[spanDial]) != 1 || len(byName[spanSession]) != 1 {
+		t.Fatalf("exported %+v", spans)
+	}
+	// The HTTP request continues the client's trace.
+	root := proxied["/vm/vm1/json/version"]
+	if root.TraceID != clientTrace || root.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("proxy span = %+v, want a child of the client's", root)
+	}
+	if upstream := byName[spanUpstream][0]; upstream.ParentSpanID != root.SpanID || upstream.TraceID != clientTrace {
+		t.Errorf("upstream span = %+v, want a child of %s", upstream, root.SpanID)
+	}
+	// The WebSocket session's spans are children of its proxy span.
+	ws := proxied["/vm/vm1/devtools/page/fake-page"]
+	for _, name := range []string{spanDiscovery, spanDial, spanSession} {
+		var found bool
+		for _, span := range byName[name] {
+			found = found || span.ParentSpanID == ws.SpanID
+		}
+		if !found {
+			t.Errorf("no %s span under the WebSocket session's %+v", name, ws)
+		}
+	}
+	if unrouted := proxied["/vm/vm2/json/version"]; unrouted.Status == nil || unrouted.Status.Code != 2 {
+		t.Errorf("span of the unrouted request = %+v, want failed", unrouted)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// copyOperand is a file of a cp command: a local path, or a path in the VM
+// vmName when it was given as "<vm>:<path>".
+type copyOperand struct {
+	vmName string
+	file   string
+}
+
+// parseCopyOperand splits "<vm>:<path>" operands from local paths. Local
+// paths with a colon, e.g. Windows drive letters and "./a:b", stay local.
+func parseCopyOperand(arg string) copyOperand {
+	if filepath.VolumeName(arg) != "" {
+		return copyOperand{file: arg}
+	}
+	vmName, p, ok := strings.Cut(arg, ":")
+	if !ok || vmName == "" || strings.ContainsAny(vmName, `/\`) {
+		return copyOperand{file: arg}
+	}
+	return copyOperand{vmName: vmName, file: p}
+}
+
+// copyFiles copies a file between the local host and a VM, in either
+// direction. Paths in the VM are always slash-separated, local ones use the
+// separator of the local OS. A destination that is a directory, or ends with
+// a separator, receives the file under its own name.
+func copyFiles(src string, dst string) error {
+	from, to := parseCopyOperand(src), parseCopyOperand(dst)
+	switch {
+	case from.vmName == "" && to.vmName != "":
+		guestPath := to.file
+		if guestPath == "" || strings.HasSuffix(guestPath, "/") {
+			guestPath = path.Join(guestPath, filepath.Base(from.file))
+		}
+		return uploadFiles(to.vmName, []string{from.file, guestPath})
+	case from.vmName != "" && to.vmName == "":
+		return downloadFile(from.vmName, from.file, to.file)
+	}
+	return fmt.Errorf("exactly one of the source and destination must be a VM path, as <vm>:<path>")
+}
+
+// downloadFile writes the file guestPath of vmName to localPath.
+func downloadFile(vmName string, guestPath string, localPath string) error {
+	if localPath == "" {
+		localPath = "."
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameFilesGet(context.Background(), vmName).Paths(guestPath).Execute()
+	if err != nil {
+		return parseErrorResponse("download files", httpResp, err)
+	}
+	files := resp.GetFiles()
+	if len(files) != 1 {
+		return fmt.Errorf("expected one file for %s, got %d", guestPath, len(files))
+	}
+
+	if info, err := os.Stat(localPath); (err == nil && info.IsDir()) || os.IsPathSeparator(localPath[len(localPath)-1]) {
+		localPath = filepath.Join(localPath, path.Base(guestPath))
+	}
+	if err := os.WriteFile(localPath, []byte(files[0].GetContent()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", localPath, err)
+	}
+	log.Infof("copied %s:%s to %s", vmName, guestPath, localPath)
+	return nil
+}
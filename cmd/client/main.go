@@ -1,24 +1,41 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
 
 	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
 	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/embedtoken"
+	"github.com/abshkbh/arrakis/pkg/server/audit"
 )
 
 var (
 	apiClient *serverapi.APIClient
+	// serverAddr is the host:port of the REST server, used to open WebSockets
+	// and stream archives, which the generated client does not support.
+	serverAddr string
 )
 
 // parseErrorResponse attempts to parse the HTTP response body as an ErrorResponse.
@@ -45,24 +62,64 @@ func parseErrorResponse(operation string, httpResp *http.Response, err error) er
 	return fmt.Errorf("failed to %s: %s (HTTP %d)", operation, string(body), httpResp.StatusCode)
 }
 
-func stopVM(vmName string) error {
+func updateVM(vmName string, newName string, owner string) error {
+	if newName == "" && owner == "" {
+		return fmt.Errorf("one of --rename or --owner is required")
+	}
+	req := apiClient.DefaultAPI.V1VmsNamePatch(context.Background(), vmName)
+
+	patch := serverapi.V1VmsNamePatchRequest{}
+	if newName != "" {
+		patch.Name = serverapi.PtrString(newName)
+	}
+	if owner != "" {
+		patch.Owner = serverapi.PtrString(owner)
+	}
+	req = req.V1VmsNamePatchRequest(patch)
+
+	resp, httpResp, err := req.Execute()
+	if err != nil {
+		return parseErrorResponse("update VM", httpResp, err)
+	}
+
+	vmBytes, err := json.MarshalIndent(resp.GetVm(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal VM: %w", err)
+	}
+	fmt.Println(string(vmBytes))
+	return nil
+}
+
+func stopVM(vmName string, graceful bool) error {
 	req := apiClient.DefaultAPI.V1VmsNamePatch(context.Background(), vmName)
 
 	req = req.V1VmsNamePatchRequest(serverapi.V1VmsNamePatchRequest{
-		Status: serverapi.PtrString("stopped"),
+		Status:   serverapi.PtrString("stopped"),
+		Graceful: serverapi.PtrBool(graceful),
 	})
 
-	_, httpResp, err := req.Execute()
+	resp, httpResp, err := req.Execute()
 	if err != nil {
 		return parseErrorResponse("stop VM", httpResp, err)
 	}
 
 	log.Infof("successfully stopped VM: %s", vmName)
+	if summary, ok := resp.GetStopSummaryOk(); ok {
+		summaryBytes, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal stop summary: %w", err)
+		}
+		fmt.Println(string(summaryBytes))
+	}
 	return nil
 }
 
-func destroyVM(vmName string) error {
-	_, httpResp, err := apiClient.DefaultAPI.V1VmsNameDelete(context.Background(), vmName).Execute()
+func destroyVM(vmName string, purge bool) error {
+	req := apiClient.DefaultAPI.V1VmsNameDelete(context.Background(), vmName)
+	if purge {
+		req = req.Purge(true)
+	}
+	_, httpResp, err := req.Execute()
 	if err != nil {
 		return parseErrorResponse("destroy VM", httpResp, err)
 	}
@@ -71,6 +128,239 @@ func destroyVM(vmName string) error {
 	return nil
 }
 
+func undeleteVM(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameUndeletePost(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("undelete VM", httpResp, err)
+	}
+
+	resp_bytes, err := resp.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	log.Infof("undeleted VM: %v", string(resp_bytes))
+	return nil
+}
+
+func adoptVM(vmName string, apiSocket string, pid int, ip string, owner string) error {
+	req := serverapi.AdoptVMRequest{VmName: serverapi.PtrString(vmName)}
+	if apiSocket != "" {
+		req.ApiSocket = serverapi.PtrString(apiSocket)
+	}
+	if pid > 0 {
+		req.Pid = serverapi.PtrInt32(int32(pid))
+	}
+	if ip != "" {
+		req.Ip = serverapi.PtrString(ip)
+	}
+	if owner != "" {
+		req.Owner = serverapi.PtrString(owner)
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsAdoptPost(context.Background()).AdoptVMRequest(req).Execute()
+	if err != nil {
+		return parseErrorResponse("adopt VM", httpResp, err)
+	}
+
+	for _, warning := range resp.GetWarnings() {
+		log.Warn(warning)
+	}
+	resp_bytes, err := resp.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	log.Infof("adopted VM: %v", string(resp_bytes))
+	return nil
+}
+
+// exportVM downloads the archive of a VM to output.
+func exportVM(vmName string, output string, memory bool) error {
+	exportURL := url.URL{
+		Scheme: "http",
+		Host:   serverAddr,
+		Path:   fmt.Sprintf("/v1/vms/%s/export", url.PathEscape(vmName)),
+	}
+	if memory {
+		exportURL.RawQuery = url.Values{"memory": {"true"}}.Encode()
+	}
+	httpResp, err := http.Get(exportURL.String())
+	if err != nil {
+		return fmt.Errorf("failed to export VM: %v", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return parseErrorResponse("export VM", httpResp, nil)
+	}
+	defer httpResp.Body.Close()
+
+	if output == "" {
+		output = vmName + ".tar.gz"
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", output, err)
+	}
+	n, err := io.Copy(f, httpResp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		return fmt.Errorf("failed to download archive: %v", err)
+	}
+	log.Infof("exported VM %s to %s (%d bytes)", vmName, output, n)
+	return nil
+}
+
+// importVM uploads the archive at input to recreate the VM it holds.
+func importVM(input string, vmName string, owner string) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", input, err)
+	}
+	defer f.Close()
+
+	query := url.Values{}
+	if vmName != "" {
+		query.Set("name", vmName)
+	}
+	if owner != "" {
+		query.Set("owner", owner)
+	}
+	importURL := url.URL{
+		Scheme:   "http",
+		Host:     serverAddr,
+		Path:     "/v1/vms/import",
+		RawQuery: query.Encode(),
+	}
+	httpResp, err := http.Post(importURL.String(), "application/gzip", f)
+	if err != nil {
+		return fmt.Errorf("failed to import VM: %v", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return parseErrorResponse("import VM", httpResp, nil)
+	}
+	defer httpResp.Body.Close()
+
+	var resp serverapi.ImportVMResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	resp_bytes, err := resp.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	log.Infof("imported VM: %v", string(resp_bytes))
+	return nil
+}
+
+// auditURL returns the URL of an audit endpoint for tenant.
+func auditURL(path string, tenant string, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	if tenant != "" {
+		query.Set("tenant", tenant)
+	}
+	u := url.URL{Scheme: "http", Host: serverAddr, Path: path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// downloadAudit saves the audit batches of tenant after seq after to dir,
+// one file per batch as the server sealed it.
+func downloadAudit(tenant string, dir string, after uint64) error {
+	httpResp, err := http.Get(auditURL("/v1/audit/batches", tenant, url.Values{"after": {strconv.FormatUint(after, 10)}}))
+	if err != nil {
+		return fmt.Errorf("failed to list audit batches: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return parseErrorResponse("list audit batches", httpResp, nil)
+	}
+	var listing audit.Listing
+	if err := json.NewDecoder(httpResp.Body).Decode(&listing); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, batch := range listing.Batches {
+		httpResp, err := http.Get(auditURL(fmt.Sprintf("/v1/audit/batches/%d", batch.Seq), tenant, nil))
+		if err != nil {
+			return fmt.Errorf("failed to download audit batch %d: %v", batch.Seq, err)
+		}
+		if httpResp.StatusCode != http.StatusOK {
+			return parseErrorResponse(fmt.Sprintf("download audit batch %d", batch.Seq), httpResp, nil)
+		}
+		data, err := io.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to download audit batch %d: %v", batch.Seq, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%08d.json", batch.Seq)), data, 0644); err != nil {
+			return err
+		}
+	}
+	log.Infof("downloaded %d audit batches of tenant %q to %s", len(listing.Batches), listing.Tenant, dir)
+	return nil
+}
+
+// verifyAudit checks the audit batches downloaded to dir with the public
+// key in keyFile or, without one, the key the server reports.
+func verifyAudit(dir string, keyFile string) error {
+	var key ed25519.PublicKey
+	var err error
+	if keyFile != "" {
+		if key, err = embedtoken.ReadPublicKey(keyFile); err != nil {
+			return err
+		}
+	} else {
+		httpResp, err := http.Get(auditURL("/v1/audit/key", "", nil))
+		if err != nil {
+			return fmt.Errorf("failed to get audit key: %v", err)
+		}
+		defer httpResp.Body.Close()
+		if httpResp.StatusCode != http.StatusOK {
+			return parseErrorResponse("get audit key", httpResp, nil)
+		}
+		var info audit.KeyInfo
+		if err := json.NewDecoder(httpResp.Body).Decode(&info); err != nil {
+			return fmt.Errorf("failed to decode response: %v", err)
+		}
+		if key, err = base64.StdEncoding.DecodeString(info.PublicKey); err != nil {
+			return fmt.Errorf("invalid audit key: %v", err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	// The names sort in the order of the batches.
+	sort.Strings(files)
+	var batches [][]byte
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		batches = append(batches, data)
+	}
+	payloads, err := audit.Verify(batches, key)
+	if err != nil {
+		return err
+	}
+	if len(payloads) == 0 {
+		return fmt.Errorf("no audit batches in %s", dir)
+	}
+	records := 0
+	for _, p := range payloads {
+		records += len(p.Records)
+	}
+	first, last := payloads[0], payloads[len(payloads)-1]
+	log.Infof("verified audit batches %d to %d of tenant %q: %d records signed by key %s", first.Seq, last.Seq, first.Tenant, records, audit.KeyID(key))
+	return nil
+}
+
 func destroyAllVMs() error {
 	_, httpResp, err := apiClient.DefaultAPI.V1VmsDelete(context.Background()).Execute()
 	if err != nil {
@@ -81,7 +371,7 @@ func destroyAllVMs() error {
 	return nil
 }
 
-func startVM(vmName string, kernel string, rootfs string, entryPoint string, snapshotId string) error {
+func startVM(vmName string, kernel string, rootfs string, arch string, hypervisor string, entryPoint string, snapshotId string, waitTimeout time.Duration, queue bool, callbackURL string, owner string, priority int, objectMounts []string, kernelArgs string, isolated bool, egressFor time.Duration) error {
 	var startVMRequest *serverapi.StartVMRequest
 	if snapshotId != "" {
 		// If snapshot ID is provided, restore the VM from the snapshot
@@ -98,11 +388,56 @@ func startVM(vmName string, kernel string, rootfs string, entryPoint string, sna
 		}
 	}
 
-	resp, httpResp, err := apiClient.DefaultAPI.V1VmsPost(context.Background()).StartVMRequest(*startVMRequest).Execute()
+	if arch != "" {
+		startVMRequest.Arch = serverapi.PtrString(arch)
+	}
+	if hypervisor != "" {
+		startVMRequest.Hypervisor = serverapi.PtrString(hypervisor)
+	}
+	if callbackURL != "" {
+		startVMRequest.CallbackUrl = serverapi.PtrString(callbackURL)
+	}
+	if owner != "" {
+		startVMRequest.Owner = serverapi.PtrString(owner)
+	}
+	if priority != 0 {
+		startVMRequest.Priority = serverapi.PtrInt32(int32(priority))
+	}
+	if len(objectMounts) > 0 {
+		startVMRequest.ObjectMounts = objectMounts
+	}
+	if kernelArgs != "" {
+		startVMRequest.KernelArgs = strings.Fields(kernelArgs)
+	}
+	if isolated || egressFor > 0 {
+		egress := &serverapi.EgressPolicy{Restricted: serverapi.PtrBool(true)}
+		if egressFor > 0 {
+			now := time.Now()
+			egress.Windows = []serverapi.EgressWindow{{
+				Start: serverapi.PtrTime(now),
+				End:   serverapi.PtrTime(now.Add(egressFor)),
+			}}
+		}
+		startVMRequest.Egress = egress
+	}
+
+	req := apiClient.DefaultAPI.V1VmsPost(context.Background()).StartVMRequest(*startVMRequest)
+	if waitTimeout > 0 {
+		req = req.Wait("ready").Timeout(waitTimeout.String())
+	}
+	if queue {
+		req = req.Queue(true)
+	}
+	resp, httpResp, err := req.Execute()
 	if err != nil {
 		return parseErrorResponse("start VM", httpResp, err)
 	}
 
+	if queue {
+		log.Infof("queued VM: %s status: %s position: %d", vmName, resp.GetStatus(), resp.GetQueuePosition())
+		return nil
+	}
+
 	resp_bytes, err := resp.MarshalJSON()
 	if err != nil {
 		return fmt.Errorf("failed to marshal response: %w", err)
@@ -123,6 +458,7 @@ func listAllVMs() error {
 
 	for _, vm := range resp.GetVms() {
 		fmt.Printf("VM Name: %s\n", vm.GetVmName())
+		fmt.Printf("VM ID: %s\n", vm.GetVmId())
 		fmt.Printf("Status: %s\n", vm.GetStatus())
 		fmt.Printf("IP Address: %s\n", vm.GetIp())
 		fmt.Printf("Tap Device: %s\n", vm.GetTapDeviceName())
@@ -184,11 +520,113 @@ func snapshotVM(vmName string, snapshotId string) error {
 		return parseErrorResponse("create snapshot", httpResp, err)
 	}
 	log.Infof("successfully created snapshot for VM %s with ID %s", vmName, resp.GetSnapshotId())
+	if resp.HasScan() {
+		scan := resp.GetScan()
+		log.Infof("snapshot scan: %s %s", scan.GetVerdict(), strings.Join(scan.GetFindings(), ", "))
+	}
+	return nil
+}
+
+func seedBrowserProfile(vmName string, archivePath string) error {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open profile: %w", err)
+	}
+	defer archive.Close()
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameBrowserProfilePost(context.Background(), vmName).Body(archive).Execute()
+	if err != nil {
+		return parseErrorResponse("seed browser profile", httpResp, err)
+	}
+	log.Infof("seeded the browser profile of VM %s with %d files (%d bytes), Chrome restarted", vmName, resp.GetFiles(), resp.GetBytes())
+	return nil
+}
+
+func resetVM(vmName string, scratchPaths []string, keepBrowserProfile bool) error {
+	req := serverapi.VmResetRequest{ScratchPaths: scratchPaths}
+	if keepBrowserProfile {
+		req.KeepBrowserProfile = serverapi.PtrBool(true)
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameResetPost(context.Background(), vmName).VmResetRequest(req).Execute()
+	if err != nil {
+		return parseErrorResponse("reset VM", httpResp, err)
+	}
+	log.Infof("reset VM %s: killed %d processes, cleared %s", vmName, resp.GetKilledProcesses(), strings.Join(resp.GetClearedPaths(), ", "))
+	if !resp.GetClean() {
+		return fmt.Errorf("VM %s isn't clean: %s", vmName, strings.Join(resp.GetErrors(), "; "))
+	}
+	return nil
+}
+
+func vmOCR(vmName string, source string, display int, language string, minConfidence float64, showWords bool) error {
+	req := serverapi.VmOcrRequest{Source: serverapi.PtrString(source)}
+	if display >= 0 {
+		req.Display = serverapi.PtrInt32(int32(display))
+	}
+	if language != "" {
+		req.Language = serverapi.PtrString(language)
+	}
+	if minConfidence > 0 {
+		req.MinConfidence = serverapi.PtrFloat64(minConfidence)
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameOcrPost(context.Background(), vmName).VmOcrRequest(req).Execute()
+	if err != nil {
+		return parseErrorResponse("extract text", httpResp, err)
+	}
+
+	if !showWords {
+		fmt.Println(resp.GetText())
+		return nil
+	}
+	for _, w := range resp.GetWords() {
+		fmt.Printf("%4d,%-4d %4dx%-4d %5.1f  %s\n", w.GetX(), w.GetY(), w.GetWidth(), w.GetHeight(), w.GetConfidence(), w.GetText())
+	}
+	return nil
+}
+
+func searchVMDisk(vmName string, glob string, limit int) error {
+	req := apiClient.DefaultAPI.V1VmsNameDiskSearchGet(context.Background(), vmName).Glob(glob)
+	if limit > 0 {
+		req = req.Limit(int32(limit))
+	}
+	resp, httpResp, err := req.Execute()
+	if err != nil {
+		return parseErrorResponse("search disk", httpResp, err)
+	}
+
+	for _, m := range resp.GetMatches() {
+		if m.GetDir() {
+			fmt.Printf("%12s  %s/\n", "-", m.GetPath())
+			continue
+		}
+		fmt.Printf("%12d  %s\n", m.GetSize(), m.GetPath())
+	}
+	if resp.GetTruncated() {
+		fmt.Println("... more files matched, raise --limit to see them")
+	}
+	return nil
+}
+
+func snapshotDiff(snapshotId string, baseId string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1SnapshotsIdDiffGet(context.Background(), snapshotId).Base(baseId).Execute()
+	if err != nil {
+		return parseErrorResponse("diff snapshots", httpResp, err)
+	}
+
+	for _, w := range resp.GetWarnings() {
+		log.Warn(w)
+	}
+	for _, c := range resp.GetChanges() {
+		fmt.Printf("%-8s %-7s %s\n", c.GetKind(), c.GetType(), c.GetPath())
+	}
+	if resp.GetTruncated() {
+		fmt.Printf("... %d changes in total\n", resp.GetTotal())
+	}
 	return nil
 }
 
 func restoreVM(vmName string, snapshotId string) error {
-	return startVM(vmName, "", "", "", snapshotId)
+	return startVM(vmName, "", "", "", "", "", snapshotId, 0, false, "", "", 0, nil, "", false, 0)
 }
 
 func pauseVM(vmName string) error {
@@ -254,10 +692,11 @@ func uploadFiles(vmName string, fileSpecs []string) error {
 	return nil
 }
 
-func runCommand(vmName string, cmd string) error {
+func runCommand(vmName string, cmd string, limits *serverapi.VmExecLimits) error {
 	req := serverapi.VmCommandRequest{
 		Cmd:      cmd,
 		Blocking: serverapi.PtrBool(true),
+		Limits:   limits,
 	}
 
 	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameCmdPost(context.Background(), vmName).VmCommandRequest(req).Execute()
@@ -265,6 +704,9 @@ func runCommand(vmName string, cmd string) error {
 		return parseErrorResponse("run command", httpResp, err)
 	}
 
+	if resp.LimitExceeded != nil {
+		return fmt.Errorf("command exceeded its %s limit: %s\nOutput: %s", resp.LimitExceeded.GetLimit(), resp.LimitExceeded.GetMessage(), resp.GetOutput())
+	}
 	if resp.GetError() != "" {
 		return fmt.Errorf("command failed: %s\nOutput: %s", resp.GetError(), resp.GetOutput())
 	}
@@ -272,6 +714,123 @@ func runCommand(vmName string, cmd string) error {
 	return nil
 }
 
+// execLimits returns the limits set by the flags of the run command, or nil
+// if none are.
+func execLimits(ctx *cli.Context) *serverapi.VmExecLimits {
+	limits := &serverapi.VmExecLimits{}
+	set := false
+	for flag, field := range map[string]**int64{
+		"cpu-seconds":      &limits.CpuSeconds,
+		"memory-mb":        &limits.MemoryMb,
+		"max-processes":    &limits.MaxProcesses,
+		"max-output-bytes": &limits.MaxOutputBytes,
+	} {
+		if ctx.IsSet(flag) {
+			*field = serverapi.PtrInt64(ctx.Int64(flag))
+			set = true
+		}
+	}
+	if !set {
+		return nil
+	}
+	return limits
+}
+
+// shell opens an interactive terminal session in a VM running cmd, or a login
+// shell if cmd is empty, and attaches it to the local terminal. It returns the
+// remote command's exit code.
+func shell(vmName string, cmd string) (int, error) {
+	fd := int(os.Stdin.Fd())
+	query := url.Values{"tty": {"true"}}
+	if cmd != "" {
+		query.Set("cmd", cmd)
+	}
+	if cols, rows, err := term.GetSize(fd); err == nil {
+		query.Set("rows", strconv.Itoa(rows))
+		query.Set("cols", strconv.Itoa(cols))
+	}
+	ptyURL := url.URL{
+		Scheme:   "ws",
+		Host:     serverAddr,
+		Path:     fmt.Sprintf("/v1/vms/%s/cmd", url.PathEscape(vmName)),
+		RawQuery: query.Encode(),
+	}
+
+	conn, httpResp, err := websocket.DefaultDialer.Dial(ptyURL.String(), nil)
+	if err != nil {
+		return 0, parseErrorResponse("open shell", httpResp, err)
+	}
+	defer conn.Close()
+
+	if term.IsTerminal(fd) {
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			return 0, fmt.Errorf("failed to put terminal in raw mode: %v", err)
+		}
+		defer term.Restore(fd, oldState)
+	}
+
+	var writeLock sync.Mutex
+	writeMessage := func(messageType int, data []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		return conn.WriteMessage(messageType, data)
+	}
+
+	// Keep the remote terminal the size of the local one.
+	resized, stopWatching := watchResize(fd)
+	defer stopWatching()
+	go func() {
+		for range resized {
+			cols, rows, err := term.GetSize(fd)
+			if err != nil {
+				continue
+			}
+			resize, _ := json.Marshal(cmdserver.PTYControl{
+				Type: cmdserver.PTYMessageResize,
+				Rows: uint16(rows),
+				Cols: uint16(cols),
+			})
+			writeMessage(websocket.TextMessage, resize)
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if werr := writeMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return 0, fmt.Errorf("shell session ended unexpectedly: %v", err)
+		}
+		if messageType == websocket.BinaryMessage {
+			os.Stdout.Write(data)
+			continue
+		}
+
+		var msg cmdserver.PTYControl
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type != cmdserver.PTYMessageExit {
+			continue
+		}
+		if msg.Error != "" {
+			return msg.Code, fmt.Errorf("shell failed: %s", msg.Error)
+		}
+		return msg.Code, nil
+	}
+}
+
 func downloadFiles(vmName string, paths []string) error {
 	pathsStr := strings.Join(paths, ",")
 	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameFilesGet(context.Background(), vmName).Paths(pathsStr).Execute()
@@ -286,159 +845,1046 @@ func downloadFiles(vmName string, paths []string) error {
 	return nil
 }
 
-func listVM(vmName string) error {
-	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameGet(context.Background(), vmName).Execute()
+func hostGC(dryRun bool) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1HostGcPost(context.Background()).DryRun(dryRun).Execute()
 	if err != nil {
-		return parseErrorResponse("get VM info", httpResp, err)
+		return parseErrorResponse("collect garbage", httpResp, err)
 	}
 
-	fmt.Printf("VM Name: %s\n", resp.GetVmName())
-	fmt.Printf("Status: %s\n", resp.GetStatus())
-	fmt.Printf("IP Address: %s\n", resp.GetIp())
-	fmt.Printf("Tap Device: %s\n", resp.GetTapDeviceName())
+	verb := "Reclaimed"
+	if resp.GetDryRun() {
+		verb = "Would reclaim"
+	}
+	for _, item := range resp.GetReclaimed() {
+		fmt.Printf("%s %s %s: %d bytes (%s)\n", verb, item.GetKind(), item.GetName(), item.GetBytes(), item.GetReason())
+	}
+	fmt.Printf("%s %d bytes, state dir uses %d bytes\n", verb, resp.GetReclaimedBytes(), resp.GetStateDirBytes())
+	if resp.GetOverLimit() {
+		fmt.Println("State dir is still over its size limit")
+	}
+	for _, msg := range resp.GetErrors() {
+		fmt.Printf("Error: %s\n", msg)
+	}
+	return nil
+}
 
-	// Print port forwards with descriptions
-	if len(resp.GetPortForwards()) > 0 {
-		fmt.Println("Port Forwards:")
-		for _, pf := range resp.GetPortForwards() {
-			fmt.Printf("  %s -> %s: %s\n",
-				pf.GetHostPort(),
-				pf.GetGuestPort(),
-				pf.GetDescription())
-		}
+func reconcileNetwork(dryRun bool) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1HostNetworkReconcilePost(context.Background()).DryRun(dryRun).Execute()
+	if err != nil {
+		return parseErrorResponse("reconcile network", httpResp, err)
 	}
 
+	for _, r := range resp.GetStale() {
+		fmt.Printf("Stale %s %s: %s\n", r.GetKind(), r.GetName(), r.GetReason())
+	}
+	if resp.GetDryRun() {
+		fmt.Printf("Found %d stale network resources\n", len(resp.GetStale()))
+	} else {
+		fmt.Printf("Removed %d of %d stale network resources\n", resp.GetRemoved(), len(resp.GetStale()))
+	}
+	for _, msg := range resp.GetErrors() {
+		fmt.Printf("Error: %s\n", msg)
+	}
 	return nil
 }
 
-func main() {
-	app := &cli.App{
-		Name:  "arrakis-client",
-		Usage: "A CLI for managing VMs",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:    "config",
-				Aliases: []string{"c"},
-				Usage:   "Path to config file",
+func hostStatus() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1HostStatusGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("get host status", httpResp, err)
+	}
+
+	fmt.Printf("VMs: %d, creating: %d, snapshotting: %d\n", resp.GetVms(), resp.GetCreating(), resp.GetSnapshotting())
+	fmt.Printf("Queued: %d, oldest waiting %.0fs\n", resp.GetQueued(), resp.GetOldestQueuedSeconds())
+	for kind, n := range resp.GetOperations() {
+		fmt.Printf("Running %s operations: %d\n", kind, n)
+	}
+	for kind, n := range resp.GetSessions() {
+		fmt.Printf("Active %s sessions: %d\n", kind, n)
+	}
+	if resp.Capacity != nil {
+		fmt.Printf("Reserved %d of %d vCPUs, %d of %d MB\n",
+			resp.Reserved.GetVcpus(), resp.Capacity.GetVcpus(), resp.Reserved.GetMemoryMb(), resp.Capacity.GetMemoryMb())
+	}
+	if resp.GetCordoned() {
+		fmt.Printf("Cordoned: %s\n", resp.GetCordonReason())
+	}
+	return nil
+}
+
+func serverVersion() error {
+	resp, httpResp, err := apiClient.DefaultAPI.VersionGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("get server version", httpResp, err)
+	}
+
+	fmt.Printf("Version: %s\n", resp.GetVersion())
+	fmt.Printf("API versions: %s (preferred %s)\n", strings.Join(resp.GetApiVersions(), ", "), resp.GetPreferredApiVersion())
+	features := resp.GetFeatures()
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %s: %t\n", name, features[name])
+	}
+	return nil
+}
+
+func hostCapabilities() error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1CapabilitiesGet(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("get host capabilities", httpResp, err)
+	}
+
+	fmt.Printf("Server version: %s, arch: %s\n", resp.GetServerVersion(), resp.GetArch())
+	for _, c := range resp.GetCapabilities() {
+		state := "disabled"
+		if c.GetEnabled() {
+			state = "enabled"
+		}
+		line := fmt.Sprintf("  %s: %s", c.GetName(), state)
+		if c.GetVersion() != "" {
+			line += " " + c.GetVersion()
+		}
+		if c.GetReason() != "" {
+			line += " (" + c.GetReason() + ")"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func cordonHost(reason string) error {
+	req := serverapi.HostCordonRequest{Reason: serverapi.PtrString(reason)}
+	resp, httpResp, err := apiClient.DefaultAPI.V1HostCordonPost(context.Background()).HostCordonRequest(req).Execute()
+	if err != nil {
+		return parseErrorResponse("cordon host", httpResp, err)
+	}
+	fmt.Printf("Host cordoned since %s, %d VMs still running\n", resp.GetSince().Format(time.RFC3339), resp.GetVms())
+	return nil
+}
+
+func uncordonHost() error {
+	_, httpResp, err := apiClient.DefaultAPI.V1HostUncordonPost(context.Background()).Execute()
+	if err != nil {
+		return parseErrorResponse("uncordon host", httpResp, err)
+	}
+	fmt.Println("Host uncordoned")
+	return nil
+}
+
+func listVM(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("get VM info", httpResp, err)
+	}
+
+	fmt.Printf("VM Name: %s\n", resp.GetVmName())
+	fmt.Printf("VM ID: %s\n", resp.GetVmId())
+	fmt.Printf("Status: %s\n", resp.GetStatus())
+	fmt.Printf("IP Address: %s\n", resp.GetIp())
+	fmt.Printf("Tap Device: %s\n", resp.GetTapDeviceName())
+
+	// Print port forwards with descriptions
+	if len(resp.GetPortForwards()) > 0 {
+		fmt.Println("Port Forwards:")
+		for _, pf := range resp.GetPortForwards() {
+			fmt.Printf("  %s -> %s: %s\n",
+				pf.GetHostPort(),
+				pf.GetGuestPort(),
+				pf.GetDescription())
+		}
+	}
+
+	if boot, ok := resp.GetBootOk(); ok {
+		fmt.Printf("Boot: %s\n", boot.GetPhase())
+		for _, e := range boot.GetEvents() {
+			fmt.Printf("  %s after %dms\n", e.GetPhase(), e.GetElapsedMs())
+		}
+		if boot.GetError() != "" {
+			fmt.Printf("  error: %s\n", boot.GetError())
+		}
+	}
+
+	return nil
+}
+
+func vmSpec(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameSpecGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("get VM spec", httpResp, err)
+	}
+
+	spec, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	fmt.Println(string(spec))
+	return nil
+}
+
+// vmEvents prints the events workloads in a VM reported after seq, one JSON
+// object per line, and with follow, keeps printing them as they come.
+func vmEvents(vmName string, seq uint64, follow bool) error {
+	query := url.Values{"after": {strconv.FormatUint(seq, 10)}}
+	if follow {
+		query.Set("follow", "true")
+	}
+	eventsURL := url.URL{
+		Scheme:   "http",
+		Host:     serverAddr,
+		Path:     fmt.Sprintf("/v1/vms/%s/events", url.PathEscape(vmName)),
+		RawQuery: query.Encode(),
+	}
+	httpResp, err := http.Get(eventsURL.String())
+	if err != nil {
+		return fmt.Errorf("failed to get guest events: %v", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return parseErrorResponse("get guest events", httpResp, nil)
+	}
+	defer httpResp.Body.Close()
+
+	if !follow {
+		var resp cmdserver.GuestEventsResponse
+		if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+			return fmt.Errorf("failed to decode response: %v", err)
+		}
+		if resp.Dropped > 0 {
+			log.Warnf("%d events were dropped", resp.Dropped)
+		}
+		for _, event := range resp.Events {
+			line, _ := json.Marshal(event)
+			fmt.Println(string(line))
+		}
+		return nil
+	}
+	scanner := bufio.NewScanner(httpResp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			fmt.Println(data)
+		}
+	}
+	return scanner.Err()
+}
+
+func vmTimeline(vmName string, kind string, from string, to string, limit int32) error {
+	req := apiClient.DefaultAPI.V1VmsNameTimelineGet(context.Background(), vmName)
+	if kind != "" {
+		req = req.Kind(kind)
+	}
+	if from != "" {
+		req = req.From(from)
+	}
+	if to != "" {
+		req = req.To(to)
+	}
+	if limit > 0 {
+		req = req.Limit(limit)
+	}
+	resp, httpResp, err := req.Execute()
+	if err != nil {
+		return parseErrorResponse("get VM timeline", httpResp, err)
+	}
+	for _, entry := range resp.GetEntries() {
+		fmt.Printf("%s  %-9s  %-18s  %s\n", entry.GetTime().Format(time.RFC3339), entry.GetKind(), entry.GetAction(), entry.GetSummary())
+	}
+	return nil
+}
+
+func printVMNetwork(resp *serverapi.VmNetworkResponse) error {
+	network, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	fmt.Println(string(network))
+	return nil
+}
+
+func vmNetwork(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameNetworkGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("get VM network", httpResp, err)
+	}
+	return printVMNetwork(resp)
+}
+
+func enableVMNetwork(vmName string, duration time.Duration) error {
+	req := serverapi.VmNetworkEnableRequest{}
+	if duration > 0 {
+		req.DurationSeconds = serverapi.PtrInt32(int32(duration.Seconds()))
+	}
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameNetworkEnablePost(context.Background(), vmName).VmNetworkEnableRequest(req).Execute()
+	if err != nil {
+		return parseErrorResponse("enable VM network", httpResp, err)
+	}
+	return printVMNetwork(resp)
+}
+
+func disableVMNetwork(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameNetworkDisablePost(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("disable VM network", httpResp, err)
+	}
+	return printVMNetwork(resp)
+}
+
+func vmDevices(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameDevicesGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("list devices", httpResp, err)
+	}
+
+	fmt.Printf("VM Name: %s\n", resp.GetVmName())
+	for _, d := range resp.GetDevices() {
+		fmt.Printf("%s\t%s\t%s%s\t%s\n", d.GetId(), d.GetKind(), d.GetPath(), d.GetTap(), d.GetPciBdf())
+	}
+	return nil
+}
+
+func attachDevice(vmName string, kind string, diskPath string, sizeMb int, readonly bool, mac string) error {
+	req := serverapi.NewVmDeviceRequest(kind)
+	if diskPath != "" {
+		req.Path = serverapi.PtrString(diskPath)
+	}
+	if sizeMb != 0 {
+		req.SizeMb = serverapi.PtrInt32(int32(sizeMb))
+	}
+	if readonly {
+		req.Readonly = serverapi.PtrBool(true)
+	}
+	if mac != "" {
+		req.Mac = serverapi.PtrString(mac)
+	}
+
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameDevicesPost(context.Background(), vmName).VmDeviceRequest(*req).Execute()
+	if err != nil {
+		return parseErrorResponse("attach device", httpResp, err)
+	}
+	log.Infof("attached %s %s to VM: %s at %s", resp.GetKind(), resp.GetId(), vmName, resp.GetPciBdf())
+	return nil
+}
+
+func detachDevice(vmName string, deviceID string) error {
+	httpResp, err := apiClient.DefaultAPI.V1VmsNameDevicesIdDelete(context.Background(), vmName, deviceID).Execute()
+	if err != nil {
+		return parseErrorResponse("detach device", httpResp, err)
+	}
+	log.Infof("detached device %s from VM: %s", deviceID, vmName)
+	return nil
+}
+
+func vmExposure(vmName string) error {
+	resp, httpResp, err := apiClient.DefaultAPI.V1VmsNameExposureGet(context.Background(), vmName).Execute()
+	if err != nil {
+		return parseErrorResponse("get VM exposure", httpResp, err)
+	}
+
+	fmt.Printf("VM Name: %s\n", resp.GetVmName())
+	fmt.Printf("IP Address: %s\n", resp.GetIp())
+	for _, e := range resp.GetExposure() {
+		listening := "not listening"
+		if e.GetListening() {
+			listening = "listening"
+		}
+		createdBy := e.GetCreatedBy()
+		if createdBy == "" {
+			createdBy = "-"
+		}
+		fmt.Printf("  %d -> %d %s (%s): %s, created by %s at %s\n",
+			e.GetHostPort(),
+			e.GetGuestPort(),
+			e.GetKind(),
+			listening,
+			e.GetDescription(),
+			createdBy,
+			e.GetCreatedAt().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func getOperation(id string, cancel bool) error {
+	var resp *serverapi.Operation
+	var httpResp *http.Response
+	var err error
+	if cancel {
+		resp, httpResp, err = apiClient.DefaultAPI.V1OperationsIdDelete(context.Background(), id).Execute()
+	} else {
+		resp, httpResp, err = apiClient.DefaultAPI.V1OperationsIdGet(context.Background(), id).Execute()
+	}
+	if err != nil {
+		return parseErrorResponse("get operation", httpResp, err)
+	}
+
+	fmt.Printf("Operation: %s (%s %s)\n", resp.GetId(), resp.GetKind(), resp.GetTarget())
+	fmt.Printf("Status: %s\n", resp.GetStatus())
+	if resp.GetProgress() != "" {
+		fmt.Printf("Progress: %s\n", resp.GetProgress())
+	}
+	if resp.GetError() != "" {
+		fmt.Printf("Error: %s\n", resp.GetError())
+	}
+	if vm, ok := resp.GetVmOk(); ok {
+		fmt.Printf("VM: %s, IP Address: %s\n", vm.GetVmName(), vm.GetIp())
+	}
+	if snapshot, ok := resp.GetSnapshotOk(); ok {
+		fmt.Printf("Snapshot: %s\n", snapshot.GetSnapshotId())
+	}
+	return nil
+}
+
+func main() {
+	app := &cli.App{
+		Name:  "arrakis-client",
+		Usage: "A CLI for managing VMs",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Aliases: []string{"c"},
+				Usage:   "Path to config file",
 				Value:   "./config.yaml",
 			},
-		},
-		Before: func(ctx *cli.Context) error {
-			configPath := ctx.String("config")
-			clientConfig, err := config.GetClientConfig(configPath)
-			if err != nil {
-				return fmt.Errorf("failed to get client config: %v", err)
-			}
-			log.Infof("client config: %v", clientConfig)
-
-			apiClient, err = createApiClient(
-				fmt.Sprintf("%s:%s", clientConfig.ServerHost, clientConfig.ServerPort),
-			)
-			if err != nil {
-				return fmt.Errorf("failed to initialize api client: %v", err)
-			}
-			return nil
-		},
-		Commands: []*cli.Command{
+		},
+		Before: func(ctx *cli.Context) error {
+			configPath := ctx.String("config")
+			clientConfig, err := config.GetClientConfig(configPath)
+			if err != nil {
+				return fmt.Errorf("failed to get client config: %v", err)
+			}
+			log.Infof("client config: %v", clientConfig)
+
+			serverAddr = net.JoinHostPort(clientConfig.ServerHost, clientConfig.ServerPort)
+			apiClient, err = createApiClient(serverAddr)
+			if err != nil {
+				return fmt.Errorf("failed to initialize api client: %v", err)
+			}
+			return nil
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "start",
+				Usage: "Start a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to create",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "kernel",
+						Aliases: []string{"k"},
+						Usage:   "Path of the kernel image to be used",
+					},
+					&cli.StringFlag{
+						Name:    "rootfs",
+						Aliases: []string{"r"},
+						Usage:   "Path of the rootfs image to be used",
+					},
+					&cli.StringFlag{
+						Name:  "arch",
+						Usage: "Architecture the VM needs, x86_64 or aarch64, refused on hosts of another one",
+					},
+					&cli.StringFlag{
+						Name:  "hypervisor",
+						Usage: "Hypervisor to run the VM with, cloud-hypervisor or firecracker. Defaults to the server's",
+					},
+					&cli.StringFlag{
+						Name:     "entry-point",
+						Aliases:  []string{"e"},
+						Usage:    "Entry point of the VM",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:    "snapshot",
+						Aliases: []string{"s"},
+						Usage:   "Path to snapshot directory to restore from",
+					},
+					&cli.DurationFlag{
+						Name:    "wait",
+						Aliases: []string{"w"},
+						Usage:   "Wait up to this long for the VM's services to be ready",
+					},
+					&cli.BoolFlag{
+						Name:  "queue",
+						Usage: "Queue the VM if the host is at capacity instead of failing",
+					},
+					&cli.StringFlag{
+						Name:  "callback-url",
+						Usage: "With --queue, URL to notify once the VM has started",
+					},
+					&cli.StringFlag{
+						Name:  "owner",
+						Usage: "Tenant or workload the VM belongs to",
+					},
+					&cli.IntFlag{
+						Name:  "priority",
+						Usage: "Admission priority, higher is admitted first",
+					},
+					&cli.StringSliceFlag{
+						Name:  "mount",
+						Usage: "Name of an object mount configured on the server to mount read-only, can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "kernel-args",
+						Usage: "Space separated kernel boot args replacing or adding to the default ones, e.g. \"console=hvc0 quiet\"",
+					},
+					&cli.BoolFlag{
+						Name:  "isolated",
+						Usage: "Only let the VM reach beyond the host once its network is enabled",
+					},
+					&cli.DurationFlag{
+						Name:  "egress-for",
+						Usage: "Let the VM reach beyond the host for this long after it starts, then isolate it",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return startVM(
+						ctx.String("name"),
+						ctx.String("kernel"),
+						ctx.String("rootfs"),
+						ctx.String("arch"),
+						ctx.String("hypervisor"),
+						ctx.String("entry-point"),
+						ctx.String("snapshot"),
+						ctx.Duration("wait"),
+						ctx.Bool("queue"),
+						ctx.String("callback-url"),
+						ctx.String("owner"),
+						ctx.Int("priority"),
+						ctx.StringSlice("mount"),
+						ctx.String("kernel-args"),
+						ctx.Bool("isolated"),
+						ctx.Duration("egress-for"),
+					)
+				},
+			},
+			{
+				Name:  "stop",
+				Usage: "Stop a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to stop",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "graceful",
+						Usage: "Run the on-stop hook and collect logs and artifacts first",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return stopVM(ctx.String("name"), ctx.Bool("graceful"))
+				},
+			},
+			{
+				Name:  "update",
+				Usage: "Rename a VM or transfer it to a new owner",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to update",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "rename",
+						Usage: "New name for the VM",
+					},
+					&cli.StringFlag{
+						Name:  "owner",
+						Usage: "Tenant or workload to transfer the VM to",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return updateVM(ctx.String("name"), ctx.String("rename"), ctx.String("owner"))
+				},
+			},
+			{
+				Name:  "destroy",
+				Usage: "Destroy a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to destroy",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "purge",
+						Usage: "Don't keep the VM to be undeleted, or purge a deleted VM right away",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return destroyVM(ctx.String("name"), ctx.Bool("purge"))
+				},
+			},
+			{
+				Name:  "undelete",
+				Usage: "Bring back a deleted VM pending purge",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the deleted VM",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return undeleteVM(ctx.String("name"))
+				},
+			},
+			{
+				Name:  "adopt",
+				Usage: "Manage a VM running in a cloud-hypervisor process started outside of arrakis",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name to manage the VM under",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "api-socket",
+						Usage: "Path of the cloud-hypervisor API socket",
+					},
+					&cli.IntFlag{
+						Name:  "pid",
+						Usage: "PID of the cloud-hypervisor process",
+					},
+					&cli.StringFlag{
+						Name:  "ip",
+						Usage: "Guest IP in CIDR notation, if the kernel command line doesn't set guest_ip",
+					},
+					&cli.StringFlag{
+						Name:  "owner",
+						Usage: "Tenant the VM belongs to",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return adoptVM(ctx.String("name"), ctx.String("api-socket"), ctx.Int("pid"), ctx.String("ip"), ctx.String("owner"))
+				},
+			},
+			{
+				Name:  "export",
+				Usage: "Download a VM as an archive to import on another host",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name or ID of the VM to export",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "File to save the archive to, <name>.tar.gz by default",
+					},
+					&cli.BoolFlag{
+						Name:  "memory",
+						Usage: "Include a snapshot of the running VM, otherwise the VM must be stopped",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return exportVM(ctx.String("name"), ctx.String("output"), ctx.Bool("memory"))
+				},
+			},
+			{
+				Name:  "import",
+				Usage: "Recreate a VM from an archive exported on another host",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "Archive to import",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "name",
+						Aliases: []string{"n"},
+						Usage:   "Name of the VM, the exported VM's name by default",
+					},
+					&cli.StringFlag{
+						Name:  "owner",
+						Usage: "Tenant the VM belongs to",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return importVM(ctx.String("file"), ctx.String("name"), ctx.String("owner"))
+				},
+			},
+			{
+				Name:  "audit-download",
+				Usage: "Download the signed audit batches of a tenant",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "tenant",
+						Usage: "Tenant whose batches to download, your own with OIDC",
+					},
+					&cli.StringFlag{
+						Name:     "output",
+						Aliases:  []string{"o"},
+						Usage:    "Directory to save the batches to",
+						Required: true,
+					},
+					&cli.Uint64Flag{
+						Name:  "after",
+						Usage: "Only download the batches after this one",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return downloadAudit(ctx.String("tenant"), ctx.String("output"), ctx.Uint64("after"))
+				},
+			},
+			{
+				Name:  "audit-verify",
+				Usage: "Verify the hash chain and signatures of downloaded audit batches",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "dir",
+						Aliases:  []string{"d"},
+						Usage:    "Directory the batches were downloaded to",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "public-key",
+						Usage: "File of the base64 public key to verify with, otherwise the key the server reports",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return verifyAudit(ctx.String("dir"), ctx.String("public-key"))
+				},
+			},
+			{
+				Name:  "destroy-all",
+				Usage: "Destroy all VMs",
+				Action: func(ctx *cli.Context) error {
+					return destroyAllVMs()
+				},
+			},
+			{
+				Name:  "list-all",
+				Usage: "List all VMs",
+				Action: func(ctx *cli.Context) error {
+					return listAllVMs()
+				},
+			},
+			{
+				Name:  "gc",
+				Usage: "Reclaim disk used by destroyed VMs and old snapshots on the server",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only report what would be reclaimed",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return hostGC(ctx.Bool("dry-run"))
+				},
+			},
+			{
+				Name:  "reconcile-network",
+				Usage: "Clean up tap devices, iptables rules and bridge addresses no VM accounts for on the server",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only report the stale resources",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return reconcileNetwork(ctx.Bool("dry-run"))
+				},
+			},
+			{
+				Name:  "host-status",
+				Usage: "Show how busy the server is: creations, queued VMs, snapshots and sessions in progress",
+				Action: func(ctx *cli.Context) error {
+					return hostStatus()
+				},
+			},
+			{
+				Name:  "server-version",
+				Usage: "Show the server's version, the API versions it serves and its optional features",
+				Action: func(ctx *cli.Context) error {
+					return serverVersion()
+				},
+			},
+			{
+				Name:  "host-capabilities",
+				Usage: "List the subsystems of the server's host, whether they are enabled and their versions",
+				Action: func(ctx *cli.Context) error {
+					return hostCapabilities()
+				},
+			},
+			{
+				Name:  "cordon",
+				Usage: "Stop the server from accepting new VMs for maintenance, its VMs keep running",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "reason",
+						Usage: "Why the host is cordoned, returned to the clients refused",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return cordonHost(ctx.String("reason"))
+				},
+			},
+			{
+				Name:  "uncordon",
+				Usage: "Let the server accept new VMs again",
+				Action: func(ctx *cli.Context) error {
+					return uncordonHost()
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List VM info",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM to destroy",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return listVM(ctx.String("name"))
+				},
+			},
 			{
-				Name:  "start",
-				Usage: "Start a VM",
+				Name:  "operation",
+				Usage: "Show or cancel a background operation",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Aliases:  []string{"i"},
+						Usage:    "ID of the operation",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "cancel",
+						Usage: "Cancel the operation if it is still running",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return getOperation(ctx.String("id"), ctx.Bool("cancel"))
+				},
+			},
+			{
+				Name:  "exposure",
+				Usage: "Audit the host ports a VM is reachable on",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:     "name",
 						Aliases:  []string{"n"},
-						Usage:    "Name of the VM to create",
+						Usage:    "Name of the VM",
 						Required: true,
 					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return vmExposure(ctx.String("name"))
+				},
+			},
+			{
+				Name:  "spec",
+				Usage: "Describe the configuration a VM runs with",
+				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:    "kernel",
-						Aliases: []string{"k"},
-						Usage:   "Path of the kernel image to be used",
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
 					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return vmSpec(ctx.String("name"))
+				},
+			},
+			{
+				Name:  "events",
+				Usage: "Print the events workloads in a VM reported through the guest agent",
+				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:    "rootfs",
-						Aliases: []string{"r"},
-						Usage:   "Path of the rootfs image to be used",
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.Uint64Flag{
+						Name:  "after",
+						Usage: "Only print events with a greater sequence number",
+					},
+					&cli.BoolFlag{
+						Name:    "follow",
+						Aliases: []string{"f"},
+						Usage:   "Keep printing events as they are reported",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return vmEvents(ctx.String("name"), ctx.Uint64("after"), ctx.Bool("follow"))
+				},
+			},
+			{
+				Name:  "timeline",
+				Usage: "Print what happened to a VM, oldest first",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
 					},
 					&cli.StringFlag{
-						Name:     "entry-point",
-						Aliases:  []string{"e"},
-						Usage:    "Entry point of the VM",
-						Required: false,
+						Name:  "kind",
+						Usage: "Comma-separated kinds to print: lifecycle, exec, recording, snapshot, download or health",
 					},
 					&cli.StringFlag{
-						Name:    "snapshot",
-						Aliases: []string{"s"},
-						Usage:   "Path to snapshot directory to restore from",
+						Name:  "from",
+						Usage: "Only print entries at or after this time (RFC 3339 or YYYY-MM-DD)",
+					},
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "Only print entries before this time (RFC 3339 or YYYY-MM-DD)",
+					},
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "Only print the latest entries",
 					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return startVM(
-						ctx.String("name"),
-						ctx.String("kernel"),
-						ctx.String("rootfs"),
-						ctx.String("entry-point"),
-						ctx.String("snapshot"),
-					)
+					return vmTimeline(ctx.String("name"), ctx.String("kind"), ctx.String("from"), ctx.String("to"), int32(ctx.Int("limit")))
 				},
 			},
 			{
-				Name:  "stop",
-				Usage: "Stop a VM",
+				Name:  "network",
+				Usage: "Show when a VM can reach beyond the host",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:     "name",
 						Aliases:  []string{"n"},
-						Usage:    "Name of the VM to stop",
+						Usage:    "Name of the VM",
 						Required: true,
 					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return stopVM(ctx.String("name"))
+					return vmNetwork(ctx.String("name"))
 				},
 			},
 			{
-				Name:  "destroy",
-				Usage: "Destroy a VM",
+				Name:  "network-enable",
+				Usage: "Let a VM with restricted egress reach beyond the host for a while",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:     "name",
 						Aliases:  []string{"n"},
-						Usage:    "Name of the VM to destroy",
+						Usage:    "Name of the VM",
 						Required: true,
 					},
+					&cli.DurationFlag{
+						Name:  "duration",
+						Usage: "How long to enable egress for, the server's default if not set",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return destroyVM(ctx.String("name"))
+					return enableVMNetwork(ctx.String("name"), ctx.Duration("duration"))
 				},
 			},
 			{
-				Name:  "destroy-all",
-				Usage: "Destroy all VMs",
+				Name:  "network-disable",
+				Usage: "Cut a VM off from beyond the host",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+				},
 				Action: func(ctx *cli.Context) error {
-					return destroyAllVMs()
+					return disableVMNetwork(ctx.String("name"))
 				},
 			},
 			{
-				Name:  "list-all",
-				Usage: "List all VMs",
+				Name:  "devices",
+				Usage: "List the extra disks and NICs of a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+				},
 				Action: func(ctx *cli.Context) error {
-					return listAllVMs()
+					return vmDevices(ctx.String("name"))
 				},
 			},
 			{
-				Name:  "list",
-				Usage: "List VM info",
+				Name:  "attach",
+				Usage: "Hot-plug a disk or NIC into a running VM",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:     "name",
 						Aliases:  []string{"n"},
-						Usage:    "Name of the VM to destroy",
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "kind",
+						Usage: "Kind of device, disk or nic",
+						Value: "disk",
+					},
+					&cli.StringFlag{
+						Name:  "path",
+						Usage: "Disk image to attach, in one of the server's devices.disk_dirs",
+					},
+					&cli.IntFlag{
+						Name:  "size-mb",
+						Usage: "Size of a blank disk to attach instead of an image",
+					},
+					&cli.BoolFlag{
+						Name:  "readonly",
+						Usage: "Attach the disk read-only",
+					},
+					&cli.StringFlag{
+						Name:  "mac",
+						Usage: "MAC address of the NIC",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return attachDevice(
+						ctx.String("name"),
+						ctx.String("kind"),
+						ctx.String("path"),
+						ctx.Int("size-mb"),
+						ctx.Bool("readonly"),
+						ctx.String("mac"),
+					)
+				},
+			},
+			{
+				Name:  "detach",
+				Usage: "Hot-unplug a device from a running VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "id",
+						Aliases:  []string{"i"},
+						Usage:    "ID of the device, as listed by devices",
 						Required: true,
 					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return listVM(ctx.String("name"))
+					return detachDevice(ctx.String("name"), ctx.String("id"))
 				},
 			},
 			{
@@ -462,6 +1908,133 @@ func main() {
 					return snapshotVM(ctx.String("name"), ctx.String("id"))
 				},
 			},
+			{
+				Name:  "browser-profile",
+				Usage: "Seed the browser profile of a VM from a zipped Chrome user-data-dir",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "Zipped user-data-dir",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return seedBrowserProfile(ctx.String("name"), ctx.String("file"))
+				},
+			},
+			{
+				Name:  "reset",
+				Usage: "Reset a VM to a clean state without rebooting it",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:  "scratch",
+						Usage: "Guest path to empty in addition to the defaults, can be repeated",
+					},
+					&cli.BoolFlag{
+						Name:  "keep-profile",
+						Usage: "Keep the browser profile, e.g. a seeded golden one",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return resetVM(ctx.String("name"), ctx.StringSlice("scratch"), ctx.Bool("keep-profile"))
+				},
+			},
+			{
+				Name:  "ocr",
+				Usage: "Extract the text on the desktop or browser page of a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "source",
+						Usage: "What to capture: desktop or browser",
+						Value: "desktop",
+					},
+					&cli.IntFlag{
+						Name:  "display",
+						Usage: "Display of the desktop to capture, the default desktop if unset",
+						Value: -1,
+					},
+					&cli.StringFlag{
+						Name:  "language",
+						Usage: "Language of the text, e.g. eng or eng+deu",
+					},
+					&cli.Float64Flag{
+						Name:  "min-confidence",
+						Usage: "Leave out words recognized with less confidence, from 0 to 100",
+					},
+					&cli.BoolFlag{
+						Name:  "words",
+						Usage: "Print every word with its bounding box and confidence",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return vmOCR(ctx.String("name"), ctx.String("source"), ctx.Int("display"), ctx.String("language"), ctx.Float64("min-confidence"), ctx.Bool("words"))
+				},
+			},
+			{
+				Name:  "disk-search",
+				Usage: "Find files a stopped VM wrote to its disk",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "glob",
+						Aliases:  []string{"g"},
+						Usage:    "Glob of file names, e.g. \"*.log\", or of whole paths, e.g. \"/home/*/out/*.tar\"",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "Most matches to return",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return searchVMDisk(ctx.String("name"), ctx.String("glob"), ctx.Int("limit"))
+				},
+			},
+			{
+				Name:  "snapshot-diff",
+				Usage: "List the files that changed in the guest between two snapshots",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Aliases:  []string{"i"},
+						Usage:    "ID of the snapshot",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "base",
+						Aliases:  []string{"b"},
+						Usage:    "ID of the earlier snapshot to compare against",
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return snapshotDiff(ctx.String("id"), ctx.String("base"))
+				},
+			},
 			{
 				Name:  "restore",
 				Usage: "Restore a VM from a snapshot",
@@ -550,9 +2123,52 @@ func main() {
 						Usage:    "Command to run",
 						Required: true,
 					},
+					&cli.Int64Flag{
+						Name:  "cpu-seconds",
+						Usage: "CPU time each process of the command may use",
+					},
+					&cli.Int64Flag{
+						Name:  "memory-mb",
+						Usage: "Memory the processes of the command may use together",
+					},
+					&cli.Int64Flag{
+						Name:  "max-processes",
+						Usage: "Processes of the command alive at once",
+					},
+					&cli.Int64Flag{
+						Name:  "max-output-bytes",
+						Usage: "Output kept before the command is killed",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					return runCommand(ctx.String("name"), ctx.String("cmd"), execLimits(ctx))
+				},
+			},
+			{
+				Name:  "shell",
+				Usage: "Open an interactive shell in a VM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "name",
+						Aliases:  []string{"n"},
+						Usage:    "Name of the VM",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "cmd",
+						Aliases: []string{"c"},
+						Usage:   "Command to run instead of a login shell",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return runCommand(ctx.String("name"), ctx.String("cmd"))
+					code, err := shell(ctx.String("name"), ctx.String("cmd"))
+					if err != nil {
+						return err
+					}
+					if code != 0 {
+						return cli.Exit("", code)
+					}
+					return nil
 				},
 			},
 			{
@@ -576,6 +2192,17 @@ func main() {
 					return downloadFiles(ctx.String("name"), ctx.StringSlice("path"))
 				},
 			},
+			{
+				Name:      "cp",
+				Usage:     "Copy a file between the local host and a VM",
+				ArgsUsage: "<vm>:<path> <local path> | <local path> <vm>:<path>",
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 2 {
+						return fmt.Errorf("cp takes a source and a destination")
+					}
+					return copyFiles(ctx.Args().Get(0), ctx.Args().Get(1))
+				},
+			},
 		},
 	}
 
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/term"
+)
+
+// resizePollInterval is how often the size of the console is checked, as
+// Windows doesn't signal resizes.
+const resizePollInterval = 250 * time.Millisecond
+
+// watchResize returns a channel receiving a value whenever the console fd is
+// resized and the function stopping it.
+func watchResize(fd int) (<-chan struct{}, func()) {
+	resized := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(resizePollInterval)
+		defer ticker.Stop()
+		cols, rows, _ := term.GetSize(fd)
+		for {
+			select {
+			case <-ticker.C:
+				c, r, err := term.GetSize(fd)
+				if err != nil || (c == cols && r == rows) {
+					continue
+				}
+				cols, rows = c, r
+				select {
+				case resized <- struct{}{}:
+				default:
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return resized, func() { close(done) }
+}
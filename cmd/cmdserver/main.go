@@ -2,26 +2,47 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/mtls"
+	"github.com/abshkbh/arrakis/pkg/sdnotify"
+	"github.com/abshkbh/arrakis/pkg/version"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/mattn/go-shellwords"
 )
 
 const (
 	// Define a base directory to prevent path traversal
 	baseDir = "/tmp/server_files"
+	// How often the declared services are probed.
+	serviceCheckInterval = 2 * time.Second
 )
 
+// The guest is only reachable from the host, which relays PTY sessions for its
+// own clients, so any origin is accepted.
+var ptyUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
 // uploadFileHandler handles "/files" POST requests.
 func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "upload")
@@ -116,10 +137,7 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Cmd      string `json:"cmd"`
-		Blocking bool   `json:"blocking,omitempty"`
-	}
+	var req cmdserver.RunCmdRequest
 	// Block by default if not specified in the payload.
 	req.Blocking = true
 
@@ -135,6 +153,10 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Empty Command", http.StatusBadRequest)
 		return
 	}
+	if err := req.Limits.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Parse the command string using shellwords to handle quotes and escaped spaces
 	parser := shellwords.NewParser()
@@ -163,8 +185,9 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 	customPath := "/usr/local/bin:/usr/bin:/bin" // Modify as needed
 	env = append(env, "PATH="+customPath)
 
-	// Create the command
-	cmd := exec.Command("bash", "-c", req.Cmd)
+	// Create the command, limited as requested
+	limited := cmdserver.NewLimitedCommand(req.Cmd, req.Limits)
+	cmd := limited.Cmd
 	cmd.Env = env
 	cmd.Dir = baseDir
 
@@ -174,12 +197,34 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		"cmd":        cmdName,
 		"args":       cmdArgs,
 		"workingDir": cmd.Dir,
+		"limits":     req.Limits,
 	}).Info("Executing command")
 
 	// Handle command execution based on blocking mode
 	if req.Blocking {
 		// Execute the command and capture the combined output in blocking mode
-		output, err := cmd.CombinedOutput()
+		limited.CaptureOutput()
+		exceeded, err := limited.Run()
+		output := limited.Output()
+		if errors.Is(err, cmdserver.ErrInvalidLimits) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if exceeded != nil {
+			log.WithFields(log.Fields{
+				"api":   "run_cmd",
+				"cmd":   cmdName,
+				"args":  cmdArgs,
+				"limit": exceeded.Limit,
+			}).Warnf("command exceeded its limits: %s", exceeded.Message)
+			resp := cmdserver.RunCmdResponse{
+				Error:         exceeded.Message,
+				Output:        string(output),
+				LimitExceeded: exceeded,
+			}
+			writeJSON(w, resp)
+			return
+		}
 		if err != nil {
 			log.WithFields(log.Fields{
 				"api":  "run_cmd",
@@ -240,7 +285,11 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Start the command
-		if err := cmd.Start(); err != nil {
+		if err := limited.Start(); err != nil {
+			if errors.Is(err, cmdserver.ErrInvalidLimits) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			log.WithFields(log.Fields{
 				"api":  "run_cmd",
 				"cmd":  cmdName,
@@ -278,8 +327,15 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Start a goroutine to wait for the command to complete
 		go func() {
-			err := cmd.Wait()
-			if err != nil {
+			exceeded, err := limited.Wait()
+			if exceeded != nil {
+				log.WithFields(log.Fields{
+					"api":   "run_cmd",
+					"cmd":   cmdName,
+					"args":  cmdArgs,
+					"limit": exceeded.Limit,
+				}).Warnf("command exceeded its limits: %s", exceeded.Message)
+			} else if err != nil {
 				log.WithFields(log.Fields{
 					"api":  "run_cmd",
 					"cmd":  cmdName,
@@ -302,6 +358,361 @@ func runCommandHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// builtinCapabilities are served by cmdserver itself.
+var builtinCapabilities = []cmdserver.Capability{
+	{
+		Name:        "exec",
+		Description: "Run commands in the guest",
+		Protocol:    "http",
+		Port:        4031,
+	},
+	{
+		Name:        "files",
+		Description: "Upload and download guest files",
+		Protocol:    "http",
+		Port:        4031,
+	},
+}
+
+// ptyHandler handles "/cmd/pty" WebSocket requests, running `cmd`, or a login
+// shell if it is empty, on a pseudo terminal.
+func ptyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "pty")
+	query := r.URL.Query()
+	rows, err := parsePTYDimension(query.Get("rows"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid rows: %v", err), http.StatusBadRequest)
+		return
+	}
+	cols, err := parsePTYDimension(query.Get("cols"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid cols: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := ptyUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Errorf("failed to upgrade connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	cmd := exec.Command("bash", "-l")
+	if c := query.Get("cmd"); strings.TrimSpace(c) != "" {
+		cmd = exec.Command("bash", "-c", c)
+	}
+	cmd.Env = append(os.Environ(), "PATH=/usr/local/bin:/usr/bin:/bin", "TERM=xterm-256color")
+	cmd.Dir = baseDir
+
+	logger.WithField("args", cmd.Args).Info("Starting pty session")
+	if err := cmdserver.RunPTY(conn, cmd, rows, cols); err != nil {
+		logger.Errorf("pty session failed: %v", err)
+		return
+	}
+	logger.WithField("args", cmd.Args).Info("Pty session ended")
+}
+
+func parsePTYDimension(value string) (uint16, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(n), nil
+}
+
+// capabilitiesHandler handles "/capabilities" GET requests. It lists the
+// built-in capabilities and those declared in the image, probed for
+// availability.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	declared, err := cmdserver.LoadCapabilities(cmdserver.CapabilitiesDir)
+	if err != nil {
+		log.WithField("api", "capabilities").Errorf("failed to load capabilities: %v", err)
+	}
+
+	capabilities := append([]cmdserver.Capability{}, builtinCapabilities...)
+	for i := range capabilities {
+		capabilities[i].Version = version.Version
+		capabilities[i].Available = true
+	}
+	var wg sync.WaitGroup
+	for i := range declared {
+		wg.Add(1)
+		go func(c *cmdserver.Capability) {
+			defer wg.Done()
+			c.Probe(r.Context())
+		}(&declared[i])
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmdserver.CapabilitiesResponse{
+		Capabilities: append(capabilities, declared...),
+	})
+}
+
+// services tracks the health of the services declared in the image.
+var services = cmdserver.NewServiceMonitor(cmdserver.CapabilitiesDir)
+
+// servicesHandler handles "/services" GET requests.
+func servicesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmdserver.ServicesResponse{Services: services.Services()})
+}
+
+// desktopsHandler handles "/desktops" GET requests.
+func desktopsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmdserver.DesktopsResponse{
+		Desktops: cmdserver.ListDesktops(r.Context(), cmdserver.X11SocketDir, cmdserver.CapabilitiesDir),
+	})
+}
+
+// sessions accounts the sessions proxies in the guest relayed, e.g. VNC.
+var sessions cmdserver.SessionCounter
+
+// sessionsHandler handles "/sessions" GET requests.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions.Totals())
+}
+
+// reportSessionHandler handles "/sessions" POST requests.
+func reportSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var report cmdserver.SessionReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil || report.Kind == "" || report.Seconds < 0 {
+		http.Error(w, "Invalid session report", http.StatusBadRequest)
+		return
+	}
+	sessions.Add(report.Kind, time.Duration(report.Seconds*float64(time.Second)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mounter sets up the object store mounts the host asks for.
+var mounter = cmdserver.NewMounter(cmdserver.MountsConfigDir)
+
+// listMountsHandler handles "/mounts" GET requests.
+func listMountsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmdserver.MountsResponse{Mounts: mounter.List(r.Context())})
+}
+
+// mountHandler handles "/mounts" POST requests.
+func mountHandler(w http.ResponseWriter, r *http.Request) {
+	var mount cmdserver.ObjectMount
+	if err := json.NewDecoder(r.Body).Decode(&mount); err != nil {
+		http.Error(w, "Invalid mount", http.StatusBadRequest)
+		return
+	}
+	if err := mount.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := mounter.Mount(r.Context(), mount); err != nil {
+		log.WithField("api", "mounts").Errorf("failed to mount %s: %v", mount.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// profileSeeder installs the browser profiles the host sends.
+var profileSeeder = cmdserver.NewProfileSeeder(cmdserver.BrowserProfileDir, cmdserver.BrowserUnit, cmdserver.BrowserUser)
+
+// browserProfileHandler handles "/browser/profile" POST requests, whose body
+// is a zipped Chrome user-data-dir.
+func browserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "browser/profile")
+	archive, err := os.CreateTemp("", "browser-profile-*.zip")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(archive.Name())
+	_, err = io.Copy(archive, http.MaxBytesReader(w, r.Body, cmdserver.MaxBrowserProfileArchiveSize))
+	archive.Close()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to receive profile: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := profileSeeder.Seed(r.Context(), archive.Name())
+	if err != nil {
+		logger.Errorf("failed to seed browser profile: %v", err)
+		statusCode := http.StatusInternalServerError
+		if errors.Is(err, cmdserver.ErrInvalidProfile) {
+			statusCode = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+	logger.Infof("seeded browser profile with %d files", resp.Files)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// browserRestartHandler handles "/browser/restart" POST requests, which
+// (re)start one of the guest's browsers, e.g. after it crashed.
+func browserRestartHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "browser/restart")
+	var req cmdserver.BrowserRestartRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := profileSeeder.RestartBrowser(r.Context(), req.Browser); err != nil {
+		logger.Errorf("failed to restart browser %q: %v", req.Browser, err)
+		statusCode := http.StatusInternalServerError
+		if errors.Is(err, cmdserver.ErrInvalidBrowser) {
+			statusCode = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+	logger.Infof("restarted browser %q", req.Browser)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// desktopApps drives the apps of the guest's desktops, as the browser's user.
+var desktopApps = cmdserver.NewDesktopApps(cmdserver.BrowserUser)
+
+// desktopStatusCode returns the status answering a failed desktop request.
+func desktopStatusCode(err error) int {
+	if errors.Is(err, cmdserver.ErrInvalidDesktopRequest) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// openURLHandler handles "/open-url" POST requests, which open a URL with the
+// desktop's default handler, e.g. the default browser.
+func openURLHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "open-url")
+	var req cmdserver.OpenURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := desktopApps.OpenURL(r.Context(), req); err != nil {
+		logger.Errorf("failed to open url: %v", err)
+		http.Error(w, err.Error(), desktopStatusCode(err))
+		return
+	}
+	logger.Infof("opened %s", req.URL)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clipboardHandler handles "/clipboard" GET requests, which read the text of
+// the clipboard of the desktop given by the display query parameter.
+func clipboardHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "clipboard")
+	var display *int
+	if v := r.URL.Query().Get("display"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid display: %q", v), http.StatusBadRequest)
+			return
+		}
+		display = &n
+	}
+	c, err := desktopApps.Clipboard(r.Context(), display)
+	if err != nil {
+		logger.Errorf("failed to read clipboard: %v", err)
+		http.Error(w, err.Error(), desktopStatusCode(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// setClipboardHandler handles "/clipboard" PUT requests, which put text on a
+// desktop's clipboard.
+func setClipboardHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "clipboard")
+	var c cmdserver.ClipboardContent
+	// JSON escaping may double the size of the text.
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*cmdserver.MaxClipboardSize+1024)).Decode(&c); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := desktopApps.SetClipboard(r.Context(), c); err != nil {
+		logger.Errorf("failed to write clipboard: %v", err)
+		http.Error(w, err.Error(), desktopStatusCode(err))
+		return
+	}
+	logger.Infof("wrote %d bytes to the clipboard", len(c.Text))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetter brings the guest back to a clean state for the next workload.
+var resetter = cmdserver.NewResetter([]string{baseDir, cmdserver.ArtifactsDir}, profileSeeder)
+
+// resetHandler handles "/reset" POST requests, which kill the workload
+// processes, clear the scratch paths and reset the browser profile.
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "reset")
+	var req cmdserver.ResetRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	resp, err := resetter.Reset(r.Context(), req)
+	if err != nil {
+		logger.Errorf("failed to reset: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if resp.Clean {
+		logger.Infof("reset, killed %d processes", resp.KilledProcesses)
+	} else {
+		logger.Warnf("reset but not clean: %s", strings.Join(resp.Errors, "; "))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// artifacts indexes the files programs in the guest hand back to the host.
+var artifacts = cmdserver.NewArtifactIndex(cmdserver.ArtifactsDir)
+
+// listArtifactsHandler handles "/artifacts" GET requests.
+func listArtifactsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := artifacts.List()
+	if err != nil {
+		log.WithField("api", "artifacts").Errorf("failed to list artifacts: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmdserver.ArtifactsResponse{Artifacts: list})
+}
+
+// getArtifactHandler handles "/artifacts/{path}" GET requests by streaming the
+// artifact's content.
+func getArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	path := mux.Vars(r)["path"]
+	file, err := artifacts.Open(path)
+	if err != nil {
+		log.WithField("api", "artifacts").Errorf("failed to open artifact %q: %v", path, err)
+		http.Error(w, "artifact not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
 // indexHandler handles "/" GET requests.
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -317,6 +728,73 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// putArtifactHandler handles "/artifacts/{path}" POST requests from
+// workloads handing an artifact over, recording an artifact event for it.
+func putArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	rel, err := artifacts.Put(mux.Vars(r)["path"], r.Body)
+	if err != nil {
+		log.WithField("api", "artifacts").Errorf("failed to store artifact: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event := guestEvents.Add(cmdserver.GuestEvent{
+		Kind:     cmdserver.GuestEventArtifact,
+		Source:   r.URL.Query().Get("source"),
+		Message:  r.URL.Query().Get("message"),
+		Artifact: rel,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
+
+// guestEvents are the events workloads in the guest report for the host.
+var guestEvents = cmdserver.NewGuestEvents()
+
+// maxEventsWait bounds how long "/events" GET requests wait for an event.
+const maxEventsWait = time.Minute
+
+// eventsHandler handles "/events" GET requests. The events after the "after"
+// sequence number are returned, waiting up to "wait" for one if there are
+// none yet.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	var after uint64
+	if value := r.URL.Query().Get("after"); value != "" {
+		var err error
+		if after, err = strconv.ParseUint(value, 10, 64); err != nil {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		if wait, err = time.ParseDuration(value); err != nil {
+			http.Error(w, "Invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = min(wait, maxEventsWait)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(guestEvents.Since(r.Context(), after, wait))
+}
+
+// reportEventHandler handles "/events" POST requests from workloads.
+func reportEventHandler(w http.ResponseWriter, r *http.Request) {
+	var event cmdserver.GuestEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	if err := event.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event.Seq = 0
+	event = guestEvents.Add(event)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
+
 // Utility function to write JSON response
 func writeJSON(w http.ResponseWriter, resp cmdserver.RunCmdResponse) {
 	w.Header().Set("Content-Type", "application/json")
@@ -324,6 +802,12 @@ func writeJSON(w http.ResponseWriter, resp cmdserver.RunCmdResponse) {
 }
 
 func main() {
+	// Used by the guest agent updater to check a new binary before installing it.
+	if len(os.Args) > 1 && os.Args[1] == "--version" {
+		fmt.Printf("arrakis-cmdserver version %s\n", version.Version)
+		return
+	}
+
 	// Ensure base directory exists.
 	err := os.MkdirAll(baseDir, os.ModePerm)
 	if err != nil {
@@ -338,13 +822,109 @@ func main() {
 	router.HandleFunc("/files", uploadFileHandler).Methods(http.MethodPost)
 	router.HandleFunc("/files", downloadFileHandler).Methods(http.MethodGet)
 	router.HandleFunc("/cmd", runCommandHandler).Methods(http.MethodPost)
+	router.HandleFunc("/cmd/pty", ptyHandler).Methods(http.MethodGet)
+	router.HandleFunc("/capabilities", capabilitiesHandler).Methods(http.MethodGet)
+	router.HandleFunc("/services", servicesHandler).Methods(http.MethodGet)
+	router.HandleFunc("/desktops", desktopsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/sessions", sessionsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/sessions", reportSessionHandler).Methods(http.MethodPost)
+	router.HandleFunc("/mounts", listMountsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/mounts", mountHandler).Methods(http.MethodPost)
+	router.HandleFunc("/artifacts", listArtifactsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/browser/profile", browserProfileHandler).Methods(http.MethodPost)
+	router.HandleFunc("/browser/restart", browserRestartHandler).Methods(http.MethodPost)
+	router.HandleFunc("/open-url", openURLHandler).Methods(http.MethodPost)
+	router.HandleFunc("/clipboard", clipboardHandler).Methods(http.MethodGet)
+	router.HandleFunc("/clipboard", setClipboardHandler).Methods(http.MethodPut)
+	router.HandleFunc("/reset", resetHandler).Methods(http.MethodPost)
+	router.HandleFunc("/artifacts/{path:.+}", getArtifactHandler).Methods(http.MethodGet)
+	router.HandleFunc("/artifacts/{path:.+}", putArtifactHandler).Methods(http.MethodPost)
+	router.HandleFunc("/events", eventsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/events", reportEventHandler).Methods(http.MethodPost)
+
+	// Probe once before serving so that /services never reports an empty,
+	// vacuously healthy, list to callers waiting for the VM to be ready.
+	services.Check(context.Background())
+	go services.Run(context.Background(), serviceCheckInterval)
 
 	// Optionally, add logging middleware.
 	router.Use(loggingMiddleware)
 
 	port := "4031"
+	tlsConfig, err := agentTLSConfig()
+	if err != nil {
+		log.Fatalf("Failed to set up mutual TLS: %v", err)
+	}
+	if tlsConfig != nil {
+		serveMutualTLS(router, port, tlsConfig)
+		return
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("Failed to listen on port %s: %v", port, err)
+	}
+
 	log.Printf("Server is running on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, router))
+	sdnotify.Ready("serving on port " + port)
+	sdnotify.Watchdog(context.Background(), sdnotify.HTTPCheck("http://127.0.0.1:"+port+"/"))
+	log.Fatal(http.Serve(listener, router))
+}
+
+// agentTLSConfig returns the mutual TLS configuration of the agent if its
+// certificates were installed into the guest image, or nil.
+func agentTLSConfig() (*tls.Config, error) {
+	c := config.MutualTLSConfig{PKIDir: cmdserver.AgentTLSDir}
+	_, certFile, _ := mtls.Files(c, mtls.ServiceAgent)
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return mtls.ServerConfig(c, mtls.ServiceAgent)
+}
+
+// serveMutualTLS serves the host on the guest's address over mutual TLS, and
+// services in the guest, e.g. the noVNC server reporting sessions, on the
+// loopback address without it.
+func serveMutualTLS(handler http.Handler, port string, tlsConfig *tls.Config) {
+	guestCIDR, err := cmdLineValue("guest_ip")
+	if err != nil {
+		log.Fatalf("Failed to find the guest address: %v", err)
+	}
+	guestIP, _, err := net.ParseCIDR(guestCIDR)
+	if err != nil {
+		log.Fatalf("Failed to parse guest address %q: %v", guestCIDR, err)
+	}
+
+	external, err := net.Listen("tcp", net.JoinHostPort(guestIP.String(), port))
+	if err != nil {
+		log.Fatalf("Failed to listen on %s:%s: %v", guestIP, port, err)
+	}
+	local, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		log.Fatalf("Failed to listen on 127.0.0.1:%s: %v", port, err)
+	}
+	go func() {
+		log.Fatal(http.Serve(tls.NewListener(external, tlsConfig), handler))
+	}()
+
+	log.Printf("Server is running on %s (mutual TLS) and %s...", external.Addr(), local.Addr())
+	sdnotify.Ready("serving on port " + port)
+	sdnotify.Watchdog(context.Background(), sdnotify.HTTPCheck("http://127.0.0.1:"+port+"/"))
+	log.Fatal(http.Serve(local, handler))
+}
+
+// cmdLineValue returns the value of a key="value" parameter of the kernel
+// command line.
+func cmdLineValue(key string) (string, error) {
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /proc/cmdline: %w", err)
+	}
+	for _, field := range strings.Fields(string(cmdline)) {
+		if value, ok := strings.CutPrefix(field, key+"="); ok {
+			return strings.Trim(value, `"`), nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in kernel command line", key)
 }
 
 // Optional: Middleware for logging requests.
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/rfb"
+)
+
+// Bounds the body of an input sequence.
+const maxInputRequestBytes = 1 << 20
+
+// vncPassword returns the password of the guest's VNC servers.
+func (s *novncServer) vncPassword() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cfg == nil || s.cfg.VNCPassword == "" {
+		return cmdserver.DefaultVNCPassword
+	}
+	return s.cfg.VNCPassword
+}
+
+// inputHandler injects a sequence of keyboard and mouse events into the
+// default desktop, so that desktops can be automated without a VNC client.
+func (s *novncServer) inputHandler(w http.ResponseWriter, r *http.Request) {
+	s.injectInput(w, r, s.vncAddr)
+}
+
+// desktopInputHandler injects a sequence of events into one desktop.
+func (s *novncServer) desktopInputHandler(w http.ResponseWriter, r *http.Request) {
+	display, _ := strconv.Atoi(mux.Vars(r)["display"])
+	if _, err := cmdserver.DesktopPort(display); err != nil {
+		http.Error(w, "404 Not Found - "+err.Error(), http.StatusNotFound)
+		return
+	}
+	s.injectInput(w, r, net.JoinHostPort("localhost", strconv.Itoa(s.vncBasePort+display)))
+}
+
+// injectInput plays the rfb.InputRequest of r on the VNC server at vncAddr,
+// connected to as one more shared client.
+func (s *novncServer) injectInput(w http.ResponseWriter, r *http.Request, vncAddr string) {
+	var req rfb.InputRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInputRequestBytes)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("400 Bad Request - invalid input sequence: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("400 Bad Request - invalid input sequence: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	client, err := rfb.Dial(r.Context(), vncAddr, s.vncPassword())
+	if err != nil {
+		log.Errorf("Failed to connect to VNC server at %s to inject input: %v", vncAddr, err)
+		if _, ok := err.(*net.OpError); ok {
+			s.vncUnavailable(w, r, vncAddr, err)
+			return
+		}
+		http.Error(w, fmt.Sprintf("502 Bad Gateway - %v", err), http.StatusBadGateway)
+		return
+	}
+	defer client.Close()
+
+	injected, err := client.Play(r.Context(), req)
+	if err != nil {
+		log.Warnf("Input sequence for %s stopped after %d events: %v", vncAddr, injected, err)
+		http.Error(w, fmt.Sprintf("502 Bad Gateway - stopped after %d events: %v", injected, err), http.StatusBadGateway)
+		return
+	}
+	log.Infof("Injected %d input events into %s for %s", injected, vncAddr, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rfb.InputResponse{Events: injected, Width: client.Width, Height: client.Height})
+}
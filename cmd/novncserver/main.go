@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
-	"io"
+	"html/template"
 	"net"
 	"net/http"
 	"os"
-	"os/signal"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -17,21 +21,175 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 
+	"github.com/abshkbh/arrakis/pkg/admin"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
 	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/embedtoken"
+	"github.com/abshkbh/arrakis/pkg/handover"
+	"github.com/abshkbh/arrakis/pkg/listener"
+	"github.com/abshkbh/arrakis/pkg/redact"
+	"github.com/abshkbh/arrakis/pkg/relay"
+	"github.com/abshkbh/arrakis/pkg/sdnotify"
+	"github.com/abshkbh/arrakis/pkg/secheaders"
+	"github.com/abshkbh/arrakis/pkg/version"
 )
 
 const (
-	baseDir = "/tmp/novncserver"
+	// VNC server running inside the guest.
+	defaultVNCAddr = "localhost:5901"
+	// Service health as probed by the guest agent.
+	defaultServicesURL = "http://127.0.0.1:4031/services"
+	// Bounds the service health lookup when the VNC server is unreachable.
+	serviceLookupTimeout = 2 * time.Second
+	// Where finished sessions are reported for usage accounting.
+	defaultSessionsURL = "http://127.0.0.1:4031/sessions"
+	// The desktops of the guest, one per display.
+	defaultDesktopsURL = "http://127.0.0.1:4031/desktops"
+	// Bounds reporting a finished session.
+	sessionReportTimeout = 2 * time.Second
+	// Where the guest image installs the noVNC client.
+	defaultNoVNCDir = "/opt/novnc"
+	// Policy of the noVNC client's pages. Its scripts are inline too, and it
+	// connects back to websockify on its own origin.
+	novncCSP = "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; " +
+		"img-src 'self' data:; connect-src 'self'; object-src 'none'; base-uri 'self'"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for simplicity
-	},
-}
+// novncAssetDirs hold the noVNC client's scripts, styles and images, which
+// pages embedded with a token load without it when the browser doesn't send
+// the token's cookie to another site. They hold nothing secret, unlike its
+// HTML pages.
+var novncAssetDirs = []string{"/app/", "/core/", "/vendor/"}
+
+// desktopPath matches the routes of one desktop, "/vm/{vm}/desktops/{n}",
+// followed by the path below it.
+var desktopPath = regexp.MustCompile(`^(/vm/[^/]+/desktops/[0-9]+)(/.*)?$`)
 
 type novncServer struct {
-	port string
+	port        string
+	vncAddr     string
+	servicesURL string
+	sessionsURL string
+	desktopsURL string
+	// vncBasePort is the port of display 0, see cmdserver.VNCBasePort.
+	vncBasePort int
+	novncDir    string // noVNC client files
+	configFile  string // Re-read on /admin/reload
+	sessions    admin.Sessions
+
+	// logRedaction masks credentials in the logs, nil in tests.
+	logRedaction *redact.Hook
+
+	// Settings below can change on reload and are guarded by mu.
+	mu          sync.RWMutex
+	compression config.CompressionConfig
+	batching    config.BatchingConfig
+	upgrader    websocket.Upgrader
+	chaos       *relay.Chaos // Developer-only fault injection, nil when disabled
+	cfg         *config.NoVNCServerConfig
+	embedKey    ed25519.PublicKey // Verifies embed tokens, nil when disabled
+}
+
+// newNoVNCServer creates a noVNC server. The VNC upstream is plain TCP, so
+// permessage-deflate, when enabled, is always applied by the proxy itself on
+// the browser facing leg.
+func newNoVNCServer(port string, compression config.CompressionConfig, batching config.BatchingConfig) *novncServer {
+	s := &novncServer{
+		port:        port,
+		vncAddr:     defaultVNCAddr,
+		servicesURL: defaultServicesURL,
+		sessionsURL: defaultSessionsURL,
+		desktopsURL: defaultDesktopsURL,
+		vncBasePort: cmdserver.VNCBasePort,
+		novncDir:    defaultNoVNCDir,
+	}
+	s.setRelaySettings(compression, batching)
+	return s
+}
+
+// setRelaySettings rebuilds the upgrader for compression. The caller must hold
+// mu if the server is already serving.
+func (s *novncServer) setRelaySettings(compression config.CompressionConfig, batching config.BatchingConfig) {
+	s.compression = compression
+	s.batching = batching
+	s.upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true // Allow all origins for simplicity
+		},
+		EnableCompression: compression.Enabled,
+	}
+}
+
+// applyConfig installs the settings of cfg that can change while serving,
+// with the key of its embed tokens as loaded by loadEmbedKey. Sessions
+// already in progress keep the settings they started with.
+func (s *novncServer) applyConfig(cfg *config.NoVNCServerConfig, embedKey ed25519.PublicKey) {
+	chaos := relay.NewChaos(cfg.Chaos)
+	// The redaction patterns were validated with the config.
+	if redactor, err := redact.New(cfg.Redaction); err != nil {
+		log.WithError(err).Error("Invalid redaction patterns")
+	} else if s.logRedaction != nil {
+		s.logRedaction.Set(redactor)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setRelaySettings(cfg.Compression, cfg.Batching)
+	s.chaos = chaos
+	s.cfg = cfg
+	s.embedKey = embedKey
+}
+
+// loadEmbedKey reads the public key embed tokens are verified with, or
+// returns nil if they aren't accepted.
+func loadEmbedKey(cfg config.EmbedTokenVerifyConfig) (ed25519.PublicKey, error) {
+	if cfg.PublicKeyFile == "" {
+		return nil, nil
+	}
+	return embedtoken.ReadPublicKey(cfg.PublicKeyFile)
+}
+
+// Reload re-reads the config file. The port and listeners are bound at startup
+// and changes to them only take effect after a restart.
+func (s *novncServer) Reload() error {
+	cfg, err := config.GetNoVNCServerConfig(s.configFile)
+	if err != nil {
+		return err
+	}
+	if err := secheaders.ValidateOrigins(cfg.EmbedAllowedOrigins); err != nil {
+		return err
+	}
+	embedKey, err := loadEmbedKey(cfg.EmbedTokens)
+	if err != nil {
+		return err
+	}
+	if _, err := redact.New(cfg.Redaction); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	current := s.cfg
+	s.mu.RUnlock()
+	if current != nil && (cfg.Port != current.Port || cfg.Host != current.Host ||
+		cfg.Interface != current.Interface ||
+		fmt.Sprint(cfg.Listeners) != fmt.Sprint(current.Listeners) ||
+		fmt.Sprint(cfg.Admin.Tokens) != fmt.Sprint(current.Admin.Tokens)) {
+		log.Warn("Address, listener and admin changes need a restart and were not applied")
+	}
+
+	s.applyConfig(cfg, embedKey)
+	log.Infof("novnc server config reloaded: %v", cfg)
+	return nil
+}
+
+// Config describes the settings in effect.
+func (s *novncServer) Config() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cfg == nil {
+		return fmt.Sprintf("{Compression: %v Batching: %v}", s.compression, s.batching)
+	}
+	return s.cfg.String()
 }
 
 // Health check endpoint
@@ -43,89 +201,195 @@ func (s *novncServer) healthCheck(w http.ResponseWriter, r *http.Request) {
 
 // WebSocket proxy for VNC connection (websockify protocol)
 func (s *novncServer) websocketHandler(w http.ResponseWriter, r *http.Request) {
-	// Upgrade HTTP connection to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	s.relayVNC(w, r, s.vncAddr)
+}
+
+// desktopWebsocketHandler relays the websockify connection of one desktop
+// to the VNC server of its display. The VM in the route is the one the
+// request reached, the guest only serves its own desktops.
+func (s *novncServer) desktopWebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	display, _ := strconv.Atoi(mux.Vars(r)["display"])
+	if _, err := cmdserver.DesktopPort(display); err != nil {
+		http.Error(w, "404 Not Found - "+err.Error(), http.StatusNotFound)
+		return
+	}
+	s.relayVNC(w, r, net.JoinHostPort("localhost", strconv.Itoa(s.vncBasePort+display)))
+}
+
+// desktopsHandler lists the desktops of the guest, as found by the agent.
+func (s *novncServer) desktopsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), serviceLookupTimeout)
+	defer cancel()
+	desktops, err := cmdserver.FetchDesktops(ctx, http.DefaultClient, s.desktopsURL)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		log.Warnf("Failed to list desktops: %v", err)
+		http.Error(w, fmt.Sprintf("502 Bad Gateway - failed to list desktops: %v", err), http.StatusBadGateway)
 		return
 	}
-	defer conn.Close()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmdserver.DesktopsResponse{Desktops: desktops})
+}
 
-	log.Printf("WebSocket connection established from %s", r.RemoteAddr)
+// relayVNC relays a websockify connection to the VNC server at vncAddr.
+func (s *novncServer) relayVNC(w http.ResponseWriter, r *http.Request, vncAddr string) {
+	if !s.sessions.Enter() {
+		log.Printf("Draining, refusing WebSocket session from %s", r.RemoteAddr)
+		http.Error(w, "503 Service Unavailable - draining", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.sessions.Leave()
 
-	// Connect to VNC server (running on localhost:5901)
-	vncConn, err := net.Dial("tcp", "localhost:5901")
+	s.mu.RLock()
+	upgrader, compression, batching, chaos := s.upgrader, s.compression, s.batching, s.chaos
+	s.mu.RUnlock()
+
+	// Connect to VNC server before upgrading so that failures can still be
+	// reported as a plain HTTP error.
+	vncConn, err := net.Dial("tcp", vncAddr)
 	if err != nil {
 		log.Printf("Failed to connect to VNC server: %v", err)
-		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "VNC server unavailable"))
+		s.vncUnavailable(w, r, vncAddr, err)
 		return
 	}
 	defer vncConn.Close()
 
-	log.Printf("Connected to VNC server at localhost:5901")
+	log.Printf("Connected to VNC server at %s", vncAddr)
 
-	// Channel to signal connection close
-	done := make(chan struct{})
+	// Upgrade HTTP connection to WebSocket
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
 
-	// Handle WebSocket to VNC direction
-	go func() {
-		defer close(done)
-		for {
-			messageType, message, err := conn.ReadMessage()
-			if err != nil {
-				log.Printf("WebSocket read error: %v", err)
-				return
-			}
-			
-			// Handle both binary and text messages (websockify protocol)
-			if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
-				// For websockify, we may receive base64 encoded data in text messages
-				var data []byte
-				if messageType == websocket.TextMessage {
-					// For text messages, assume they are base64 encoded VNC data
-					log.Printf("Received text message, treating as binary")
-					data = message
-				} else {
-					data = message
-				}
-				
-				if _, err := vncConn.Write(data); err != nil {
-					log.Printf("VNC write error: %v", err)
-					return
-				}
-			}
+	if compression.Enabled && compression.Level != 0 {
+		if err := conn.SetCompressionLevel(compression.Level); err != nil {
+			log.Warnf("Invalid compression level %d: %v", compression.Level, err)
 		}
-	}()
+	}
 
-	// Handle VNC to WebSocket direction
-	go func() {
-		buffer := make([]byte, 4096)
-		for {
-			n, err := vncConn.Read(buffer)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("VNC read error: %v", err)
-				}
-				close(done)
-				return
-			}
-			if err := conn.WriteMessage(websocket.BinaryMessage, buffer[:n]); err != nil {
-				log.Printf("WebSocket write error: %v", err)
-				close(done)
-				return
-			}
-		}
-	}()
+	log.Printf("WebSocket connection established from %s", r.RemoteAddr)
 
-	// Wait for either direction to close
-	<-done
+	start := time.Now()
+	relay.VNC(conn, vncConn, batching, chaos)
 	log.Printf("WebSocket connection closed for %s", r.RemoteAddr)
+	s.reportSession(time.Since(start))
+}
+
+// reportSession tells the guest agent how long a VNC session lasted so that
+// it is accounted to the VM.
+func (s *novncServer) reportSession(d time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionReportTimeout)
+	defer cancel()
+	if err := cmdserver.ReportSession(ctx, http.DefaultClient, s.sessionsURL, cmdserver.SessionVNC, d); err != nil {
+		log.Warnf("Failed to report VNC session: %v", err)
+	}
+}
+
+// vncUnavailable answers a request the VNC server could not be reached for
+// with a 503. The reason is the VNC service's health as reported by the guest
+// agent, e.g. "desktop: down", falling back to the connection error.
+func (s *novncServer) vncUnavailable(w http.ResponseWriter, r *http.Request, vncAddr string, err error) {
+	reason := fmt.Sprintf("VNC server unavailable: %v", err)
+
+	_, portStr, splitErr := net.SplitHostPort(vncAddr)
+	port, atoiErr := strconv.Atoi(portStr)
+	if splitErr == nil && atoiErr == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), serviceLookupTimeout)
+		defer cancel()
+		services, lookupErr := cmdserver.FetchServices(ctx, http.DefaultClient, s.servicesURL)
+		if lookupErr != nil {
+			log.Debugf("Failed to look up guest services: %v", lookupErr)
+		} else if h, ok := cmdserver.ServiceOnPort(services, port); ok && h.State != cmdserver.ServiceUp {
+			reason = h.String()
+		}
+	}
+	http.Error(w, "503 Service Unavailable - "+reason, http.StatusServiceUnavailable)
+}
+
+// embedToken returns the claims of the embed token r carries, if it was
+// issued for this VM's desktop. The guest doesn't know the VM's ID, so tokens
+// are matched by the VM's address, the one r was received on.
+func (s *novncServer) embedToken(r *http.Request) (embedtoken.Claims, bool) {
+	s.mu.RLock()
+	key := s.embedKey
+	s.mu.RUnlock()
+	token := embedtoken.FromRequest(r)
+	if key == nil || token == "" {
+		return embedtoken.Claims{}, false
+	}
+	claims, err := embedtoken.Verify(key, token, time.Now())
+	if err != nil {
+		log.Warnf("Rejected embed token from %s for %s: %v", r.RemoteAddr, r.URL.Path, err)
+		return claims, false
+	}
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if claims.Scope != embedtoken.ScopeVNC || localAddr == nil {
+		return claims, false
+	}
+	host, _, err := net.SplitHostPort(localAddr.String())
+	if err != nil || claims.IP != host {
+		log.Warnf("Rejected embed token from %s issued for VM %s", r.RemoteAddr, claims.IP)
+		return claims, false
+	}
+	return claims, true
+}
+
+// embeddedRequest reports whether r may skip the listeners' authentication:
+// it carries an embed token for this VM, or loads a noVNC asset while embed
+// tokens are accepted.
+func (s *novncServer) embeddedRequest(r *http.Request) bool {
+	s.mu.RLock()
+	enabled := s.embedKey != nil
+	s.mu.RUnlock()
+	if !enabled {
+		return false
+	}
+	if r.Method == http.MethodGet && s.isAsset(r.URL.Path) {
+		return true
+	}
+	_, ok := s.embedToken(r)
+	return ok
+}
+
+// isAsset reports whether urlPath is one of noVNC's assets. Missing files
+// aren't, since the client's page is served in their place.
+func (s *novncServer) isAsset(urlPath string) bool {
+	urlPath = path.Clean(urlPath)
+	if m := desktopPath.FindStringSubmatch(urlPath); m != nil {
+		urlPath = m[2]
+	}
+	if strings.HasSuffix(urlPath, ".html") {
+		return false
+	}
+	for _, dir := range novncAssetDirs {
+		if strings.HasPrefix(urlPath, dir) {
+			info, err := os.Stat(s.novncDir + urlPath)
+			return err == nil && info.Mode().IsRegular()
+		}
+	}
+	return false
 }
 
-// Serve the standard noVNC client files from /opt/novnc
+// Serve the standard noVNC client files from novncDir, /opt/novnc by default
 func (s *novncServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 	// Serve files from the actual noVNC installation at /opt/novnc
 	path := r.URL.Path
+	// The client of a desktop is served below its routes and connects to
+	// its websockify.
+	websockifyPath := "websockify"
+	if m := desktopPath.FindStringSubmatch(path); m != nil {
+		if m[2] == "" {
+			// The client's assets are relative to the desktop's route.
+			target := *r.URL
+			target.Path += "/"
+			http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+			return
+		}
+		path = m[2]
+		websockifyPath = strings.TrimPrefix(m[1], "/") + "/websockify"
+	}
 	
 	// Default to index.html (which is symlinked to vnc.html)
 	if path == "/" {
@@ -133,12 +397,12 @@ func (s *novncServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Serve the file from /opt/novnc
-	filePath := "/opt/novnc" + path
+	filePath := s.novncDir + path
 	
 	// Check if file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		// If file doesn't exist, serve the main vnc.html
-		filePath = "/opt/novnc/vnc.html"
+		filePath = s.novncDir + "/vnc.html"
 	}
 	
 	// Read the file
@@ -148,6 +412,20 @@ func (s *novncServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+
+	var embedAllowedOrigins []string
+	s.mu.RLock()
+	if s.cfg != nil {
+		embedAllowedOrigins = s.cfg.EmbedAllowedOrigins
+	}
+	s.mu.RUnlock()
+	secheaders.Set(w.Header(), novncCSP, embedAllowedOrigins)
+	if r.URL.Query().Get(embedtoken.QueryParam) != "" {
+		if claims, ok := s.embedToken(r); ok {
+			// Keeps the page working when reloaded without the token.
+			embedtoken.SetCookie(w, r, r.URL.Query().Get(embedtoken.QueryParam), claims)
+		}
+	}
 	
 	// Set proper content type
 	if strings.HasSuffix(filePath, ".html") {
@@ -165,6 +443,8 @@ func (s *novncServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 	// If it's the main HTML file, modify it to use our websocket endpoint
 	if strings.HasSuffix(filePath, ".html") {
 		htmlContent := string(content)
+		wsPath := template.JSEscapeString(websockifyPath)
+		password := template.JSEscapeString(s.vncPassword())
 		
 		// Modify the HTML to use our websockify endpoint and auto-configure
 		htmlContent = strings.ReplaceAll(htmlContent, 
@@ -182,10 +462,14 @@ func (s *novncServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 							document.getElementById('noVNC_setting_port').value = window.location.port || '`+s.port+`';
 						}
 						if (document.getElementById('noVNC_setting_password')) {
-							document.getElementById('noVNC_setting_password').value = 'elara0000';
+							document.getElementById('noVNC_setting_password').value = '`+password+`';
 						}
 						if (document.getElementById('noVNC_setting_path')) {
-							document.getElementById('noVNC_setting_path').value = 'websockify';
+							// Pass an embed token on, its cookie may not be sent
+							// to the site embedding the page.
+							var embedToken = new URLSearchParams(window.location.search).get('`+embedtoken.QueryParam+`');
+							document.getElementById('noVNC_setting_path').value = embedToken ?
+								'`+wsPath+`?`+embedtoken.QueryParam+`=' + encodeURIComponent(embedToken) : '`+wsPath+`';
 						}
 						
 						// Auto-connect
@@ -202,13 +486,39 @@ func (s *novncServer) proxyHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(content)
 }
 
+// router registers the websockify endpoint and the noVNC static files.
+func (s *novncServer) router() *mux.Router {
+	r := mux.NewRouter()
+	r.StrictSlash(true) // Automatically handle trailing slashes
+
+	// Register routes
+	r.HandleFunc("/health", s.healthCheck).Methods("GET")
+	// Runtime control, only enabled with admin tokens configured
+	if s.cfg != nil {
+		admin.Register(r, s.cfg.Admin, "novnc", s, &s.sessions)
+	}
+	r.HandleFunc("/websockify", s.websocketHandler)
+	// The desktops of the guest, one per display
+	r.HandleFunc("/vm/{vm}/desktops", s.desktopsHandler).Methods("GET")
+	r.HandleFunc("/vm/{vm}/desktops/{display:[0-9]+}/websockify", s.desktopWebsocketHandler)
+	// Scripted keyboard and mouse input
+	r.HandleFunc("/vm/{vm}/input", s.inputHandler).Methods("POST")
+	r.HandleFunc("/vm/{vm}/desktops/{display:[0-9]+}/input", s.desktopInputHandler).Methods("POST")
+	r.HandleFunc("/", s.proxyHandler).Methods("GET")
+	r.PathPrefix("/").HandlerFunc(s.proxyHandler)
+	return r
+}
+
 func main() {
 	var novncConfig *config.NoVNCServerConfig
+	var embedKey ed25519.PublicKey
+	var logRedaction *redact.Hook
 	var configFile string
 
 	app := &cli.App{
-		Name:  "arrakis-novncserver",
-		Usage: "NoVNC server for remote desktop access",
+		Name:    "arrakis-novncserver",
+		Usage:   "NoVNC server for remote desktop access",
+		Version: version.Version,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "config",
@@ -224,6 +534,18 @@ func main() {
 			if err != nil {
 				return fmt.Errorf("novnc server config not found: %v", err)
 			}
+			if err := secheaders.ValidateOrigins(novncConfig.EmbedAllowedOrigins); err != nil {
+				return fmt.Errorf("embed_allowed_origins: %v", err)
+			}
+			if embedKey, err = loadEmbedKey(novncConfig.EmbedTokens); err != nil {
+				return fmt.Errorf("embed_tokens: %v", err)
+			}
+			redactor, err := redact.New(novncConfig.Redaction)
+			if err != nil {
+				return fmt.Errorf("redaction: %v", err)
+			}
+			logRedaction = redact.NewHook(redactor)
+			log.AddHook(logRedaction)
 			log.Infof("novnc server config: %v", novncConfig)
 			return nil
 		},
@@ -233,49 +555,55 @@ func main() {
 	if err != nil {
 		log.WithError(err).Fatal("novnc server exited with error")
 	}
-
-	// Ensure base directory exists
-	err = os.MkdirAll(baseDir, os.ModePerm)
-	if err != nil {
-		log.Fatalf("Failed to create base directory: %v", err)
+	if novncConfig == nil {
+		// --help or --version was handled by the CLI.
+		return
 	}
 
 	// Create NoVNC server
-	s := &novncServer{port: novncConfig.Port}
-	r := mux.NewRouter()
-	r.StrictSlash(true) // Automatically handle trailing slashes
-
-	// Register routes
-	r.HandleFunc("/health", s.healthCheck).Methods("GET")
-	r.HandleFunc("/websockify", s.websocketHandler)
-	r.HandleFunc("/", s.proxyHandler).Methods("GET")
-	r.PathPrefix("/").HandlerFunc(s.proxyHandler)
+	s := newNoVNCServer(novncConfig.Port, novncConfig.Compression, novncConfig.Batching)
+	s.configFile = configFile
+	s.logRedaction = logRedaction
+	s.applyConfig(novncConfig, embedKey)
 
-	// Start HTTP server
-	srv := &http.Server{
-		Addr:    ":" + novncConfig.Port,
-		Handler: r,
+	// Start HTTP servers on every configured listener. Listeners may be
+	// inherited from a previous instance during a zero-downtime restart.
+	listeners, err := listener.Open(listener.Defaults(novncConfig.Listeners, "tcp", net.JoinHostPort(novncConfig.Host, novncConfig.Port), novncConfig.Interface))
+	if err != nil {
+		log.Fatalf("Failed to create listeners: %v", err)
 	}
+	listeners.AllowEmbedded(s.embeddedRequest)
+	listeners.Serve(s.router())
+	log.Printf("NoVNC server listening on: %s", listeners)
 
-	go func() {
-		log.Printf("NoVNC server listening on port: %s", novncConfig.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start novnc server: %v", err)
-		}
-	}()
+	sdnotify.Ready(fmt.Sprintf("serving on %s", listeners))
+	var healthCheck func(context.Context) error
+	if url := listeners.LocalURL(); url != "" {
+		healthCheck = sdnotify.HTTPCheck(url + "/health")
+	}
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	sdnotify.Watchdog(watchdogCtx, healthCheck)
 
-	// Set up signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	// Wait for a shutdown or restart (SIGUSR2) request
+	handedOver := handover.WaitForSignal(listeners.Listeners()...)
+	stopWatchdog()
 
 	log.Info("Shutting down NoVNC server...")
+	sdnotify.Stopping("shutting down")
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := listeners.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	// Shutdown does not wait for hijacked WebSocket connections. After a
+	// handover let them run to completion so no session is dropped.
+	if handedOver {
+		log.Info("Waiting for active sessions to finish")
+		sdnotify.Status("handed over, waiting for active sessions to finish")
+		s.sessions.Wait()
+	}
+
 	log.Info("NoVNC server exited")
 }
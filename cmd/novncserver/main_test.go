@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/embedtoken"
+	"github.com/abshkbh/arrakis/pkg/listener"
+	"github.com/abshkbh/arrakis/pkg/rfb"
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+// newTestProxy starts a novncServer relaying to vncAddr.
+func newTestProxy(t *testing.T, vncAddr string, batching config.BatchingConfig) *httptest.Server {
+	t.Helper()
+	s := newNoVNCServer("0", config.CompressionConfig{}, batching)
+	s.vncAddr = vncAddr
+	proxy := httptest.NewServer(s.router())
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func dialWebsockify(t *testing.T, proxy *httptest.Server) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/websockify", nil)
+	if err != nil {
+		t.Fatalf("dial websockify: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestHealth(t *testing.T) {
+	proxy := newTestProxy(t, "127.0.0.1:1", config.BatchingConfig{})
+
+	resp, err := http.Get(proxy.URL + "/health")
+	if err != nil {
+		t.Fatalf("GET /health: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestWebsockifyRelay(t *testing.T) {
+	for _, batching := range []config.BatchingConfig{
+		{},
+		{FlushInterval: 5 * time.Millisecond, MaxBatchBytes: 1024},
+	} {
+		t.Run(batching.String(), func(t *testing.T) {
+			vnc, err := testharness.NewFakeVNC()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vnc.Close()
+			conn := dialWebsockify(t, newTestProxy(t, vnc.Addr(), batching))
+
+			messageType, banner, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("read banner: %v", err)
+			}
+			if messageType != websocket.BinaryMessage || string(banner) != testharness.RFBVersion {
+				t.Errorf("banner = %d %q, want binary %q", messageType, banner, testharness.RFBVersion)
+			}
+
+			if err := conn.WriteMessage(websocket.BinaryMessage, []byte(testharness.RFBVersion)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			_, echo, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("read echo: %v", err)
+			}
+			if string(echo) != testharness.RFBVersion {
+				t.Errorf("echo = %q, want %q", echo, testharness.RFBVersion)
+			}
+		})
+	}
+}
+
+func TestWebsockifyVNCUnavailable(t *testing.T) {
+	vnc, err := testharness.NewFakeVNC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := vnc.Addr()
+	vnc.Close()
+	_, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(cmdserver.ServicesResponse{Services: []cmdserver.ServiceHealth{
+			{Name: "desktop", Port: port, State: cmdserver.ServiceDown, Reason: "unit arrakis-vncserver.service is failed"},
+		}})
+	}))
+	defer agent.Close()
+
+	for _, tc := range []struct {
+		name        string
+		servicesURL string
+		want        string
+	}{
+		{name: "agent unreachable", servicesURL: "http://127.0.0.1:1/services", want: "VNC server unavailable"},
+		{name: "service down", servicesURL: agent.URL, want: "desktop: down (unit arrakis-vncserver.service is failed)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newNoVNCServer("0", config.CompressionConfig{}, config.BatchingConfig{})
+			s.vncAddr = addr
+			s.servicesURL = tc.servicesURL
+			proxy := httptest.NewServer(s.router())
+			defer proxy.Close()
+
+			_, resp, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/websockify", nil)
+			if err == nil || resp == nil {
+				t.Fatalf("dial succeeded without VNC, err = %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), tc.want) {
+				t.Errorf("response = %d %q, want 503 mentioning %q", resp.StatusCode, body, tc.want)
+			}
+		})
+	}
+}
+
+func TestWebsockifyUpstreamClosed(t *testing.T) {
+	vnc, err := testharness.NewFakeVNC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dialWebsockify(t, newTestProxy(t, vnc.Addr(), config.BatchingConfig{}))
+
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("read banner: %v", err)
+	}
+	vnc.Close()
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Errorf("read after upstream close succeeded, want error")
+	}
+}
+
+func TestWebsockifyReportsSession(t *testing.T) {
+	reports := make(chan cmdserver.SessionReport, 1)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report cmdserver.SessionReport
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&report) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reports <- report
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer agent.Close()
+
+	vnc, err := testharness.NewFakeVNC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vnc.Close()
+	s := newNoVNCServer("0", config.CompressionConfig{}, config.BatchingConfig{})
+	s.vncAddr = vnc.Addr()
+	s.sessionsURL = agent.URL
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	conn := dialWebsockify(t, proxy)
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("read banner: %v", err)
+	}
+	conn.Close()
+
+	select {
+	case report := <-reports:
+		if report.Kind != cmdserver.SessionVNC || report.Seconds <= 0 {
+			t.Errorf("Reported session = %+v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session was not reported")
+	}
+}
+
+func TestClientSecurityHeaders(t *testing.T) {
+	s := newNoVNCServer("0", config.CompressionConfig{}, config.BatchingConfig{})
+	s.novncDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(s.novncDir, "vnc.html"), []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		origins       []string
+		frameOptions  string
+		frameAncestor string
+	}{
+		{nil, "SAMEORIGIN", "frame-ancestors 'self'"},
+		{[]string{"https://app.example.com"}, "", "frame-ancestors 'self' https://app.example.com"},
+	} {
+		s.applyConfig(&config.NoVNCServerConfig{EmbedAllowedOrigins: tc.origins}, nil)
+		proxy := httptest.NewServer(s.router())
+		resp, err := http.Get(proxy.URL + "/")
+		proxy.Close()
+		if err != nil {
+			t.Fatalf("GET /: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Frame-Options"); got != tc.frameOptions {
+			t.Errorf("origins %v: X-Frame-Options = %q, want %q", tc.origins, got, tc.frameOptions)
+		}
+		if csp := resp.Header.Get("Content-Security-Policy"); !strings.HasSuffix(csp, tc.frameAncestor) {
+			t.Errorf("origins %v: Content-Security-Policy = %q, want %q", tc.origins, csp, tc.frameAncestor)
+		}
+		if resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("origins %v: X-Content-Type-Options missing", tc.origins)
+		}
+	}
+}
+
+func TestEmbedToken(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newNoVNCServer("0", config.CompressionConfig{}, config.BatchingConfig{})
+	s.vncAddr = "127.0.0.1:1"
+	s.novncDir = t.TempDir()
+	os.WriteFile(filepath.Join(s.novncDir, "vnc.html"), []byte("<html></html>"), 0644)
+	os.MkdirAll(filepath.Join(s.novncDir, "app"), 0755)
+	os.WriteFile(filepath.Join(s.novncDir, "app", "ui.js"), []byte("//"), 0644)
+	s.applyConfig(&config.NoVNCServerConfig{}, public)
+
+	// As served behind a listener requiring a token.
+	router := s.router()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.embeddedRequest(r) {
+			router.ServeHTTP(w, r)
+			return
+		}
+		listener.RequireToken([]string{"secret"}, router).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	issue := func(claims embedtoken.Claims) string {
+		if claims.Expiry == 0 {
+			claims.Expiry = time.Now().Add(time.Minute).Unix()
+		}
+		token, err := embedtoken.Issue(private, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := issue(embedtoken.Claims{Scope: embedtoken.ScopeVNC, IP: "127.0.0.1"})
+	for _, tc := range []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"page", "/?embed_token=" + valid, http.StatusOK},
+		{"websockify", "/websockify?embed_token=" + valid, http.StatusServiceUnavailable},
+		{"asset", "/app/ui.js", http.StatusOK},
+		{"no token", "/", http.StatusUnauthorized},
+		{"missing asset", "/app/nope.js", http.StatusUnauthorized},
+		{"other VM", "/?embed_token=" + issue(embedtoken.Claims{Scope: embedtoken.ScopeVNC, IP: "10.20.1.2"}), http.StatusUnauthorized},
+		{"terminal scope", "/?embed_token=" + issue(embedtoken.Claims{Scope: embedtoken.ScopeTerminal, IP: "127.0.0.1"}), http.StatusUnauthorized},
+		{"expired", "/?embed_token=" + issue(embedtoken.Claims{Scope: embedtoken.ScopeVNC, IP: "127.0.0.1", Expiry: 1}), http.StatusUnauthorized},
+	} {
+		resp, err := http.Get(proxy.URL + tc.target)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+		if tc.name == "page" && !strings.HasPrefix(resp.Header.Get("Set-Cookie"), embedtoken.CookieName+"=") {
+			t.Errorf("page: Set-Cookie = %q, want the embed token", resp.Header.Get("Set-Cookie"))
+		}
+	}
+}
+
+func TestDesktops(t *testing.T) {
+	vnc, err := testharness.NewFakeVNC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vnc.Close()
+	_, portStr, _ := net.SplitHostPort(vnc.Addr())
+	vncPort, _ := strconv.Atoi(portStr)
+
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(cmdserver.DesktopsResponse{Desktops: []cmdserver.Desktop{
+			{Display: 1, Kind: cmdserver.DesktopX11, Port: 5901, Available: true},
+			{Display: 2, Kind: cmdserver.DesktopX11, Port: 5902, Available: true},
+		}})
+	}))
+	defer agent.Close()
+
+	s := newNoVNCServer("0", config.CompressionConfig{}, config.BatchingConfig{})
+	s.desktopsURL = agent.URL
+	// Display 2 is served by the fake.
+	s.vncBasePort = vncPort - 2
+	s.novncDir = t.TempDir()
+	os.WriteFile(filepath.Join(s.novncDir, "vnc.html"), []byte(`<script src="app/ui.js"></script>`), 0644)
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/vm/vm1/desktops")
+	if err != nil {
+		t.Fatalf("GET desktops: %v", err)
+	}
+	var desktops cmdserver.DesktopsResponse
+	json.NewDecoder(resp.Body).Decode(&desktops)
+	resp.Body.Close()
+	if len(desktops.Desktops) != 2 || desktops.Desktops[1].Display != 2 {
+		t.Errorf("desktops = %+v", desktops)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(testharness.WebSocketURL(proxy.URL)+"/vm/vm1/desktops/2/websockify", nil)
+	if err != nil {
+		t.Fatalf("dial desktop 2: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, banner, err := conn.ReadMessage(); err != nil || string(banner) != testharness.RFBVersion {
+		t.Errorf("banner of desktop 2 = %q, %v", banner, err)
+	}
+
+	// The client of a desktop connects to its websockify.
+	resp, err = http.Get(proxy.URL + "/vm/vm1/desktops/2")
+	if err != nil {
+		t.Fatalf("GET desktop 2: %v", err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/vm/vm1/desktops/2/" || !strings.Contains(string(page), "'vm/vm1/desktops/2/websockify'") {
+		t.Errorf("client of desktop 2 at %s = %s", resp.Request.URL.Path, page)
+	}
+
+	resp, err = http.Get(proxy.URL + "/vm/vm1/desktops/100/websockify")
+	if err != nil {
+		t.Fatalf("GET desktop 100: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("desktop 100 status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestInput(t *testing.T) {
+	desktop, err := testharness.NewFakeDesktop(cmdserver.DefaultVNCPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desktop.Close()
+	_, portStr, _ := net.SplitHostPort(desktop.Addr())
+	desktopPort, _ := strconv.Atoi(portStr)
+
+	s := newNoVNCServer("0", config.CompressionConfig{}, config.BatchingConfig{})
+	s.vncAddr = desktop.Addr()
+	// Display 3 is served by the fake too.
+	s.vncBasePort = desktopPort - 3
+	proxy := httptest.NewServer(s.router())
+	defer proxy.Close()
+
+	post := func(path string, body string) (*http.Response, string) {
+		resp, err := http.Post(proxy.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	resp, body := post("/vm/vm1/input", `{"events": [{"type": "text", "text": "a"}, {"type": "click", "x": 5, "y": 6}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	var injected rfb.InputResponse
+	json.Unmarshal([]byte(body), &injected)
+	if injected.Events != 2 || injected.Width != desktop.Width {
+		t.Errorf("response = %s", body)
+	}
+
+	resp, body = post("/vm/vm1/desktops/3/input", `{"events": [{"type": "key", "key": "Return"}]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status of display 3 = %d: %s", resp.StatusCode, body)
+	}
+	want := []testharness.DesktopEvent{
+		{Key: 'a', Down: true}, {Key: 'a'},
+		{X: 5, Y: 6}, {Buttons: 1, X: 5, Y: 6}, {X: 5, Y: 6},
+		{Key: 0xff0d, Down: true}, {Key: 0xff0d},
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(desktop.Events()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := desktop.Events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	if resp, body := post("/vm/vm1/input", `{"events": [{"type": "teleport"}]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid sequence status = %d: %s", resp.StatusCode, body)
+	}
+}
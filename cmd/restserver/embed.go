@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/embedtoken"
+)
+
+const (
+	// How long embed tokens last unless configured or requested otherwise.
+	defaultEmbedTokenTTL    = 5 * time.Minute
+	defaultMaxEmbedTokenTTL = time.Hour
+)
+
+// embedTokens issues the tokens of POST /v1/vms/{name}/embed-tokens.
+type embedTokens struct {
+	key    ed25519.PrivateKey
+	ttl    time.Duration
+	maxTTL time.Duration
+}
+
+// newEmbedTokens loads the signing key of cfg, or returns nil if embed tokens
+// aren't enabled.
+func newEmbedTokens(cfg config.EmbedTokensConfig) (*embedTokens, error) {
+	if cfg.PrivateKeyFile == "" {
+		return nil, nil
+	}
+	key, err := embedtoken.ReadPrivateKey(cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	t := &embedTokens{key: key, ttl: cfg.TTL, maxTTL: cfg.MaxTTL}
+	if t.ttl <= 0 {
+		t.ttl = defaultEmbedTokenTTL
+	}
+	if t.maxTTL <= 0 {
+		t.maxTTL = defaultMaxEmbedTokenTTL
+	}
+	if t.ttl > t.maxTTL {
+		return nil, fmt.Errorf("ttl %s is longer than max_ttl %s", t.ttl, t.maxTTL)
+	}
+	return t, nil
+}
+
+// verify returns the claims of a token t issued, unless it expired.
+func (t *embedTokens) verify(token string) (embedtoken.Claims, error) {
+	return embedtoken.Verify(t.key.Public().(ed25519.PublicKey), token, time.Now())
+}
+
+// createEmbedToken exchanges the caller's credentials for a token that opens
+// the terminal or noVNC desktop of one VM until it expires, so that a page
+// embedding it in another site never holds an API key.
+func (s *restServer) createEmbedToken(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "createEmbedToken")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	if s.embedTokens == nil {
+		sendErrorResponse(
+			w,
+			http.StatusNotFound,
+			"Embed tokens are disabled, set embed_tokens.private_key_file")
+		return
+	}
+
+	var req serverapi.VmEmbedTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+	scope := req.GetScope()
+	if scope != embedtoken.ScopeTerminal && scope != embedtoken.ScopeVNC {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("scope must be %q or %q", embedtoken.ScopeTerminal, embedtoken.ScopeVNC))
+		return
+	}
+	ttl := s.embedTokens.ttl
+	if req.GetTtlSeconds() < 0 {
+		sendErrorResponse(w, http.StatusBadRequest, "ttlSeconds must not be negative")
+		return
+	} else if req.GetTtlSeconds() > 0 {
+		ttl = time.Duration(req.GetTtlSeconds()) * time.Second
+	}
+	if ttl > s.embedTokens.maxTTL {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("ttlSeconds must be at most %d", int(s.embedTokens.maxTTL.Seconds())))
+		return
+	}
+
+	vm, err := s.vmServer.ListVM(r.Context(), vmName)
+	if err == nil {
+		// Not yet created if still queued or booting, or deleted.
+		if _, ok := s.vmServer.LiveVMName(vm.GetVmId()); !ok {
+			err = status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+		}
+	}
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get VM")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(w, statusCode, fmt.Sprintf("Failed to get VM: %v", err))
+		return
+	}
+	if _, err := tenantOwner(r, vm.GetOwner()); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Warn("Owner not allowed")
+		sendErrorResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	ip, _, _ := strings.Cut(vm.GetIp(), "/")
+	expiresAt := time.Now().Add(ttl)
+	claims := embedtoken.Claims{
+		Scope:  scope,
+		VMID:   vm.GetVmId(),
+		IP:     ip,
+		Expiry: expiresAt.Unix(),
+	}
+	token, err := embedtoken.Issue(s.embedTokens.key, claims)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to issue embed token")
+		sendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Failed to issue embed token: %v", err))
+		return
+	}
+	logger.WithFields(log.Fields{"vmName": vmName, "scope": scope, "ttl": ttl}).Info("Issued embed token")
+
+	resp := serverapi.VmEmbedTokenResponse{
+		Token:     serverapi.PtrString(token),
+		Scope:     serverapi.PtrString(scope),
+		ExpiresAt: serverapi.PtrTime(time.Unix(claims.Expiry, 0).UTC()),
+	}
+	if scope == embedtoken.ScopeTerminal {
+		resp.Url = serverapi.PtrString("/vm/" + url.PathEscape(vm.GetVmName()) + "/terminal?" +
+			url.Values{embedtoken.QueryParam: {token}}.Encode())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// embeddedRequest reports whether r opens the terminal of a VM, its page or
+// its PTY WebSocket, with an embed token issued for that VM. Such requests
+// skip the listeners' authentication.
+func (s *restServer) embeddedRequest(r *http.Request) bool {
+	if s.embedTokens == nil || r.Method != http.MethodGet {
+		return false
+	}
+	var vmName string
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "vm" && parts[2] == "terminal":
+		vmName = parts[1]
+	case len(parts) == 4 && parts[0] == API_VERSION && parts[1] == "vms" && parts[3] == "cmd" &&
+		r.URL.Query().Get("tty") == "true":
+		vmName = parts[2]
+	default:
+		return false
+	}
+	token := embedtoken.FromRequest(r)
+	if token == "" {
+		return false
+	}
+	claims, err := s.embedTokens.verify(token)
+	if err != nil {
+		log.Warnf("Rejected embed token from %s for %s: %v", r.RemoteAddr, r.URL.Path, err)
+		return false
+	}
+	if claims.Scope != embedtoken.ScopeTerminal {
+		return false
+	}
+	// Matched by ID, so that a VM destroyed and recreated under the same
+	// name doesn't match.
+	name, ok := s.vmServer.LiveVMName(claims.VMID)
+	return ok && s.vmServer.ResolveVMName(vmName) == name
+}
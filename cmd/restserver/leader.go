@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/leader"
+)
+
+// handoff serves a handler that can be swapped while serving, e.g. the API
+// once a standby is promoted.
+type handoff struct {
+	handler atomic.Pointer[http.Handler]
+	// embedded is the API's check of embed tokens, nil while standing by.
+	embedded atomic.Pointer[func(*http.Request) bool]
+}
+
+func (h *handoff) set(handler http.Handler) {
+	h.handler.Store(&handler)
+}
+
+func (h *handoff) setEmbedded(embedded func(*http.Request) bool) {
+	h.embedded.Store(&embedded)
+}
+
+// embeddedRequest lets the listeners pass the requests carrying an embed
+// token the API accepts, see listener.Set.AllowEmbedded.
+func (h *handoff) embeddedRequest(r *http.Request) bool {
+	embedded := h.embedded.Load()
+	return embedded != nil && (*embedded)(r)
+}
+
+func (h *handoff) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*h.handler.Load()).ServeHTTP(w, r)
+}
+
+// standbyHandler serves a standby of an active/standby pair. Its health check
+// fails so that load balancers send calls to the leader, and calls that
+// reach it anyway are redirected to the leader.
+func standbyHandler(elector *leader.Elector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lease, err := elector.Current()
+		held := err == nil && lease.Held(time.Now())
+		if r.URL.Path == "/"+API_VERSION+"/health" {
+			response := map[string]interface{}{
+				"status":    "standby",
+				"timestamp": time.Now().UTC().Format(time.RFC3339),
+			}
+			if held {
+				response["leader"] = lease.Holder
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if held && lease.URL != "" {
+			http.Redirect(w, r, strings.TrimSuffix(lease.URL, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		sendErrorResponse(w, http.StatusServiceUnavailable, "This server is a standby and no leader is known, retry later")
+	})
+}
@@ -2,28 +2,65 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/apiv2"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
 	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/leader"
+	"github.com/abshkbh/arrakis/pkg/listener"
+	"github.com/abshkbh/arrakis/pkg/metrics"
+	"github.com/abshkbh/arrakis/pkg/oidc"
+	"github.com/abshkbh/arrakis/pkg/ratelimit"
+	"github.com/abshkbh/arrakis/pkg/redact"
+	"github.com/abshkbh/arrakis/pkg/relay"
+	"github.com/abshkbh/arrakis/pkg/reqtrace"
+	"github.com/abshkbh/arrakis/pkg/sdnotify"
+	"github.com/abshkbh/arrakis/pkg/secheaders"
 	"github.com/abshkbh/arrakis/pkg/server"
+	"github.com/abshkbh/arrakis/pkg/server/bootprogress"
+	"github.com/abshkbh/arrakis/pkg/server/recordings"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+	"github.com/abshkbh/arrakis/pkg/server/usage"
+	"github.com/abshkbh/arrakis/pkg/version"
 )
 
 const (
 	API_VERSION = "v1"
+	// How long `POST /v1/vms?wait=ready` waits by default.
+	defaultReadyTimeout = 60 * time.Second
+	// Bounds how long `GET /v1/vms?since=<revision>&wait=<duration>` waits
+	// for a change, and how often the listing is checked meanwhile.
+	maxListWait          = 5 * time.Minute
+	listWaitPollInterval = 250 * time.Millisecond
 )
 
+// Clients of the REST API are not browsers running on its origin, so WebSocket
+// upgrades are accepted from any origin like every other request.
+var ptyUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
 // sendErrorResponse sends a standardized error response to the client.
 func sendErrorResponse(w http.ResponseWriter, statusCode int, message string) {
 	resp := serverapi.ErrorResponse{
@@ -36,8 +73,150 @@ func sendErrorResponse(w http.ResponseWriter, statusCode int, message string) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// errorCodeHostCordoned is the code of the errors of VM creations refused by
+// a cordoned host.
+const errorCodeHostCordoned = "host_cordoned"
+
+// sendCordonedResponse answers a VM creation refused by a cordoned host with a
+// 503 carrying the cordon's reason, so that clients, e.g. of several hosts,
+// can create the VM elsewhere. It reports whether err was such a refusal.
+func sendCordonedResponse(w http.ResponseWriter, err error) bool {
+	var cordoned *server.CordonedError
+	if !errors.As(err, &cordoned) {
+		return false
+	}
+	message := err.Error()
+	resp := serverapi.ErrorResponse{
+		Error: &serverapi.ErrorResponseError{
+			Message: &message,
+			Code:    serverapi.PtrString(errorCodeHostCordoned),
+			Reason:  serverapi.PtrString(cordoned.Reason),
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(resp)
+	return true
+}
+
 type restServer struct {
 	vmServer *server.Server
+	requests *reqtrace.Recorder
+	// Limits of VM creations, snapshots and commands.
+	createLimit   *ratelimit.Limiter
+	snapshotLimit *ratelimit.Limiter
+	execLimit     *ratelimit.Limiter
+	// ptySessions counts the terminal sessions being relayed.
+	ptySessions atomic.Int64
+	// embedAllowedOrigins may embed the terminal page.
+	embedAllowedOrigins []string
+	// embedTokens issues the tokens that open a VM's terminal or desktop in
+	// those pages, nil if disabled.
+	embedTokens *embedTokens
+}
+
+// v2Options are the routes that v2 of the API serves differently from v1.
+var v2Options = apiv2.Options{
+	Async: []apiv2.Route{
+		{Method: http.MethodPost, Path: "/vms"},
+		{Method: http.MethodPost, Path: "/vms/*/snapshots"},
+	},
+	Lists: []apiv2.List{
+		{Path: "/vms", Field: "vms", Key: "vmId", Unless: "since"},
+		{Path: "/operations", Field: "operations", Key: "id"},
+		{Path: "/recordings", Field: "recordings", Key: "key"},
+	},
+	ByID: []apiv2.Collection{
+		{Path: "/vms", Static: []string{"adopt", "import"}},
+	},
+}
+
+// resolveVMIDs lets every route that takes a VM's name take its ID as well,
+// by rewriting the ID to the VM's current name before the handler runs. VMs
+// of other tenants are not found for callers authenticated with OIDC, unless
+// they are admins.
+func (s *restServer) resolveVMIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := oidc.FromContext(r.Context())
+		for _, key := range []string{"name", "vm"} {
+			if nameOrID, ok := vars[key]; ok {
+				vars[key] = s.vmServer.ResolveVMName(nameOrID)
+				if id == nil || id.Admin {
+					continue
+				}
+				if owner, ok := s.vmServer.VMOwner(vars[key]); ok && owner != id.Tenant {
+					sendErrorResponse(
+						w,
+						http.StatusNotFound,
+						fmt.Sprintf("vm not found: %s", nameOrID))
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, mux.SetURLVars(r, vars))
+	})
+}
+
+// requireTenant rejects callers authenticated with OIDC that are neither
+// admins nor in a tenant, as their token doesn't say what they may reach.
+func requireTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := oidc.FromContext(r.Context()); id != nil && !id.Admin && id.Tenant == "" {
+			sendErrorResponse(
+				w,
+				http.StatusForbidden,
+				"Token carries no tenant")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminOnly rejects callers authenticated with OIDC that aren't admins, for
+// routes acting on the whole host or on every tenant.
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id := oidc.FromContext(r.Context()); id != nil && !id.Admin {
+			sendErrorResponse(
+				w,
+				http.StatusForbidden,
+				"Only admins may call this")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// callerTenant returns the tenant a caller authenticated with OIDC is
+// confined to, "" for admins and callers authenticated otherwise, who see
+// every tenant.
+func callerTenant(r *http.Request) string {
+	id := oidc.FromContext(r.Context())
+	if id == nil || id.Admin {
+		return ""
+	}
+	return id.Tenant
+}
+
+// rateLimited rejects the calls to handler over limit with 429 and a
+// Retry-After header. Calls authenticated with OIDC are also limited per
+// tenant.
+func rateLimited(limit *ratelimit.Limiter, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var tenant string
+		if id := oidc.FromContext(r.Context()); id != nil {
+			tenant = id.Tenant
+		}
+		release, retryAfter, ok := limit.Acquire(tenant)
+		if !ok {
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(retryAfter))
+			sendErrorResponse(w, http.StatusTooManyRequests, "Too many requests, retry later")
+			return
+		}
+		defer release()
+		handler(w, r)
+	}
 }
 
 // Health check endpoint for load balancer monitoring
@@ -76,17 +255,157 @@ func (s *restServer) startVM(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if owner, err := tenantOwner(r, req.GetOwner()); err != nil {
+		logger.WithError(err).Warn("Owner not allowed")
+		sendErrorResponse(
+			w,
+			http.StatusForbidden,
+			err.Error())
+		return
+	} else if owner != "" {
+		req.SetOwner(owner)
+	}
+
+	// With `dryRun=true` the request is only validated, and the spec that
+	// would be launched is returned.
+	if r.URL.Query().Get("dryRun") == "true" {
+		resp, err := s.vmServer.DryRunVM(r.Context(), &req)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to validate VM")
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Failed to validate VM: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	// With `wait=ready` the response is only sent once the guest agent and
+	// the services the image declares are healthy, for at most `timeout`
+	// after the VM has booted.
+	wait := r.URL.Query().Get("wait")
+	if wait != "" && wait != "ready" {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid wait %q, only \"ready\" is supported", wait))
+		return
+	}
+	readyTimeout := defaultReadyTimeout
+	if timeout := r.URL.Query().Get("timeout"); timeout != "" {
+		var err error
+		readyTimeout, err = time.ParseDuration(timeout)
+		if err != nil || readyTimeout <= 0 {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid timeout %q", timeout))
+			return
+		}
+	}
+
+	// With `queue=true` the VM waits for admission instead of being rejected
+	// when the host is at its overcommit limit.
+	queue := r.URL.Query().Get("queue") == "true"
+	if queue && wait != "" {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"wait can't be combined with queue")
+		return
+	}
+	if req.GetCallbackUrl() != "" && !queue {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"callbackUrl is only supported with queue=true")
+		return
+	}
+
+	// With `async=true` the response is an operation to poll at
+	// /v1/operations/{id} rather than the started VM.
+	if r.URL.Query().Get("async") == "true" {
+		if queue {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				"async can't be combined with queue")
+			return
+		}
+		if wait != "ready" {
+			readyTimeout = 0
+		}
+		if err := s.vmServer.CheckCordon(s.vmServer.ResolveVMName(req.GetVmName())); err != nil {
+			logger.WithField("vmName", req.GetVmName()).WithError(err).Warn("VM refused")
+			sendCordonedResponse(w, err)
+			return
+		}
+		writeOperation(w, s.vmServer.StartVMAsync(r.Context(), &req, readyTimeout))
+		return
+	}
+
 	vmName := req.GetVmName()
-	resp, err := s.vmServer.StartVM(r.Context(), &req)
+	var resp *serverapi.StartVMResponse
+	var err error
+	if queue {
+		resp, err = s.vmServer.QueueVM(r.Context(), &req)
+	} else {
+		resp, err = s.vmServer.StartVM(r.Context(), &req)
+	}
 	if err != nil {
 		logger.WithField("vmName", vmName).WithError(err).Error("Failed to start VM")
+		if sendCordonedResponse(w, err) {
+			return
+		}
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.ResourceExhausted:
+			statusCode = http.StatusTooManyRequests
+		case codes.AlreadyExists, codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			statusCode,
 			fmt.Sprintf("Failed to start VM: %v", err))
 		return
 	}
 
+	if queue {
+		logger.WithFields(log.Fields{
+			"vmName":   vmName,
+			"position": resp.GetQueuePosition(),
+		}).Info("VM queued")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if wait == "ready" {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		services, err := s.vmServer.WaitVMReady(ctx, vmName)
+		cancel()
+		if err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("VM did not become ready")
+			statusCode := http.StatusInternalServerError
+			if status.Code(err) == codes.DeadlineExceeded {
+				statusCode = http.StatusGatewayTimeout
+			}
+			sendErrorResponse(
+				w,
+				statusCode,
+				fmt.Sprintf("VM started but is not ready: %v", err))
+			return
+		}
+		resp.Services = services
+	}
+
 	elapsedTime := time.Since(startTime)
 	logger.WithFields(log.Fields{
 		"vmName":      vmName,
@@ -106,12 +425,24 @@ func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
 		VmName: &vmName,
 	}
 
-	resp, err := s.vmServer.DestroyVM(r.Context(), &req)
+	// With `purge=true` the VM isn't kept to be undeleted, and a deleted VM
+	// is purged right away.
+	var resp *serverapi.VMResponse
+	var err error
+	if r.URL.Query().Get("purge") == "true" {
+		resp, err = s.vmServer.PurgeVM(r.Context(), vmName)
+	} else {
+		resp, err = s.vmServer.DestroyVM(r.Context(), &req)
+	}
 	if err != nil {
 		logger.WithField("vmName", vmName).WithError(err).Error("Failed to destroy VM")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			statusCode,
 			fmt.Sprintf("Failed to destroy VM: %v", err))
 		return
 	}
@@ -120,6 +451,82 @@ func (s *restServer) destroyVM(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+func (s *restServer) undeleteVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "undeleteVM")
+	vmName := mux.Vars(r)["name"]
+	resp, err := s.vmServer.UndeleteVM(r.Context(), vmName, callerTenant(r))
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to undelete VM")
+		if sendCordonedResponse(w, err) {
+			return
+		}
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.AlreadyExists, codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		case codes.ResourceExhausted:
+			statusCode = http.StatusTooManyRequests
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to undelete VM: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) adoptVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "adoptVM")
+
+	var req serverapi.AdoptVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	if owner, err := tenantOwner(r, req.GetOwner()); err != nil {
+		logger.WithError(err).Warn("Owner not allowed")
+		sendErrorResponse(
+			w,
+			http.StatusForbidden,
+			err.Error())
+		return
+	} else if owner != "" {
+		req.SetOwner(owner)
+	}
+
+	resp, err := s.vmServer.AdoptVM(r.Context(), &req)
+	if err != nil {
+		logger.WithField("vmName", req.GetVmName()).WithError(err).Error("Failed to adopt VM")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.AlreadyExists, codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to adopt VM: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "destroyAllVMs")
 	resp, err := s.vmServer.DestroyAllVMs(r.Context())
@@ -136,22 +543,96 @@ func (s *restServer) destroyAllVMs(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// listAllVMs lists the VMs, or with ?since=<revision> only the changes after
+// an earlier listing, of the caller's tenant for callers authenticated with
+// OIDC unless they are admins. The listing's revision is its ETag, so that pollers
+// sending If-None-Match get a 304 while nothing changes. With
+// &wait=<duration> as well, the response is held until something changed
+// after since or the wait is over, so that subscribers long-poll for changes.
 func (s *restServer) listAllVMs(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "listAllVMs")
-	resp, err := s.vmServer.ListAllVMs(r.Context())
+	since := r.URL.Query().Get("since")
+	var wait time.Duration
+	if waitParam := r.URL.Query().Get("wait"); waitParam != "" {
+		var err error
+		wait, err = time.ParseDuration(waitParam)
+		if err != nil || wait <= 0 || wait > maxListWait || since == "" {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid wait %q, it needs since and must be at most %s", waitParam, maxListWait))
+			return
+		}
+	}
+
+	var resp *serverapi.ListAllVMsResponse
+	var err error
+	if since != "" {
+		resp, err = s.vmServer.ListVMChanges(r.Context(), since)
+		if wait > 0 {
+			deadline := time.NewTimer(wait)
+			defer deadline.Stop()
+			ticker := time.NewTicker(listWaitPollInterval)
+			defer ticker.Stop()
+		waiting:
+			for err == nil && resp.GetRevision() == since {
+				select {
+				case <-ticker.C:
+					resp, err = s.vmServer.ListVMChanges(r.Context(), since)
+				case <-deadline.C:
+					break waiting
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+	} else {
+		resp, err = s.vmServer.ListAllVMs(r.Context())
+	}
 	if err != nil {
 		logger.WithError(err).Error("Failed to list all VMs")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.InvalidArgument {
+			statusCode = http.StatusBadRequest
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			statusCode,
 			fmt.Sprintf("Failed to list all VMs: %v", err))
 		return
 	}
 
+	if tenant := callerTenant(r); tenant != "" {
+		vms := []serverapi.ListAllVMsResponseVmsInner{}
+		for _, vm := range resp.Vms {
+			if vm.GetOwner() == tenant {
+				vms = append(vms, vm)
+			}
+		}
+		resp.Vms = vms
+	}
+
+	etag := `"` + resp.GetRevision() + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// etagMatches reports whether an If-None-Match header lists etag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *restServer) listVM(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "listVM")
 	vars := mux.Vars(r)
@@ -187,6 +668,24 @@ func (s *restServer) snapshotVM(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Get("async") == "true" {
+		op, err := s.vmServer.SnapshotVMAsync(r.Context(), vmName, req.SnapshotId)
+		if err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("Failed to start snapshot")
+			statusCode := http.StatusInternalServerError
+			if status.Code(err) == codes.NotFound {
+				statusCode = http.StatusNotFound
+			}
+			sendErrorResponse(
+				w,
+				statusCode,
+				fmt.Sprintf("Failed to create snapshot: %v", err))
+			return
+		}
+		writeOperation(w, op)
+		return
+	}
+
 	resp, err := s.vmServer.SnapshotVM(r.Context(), vmName, req.SnapshotId)
 	if err != nil {
 		logger.WithFields(log.Fields{
@@ -219,6 +718,11 @@ func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.GetName() != "" || req.GetOwner() != "" {
+		s.updateVM(w, r, vmName, req)
+		return
+	}
+
 	status := req.GetStatus()
 	if status != "stopped" && status != "paused" && status != "resume" {
 		logger.WithFields(log.Fields{
@@ -236,9 +740,19 @@ func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
 		VmName: &vmName,
 	}
 
+	if req.GetGraceful() && status != "stopped" {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"graceful is only supported when stopping a VM")
+		return
+	}
+
 	var resp *serverapi.VMResponse
 	var err error
-	if status == "stopped" {
+	if status == "stopped" && req.GetGraceful() {
+		resp, err = s.vmServer.StopVMGracefully(r.Context(), vmName)
+	} else if status == "stopped" {
 		resp, err = s.vmServer.StopVM(r.Context(), &vmReq)
 	} else if status == "paused" {
 		resp, err = s.vmServer.PauseVM(r.Context(), &vmReq)
@@ -262,6 +776,79 @@ func (s *restServer) updateVMState(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// tenantOwner returns the owner a request may create or transfer a VM to. For
+// callers authenticated with OIDC it defaults to their tenant, and only admins
+// may pick another one, and those in no tenant none. Other callers may pick
+// any owner.
+func tenantOwner(r *http.Request, owner string) (string, error) {
+	id := oidc.FromContext(r.Context())
+	if id == nil || id.Admin {
+		return owner, nil
+	}
+	if id.Tenant == "" {
+		return "", fmt.Errorf("caller %q is in no tenant", id.Subject)
+	}
+	if owner == "" {
+		return id.Tenant, nil
+	}
+	if owner != id.Tenant {
+		return "", fmt.Errorf("tenant %q can't act on behalf of owner %q", id.Tenant, owner)
+	}
+	return owner, nil
+}
+
+// updateVM handles the rename and owner transfer form of PATCH, which can't
+// be combined with a state change.
+func (s *restServer) updateVM(w http.ResponseWriter, r *http.Request, vmName string, req serverapi.V1VmsNamePatchRequest) {
+	logger := log.WithFields(log.Fields{
+		"api":     "updateVM",
+		"vmName":  vmName,
+		"newName": req.GetName(),
+		"owner":   req.GetOwner(),
+	})
+
+	if req.GetStatus() != "" || req.GetGraceful() {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"name and owner can't be changed together with the VM's status")
+		return
+	}
+
+	if req.GetOwner() != "" {
+		if _, err := tenantOwner(r, req.GetOwner()); err != nil {
+			logger.WithError(err).Warn("Owner not allowed")
+			sendErrorResponse(
+				w,
+				http.StatusForbidden,
+				err.Error())
+			return
+		}
+	}
+
+	resp, err := s.vmServer.UpdateVM(r.Context(), vmName, req.GetName(), req.GetOwner())
+	if err != nil {
+		logger.WithError(err).Error("Failed to update VM")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.AlreadyExists:
+			statusCode = http.StatusConflict
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to update VM: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "vmCommand")
 	vars := mux.Vars(r)
@@ -286,6 +873,14 @@ func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.GetTty() {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"Interactive sessions require a WebSocket: GET this path with tty=true")
+		return
+	}
+
 	cmd := req.GetCmd()
 	// Default to blocking if not specified
 	blocking := true
@@ -293,7 +888,24 @@ func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
 		blocking = *req.Blocking
 	}
 
-	resp, err := s.vmServer.VMCommand(r.Context(), vmName, cmd, blocking)
+	var limits cmdserver.ExecLimits
+	if l := req.Limits; l != nil {
+		limits = cmdserver.ExecLimits{
+			CPUSeconds:     l.GetCpuSeconds(),
+			MemoryMB:       l.GetMemoryMb(),
+			MaxProcesses:   l.GetMaxProcesses(),
+			MaxOutputBytes: l.GetMaxOutputBytes(),
+		}
+	}
+	if err := limits.Validate(); err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			err.Error())
+		return
+	}
+
+	resp, err := s.vmServer.VMCommand(r.Context(), vmName, cmd, blocking, limits)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			"vmName":   vmName,
@@ -301,9 +913,13 @@ func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
 			"blocking": blocking,
 			"success":  false,
 		}).Error("Failed to execute command")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.InvalidArgument {
+			statusCode = http.StatusBadRequest
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			statusCode,
 			fmt.Sprintf("Failed to execute command: %v", err))
 		return
 	}
@@ -318,6 +934,72 @@ func (s *restServer) vmCommand(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// vmPTY upgrades a GET on the exec endpoint with `tty=true` to a WebSocket
+// and relays it to a PTY session in the VM.
+func (s *restServer) vmPTY(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmPTY")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	query := r.URL.Query()
+
+	var size [2]uint16
+	for i, param := range []string{"rows", "cols"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid %s: %v", param, err))
+			return
+		}
+		size[i] = uint16(n)
+	}
+
+	cmd := query.Get("cmd")
+	guestConn, err := s.vmServer.VMPTY(r.Context(), vmName, cmd, size[0], size[1])
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to open pty session")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.FailedPrecondition:
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to open pty session: %v", err))
+		return
+	}
+	defer guestConn.Close()
+
+	clientConn, err := ptyUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to upgrade connection")
+		return
+	}
+	defer clientConn.Close()
+
+	logger.WithFields(log.Fields{
+		"vmName": vmName,
+		"cmd":    cmd,
+	}).Info("Pty session started")
+	s.ptySessions.Add(1)
+	defer s.ptySessions.Add(-1)
+	relay.WebSockets(clientConn, guestConn, nil)
+	// The guest's close, sent after the exit message, is not relayed.
+	clientConn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	logger.WithField("vmName", vmName).Info("Pty session ended")
+}
+
 func (s *restServer) vmFileUpload(w http.ResponseWriter, r *http.Request) {
 	logger := log.WithField("api", "vmFileUpload")
 	vars := mux.Vars(r)
@@ -349,9 +1031,16 @@ func (s *restServer) vmFileUpload(w http.ResponseWriter, r *http.Request) {
 			"vmName":    vmName,
 			"fileCount": len(files),
 		}).WithError(err).Error("Failed to upload files")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.PermissionDenied:
+			statusCode = http.StatusForbidden
+		}
 		sendErrorResponse(
 			w,
-			http.StatusInternalServerError,
+			statusCode,
 			fmt.Sprintf("Failed to upload files: %v", err))
 		return
 	}
@@ -392,92 +1081,1750 @@ func (s *restServer) vmFileDownload(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func main() {
-	var serverConfig *config.ServerConfig
-	var configFile string
-
-	app := &cli.App{
-		Name:  "arrakis-restserver",
-		Usage: "A daemon for spawning and managing cloud-hypervisor based microVMs.",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:        "config",
-				Aliases:     []string{"c"},
-				Usage:       "Path to config file",
-				Destination: &configFile,
-				Value:       "./config.yaml",
-			},
-		},
-		Action: func(ctx *cli.Context) error {
-			var err error
-			serverConfig, err = config.GetServerConfig(configFile)
-			if err != nil {
-				return fmt.Errorf("server config not found: %v", err)
-			}
-			log.Infof("server config: %v", serverConfig)
-			return nil
-		},
-	}
+func (s *restServer) vmAgentUpdate(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmAgentUpdate")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
 
-	err := app.Run(os.Args)
-	if err != nil {
-		log.WithError(err).Fatal("server exited with error")
-	}
+	var req serverapi.VmAgentUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	binary, err := base64.StdEncoding.DecodeString(req.GetBinary())
+	if err != nil || len(binary) == 0 || req.GetVersion() == "" || req.GetSignature() == "" {
+		logger.WithField("vmName", vmName).Error("Missing or invalid binary, version or signature")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"A base64 encoded binary, its version and its signature are required")
+		return
+	}
+
+	resp, err := s.vmServer.UpdateAgent(r.Context(), vmName, req.GetAgent(), req.GetVersion(), binary, req.GetSignature())
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"agent":  req.GetAgent(),
+		}).WithError(err).Error("Failed to update agent")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to update agent: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmCapabilities(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmCapabilities")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.VMCapabilities(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list capabilities")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to list capabilities: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmServices(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmServices")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.VMServices(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get services")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get services: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// vmBootEvents streams the boot phases of a VM as server-sent events, starting
+// with those already reached, until the boot completes or fails.
+func (s *restServer) vmBootEvents(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmBootEvents")
+	vmName := mux.Vars(r)["name"]
+
+	past, events, stop, err := s.vmServer.BootEvents(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get boot events")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get boot events: %v", err))
+		return
+	}
+	defer stop()
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(event bootprogress.Event) {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: boot\ndata: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	for _, event := range past {
+		send(event)
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			send(event)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// vmEvents lists the events workloads in a VM reported after the "after"
+// sequence number or, with follow=true, streams them as server-sent events
+// named "guest" as they are reported. A reconnecting stream resumes after
+// its Last-Event-ID.
+func (s *restServer) vmEvents(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmEvents")
+	vmName := mux.Vars(r)["name"]
+
+	after := r.URL.Query().Get("after")
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		after = lastID
+	}
+	var seq uint64
+	if after != "" {
+		var err error
+		if seq, err = strconv.ParseUint(after, 10, 64); err != nil {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid after: %v", err))
+			return
+		}
+	}
+
+	if r.URL.Query().Get("follow") != "true" {
+		resp, err := s.vmServer.VMEvents(r.Context(), vmName, seq)
+		if err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("Failed to get guest events")
+			statusCode := http.StatusInternalServerError
+			if status.Code(err) == codes.NotFound {
+				statusCode = http.StatusNotFound
+			}
+			sendErrorResponse(
+				w,
+				statusCode,
+				fmt.Sprintf("Failed to get guest events: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	events, err := s.vmServer.FollowVMEvents(r.Context(), vmName, seq)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to follow guest events")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to follow guest events: %v", err))
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for event := range events {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "id: %d\nevent: guest\ndata: %s\n\n", event.Seq, data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// thumbnails streams downscaled screenshots of the running VMs, or those of
+// the comma-separated vm parameter, every interval: as JSON messages over a
+// WebSocket, or as an MJPEG stream, a multipart/x-mixed-replace of JPEGs
+// naming their VM in an X-Arrakis-Vm header, that an <img> can show. Failed
+// captures are only sent over WebSockets.
+func (s *restServer) thumbnails(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "thumbnails")
+	params := r.URL.Query()
+
+	opts := server.ThumbnailOptions{Source: params.Get("source"), Owner: callerTenant(r)}
+	if vms := params.Get("vm"); vms != "" {
+		opts.VMs = strings.Split(vms, ",")
+	}
+	if width := params.Get("width"); width != "" {
+		var err error
+		if opts.Width, err = strconv.Atoi(width); err != nil || opts.Width <= 0 {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid width: %s", width))
+			return
+		}
+	}
+	if interval := params.Get("interval"); interval != "" {
+		var err error
+		if opts.Interval, err = time.ParseDuration(interval); err != nil || opts.Interval <= 0 {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid interval: %s", interval))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	thumbnails, err := s.vmServer.StreamThumbnails(ctx, opts)
+	if err != nil {
+		logger.WithError(err).Error("Failed to stream thumbnails")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to stream thumbnails: %v", err))
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := ptyUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.WithError(err).Error("Failed to upgrade to WebSocket")
+			return
+		}
+		defer conn.Close()
+		// The stream ends once the client goes away, which only a read
+		// notices on a hijacked connection.
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		for thumb := range thumbnails {
+			if err := conn.WriteJSON(thumb); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	const boundary = "arrakis-thumbnail"
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for thumb := range thumbnails {
+		if thumb.Error != "" {
+			continue
+		}
+		fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\nX-Arrakis-Vm: %s\r\n\r\n", boundary, len(thumb.JPEG), thumb.VMName)
+		if _, err := w.Write(append(thumb.JPEG, "\r\n"...)); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// vmTimeline lists what happened to a VM in chronological order, optionally
+// only entries of the comma-separated kinds, between from and to, or the
+// latest limit of them.
+func (s *restServer) vmTimeline(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmTimeline")
+	vmName := mux.Vars(r)["name"]
+	params := r.URL.Query()
+
+	var filter timeline.Filter
+	if kinds := params.Get("kind"); kinds != "" {
+		filter.Kinds = strings.Split(kinds, ",")
+	}
+	var err error
+	if filter.Since, err = parseUsageTime(params.Get("from")); err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid from: %v", err))
+		return
+	}
+	if filter.Until, err = parseUsageTime(params.Get("to")); err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid to: %v", err))
+		return
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid limit: %s", limit))
+			return
+		}
+	}
+
+	resp, err := s.vmServer.VMTimeline(r.Context(), vmName, filter)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get VM timeline")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get VM timeline: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmExposure(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmExposure")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.VMExposure(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get exposure")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get exposure: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmSpec(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmSpec")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.VMSpec(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get spec")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get spec: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) searchVMDisk(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "searchVMDisk")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	query := r.URL.Query()
+
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid limit: %v", err))
+			return
+		}
+		limit = n
+	}
+
+	resp, err := s.vmServer.SearchVMDisk(r.Context(), vmName, query.Get("glob"), limit)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to search disk")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to search disk: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) seedBrowserProfile(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "seedBrowserProfile")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	if r.ContentLength < 0 {
+		sendErrorResponse(
+			w,
+			http.StatusLengthRequired,
+			"The size of the zipped profile must be given as Content-Length")
+		return
+	}
+
+	resp, err := s.vmServer.SeedBrowserProfile(r.Context(), vmName, r.Body, r.ContentLength)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to seed browser profile")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.PermissionDenied:
+			statusCode = http.StatusForbidden
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to seed browser profile: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) restartBrowser(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "restartBrowser")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	// The body is optional.
+	var req serverapi.VmBrowserRestartRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+	}
+
+	if err := s.vmServer.RestartBrowser(r.Context(), vmName, req.GetBrowser()); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to restart browser")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to restart browser: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *restServer) openURL(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "openURL")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req cmdserver.OpenURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if err := s.vmServer.OpenURL(r.Context(), vmName, req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to open url")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to open url: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *restServer) vmClipboard(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmClipboard")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var display *int
+	if v := r.URL.Query().Get("display"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid display: %q", v))
+			return
+		}
+		display = &n
+	}
+
+	resp, err := s.vmServer.Clipboard(r.Context(), vmName, display)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to read clipboard")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to read clipboard: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) setVMClipboard(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "setVMClipboard")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req cmdserver.ClipboardContent
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if err := s.vmServer.SetClipboard(r.Context(), vmName, req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to write clipboard")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to write clipboard: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *restServer) resetVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "resetVM")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	// The body is optional.
+	var req serverapi.VmResetRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+	}
+
+	resp, err := s.vmServer.ResetVM(r.Context(), vmName, &req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to reset VM")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to reset VM: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmOCR(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmOCR")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	// The body is optional.
+	var req serverapi.VmOcrRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid request format: %v", err))
+			return
+		}
+	}
+
+	resp, err := s.vmServer.VMOCR(r.Context(), vmName, req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to extract text")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		case codes.Unimplemented:
+			statusCode = http.StatusNotImplemented
+		case codes.Unavailable:
+			statusCode = http.StatusBadGateway
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to extract text: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) snapshotDiff(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "snapshotDiff")
+	vars := mux.Vars(r)
+	snapshotID := vars["id"]
+	baseID := r.URL.Query().Get("base")
+
+	resp, err := s.vmServer.SnapshotDiff(r.Context(), snapshotID, baseID, callerTenant(r))
+	if err != nil {
+		logger.WithFields(log.Fields{"snapshotId": snapshotID, "base": baseID}).WithError(err).Error("Failed to diff snapshots")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to diff snapshots: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmNetwork(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmNetwork")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.VMNetwork(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get network")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get network: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) enableVMNetwork(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "enableVMNetwork")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	// The body is optional.
+	var req serverapi.VmNetworkEnableRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid request format: %v", err))
+			return
+		}
+	}
+
+	duration := time.Duration(req.GetDurationSeconds()) * time.Second
+	resp, err := s.vmServer.EnableVMNetwork(r.Context(), vmName, duration)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to enable network")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to enable network: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) disableVMNetwork(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "disableVMNetwork")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.DisableVMNetwork(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to disable network")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to disable network: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmDevices(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmDevices")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.VMDevices(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list devices")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to list devices: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) attachDevice(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "attachDevice")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req serverapi.VmDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.AttachDevice(r.Context(), vmName, req)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to attach device")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		case codes.ResourceExhausted:
+			statusCode = http.StatusTooManyRequests
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to attach device: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) detachDevice(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "detachDevice")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	deviceID := vars["id"]
+
+	if err := s.vmServer.DetachDevice(r.Context(), vmName, deviceID); err != nil {
+		logger.WithFields(log.Fields{"vmName": vmName, "device": deviceID}).WithError(err).Error("Failed to detach device")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to detach device: %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *restServer) vmObjectMounts(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmObjectMounts")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.VMObjectMounts(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get object mounts")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get object mounts: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmArtifacts(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmArtifacts")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.VMArtifacts(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to list artifacts")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to list artifacts: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) vmArtifact(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmArtifact")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	artifactPath := vars["path"]
+
+	resp, err := s.vmServer.VMArtifact(r.Context(), vmName, artifactPath)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"path":   artifactPath,
+		}).WithError(err).Error("Failed to get artifact")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.PermissionDenied:
+			statusCode = http.StatusForbidden
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get artifact: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range []string{"Content-Type", "Content-Length", "Last-Modified", "X-Arrakis-Scan"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Warn("Artifact download interrupted")
+	}
+}
+
+func (s *restServer) vmWorkDir(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmWorkDir")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	resp, err := s.vmServer.WorkDir(r.Context(), vmName)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get working directory")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get working directory: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) cleanVMArtifacts(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "cleanVMArtifacts")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	typ := r.URL.Query().Get("type")
+
+	resp, err := s.vmServer.CleanWorkDir(r.Context(), vmName, typ)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"vmName": vmName,
+			"type":   typ,
+		}).WithError(err).Error("Failed to clean working directory")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to clean working directory: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) exportVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "exportVM")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+	memory := r.URL.Query().Get("memory") == "true"
+
+	export, err := s.vmServer.ExportVM(r.Context(), vmName, memory)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to export VM")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to export VM: %v", err))
+		return
+	}
+	defer export.Close()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", export.Filename))
+	// The status is sent with the first byte, errors past it cut the
+	// download short, which the client sees as a truncated archive.
+	if err := export.WriteTo(w); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Warn("VM export interrupted")
+	}
+}
+
+func (s *restServer) importVM(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "importVM")
+	vmName := r.URL.Query().Get("name")
+
+	owner, err := tenantOwner(r, r.URL.Query().Get("owner"))
+	if err != nil {
+		logger.WithError(err).Warn("Owner not allowed")
+		sendErrorResponse(
+			w,
+			http.StatusForbidden,
+			err.Error())
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, s.vmServer.MaxImportSize())
+	resp, err := s.vmServer.ImportVM(r.Context(), body, vmName, owner)
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to import VM")
+		if sendCordonedResponse(w, err) {
+			return
+		}
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		case codes.AlreadyExists, codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		case codes.OutOfRange:
+			statusCode = http.StatusRequestEntityTooLarge
+		case codes.ResourceExhausted:
+			statusCode = http.StatusTooManyRequests
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to import VM: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) hostGC(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "hostGC")
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	resp, err := s.vmServer.CollectGarbage(r.Context(), dryRun)
+	if err != nil {
+		logger.WithError(err).Error("Failed to collect garbage")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to collect garbage: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// hostStatus adds the sessions relayed by the REST server to the server's
+// status.
+func (s *restServer) hostStatus() *serverapi.HostStatusResponse {
+	resp := s.vmServer.HostStatus()
+	resp.SetSessions(map[string]int32{"pty": int32(s.ptySessions.Load())})
+	return resp
+}
+
+func (s *restServer) getHostStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.hostStatus())
+}
+
+// getHostAutoscaling reports the host's utilization and admission queue,
+// whether they call for more or fewer hosts, and the latest recommendations.
+func (s *restServer) getHostAutoscaling(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.vmServer.Autoscaling())
+}
+
+func (s *restServer) getHostCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.vmServer.HostCapabilities(r.Context()))
+}
+
+// getVersion reports the server's version, the API versions it serves and
+// the optional features it has configured, for clients to negotiate with.
+func (s *restServer) getVersion(w http.ResponseWriter, r *http.Request) {
+	features := s.vmServer.Features()
+	features["embed_tokens"] = s.embedTokens != nil
+	resp := serverapi.VersionResponse{
+		Version:             serverapi.PtrString(version.Version),
+		ApiVersions:         apiv2.Versions,
+		PreferredApiVersion: serverapi.PtrString(apiv2.Versions[len(apiv2.Versions)-1]),
+	}
+	resp.SetFeatures(features)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) getHostCordon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.vmServer.HostCordon())
+}
+
+// cordonHost stops the host from accepting new VMs for maintenance, the VMs on
+// it keep running.
+func (s *restServer) cordonHost(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "cordonHost")
+
+	var req serverapi.HostCordonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		logger.WithError(err).Error("Invalid request body")
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request format: %v", err))
+		return
+	}
+
+	resp, err := s.vmServer.CordonHost(req.GetReason())
+	if err != nil {
+		logger.WithError(err).Error("Failed to cordon host")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to cordon host: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) uncordonHost(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "uncordonHost")
+
+	resp, err := s.vmServer.UncordonHost()
+	if err != nil {
+		logger.WithError(err).Error("Failed to uncordon host")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to uncordon host: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) getMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.Serve(w, append(server.HostMetrics(s.hostStatus()), s.vmServer.AutoscalingMetrics()...))
+}
+
+func (s *restServer) hostNetworkReconcile(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "hostNetworkReconcile")
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	resp, err := s.vmServer.ReconcileNetwork(r.Context(), dryRun)
+	if err != nil {
+		logger.WithError(err).Error("Failed to reconcile network")
+		sendErrorResponse(
+			w,
+			http.StatusInternalServerError,
+			fmt.Sprintf("Failed to reconcile network: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseUsageTime parses a `from` or `to` query parameter, which is either an
+// RFC 3339 timestamp or a date.
+func parseUsageTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// writeOperation responds to a request that started a background operation.
+func writeOperation(w http.ResponseWriter, op *serverapi.Operation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/"+API_VERSION+"/operations/"+op.GetId())
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(op)
+}
+
+func (s *restServer) getOperation(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "getOperation")
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.GetOperation(r.Context(), id, callerTenant(r))
+	if err != nil {
+		logger.WithField("operation", id).WithError(err).Error("Failed to get operation")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to get operation: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *restServer) listOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.vmServer.ListOperations(r.Context(), callerTenant(r)))
+}
+
+func (s *restServer) cancelOperation(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "cancelOperation")
+	id := mux.Vars(r)["id"]
+
+	resp, err := s.vmServer.CancelOperation(r.Context(), id, callerTenant(r))
+	if err != nil {
+		logger.WithField("operation", id).WithError(err).Error("Failed to cancel operation")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.FailedPrecondition:
+			statusCode = http.StatusConflict
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to cancel operation: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// slowRequests lists the most recent API calls that took longer than the
+// request log's slow threshold, with their timing breakdown.
+func (s *restServer) slowRequests(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Requests []reqtrace.Request `json:"requests"`
+	}{Requests: s.requests.Slow()})
+}
+
+// getRecordings lists the recordings, of the caller's tenant for callers
+// authenticated with OIDC unless they are admins.
+func (s *restServer) getRecordings(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	tenant, err := tenantOwner(r, params.Get("tenant"))
+	if err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusForbidden,
+			err.Error())
+		return
+	}
+
+	from, err := parseUsageTime(params.Get("from"))
+	if err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid from: %v", err))
+		return
+	}
+	to, err := parseUsageTime(params.Get("to"))
+	if err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid to: %v", err))
+		return
+	}
+
+	listing := s.vmServer.Recordings(r.Context(), recordings.Filter{
+		VM:    params.Get("vmName"),
+		Owner: tenant,
+		Kind:  params.Get("kind"),
+		Since: from,
+		Until: to,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+func (s *restServer) purgeRecordings(w http.ResponseWriter, r *http.Request) {
+	purged := s.vmServer.PurgeRecordings(r.Context(), time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(purged)
+}
+
+// auditStatusCode maps errors of the audit export to HTTP status codes.
+func auditStatusCode(err error) int {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *restServer) listAuditBatches(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "listAuditBatches")
+	tenant := r.URL.Query().Get("tenant")
+	var after uint64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			sendErrorResponse(
+				w,
+				http.StatusBadRequest,
+				fmt.Sprintf("Invalid after: %v", err))
+			return
+		}
+	}
+
+	listing, err := s.vmServer.AuditBatches(tenant, after)
+	if err != nil {
+		logger.WithField("tenant", tenant).WithError(err).Error("Failed to list audit batches")
+		sendErrorResponse(
+			w,
+			auditStatusCode(err),
+			fmt.Sprintf("Failed to list audit batches: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+// getAuditBatch serves a batch byte for byte as it was sealed, so that the
+// hash of its payload can be checked.
+func (s *restServer) getAuditBatch(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "getAuditBatch")
+	tenant := r.URL.Query().Get("tenant")
+	seq, err := strconv.ParseUint(mux.Vars(r)["seq"], 10, 64)
+	if err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid batch: %v", err))
+		return
+	}
+
+	batch, err := s.vmServer.AuditBatch(tenant, seq)
+	if err != nil {
+		logger.WithFields(log.Fields{"tenant": tenant, "seq": seq}).WithError(err).Error("Failed to read audit batch")
+		sendErrorResponse(
+			w,
+			auditStatusCode(err),
+			fmt.Sprintf("Failed to read audit batch: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(batch)
+}
+
+func (s *restServer) getAuditKey(w http.ResponseWriter, r *http.Request) {
+	key, err := s.vmServer.AuditKey()
+	if err != nil {
+		sendErrorResponse(
+			w,
+			auditStatusCode(err),
+			fmt.Sprintf("Failed to get audit key: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
+
+// getUsage reports the usage, of the caller's tenant for callers
+// authenticated with OIDC unless they are admins.
+func (s *restServer) getUsage(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "getUsage")
+	params := r.URL.Query()
+	tenant, err := tenantOwner(r, params.Get("tenant"))
+	if err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusForbidden,
+			err.Error())
+		return
+	}
+
+	from, err := parseUsageTime(params.Get("from"))
+	if err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid from: %v", err))
+		return
+	}
+	to, err := parseUsageTime(params.Get("to"))
+	if err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid to: %v", err))
+		return
+	}
+	if !to.IsZero() && !to.After(from) {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"to must be after from")
+		return
+	}
+
+	report := s.vmServer.Usage(r.Context(), usage.Query{
+		Tenant: tenant,
+		VM:     params.Get("vmName"),
+		From:   from,
+		To:     to,
+	})
+
+	switch params.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		if err := report.WriteCSV(w); err != nil {
+			logger.WithError(err).Warn("Usage export interrupted")
+		}
+	default:
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Unsupported format: %s", params.Get("format")))
+	}
+}
+
+func (s *restServer) vmSessions(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmSessions")
+	vars := mux.Vars(r)
+	vmName := vars["name"]
+
+	var req cmdserver.SessionReport
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if req.Seconds < 0 {
+		sendErrorResponse(
+			w,
+			http.StatusBadRequest,
+			"seconds must not be negative")
+		return
+	}
+
+	d := time.Duration(req.Seconds * float64(time.Second))
+	if err := s.vmServer.RecordSession(r.Context(), vmName, req.Kind, d); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to record session")
+		statusCode := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			statusCode = http.StatusNotFound
+		case codes.InvalidArgument:
+			statusCode = http.StatusBadRequest
+		}
+		sendErrorResponse(
+			w,
+			statusCode,
+			fmt.Sprintf("Failed to record session: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func main() {
+	var serverConfig *config.ServerConfig
+	var configFile string
+
+	app := &cli.App{
+		Name:  "arrakis-restserver",
+		Usage: "A daemon for spawning and managing cloud-hypervisor based microVMs.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "config",
+				Aliases:     []string{"c"},
+				Usage:       "Path to config file",
+				Destination: &configFile,
+				Value:       "./config.yaml",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			var err error
+			serverConfig, err = config.GetServerConfig(configFile)
+			if err != nil {
+				return fmt.Errorf("server config not found: %v", err)
+			}
+			if err := secheaders.ValidateOrigins(serverConfig.EmbedAllowedOrigins); err != nil {
+				return fmt.Errorf("embed_allowed_origins: %v", err)
+			}
+			redactor, err := redact.New(serverConfig.Redaction)
+			if err != nil {
+				return fmt.Errorf("redaction: %v", err)
+			}
+			log.AddHook(redact.NewHook(redactor))
+			log.Infof("server config: %v", serverConfig)
+			return nil
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.WithError(err).Fatal("server exited with error")
+	}
 
 	// At this point `serverConfig` is populated.
+	embeds, err := newEmbedTokens(serverConfig.EmbedTokens)
+	if err != nil {
+		log.Fatalf("Failed to set up embed tokens: %v", err)
+	}
+
+	// In an active/standby pair, stand by until this instance takes the
+	// leader lease, so that only the leader uses the shared state dir.
+	var api handoff
+	var listeners *listener.Set
+	var elector *leader.Elector
+	var lease leader.Lease
+	if serverConfig.LeaderElection.LeaseFile != "" {
+		elector, err = leader.New(serverConfig.LeaderElection)
+		if err != nil {
+			log.Fatalf("Failed to set up leader election: %v", err)
+		}
+		listeners = openListeners(serverConfig)
+		api.set(standbyHandler(elector))
+		listeners.AllowEmbedded(api.embeddedRequest)
+		listeners.Serve(&api)
+		log.Printf("Standby REST server listening on: %s", listeners)
+
+		sdnotify.Ready("standing by for the leader lease")
+		standbyWatchdogCtx, stopStandbyWatchdog := context.WithCancel(context.Background())
+		sdnotify.Watchdog(standbyWatchdogCtx, nil)
+		campaignCtx, stopCampaign := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		lease, err = elector.Campaign(campaignCtx)
+		stopCampaign()
+		stopStandbyWatchdog()
+		if err != nil {
+			log.Println("Shutting down standby server...")
+			if err := listeners.Shutdown(context.Background()); err != nil {
+				log.Fatalf("Server shutdown failed: %v", err)
+			}
+			log.Println("Server stopped")
+			return
+		}
+	}
+
 	// Create the VM server
 	vmServer, err := server.NewServer(*serverConfig)
 	if err != nil {
 		log.Fatalf("failed to create VM server: %v", err)
 	}
 
+	usageCtx, stopUsage := context.WithCancel(context.Background())
+	usageDone := make(chan struct{})
+	go func() {
+		defer close(usageDone)
+		vmServer.AccountUsage(usageCtx)
+	}()
+	housekeepingCtx, stopHousekeeping := context.WithCancel(context.Background())
+	go vmServer.CollectGarbagePeriodically(housekeepingCtx)
+	go vmServer.ReconcileNetworkPeriodically(housekeepingCtx)
+	go vmServer.PurgeDeletedVMsPeriodically(housekeepingCtx)
+	go vmServer.EnforceEgressPeriodically(housekeepingCtx)
+	go vmServer.PurgeRecordingsPeriodically(housekeepingCtx)
+	go vmServer.CheckDiskPeriodically(housekeepingCtx)
+	go vmServer.EvaluateAutoscalingPeriodically(housekeepingCtx)
+	go vmServer.DestroyExpiredVMsPeriodically(housekeepingCtx)
+	go vmServer.SealAuditPeriodically(housekeepingCtx)
+
 	// Create REST server
-	s := &restServer{vmServer: vmServer}
-	r := mux.NewRouter()
-	r.StrictSlash(true) // Automatically handle trailing slashes
-
-	// Register routes
-	r.HandleFunc("/"+API_VERSION+"/vms", s.startVM).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.updateVMState).Methods("PATCH")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.destroyVM).Methods("DELETE")
-	r.HandleFunc("/"+API_VERSION+"/vms", s.destroyAllVMs).Methods("DELETE")
-	r.HandleFunc("/"+API_VERSION+"/vms", s.listAllVMs).Methods("GET")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.listVM).Methods("GET")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}/snapshots", s.snapshotVM).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}/cmd", s.vmCommand).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}/files", s.vmFileUpload).Methods("POST")
-	r.HandleFunc("/"+API_VERSION+"/vms/{name}/files", s.vmFileDownload).Methods("GET")
-	r.HandleFunc("/"+API_VERSION+"/health", s.healthCheck).Methods("GET")
-
-	// Start HTTP server - Force IPv4 binding to avoid IPv6-only issues
-	addr := serverConfig.Host + ":" + serverConfig.Port
-	
-	// Create IPv4 listener explicitly
-	listener, err := net.Listen("tcp4", addr)
-	if err != nil {
-		log.Fatalf("Failed to create IPv4 listener: %v", err)
+	s := &restServer{
+		vmServer:            vmServer,
+		requests:            reqtrace.NewRecorder(serverConfig.RequestLog),
+		createLimit:         ratelimit.New(serverConfig.RateLimit.Create),
+		snapshotLimit:       ratelimit.New(serverConfig.RateLimit.Snapshot),
+		execLimit:           ratelimit.New(serverConfig.RateLimit.Exec),
+		embedAllowedOrigins: serverConfig.EmbedAllowedOrigins,
+		embedTokens:         embeds,
 	}
-	
-	srv := &http.Server{
-		Handler: r,
+	r := s.router(serverConfig)
+
+	// A promoted standby already serves its listeners.
+	api.set(apiv2.Handler(r, v2Options))
+	api.setEmbedded(s.embeddedRequest)
+	if listeners == nil {
+		listeners = openListeners(serverConfig)
+		listeners.AllowEmbedded(api.embeddedRequest)
+		listeners.Serve(&api)
+	}
+	log.Printf("REST server listening on: %s", listeners)
+	leaderCtx, stopLeading := context.WithCancel(context.Background())
+	lost := make(chan error, 1)
+	if elector != nil {
+		go func() {
+			lost <- elector.Hold(leaderCtx, lease)
+		}()
 	}
 
-	go func() {
-		log.Printf("REST server listening on IPv4: %s", addr)
-		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
-		}
-	}()
+	sdnotify.Ready(fmt.Sprintf("serving on %s", listeners))
+	var healthCheck func(context.Context) error
+	if url := listeners.LocalURL(); url != "" {
+		healthCheck = sdnotify.HTTPCheck(url + "/" + API_VERSION + "/health")
+	}
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	sdnotify.Watchdog(watchdogCtx, healthCheck)
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	var stepDown error
+	select {
+	case <-sigChan:
+	case stepDown = <-lost:
+		log.WithError(stepDown).Error("Stepping down")
+	}
+	stopWatchdog()
 
 	log.Println("Shutting down server...")
-	if err := srv.Shutdown(context.Background()); err != nil {
+	stopHousekeeping()
+	if stepDown != nil {
+		sdnotify.Stopping("stepping down, leaving the VMs running")
+	} else {
+		sdnotify.Stopping("shutting down and destroying VMs")
+	}
+	if err := listeners.Shutdown(context.Background()); err != nil {
 		log.Fatalf("Server shutdown failed: %v", err)
 	}
-	vmServer.DestroyAllVMs(context.Background())
+	vmServer.CancelAllOperations()
+	// A leader stepping down leaves its VMs running, for this host to adopt
+	// them once it leads again.
+	if stepDown == nil {
+		vmServer.DestroyAllVMs(context.Background())
+	}
+	// Destroying the VMs accounted for their final usage, save it.
+	stopUsage()
+	<-usageDone
+	// Release the lease only once the VMs are gone, for the standby to take
+	// over right away.
+	stopLeading()
+	if elector != nil && stepDown == nil {
+		<-lost
+	}
 	log.Println("Server stopped")
+	if stepDown != nil {
+		os.Exit(1)
+	}
+}
+
+// openListeners opens every configured listener. Without a listeners
+// section, force IPv4 binding to avoid IPv6-only issues.
+func openListeners(serverConfig *config.ServerConfig) *listener.Set {
+	addr := serverConfig.Host + ":" + serverConfig.Port
+	listeners, err := listener.Open(listener.Defaults(serverConfig.Listeners, "tcp4", addr, serverConfig.Interface))
+	if err != nil {
+		log.Fatalf("Failed to create listeners: %v", err)
+	}
+	return listeners
 }
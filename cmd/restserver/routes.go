@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/listener"
+)
+
+// router routes the API to s. Routes acting on the whole host or on every
+// tenant are for admins only among callers authenticated with OIDC, the
+// others only reach the VMs, operations, snapshots, usage and recordings of
+// the caller's tenant.
+func (s *restServer) router(serverConfig *config.ServerConfig) *mux.Router {
+	r := mux.NewRouter()
+	r.StrictSlash(true) // Automatically handle trailing slashes
+	r.Use(s.requests.Middleware)
+	r.Use(requireTenant)
+	r.Use(s.resolveVMIDs)
+
+	r.HandleFunc("/"+API_VERSION+"/vms", rateLimited(s.createLimit, s.startVM)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/adopt", adminOnly(s.adoptVM)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/import", rateLimited(s.createLimit, s.importVM)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.updateVMState).Methods("PATCH")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.destroyVM).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/vms", adminOnly(s.destroyAllVMs)).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/vms", s.listAllVMs).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}", s.listVM).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/snapshots", rateLimited(s.snapshotLimit, s.snapshotVM)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/snapshots/{id}/diff", s.snapshotDiff).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/undelete", s.undeleteVM).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/cmd", rateLimited(s.execLimit, s.vmCommand)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/cmd", rateLimited(s.execLimit, s.vmPTY)).Methods("GET").Queries("tty", "true")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/files", s.vmFileUpload).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/files", s.vmFileDownload).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/agent/update", s.vmAgentUpdate).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/capabilities", s.vmCapabilities).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/services", s.vmServices).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/browser/profile", s.seedBrowserProfile).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/browser/restart", s.restartBrowser).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/open-url", s.openURL).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/clipboard", s.vmClipboard).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/clipboard", s.setVMClipboard).Methods("PUT")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/reset", s.resetVM).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/ocr", rateLimited(s.execLimit, s.vmOCR)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/mounts", s.vmObjectMounts).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/exposure", s.vmExposure).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/spec", s.vmSpec).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/disk/search", s.searchVMDisk).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/network", s.vmNetwork).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/network/enable", s.enableVMNetwork).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/network/disable", s.disableVMNetwork).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/devices", s.vmDevices).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/devices", s.attachDevice).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/devices/{id}", s.detachDevice).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/boot/events", s.vmBootEvents).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/events", s.vmEvents).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/timeline", s.vmTimeline).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/export", rateLimited(s.snapshotLimit, s.exportVM)).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/artifacts", s.vmArtifacts).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/artifacts", s.cleanVMArtifacts).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/artifacts/{path:.+}", s.vmArtifact).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/workdir", s.vmWorkDir).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/sessions", s.vmSessions).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/vms/{name}/embed-tokens", s.createEmbedToken).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/thumbnails", s.thumbnails).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/operations", s.listOperations).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/operations/{id}", s.getOperation).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/operations/{id}", s.cancelOperation).Methods("DELETE")
+	r.HandleFunc("/"+API_VERSION+"/usage", s.getUsage).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/recordings", s.getRecordings).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/recordings/purge", adminOnly(s.purgeRecordings)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/audit/batches", adminOnly(s.listAuditBatches)).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/audit/batches/{seq}", adminOnly(s.getAuditBatch)).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/audit/key", s.getAuditKey).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/host/gc", adminOnly(s.hostGC)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/host/network/reconcile", adminOnly(s.hostNetworkReconcile)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/host/status", s.getHostStatus).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/host/autoscaling", s.getHostAutoscaling).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/capabilities", s.getHostCapabilities).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/host/cordon", s.getHostCordon).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/host/cordon", adminOnly(s.cordonHost)).Methods("POST")
+	r.HandleFunc("/"+API_VERSION+"/host/uncordon", adminOnly(s.uncordonHost)).Methods("POST")
+	r.HandleFunc("/metrics", s.getMetrics).Methods("GET")
+	r.HandleFunc("/version", s.getVersion).Methods("GET")
+	r.HandleFunc("/"+API_VERSION+"/health", s.healthCheck).Methods("GET")
+	r.HandleFunc("/vm/{vm}/terminal", s.vmTerminal).Methods("GET")
+	// The admin endpoints are disabled unless a token is set.
+	if len(serverConfig.Admin.Tokens) > 0 {
+		r.Handle("/"+API_VERSION+"/admin/slow-requests",
+			listener.RequireToken(serverConfig.Admin.Tokens, http.HandlerFunc(s.slowRequests))).Methods("GET")
+	}
+	return r
+}
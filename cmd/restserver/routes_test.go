@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/oidc"
+	"github.com/abshkbh/arrakis/pkg/ratelimit"
+	"github.com/abshkbh/arrakis/pkg/reqtrace"
+)
+
+// newTestRouter routes to a restServer without a VM server, for the checks
+// made before any call reaches it.
+func newTestRouter() http.Handler {
+	s := &restServer{
+		requests:      reqtrace.NewRecorder(config.RequestLogConfig{}),
+		createLimit:   ratelimit.New(config.RateLimit{}),
+		snapshotLimit: ratelimit.New(config.RateLimit{}),
+		execLimit:     ratelimit.New(config.RateLimit{}),
+	}
+	return s.router(&config.ServerConfig{})
+}
+
+// serveAs serves method and target as a caller authenticated with OIDC as id.
+func serveAs(t *testing.T, h http.Handler, id *oidc.Identity, method, target string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	req = req.WithContext(oidc.NewContext(req.Context(), id))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAdminOnlyRoutes(t *testing.T) {
+	h := newTestRouter()
+	tenant := &oidc.Identity{Subject: "alice", Tenant: "acme"}
+	for _, route := range []struct{ method, target string }{
+		{http.MethodPost, "/v1/vms/adopt"},
+		{http.MethodDelete, "/v1/vms"},
+		{http.MethodPost, "/v1/recordings/purge"},
+		{http.MethodGet, "/v1/audit/batches"},
+		{http.MethodGet, "/v1/audit/batches/1"},
+		{http.MethodPost, "/v1/host/gc"},
+		{http.MethodPost, "/v1/host/network/reconcile"},
+		{http.MethodPost, "/v1/host/cordon"},
+		{http.MethodPost, "/v1/host/uncordon"},
+	} {
+		if code := serveAs(t, h, tenant, route.method, route.target); code != http.StatusForbidden {
+			t.Errorf("%s %s as tenant: got %d, want %d", route.method, route.target, code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestOtherTenantQueries(t *testing.T) {
+	h := newTestRouter()
+	tenant := &oidc.Identity{Subject: "alice", Tenant: "acme"}
+	for _, target := range []string{
+		"/v1/usage?tenant=globex",
+		"/v1/recordings?tenant=globex",
+	} {
+		if code := serveAs(t, h, tenant, http.MethodGet, target); code != http.StatusForbidden {
+			t.Errorf("GET %s as tenant: got %d, want %d", target, code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestTenantlessCallersRejected(t *testing.T) {
+	h := newTestRouter()
+	nobody := &oidc.Identity{Subject: "bob"}
+	for _, route := range []struct{ method, target string }{
+		{http.MethodGet, "/v1/vms"},
+		{http.MethodGet, "/v1/vms/sandbox"},
+		{http.MethodPost, "/v1/vms"},
+		{http.MethodGet, "/v1/operations"},
+		{http.MethodGet, "/v1/usage"},
+	} {
+		if code := serveAs(t, h, nobody, route.method, route.target); code != http.StatusForbidden {
+			t.Errorf("%s %s without tenant: got %d, want %d", route.method, route.target, code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestTenantOwner(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		id      *oidc.Identity
+		owner   string
+		want    string
+		wantErr bool
+	}{
+		{name: "no oidc", owner: "globex", want: "globex"},
+		{name: "admin", id: &oidc.Identity{Subject: "root", Admin: true}, owner: "globex", want: "globex"},
+		{name: "default", id: &oidc.Identity{Subject: "alice", Tenant: "acme"}, want: "acme"},
+		{name: "own", id: &oidc.Identity{Subject: "alice", Tenant: "acme"}, owner: "acme", want: "acme"},
+		{name: "other", id: &oidc.Identity{Subject: "alice", Tenant: "acme"}, owner: "globex", wantErr: true},
+		{name: "no tenant", id: &oidc.Identity{Subject: "bob"}, wantErr: true},
+		{name: "no tenant with owner", id: &oidc.Identity{Subject: "bob"}, owner: "globex", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/usage", nil)
+			if tc.id != nil {
+				r = r.WithContext(oidc.NewContext(r.Context(), tc.id))
+			}
+			got, err := tenantOwner(r, tc.owner)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("tenantOwner() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("tenantOwner() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/embedtoken"
+	"github.com/abshkbh/arrakis/pkg/secheaders"
+)
+
+//go:embed terminal.html
+var terminalHTML string
+
+var terminalTemplate = template.Must(template.New("terminal").Parse(terminalHTML))
+
+// terminalCSP is the policy of the terminal page, which loads xterm.js from
+// its CDN and talks to the PTY WebSocket of its own origin.
+const terminalCSP = "default-src 'none'; script-src 'nonce-%s' https://cdn.jsdelivr.net; " +
+	"style-src 'unsafe-inline' https://cdn.jsdelivr.net; connect-src 'self'; base-uri 'none'; form-action 'none'"
+
+// vmTerminal serves an in-browser terminal wired to the VM's PTY exec
+// WebSocket. A `token` or `embed_token` query parameter is passed on to the
+// WebSocket for listeners that require authentication.
+func (s *restServer) vmTerminal(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("api", "vmTerminal")
+	vars := mux.Vars(r)
+	vmName := vars["vm"]
+
+	if _, err := s.vmServer.ListVM(r.Context(), vmName); err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to get VM")
+		statusCode := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			statusCode = http.StatusNotFound
+		}
+		sendErrorResponse(w, statusCode, fmt.Sprintf("Failed to get VM: %v", err))
+		return
+	}
+
+	s.keepEmbedToken(w, r)
+	nonce := secheaders.Nonce()
+	secheaders.Set(w.Header(), fmt.Sprintf(terminalCSP, nonce), s.embedAllowedOrigins)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := terminalTemplate.Execute(w, struct {
+		VMName  string
+		PTYPath string
+		Nonce   string
+	}{
+		VMName:  vmName,
+		PTYPath: "/" + API_VERSION + "/vms/" + url.PathEscape(vmName) + "/cmd",
+		Nonce:   nonce,
+	})
+	if err != nil {
+		logger.WithField("vmName", vmName).WithError(err).Error("Failed to render terminal")
+	}
+}
+
+// keepEmbedToken sets a cookie with the embed token the page was opened with,
+// so that it keeps working when reloaded without it.
+func (s *restServer) keepEmbedToken(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get(embedtoken.QueryParam)
+	if s.embedTokens == nil || token == "" {
+		return
+	}
+	claims, err := s.embedTokens.verify(token)
+	if err != nil {
+		return
+	}
+	embedtoken.SetCookie(w, r, token, claims)
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/mtls"
 	"github.com/urfave/cli/v2"
 	"gvisor.dev/gvisor/pkg/cleanup"
 )
@@ -33,7 +36,7 @@ func runCmd(cmdName string, args ...string) error {
 	return cmd.Run()
 }
 
-func createRootfsFromDockerfile(dockerFile string, outputFile string) (retErr error) {
+func createRootfsFromDockerfile(dockerFile string, outputFile string, pkiDir string) (retErr error) {
 	cleanup := cleanup.Make(func() {
 		if retErr == nil {
 			log.Info("create rootfs from docker file finished")
@@ -173,6 +176,32 @@ func createRootfsFromDockerfile(dockerFile string, outputFile string) (retErr er
 		}
 	})
 
+	if pkiDir != "" {
+		log.Info("installing agent certificates")
+		if err := installAgentCertificates(pkiDir, mountDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installAgentCertificates copies the agent's mutual TLS certificates from
+// the internal PKI in pkiDir into the rootfs mounted at rootDir.
+func installAgentCertificates(pkiDir string, rootDir string) error {
+	tlsDir := filepath.Join(rootDir, cmdserver.AgentTLSDir)
+	for _, file := range []struct {
+		name string
+		mode string
+	}{
+		{"ca.crt", "0644"},
+		{mtls.ServiceAgent + ".crt", "0644"},
+		{mtls.ServiceAgent + ".key", "0600"},
+	} {
+		src := filepath.Join(pkiDir, file.name)
+		if err := runCmd("install", "-D", "-m", file.mode, src, filepath.Join(tlsDir, file.name)); err != nil {
+			return fmt.Errorf("failed to install %s: %w", src, err)
+		}
+	}
 	return nil
 }
 
@@ -199,9 +228,13 @@ func main() {
 						Usage:    "Path to the output rootfs file",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:  "pki-dir",
+						Usage: "Internal PKI to install the guest agent's mutual TLS certificates from",
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return createRootfsFromDockerfile(ctx.String("dockerfile"), ctx.String("output"))
+					return createRootfsFromDockerfile(ctx.String("dockerfile"), ctx.String("output"), ctx.String("pki-dir"))
 				},
 			},
 		},
@@ -2,21 +2,26 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
 
-	"github.com/coreos/go-systemd/daemon"
 	"github.com/mdlayher/vsock"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/agentupdate"
+	"github.com/abshkbh/arrakis/pkg/sdnotify"
 )
 
 const (
 	// Define a base directory to prevent path traversal.
 	baseDir = "/tmp/vsockserver"
 	port    = 4032
+	// Public key that agent updates pushed by the host must be signed with.
+	agentUpdateKeyPath = "/etc/arrakis/agent-update.pub"
 )
 
 func handleConnection(conn *vsock.Conn) {
@@ -91,6 +96,37 @@ func handleConnection(conn *vsock.Conn) {
 	}
 }
 
+// serveAgentUpdates accepts agent updates from the host, one per connection.
+func serveAgentUpdates() {
+	publicKey, err := agentupdate.ReadPublicKey(agentUpdateKeyPath)
+	if err != nil {
+		// Keep listening so the host gets a clear error instead of a
+		// connection failure.
+		log.Warnf("Agent updates disabled, no signing key: %v", err)
+	}
+	updater := agentupdate.NewUpdater(publicKey)
+
+	listener, err := vsock.Listen(uint32(agentupdate.Port), &vsock.Config{})
+	if err != nil {
+		log.Errorf("Failed to create agent update vsock listener: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	log.Printf("Agent updater listening on vsock port %d...", agentupdate.Port)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Errorf("Failed to accept agent update connection: %v", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			updater.Serve(conn)
+		}()
+	}
+}
+
 func main() {
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		log.Fatalf("Failed to create base directory: %v", err)
@@ -101,12 +137,12 @@ func main() {
 		log.Fatalf("Failed to create vsock listener: %v", err)
 	}
 	defer listener.Close()
+	go serveAgentUpdates()
 
 	log.Printf("VSock server listening on port %d...", port)
 	// Make other services start via systemd since we're ready to debug.
-	if _, err := daemon.SdNotify(false, daemon.SdNotifyReady); err != nil {
-		log.Warnf("Failed to notify systemd of readiness: %v", err)
-	}
+	sdnotify.Ready(fmt.Sprintf("listening on vsock port %d", port))
+	sdnotify.Watchdog(context.Background(), nil)
 
 	for {
 		conn, err := listener.Accept()
@@ -0,0 +1,284 @@
+// Package admin implements the runtime control endpoints shared by the guest
+// proxies:
+//
+//	GET    /admin/status   running state, active sessions and config
+//	GET    /admin/metrics  active sessions and draining state, and the
+//	                       proxy's own metrics, for Prometheus
+//	POST   /admin/drain    refuse new sessions, let active ones finish, for
+//	                       at most ?timeout= if set
+//	DELETE /admin/drain    accept new sessions again
+//	POST   /admin/reload   re-read the config file and apply what can change live
+//
+// Every endpoint requires one of the configured admin tokens.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/listener"
+	"github.com/abshkbh/arrakis/pkg/metrics"
+)
+
+// Sessions counts the active sessions of a proxy and refuses new ones while
+// draining. The zero value is ready to use.
+type Sessions struct {
+	wg       sync.WaitGroup
+	active   atomic.Int64
+	draining atomic.Bool
+}
+
+// Enter registers a new session. It returns false, and registers nothing, if
+// the proxy is draining. Every successful Enter must be paired with Leave.
+func (s *Sessions) Enter() bool {
+	if s.draining.Load() {
+		return false
+	}
+	s.wg.Add(1)
+	s.active.Add(1)
+	return true
+}
+
+// Leave marks a session as finished.
+func (s *Sessions) Leave() {
+	s.active.Add(-1)
+	s.wg.Done()
+}
+
+// Wait blocks until all active sessions have finished.
+func (s *Sessions) Wait() {
+	s.wg.Wait()
+}
+
+// WaitContext blocks until all active sessions have finished or ctx is done,
+// returning ctx's error then.
+func (s *Sessions) WaitContext(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Active returns the number of sessions in progress.
+func (s *Sessions) Active() int64 {
+	return s.active.Load()
+}
+
+// SetDraining starts or stops refusing new sessions.
+func (s *Sessions) SetDraining(draining bool) {
+	s.draining.Store(draining)
+}
+
+// Draining reports whether new sessions are being refused.
+func (s *Sessions) Draining() bool {
+	return s.draining.Load()
+}
+
+// Proxy is a service controlled through the admin endpoints.
+type Proxy interface {
+	// Reload re-reads the config file and applies the settings that can
+	// change without a restart.
+	Reload() error
+	// Config returns a description of the settings in effect.
+	Config() string
+}
+
+// Drainer is implemented by proxies that can close their active sessions
+// once a drain timed out, telling clients to reconnect elsewhere rather than
+// dropping them mid-message.
+type Drainer interface {
+	// CloseSessions closes the active sessions and returns how many.
+	CloseSessions() int
+}
+
+// MetricsSource is implemented by proxies with metrics of their own, served
+// along the admin ones.
+type MetricsSource interface {
+	// Metrics returns the proxy's gauges and histograms.
+	Metrics() ([]metrics.Gauge, []metrics.Histogram)
+}
+
+// drainCloseGrace bounds waiting for sessions to finish once closed.
+const drainCloseGrace = 5 * time.Second
+
+// Drain refuses new sessions and waits up to timeout for the active ones to
+// finish. Those still active then are closed if proxy is a Drainer. It
+// returns how many were closed.
+func Drain(sessions *Sessions, proxy any, timeout time.Duration) int {
+	sessions.SetDraining(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if sessions.WaitContext(ctx) == nil {
+		return 0
+	}
+	drainer, ok := proxy.(Drainer)
+	if !ok {
+		log.Warnf("%d sessions still active after %s", sessions.Active(), timeout)
+		return 0
+	}
+	closed := drainer.CloseSessions()
+	log.Infof("Closed %d sessions still active after %s", closed, timeout)
+
+	ctx, cancel = context.WithTimeout(context.Background(), drainCloseGrace)
+	defer cancel()
+	if err := sessions.WaitContext(ctx); err != nil {
+		log.Warnf("%d sessions still active after being closed", sessions.Active())
+	}
+	return closed
+}
+
+// Status is the response of GET /admin/status.
+type Status struct {
+	Service        string `json:"service"`
+	PID            int    `json:"pid"`
+	Uptime         string `json:"uptime"`
+	Draining       bool   `json:"draining"`
+	ActiveSessions int64  `json:"activeSessions"`
+	LastReload     string `json:"lastReload,omitempty"`
+	Config         string `json:"config"`
+}
+
+type handler struct {
+	service  string
+	proxy    Proxy
+	sessions *Sessions
+	started  time.Time
+
+	mu         sync.Mutex // Serializes reloads
+	lastReload time.Time
+}
+
+// Register adds the admin endpoints for proxy to r. Nothing is registered if
+// cfg has no tokens, so the endpoints are never reachable unauthenticated.
+func Register(r *mux.Router, cfg config.AdminConfig, service string, proxy Proxy, sessions *Sessions) {
+	if len(cfg.Tokens) == 0 {
+		log.Info("No admin tokens configured, admin endpoints disabled")
+		return
+	}
+
+	h := &handler{
+		service:  service,
+		proxy:    proxy,
+		sessions: sessions,
+		started:  time.Now(),
+	}
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(func(next http.Handler) http.Handler {
+		return listener.RequireToken(cfg.Tokens, next)
+	})
+	admin.HandleFunc("/status", h.status).Methods("GET")
+	admin.HandleFunc("/metrics", h.metrics).Methods("GET")
+	admin.HandleFunc("/drain", h.drain).Methods("POST", "DELETE")
+	admin.HandleFunc("/reload", h.reload).Methods("POST")
+}
+
+func (h *handler) currentStatus() Status {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := Status{
+		Service:        h.service,
+		PID:            os.Getpid(),
+		Uptime:         time.Since(h.started).Round(time.Second).String(),
+		Draining:       h.sessions.Draining(),
+		ActiveSessions: h.sessions.Active(),
+		Config:         h.proxy.Config(),
+	}
+	if !h.lastReload.IsZero() {
+		status.LastReload = h.lastReload.Format(time.RFC3339)
+	}
+	return status
+}
+
+func (h *handler) writeStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.currentStatus())
+}
+
+func (h *handler) status(w http.ResponseWriter, r *http.Request) {
+	h.writeStatus(w)
+}
+
+func (h *handler) metrics(w http.ResponseWriter, r *http.Request) {
+	labels := map[string]string{"service": h.service}
+	var draining float64
+	if h.sessions.Draining() {
+		draining = 1
+	}
+	gauges := []metrics.Gauge{
+		{
+			Name:    "arrakis_proxy_sessions",
+			Help:    "Sessions in progress through the proxy.",
+			Samples: []metrics.Sample{{Labels: labels, Value: float64(h.sessions.Active())}},
+		},
+		{
+			Name:    "arrakis_proxy_draining",
+			Help:    "Whether the proxy refuses new sessions.",
+			Samples: []metrics.Sample{{Labels: labels, Value: draining}},
+		},
+	}
+	var histograms []metrics.Histogram
+	if source, ok := h.proxy.(MetricsSource); ok {
+		g, hs := source.Metrics()
+		gauges = append(gauges, g...)
+		histograms = hs
+	}
+	metrics.Serve(w, gauges, histograms...)
+}
+
+func (h *handler) drain(w http.ResponseWriter, r *http.Request) {
+	draining := r.Method == http.MethodPost
+	var timeout time.Duration
+	if t := r.URL.Query().Get("timeout"); draining && t != "" {
+		var err error
+		timeout, err = time.ParseDuration(t)
+		if err != nil || timeout <= 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout %q", t), http.StatusBadRequest)
+			return
+		}
+	}
+	h.sessions.SetDraining(draining)
+	if draining {
+		log.Infof("Draining: refusing new sessions, %d still active", h.sessions.Active())
+		if timeout > 0 {
+			Drain(h.sessions, h.proxy, timeout)
+		}
+	} else {
+		log.Info("Drain cancelled: accepting new sessions")
+	}
+	h.writeStatus(w)
+}
+
+func (h *handler) reload(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	err := h.proxy.Reload()
+	if err == nil {
+		h.lastReload = time.Now()
+	}
+	h.mu.Unlock()
+
+	if err != nil {
+		log.Errorf("Config reload failed, keeping current settings: %v", err)
+		http.Error(w, "reload failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Info("Config reloaded")
+	h.writeStatus(w)
+}
@@ -0,0 +1,215 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/metrics"
+)
+
+type fakeProxy struct {
+	reloads   int
+	reloadErr error
+}
+
+func (p *fakeProxy) Reload() error {
+	if p.reloadErr != nil {
+		return p.reloadErr
+	}
+	p.reloads++
+	return nil
+}
+
+func (p *fakeProxy) Config() string {
+	return "{fake}"
+}
+
+func newTestRouter(proxy Proxy, sessions *Sessions) *mux.Router {
+	r := mux.NewRouter()
+	Register(r, config.AdminConfig{Tokens: []string{"secret"}}, "test", proxy, sessions)
+	return r
+}
+
+func do(t *testing.T, r http.Handler, method string, target string, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSessionsDrain(t *testing.T) {
+	var s Sessions
+	if !s.Enter() {
+		t.Fatal("Enter() = false before draining")
+	}
+	s.SetDraining(true)
+	if s.Enter() {
+		t.Error("Enter() = true while draining")
+	}
+	if got := s.Active(); got != 1 {
+		t.Errorf("Active() = %d, want 1", got)
+	}
+	s.Leave()
+	s.Wait()
+	s.SetDraining(false)
+	if !s.Enter() {
+		t.Error("Enter() = false after cancelling the drain")
+	}
+	s.Leave()
+}
+
+func TestDisabledWithoutTokens(t *testing.T) {
+	r := mux.NewRouter()
+	Register(r, config.AdminConfig{}, "test", &fakeProxy{}, &Sessions{})
+	if rec := do(t, r, "GET", "/admin/status", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("status without tokens configured returned %d, want 404", rec.Code)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	r := newTestRouter(&fakeProxy{}, &Sessions{})
+	if rec := do(t, r, "GET", "/admin/status", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("status without token returned %d, want 401", rec.Code)
+	}
+	if rec := do(t, r, "GET", "/admin/status", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("status with wrong token returned %d, want 401", rec.Code)
+	}
+	if rec := do(t, r, "GET", "/admin/status", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("status with token returned %d, want 200", rec.Code)
+	}
+}
+
+func TestDrainAndStatus(t *testing.T) {
+	sessions := &Sessions{}
+	sessions.Enter()
+	defer sessions.Leave()
+	r := newTestRouter(&fakeProxy{}, sessions)
+
+	rec := do(t, r, "POST", "/admin/drain", "secret")
+	var status Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to decode status %q: %v", rec.Body, err)
+	}
+	if !status.Draining || status.ActiveSessions != 1 || status.Service != "test" {
+		t.Errorf("status after drain = %+v", status)
+	}
+	if !sessions.Draining() {
+		t.Error("sessions not draining after POST /admin/drain")
+	}
+
+	do(t, r, "DELETE", "/admin/drain", "secret")
+	if sessions.Draining() {
+		t.Error("sessions still draining after DELETE /admin/drain")
+	}
+}
+
+// drainingProxy ends its sessions when asked to close them.
+type drainingProxy struct {
+	fakeProxy
+	sessions *Sessions
+	open     int
+}
+
+func (p *drainingProxy) CloseSessions() int {
+	closed := p.open
+	for ; p.open > 0; p.open-- {
+		p.sessions.Leave()
+	}
+	return closed
+}
+
+func TestDrainTimeout(t *testing.T) {
+	sessions := &Sessions{}
+	sessions.Enter()
+	sessions.Enter()
+	proxy := &drainingProxy{sessions: sessions, open: 2}
+	r := newTestRouter(proxy, sessions)
+
+	rec := do(t, r, "POST", "/admin/drain?timeout=10ms", "secret")
+	var status Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to decode status %q: %v", rec.Body, err)
+	}
+	if !status.Draining || status.ActiveSessions != 0 || proxy.open != 0 {
+		t.Errorf("status after drain = %+v, %d sessions open", status, proxy.open)
+	}
+
+	if rec := do(t, r, "POST", "/admin/drain?timeout=soon", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("drain with an invalid timeout = %d, want 400", rec.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	sessions := &Sessions{}
+	sessions.Enter()
+	sessions.Enter()
+	defer sessions.Leave()
+	defer sessions.Leave()
+	r := newTestRouter(&fakeProxy{}, sessions)
+
+	rec := do(t, r, "GET", "/admin/metrics", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics returned %d, want 200", rec.Code)
+	}
+	for _, want := range []string{
+		`arrakis_proxy_sessions{service="test"} 2`,
+		`arrakis_proxy_draining{service="test"} 0`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics %q don't contain %q", rec.Body, want)
+		}
+	}
+}
+
+type metricsProxy struct {
+	fakeProxy
+}
+
+func (p *metricsProxy) Metrics() ([]metrics.Gauge, []metrics.Histogram) {
+	return []metrics.Gauge{metrics.NewGauge("arrakis_test_gauge", "A gauge.", 1)},
+		[]metrics.Histogram{{Name: "arrakis_test_seconds", Help: "A histogram.", Samples: []metrics.HistogramSample{{Count: 1, Sum: 0.5}}}}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	r := newTestRouter(&metricsProxy{}, &Sessions{})
+
+	rec := do(t, r, "GET", "/admin/metrics", "secret")
+	for _, want := range []string{
+		`arrakis_proxy_sessions{service="test"} 0`,
+		"arrakis_test_gauge 1",
+		`arrakis_test_seconds_bucket{le="+Inf"} 1`,
+		"arrakis_test_seconds_sum 0.5",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics %q don't contain %q", rec.Body, want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	proxy := &fakeProxy{}
+	r := newTestRouter(proxy, &Sessions{})
+
+	if rec := do(t, r, "POST", "/admin/reload", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("reload returned %d, want 200", rec.Code)
+	}
+	if proxy.reloads != 1 {
+		t.Errorf("proxy reloaded %d times, want 1", proxy.reloads)
+	}
+
+	proxy.reloadErr = errors.New("bad config")
+	if rec := do(t, r, "POST", "/admin/reload", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("failed reload returned %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,163 @@
+// Package agentupdate replaces guest agent binaries in a running VM without
+// rebuilding the guest image.
+//
+// The host connects to the updater in the guest over vsock and sends a single
+// JSON header line followed by the binary:
+//
+//	{"agent":"arrakis-cmdserver","version":"v1.2.0","size":123,"signature":"<base64>"}\n<binary>
+//
+// The signature is an ed25519 signature over SignedDigest, which binds the
+// agent's name and version to the SHA-256 digest of the binary, made with the
+// private key matching the public key baked into the guest image. The guest
+// verifies it, checks that the new binary runs and reports being that agent
+// and version, no older than the installed one, swaps it in atomically,
+// restarts the agent and replies with one JSON line carrying the installed
+// version or an error.
+package agentupdate
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// Port is the vsock port the updater listens on inside the guest.
+	Port = 4033
+	// DefaultAgent is updated when a request does not name an agent.
+	DefaultAgent = "arrakis-cmdserver"
+	// MaxBinarySize bounds the size of an agent binary.
+	MaxBinarySize = 256 << 20
+)
+
+// Header precedes the binary on the wire.
+type Header struct {
+	Agent string `json:"agent"`
+	// Version of the binary, as it reports it after "<agent> version ".
+	Version   string `json:"version"`
+	Size      int64  `json:"size"`
+	Signature string `json:"signature"` // Base64 encoded ed25519 signature
+}
+
+// Result is the updater's reply.
+type Result struct {
+	Agent   string `json:"agent"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Digest returns the SHA-256 digest of binary.
+func Digest(binary io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, binary); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// SignedDigest returns the digest signed for version of agent, whose binary
+// has the SHA-256 digest binaryDigest, so that a signature can't be replayed
+// to install the binary as another agent or claim another version.
+func SignedDigest(agent string, version string, binaryDigest []byte) []byte {
+	// Marshaling a struct can't fail, and keeps the fields apart whatever
+	// they hold.
+	data, _ := json.Marshal(struct {
+		Agent   string `json:"agent"`
+		Version string `json:"version"`
+		SHA256  string `json:"sha256"`
+	}{agent, version, hex.EncodeToString(binaryDigest)})
+	digest := sha256.Sum256(data)
+	return digest[:]
+}
+
+// Sign returns the base64 encoded signature of binary, version of agent, for
+// a Header.
+func Sign(privateKey ed25519.PrivateKey, agent string, version string, binary []byte) string {
+	binaryDigest := sha256.Sum256(binary)
+	digest := SignedDigest(agent, version, binaryDigest[:])
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, digest))
+}
+
+// Verify checks a base64 encoded signature against a digest.
+func Verify(publicKey ed25519.PublicKey, digest []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	if !ed25519.Verify(publicKey, digest, sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// ReadPublicKey reads a base64 encoded ed25519 public key from path.
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %v", path, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key in %s: got %d bytes, want %d", path, len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Send pushes binary, version of agent, to the updater at the other end of
+// conn and waits for its reply. An error is returned if either the transfer
+// or the update fails. The updater may reject a request before reading the
+// binary, so the caller must close conn once Send returns.
+func Send(conn io.ReadWriter, agent string, version string, binary []byte, signature string) (*Result, error) {
+	if agent == "" {
+		agent = DefaultAgent
+	}
+	header, err := json.Marshal(Header{Agent: agent, Version: version, Size: int64(len(binary)), Signature: signature})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal header: %v", err)
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		if _, err := conn.Write(append(header, '\n')); err != nil {
+			writeErr <- fmt.Errorf("failed to send header: %v", err)
+			return
+		}
+		if _, err := conn.Write(binary); err != nil {
+			writeErr <- fmt.Errorf("failed to send binary: %v", err)
+			return
+		}
+		writeErr <- nil
+	}()
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		// A failed write explains a missing reply better than the read error.
+		select {
+		case werr := <-writeErr:
+			if werr != nil {
+				return nil, werr
+			}
+		default:
+		}
+		return nil, fmt.Errorf("failed to read update result: %v", err)
+	}
+	var result Result
+	if err := json.Unmarshal(line, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse update result: %v", err)
+	}
+	if result.Error != "" {
+		return &result, fmt.Errorf("update of %s failed: %s", result.Agent, result.Error)
+	}
+	return &result, nil
+}
@@ -0,0 +1,190 @@
+package agentupdate
+
+import (
+	"crypto/ed25519"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const fakeAgent = "#!/bin/sh\necho fake-agent version 2\n"
+
+// update runs a Send against an Updater over an in-memory connection.
+func update(t *testing.T, u *Updater, agent string, version string, binary []byte, signature string) (*Result, error) {
+	t.Helper()
+	host, guest := net.Pipe()
+	defer host.Close()
+	go func() {
+		defer guest.Close()
+		u.Serve(guest)
+	}()
+	return Send(host, agent, version, binary, signature)
+}
+
+func newTestUpdater(t *testing.T) (*Updater, ed25519.PrivateKey, string, *[]Agent) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\necho fake-agent version 1\n"), 0755); err != nil {
+		t.Fatalf("Failed to write agent: %v", err)
+	}
+	otherPath := filepath.Join(dir, "other-agent")
+	if err := os.WriteFile(otherPath, []byte("#!/bin/sh\necho other-agent version 1\n"), 0755); err != nil {
+		t.Fatalf("Failed to write agent: %v", err)
+	}
+
+	var restarted []Agent
+	u := &Updater{
+		PublicKey: publicKey,
+		Agents: map[string]Agent{
+			"fake-agent":  {Path: path},
+			"other-agent": {Path: otherPath},
+		},
+		Restart: func(agent Agent) error {
+			restarted = append(restarted, agent)
+			return nil
+		},
+	}
+	return u, privateKey, path, &restarted
+}
+
+func TestUpdate(t *testing.T) {
+	u, privateKey, path, restarted := newTestUpdater(t)
+
+	binary := []byte(fakeAgent)
+	result, err := update(t, u, "fake-agent", "2", binary, Sign(privateKey, "fake-agent", "2", binary))
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if result.Version != "fake-agent version 2" {
+		t.Errorf("Reported version %q, want %q", result.Version, "fake-agent version 2")
+	}
+	installed, err := os.ReadFile(path)
+	if err != nil || string(installed) != fakeAgent {
+		t.Errorf("Installed binary = %q, %v; want the new binary", installed, err)
+	}
+	if len(*restarted) != 1 {
+		t.Errorf("Agent restarted %d times, want 1", len(*restarted))
+	}
+	if _, err := os.Stat(path + ".new"); !os.IsNotExist(err) {
+		t.Errorf("Temporary binary left behind: %v", err)
+	}
+}
+
+func TestUpdateRejected(t *testing.T) {
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	binary := []byte(fakeAgent)
+	older := []byte("#!/bin/sh\necho fake-agent version 0\n")
+
+	tests := []struct {
+		name      string
+		agent     string
+		version   string
+		binary    []byte
+		signature func(ed25519.PrivateKey) string
+		wantErr   string
+	}{
+		{
+			name:      "unknown agent",
+			agent:     "unknown-agent",
+			version:   "2",
+			binary:    binary,
+			signature: func(key ed25519.PrivateKey) string { return Sign(key, "unknown-agent", "2", binary) },
+			wantErr:   "unknown agent",
+		},
+		{
+			name:      "no version",
+			agent:     "fake-agent",
+			binary:    binary,
+			signature: func(key ed25519.PrivateKey) string { return Sign(key, "fake-agent", "", binary) },
+			wantErr:   "no version",
+		},
+		{
+			name:      "wrong key",
+			agent:     "fake-agent",
+			version:   "2",
+			binary:    binary,
+			signature: func(ed25519.PrivateKey) string { return Sign(otherKey, "fake-agent", "2", binary) },
+			wantErr:   "signature verification failed",
+		},
+		{
+			name:      "tampered binary",
+			agent:     "fake-agent",
+			version:   "2",
+			binary:    []byte(strings.Replace(fakeAgent, "2", "3", 1)),
+			signature: func(key ed25519.PrivateKey) string { return Sign(key, "fake-agent", "2", binary) },
+			wantErr:   "signature verification failed",
+		},
+		{
+			name:      "signed for another agent",
+			agent:     "other-agent",
+			version:   "2",
+			binary:    binary,
+			signature: func(key ed25519.PrivateKey) string { return Sign(key, "fake-agent", "2", binary) },
+			wantErr:   "signature verification failed",
+		},
+		{
+			name:      "signed for another version",
+			agent:     "fake-agent",
+			version:   "3",
+			binary:    binary,
+			signature: func(key ed25519.PrivateKey) string { return Sign(key, "fake-agent", "2", binary) },
+			wantErr:   "signature verification failed",
+		},
+		{
+			name:      "binary of another agent",
+			agent:     "other-agent",
+			version:   "2",
+			binary:    binary,
+			signature: func(key ed25519.PrivateKey) string { return Sign(key, "other-agent", "2", binary) },
+			wantErr:   "not being other-agent",
+		},
+		{
+			name:      "binary of another version",
+			agent:     "fake-agent",
+			version:   "3",
+			binary:    binary,
+			signature: func(key ed25519.PrivateKey) string { return Sign(key, "fake-agent", "3", binary) },
+			wantErr:   "not 3",
+		},
+		{
+			name:      "older version",
+			agent:     "fake-agent",
+			version:   "0",
+			binary:    older,
+			signature: func(key ed25519.PrivateKey) string { return Sign(key, "fake-agent", "0", older) },
+			wantErr:   "older than the installed 1",
+		},
+		{
+			name:      "binary does not run",
+			agent:     "fake-agent",
+			version:   "2",
+			binary:    []byte("not an executable"),
+			signature: func(key ed25519.PrivateKey) string { return Sign(key, "fake-agent", "2", []byte("not an executable")) },
+			wantErr:   "does not run",
+		},
+	}
+	for _, test := range tests {
+		u, privateKey, path, restarted := newTestUpdater(t)
+		_, err := update(t, u, test.agent, test.version, test.binary, test.signature(privateKey))
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+		}
+		installed, _ := os.ReadFile(path)
+		if !strings.Contains(string(installed), "version 1") {
+			t.Errorf("%s: installed binary was replaced", test.name)
+		}
+		if len(*restarted) != 0 {
+			t.Errorf("%s: agent was restarted", test.name)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package agentupdate
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	versionTimeout = 10 * time.Second
+)
+
+// Agent is a binary the updater may replace.
+type Agent struct {
+	Path string // Installed binary
+	Unit string // systemd unit to restart once the binary is swapped
+	// Handover is set for daemons that support zero-downtime restarts on
+	// SIGUSR2, which are used instead of a full restart.
+	Handover bool
+}
+
+// DefaultAgents are the guest agents shipped in the guest rootfs.
+var DefaultAgents = map[string]Agent{
+	"arrakis-cmdserver": {
+		Path: "/usr/local/bin/arrakis-cmdserver",
+		Unit: "arrakis-cmdserver.service",
+	},
+	"arrakis-novncserver": {
+		Path:     "/usr/local/bin/arrakis-novncserver",
+		Unit:     "arrakis-novncserver.service",
+		Handover: true,
+	},
+}
+
+// Updater installs signed agent binaries pushed by the host.
+type Updater struct {
+	PublicKey ed25519.PublicKey
+	Agents    map[string]Agent
+	// Restart restarts an agent after its binary was swapped. It defaults to
+	// restarting the agent's systemd unit.
+	Restart func(agent Agent) error
+}
+
+// NewUpdater returns an updater for DefaultAgents trusting publicKey.
+func NewUpdater(publicKey ed25519.PublicKey) *Updater {
+	return &Updater{
+		PublicKey: publicKey,
+		Agents:    DefaultAgents,
+		Restart:   restartUnit,
+	}
+}
+
+// Serve handles one update request on conn and replies with the result.
+func (u *Updater) Serve(conn io.ReadWriter) {
+	agentName, version, err := u.receive(bufio.NewReader(conn))
+	result := Result{Agent: agentName}
+	if err != nil {
+		log.WithField("agent", result.Agent).WithError(err).Error("Agent update failed")
+		result.Error = err.Error()
+	} else {
+		log.WithFields(log.Fields{
+			"agent":   result.Agent,
+			"version": version,
+		}).Info("Agent updated")
+		result.Version = version
+	}
+
+	reply, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("Failed to marshal update result: %v", err)
+		return
+	}
+	if _, err := conn.Write(append(reply, '\n')); err != nil {
+		log.Errorf("Failed to send update result: %v", err)
+	}
+}
+
+// receive reads an update request and installs it. It returns the name of
+// the agent being updated and its new version.
+func (u *Updater) receive(reader *bufio.Reader) (string, string, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read header: %v", err)
+	}
+	var header Header
+	if err := json.Unmarshal(line, &header); err != nil {
+		return "", "", fmt.Errorf("invalid header: %v", err)
+	}
+	if header.Agent == "" {
+		header.Agent = DefaultAgent
+	}
+
+	agent, ok := u.Agents[header.Agent]
+	if !ok {
+		return header.Agent, "", fmt.Errorf("unknown agent %q", header.Agent)
+	}
+	if header.Version == "" {
+		return header.Agent, "", fmt.Errorf("no version for %s", header.Agent)
+	}
+	if header.Size <= 0 || header.Size > MaxBinarySize {
+		return header.Agent, "", fmt.Errorf("invalid binary size %d", header.Size)
+	}
+	if u.PublicKey == nil {
+		return header.Agent, "", fmt.Errorf("no update signing key installed in the guest")
+	}
+	version, err := u.install(agent, header, reader)
+	return header.Agent, version, err
+}
+
+// install writes the binary next to the installed one, verifies it and
+// renames it into place so the agent never sees a partially written file.
+func (u *Updater) install(agent Agent, header Header, binary io.Reader) (string, error) {
+	tmpPath := agent.Path + ".new"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", tmpPath, err)
+	}
+	installed := false
+	defer func() {
+		if !installed {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(binary, header.Size))
+	if err == nil && n != header.Size {
+		err = fmt.Errorf("got %d of %d bytes", n, header.Size)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to receive binary: %v", err)
+	}
+
+	if err := Verify(u.PublicKey, SignedDigest(header.Agent, header.Version, hash.Sum(nil)), header.Signature); err != nil {
+		return "", err
+	}
+	// A signed binary of an older version, e.g. with a since fixed bug, must
+	// not replace a newer one. The installed agent may not run at all.
+	if installed, err := binaryVersion(agent.Path); err == nil {
+		if err := checkNotOlder(header.Version, installed); err != nil {
+			return "", err
+		}
+	}
+
+	// Refuse binaries that do not even start, e.g. built for the wrong
+	// architecture, before replacing a working agent. They must also be the
+	// agent and version they were signed as.
+	version, err := binaryVersion(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("new binary does not run: %v", err)
+	}
+	name, reported, ok := splitVersion(version)
+	if !ok || name != header.Agent {
+		return "", fmt.Errorf("new binary reports %q, not being %s", version, header.Agent)
+	}
+	if reported != header.Version {
+		return "", fmt.Errorf("new binary is version %s, not %s", reported, header.Version)
+	}
+
+	if err := os.Rename(tmpPath, agent.Path); err != nil {
+		return "", fmt.Errorf("failed to install %s: %v", agent.Path, err)
+	}
+	installed = true
+
+	if u.Restart != nil {
+		if err := u.Restart(agent); err != nil {
+			return version, fmt.Errorf("installed %s but failed to restart it: %v", version, err)
+		}
+	}
+	return version, nil
+}
+
+// binaryVersion runs path with --version and returns its output.
+func binaryVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// restartUnit restarts agent's systemd unit, with a zero-downtime handover if
+// the agent supports it.
+func restartUnit(agent Agent) error {
+	if agent.Unit == "" {
+		return nil
+	}
+	args := []string{"restart", agent.Unit}
+	if agent.Handover {
+		args = []string{"kill", "--signal=SIGUSR2", "--kill-whom=main", agent.Unit}
+	}
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
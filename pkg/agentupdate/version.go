@@ -0,0 +1,91 @@
+package agentupdate
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// splitVersion splits the output of an agent's --version, "<agent> version
+// <version>", into the agent's name and its version.
+func splitVersion(output string) (string, string, bool) {
+	agent, version, ok := strings.Cut(output, " version ")
+	if !ok || agent == "" || version == "" || strings.ContainsAny(version, " \n") {
+		return "", "", false
+	}
+	return agent, version, true
+}
+
+// describedVersion matches the versions the binaries are built with, as
+// `git describe` prints them: a tag, optionally followed by the number of
+// commits since and the commit.
+var describedVersion = regexp.MustCompile(`^v?(\d+(?:\.\d+)*)(?:-(\d+)-g[0-9a-f]+)?(?:-dirty)?$`)
+
+// tagVersion orders versions: by tag, then by commits since the tag.
+type tagVersion struct {
+	tag     []int
+	commits int
+}
+
+// parseVersion parses a version as `git describe` prints it.
+func parseVersion(version string) (tagVersion, error) {
+	m := describedVersion.FindStringSubmatch(version)
+	if m == nil {
+		return tagVersion{}, fmt.Errorf("version %q isn't a tag", version)
+	}
+	var v tagVersion
+	for _, part := range strings.Split(m[1], ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return tagVersion{}, fmt.Errorf("version %q: %v", version, err)
+		}
+		v.tag = append(v.tag, n)
+	}
+	if m[2] != "" {
+		v.commits, _ = strconv.Atoi(m[2])
+	}
+	return v, nil
+}
+
+// compare returns -1, 0 or 1 as v is older than, the same as or newer than
+// other. Missing parts of a tag count as 0, so that 1.2 is 1.2.0.
+func (v tagVersion) compare(other tagVersion) int {
+	for i := 0; i < max(len(v.tag), len(other.tag)); i++ {
+		var a, b int
+		if i < len(v.tag) {
+			a = v.tag[i]
+		}
+		if i < len(other.tag) {
+			b = other.tag[i]
+		}
+		if a != b {
+			return cmp.Compare(a, b)
+		}
+	}
+	return cmp.Compare(v.commits, other.commits)
+}
+
+// checkNotOlder rejects version if the installed agent reports a newer one,
+// installedOutput being what its --version printed. An installed agent
+// without a version that orders, e.g. a "dev" build, accepts any version, a
+// tagged one only another tagged one.
+func checkNotOlder(version string, installedOutput string) error {
+	_, installed, ok := splitVersion(installedOutput)
+	if !ok {
+		return nil
+	}
+	installedVersion, err := parseVersion(installed)
+	if err != nil {
+		return nil
+	}
+	newVersion, err := parseVersion(version)
+	if err != nil {
+		return fmt.Errorf("can't tell whether %s is older than the installed %s: %v", version, installed, err)
+	}
+	if newVersion.compare(installedVersion) < 0 {
+		return fmt.Errorf("version %s is older than the installed %s", version, installed)
+	}
+	return nil
+}
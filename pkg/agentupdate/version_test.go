@@ -0,0 +1,30 @@
+package agentupdate
+
+import "testing"
+
+func TestCheckNotOlder(t *testing.T) {
+	for _, test := range []struct {
+		version   string
+		installed string
+		wantErr   bool
+	}{
+		{version: "v1.2.0", installed: "arrakis-cmdserver version v1.2.0"},
+		{version: "v1.3.0", installed: "arrakis-cmdserver version v1.2.0"},
+		{version: "v1.2.0-3-gabc1234", installed: "arrakis-cmdserver version v1.2.0"},
+		{version: "v1.10", installed: "arrakis-cmdserver version v1.9.9-dirty"},
+		{version: "v1.2.0", installed: "arrakis-cmdserver version v1.2.0-3-gabc1234", wantErr: true},
+		{version: "v1.1.9", installed: "arrakis-cmdserver version v1.2.0", wantErr: true},
+		{version: "v1.2", installed: "arrakis-cmdserver version v1.2.1", wantErr: true},
+		// An untagged build can't be ordered against a tagged one.
+		{version: "dev", installed: "arrakis-cmdserver version v1.2.0", wantErr: true},
+		{version: "abc1234", installed: "arrakis-cmdserver version v1.2.0", wantErr: true},
+		// Nor can anything against an untagged build.
+		{version: "v0.1.0", installed: "arrakis-cmdserver version dev"},
+		{version: "v0.1.0", installed: "garbage"},
+	} {
+		err := checkNotOlder(test.version, test.installed)
+		if (err != nil) != test.wantErr {
+			t.Errorf("checkNotOlder(%q, %q) = %v, want error %v", test.version, test.installed, err, test.wantErr)
+		}
+	}
+}
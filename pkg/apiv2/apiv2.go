@@ -0,0 +1,408 @@
+// Package apiv2 serves version 2 of the REST API by adapting the handlers of
+// version 1, which keep serving /v1 unchanged. Compared to v1, v2:
+//
+//   - answers every error with the envelope {"error": {"code", "message",
+//     "status"}}, with a code for every status, not only for the errors
+//     clients act on;
+//   - addresses VMs by their ID only, not by name;
+//   - creates and snapshots VMs asynchronously, answering 202 with an
+//     operation to poll;
+//   - paginates lists with pageSize and pageToken.
+package apiv2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Header names the API version that served a response.
+	Header = "Arrakis-API-Version"
+
+	// DefaultPageSize and MaxPageSize bound the items of a list page.
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+
+	v1Prefix = "/v1"
+	v2Prefix = "/v2"
+)
+
+// Versions are the API versions served, oldest first.
+var Versions = []string{"v1", "v2"}
+
+// Route matches requests by method and by path below the version prefix,
+// e.g. "/vms/*/snapshots". "*" matches any path element.
+type Route struct {
+	Method string
+	Path   string
+}
+
+// List is a list route whose items v2 paginates.
+type List struct {
+	Path string
+	// Field holds the items in the response, e.g. "vms".
+	Field string
+	// Key is the field of the items they are ordered and paged by, e.g.
+	// "vmId".
+	Key string
+	// Unless is a query parameter that turns pagination off, e.g. "since"
+	// for the changes to a list, whose revision covers every item.
+	Unless string
+}
+
+// Collection is a collection whose members v2 addresses by ID only.
+type Collection struct {
+	// Path is the collection's, e.g. "/vms".
+	Path string
+	// Static are the path elements below Path that aren't members, e.g.
+	// "import".
+	Static []string
+}
+
+// Options are the routes of v1 that v2 adapts.
+type Options struct {
+	// Async routes answer with an operation when asked with async=true.
+	Async []Route
+	// Lists are paginated.
+	Lists []List
+	// ByID are collections addressed by ID.
+	ByID []Collection
+}
+
+// Error is the error of an error response in v2, which is {"error": Error}.
+type Error struct {
+	// Code identifies the error for clients to act on, e.g. "not_found" or
+	// "host_cordoned".
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Status is the HTTP status of the response.
+	Status int `json:"status"`
+	// Reason is why the request was refused, if known.
+	Reason string `json:"reason,omitempty"`
+}
+
+// codes are the codes of the errors v1 answers without one, by status.
+var codes = map[int]string{
+	http.StatusBadRequest:            "invalid_argument",
+	http.StatusUnauthorized:          "unauthenticated",
+	http.StatusForbidden:             "permission_denied",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "failed_precondition",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusTooManyRequests:       "resource_exhausted",
+	http.StatusNotImplemented:        "unimplemented",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "deadline_exceeded",
+}
+
+// Code returns the code of an error answered with status.
+func Code(status int) string {
+	if code, ok := codes[status]; ok {
+		return code
+	}
+	if status < http.StatusInternalServerError {
+		return "failed_request"
+	}
+	return "internal"
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// IsID reports whether s is shaped like an ID, i.e. a lowercase UUID.
+func IsID(s string) bool {
+	return uuidPattern.MatchString(s)
+}
+
+// Handler serves /v2 with the handlers of v1 and passes every other request
+// to v1 unchanged.
+func Handler(v1 http.Handler, opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != v2Prefix && !strings.HasPrefix(r.URL.Path, v2Prefix+"/") {
+			v1.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(Header, "v2")
+		path := strings.TrimPrefix(r.URL.Path, v2Prefix)
+
+		for _, c := range opts.ByID {
+			if elem, ok := member(c, path); ok && !IsID(elem) {
+				writeError(w, Error{
+					Code:    Code(http.StatusNotFound),
+					Message: fmt.Sprintf("%q is not an ID, v2 addresses %s by ID only", elem, strings.TrimPrefix(c.Path, "/")),
+					Status:  http.StatusNotFound,
+				})
+				return
+			}
+		}
+
+		r = r.Clone(r.Context())
+		r.URL.Path = v1Prefix + path
+		if r.URL.RawPath != "" {
+			r.URL.RawPath = v1Prefix + strings.TrimPrefix(r.URL.RawPath, v2Prefix)
+		}
+		query := r.URL.Query()
+		for _, route := range opts.Async {
+			if r.Method == route.Method && match(route.Path, path) {
+				query.Set("async", "true")
+			}
+		}
+		r.URL.RawQuery = query.Encode()
+		r.RequestURI = r.URL.RequestURI()
+
+		rw := &responseWriter{ResponseWriter: w}
+		for _, list := range opts.Lists {
+			if r.Method != http.MethodGet || !match(list.Path, path) || (list.Unless != "" && query.Has(list.Unless)) {
+				continue
+			}
+			size, after, err := pageParams(query)
+			if err != nil {
+				writeError(w, Error{
+					Code:    Code(http.StatusBadRequest),
+					Message: err.Error(),
+					Status:  http.StatusBadRequest,
+				})
+				return
+			}
+			rw.paginate = func(body []byte) ([]byte, error) {
+				return paginate(body, list, size, after)
+			}
+		}
+		v1.ServeHTTP(rw, r)
+		rw.finish()
+	})
+}
+
+// member returns the path element naming a member of c in path, if path is
+// within c.
+func member(c Collection, path string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, c.Path+"/")
+	if !ok {
+		return "", false
+	}
+	elem, _, _ := strings.Cut(rest, "/")
+	for _, static := range c.Static {
+		if elem == static {
+			return "", false
+		}
+	}
+	return elem, true
+}
+
+// match reports whether path matches pattern, element by element.
+func match(pattern string, path string) bool {
+	patternElems := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathElems := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternElems) != len(pathElems) {
+		return false
+	}
+	for i, elem := range patternElems {
+		if elem != "*" && elem != pathElems[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pageParams returns the page size and the key after which the page starts.
+func pageParams(query url.Values) (int, string, error) {
+	size := DefaultPageSize
+	if param := query.Get("pageSize"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n <= 0 || n > MaxPageSize {
+			return 0, "", fmt.Errorf("invalid pageSize %q, it must be between 1 and %d", param, MaxPageSize)
+		}
+		size = n
+	}
+	var after string
+	if token := query.Get("pageToken"); token != "" {
+		key, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil || len(key) == 0 {
+			return 0, "", fmt.Errorf("invalid pageToken %q", token)
+		}
+		after = string(key)
+	}
+	return size, after, nil
+}
+
+// paginate returns the page of the items of a list response ordered by
+// key, of at most size items after the key after, with nextPageToken set
+// if more follow.
+func paginate(body []byte, list List, size int, after string) ([]byte, error) {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode list: %w", err)
+	}
+	var items []json.RawMessage
+	if raw, ok := resp[list.Field]; ok {
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", list.Field, err)
+		}
+	}
+	keys := make([]string, len(items))
+	for i, item := range items {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(item, &fields); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", list.Field, err)
+		}
+		// Items without a key sort first and are only ever on the first
+		// page.
+		json.Unmarshal(fields[list.Key], &keys[i])
+	}
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return keys[order[i]] < keys[order[j]] })
+
+	page := make([]json.RawMessage, 0, size)
+	var last, next string
+	for _, i := range order {
+		if after != "" && keys[i] <= after {
+			continue
+		}
+		if len(page) == size {
+			next = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		page = append(page, items[i])
+		last = keys[i]
+	}
+
+	raw, err := json.Marshal(page)
+	if err != nil {
+		return nil, err
+	}
+	resp[list.Field] = raw
+	if next != "" {
+		resp["nextPageToken"], _ = json.Marshal(next)
+	}
+	return json.Marshal(resp)
+}
+
+// writeError answers with the error envelope of v2.
+func writeError(w http.ResponseWriter, e Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(struct {
+		Error Error `json:"error"`
+	}{e})
+}
+
+// envelope returns the v2 error of a v1 error response: v1 answers
+// {"error": {"message", "code"?, "reason"?}} or, for errors outside the
+// handlers, plain text.
+func envelope(status int, body []byte) Error {
+	e := Error{Status: status}
+	var resp struct {
+		Error *struct {
+			Message string `json:"message"`
+			Code    string `json:"code"`
+			Reason  string `json:"reason"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Error != nil {
+		e.Message, e.Code, e.Reason = resp.Error.Message, resp.Error.Code, resp.Error.Reason
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if e.Code == "" {
+		e.Code = Code(status)
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+	return e
+}
+
+// responseWriter adapts the responses of v1 to v2. It holds back error
+// responses and the list responses to paginate, and streams every other
+// response through. It supports hijacking for the WebSocket endpoints and
+// flushing for streamed responses.
+type responseWriter struct {
+	http.ResponseWriter
+	// paginate returns the page of a list response, nil unless listing.
+	paginate func([]byte) ([]byte, error)
+
+	status   int
+	buffered bool
+	body     bytes.Buffer
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if location := w.Header().Get("Location"); strings.HasPrefix(location, v1Prefix+"/") {
+		w.Header().Set("Location", v2Prefix+strings.TrimPrefix(location, v1Prefix))
+	}
+	if status >= http.StatusBadRequest || (status == http.StatusOK && w.paginate != nil) {
+		w.buffered = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffered {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	if w.buffered {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer doesn't support hijacking")
+	}
+	return h.Hijack()
+}
+
+// finish writes the response held back.
+func (w *responseWriter) finish() {
+	if !w.buffered {
+		return
+	}
+	if w.status >= http.StatusBadRequest {
+		writeError(w.ResponseWriter, envelope(w.status, w.body.Bytes()))
+		return
+	}
+	page, err := w.paginate(w.body.Bytes())
+	if err != nil {
+		writeError(w.ResponseWriter, Error{
+			Code:    Code(http.StatusInternalServerError),
+			Message: fmt.Sprintf("Failed to paginate: %v", err),
+			Status:  http.StatusInternalServerError,
+		})
+		return
+	}
+	w.ResponseWriter.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(append(page, '\n'))
+}
@@ -0,0 +1,182 @@
+package apiv2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const vmID = "0b6b0c3e-2f0a-4c3e-9d2a-6c1f9e8a7b5d"
+
+var testOptions = Options{
+	Async: []Route{{Method: http.MethodPost, Path: "/vms"}, {Method: http.MethodPost, Path: "/vms/*/snapshots"}},
+	Lists: []List{{Path: "/vms", Field: "vms", Key: "vmId", Unless: "since"}},
+	ByID:  []Collection{{Path: "/vms", Static: []string{"import"}}},
+}
+
+// v1 is a stand-in for the v1 API: it echoes the request, lists 5 VMs and
+// fails the way v1 handlers do.
+func v1() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/vms", func(w http.ResponseWriter, r *http.Request) {
+		var vms []map[string]string
+		for i := 5; i > 0; i-- {
+			vms = append(vms, map[string]string{"vmId": fmt.Sprintf("id-%d", i)})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"vms": vms, "revision": "r1"})
+	})
+	mux.HandleFunc("POST /v1/vms", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/v1/operations/op1")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"path":%q,"async":%q}`, r.URL.Path, r.URL.Query().Get("async"))
+	})
+	mux.HandleFunc("GET /v1/vms/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("name") != vmID {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"message":"VM not found"}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"vmId":%q}`, vmID)
+	})
+	mux.HandleFunc("POST /v1/vms/import", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"error":{"message":"Host is cordoned","code":"host_cordoned","reason":"kernel upgrade"}}`)
+	})
+	mux.HandleFunc("GET /v1/health", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "stepping down", http.StatusServiceUnavailable)
+	})
+	return mux
+}
+
+func serve(t *testing.T, method string, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler(v1(), testOptions).ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) Error {
+	t.Helper()
+	var resp struct {
+		Error Error `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode %q: %v", w.Body.String(), err)
+	}
+	return resp.Error
+}
+
+func TestV1Unchanged(t *testing.T) {
+	w := serve(t, http.MethodGet, "/v1/vms/web")
+	if w.Code != http.StatusNotFound || w.Body.String() != `{"error":{"message":"VM not found"}}` {
+		t.Errorf("GET /v1/vms/web = %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get(Header) != "" {
+		t.Errorf("%s = %q on v1", Header, w.Header().Get(Header))
+	}
+
+	w = serve(t, http.MethodGet, "/v1/vms")
+	var resp map[string]json.RawMessage
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if _, ok := resp["nextPageToken"]; ok {
+		t.Errorf("GET /v1/vms is paginated: %s", w.Body.String())
+	}
+}
+
+func TestErrors(t *testing.T) {
+	w := serve(t, http.MethodGet, "/v2/vms/"+vmID[:len(vmID)-1]+"0")
+	if e := decodeError(t, w); w.Code != http.StatusNotFound || e != (Error{Code: "not_found", Message: "VM not found", Status: http.StatusNotFound}) {
+		t.Errorf("GET unknown VM = %d %+v", w.Code, e)
+	}
+	if w.Header().Get(Header) != "v2" {
+		t.Errorf("%s = %q", Header, w.Header().Get(Header))
+	}
+
+	w = serve(t, http.MethodPost, "/v2/vms/import")
+	if e := decodeError(t, w); e != (Error{Code: "host_cordoned", Message: "Host is cordoned", Status: http.StatusServiceUnavailable, Reason: "kernel upgrade"}) {
+		t.Errorf("POST /v2/vms/import = %+v", e)
+	}
+
+	w = serve(t, http.MethodGet, "/v2/health")
+	if e := decodeError(t, w); e != (Error{Code: "unavailable", Message: "stepping down", Status: http.StatusServiceUnavailable}) {
+		t.Errorf("GET /v2/health = %+v", e)
+	}
+
+	w = serve(t, http.MethodGet, "/v2/nope")
+	if e := decodeError(t, w); w.Code != http.StatusNotFound || e.Code != "not_found" {
+		t.Errorf("GET /v2/nope = %d %+v", w.Code, e)
+	}
+}
+
+func TestByID(t *testing.T) {
+	w := serve(t, http.MethodGet, "/v2/vms/"+vmID)
+	if w.Code != http.StatusOK || w.Body.String() != fmt.Sprintf(`{"vmId":%q}`, vmID) {
+		t.Errorf("GET by ID = %d %q", w.Code, w.Body.String())
+	}
+
+	w = serve(t, http.MethodGet, "/v2/vms/web")
+	if e := decodeError(t, w); w.Code != http.StatusNotFound || e.Code != "not_found" {
+		t.Errorf("GET by name = %d %+v, want not_found", w.Code, e)
+	}
+}
+
+func TestAsync(t *testing.T) {
+	w := serve(t, http.MethodPost, "/v2/vms?async=false")
+	if w.Code != http.StatusAccepted || w.Body.String() != `{"path":"/v1/vms","async":"true"}` {
+		t.Errorf("POST /v2/vms = %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Location"); got != "/v2/operations/op1" {
+		t.Errorf("Location = %q", got)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	type page struct {
+		VMs []struct {
+			VMID string `json:"vmId"`
+		} `json:"vms"`
+		Revision      string `json:"revision"`
+		NextPageToken string `json:"nextPageToken"`
+	}
+	var ids []string
+	target := "/v2/vms?pageSize=2"
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("too many pages, got %v", ids)
+		}
+		w := serve(t, http.MethodGet, target)
+		var p page
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %q", target, w.Code, w.Body.String())
+		}
+		if p.Revision != "r1" {
+			t.Errorf("revision = %q, want the rest of the response kept", p.Revision)
+		}
+		for _, vm := range p.VMs {
+			ids = append(ids, vm.VMID)
+		}
+		if p.NextPageToken == "" {
+			break
+		}
+		target = "/v2/vms?pageSize=2&pageToken=" + p.NextPageToken
+	}
+	if fmt.Sprint(ids) != "[id-1 id-2 id-3 id-4 id-5]" {
+		t.Errorf("pages = %v", ids)
+	}
+
+	var p page
+	json.Unmarshal(serve(t, http.MethodGet, "/v2/vms?since=r0").Body.Bytes(), &p)
+	if len(p.VMs) != 5 || p.NextPageToken != "" {
+		t.Errorf("changes are paginated: %+v", p)
+	}
+
+	for _, query := range []string{"pageSize=0", "pageSize=1001", "pageSize=x", "pageToken=!!"} {
+		w := serve(t, http.MethodGet, "/v2/vms?"+query)
+		if e := decodeError(t, w); w.Code != http.StatusBadRequest || e.Code != "invalid_argument" {
+			t.Errorf("GET /v2/vms?%s = %d %+v", query, w.Code, e)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package cmdserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ArtifactsDir is where programs in the guest drop files they want to hand
+	// back to the host, e.g. screenshots, recordings or reports. Everything
+	// below it is listed as an artifact.
+	ArtifactsDir = "/artifacts"
+
+	// uploadPrefix names artifacts being written by Put, which aren't listed
+	// until they are complete.
+	uploadPrefix = ".upload-"
+)
+
+// Artifact describes a file in the artifacts directory.
+type Artifact struct {
+	// Path relative to the artifacts directory, with forward slashes.
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+	ContentType string    `json:"contentType"`
+	SHA256      string    `json:"sha256"`
+}
+
+// ArtifactsResponse lists the artifacts of a guest.
+type ArtifactsResponse struct {
+	Artifacts []Artifact `json:"artifacts"`
+}
+
+// ArtifactIndex tracks the files in an artifacts directory. Checksums are
+// only recomputed for files whose size or modification time changed since
+// they were last listed.
+type ArtifactIndex struct {
+	dir   string
+	lock  sync.Mutex
+	cache map[string]Artifact
+}
+
+// NewArtifactIndex returns an index of dir.
+func NewArtifactIndex(dir string) *ArtifactIndex {
+	return &ArtifactIndex{
+		dir:   dir,
+		cache: make(map[string]Artifact),
+	}
+}
+
+// List returns the current artifacts sorted by path. A missing directory has
+// no artifacts.
+func (i *ArtifactIndex) List() ([]Artifact, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	artifacts := []Artifact{}
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(i.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == i.dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), uploadPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(i.dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		cached, ok := i.cache[rel]
+		if ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+			artifacts = append(artifacts, cached)
+			return nil
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			// The file may have been removed while walking.
+			return nil
+		}
+		artifact := Artifact{
+			Path:        rel,
+			Size:        info.Size(),
+			ModTime:     info.ModTime(),
+			ContentType: artifactContentType(rel),
+			SHA256:      sum,
+		}
+		i.cache[rel] = artifact
+		artifacts = append(artifacts, artifact)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list artifacts in %s: %w", i.dir, err)
+	}
+
+	for rel := range i.cache {
+		if !seen[rel] {
+			delete(i.cache, rel)
+		}
+	}
+	sort.Slice(artifacts, func(a, b int) bool { return artifacts[a].Path < artifacts[b].Path })
+	return artifacts, nil
+}
+
+// Open opens the artifact at the relative path rel. Paths escaping the
+// artifacts directory are rejected.
+func (i *ArtifactIndex) Open(rel string) (*os.File, error) {
+	clean := filepath.Clean("/" + rel)
+	if clean == "/" || strings.Contains(rel, "\x00") {
+		return nil, fmt.Errorf("invalid artifact path %q", rel)
+	}
+	file, err := os.Open(filepath.Join(i.dir, clean))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("artifact %q is not a regular file", rel)
+	}
+	return file, nil
+}
+
+// Put writes the artifact at the relative path rel from r, replacing it if
+// it exists, and returns its path as it is listed. The artifact only appears
+// once it is complete.
+func (i *ArtifactIndex) Put(rel string, r io.Reader) (string, error) {
+	clean := filepath.Clean("/" + rel)
+	if clean == "/" || strings.Contains(rel, "\x00") {
+		return "", fmt.Errorf("invalid artifact path %q", rel)
+	}
+	dest := filepath.Join(i.dir, clean)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), uploadPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write artifact %q: %w", rel, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return strings.TrimPrefix(clean, "/"), nil
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func artifactContentType(path string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
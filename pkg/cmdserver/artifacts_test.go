@@ -0,0 +1,95 @@
+package cmdserver
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArtifactIndex(t *testing.T) {
+	dir := t.TempDir()
+	index := NewArtifactIndex(dir)
+
+	if artifacts, err := index.List(); err != nil || len(artifacts) != 0 {
+		t.Fatalf("List() on an empty dir = %v, %v", artifacts, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "shots"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "shots", "1.png"), []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "report.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	artifacts, err := index.List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	if len(artifacts) != 2 {
+		t.Fatalf("List() returned %d artifacts, want 2", len(artifacts))
+	}
+	report, shot := artifacts[0], artifacts[1]
+	if report.Path != "report.json" || report.ContentType != "application/json" || report.Size != 2 {
+		t.Errorf("report listed as %+v", report)
+	}
+	if shot.Path != "shots/1.png" || shot.ContentType != "image/png" {
+		t.Errorf("screenshot listed as %+v", shot)
+	}
+	// sha256("{}")
+	if report.SHA256 != "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a" {
+		t.Errorf("report checksum = %s", report.SHA256)
+	}
+
+	os.Remove(filepath.Join(dir, "report.json"))
+	if artifacts, _ := index.List(); len(artifacts) != 1 {
+		t.Errorf("List() after removing a file returned %d artifacts, want 1", len(artifacts))
+	}
+
+	file, err := index.Open("shots/1.png")
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	content, _ := io.ReadAll(file)
+	file.Close()
+	if string(content) != "png" {
+		t.Errorf("Open() read %q", content)
+	}
+
+	outside := filepath.Join(filepath.Dir(dir), "secret")
+	os.WriteFile(outside, []byte("secret"), 0644)
+	defer os.Remove(outside)
+	for _, path := range []string{"../secret", "shots/../../secret", "", "shots"} {
+		if file, err := index.Open(path); err == nil {
+			file.Close()
+			t.Errorf("Open(%q) succeeded, want an error", path)
+		}
+	}
+}
+
+func TestArtifactIndexPut(t *testing.T) {
+	dir := t.TempDir()
+	index := NewArtifactIndex(dir)
+
+	rel, err := index.Put("../reports/run.txt", strings.NewReader("done"))
+	if err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	if rel != "reports/run.txt" {
+		t.Errorf("Put() = %q, want reports/run.txt", rel)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "reports", "run.txt")); string(data) != "done" {
+		t.Errorf("artifact content = %q", data)
+	}
+	os.WriteFile(filepath.Join(dir, uploadPrefix+"partial"), []byte("x"), 0644)
+	if artifacts, _ := index.List(); len(artifacts) != 1 || artifacts[0].Path != "reports/run.txt" {
+		t.Errorf("List() = %+v, want only the complete artifact", artifacts)
+	}
+	if _, err := index.Put("", strings.NewReader("x")); err == nil {
+		t.Error("Put() of an empty path succeeded")
+	}
+}
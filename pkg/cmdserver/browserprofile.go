@@ -0,0 +1,346 @@
+package cmdserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// BrowserProfileDir is the user-data-dir Chrome runs with, see
+	// arrakis-chrome.service.
+	BrowserProfileDir = "/home/elara/.chrome-data"
+	// BrowserUnit runs Chrome.
+	BrowserUnit = "arrakis-chrome.service"
+	// BrowserUser owns Chrome's profile.
+	BrowserUser = "elara"
+	// MaxBrowserProfileArchiveSize bounds the zipped profiles the agent
+	// accepts.
+	MaxBrowserProfileArchiveSize = 1 << 30
+	// maxBrowserProfileSize bounds the size of a profile once extracted, to
+	// guard against zip bombs.
+	maxBrowserProfileSize = 4 << 30
+)
+
+// ErrInvalidProfile is returned for archives that aren't a usable profile.
+var ErrInvalidProfile = errors.New("invalid browser profile")
+
+// ErrInvalidBrowser is returned for browser IDs that can't name a unit.
+var ErrInvalidBrowser = errors.New("invalid browser")
+
+// BrowserRestartRequest asks the agent to restart one of the guest's
+// browsers.
+type BrowserRestartRequest struct {
+	// Browser is the ID of the browser, "" for the default one.
+	Browser string `json:"browser,omitempty"`
+}
+
+// BrowserUnitOf returns the unit running the browser browserID: BrowserUnit
+// for the default browser, and an instance of the arrakis-chrome@ template
+// for the others, e.g. arrakis-chrome@profile2.service.
+func BrowserUnitOf(browserID string) (string, error) {
+	if browserID == "" {
+		return BrowserUnit, nil
+	}
+	for _, c := range browserID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "", fmt.Errorf("%w: %q, IDs are made of letters, digits, - and _", ErrInvalidBrowser, browserID)
+		}
+	}
+	return strings.TrimSuffix(BrowserUnit, ".service") + "@" + browserID + ".service", nil
+}
+
+// BrowserProfileResponse reports what was installed by a profile seed.
+type BrowserProfileResponse struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// ProfileSeeder replaces Chrome's profile with one from a zipped
+// user-data-dir, e.g. a golden profile with bookmarks, extensions and
+// logins.
+type ProfileSeeder struct {
+	dir  string
+	unit string
+	// owner is the user the profile is handed to. Empty keeps the agent's.
+	owner string
+	// run executes a command. Replaced in tests.
+	run func(ctx context.Context, args ...string) error
+
+	lock sync.Mutex
+}
+
+// NewProfileSeeder returns a seeder of the profile in dir, used by the
+// browser that unit runs as owner.
+func NewProfileSeeder(dir string, unit string, owner string) *ProfileSeeder {
+	return &ProfileSeeder{dir: dir, unit: unit, owner: owner, run: runCommand}
+}
+
+// Seed extracts the zipped profile at archive and restarts the browser with
+// it in place of the current one. Archives holding a single directory are
+// taken to hold the profile in it. Chrome's locks of the machine the profile
+// was made on are left out.
+func (p *ProfileSeeder) Seed(ctx context.Context, archive string) (BrowserProfileResponse, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	staging := p.dir + ".seeding"
+	if err := os.RemoveAll(staging); err != nil {
+		return BrowserProfileResponse{}, err
+	}
+	defer os.RemoveAll(staging)
+	resp, err := extractProfile(archive, staging)
+	if err != nil {
+		return BrowserProfileResponse{}, err
+	}
+	if err := p.chown(staging); err != nil {
+		return BrowserProfileResponse{}, fmt.Errorf("failed to hand profile to %s: %w", p.owner, err)
+	}
+
+	if err := p.run(ctx, "systemctl", "stop", p.unit); err != nil {
+		return BrowserProfileResponse{}, fmt.Errorf("failed to stop browser: %w", err)
+	}
+	previous := p.dir + ".previous"
+	os.RemoveAll(previous)
+	if err := os.Rename(p.dir, previous); err != nil && !os.IsNotExist(err) {
+		p.run(ctx, "systemctl", "start", p.unit)
+		return BrowserProfileResponse{}, fmt.Errorf("failed to move current profile away: %w", err)
+	}
+	if err := os.Rename(staging, p.dir); err != nil {
+		os.Rename(previous, p.dir)
+		p.run(ctx, "systemctl", "start", p.unit)
+		return BrowserProfileResponse{}, fmt.Errorf("failed to install profile: %w", err)
+	}
+	os.RemoveAll(previous)
+	if err := p.run(ctx, "systemctl", "start", p.unit); err != nil {
+		return BrowserProfileResponse{}, fmt.Errorf("profile installed but failed to start browser: %w", err)
+	}
+	return resp, nil
+}
+
+// RestartBrowser restarts the browser browserID, starting it if it isn't
+// running, e.g. after it crashed. A profile being seeded is waited for, as
+// seeding restarts the default browser anyway.
+func (p *ProfileSeeder) RestartBrowser(ctx context.Context, browserID string) error {
+	unit, err := BrowserUnitOf(browserID)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if browserID == "" {
+		unit = p.unit
+	}
+	if err := p.run(ctx, "systemctl", "restart", unit); err != nil {
+		return fmt.Errorf("failed to restart %s: %w", unit, err)
+	}
+	return nil
+}
+
+// Reset restarts the browser on an empty profile, which Chrome fills in
+// anew on start.
+func (p *ProfileSeeder) Reset(ctx context.Context) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.run(ctx, "systemctl", "stop", p.unit); err != nil {
+		return fmt.Errorf("failed to stop browser: %w", err)
+	}
+	if err := os.RemoveAll(p.dir); err != nil {
+		p.run(ctx, "systemctl", "start", p.unit)
+		return fmt.Errorf("failed to remove profile: %w", err)
+	}
+	if err := p.run(ctx, "systemctl", "start", p.unit); err != nil {
+		return fmt.Errorf("profile removed but failed to start browser: %w", err)
+	}
+	return nil
+}
+
+func (p *ProfileSeeder) chown(dir string) error {
+	if p.owner == "" {
+		return nil
+	}
+	u, err := user.Lookup(p.owner)
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
+
+// isProfileLock reports whether name is one of the files by which Chrome
+// keeps other instances off a profile. They point at the machine the
+// profile was made on and would keep Chrome from starting.
+func isProfileLock(name string) bool {
+	return path.Dir(name) == "." && strings.HasPrefix(name, "Singleton")
+}
+
+// extractProfile extracts the zipped profile at archive into dir.
+func extractProfile(archive string, dir string) (BrowserProfileResponse, error) {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return BrowserProfileResponse{}, fmt.Errorf("%w: %v", ErrInvalidProfile, err)
+	}
+	defer r.Close()
+
+	prefix := commonDir(r.File)
+	var resp BrowserProfileResponse
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return resp, err
+	}
+	for _, f := range r.File {
+		name := strings.TrimPrefix(f.Name, prefix)
+		if name == "" {
+			// The directory holding the profile.
+			continue
+		}
+		clean := path.Clean(name)
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return resp, fmt.Errorf("%w: %s is outside the profile", ErrInvalidProfile, f.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(clean))
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return resp, err
+			}
+		case mode.IsRegular():
+			if isProfileLock(clean) {
+				continue
+			}
+			n, err := extractFile(f, target, maxBrowserProfileSize-resp.Bytes)
+			resp.Bytes += n
+			if err != nil {
+				return resp, err
+			}
+			resp.Files++
+		default:
+			// Symlinks and the like have no place in a profile, other than
+			// as locks.
+			continue
+		}
+	}
+	if resp.Files == 0 {
+		return resp, fmt.Errorf("%w: the archive holds no files", ErrInvalidProfile)
+	}
+	return resp, nil
+}
+
+// commonDir returns the directory, with a trailing slash, all the files of
+// an archive are in, or "" if they aren't in a single one.
+func commonDir(files []*zip.File) string {
+	var prefix string
+	for _, f := range files {
+		i := strings.Index(f.Name, "/")
+		if i < 0 {
+			return ""
+		}
+		if prefix == "" {
+			prefix = f.Name[:i+1]
+		} else if f.Name[:i+1] != prefix {
+			return ""
+		}
+	}
+	return prefix
+}
+
+func extractFile(f *zip.File, target string, budget int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return 0, err
+	}
+	src, err := f.Open()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %v", ErrInvalidProfile, f.Name, err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	n, err := io.Copy(dst, io.LimitReader(src, budget+1))
+	if err != nil {
+		return n, fmt.Errorf("%w: %s: %v", ErrInvalidProfile, f.Name, err)
+	}
+	if n > budget {
+		return n, fmt.Errorf("%w: larger than %d bytes once extracted", ErrInvalidProfile, int64(maxBrowserProfileSize))
+	}
+	return n, nil
+}
+
+// SeedBrowserProfile POSTs a zipped profile of size bytes to the agent's
+// /browser/profile endpoint at url.
+func SeedBrowserProfile(ctx context.Context, client *http.Client, url string, archive io.Reader, size int64) (BrowserProfileResponse, error) {
+	var resp BrowserProfileResponse
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, archive)
+	if err != nil {
+		return resp, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/zip")
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode >= http.StatusBadRequest {
+		var buf bytes.Buffer
+		buf.ReadFrom(httpResp.Body)
+		msg := strings.TrimSpace(buf.String())
+		if httpResp.StatusCode == http.StatusBadRequest {
+			return resp, fmt.Errorf("%w: %s", ErrInvalidProfile, strings.TrimPrefix(msg, ErrInvalidProfile.Error()+": "))
+		}
+		return resp, fmt.Errorf("request failed with status %d: %s", httpResp.StatusCode, msg)
+	}
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	return resp, err
+}
+
+// RestartBrowser POSTs a BrowserRestartRequest to the agent's
+// /browser/restart endpoint, or the REST API's per VM equivalent, at url.
+func RestartBrowser(ctx context.Context, client *http.Client, url string, browserID string) error {
+	body, err := json.Marshal(BrowserRestartRequest{Browser: browserID})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		msg := strings.TrimSpace(buf.String())
+		if resp.StatusCode == http.StatusBadRequest {
+			return fmt.Errorf("%w: %s", ErrInvalidBrowser, strings.TrimPrefix(msg, ErrInvalidBrowser.Error()+": "))
+		}
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package cmdserver
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "profile.zip")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return p
+}
+
+func TestProfileSeederSeed(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), ".chrome-data")
+	if err := os.MkdirAll(filepath.Join(dir, "Default"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "Default", "History"), []byte("old"), 0600)
+
+	var commands []string
+	seeder := NewProfileSeeder(dir, BrowserUnit, "")
+	seeder.run = func(ctx context.Context, args ...string) error {
+		commands = append(commands, strings.Join(args, " "))
+		return nil
+	}
+
+	// Zipped from the parent of the user-data-dir, so everything is in one
+	// directory.
+	archive := writeZip(t, map[string]string{
+		"golden/Local State":         "{}",
+		"golden/Default/Bookmarks":   "{\"roots\": {}}",
+		"golden/Default/Cookies":     "cookies",
+		"golden/SingletonLock":       "other-host-1234",
+		"golden/Default/Extensions/": "",
+	})
+	resp, err := seeder.Seed(context.Background(), archive)
+	if err != nil {
+		t.Fatalf("Seed failed: %v", err)
+	}
+	if resp.Files != 3 || resp.Bytes != int64(len("{}")+len("{\"roots\": {}}")+len("cookies")) {
+		t.Errorf("Seed = %+v", resp)
+	}
+	want := []string{"systemctl stop " + BrowserUnit, "systemctl start " + BrowserUnit}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %v, want %v", commands, want)
+	}
+
+	if content, err := os.ReadFile(filepath.Join(dir, "Default", "Bookmarks")); err != nil || string(content) != "{\"roots\": {}}" {
+		t.Errorf("Bookmarks = %q, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Default", "Extensions")); err != nil {
+		t.Errorf("empty directory not extracted: %v", err)
+	}
+	for _, gone := range []string{"SingletonLock", "Default/History"} {
+		if _, err := os.Stat(filepath.Join(dir, gone)); !os.IsNotExist(err) {
+			t.Errorf("%s is in the seeded profile", gone)
+		}
+	}
+	for _, leftover := range []string{dir + ".seeding", dir + ".previous"} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind", leftover)
+		}
+	}
+}
+
+func TestProfileSeederRejects(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), ".chrome-data")
+	os.MkdirAll(dir, 0700)
+	os.WriteFile(filepath.Join(dir, "Local State"), []byte("current"), 0600)
+	seeder := NewProfileSeeder(dir, BrowserUnit, "")
+	seeder.run = func(ctx context.Context, args ...string) error {
+		t.Errorf("browser restarted for a rejected profile: %v", args)
+		return nil
+	}
+
+	notZip := filepath.Join(t.TempDir(), "profile.zip")
+	os.WriteFile(notZip, []byte("not a zip"), 0644)
+	for name, archive := range map[string]string{
+		"escaping":  writeZip(t, map[string]string{"Local State": "{}", "../evil": "x"}),
+		"empty":     writeZip(t, map[string]string{"Default/": ""}),
+		"not a zip": notZip,
+	} {
+		if _, err := seeder.Seed(context.Background(), archive); !errors.Is(err, ErrInvalidProfile) {
+			t.Errorf("Seed(%s) = %v, want ErrInvalidProfile", name, err)
+		}
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "Local State")); string(content) != "current" {
+		t.Errorf("current profile changed to %q", content)
+	}
+}
+
+func TestProfileSeederRestartBrowser(t *testing.T) {
+	var commands []string
+	seeder := NewProfileSeeder(t.TempDir(), BrowserUnit, "")
+	seeder.run = func(ctx context.Context, args ...string) error {
+		commands = append(commands, strings.Join(args, " "))
+		return nil
+	}
+	for _, browserID := range []string{"", "profile2"} {
+		if err := seeder.RestartBrowser(context.Background(), browserID); err != nil {
+			t.Fatalf("RestartBrowser(%q) = %v", browserID, err)
+		}
+	}
+	want := []string{"systemctl restart arrakis-chrome.service", "systemctl restart arrakis-chrome@profile2.service"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+
+	for _, browserID := range []string{"../x", "a b", "p;rm"} {
+		if err := seeder.RestartBrowser(context.Background(), browserID); !errors.Is(err, ErrInvalidBrowser) {
+			t.Errorf("RestartBrowser(%q) = %v, want ErrInvalidBrowser", browserID, err)
+		}
+	}
+}
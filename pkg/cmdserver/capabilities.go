@@ -0,0 +1,103 @@
+package cmdserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// CapabilitiesDir holds one YAML declaration per capability the guest
+	// image provides. Images and users add capabilities by dropping files here.
+	CapabilitiesDir = "/etc/arrakis/capabilities.d"
+
+	capabilityProbeTimeout = time.Second
+)
+
+// Capability is an operation a guest image supports, such as browser control
+// or code execution.
+type Capability struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description"`
+	Version     string `json:"version,omitempty" yaml:"version"`
+	// Protocol spoken on Port, e.g. "cdp", "vnc" or "http".
+	Protocol string `json:"protocol,omitempty" yaml:"protocol"`
+	// Port is the guest port serving the capability, if any.
+	Port int `json:"port,omitempty" yaml:"port"`
+	// Health is an HTTP path on Port that succeeds once the capability is
+	// ready. Without it the port accepting connections is enough.
+	Health string `json:"health,omitempty" yaml:"health"`
+	// Unit is a systemd unit that must be active for the capability to be
+	// available. It is not reported.
+	Unit string `json:"-" yaml:"unit"`
+	// Available and Error are filled in by Probe.
+	Available bool   `json:"available"`
+	Error     string `json:"error,omitempty" yaml:"-"`
+}
+
+// CapabilitiesResponse lists the capabilities of a guest.
+type CapabilitiesResponse struct {
+	Capabilities []Capability `json:"capabilities"`
+}
+
+// LoadCapabilities reads the declarations in dir. A missing directory yields
+// no capabilities; invalid declarations are returned as unavailable
+// capabilities carrying the error so that they show up when listing.
+func LoadCapabilities(dir string) ([]Capability, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var capabilities []Capability
+	for _, path := range paths {
+		var capability Capability
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = yaml.Unmarshal(data, &capability)
+		}
+		if err == nil && capability.Name == "" {
+			err = fmt.Errorf("missing name")
+		}
+		if err != nil {
+			capabilities = append(capabilities, Capability{
+				Name:  filepath.Base(path),
+				Error: fmt.Sprintf("invalid declaration %s: %v", path, err),
+			})
+			continue
+		}
+		capabilities = append(capabilities, capability)
+	}
+	return capabilities, nil
+}
+
+// Probe checks whether the capability is currently usable: its unit, if any,
+// must be active and its port, if any, must pass its health check.
+func (c *Capability) Probe(ctx context.Context) {
+	if c.Error != "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, capabilityProbeTimeout)
+	defer cancel()
+
+	if c.Unit != "" {
+		if err := exec.CommandContext(ctx, "systemctl", "is-active", "--quiet", c.Unit).Run(); err != nil {
+			c.Error = fmt.Sprintf("unit %s is not active", c.Unit)
+			return
+		}
+	}
+	if c.Port != 0 {
+		if err := checkEndpoint(ctx, c.Port, c.Health); err != nil {
+			c.Error = err.Error()
+			return
+		}
+	}
+	c.Available = true
+}
@@ -0,0 +1,68 @@
+package cmdserver
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCapabilities(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"browser.yaml": "name: browser\nprotocol: cdp\nport: 9223\nunit: arrakis-chrome.service\n",
+		"broken.yaml":  "name: [\n",
+		"noname.yaml":  "protocol: http\n",
+		"ignored.txt":  "name: ignored\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	capabilities, err := LoadCapabilities(dir)
+	if err != nil {
+		t.Fatalf("LoadCapabilities failed: %v", err)
+	}
+	if len(capabilities) != 3 {
+		t.Fatalf("Loaded %d capabilities, want 3: %+v", len(capabilities), capabilities)
+	}
+	// Sorted by file name.
+	if c := capabilities[0]; c.Name != "broken.yaml" || c.Error == "" {
+		t.Errorf("Invalid declaration loaded as %+v", c)
+	}
+	if c := capabilities[1]; c.Name != "browser" || c.Port != 9223 || c.Unit != "arrakis-chrome.service" || c.Error != "" {
+		t.Errorf("browser loaded as %+v", c)
+	}
+	if c := capabilities[2]; !strings.Contains(c.Error, "missing name") {
+		t.Errorf("Declaration without a name loaded as %+v", c)
+	}
+
+	if capabilities, err := LoadCapabilities(filepath.Join(dir, "missing")); err != nil || len(capabilities) != 0 {
+		t.Errorf("LoadCapabilities on a missing dir = %v, %v; want nothing", capabilities, err)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	up := Capability{Name: "up", Port: port}
+	up.Probe(context.Background())
+	if !up.Available || up.Error != "" {
+		t.Errorf("Capability on a listening port probed as %+v", up)
+	}
+
+	listener.Close()
+	down := Capability{Name: "down", Port: port}
+	down.Probe(context.Background())
+	if down.Available || down.Error == "" {
+		t.Errorf("Capability on a closed port probed as %+v", down)
+	}
+}
@@ -1,5 +1,10 @@
 package cmdserver
 
+// AgentTLSDir holds the agent's mutual TLS certificates, laid out as a PKI dir
+// with ca.crt, agent.crt and agent.key. Without them the agent serves plain
+// HTTP.
+const AgentTLSDir = "/etc/arrakis/tls"
+
 // fileData represents a single file's content and metadata.
 type FileData struct {
 	Content string `json:"content"`
@@ -27,4 +32,14 @@ type FilesPostRequest struct {
 type RunCmdResponse struct {
 	Output string `json:"output,omitempty"`
 	Error  string `json:"error,omitempty"`
+	// LimitExceeded is the limit of the request that stopped the command.
+	LimitExceeded *LimitExceeded `json:"limitExceeded,omitempty"`
+}
+
+// RunCmdRequest runs a command with bash, and waits for it to exit unless
+// Blocking is false.
+type RunCmdRequest struct {
+	Cmd      string     `json:"cmd"`
+	Blocking bool       `json:"blocking"`
+	Limits   ExecLimits `json:"limits"`
 } 
\ No newline at end of file
@@ -0,0 +1,241 @@
+package cmdserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// MaxClipboardSize bounds the text put on, or read from, a desktop's
+	// clipboard.
+	MaxClipboardSize = 1 << 20
+	// desktopCommandWaitDelay bounds waiting for the output of desktop
+	// commands once they exited: xclip leaves a child serving the selection
+	// and xdg-open the app it opened, both holding the output open.
+	desktopCommandWaitDelay = time.Second
+)
+
+// ErrInvalidDesktopRequest is returned for URLs, clipboard contents or
+// displays the desktop can't be driven with.
+var ErrInvalidDesktopRequest = errors.New("invalid desktop request")
+
+// OpenURLRequest asks the agent to open a URL with the desktop's default
+// handler, e.g. a web page in the default browser.
+type OpenURLRequest struct {
+	URL string `json:"url"`
+	// Display is the desktop's X display, DefaultDisplay if nil.
+	Display *int `json:"display,omitempty"`
+}
+
+// ClipboardContent is the text of a desktop's clipboard.
+type ClipboardContent struct {
+	Text string `json:"text"`
+	// Display is the desktop's X display, DefaultDisplay if nil.
+	Display *int `json:"display,omitempty"`
+}
+
+// displayOf returns display, DefaultDisplay if nil, checking that it can be
+// a desktop's.
+func displayOf(display *int) (int, error) {
+	if display == nil {
+		return DefaultDisplay, nil
+	}
+	if _, err := DesktopPort(*display); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidDesktopRequest, err)
+	}
+	return *display, nil
+}
+
+// Validate checks that the URL is absolute and the display valid.
+func (req OpenURLRequest) Validate() error {
+	u, err := url.Parse(req.URL)
+	if err != nil || u.Scheme == "" {
+		return fmt.Errorf("%w: the url must be absolute, e.g. https://example.com", ErrInvalidDesktopRequest)
+	}
+	_, err = displayOf(req.Display)
+	return err
+}
+
+// Validate checks that the text can be put on the clipboard and the display
+// is valid.
+func (c ClipboardContent) Validate() error {
+	if len(c.Text) > MaxClipboardSize {
+		return fmt.Errorf("%w: the clipboard is limited to %d bytes", ErrInvalidDesktopRequest, MaxClipboardSize)
+	}
+	if !utf8.ValidString(c.Text) {
+		return fmt.Errorf("%w: the clipboard only holds UTF-8 text", ErrInvalidDesktopRequest)
+	}
+	_, err := displayOf(c.Display)
+	return err
+}
+
+// DesktopApps drives the apps of the guest's desktops for the host, for
+// images whose browser doesn't expose the DevTools protocol: it opens URLs
+// with xdg-open and reads and writes the clipboard with xclip.
+type DesktopApps struct {
+	// user runs the commands, as the owner of the desktops. Empty keeps the
+	// agent's.
+	user string
+	// run executes a command with stdin, returning its output. Replaced in
+	// tests.
+	run func(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error)
+}
+
+// NewDesktopApps returns the apps of the desktops of user.
+func NewDesktopApps(user string) *DesktopApps {
+	return &DesktopApps{user: user, run: runDesktopCommand}
+}
+
+// command returns the command line running args on display as the
+// desktops' user.
+func (d *DesktopApps) command(display int, args ...string) []string {
+	env := []string{"env", fmt.Sprintf("DISPLAY=:%d", display)}
+	if d.user == "" {
+		return append(env, args...)
+	}
+	home := "/home/" + d.user
+	if u, err := user.Lookup(d.user); err == nil {
+		home = u.HomeDir
+	}
+	command := []string{"runuser", "-u", d.user, "--"}
+	command = append(command, env...)
+	command = append(command, "HOME="+home)
+	return append(command, args...)
+}
+
+// OpenURL opens req.URL with the desktop's default handler.
+func (d *DesktopApps) OpenURL(ctx context.Context, req OpenURLRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	display, _ := displayOf(req.Display)
+	if _, err := d.run(ctx, nil, d.command(display, "xdg-open", req.URL)...); err != nil {
+		return fmt.Errorf("failed to open %s: %w", req.URL, err)
+	}
+	return nil
+}
+
+// Clipboard returns the text of the clipboard of display, nil being
+// DefaultDisplay.
+func (d *DesktopApps) Clipboard(ctx context.Context, display *int) (ClipboardContent, error) {
+	n, err := displayOf(display)
+	if err != nil {
+		return ClipboardContent{}, err
+	}
+	out, err := d.run(ctx, nil, d.command(n, "xclip", "-selection", "clipboard", "-out")...)
+	if err != nil {
+		// xclip fails when nothing was ever copied.
+		if strings.Contains(err.Error(), "not available") {
+			return ClipboardContent{Text: "", Display: &n}, nil
+		}
+		return ClipboardContent{}, fmt.Errorf("failed to read the clipboard: %w", err)
+	}
+	if len(out) > MaxClipboardSize {
+		return ClipboardContent{}, fmt.Errorf("the clipboard holds more than %d bytes", MaxClipboardSize)
+	}
+	return ClipboardContent{Text: string(out), Display: &n}, nil
+}
+
+// SetClipboard puts c.Text on the clipboard of c.Display.
+func (d *DesktopApps) SetClipboard(ctx context.Context, c ClipboardContent) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	display, _ := displayOf(c.Display)
+	if _, err := d.run(ctx, strings.NewReader(c.Text), d.command(display, "xclip", "-selection", "clipboard", "-in")...); err != nil {
+		return fmt.Errorf("failed to write the clipboard: %w", err)
+	}
+	return nil
+}
+
+// runDesktopCommand runs args with stdin and returns its output. The output
+// of the children it leaves running, e.g. the app xdg-open started, is
+// given up on once it exited.
+func runDesktopCommand(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = stdin
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	cmd.WaitDelay = desktopCommandWaitDelay
+	if err := cmd.Run(); err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// OpenURL POSTs an OpenURLRequest to the agent's /open-url endpoint at url.
+func OpenURL(ctx context.Context, client *http.Client, url string, req OpenURLRequest) error {
+	return postDesktopRequest(ctx, client, http.MethodPost, url, req)
+}
+
+// SetClipboard PUTs a ClipboardContent to the agent's /clipboard endpoint at
+// url.
+func SetClipboard(ctx context.Context, client *http.Client, url string, c ClipboardContent) error {
+	return postDesktopRequest(ctx, client, http.MethodPut, url, c)
+}
+
+func postDesktopRequest(ctx context.Context, client *http.Client, method string, url string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return desktopResponseError(resp)
+}
+
+// FetchClipboard reads a ClipboardContent from the agent's /clipboard
+// endpoint at url, e.g. with a display query parameter.
+func FetchClipboard(ctx context.Context, client *http.Client, url string) (ClipboardContent, error) {
+	var c ClipboardContent
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return c, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return c, err
+	}
+	defer resp.Body.Close()
+	if err := desktopResponseError(resp); err != nil {
+		return c, err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return c, fmt.Errorf("failed to decode clipboard: %v", err)
+	}
+	return c, nil
+}
+
+// desktopResponseError returns the error an agent's response reports, if
+// any, wrapping ErrInvalidDesktopRequest for a 400.
+func desktopResponseError(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	msg := strings.TrimSpace(buf.String())
+	if resp.StatusCode == http.StatusBadRequest {
+		return fmt.Errorf("%w: %s", ErrInvalidDesktopRequest, strings.TrimPrefix(msg, ErrInvalidDesktopRequest.Error()+": "))
+	}
+	return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, msg)
+}
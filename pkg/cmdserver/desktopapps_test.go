@@ -0,0 +1,128 @@
+package cmdserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDesktopApps(t *testing.T) {
+	var commands []string
+	var stdins []string
+	clipboard := "copied"
+	apps := NewDesktopApps("")
+	apps.run = func(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+		commands = append(commands, strings.Join(args, " "))
+		if stdin != nil {
+			b, _ := io.ReadAll(stdin)
+			stdins = append(stdins, string(b))
+		}
+		return []byte(clipboard), nil
+	}
+
+	display := 2
+	if err := apps.OpenURL(context.Background(), OpenURLRequest{URL: "https://example.com/a b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apps.SetClipboard(context.Background(), ClipboardContent{Text: "pasted", Display: &display}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := apps.Clipboard(context.Background(), nil)
+	if err != nil || c.Text != clipboard || *c.Display != DefaultDisplay {
+		t.Fatalf("Clipboard() = %+v, %v", c, err)
+	}
+
+	want := []string{
+		"env DISPLAY=:1 xdg-open https://example.com/a b",
+		"env DISPLAY=:2 xclip -selection clipboard -in",
+		"env DISPLAY=:1 xclip -selection clipboard -out",
+	}
+	if strings.Join(commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+	if len(stdins) != 1 || stdins[0] != "pasted" {
+		t.Errorf("stdins = %q", stdins)
+	}
+	if got := strings.Join(NewDesktopApps("elara").command(1, "xdg-open"), " "); !strings.HasPrefix(got, "runuser -u elara -- env DISPLAY=:1 HOME=") {
+		t.Errorf("command as elara = %q", got)
+	}
+
+	// Nothing was copied yet.
+	apps.run = func(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+		return nil, errors.New("exit status 1: Error: target STRING not available")
+	}
+	if c, err := apps.Clipboard(context.Background(), nil); err != nil || c.Text != "" {
+		t.Errorf("Clipboard() of an empty clipboard = %+v, %v", c, err)
+	}
+}
+
+func TestDesktopAppsRejects(t *testing.T) {
+	apps := NewDesktopApps("")
+	apps.run = func(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+		t.Errorf("ran %q", args)
+		return nil, nil
+	}
+	display := 100
+	for name, req := range map[string]OpenURLRequest{
+		"relative": {URL: "example.com"},
+		"empty":    {},
+		"display":  {URL: "https://example.com", Display: &display},
+	} {
+		if err := apps.OpenURL(context.Background(), req); !errors.Is(err, ErrInvalidDesktopRequest) {
+			t.Errorf("OpenURL(%s) = %v, want ErrInvalidDesktopRequest", name, err)
+		}
+	}
+	for name, c := range map[string]ClipboardContent{
+		"too large": {Text: strings.Repeat("x", MaxClipboardSize+1)},
+		"not UTF-8": {Text: "\xff"},
+	} {
+		if err := apps.SetClipboard(context.Background(), c); !errors.Is(err, ErrInvalidDesktopRequest) {
+			t.Errorf("SetClipboard(%s) = %v, want ErrInvalidDesktopRequest", name, err)
+		}
+	}
+	if _, err := apps.Clipboard(context.Background(), &display); !errors.Is(err, ErrInvalidDesktopRequest) {
+		t.Errorf("Clipboard(:100) = %v, want ErrInvalidDesktopRequest", err)
+	}
+}
+
+func TestDesktopAppsClient(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/open-url":
+			var req OpenURLRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if err := req.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(ClipboardContent{Text: "copied on " + r.URL.Query().Get("display")})
+		default:
+			http.Error(w, "no desktop", http.StatusInternalServerError)
+		}
+	}))
+	defer agent.Close()
+
+	ctx := context.Background()
+	if err := OpenURL(ctx, agent.Client(), agent.URL+"/open-url", OpenURLRequest{URL: "https://example.com"}); err != nil {
+		t.Errorf("OpenURL() = %v", err)
+	}
+	err := OpenURL(ctx, agent.Client(), agent.URL+"/open-url", OpenURLRequest{URL: "example.com"})
+	if !errors.Is(err, ErrInvalidDesktopRequest) || strings.Count(err.Error(), ErrInvalidDesktopRequest.Error()) != 1 {
+		t.Errorf("OpenURL(relative) = %v, want ErrInvalidDesktopRequest once", err)
+	}
+	c, err := FetchClipboard(ctx, agent.Client(), fmt.Sprintf("%s/clipboard?display=%d", agent.URL, 2))
+	if err != nil || c.Text != "copied on 2" {
+		t.Errorf("FetchClipboard() = %+v, %v", c, err)
+	}
+	if err := SetClipboard(ctx, agent.Client(), agent.URL+"/clipboard", ClipboardContent{Text: "x"}); err == nil || errors.Is(err, ErrInvalidDesktopRequest) {
+		t.Errorf("SetClipboard() = %v, want an internal error", err)
+	}
+}
@@ -0,0 +1,131 @@
+package cmdserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// X11SocketDir holds the socket "X<n>" of every running X display n.
+	X11SocketDir = "/tmp/.X11-unix"
+	// VNCBasePort is the port of display 0's VNC server. As with vncserver,
+	// display n is served on VNCBasePort+n.
+	VNCBasePort = 5900
+	// MaxDisplay bounds display numbers, so that only VNC ports are reached
+	// through them.
+	MaxDisplay = 99
+	// DefaultVNCPassword is the password of the guest image's VNC servers,
+	// see resources/arrakis-vncserver.service.
+	DefaultVNCPassword = "elara0000"
+	// DefaultDisplay is the display of the guest image's desktop, which
+	// Chrome runs on.
+	DefaultDisplay = 1
+)
+
+// Kinds of desktops.
+const (
+	// DesktopX11 is an X display found in X11SocketDir.
+	DesktopX11 = "x11"
+	// DesktopVNC is a VNC server declared as a capability with the "vnc"
+	// protocol, e.g. of a Wayland compositor such as wayvnc.
+	DesktopVNC = "vnc"
+)
+
+// Desktop is a graphical session of the guest, served over VNC.
+type Desktop struct {
+	Display int    `json:"display"`
+	Kind    string `json:"kind"`
+	// Name of the capability declaring the desktop, if any.
+	Name string `json:"name,omitempty"`
+	Port int    `json:"port"`
+	// Available is set once the VNC server accepts connections.
+	Available bool   `json:"available"`
+	Error     string `json:"error,omitempty"`
+}
+
+// DesktopsResponse lists the desktops of a guest.
+type DesktopsResponse struct {
+	Desktops []Desktop `json:"desktops"`
+}
+
+// DesktopPort returns the port of the VNC server of a display.
+func DesktopPort(display int) (int, error) {
+	if display < 0 || display > MaxDisplay {
+		return 0, fmt.Errorf("display %d isn't between 0 and %d", display, MaxDisplay)
+	}
+	return VNCBasePort + display, nil
+}
+
+// ListDesktops returns the X displays running in x11Dir and the VNC servers
+// declared in capabilitiesDir, by display, probing whether they can be
+// connected to.
+func ListDesktops(ctx context.Context, x11Dir string, capabilitiesDir string) []Desktop {
+	byDisplay := make(map[int]*Desktop)
+	entries, _ := os.ReadDir(x11Dir)
+	for _, entry := range entries {
+		display, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), "X"))
+		if !strings.HasPrefix(entry.Name(), "X") || err != nil {
+			continue
+		}
+		port, err := DesktopPort(display)
+		if err != nil {
+			continue
+		}
+		byDisplay[display] = &Desktop{Display: display, Kind: DesktopX11, Port: port}
+	}
+	declared, _ := LoadCapabilities(capabilitiesDir)
+	for _, c := range declared {
+		display := c.Port - VNCBasePort
+		if c.Error != "" || c.Protocol != "vnc" || display < 0 || display > MaxDisplay {
+			continue
+		}
+		if d, ok := byDisplay[display]; ok {
+			d.Name = c.Name
+			continue
+		}
+		byDisplay[display] = &Desktop{Display: display, Kind: DesktopVNC, Name: c.Name, Port: c.Port}
+	}
+
+	desktops := []Desktop{}
+	for _, d := range byDisplay {
+		probeCtx, cancel := context.WithTimeout(ctx, capabilityProbeTimeout)
+		if err := checkEndpoint(probeCtx, d.Port, ""); err != nil {
+			d.Error = err.Error()
+		} else {
+			d.Available = true
+		}
+		cancel()
+		desktops = append(desktops, *d)
+	}
+	sort.Slice(desktops, func(i, j int) bool { return desktops[i].Display < desktops[j].Display })
+	return desktops
+}
+
+// FetchDesktops reads a DesktopsResponse from the agent's /desktops endpoint
+// at url.
+func FetchDesktops(ctx context.Context, client *http.Client, url string) ([]Desktop, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status: %d", resp.StatusCode)
+	}
+
+	var desktops DesktopsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&desktops); err != nil {
+		return nil, fmt.Errorf("failed to decode desktops: %v", err)
+	}
+	return desktops.Desktops, nil
+}
@@ -0,0 +1,54 @@
+package cmdserver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListDesktops(t *testing.T) {
+	x11Dir := t.TempDir()
+	for _, name := range []string{"X1", "X3", "X100", "Xfoo", "other"} {
+		if err := os.WriteFile(filepath.Join(x11Dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	capabilitiesDir := t.TempDir()
+	for name, content := range map[string]string{
+		"desktop.yaml": "name: desktop\nprotocol: vnc\nport: 5901\n",
+		"wayland.yaml": "name: wayland\nprotocol: vnc\nport: 5902\n",
+		"browser.yaml": "name: browser\nprotocol: cdp\nport: 9223\n",
+	} {
+		if err := os.WriteFile(filepath.Join(capabilitiesDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	desktops := ListDesktops(context.Background(), x11Dir, capabilitiesDir)
+	want := []Desktop{
+		{Display: 1, Kind: DesktopX11, Name: "desktop", Port: 5901},
+		{Display: 2, Kind: DesktopVNC, Name: "wayland", Port: 5902},
+		{Display: 3, Kind: DesktopX11, Port: 5903},
+	}
+	if len(desktops) != len(want) {
+		t.Fatalf("ListDesktops() = %+v, want %+v", desktops, want)
+	}
+	for i, d := range desktops {
+		w := want[i]
+		if d.Display != w.Display || d.Kind != w.Kind || d.Name != w.Name || d.Port != w.Port {
+			t.Errorf("desktop %d = %+v, want %+v", i, d, w)
+		}
+	}
+}
+
+func TestDesktopPort(t *testing.T) {
+	if port, err := DesktopPort(1); err != nil || port != 5901 {
+		t.Errorf("DesktopPort(1) = %d, %v", port, err)
+	}
+	for _, display := range []int{-1, MaxDisplay + 1} {
+		if _, err := DesktopPort(display); err == nil {
+			t.Errorf("DesktopPort(%d) succeeded", display)
+		}
+	}
+}
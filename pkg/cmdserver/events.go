@@ -0,0 +1,143 @@
+package cmdserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Kinds of events workloads in the guest report to the host through the
+// agent's /events endpoint.
+const (
+	// GuestEventProgress reports how far along the workload is.
+	GuestEventProgress = "progress"
+	// GuestEventStatus reports a change of the workload's state, e.g. done.
+	GuestEventStatus = "status"
+	// GuestEventLog is a message for whoever watches the VM.
+	GuestEventLog = "log"
+	// GuestEventArtifact is recorded by the agent when a workload hands an
+	// artifact over through POST /artifacts/{path}.
+	GuestEventArtifact = "artifact"
+)
+
+const (
+	// maxGuestEvents is how many events the agent keeps for the host to
+	// fetch. Older ones are dropped.
+	maxGuestEvents = 1000
+	// maxGuestEventData bounds the data of an event.
+	maxGuestEventData = 64 * 1024
+)
+
+// GuestEvent is reported by a workload in the guest, so that it can tell the
+// host how it is doing without any network egress: the agent is reachable
+// on the guest's loopback address.
+type GuestEvent struct {
+	// Seq numbers the events of the agent from 1, in the order they were
+	// reported. It is set by the agent.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Source names what reported the event, e.g. the workload.
+	Source  string `json:"source,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Progress, between 0 and 1, for progress events.
+	Progress *float64 `json:"progress,omitempty"`
+	// Data is free-form JSON for the host.
+	Data json.RawMessage `json:"data,omitempty"`
+	// Artifact is the path of the artifact of artifact events.
+	Artifact string `json:"artifact,omitempty"`
+}
+
+// Validate checks an event reported by a workload.
+func (e GuestEvent) Validate() error {
+	switch e.Kind {
+	case GuestEventProgress, GuestEventStatus, GuestEventLog:
+	case "":
+		return fmt.Errorf("kind is required")
+	default:
+		return fmt.Errorf("unknown kind %q, expected %s, %s or %s", e.Kind, GuestEventProgress, GuestEventStatus, GuestEventLog)
+	}
+	if e.Progress != nil && (*e.Progress < 0 || *e.Progress > 1) {
+		return fmt.Errorf("progress %v isn't between 0 and 1", *e.Progress)
+	}
+	if len(e.Data) > maxGuestEventData {
+		return fmt.Errorf("data is larger than %d bytes", maxGuestEventData)
+	}
+	return nil
+}
+
+// GuestEventsResponse lists events reported after a sequence number.
+type GuestEventsResponse struct {
+	Events []GuestEvent `json:"events"`
+	// Dropped is how many events past the sequence number were dropped
+	// before they were fetched.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// GuestEvents keeps the latest events reported in the guest until the host
+// fetches them.
+type GuestEvents struct {
+	lock    sync.Mutex
+	events  []GuestEvent
+	next    uint64
+	changed chan struct{} // closed and replaced on every event
+}
+
+// NewGuestEvents returns an empty log of events.
+func NewGuestEvents() *GuestEvents {
+	return &GuestEvents{next: 1, changed: make(chan struct{})}
+}
+
+// Add records an event and returns it with its sequence number set. A
+// missing time is set to now.
+func (l *GuestEvents) Add(e GuestEvent) GuestEvent {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e.Seq = l.next
+	l.next++
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	l.events = append(l.events, e)
+	if len(l.events) > maxGuestEvents {
+		l.events = l.events[len(l.events)-maxGuestEvents:]
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return e
+}
+
+// Since returns the events after seq, waiting up to wait for one if there
+// are none yet.
+func (l *GuestEvents) Since(ctx context.Context, seq uint64, wait time.Duration) GuestEventsResponse {
+	resp, changed := l.since(seq)
+	if len(resp.Events) > 0 || wait <= 0 {
+		return resp
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	resp, _ = l.since(seq)
+	return resp
+}
+
+func (l *GuestEvents) since(seq uint64) (GuestEventsResponse, <-chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	resp := GuestEventsResponse{Events: []GuestEvent{}}
+	for _, e := range l.events {
+		if e.Seq > seq {
+			resp.Events = append(resp.Events, e)
+		}
+	}
+	if len(l.events) > 0 && l.events[0].Seq > seq+1 {
+		resp.Dropped = l.events[0].Seq - seq - 1
+	}
+	return resp, l.changed
+}
@@ -0,0 +1,66 @@
+package cmdserver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGuestEvents(t *testing.T) {
+	events := NewGuestEvents()
+	if resp := events.Since(context.Background(), 0, 0); len(resp.Events) != 0 {
+		t.Fatalf("Since() on an empty log = %+v", resp)
+	}
+
+	first := events.Add(GuestEvent{Kind: GuestEventLog, Message: "hello"})
+	if first.Seq != 1 || first.Time.IsZero() {
+		t.Errorf("Add() = %+v, want seq 1 with a time", first)
+	}
+	events.Add(GuestEvent{Kind: GuestEventStatus, Message: "done"})
+	if resp := events.Since(context.Background(), 1, 0); len(resp.Events) != 1 || resp.Events[0].Message != "done" {
+		t.Errorf("Since(1) = %+v", resp)
+	}
+
+	// A waiting fetch returns as soon as an event is added.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		events.Add(GuestEvent{Kind: GuestEventLog, Message: "late"})
+	}()
+	start := time.Now()
+	resp := events.Since(context.Background(), 2, 5*time.Second)
+	if len(resp.Events) != 1 || resp.Events[0].Seq != 3 {
+		t.Errorf("Since(2) after waiting = %+v", resp)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Since() waited for the timeout")
+	}
+}
+
+func TestGuestEventsDrops(t *testing.T) {
+	events := NewGuestEvents()
+	for i := 0; i < maxGuestEvents+10; i++ {
+		events.Add(GuestEvent{Kind: GuestEventLog})
+	}
+	resp := events.Since(context.Background(), 0, 0)
+	if len(resp.Events) != maxGuestEvents || resp.Dropped != 10 {
+		t.Errorf("Since(0) returned %d events, %d dropped, want %d and 10", len(resp.Events), resp.Dropped, maxGuestEvents)
+	}
+}
+
+func TestGuestEventValidate(t *testing.T) {
+	half, tooMuch := 0.5, 2.0
+	for _, tc := range []struct {
+		event GuestEvent
+		valid bool
+	}{
+		{GuestEvent{Kind: GuestEventProgress, Progress: &half}, true},
+		{GuestEvent{Kind: GuestEventProgress, Progress: &tooMuch}, false},
+		{GuestEvent{Kind: GuestEventArtifact}, false},
+		{GuestEvent{}, false},
+		{GuestEvent{Kind: GuestEventLog, Data: make([]byte, maxGuestEventData+1)}, false},
+	} {
+		if err := tc.event.Validate(); (err == nil) != tc.valid {
+			t.Errorf("Validate(%+v) = %v, want valid %v", tc.event, err, tc.valid)
+		}
+	}
+}
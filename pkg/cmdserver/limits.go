@@ -0,0 +1,102 @@
+package cmdserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Limits a command can exceed.
+const (
+	LimitCPU       = "cpu"
+	LimitMemory    = "memory"
+	LimitProcesses = "processes"
+	LimitOutput    = "output"
+)
+
+// ErrInvalidLimits is returned for limits that can't be enforced.
+var ErrInvalidLimits = errors.New("invalid limits")
+
+// ExecLimits bound the resources of one command and the processes it starts.
+// Zero fields don't limit.
+type ExecLimits struct {
+	// CPUSeconds is the CPU time each process may use.
+	CPUSeconds int64 `json:"cpuSeconds,omitempty"`
+	// MemoryMB bounds the memory of the processes together, or of each
+	// without cgroups.
+	MemoryMB int64 `json:"memoryMb,omitempty"`
+	// MaxProcesses bounds the processes alive at once. It needs cgroups.
+	MaxProcesses int64 `json:"maxProcesses,omitempty"`
+	// MaxOutputBytes bounds the output captured, the command is killed once
+	// it writes more.
+	MaxOutputBytes int64 `json:"maxOutputBytes,omitempty"`
+}
+
+// IsZero reports whether the limits limit nothing.
+func (l ExecLimits) IsZero() bool {
+	return l == ExecLimits{}
+}
+
+// Validate rejects negative limits.
+func (l ExecLimits) Validate() error {
+	if l.CPUSeconds < 0 || l.MemoryMB < 0 || l.MaxProcesses < 0 || l.MaxOutputBytes < 0 {
+		return fmt.Errorf("%w: limits must not be negative", ErrInvalidLimits)
+	}
+	return nil
+}
+
+// LimitExceeded reports the limit that stopped a command.
+type LimitExceeded struct {
+	// Limit is LimitCPU, LimitMemory, LimitProcesses or LimitOutput.
+	Limit string `json:"limit"`
+	// Value of the limit, in its unit.
+	Value   int64  `json:"value"`
+	Message string `json:"message"`
+}
+
+func (e *LimitExceeded) Error() string {
+	return e.Message
+}
+
+// limitedBuffer keeps the first max bytes written to it, 0 keeping all, and
+// calls onExceed once when more are written.
+type limitedBuffer struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	max      int64
+	exceeded bool
+	onExceed func()
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.exceeded {
+		b.mu.Unlock()
+		return len(p), nil
+	}
+	if b.max <= 0 || int64(b.buf.Len()+len(p)) <= b.max {
+		b.buf.Write(p)
+		b.mu.Unlock()
+		return len(p), nil
+	}
+	b.buf.Write(p[:b.max-int64(b.buf.Len())])
+	b.exceeded = true
+	b.mu.Unlock()
+	b.onExceed()
+	return len(p), nil
+}
+
+// Bytes returns what was kept.
+func (b *limitedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+// Exceeded reports whether more than max bytes were written.
+func (b *limitedBuffer) Exceeded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exceeded
+}
@@ -0,0 +1,312 @@
+package cmdserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// execCgroupRoot holds a cgroup per limited command.
+	execCgroupRoot = "/sys/fs/cgroup/arrakis-exec"
+	// limitedWaitDelay bounds waiting for the output of a command killed for
+	// exceeding its limits.
+	limitedWaitDelay = 2 * time.Second
+	// cgroup2SuperMagic is the filesystem type of cgroup v2.
+	cgroup2SuperMagic = 0x63677270
+)
+
+// execCgroupSeq names the cgroups of commands.
+var execCgroupSeq atomic.Uint64
+
+// LimitedCommand runs a shell command under ExecLimits: CPU time and, without
+// cgroups, memory as rlimits, and memory and processes in a cgroup of its
+// own when the guest has cgroup v2.
+type LimitedCommand struct {
+	Cmd    *exec.Cmd
+	limits ExecLimits
+	cgroup *execCgroup // nil without cgroup limits
+	output *limitedBuffer
+}
+
+// NewLimitedCommand returns the command running script with bash under
+// limits. Its Dir and Env can be set before it is started.
+func NewLimitedCommand(script string, limits ExecLimits) *LimitedCommand {
+	c := &LimitedCommand{limits: limits}
+	c.Cmd = exec.Command("bash", "-c", script)
+	// The command and what it starts are killed together.
+	c.Cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cmd.WaitDelay = limitedWaitDelay
+	return c
+}
+
+// CaptureOutput sends the command's stdout and stderr to a buffer bounded by
+// MaxOutputBytes, returned by Output.
+func (c *LimitedCommand) CaptureOutput() {
+	c.output = &limitedBuffer{max: c.limits.MaxOutputBytes, onExceed: c.kill}
+	c.Cmd.Stdout = c.output
+	c.Cmd.Stderr = c.output
+}
+
+// Output returns what the command wrote, up to MaxOutputBytes.
+func (c *LimitedCommand) Output() []byte {
+	if c.output == nil {
+		return nil
+	}
+	return c.output.Bytes()
+}
+
+// Start starts the command in a cgroup enforcing its memory and process
+// limits, falling back to rlimits for memory. It fails if the process limit
+// can't be enforced.
+func (c *LimitedCommand) Start() error {
+	var rlimits []string
+	if c.limits.CPUSeconds > 0 {
+		rlimits = append(rlimits, fmt.Sprintf("-t %d", c.limits.CPUSeconds))
+	}
+	if c.limits.MemoryMB > 0 || c.limits.MaxProcesses > 0 {
+		cgroup, err := newExecCgroup(c.limits)
+		switch {
+		case err == nil:
+			c.cgroup = cgroup
+			cgroup.apply(c.Cmd)
+		case c.limits.MaxProcesses > 0:
+			return fmt.Errorf("%w: processes can't be limited: %v", ErrInvalidLimits, err)
+		default:
+			log.WithError(err).Debug("Limiting the memory of each process instead of the command's")
+			rlimits = append(rlimits, fmt.Sprintf("-v %d", c.limits.MemoryMB*1024))
+		}
+	}
+	if len(rlimits) > 0 {
+		script := c.Cmd.Args[len(c.Cmd.Args)-1]
+		c.Cmd.Args[len(c.Cmd.Args)-1] = fmt.Sprintf("ulimit %s || exit 126\n%s", strings.Join(rlimits, " "), script)
+	}
+	err := c.Cmd.Start()
+	c.cgroup.started()
+	if err != nil {
+		c.cgroup.remove()
+	}
+	return err
+}
+
+// Wait waits for the command to exit and returns the limit it exceeded, if
+// any, along with its error.
+func (c *LimitedCommand) Wait() (*LimitExceeded, error) {
+	err := c.Cmd.Wait()
+	defer c.cgroup.remove()
+	return c.exceeded(), err
+}
+
+// Run starts the command and waits for it.
+func (c *LimitedCommand) Run() (*LimitExceeded, error) {
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return c.Wait()
+}
+
+// exceeded returns the limit the exited command exceeded, if any.
+func (c *LimitedCommand) exceeded() *LimitExceeded {
+	if c.output != nil && c.output.Exceeded() {
+		return &LimitExceeded{
+			Limit:   LimitOutput,
+			Value:   c.limits.MaxOutputBytes,
+			Message: fmt.Sprintf("output exceeded %d bytes, the command was killed", c.limits.MaxOutputBytes),
+		}
+	}
+	if c.cpuExceeded() {
+		return &LimitExceeded{
+			Limit:   LimitCPU,
+			Value:   c.limits.CPUSeconds,
+			Message: fmt.Sprintf("a process used more than %d seconds of CPU time and was killed", c.limits.CPUSeconds),
+		}
+	}
+	if c.cgroup != nil {
+		if c.cgroup.oomKilled() {
+			return &LimitExceeded{
+				Limit:   LimitMemory,
+				Value:   c.limits.MemoryMB,
+				Message: fmt.Sprintf("memory exceeded %d MB, a process was killed", c.limits.MemoryMB),
+			}
+		}
+		if c.cgroup.processesRefused() {
+			return &LimitExceeded{
+				Limit:   LimitProcesses,
+				Value:   c.limits.MaxProcesses,
+				Message: fmt.Sprintf("more than %d processes were started, a fork failed", c.limits.MaxProcesses),
+			}
+		}
+	}
+	return nil
+}
+
+// cpuExceeded reports whether the shell, or the process it reported, was
+// killed for its CPU time. The kernel sends SIGKILL at the limit, with the CPU
+// time accounted possibly a tick short of it.
+func (c *LimitedCommand) cpuExceeded() bool {
+	state := c.Cmd.ProcessState
+	if state == nil || c.limits.CPUSeconds <= 0 {
+		return false
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+	signal := status.Signal()
+	if status.Exited() {
+		// bash exits 128+n for a child killed by signal n.
+		signal = syscall.Signal(status.ExitStatus() - 128)
+	}
+	if signal != syscall.SIGKILL && signal != syscall.SIGXCPU {
+		return false
+	}
+	limit := time.Duration(c.limits.CPUSeconds) * time.Second
+	return state.UserTime()+state.SystemTime() >= limit*9/10
+}
+
+// kill kills the command and every process it started.
+func (c *LimitedCommand) kill() {
+	if c.Cmd.Process != nil {
+		syscall.Kill(-c.Cmd.Process.Pid, syscall.SIGKILL)
+	}
+	c.cgroup.kill()
+}
+
+// execCgroup is the cgroup v2 of a limited command.
+type execCgroup struct {
+	dir string
+	fd  *os.File // of dir, open until the command started
+}
+
+// newExecCgroup creates a cgroup enforcing the memory and process limits.
+func newExecCgroup(limits ExecLimits) (*execCgroup, error) {
+	var controllers []string
+	if limits.MemoryMB > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if limits.MaxProcesses > 0 {
+		controllers = append(controllers, "pids")
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Dir(execCgroupRoot), &fs); err != nil {
+		return nil, err
+	}
+	if fs.Type != cgroup2SuperMagic {
+		return nil, errors.New("no cgroup v2 hierarchy")
+	}
+	// The root cgroup delegates the controllers to execCgroupRoot, which
+	// delegates them to the cgroups of the commands.
+	if err := os.Mkdir(execCgroupRoot, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	for _, dir := range []string{filepath.Dir(execCgroupRoot), execCgroupRoot} {
+		for _, controller := range controllers {
+			if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0); err != nil {
+				return nil, fmt.Errorf("failed to enable the %s controller: %w", controller, err)
+			}
+		}
+	}
+
+	g := &execCgroup{dir: filepath.Join(execCgroupRoot, fmt.Sprintf("%d-%d", os.Getpid(), execCgroupSeq.Add(1)))}
+	if err := os.Mkdir(g.dir, 0o755); err != nil {
+		return nil, err
+	}
+	settings := map[string]int64{}
+	if limits.MemoryMB > 0 {
+		settings["memory.max"] = limits.MemoryMB * 1024 * 1024
+		settings["memory.swap.max"] = 0
+	}
+	if limits.MaxProcesses > 0 {
+		settings["pids.max"] = limits.MaxProcesses
+	}
+	for file, value := range settings {
+		err := os.WriteFile(filepath.Join(g.dir, file), []byte(strconv.FormatInt(value, 10)), 0)
+		// Guests without swap have no memory.swap.max.
+		if err != nil && file != "memory.swap.max" {
+			g.remove()
+			return nil, fmt.Errorf("failed to set %s: %w", file, err)
+		}
+	}
+	fd, err := os.Open(g.dir)
+	if err != nil {
+		g.remove()
+		return nil, err
+	}
+	g.fd = fd
+	return g, nil
+}
+
+// apply starts cmd in the cgroup, so that no process escapes its limits.
+func (g *execCgroup) apply(cmd *exec.Cmd) {
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(g.fd.Fd())
+}
+
+// started releases what starting the command needed.
+func (g *execCgroup) started() {
+	if g != nil && g.fd != nil {
+		g.fd.Close()
+		g.fd = nil
+	}
+}
+
+// oomKilled reports whether a process was killed for exceeding memory.max.
+func (g *execCgroup) oomKilled() bool {
+	return g.counter("memory.events", "oom_kill") > 0
+}
+
+// processesRefused reports whether a fork failed for exceeding pids.max.
+func (g *execCgroup) processesRefused() bool {
+	return g.counter("pids.events", "max") > 0
+}
+
+// counter returns the counter name of the flat keyed file, 0 if missing.
+func (g *execCgroup) counter(file string, name string) int64 {
+	f, err := os.Open(filepath.Join(g.dir, file))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == name {
+			v, _ := strconv.ParseInt(fields[1], 10, 64)
+			return v
+		}
+	}
+	return 0
+}
+
+// kill kills the processes of the cgroup.
+func (g *execCgroup) kill() {
+	if g != nil {
+		os.WriteFile(filepath.Join(g.dir, "cgroup.kill"), []byte("1"), 0)
+	}
+}
+
+// remove kills what is left in the cgroup and removes it.
+func (g *execCgroup) remove() {
+	if g == nil {
+		return
+	}
+	g.started()
+	g.kill()
+	var err error
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err = os.Remove(g.dir); err == nil || errors.Is(err, os.ErrNotExist) {
+			return
+		}
+	}
+	log.WithError(err).Warnf("Failed to remove cgroup %s", g.dir)
+}
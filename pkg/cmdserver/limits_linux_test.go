@@ -0,0 +1,71 @@
+package cmdserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLimitedCommand(t *testing.T) {
+	c := NewLimitedCommand("echo hello", ExecLimits{})
+	c.CaptureOutput()
+	if exceeded, err := c.Run(); exceeded != nil || err != nil {
+		t.Fatalf("Run = %+v, %v", exceeded, err)
+	}
+	if got := string(c.Output()); got != "hello\n" {
+		t.Errorf("output = %q", got)
+	}
+
+	// A failure isn't a limit exceeded.
+	c = NewLimitedCommand("exit 3", ExecLimits{CPUSeconds: 5})
+	if exceeded, err := c.Run(); exceeded != nil || err == nil {
+		t.Errorf("Run = %+v, %v, want the exit status only", exceeded, err)
+	}
+}
+
+func TestLimitedCommandOutput(t *testing.T) {
+	c := NewLimitedCommand("yes", ExecLimits{MaxOutputBytes: 1000})
+	c.CaptureOutput()
+	exceeded, err := c.Run()
+	if err == nil || exceeded == nil || exceeded.Limit != LimitOutput || exceeded.Value != 1000 {
+		t.Fatalf("Run = %+v, %v, want the output limit exceeded", exceeded, err)
+	}
+	if got := c.Output(); len(got) != 1000 || !strings.HasPrefix(string(got), "y\ny\n") {
+		t.Errorf("kept %d bytes", len(got))
+	}
+}
+
+func TestLimitedCommandCPU(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uses a second of CPU")
+	}
+	c := NewLimitedCommand("while :; do :; done", ExecLimits{CPUSeconds: 1})
+	exceeded, err := c.Run()
+	if err == nil || exceeded == nil || exceeded.Limit != LimitCPU || exceeded.Value != 1 {
+		t.Errorf("Run = %+v, %v, want the CPU limit exceeded", exceeded, err)
+	}
+	// Of a process the shell waited for.
+	c = NewLimitedCommand("bash -c 'while :; do :; done'; exit $?", ExecLimits{CPUSeconds: 1})
+	exceeded, err = c.Run()
+	if err == nil || exceeded == nil || exceeded.Limit != LimitCPU {
+		t.Errorf("Run = %+v, %v, want the CPU limit exceeded", exceeded, err)
+	}
+}
+
+func TestLimitedCommandProcesses(t *testing.T) {
+	if g, err := newExecCgroup(ExecLimits{MaxProcesses: 1}); err == nil {
+		g.remove()
+	} else {
+		c := NewLimitedCommand("true", ExecLimits{MaxProcesses: 4})
+		if _, err := c.Run(); !errors.Is(err, ErrInvalidLimits) {
+			t.Errorf("Run without cgroups = %v, want ErrInvalidLimits", err)
+		}
+		t.Skipf("no cgroup v2: %v", err)
+	}
+	c := NewLimitedCommand("for i in 1 2 3 4 5 6 7 8; do sleep 1 & done; wait", ExecLimits{MaxProcesses: 4})
+	c.CaptureOutput()
+	exceeded, _ := c.Run()
+	if exceeded == nil || exceeded.Limit != LimitProcesses {
+		t.Errorf("exceeded = %+v, want the process limit", exceeded)
+	}
+}
@@ -0,0 +1,40 @@
+package cmdserver
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLimitedBuffer(t *testing.T) {
+	exceeded := 0
+	b := &limitedBuffer{max: 5, onExceed: func() { exceeded++ }}
+	b.Write([]byte("abc"))
+	if b.Exceeded() || exceeded != 0 {
+		t.Error("exceeded under the limit")
+	}
+	if n, err := b.Write([]byte("defg")); n != 4 || err != nil {
+		t.Errorf("Write = %d, %v, want all written", n, err)
+	}
+	b.Write([]byte("h"))
+	if got := string(b.Bytes()); got != "abcde" || !b.Exceeded() || exceeded != 1 {
+		t.Errorf("kept %q, exceeded %t %d times", got, b.Exceeded(), exceeded)
+	}
+
+	unbounded := &limitedBuffer{}
+	unbounded.Write(make([]byte, 1<<16))
+	if len(unbounded.Bytes()) != 1<<16 || unbounded.Exceeded() {
+		t.Error("unbounded buffer exceeded")
+	}
+}
+
+func TestExecLimitsValidate(t *testing.T) {
+	if err := (ExecLimits{}).Validate(); err != nil {
+		t.Errorf("no limits: %v", err)
+	}
+	if err := (ExecLimits{CPUSeconds: 1, MemoryMB: 64, MaxProcesses: 8, MaxOutputBytes: 1024}).Validate(); err != nil {
+		t.Errorf("limits: %v", err)
+	}
+	if err := (ExecLimits{MemoryMB: -1}).Validate(); !errors.Is(err, ErrInvalidLimits) {
+		t.Errorf("negative limit: %v, want ErrInvalidLimits", err)
+	}
+}
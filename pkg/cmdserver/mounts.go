@@ -0,0 +1,243 @@
+package cmdserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// MountsConfigDir holds the rclone configuration of each object mount.
+	// It holds credentials so only root may read it.
+	MountsConfigDir = "/etc/arrakis/mounts"
+	// DefaultMountsDir is where object mounts without a mount path go, as
+	// <DefaultMountsDir>/<name>.
+	DefaultMountsDir = "/mnt/objects"
+)
+
+var mountNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// ObjectMount exposes a bucket, or a prefix of it, of an S3 compatible object
+// store read-only inside the guest.
+type ObjectMount struct {
+	// Name identifies the mount. It names the guest's systemd unit, so it is
+	// limited to lower case letters, digits and dashes.
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region,omitempty"`
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix,omitempty"`
+	// Credentials are optional for public buckets.
+	AccessKeyID     string `json:"accessKeyId,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	// MountPath defaults to <DefaultMountsDir>/<name>.
+	MountPath string `json:"mountPath,omitempty"`
+}
+
+// Validate checks that the mount can be set up and fills in defaults.
+func (m *ObjectMount) Validate() error {
+	if !mountNameRegexp.MatchString(m.Name) {
+		return fmt.Errorf("invalid mount name %q: use lower case letters, digits and dashes", m.Name)
+	}
+	if m.Endpoint == "" || m.Bucket == "" {
+		return fmt.Errorf("mount %s: endpoint and bucket are required", m.Name)
+	}
+	if m.MountPath == "" {
+		m.MountPath = path.Join(DefaultMountsDir, m.Name)
+	}
+	if !path.IsAbs(m.MountPath) || path.Clean(m.MountPath) == "/" {
+		return fmt.Errorf("mount %s: mount path must be an absolute path below /, got %q", m.Name, m.MountPath)
+	}
+	m.MountPath = path.Clean(m.MountPath)
+	return nil
+}
+
+// MountStatus reports whether an object mount is serving in the guest.
+type MountStatus struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	Source    string `json:"source"`
+	State     string `json:"state"`
+}
+
+// MountsResponse lists the object mounts of a guest.
+type MountsResponse struct {
+	Mounts []MountStatus `json:"mounts"`
+}
+
+// rcloneConfig returns the rclone configuration of the mount. Credentials are
+// kept out of the command line so that they don't show up in the process list.
+func (m ObjectMount) rcloneConfig() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s]\n", m.Name)
+	fmt.Fprintf(&b, "type = s3\n")
+	fmt.Fprintf(&b, "provider = Other\n")
+	fmt.Fprintf(&b, "endpoint = %s\n", m.Endpoint)
+	if m.Region != "" {
+		fmt.Fprintf(&b, "region = %s\n", m.Region)
+	}
+	if m.AccessKeyID != "" {
+		fmt.Fprintf(&b, "access_key_id = %s\n", m.AccessKeyID)
+		fmt.Fprintf(&b, "secret_access_key = %s\n", m.SecretAccessKey)
+	}
+	return b.String()
+}
+
+// source is the rclone remote path the mount serves.
+func (m ObjectMount) source() string {
+	return fmt.Sprintf("%s:%s", m.Name, path.Join(m.Bucket, m.Prefix))
+}
+
+// Location describes where the mounted objects are, e.g.
+// "https://s3.example.com/bucket/prefix".
+func (m ObjectMount) Location() string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(m.Endpoint, "/"), path.Join(m.Bucket, m.Prefix))
+}
+
+func (m ObjectMount) unit() string {
+	return fmt.Sprintf("arrakis-mount-%s", m.Name)
+}
+
+// command returns the systemd-run invocation that serves the mount. Running it
+// as a transient unit keeps it alive across agent restarts, and as rclone
+// notifies systemd once mounted, systemd-run returns when the mount is ready.
+func (m ObjectMount) command(configPath string) []string {
+	return []string{
+		"systemd-run",
+		"--unit=" + m.unit(),
+		"--property=Type=notify",
+		"--collect",
+		"rclone", "mount",
+		"--config=" + configPath,
+		"--read-only",
+		"--allow-other",
+		"--dir-cache-time=1m",
+		m.source(),
+		m.MountPath,
+	}
+}
+
+// Mounter sets up object mounts in the guest with rclone.
+type Mounter struct {
+	configDir string
+	// run executes a command and unitState returns the systemd ActiveState
+	// of a unit. Replaced in tests.
+	run       func(ctx context.Context, args ...string) error
+	unitState func(ctx context.Context, unit string) string
+
+	lock   sync.Mutex
+	mounts map[string]ObjectMount
+}
+
+// NewMounter returns a mounter that keeps mount configurations in configDir.
+func NewMounter(configDir string) *Mounter {
+	return &Mounter{
+		configDir: configDir,
+		run:       runCommand,
+		unitState: systemdUnitState,
+		mounts:    make(map[string]ObjectMount),
+	}
+}
+
+// Mount sets up the mount. Mounting the same mount again is a no-op, while
+// reusing its name for a different one is an error.
+func (m *Mounter) Mount(ctx context.Context, mount ObjectMount) error {
+	if err := mount.Validate(); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if existing, ok := m.mounts[mount.Name]; ok {
+		if existing != mount {
+			return fmt.Errorf("mount %s already exists with a different configuration", mount.Name)
+		}
+		return nil
+	}
+	// The mount's unit outlives the agent, e.g. across agent updates.
+	if m.unitState(ctx, mount.unit()) == "active" {
+		m.mounts[mount.Name] = mount
+		return nil
+	}
+
+	if err := os.MkdirAll(m.configDir, 0700); err != nil {
+		return fmt.Errorf("failed to create mount config dir: %w", err)
+	}
+	configPath := filepath.Join(m.configDir, mount.Name+".conf")
+	if err := os.WriteFile(configPath, []byte(mount.rcloneConfig()), 0600); err != nil {
+		return fmt.Errorf("failed to write mount config: %w", err)
+	}
+	if err := os.MkdirAll(mount.MountPath, 0755); err != nil {
+		return fmt.Errorf("failed to create mount path: %w", err)
+	}
+	if err := m.run(ctx, mount.command(configPath)...); err != nil {
+		os.Remove(configPath)
+		return fmt.Errorf("failed to mount %s: %w", mount.Name, err)
+	}
+	m.mounts[mount.Name] = mount
+	return nil
+}
+
+// List reports the mounts set up so far and the state of their units.
+func (m *Mounter) List(ctx context.Context) []MountStatus {
+	m.lock.Lock()
+	mounts := make([]ObjectMount, 0, len(m.mounts))
+	for _, mount := range m.mounts {
+		mounts = append(mounts, mount)
+	}
+	m.lock.Unlock()
+
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Name < mounts[j].Name })
+	statuses := make([]MountStatus, len(mounts))
+	for i, mount := range mounts {
+		statuses[i] = MountStatus{
+			Name:      mount.Name,
+			MountPath: mount.MountPath,
+			Source:    mount.Location(),
+			State:     m.unitState(ctx, mount.unit()),
+		}
+	}
+	return statuses
+}
+
+func runCommand(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// RequestMount POSTs an ObjectMount to the agent's /mounts endpoint at url.
+func RequestMount(ctx context.Context, client *http.Client, url string, mount ObjectMount) error {
+	body, err := json.Marshal(mount)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(msg.String()))
+	}
+	return nil
+}
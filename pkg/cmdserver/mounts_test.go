@@ -0,0 +1,113 @@
+package cmdserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestObjectMountValidate(t *testing.T) {
+	m := ObjectMount{Name: "datasets", Endpoint: "https://s3.example.com", Bucket: "data"}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if m.MountPath != "/mnt/objects/datasets" {
+		t.Errorf("MountPath = %q, want the default", m.MountPath)
+	}
+
+	for _, bad := range []ObjectMount{
+		{Name: "Data Sets", Endpoint: "https://s3.example.com", Bucket: "data"},
+		{Name: "datasets", Bucket: "data"},
+		{Name: "datasets", Endpoint: "https://s3.example.com", Bucket: "data", MountPath: "relative"},
+		{Name: "datasets", Endpoint: "https://s3.example.com", Bucket: "data", MountPath: "/"},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", bad)
+		}
+	}
+}
+
+func TestMounterMount(t *testing.T) {
+	configDir := filepath.Join(t.TempDir(), "mounts")
+	var commands [][]string
+	fail := false
+	m := NewMounter(configDir)
+	m.run = func(ctx context.Context, args ...string) error {
+		commands = append(commands, args)
+		if fail {
+			return errors.New("rclone failed")
+		}
+		return nil
+	}
+	units := &fakeUnits{states: make(map[string]string)}
+	m.unitState = units.state
+
+	mount := ObjectMount{
+		Name:            "datasets",
+		Endpoint:        "https://s3.example.com",
+		Bucket:          "data",
+		Prefix:          "imagenet",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		MountPath:       filepath.Join(t.TempDir(), "datasets"),
+	}
+	if err := m.Mount(context.Background(), mount); err != nil {
+		t.Fatalf("Mount failed: %v", err)
+	}
+	if len(commands) != 1 {
+		t.Fatalf("Ran %d commands, want 1", len(commands))
+	}
+	command := strings.Join(commands[0], " ")
+	if !strings.Contains(command, "--read-only") || !strings.Contains(command, " datasets:data/imagenet ") {
+		t.Errorf("Command = %q", command)
+	}
+	if strings.Contains(command, "secret") {
+		t.Errorf("Credentials on the command line: %q", command)
+	}
+
+	config, err := os.ReadFile(filepath.Join(configDir, "datasets.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), "secret_access_key = secret") {
+		t.Errorf("Config = %q", config)
+	}
+	if info, err := os.Stat(filepath.Join(configDir, "datasets.conf")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Config mode = %v, %v, want 0600", info.Mode(), err)
+	}
+
+	// Mounting again is a no-op, but the name can't be reused.
+	if err := m.Mount(context.Background(), mount); err != nil || len(commands) != 1 {
+		t.Errorf("Remount = %v after %d commands, want a no-op", err, len(commands))
+	}
+	changed := mount
+	changed.Bucket = "other"
+	if err := m.Mount(context.Background(), changed); err == nil {
+		t.Error("Reused a mount name for a different bucket")
+	}
+
+	// A mount that survived an agent restart is adopted rather than mounted
+	// again.
+	units.set("arrakis-mount-survivor", "active")
+	survivor := mount
+	survivor.Name = "survivor"
+	if err := m.Mount(context.Background(), survivor); err != nil || len(commands) != 1 {
+		t.Errorf("Mount of an active unit = %v after %d commands, want adopted", err, len(commands))
+	}
+	if statuses := m.List(context.Background()); len(statuses) != 2 || statuses[1].State != "active" {
+		t.Errorf("List = %+v", statuses)
+	}
+
+	fail = true
+	failing := mount
+	failing.Name = "broken"
+	if err := m.Mount(context.Background(), failing); err == nil {
+		t.Error("Mount succeeded although rclone failed")
+	}
+	if _, err := os.Stat(filepath.Join(configDir, "broken.conf")); !os.IsNotExist(err) {
+		t.Errorf("Config of a failed mount kept: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package cmdserver
+
+// A PTY exec session is a WebSocket on which binary messages carry raw terminal
+// data in both directions and text messages carry PTYControl messages:
+//
+//	client -> server  {"type":"resize","rows":40,"cols":120}
+//	client -> server  {"type":"signal","signal":"SIGINT"}
+//	server -> client  {"type":"exit","code":0}
+//
+// The server sends exactly one exit message, after the last output, and then
+// closes the connection.
+const (
+	PTYMessageResize = "resize"
+	PTYMessageSignal = "signal"
+	PTYMessageExit   = "exit"
+
+	// DefaultPTYRows and DefaultPTYCols size a terminal whose client did not
+	// report a size.
+	DefaultPTYRows = 24
+	DefaultPTYCols = 80
+)
+
+// PTYControl is a control message on a PTY exec WebSocket.
+type PTYControl struct {
+	Type   string `json:"type"`
+	Rows   uint16 `json:"rows,omitempty"`
+	Cols   uint16 `json:"cols,omitempty"`
+	Signal string `json:"signal,omitempty"`
+	Code   int    `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
@@ -0,0 +1,103 @@
+//go:build !windows
+
+package cmdserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startPTYServer serves a single PTY session running script and returns a
+// client connection to it.
+func startPTYServer(t *testing.T, script string) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		RunPTY(conn, exec.Command("sh", "-c", script), 0, 0)
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial pty server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+// readSession collects output until the exit message.
+func readSession(t *testing.T, conn *websocket.Conn) (string, PTYControl) {
+	t.Helper()
+	var output strings.Builder
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Session ended without exit message, output %q: %v", output.String(), err)
+		}
+		if messageType == websocket.BinaryMessage {
+			output.Write(data)
+			continue
+		}
+		var msg PTYControl
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Invalid control message %q: %v", data, err)
+		}
+		if msg.Type == PTYMessageExit {
+			return output.String(), msg
+		}
+	}
+}
+
+func TestRunPTY(t *testing.T) {
+	conn := startPTYServer(t, "read line; stty size; echo \"got $line\"; exit 3")
+
+	resize, _ := json.Marshal(PTYControl{Type: PTYMessageResize, Rows: 40, Cols: 100})
+	if err := conn.WriteMessage(websocket.TextMessage, resize); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	output, exit := readSession(t, conn)
+	if !strings.Contains(output, "40 100") {
+		t.Errorf("Terminal was not resized, output %q", output)
+	}
+	if !strings.Contains(output, "got hello") {
+		t.Errorf("Input was not delivered, output %q", output)
+	}
+	if exit.Code != 3 {
+		t.Errorf("Exit code %d, want 3", exit.Code)
+	}
+}
+
+func TestRunPTYSignal(t *testing.T) {
+	conn := startPTYServer(t, "echo ready; sleep 30")
+
+	messageType, data, err := conn.ReadMessage()
+	if err != nil || messageType != websocket.BinaryMessage || !strings.Contains(string(data), "ready") {
+		t.Fatalf("Unexpected first message %q: %v", data, err)
+	}
+	signal, _ := json.Marshal(PTYControl{Type: PTYMessageSignal, Signal: "SIGTERM"})
+	if err := conn.WriteMessage(websocket.TextMessage, signal); err != nil {
+		t.Fatal(err)
+	}
+
+	_, exit := readSession(t, conn)
+	if exit.Code != -1 {
+		t.Errorf("Exit code %d, want -1 for a signalled command", exit.Code)
+	}
+}
@@ -0,0 +1,207 @@
+//go:build !windows
+
+package cmdserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// The PTY server runs in the guest. Clients, which may run on any OS, only
+// need the protocol of pty.go.
+
+const (
+	ptyReadBufferSize = 32 * 1024
+	// Background jobs can keep the terminal open after the command exits, so
+	// remaining output is only waited for this long.
+	ptyOutputDrainTimeout = 2 * time.Second
+)
+
+// Signals that clients may deliver to a PTY session.
+var ptySignals = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGKILL":  syscall.SIGKILL,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGCONT":  syscall.SIGCONT,
+	"SIGTSTP":  syscall.SIGTSTP,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+type ptySession struct {
+	conn *websocket.Conn
+	ptmx *os.File
+	cmd  *exec.Cmd
+	// Closed once the command has been waited for, after which its pid may be
+	// reused and must not be signalled.
+	exited chan struct{}
+
+	writeLock sync.Mutex // Serializes writes to conn
+}
+
+// RunPTY runs cmd on a new pseudo terminal of the given size and connects it to
+// conn until the command exits. If the client goes away first the command's
+// session is hung up. Closing conn is left to the caller.
+func RunPTY(conn *websocket.Conn, cmd *exec.Cmd, rows uint16, cols uint16) error {
+	if rows == 0 {
+		rows = DefaultPTYRows
+	}
+	if cols == 0 {
+		cols = DefaultPTYCols
+	}
+
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: rows, Cols: cols})
+	if err != nil {
+		err = fmt.Errorf("failed to start command on pty: %v", err)
+		s := &ptySession{conn: conn}
+		s.writeControl(PTYControl{Type: PTYMessageExit, Code: -1, Error: err.Error()})
+		s.close()
+		return err
+	}
+	defer ptmx.Close()
+
+	s := &ptySession{conn: conn, ptmx: ptmx, cmd: cmd, exited: make(chan struct{})}
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		s.copyOutput()
+	}()
+	go s.copyInput()
+
+	waitErr := cmd.Wait()
+	close(s.exited)
+	select {
+	case <-outputDone:
+	case <-time.After(ptyOutputDrainTimeout):
+	}
+
+	exit := PTYControl{Type: PTYMessageExit}
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) {
+		exit.Code = exitErr.ExitCode()
+	} else if waitErr != nil {
+		exit.Code = -1
+		exit.Error = waitErr.Error()
+	}
+	s.writeControl(exit)
+	s.close()
+	return nil
+}
+
+// copyOutput forwards terminal output to the client until the terminal is
+// closed, which the kernel reports as EIO once the command's side is gone.
+func (s *ptySession) copyOutput() {
+	buf := make([]byte, ptyReadBufferSize)
+	for {
+		n, err := s.ptmx.Read(buf)
+		if n > 0 {
+			s.writeLock.Lock()
+			werr := s.conn.WriteMessage(websocket.BinaryMessage, buf[:n])
+			s.writeLock.Unlock()
+			if werr != nil {
+				log.Debugf("Failed to write pty output: %v", werr)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// copyInput forwards terminal input and applies control messages until the
+// client disconnects.
+func (s *ptySession) copyInput() {
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			log.Debugf("PTY client disconnected: %v", err)
+			s.signal(syscall.SIGHUP)
+			return
+		}
+
+		switch messageType {
+		case websocket.BinaryMessage:
+			if _, err := s.ptmx.Write(data); err != nil {
+				log.Debugf("Failed to write pty input: %v", err)
+				return
+			}
+		case websocket.TextMessage:
+			if err := s.handleControl(data); err != nil {
+				log.Warnf("Ignoring pty control message: %v", err)
+			}
+		}
+	}
+}
+
+func (s *ptySession) handleControl(data []byte) error {
+	var msg PTYControl
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return fmt.Errorf("invalid control message: %v", err)
+	}
+
+	switch msg.Type {
+	case PTYMessageResize:
+		if msg.Rows == 0 || msg.Cols == 0 {
+			return fmt.Errorf("invalid terminal size %dx%d", msg.Cols, msg.Rows)
+		}
+		return pty.Setsize(s.ptmx, &pty.Winsize{Rows: msg.Rows, Cols: msg.Cols})
+	case PTYMessageSignal:
+		sig, ok := ptySignals[msg.Signal]
+		if !ok {
+			return fmt.Errorf("unsupported signal %q", msg.Signal)
+		}
+		s.signal(sig)
+		return nil
+	default:
+		return fmt.Errorf("unknown control message type %q", msg.Type)
+	}
+}
+
+// signal delivers sig to the command's process group, which it leads as the
+// session leader of the pty.
+func (s *ptySession) signal(sig syscall.Signal) {
+	select {
+	case <-s.exited:
+		return
+	default:
+	}
+	if err := syscall.Kill(-s.cmd.Process.Pid, sig); err != nil && err != syscall.ESRCH {
+		log.Debugf("Failed to signal pty session: %v", err)
+	}
+}
+
+func (s *ptySession) writeControl(msg PTYControl) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Debugf("Failed to write pty control message: %v", err)
+	}
+}
+
+// close starts the WebSocket closing handshake.
+func (s *ptySession) close() {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+}
@@ -0,0 +1,267 @@
+package cmdserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// workloadExitTimeout bounds waiting for the killed workload processes to be
+// gone.
+const workloadExitTimeout = 5 * time.Second
+
+// ErrInvalidReset is returned for resets asking to clear paths that can't be
+// scratch paths.
+var ErrInvalidReset = errors.New("invalid reset")
+
+// ResetRequest asks the agent to bring the guest back to a clean state.
+type ResetRequest struct {
+	// ScratchPaths are emptied in addition to the agent's defaults.
+	ScratchPaths []string `json:"scratchPaths,omitempty"`
+	// KeepBrowserProfile leaves the browser's profile, e.g. a seeded golden
+	// one, in place. The browser is restarted either way.
+	KeepBrowserProfile bool `json:"keepBrowserProfile,omitempty"`
+}
+
+// ResetResponse reports what a reset did and whether the guest was left
+// clean.
+type ResetResponse struct {
+	// KilledProcesses is how many workload processes were killed.
+	KilledProcesses int `json:"killedProcesses"`
+	// ClearedPaths are the scratch paths emptied, sorted.
+	ClearedPaths []string `json:"clearedPaths"`
+	// BrowserProfileReset is set once the browser was restarted on an empty
+	// profile.
+	BrowserProfileReset bool `json:"browserProfileReset"`
+	// Clean is set when no workload process survived, every scratch path is
+	// empty and the browser was restarted.
+	Clean bool `json:"clean"`
+	// Errors describe what kept the guest from being clean.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Resetter brings a guest back to the state it booted in, a faster
+// alternative to replacing the VM for pooled sandboxes. Workload processes
+// are the ones the agent started, commands and terminals, along with what
+// they started: everything in the agent's cgroup other than the agent.
+type Resetter struct {
+	scratch []string
+	seeder  *ProfileSeeder
+	// procs returns the PIDs in the agent's cgroup. Replaced in tests.
+	procs func() ([]int, error)
+	// kill kills a process. Replaced in tests.
+	kill func(pid int) error
+	self int
+}
+
+// NewResetter returns a resetter emptying the scratch paths and the profile
+// seeder's browser profile.
+func NewResetter(scratch []string, seeder *ProfileSeeder) *Resetter {
+	return &Resetter{
+		scratch: scratch,
+		seeder:  seeder,
+		procs:   cgroupProcs,
+		kill: func(pid int) error {
+			p, err := os.FindProcess(pid)
+			if err != nil {
+				return err
+			}
+			return p.Kill()
+		},
+		self: os.Getpid(),
+	}
+}
+
+// Validate checks that the scratch paths asked for can be emptied.
+func (req ResetRequest) Validate() error {
+	for _, p := range req.ScratchPaths {
+		if !path.IsAbs(p) || path.Clean(p) == "/" {
+			return fmt.Errorf("%w: scratch paths must be absolute paths below /, got %q", ErrInvalidReset, p)
+		}
+	}
+	return nil
+}
+
+// Reset kills the workload processes, empties the scratch paths and restarts
+// the browser, on an empty profile unless asked to keep it. Every step is
+// attempted even if an earlier one failed; the failures are reported in the
+// response rather than as an error, which is only returned for invalid
+// requests.
+func (r *Resetter) Reset(ctx context.Context, req ResetRequest) (ResetResponse, error) {
+	if err := req.Validate(); err != nil {
+		return ResetResponse{}, err
+	}
+	resp := ResetResponse{ClearedPaths: []string{}}
+	fail := func(format string, args ...any) {
+		resp.Errors = append(resp.Errors, fmt.Sprintf(format, args...))
+	}
+
+	killed, err := r.killWorkloads(ctx)
+	resp.KilledProcesses = killed
+	if err != nil {
+		fail("%v", err)
+	}
+
+	paths := make(map[string]bool)
+	for _, p := range append(append([]string{}, r.scratch...), req.ScratchPaths...) {
+		paths[filepath.Clean(p)] = true
+	}
+	for p := range paths {
+		if err := emptyDir(p); err != nil {
+			fail("failed to clear %s: %v", p, err)
+			continue
+		}
+		resp.ClearedPaths = append(resp.ClearedPaths, p)
+	}
+	sort.Strings(resp.ClearedPaths)
+
+	if req.KeepBrowserProfile {
+		err = r.seeder.RestartBrowser(ctx, "")
+	} else {
+		err = r.seeder.Reset(ctx)
+		resp.BrowserProfileReset = err == nil
+	}
+	if err != nil {
+		fail("%v", err)
+	}
+
+	resp.Clean = len(resp.Errors) == 0
+	return resp, nil
+}
+
+// killWorkloads kills the processes in the agent's cgroup other than the
+// agent, and waits for them to be gone. It returns how many were killed.
+func (r *Resetter) killWorkloads(ctx context.Context) (int, error) {
+	pids, err := r.workloads()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list workload processes: %w", err)
+	}
+	killed := 0
+	for _, pid := range pids {
+		if err := r.kill(pid); err == nil {
+			killed++
+		}
+	}
+
+	deadline := time.Now().Add(workloadExitTimeout)
+	for {
+		pids, err = r.workloads()
+		if err != nil {
+			return killed, fmt.Errorf("failed to list workload processes: %w", err)
+		}
+		if len(pids) == 0 {
+			return killed, nil
+		}
+		if time.Now().After(deadline) {
+			return killed, fmt.Errorf("workload processes %v survived", pids)
+		}
+		select {
+		case <-ctx.Done():
+			return killed, fmt.Errorf("workload processes %v survived: %w", pids, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (r *Resetter) workloads() ([]int, error) {
+	pids, err := r.procs()
+	if err != nil {
+		return nil, err
+	}
+	workloads := pids[:0]
+	for _, pid := range pids {
+		if pid != r.self {
+			workloads = append(workloads, pid)
+		}
+	}
+	return workloads, nil
+}
+
+// cgroupProcs returns the PIDs in the cgroup v2 of the agent, its systemd
+// unit.
+func cgroupProcs() ([]int, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	var cgroup string
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			cgroup = p
+		}
+	}
+	if cgroup == "" {
+		return nil, errors.New("not in a cgroup v2 hierarchy")
+	}
+	procs, err := os.ReadFile(filepath.Join("/sys/fs/cgroup", cgroup, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(procs)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PID %q: %w", field, err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// emptyDir removes what dir holds, keeping dir itself. A missing dir is
+// empty.
+func emptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequestReset POSTs a ResetRequest to the agent's /reset endpoint at url.
+func RequestReset(ctx context.Context, client *http.Client, url string, req ResetRequest) (ResetResponse, error) {
+	var resp ResetResponse
+	body, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return resp, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode >= http.StatusBadRequest {
+		var buf bytes.Buffer
+		buf.ReadFrom(httpResp.Body)
+		msg := strings.TrimSpace(buf.String())
+		if httpResp.StatusCode == http.StatusBadRequest {
+			return resp, fmt.Errorf("%w: %s", ErrInvalidReset, strings.TrimPrefix(msg, ErrInvalidReset.Error()+": "))
+		}
+		return resp, fmt.Errorf("request failed with status %d: %s", httpResp.StatusCode, msg)
+	}
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	return resp, err
+}
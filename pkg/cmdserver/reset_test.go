@@ -0,0 +1,112 @@
+package cmdserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResetterReset(t *testing.T) {
+	scratch := t.TempDir()
+	os.MkdirAll(filepath.Join(scratch, "build", "obj"), 0700)
+	os.WriteFile(filepath.Join(scratch, "out.log"), []byte("log"), 0600)
+	extra := filepath.Join(t.TempDir(), "missing")
+	profile := filepath.Join(t.TempDir(), ".chrome-data")
+	os.MkdirAll(filepath.Join(profile, "Default"), 0700)
+
+	var commands []string
+	seeder := NewProfileSeeder(profile, BrowserUnit, "")
+	seeder.run = func(ctx context.Context, args ...string) error {
+		commands = append(commands, strings.Join(args, " "))
+		return nil
+	}
+	// The agent is PID 1, its workloads 10 and 11 until killed.
+	running := map[int]bool{1: true, 10: true, 11: true}
+	r := NewResetter([]string{scratch}, seeder)
+	r.self = 1
+	r.procs = func() ([]int, error) {
+		var pids []int
+		for pid := range running {
+			pids = append(pids, pid)
+		}
+		return pids, nil
+	}
+	r.kill = func(pid int) error {
+		if pid == r.self {
+			t.Error("agent killed")
+		}
+		delete(running, pid)
+		return nil
+	}
+
+	resp, err := r.Reset(context.Background(), ResetRequest{ScratchPaths: []string{extra}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ResetResponse{
+		KilledProcesses:     2,
+		ClearedPaths:        []string{extra, scratch},
+		BrowserProfileReset: true,
+		Clean:               true,
+	}
+	if extra > scratch {
+		want.ClearedPaths = []string{scratch, extra}
+	}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("Reset = %+v, want %+v", resp, want)
+	}
+	if entries, _ := os.ReadDir(scratch); len(entries) != 0 {
+		t.Errorf("scratch path holds %d entries", len(entries))
+	}
+	if _, err := os.Stat(scratch); err != nil {
+		t.Errorf("scratch path removed: %v", err)
+	}
+	if _, err := os.Stat(profile); !os.IsNotExist(err) {
+		t.Error("profile not removed")
+	}
+	wantCommands := []string{"systemctl stop " + BrowserUnit, "systemctl start " + BrowserUnit}
+	if !reflect.DeepEqual(commands, wantCommands) {
+		t.Errorf("commands = %q, want %q", commands, wantCommands)
+	}
+}
+
+func TestResetterReportsSurvivors(t *testing.T) {
+	seeder := NewProfileSeeder(t.TempDir(), BrowserUnit, "")
+	var commands []string
+	seeder.run = func(ctx context.Context, args ...string) error {
+		commands = append(commands, strings.Join(args, " "))
+		return nil
+	}
+	r := NewResetter(nil, seeder)
+	r.self = 1
+	r.procs = func() ([]int, error) { return []int{1, 10}, nil }
+	r.kill = func(pid int) error { return errors.New("operation not permitted") }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resp, err := r.Reset(ctx, ResetRequest{KeepBrowserProfile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Clean || len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0], "[10] survived") || resp.KilledProcesses != 0 || resp.BrowserProfileReset {
+		t.Errorf("Reset = %+v, want a surviving workload reported", resp)
+	}
+	if want := []string{"systemctl restart " + BrowserUnit}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+}
+
+func TestResetRequestValidate(t *testing.T) {
+	for _, p := range []string{"/", "tmp", "/tmp/../"} {
+		if err := (ResetRequest{ScratchPaths: []string{p}}).Validate(); !errors.Is(err, ErrInvalidReset) {
+			t.Errorf("Validate(%q) = %v, want ErrInvalidReset", p, err)
+		}
+	}
+	if err := (ResetRequest{ScratchPaths: []string{"/home/elara/work"}}).Validate(); err != nil {
+		t.Errorf("Validate = %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package cmdserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceState is the health of a guest service as seen by the agent.
+type ServiceState string
+
+const (
+	// ServiceUp means the service passes its health check.
+	ServiceUp ServiceState = "up"
+	// ServiceStarting means the service has not passed its health check
+	// since its unit was (re)started, e.g. Chrome still launching.
+	ServiceStarting ServiceState = "starting"
+	// ServiceDown means the service's unit is not running, it stopped passing
+	// its health check, or it never came up within serviceStartTimeout.
+	ServiceDown ServiceState = "down"
+
+	// A service that is still not up this long after it started being
+	// probed is reported down.
+	serviceStartTimeout = 2 * time.Minute
+)
+
+// ServiceHealth is the last probed health of a guest service. Services are
+// the capabilities declared with a port.
+type ServiceHealth struct {
+	Name  string       `json:"name"`
+	Port  int          `json:"port"`
+	State ServiceState `json:"state"`
+	// Reason explains why a service is not up.
+	Reason string `json:"reason,omitempty"`
+	// Since is when the service entered State.
+	Since time.Time `json:"since"`
+}
+
+// String describes the health for error messages, e.g. "browser: starting".
+func (h ServiceHealth) String() string {
+	if h.Reason == "" {
+		return fmt.Sprintf("%s: %s", h.Name, h.State)
+	}
+	return fmt.Sprintf("%s: %s (%s)", h.Name, h.State, h.Reason)
+}
+
+// ServicesResponse lists the health of a guest's services.
+type ServicesResponse struct {
+	Services []ServiceHealth `json:"services"`
+}
+
+// ServiceMonitor periodically probes the services declared in a capabilities
+// directory and remembers their health.
+type ServiceMonitor struct {
+	dir string
+	// unitState returns the systemd ActiveState of a unit. Replaced in tests.
+	unitState func(ctx context.Context, unit string) string
+
+	lock     sync.Mutex
+	services []ServiceHealth
+}
+
+// NewServiceMonitor returns a monitor for the services declared in dir.
+func NewServiceMonitor(dir string) *ServiceMonitor {
+	return &ServiceMonitor{
+		dir:       dir,
+		unitState: systemdUnitState,
+	}
+}
+
+// Run probes the services every interval until ctx is done.
+func (m *ServiceMonitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check probes every declared service once. Declarations are re-read each
+// time so that services added or removed at runtime are picked up.
+func (m *ServiceMonitor) Check(ctx context.Context) {
+	declared, _ := LoadCapabilities(m.dir)
+
+	m.lock.Lock()
+	previous := make(map[string]ServiceHealth, len(m.services))
+	for _, h := range m.services {
+		previous[h.Name] = h
+	}
+	m.lock.Unlock()
+
+	var probed []Capability
+	for _, c := range declared {
+		if c.Error == "" && c.Port != 0 {
+			probed = append(probed, c)
+		}
+	}
+
+	now := time.Now()
+	services := make([]ServiceHealth, len(probed))
+	var wg sync.WaitGroup
+	for i, c := range probed {
+		wg.Add(1)
+		go func(i int, c Capability) {
+			defer wg.Done()
+			prev, seen := previous[c.Name]
+			state, reason := m.probe(ctx, c, prev)
+			since := now
+			if seen && prev.State == state {
+				since = prev.Since
+			}
+			services[i] = ServiceHealth{
+				Name:   c.Name,
+				Port:   c.Port,
+				State:  state,
+				Reason: reason,
+				Since:  since,
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	m.lock.Lock()
+	m.services = services
+	m.lock.Unlock()
+}
+
+// probe returns the new state of a service given its previous health.
+func (m *ServiceMonitor) probe(ctx context.Context, c Capability, prev ServiceHealth) (ServiceState, string) {
+	ctx, cancel := context.WithTimeout(ctx, capabilityProbeTimeout)
+	defer cancel()
+
+	if c.Unit != "" {
+		switch state := m.unitState(ctx, c.Unit); state {
+		case "active":
+		case "activating", "reloading":
+			return ServiceStarting, fmt.Sprintf("unit %s is %s", c.Unit, state)
+		default:
+			return ServiceDown, fmt.Sprintf("unit %s is %s", c.Unit, state)
+		}
+	}
+
+	if err := checkEndpoint(ctx, c.Port, c.Health); err != nil {
+		switch {
+		case prev.State == ServiceUp || prev.State == ServiceDown:
+			return ServiceDown, err.Error()
+		case prev.State == ServiceStarting && time.Since(prev.Since) > serviceStartTimeout:
+			return ServiceDown, fmt.Sprintf("not up after %v: %v", serviceStartTimeout, err)
+		default:
+			return ServiceStarting, err.Error()
+		}
+	}
+	return ServiceUp, ""
+}
+
+// Services returns the health of every service as of the last check.
+func (m *ServiceMonitor) Services() []ServiceHealth {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]ServiceHealth{}, m.services...)
+}
+
+// systemdUnitState returns the ActiveState of unit, e.g. "active" or
+// "activating", or "unknown" if systemd can't be asked.
+func systemdUnitState(ctx context.Context, unit string) string {
+	// is-active exits non-zero for inactive units but still prints the state.
+	out, _ := exec.CommandContext(ctx, "systemctl", "is-active", unit).Output()
+	if state := strings.TrimSpace(string(out)); state != "" {
+		return state
+	}
+	return "unknown"
+}
+
+// checkEndpoint verifies that port accepts connections and, if health is set,
+// that a GET of that path on it succeeds.
+func checkEndpoint(ctx context.Context, port int, health string) error {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	if health == "" {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("port %d is not accepting connections", port)
+		}
+		conn.Close()
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+health, nil)
+	if err != nil {
+		return fmt.Errorf("invalid health path %q: %v", health, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check on port %d failed: %v", port, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("health check on port %d returned %d", port, resp.StatusCode)
+	}
+	return nil
+}
+
+// FetchServices reads a ServicesResponse from url, which is either the agent's
+// /services endpoint or the REST API's per VM equivalent.
+func FetchServices(ctx context.Context, client *http.Client, url string) ([]ServiceHealth, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status: %d", resp.StatusCode)
+	}
+
+	var services ServicesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
+		return nil, fmt.Errorf("failed to decode services: %v", err)
+	}
+	return services.Services, nil
+}
+
+// ServiceOnPort returns the service listening on a guest port.
+func ServiceOnPort(services []ServiceHealth, port int) (ServiceHealth, bool) {
+	for _, h := range services {
+		if h.Port == port {
+			return h, true
+		}
+	}
+	return ServiceHealth{}, false
+}
@@ -0,0 +1,132 @@
+package cmdserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUnits stands in for systemd in ServiceMonitor tests.
+type fakeUnits struct {
+	lock   sync.Mutex
+	states map[string]string
+}
+
+func (f *fakeUnits) set(unit string, state string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.states[unit] = state
+}
+
+func (f *fakeUnits) state(ctx context.Context, unit string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.states[unit]
+}
+
+func serverPort(t *testing.T, srv *httptest.Server) int {
+	t.Helper()
+	return srv.Listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestServiceMonitor(t *testing.T) {
+	healthy := true
+	var lock sync.Mutex
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.URL.Path != "/health" || !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer web.Close()
+
+	dir := t.TempDir()
+	declarations := map[string]string{
+		"web.yaml":      fmt.Sprintf("name: web\nport: %d\nhealth: /health\nunit: web.service\n", serverPort(t, web)),
+		"exec.yaml":     "name: exec\n",
+		"missing.yaml":  "name: missing\nport: 1\n",
+		"disabled.yaml": "name: disabled\nport: 1\nunit: disabled.service\n",
+	}
+	for name, content := range declarations {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	units := &fakeUnits{states: map[string]string{
+		"web.service":      "activating",
+		"disabled.service": "failed",
+	}}
+	m := NewServiceMonitor(dir)
+	m.unitState = units.state
+
+	states := func() map[string]ServiceHealth {
+		m.Check(context.Background())
+		got := make(map[string]ServiceHealth)
+		for _, h := range m.Services() {
+			got[h.Name] = h
+		}
+		return got
+	}
+
+	got := states()
+	if len(got) != 3 {
+		t.Fatalf("Monitored %v, want the 3 services with ports", got)
+	}
+	if h := got["web"]; h.State != ServiceStarting {
+		t.Errorf("Activating unit reported as %v", h)
+	}
+	if h := got["missing"]; h.State != ServiceStarting || !strings.Contains(h.Reason, "not accepting") {
+		t.Errorf("Service that never came up reported as %v", h)
+	}
+	if h := got["disabled"]; h.State != ServiceDown || !strings.Contains(h.String(), "disabled: down (unit disabled.service is failed)") {
+		t.Errorf("Failed unit reported as %v", h)
+	}
+
+	units.set("web.service", "active")
+	got = states()
+	if h := got["web"]; h.State != ServiceUp || h.Reason != "" {
+		t.Errorf("Healthy service reported as %v", h)
+	}
+	since := got["web"].Since
+
+	time.Sleep(10 * time.Millisecond)
+	if h := states()["web"]; h.State != ServiceUp || !h.Since.Equal(since) {
+		t.Errorf("Still healthy service reported as %v, want up since %v", h, since)
+	}
+
+	lock.Lock()
+	healthy = false
+	lock.Unlock()
+	if h := states()["web"]; h.State != ServiceDown || !strings.Contains(h.Reason, "returned 503") {
+		t.Errorf("Service failing its health check reported as %v", h)
+	}
+}
+
+func TestFetchServices(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"services":[{"name":"browser","port":9223,"state":"starting","hostPort":"3000"}]}`)
+	}))
+	defer srv.Close()
+
+	services, err := FetchServices(context.Background(), http.DefaultClient, srv.URL)
+	if err != nil {
+		t.Fatalf("FetchServices failed: %v", err)
+	}
+	h, ok := ServiceOnPort(services, 9223)
+	if !ok || h.String() != "browser: starting" {
+		t.Errorf("ServiceOnPort(9223) = %v, %v", h, ok)
+	}
+	if _, ok := ServiceOnPort(services, 5901); ok {
+		t.Errorf("Found a service on an undeclared port")
+	}
+}
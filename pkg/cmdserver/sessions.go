@@ -0,0 +1,101 @@
+package cmdserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Kinds of proxied sessions that are accounted for.
+const (
+	SessionCDP = "cdp"
+	SessionVNC = "vnc"
+)
+
+// SessionReport is sent by a proxy, e.g. the CDP or VNC proxy, when a session
+// it relayed ends so that the session's duration can be accounted for.
+type SessionReport struct {
+	Kind    string  `json:"kind"`
+	Seconds float64 `json:"seconds"`
+}
+
+// SessionTotals are the cumulative seconds of reported sessions per kind
+// since the agent started.
+type SessionTotals struct {
+	Seconds map[string]float64 `json:"seconds"`
+}
+
+// SessionCounter accumulates reported sessions.
+type SessionCounter struct {
+	lock    sync.Mutex
+	seconds map[string]float64
+}
+
+// Add accounts a session of the given kind.
+func (c *SessionCounter) Add(kind string, d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.seconds == nil {
+		c.seconds = make(map[string]float64)
+	}
+	c.seconds[kind] += d.Seconds()
+}
+
+// Totals returns the sessions accounted so far.
+func (c *SessionCounter) Totals() SessionTotals {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	totals := SessionTotals{Seconds: make(map[string]float64, len(c.seconds))}
+	for kind, seconds := range c.seconds {
+		totals.Seconds[kind] = seconds
+	}
+	return totals
+}
+
+// ReportSession POSTs a SessionReport to url, which is either the agent's
+// /sessions endpoint or the REST API's per VM equivalent.
+func ReportSession(ctx context.Context, client *http.Client, url string, kind string, d time.Duration) error {
+	body, err := json.Marshal(SessionReport{Kind: kind, Seconds: d.Seconds()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("request failed with status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// FetchSessionTotals reads the agent's SessionTotals from url.
+func FetchSessionTotals(ctx context.Context, client *http.Client, url string) (SessionTotals, error) {
+	var totals SessionTotals
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return totals, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return totals, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return totals, fmt.Errorf("request failed with status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&totals); err != nil {
+		return totals, fmt.Errorf("failed to decode session totals: %v", err)
+	}
+	return totals, nil
+}
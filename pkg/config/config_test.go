@@ -0,0 +1,39 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressionUpstream(t *testing.T) {
+	for _, tc := range []struct {
+		upstream string
+		wantErr  bool
+	}{
+		{upstream: ""},
+		{upstream: CompressionUpstreamPassthrough},
+		{upstream: CompressionUpstreamRecompress},
+		{upstream: "passthru", wantErr: true},
+		{upstream: "Recompress", wantErr: true},
+	} {
+		configFile := filepath.Join(t.TempDir(), "config.yaml")
+		data := "guestservices:\n" +
+			"  cdpserver:\n    compression:\n      upstream: \"" + tc.upstream + "\"\n" +
+			"  novncserver:\n    compression:\n      upstream: \"" + tc.upstream + "\"\n"
+		if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, cdpErr := GetCDPServerConfig(configFile)
+		_, novncErr := GetNoVNCServerConfig(configFile)
+		for name, err := range map[string]error{"cdpserver": cdpErr, "novncserver": novncErr} {
+			if (err != nil) != tc.wantErr {
+				t.Errorf("%s: %q: error = %v, wantErr %t", name, tc.upstream, err, tc.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), `"`+tc.upstream+`"`) {
+				t.Errorf("%s: error %q doesn't name %q", name, err, tc.upstream)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Package embedtoken issues and verifies the short-lived tokens that let a
+// browser embedding a sandbox's UI, e.g. in an iframe of another product,
+// open its terminal or desktop without holding an API key. Tokens are signed
+// by the restserver with an ed25519 key, so that services in the guest can
+// verify them with the public key without being able to issue any.
+package embedtoken
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scopes of tokens, the UI they open.
+const (
+	// ScopeTerminal opens the terminal page of a VM and its PTY WebSocket.
+	ScopeTerminal = "terminal"
+	// ScopeVNC opens the noVNC client of a VM and its websockify WebSocket.
+	ScopeVNC = "vnc"
+)
+
+const (
+	// QueryParam carries a token in a URL.
+	QueryParam = "embed_token"
+	// CookieName carries a token once a page was opened with it.
+	CookieName = "arrakis_embed"
+)
+
+// Claims are what a token grants.
+type Claims struct {
+	Scope string `json:"scope"`
+	// VMID is the VM the token opens.
+	VMID string `json:"vmId"`
+	// IP is the VM's address, which services in the guest, which don't know
+	// the VM's ID, match instead.
+	IP string `json:"ip,omitempty"`
+	// Expiry is in seconds since the epoch.
+	Expiry int64 `json:"exp"`
+}
+
+// Issue returns a token granting claims, signed with key.
+func Issue(key ed25519.PrivateKey, claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key, []byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify returns the claims of a token signed with the private key of key,
+// unless it expired by now.
+func Verify(key ed25519.PublicKey, token string, now time.Time) (Claims, error) {
+	var claims Claims
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, errors.New("malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !ed25519.Verify(key, []byte(encoded), signature) {
+		return claims, errors.New("invalid token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return claims, fmt.Errorf("malformed token: %v", err)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("malformed token: %v", err)
+	}
+	if now.Unix() >= claims.Expiry {
+		return claims, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+// FromRequest returns the token carried by a request, in its QueryParam or
+// its cookie, or "".
+func FromRequest(r *http.Request) string {
+	if token := r.URL.Query().Get(QueryParam); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(CookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// SetCookie keeps a token for the requests of the page opened with it until
+// it expires. In an iframe of another site the cookie is only sent over TLS,
+// the query parameter has to be passed on otherwise.
+func SetCookie(w http.ResponseWriter, r *http.Request, token string, claims Claims) {
+	cookie := &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Unix(claims.Expiry, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if r.TLS != nil {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, cookie)
+}
+
+// ReadPrivateKey reads a base64 encoded ed25519 private key from path, as
+// written by `arrakis-agentsign keygen`.
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	key, err := readKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key in %s", path)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// ReadPublicKey reads a base64 encoded ed25519 public key from path.
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := readKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key in %s", path)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func readKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %v", path, err)
+	}
+	return key, nil
+}
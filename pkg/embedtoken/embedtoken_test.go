@@ -0,0 +1,63 @@
+package embedtoken
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssueVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := Claims{Scope: ScopeVNC, VMID: "id", IP: "10.20.1.2", Expiry: now.Add(time.Minute).Unix()}
+	token, err := Issue(private, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Verify(public, token, now)
+	if err != nil || got != claims {
+		t.Errorf("Verify() = %+v, %v, want %+v", got, err, claims)
+	}
+	if _, err := Verify(public, token, now.Add(time.Minute)); err == nil {
+		t.Errorf("Verify() of an expired token succeeded")
+	}
+
+	otherPublic, _, _ := ed25519.GenerateKey(nil)
+	encoded, sig, _ := strings.Cut(token, ".")
+	tampered, _ := Issue(private, Claims{Scope: ScopeTerminal, VMID: "id", Expiry: claims.Expiry})
+	tamperedEncoded, _, _ := strings.Cut(tampered, ".")
+	for name, test := range map[string]struct {
+		key   ed25519.PublicKey
+		token string
+	}{
+		"other key":       {otherPublic, token},
+		"other claims":    {public, tamperedEncoded + "." + sig},
+		"no signature":    {public, encoded},
+		"garbage":         {public, "not.a.token"},
+		"empty signature": {public, encoded + "."},
+	} {
+		if _, err := Verify(test.key, test.token, now); err == nil {
+			t.Errorf("%s: Verify() succeeded", name)
+		}
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/websockify?"+QueryParam+"=query", nil)
+	r.AddCookie(&http.Cookie{Name: CookieName, Value: "cookie"})
+	if got := FromRequest(r); got != "query" {
+		t.Errorf("FromRequest() = %q, want the query parameter first", got)
+	}
+	r = httptest.NewRequest("GET", "/websockify", nil)
+	r.AddCookie(&http.Cookie{Name: CookieName, Value: "cookie"})
+	if got := FromRequest(r); got != "cookie" {
+		t.Errorf("FromRequest() = %q, want the cookie", got)
+	}
+}
@@ -0,0 +1,186 @@
+// Package handover lets a daemon be upgraded in place without dropping its
+// listening sockets or the sessions already being served.
+//
+// On SIGUSR2 the running process re-executes its own binary and passes the
+// listening sockets to the child, which starts accepting immediately. The
+// parent stops accepting, finishes the sessions it already owns and exits.
+// Sockets passed by systemd socket activation are picked up as well.
+package handover
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/coreos/go-systemd/activation"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// listenFDsEnv carries the number of inherited listening sockets to a
+	// re-executed child.
+	listenFDsEnv = "ARRAKIS_LISTEN_FDS"
+	// Children get the listeners as their first extra files, i.e. after stdin,
+	// stdout and stderr.
+	childFirstListenFD = 3
+)
+
+var (
+	inheritOnce sync.Once
+	inheritLock sync.Mutex
+	inherited   []net.Listener
+	inheritErr  error
+)
+
+// loadInherited collects sockets handed to us by a parent process or by
+// systemd socket activation, in the order they were passed.
+func loadInherited() {
+	if countStr := os.Getenv(listenFDsEnv); countStr != "" {
+		os.Unsetenv(listenFDsEnv)
+		count, err := strconv.Atoi(countStr)
+		if err != nil {
+			inheritErr = fmt.Errorf("invalid %s %q: %v", listenFDsEnv, countStr, err)
+			return
+		}
+		for i := 0; i < count; i++ {
+			file := os.NewFile(uintptr(childFirstListenFD+i), "inherited-listener")
+			listener, err := net.FileListener(file)
+			file.Close()
+			if err != nil {
+				inheritErr = fmt.Errorf("failed to use inherited listener %d: %v", i, err)
+				return
+			}
+			log.Infof("Using listener inherited from parent: %s", listener.Addr())
+			inherited = append(inherited, listener)
+		}
+		return
+	}
+
+	listeners, err := activation.Listeners()
+	if err != nil {
+		inheritErr = fmt.Errorf("failed to get systemd activated listeners: %v", err)
+		return
+	}
+	for _, listener := range listeners {
+		if listener != nil {
+			log.Infof("Using systemd activated listener: %s", listener.Addr())
+			inherited = append(inherited, listener)
+		}
+	}
+}
+
+// Listen returns the next listener to serve on. Sockets inherited from a
+// parent during a handover, or passed by systemd socket activation, are
+// returned first and in order; once they run out a fresh socket is bound on
+// addr. Callers opening several listeners must therefore always open them in
+// the same order.
+func Listen(network string, addr string) (net.Listener, error) {
+	inheritOnce.Do(loadInherited)
+	if inheritErr != nil {
+		return nil, inheritErr
+	}
+
+	inheritLock.Lock()
+	defer inheritLock.Unlock()
+	if len(inherited) > 0 {
+		listener := inherited[0]
+		inherited = inherited[1:]
+		return listener, nil
+	}
+
+	if network == "unix" {
+		// Remove a stale socket left behind by an unclean exit.
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", addr, err)
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// reexec starts a new copy of the running binary, with the same arguments,
+// and hands it duplicates of listeners.
+func reexec(listeners []net.Listener) (*os.Process, error) {
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("listener %T cannot be handed over", listener)
+		}
+		file, err := filer.File()
+		if err != nil {
+			return nil, fmt.Errorf("failed to duplicate listener %s: %v", listener.Addr(), err)
+		}
+		files = append(files, file)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find own executable: %v", err)
+	}
+
+	// WATCHDOG_PID names the parent; the child picks up the watchdog once it
+	// reports itself as the main process.
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			env = append(env, kv)
+		}
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(env, fmt.Sprintf("%s=%d", listenFDsEnv, len(files)))
+	cmd.ExtraFiles = files
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", exe, err)
+	}
+	return cmd.Process, nil
+}
+
+// WaitForSignal blocks until the process is asked to stop. SIGINT and SIGTERM
+// return false. SIGUSR2 hands listeners over to a freshly started copy of the
+// binary and returns true; the caller should then stop accepting, let its
+// active sessions finish and exit. A failed handover is logged and the
+// process keeps serving.
+func WaitForSignal(listeners ...net.Listener) bool {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	defer signal.Stop(sigChan)
+
+	for sig := range sigChan {
+		if sig != syscall.SIGUSR2 {
+			return false
+		}
+
+		process, err := reexec(listeners)
+		if err != nil {
+			log.Errorf("Handover failed, continuing to serve: %v", err)
+			continue
+		}
+		log.Infof("Handed %d listener(s) over to new process %d", len(listeners), process.Pid)
+		// The socket files now belong to the child and must survive our
+		// listeners being closed.
+		for _, listener := range listeners {
+			if unixListener, ok := listener.(*net.UnixListener); ok {
+				unixListener.SetUnlinkOnClose(false)
+			}
+		}
+		// The child is not waited on; it outlives us.
+		process.Release()
+		return true
+	}
+	return false
+}
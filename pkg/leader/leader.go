@@ -0,0 +1,297 @@
+// Package leader elects which of a pair of restservers sharing a state dir
+// serves the API and manages VMs, so that the control plane survives the loss
+// of either host.
+//
+// The leader holds a lease in a file on the shared storage and renews it
+// periodically. The standby takes the lease once it has expired. Reads and
+// writes of the lease are serialized with a lock on a file next to it, which
+// NFS and other POSIX shared file systems support. A leader that can't renew
+// its lease steps down an interval before the lease expires, so clocks of the
+// pair must agree within the renew interval.
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const defaultLeaseDuration = 15 * time.Second
+
+// ErrLost is returned once the lease was taken over or couldn't be renewed in
+// time.
+var ErrLost = errors.New("leadership lost")
+
+// Lease is the content of the lease file.
+type Lease struct {
+	// Holder is the ID of the instance holding the lease, and URL where it
+	// serves the API.
+	Holder string `json:"holder"`
+	URL    string `json:"url,omitempty"`
+	// Session distinguishes runs of the same instance, e.g. across restarts.
+	Session string `json:"session"`
+	// Term is incremented every time the lease changes hands.
+	Term    int64     `json:"term"`
+	Expires time.Time `json:"expires"`
+}
+
+// Held reports whether the lease is held by anyone at now.
+func (l Lease) Held(now time.Time) bool {
+	return l.Session != "" && now.Before(l.Expires)
+}
+
+// Elector takes and holds the lease for an instance.
+type Elector struct {
+	path     string
+	id       string
+	url      string
+	session  string
+	duration time.Duration
+	interval time.Duration
+	now      func() time.Time
+}
+
+// New returns an elector configured by c.
+func New(c config.LeaderElectionConfig) (*Elector, error) {
+	if c.LeaseFile == "" {
+		return nil, errors.New("lease file is required")
+	}
+	id := c.ID
+	if id == "" {
+		var err error
+		if id, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("failed to get hostname: %w", err)
+		}
+	}
+	duration := c.LeaseDuration
+	if duration <= 0 {
+		duration = defaultLeaseDuration
+	}
+	interval := c.RenewInterval
+	if interval <= 0 {
+		interval = duration / 3
+	}
+	if interval >= duration {
+		return nil, fmt.Errorf("renew interval %s must be shorter than lease duration %s", interval, duration)
+	}
+	session := make([]byte, 8)
+	if _, err := rand.Read(session); err != nil {
+		return nil, fmt.Errorf("failed to generate session: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.LeaseFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lease directory: %w", err)
+	}
+	return &Elector{
+		path:     c.LeaseFile,
+		id:       id,
+		url:      c.AdvertiseURL,
+		session:  hex.EncodeToString(session),
+		duration: duration,
+		interval: interval,
+		now:      time.Now,
+	}, nil
+}
+
+// ID returns the ID of the instance.
+func (e *Elector) ID() string {
+	return e.id
+}
+
+// Current returns the lease as last written, the zero Lease if there is none.
+func (e *Elector) Current() (Lease, error) {
+	return e.read()
+}
+
+// Campaign blocks until the instance holds the lease, or ctx is done.
+func (e *Elector) Campaign(ctx context.Context) (Lease, error) {
+	logged := ""
+	for {
+		lease, ok, err := e.tryAcquire()
+		switch {
+		case err != nil:
+			log.WithError(err).Warn("Failed to take the leader lease")
+		case ok:
+			log.WithField("term", lease.Term).Infof("Took the leader lease as %s", e.id)
+			return lease, nil
+		case lease.Holder != logged:
+			log.Infof("Standing by, %s leads at %s", lease.Holder, lease.URL)
+			logged = lease.Holder
+		}
+		select {
+		case <-ctx.Done():
+			return Lease{}, ctx.Err()
+		case <-time.After(e.interval):
+		}
+	}
+}
+
+// Hold renews lease until ctx is done, when it is released for the standby to
+// take over right away, or until it is lost, when an error wrapping ErrLost
+// is returned.
+func (e *Elector) Hold(ctx context.Context, lease Lease) error {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := e.release(); err != nil {
+				log.WithError(err).Warn("Failed to release the leader lease")
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		// Storage that hangs must not keep us leading past the lease.
+		type renewal struct {
+			lease Lease
+			err   error
+		}
+		result := make(chan renewal, 1)
+		go func() {
+			renewed, err := e.renew(lease)
+			result <- renewal{renewed, err}
+		}()
+		select {
+		case r := <-result:
+			if r.err == nil {
+				lease = r.lease
+				continue
+			}
+			if errors.Is(r.err, ErrLost) {
+				return r.err
+			}
+			if !e.now().Before(e.stepDown(lease)) {
+				return fmt.Errorf("%w: failed to renew the lease: %v", ErrLost, r.err)
+			}
+			log.WithError(r.err).Warn("Failed to renew the leader lease, retrying")
+		case <-time.After(e.stepDown(lease).Sub(e.now())):
+			return fmt.Errorf("%w: renewing the lease timed out", ErrLost)
+		}
+	}
+}
+
+// stepDown is when a leader that couldn't renew lease must stop leading,
+// an interval before the standby may take over.
+func (e *Elector) stepDown(lease Lease) time.Time {
+	return lease.Expires.Add(-e.interval)
+}
+
+// renew extends lease, held by this instance.
+func (e *Elector) renew(lease Lease) (Lease, error) {
+	renewed, ok, err := e.tryAcquire()
+	if err != nil {
+		return Lease{}, err
+	}
+	if !ok || renewed.Term != lease.Term {
+		return Lease{}, fmt.Errorf("%w: %s took over the lease", ErrLost, renewed.Holder)
+	}
+	return renewed, nil
+}
+
+// tryAcquire takes the lease if it is free or expired, or renews it if this
+// instance holds it. It returns the lease as it is afterwards and whether
+// this instance holds it.
+func (e *Elector) tryAcquire() (Lease, bool, error) {
+	unlock, err := e.lock()
+	if err != nil {
+		return Lease{}, false, err
+	}
+	defer unlock()
+
+	lease, err := e.read()
+	if err != nil {
+		return Lease{}, false, err
+	}
+	now := e.now()
+	if lease.Session != e.session {
+		if lease.Held(now) {
+			return lease, false, nil
+		}
+		lease.Term++
+	}
+	lease.Holder = e.id
+	lease.URL = e.url
+	lease.Session = e.session
+	lease.Expires = now.Add(e.duration)
+	if err := e.write(lease); err != nil {
+		return Lease{}, false, err
+	}
+	return lease, true, nil
+}
+
+// release expires the lease if this instance holds it.
+func (e *Elector) release() error {
+	unlock, err := e.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	lease, err := e.read()
+	if err != nil {
+		return err
+	}
+	if lease.Session != e.session {
+		return nil
+	}
+	lease.Expires = e.now()
+	return e.write(lease)
+}
+
+func (e *Elector) lock() (func(), error) {
+	f, err := os.OpenFile(e.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock lease: %w", err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (e *Elector) read() (Lease, error) {
+	var lease Lease
+	data, err := os.ReadFile(e.path)
+	if os.IsNotExist(err) {
+		return lease, nil
+	}
+	if err != nil {
+		return lease, fmt.Errorf("failed to read lease: %w", err)
+	}
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return lease, fmt.Errorf("failed to parse lease: %w", err)
+	}
+	return lease, nil
+}
+
+// write replaces the lease file atomically, so that readers never see a
+// partial lease.
+func (e *Elector) write(lease Lease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	tmp := e.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write lease: %w", err)
+	}
+	if err := os.Rename(tmp, e.path); err != nil {
+		return fmt.Errorf("failed to write lease: %w", err)
+	}
+	return nil
+}
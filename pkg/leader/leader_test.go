@@ -0,0 +1,101 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+// newTestPair returns two electors sharing a lease file and a clock.
+func newTestPair(t *testing.T) (*Elector, *Elector, *time.Time) {
+	t.Helper()
+	leaseFile := filepath.Join(t.TempDir(), "leader.lease")
+	now := time.Unix(1000, 0)
+	var electors []*Elector
+	for _, id := range []string{"a", "b"} {
+		e, err := New(config.LeaderElectionConfig{
+			LeaseFile:     leaseFile,
+			ID:            id,
+			AdvertiseURL:  "http://" + id + ":7000",
+			LeaseDuration: 15 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.now = func() time.Time { return now }
+		electors = append(electors, e)
+	}
+	return electors[0], electors[1], &now
+}
+
+func TestFailover(t *testing.T) {
+	a, b, now := newTestPair(t)
+
+	lease, ok, err := a.tryAcquire()
+	if err != nil || !ok || lease.Term != 1 {
+		t.Fatalf("a.tryAcquire() = %+v, %v, %v, want term 1", lease, ok, err)
+	}
+	if current, ok, err := b.tryAcquire(); err != nil || ok || current.Holder != "a" || current.URL != "http://a:7000" {
+		t.Fatalf("b.tryAcquire() while a leads = %+v, %v, %v", current, ok, err)
+	}
+
+	*now = now.Add(10 * time.Second)
+	if lease, err = a.renew(lease); err != nil {
+		t.Fatalf("a.renew() = %v", err)
+	}
+	*now = now.Add(10 * time.Second)
+	if _, ok, _ := b.tryAcquire(); ok {
+		t.Fatal("b took a renewed lease")
+	}
+
+	// a stops renewing, b takes over once the lease expires.
+	*now = now.Add(16 * time.Second)
+	taken, ok, err := b.tryAcquire()
+	if err != nil || !ok || taken.Term != 2 || taken.Holder != "b" {
+		t.Fatalf("b.tryAcquire() after expiry = %+v, %v, %v, want term 2", taken, ok, err)
+	}
+	if _, err := a.renew(lease); !errors.Is(err, ErrLost) {
+		t.Errorf("a.renew() after b took over = %v, want ErrLost", err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	a, b, _ := newTestPair(t)
+	lease, err := a.Campaign(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.Hold(ctx, lease); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Hold() = %v, want context.Canceled", err)
+	}
+	if _, ok, err := b.tryAcquire(); err != nil || !ok {
+		t.Errorf("b.tryAcquire() after a released = %v, %v", ok, err)
+	}
+}
+
+func TestCampaignCancelled(t *testing.T) {
+	a, b, _ := newTestPair(t)
+	if _, err := a.Campaign(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b.interval = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.Campaign(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Campaign() while a leads = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	leaseFile := filepath.Join(t.TempDir(), "leader.lease")
+	if _, err := New(config.LeaderElectionConfig{LeaseFile: leaseFile, LeaseDuration: time.Second, RenewInterval: time.Second}); err == nil {
+		t.Error("New() accepted a renew interval as long as the lease")
+	}
+}
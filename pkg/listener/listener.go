@@ -0,0 +1,393 @@
+// Package listener serves an HTTP handler on every address configured in a
+// service's `listeners` section, each with its own TLS and authentication
+// policy.
+package listener
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/handover"
+	"github.com/abshkbh/arrakis/pkg/mtls"
+	"github.com/abshkbh/arrakis/pkg/oidc"
+)
+
+const (
+	defaultNetwork = "tcp"
+)
+
+// Liveness endpoints left open on every listener so supervisors can probe them
+// regardless of the auth policy.
+var healthPaths = map[string]bool{
+	"/health":    true, // cdpserver, novncserver
+	"/v1/health": true, // restserver
+}
+
+// Defaults returns the listener configuration to use for a service. An
+// explicit `listeners` section wins; otherwise the service's legacy
+// single-address settings, its address and the interface to bind it on, are
+// turned into one unauthenticated listener.
+func Defaults(listeners []config.ListenerConfig, network string, addr string, iface string) []config.ListenerConfig {
+	if len(listeners) > 0 {
+		return listeners
+	}
+	return []config.ListenerConfig{{Network: network, Address: addr, Interface: iface}}
+}
+
+type entry struct {
+	config   config.ListenerConfig
+	listener net.Listener
+	server   *http.Server
+	// clientCAs verify client certificates, nil unless required.
+	clientCAs *x509.CertPool
+	// verifier validates tokens of the "oidc" auth policy.
+	verifier *oidc.Verifier
+}
+
+// Set is the group of listeners a service serves on.
+type Set struct {
+	entries []*entry
+	// embedded passes requests on without the listeners' authentication,
+	// see AllowEmbedded.
+	embedded func(*http.Request) bool
+}
+
+// interfaceAddrs returns the addresses of a network interface. Replaced in
+// tests.
+var interfaceAddrs = func(name string) ([]net.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return iface.Addrs()
+}
+
+// BindAddress returns the address to bind addr, a host:port, on: addr itself,
+// or with iface set, the port on the address of that network interface, so
+// that the service can't be reached through the host's other interfaces.
+// IPv4 addresses are preferred, and link-local ones skipped. With iface set,
+// addr's host must be empty or unspecified, e.g. "0.0.0.0".
+func BindAddress(iface string, addr string) (string, error) {
+	if iface == "" {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return "", fmt.Errorf("address %s and interface %s both pick where to bind, set only one", addr, iface)
+	}
+	addrs, err := interfaceAddrs(iface)
+	if err != nil {
+		return "", fmt.Errorf("interface %s: %v", iface, err)
+	}
+	var found net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			found = ipNet.IP
+			break
+		}
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+	if found == nil {
+		return "", fmt.Errorf("interface %s has no address", iface)
+	}
+	return net.JoinHostPort(found.String(), port), nil
+}
+
+// Open binds, or inherits during a handover, a listener for every config. The
+// order of configs must be stable across restarts.
+func Open(configs []config.ListenerConfig) (*Set, error) {
+	set := &Set{}
+	for _, cfg := range configs {
+		if cfg.Network == "" {
+			cfg.Network = defaultNetwork
+		}
+		if err := validate(cfg); err != nil {
+			set.Close()
+			return nil, err
+		}
+		addr, err := BindAddress(cfg.Interface, cfg.Address)
+		if err != nil {
+			set.Close()
+			return nil, fmt.Errorf("listener %s: %v", cfg.Address, err)
+		}
+		cfg.Address = addr
+
+		var clientCAs *x509.CertPool
+		if cfg.TLS.ClientCAFile != "" {
+			pool, err := mtls.LoadCAPool(cfg.TLS.ClientCAFile)
+			if err != nil {
+				set.Close()
+				return nil, fmt.Errorf("listener %s: %v", cfg.Address, err)
+			}
+			clientCAs = pool
+		}
+
+		var verifier *oidc.Verifier
+		if cfg.Auth.Policy == config.ListenerAuthOIDC {
+			v, err := oidc.NewVerifier(cfg.Auth.OIDC)
+			if err != nil {
+				set.Close()
+				return nil, fmt.Errorf("listener %s: %v", cfg.Address, err)
+			}
+			verifier = v
+		}
+
+		l, err := handover.Listen(cfg.Network, cfg.Address)
+		if err != nil {
+			set.Close()
+			return nil, fmt.Errorf("failed to listen on %s %s: %v", cfg.Network, cfg.Address, err)
+		}
+		set.entries = append(set.entries, &entry{config: cfg, listener: l, clientCAs: clientCAs, verifier: verifier})
+	}
+	return set, nil
+}
+
+func validate(cfg config.ListenerConfig) error {
+	switch cfg.Auth.Policy {
+	case "", config.ListenerAuthNone:
+	case config.ListenerAuthToken:
+		if len(cfg.Auth.Tokens) == 0 {
+			return fmt.Errorf("listener %s: token auth requires at least one token", cfg.Address)
+		}
+	case config.ListenerAuthOIDC:
+		if cfg.Auth.OIDC.Issuer == "" || cfg.Auth.OIDC.Audience == "" {
+			return fmt.Errorf("listener %s: oidc auth requires an issuer and an audience", cfg.Address)
+		}
+	default:
+		return fmt.Errorf("listener %s: unknown auth policy %q", cfg.Address, cfg.Auth.Policy)
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("listener %s: tls needs both cert_file and key_file", cfg.Address)
+	}
+	if cfg.TLS.ClientCAFile != "" && !cfg.TLS.Enabled() {
+		return fmt.Errorf("listener %s: client_ca_file needs cert_file and key_file", cfg.Address)
+	}
+	if cfg.Interface != "" && cfg.Network == "unix" {
+		return fmt.Errorf("listener %s: interface doesn't apply to unix sockets", cfg.Address)
+	}
+	return nil
+}
+
+// AllowEmbedded lets requests for which allow returns true through without the
+// listeners' token, OIDC or client certificate authentication, e.g. those of a
+// page embedded in another site that carry an embed token instead. It must be
+// called before Serve.
+func (s *Set) AllowEmbedded(allow func(*http.Request) bool) {
+	s.embedded = allow
+}
+
+// Serve starts serving handler on every listener in the background. Errors
+// other than a clean shutdown are fatal, as with a single listener.
+func (s *Set) Serve(handler http.Handler) {
+	for _, e := range s.entries {
+		e.server = &http.Server{
+			Handler: authMiddleware(e.config.Auth, e.verifier, s.embedded, handler),
+		}
+		if e.clientCAs != nil {
+			// Verified in the handler rather than the handshake so that the
+			// health endpoints stay open.
+			e.server.TLSConfig = &tls.Config{
+				ClientCAs:  e.clientCAs,
+				ClientAuth: tls.VerifyClientCertIfGiven,
+			}
+			e.server.Handler = requireClientCert(s.embedded, e.server.Handler)
+		}
+
+		go func(e *entry) {
+			var err error
+			if e.config.TLS.Enabled() {
+				log.Infof("Listening on %s (TLS, client certificates: %t, auth: %s)",
+					e.listener.Addr(), e.clientCAs != nil, policyName(e.config.Auth))
+				err = e.server.ServeTLS(e.listener, e.config.TLS.CertFile, e.config.TLS.KeyFile)
+			} else {
+				log.Infof("Listening on %s (auth: %s)", e.listener.Addr(), policyName(e.config.Auth))
+				err = e.server.Serve(e.listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to serve on %s: %v", e.listener.Addr(), err)
+			}
+		}(e)
+	}
+}
+
+// Listeners returns the raw listeners, e.g. to hand them over on restart.
+func (s *Set) Listeners() []net.Listener {
+	var listeners []net.Listener
+	for _, e := range s.entries {
+		listeners = append(listeners, e.listener)
+	}
+	return listeners
+}
+
+// String describes the addresses being served.
+func (s *Set) String() string {
+	var addrs []string
+	for _, e := range s.entries {
+		addrs = append(addrs, e.listener.Addr().String())
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// LocalURL returns a plain http:// URL for the first TCP listener without
+// TLS, suitable for probing the service from the same host. It returns "" if
+// there is no such listener.
+func (s *Set) LocalURL() string {
+	for _, e := range s.entries {
+		if e.config.TLS.Enabled() {
+			continue
+		}
+		addr, ok := e.listener.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		host := "127.0.0.1"
+		if addr.IP.To4() == nil && !addr.IP.IsUnspecified() {
+			host = "[::1]"
+		}
+		return fmt.Sprintf("http://%s:%d", host, addr.Port)
+	}
+	return ""
+}
+
+// Shutdown gracefully stops all servers. Like http.Server.Shutdown it does not
+// wait for hijacked connections such as WebSockets.
+func (s *Set) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, e := range s.entries {
+		if e.server == nil {
+			continue
+		}
+		if err := e.server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", e.listener.Addr(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the listeners of a set that has not started serving.
+func (s *Set) Close() {
+	for _, e := range s.entries {
+		e.listener.Close()
+	}
+}
+
+func policyName(auth config.ListenerAuthConfig) string {
+	if auth.Policy == "" {
+		return config.ListenerAuthNone
+	}
+	return auth.Policy
+}
+
+// authMiddleware enforces a listener's auth policy on everything except the
+// health endpoints and the requests embedded allows, if not nil. verifier is
+// only used by the "oidc" policy.
+func authMiddleware(auth config.ListenerAuthConfig, verifier *oidc.Verifier, embedded func(*http.Request) bool, next http.Handler) http.Handler {
+	var protected http.Handler
+	switch auth.Policy {
+	case config.ListenerAuthToken:
+		protected = RequireToken(auth.Tokens, next)
+	case config.ListenerAuthOIDC:
+		protected = RequireOIDC(verifier, next)
+	default:
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if healthPaths[r.URL.Path] || (embedded != nil && embedded(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		protected.ServeHTTP(w, r)
+	})
+}
+
+// requireClientCert only passes requests authenticated with a verified client
+// certificate, those for the health endpoints and those embedded allows on to
+// next.
+func requireClientCert(embedded func(*http.Request) bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if healthPaths[r.URL.Path] || (r.TLS != nil && len(r.TLS.VerifiedChains) > 0) || (embedded != nil && embedded(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Warnf("Rejected request without a client certificate from %s for %s", r.RemoteAddr, r.URL.Path)
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	})
+}
+
+// RequireToken only passes requests carrying one of tokens, either as
+// "Authorization: Bearer <token>" or as a `token` query parameter, on to next.
+func RequireToken(tokens []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if validToken(RequestToken(r), tokens) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Warnf("Rejected unauthenticated request from %s for %s", r.RemoteAddr, r.URL.Path)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// RequireOIDC only passes requests carrying a JWT accepted by verifier, passed
+// like the tokens of RequireToken, on to next. The caller's identity is added
+// to the request's context, see oidc.FromContext.
+func RequireOIDC(verifier *oidc.Verifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := RequestToken(r)
+		if token == "" {
+			log.Warnf("Rejected unauthenticated request from %s for %s", r.RemoteAddr, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := verifier.Verify(r.Context(), token)
+		if err != nil {
+			log.Warnf("Rejected request from %s for %s: %v", r.RemoteAddr, r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(oidc.NewContext(r.Context(), id)))
+	})
+}
+
+// RequestToken returns the token r carries, as "Authorization: Bearer
+// <token>" or as a `token` query parameter for clients that can't set
+// headers, e.g. browsers opening WebSockets.
+func RequestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+func validToken(token string, tokens []string) bool {
+	if token == "" {
+		return false
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
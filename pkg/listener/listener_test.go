@@ -0,0 +1,149 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/oidc"
+)
+
+func TestDefaults(t *testing.T) {
+	got := Defaults(nil, "tcp4", "0.0.0.0:7000", "")
+	if len(got) != 1 || got[0].Network != "tcp4" || got[0].Address != "0.0.0.0:7000" {
+		t.Errorf("Defaults(nil) = %v, want one tcp4 listener on 0.0.0.0:7000", got)
+	}
+
+	configured := []config.ListenerConfig{{Address: "127.0.0.1:1"}, {Address: "127.0.0.1:2"}}
+	if got := Defaults(configured, "tcp4", "0.0.0.0:7000", "eth1"); len(got) != 2 {
+		t.Errorf("Defaults(configured) returned %d listeners, want 2", len(got))
+	}
+}
+
+func TestBindAddress(t *testing.T) {
+	orig := interfaceAddrs
+	t.Cleanup(func() { interfaceAddrs = orig })
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		if name != "eth1" {
+			return nil, fmt.Errorf("no such network interface")
+		}
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(24, 32)},
+		}, nil
+	}
+
+	tests := []struct {
+		iface   string
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{"", "127.0.0.1:7000", "127.0.0.1:7000", false},
+		{"eth1", ":7000", "10.0.0.5:7000", false},
+		{"eth1", "0.0.0.0:7000", "10.0.0.5:7000", false},
+		{"eth1", "127.0.0.1:7000", "", true},
+		{"eth2", ":7000", "", true},
+	}
+	for _, test := range tests {
+		got, err := BindAddress(test.iface, test.addr)
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("BindAddress(%q, %q) = %q, %v, want %q", test.iface, test.addr, got, err, test.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.ListenerConfig
+		wantErr bool
+	}{
+		{"plain", config.ListenerConfig{}, false},
+		{"token", config.ListenerConfig{Auth: config.ListenerAuthConfig{Policy: config.ListenerAuthToken, Tokens: []string{"t"}}}, false},
+		{"token without tokens", config.ListenerConfig{Auth: config.ListenerAuthConfig{Policy: config.ListenerAuthToken}}, true},
+		{"oidc", config.ListenerConfig{Auth: config.ListenerAuthConfig{Policy: config.ListenerAuthOIDC, OIDC: config.OIDCConfig{Issuer: "https://idp", Audience: "arrakis"}}}, false},
+		{"oidc without audience", config.ListenerConfig{Auth: config.ListenerAuthConfig{Policy: config.ListenerAuthOIDC, OIDC: config.OIDCConfig{Issuer: "https://idp"}}}, true},
+		{"unknown policy", config.ListenerConfig{Auth: config.ListenerAuthConfig{Policy: "mtls"}}, true},
+		{"cert without key", config.ListenerConfig{TLS: config.TLSConfig{CertFile: "cert.pem"}}, true},
+		{"client CA without TLS", config.ListenerConfig{TLS: config.TLSConfig{ClientCAFile: "ca.pem"}}, true},
+		{"interface of a unix socket", config.ListenerConfig{Network: "unix", Interface: "eth1"}, true},
+	}
+	for _, test := range tests {
+		if err := validate(test.cfg); (err != nil) != test.wantErr {
+			t.Errorf("%s: validate() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	embedded := func(r *http.Request) bool { return r.URL.Query().Get("embed_token") == "ok" }
+	handler := authMiddleware(config.ListenerAuthConfig{Policy: config.ListenerAuthToken, Tokens: []string{"secret"}}, nil, embedded, next)
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		want   int
+	}{
+		{"no token", "/json/version", "", http.StatusUnauthorized},
+		{"wrong token", "/json/version", "Bearer nope", http.StatusUnauthorized},
+		{"bearer", "/json/version", "Bearer secret", http.StatusOK},
+		{"query", "/json/version?token=secret", "", http.StatusOK},
+		{"health", "/health", "", http.StatusOK},
+		{"rest health", "/v1/health", "", http.StatusOK},
+		{"embedded", "/vm/foo/terminal?embed_token=ok", "", http.StatusOK},
+		{"bad embed token", "/vm/foo/terminal?embed_token=nope", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.target, nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, rec.Code, test.want)
+		}
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	embedded := func(r *http.Request) bool { return r.URL.Path == "/websockify" }
+	handler := requireClientCert(embedded, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for target, want := range map[string]int{
+		"/v1/vms":     http.StatusForbidden,
+		"/v1/health":  http.StatusOK,
+		"/websockify": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != want {
+			t.Errorf("%s: got status %d, want %d", target, rec.Code, want)
+		}
+	}
+}
+
+func TestOIDCAuthWithoutToken(t *testing.T) {
+	auth := config.ListenerAuthConfig{Policy: config.ListenerAuthOIDC, OIDC: config.OIDCConfig{Issuer: "https://idp.invalid", Audience: "arrakis"}}
+	verifier, err := oidc.NewVerifier(auth.OIDC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := authMiddleware(auth, verifier, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for target, want := range map[string]int{
+		"/v1/vms":    http.StatusUnauthorized,
+		"/v1/health": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != want {
+			t.Errorf("%s: got status %d, want %d", target, rec.Code, want)
+		}
+	}
+}
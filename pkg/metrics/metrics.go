@@ -0,0 +1,143 @@
+// Package metrics writes gauges and histograms in the Prometheus text
+// exposition format, so
+// that monitoring and autoscalers can scrape the services without a client
+// library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Gauge is a metric that can go up and down, with a value per set of labels.
+type Gauge struct {
+	Name    string
+	Help    string
+	Samples []Sample
+}
+
+// Sample is the value of a gauge for a set of labels.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// NewGauge returns a gauge with a single unlabeled value.
+func NewGauge(name string, help string, value float64) Gauge {
+	return Gauge{Name: name, Help: help, Samples: []Sample{{Value: value}}}
+}
+
+// Histogram is a metric counting observations in buckets, with a
+// distribution per set of labels.
+type Histogram struct {
+	Name    string
+	Help    string
+	Samples []HistogramSample
+}
+
+// HistogramSample is the distribution of a histogram for a set of labels.
+type HistogramSample struct {
+	Labels map[string]string
+	// Buckets are in increasing order of upper bound, without +Inf.
+	Buckets []Bucket
+	// Count is the number of observations, +Inf's bucket.
+	Count uint64
+	// Sum is the sum of the observations.
+	Sum float64
+}
+
+// Bucket counts the observations up to UpperBound, inclusive, so that its
+// count includes the previous buckets'.
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// Write writes gauges to w in the text exposition format.
+func Write(w io.Writer, gauges []Gauge) error {
+	bw := bufio.NewWriter(w)
+	for _, g := range gauges {
+		fmt.Fprintf(bw, "# HELP %s %s\n", g.Name, escapeHelp(g.Help))
+		fmt.Fprintf(bw, "# TYPE %s gauge\n", g.Name)
+		for _, s := range g.Samples {
+			fmt.Fprintf(bw, "%s%s %s\n", g.Name, formatLabels(s.Labels), formatFloat(s.Value))
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteHistograms writes histograms to w in the text exposition format.
+func WriteHistograms(w io.Writer, histograms []Histogram) error {
+	bw := bufio.NewWriter(w)
+	for _, h := range histograms {
+		fmt.Fprintf(bw, "# HELP %s %s\n", h.Name, escapeHelp(h.Help))
+		fmt.Fprintf(bw, "# TYPE %s histogram\n", h.Name)
+		for _, s := range h.Samples {
+			for _, b := range s.Buckets {
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", h.Name, formatLabels(withLabel(s.Labels, "le", formatFloat(b.UpperBound))), b.Count)
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", h.Name, formatLabels(withLabel(s.Labels, "le", "+Inf")), s.Count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", h.Name, formatLabels(s.Labels), formatFloat(s.Sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", h.Name, formatLabels(s.Labels), s.Count)
+		}
+	}
+	return bw.Flush()
+}
+
+// Serve writes gauges, then histograms, as the response to a scrape.
+func Serve(w http.ResponseWriter, gauges []Gauge, histograms ...Histogram) {
+	w.Header().Set("Content-Type", ContentType)
+	Write(w, gauges)
+	WriteHistograms(w, histograms)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// withLabel returns a copy of labels with name set to value.
+func withLabel(labels map[string]string, name string, value string) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out[name] = value
+	return out
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabel(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
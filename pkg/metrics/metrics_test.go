@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	var b strings.Builder
+	err := Write(&b, []Gauge{
+		NewGauge("arrakis_vms", "VMs on the host.", 3),
+		{
+			Name: "arrakis_operations_running",
+			Help: "Background operations in progress.\nBy kind.",
+			Samples: []Sample{
+				{Labels: map[string]string{"kind": "create_vm", "host": `a"b\c`}, Value: 2},
+				{Labels: map[string]string{"kind": "snapshot_vm"}, Value: 0.5},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP arrakis_vms VMs on the host.
+# TYPE arrakis_vms gauge
+arrakis_vms 3
+# HELP arrakis_operations_running Background operations in progress.\nBy kind.
+# TYPE arrakis_operations_running gauge
+arrakis_operations_running{host="a\"b\\c",kind="create_vm"} 2
+arrakis_operations_running{kind="snapshot_vm"} 0.5
+`
+	if got := b.String(); got != want {
+		t.Errorf("Write =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteHistograms(t *testing.T) {
+	var b strings.Builder
+	err := WriteHistograms(&b, []Histogram{{
+		Name: "arrakis_probe_latency_seconds",
+		Help: "Probe latency.",
+		Samples: []HistogramSample{{
+			Labels:  map[string]string{"vm": "vm1"},
+			Buckets: []Bucket{{UpperBound: 0.01, Count: 2}, {UpperBound: 0.1, Count: 3}},
+			Count:   4,
+			Sum:     1.25,
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP arrakis_probe_latency_seconds Probe latency.
+# TYPE arrakis_probe_latency_seconds histogram
+arrakis_probe_latency_seconds_bucket{le="0.01",vm="vm1"} 2
+arrakis_probe_latency_seconds_bucket{le="0.1",vm="vm1"} 3
+arrakis_probe_latency_seconds_bucket{le="+Inf",vm="vm1"} 4
+arrakis_probe_latency_seconds_sum{vm="vm1"} 1.25
+arrakis_probe_latency_seconds_count{vm="vm1"} 4
+`
+	if got := b.String(); got != want {
+		t.Errorf("WriteHistograms =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,276 @@
+// Package mtls mutually authenticates the calls between arrakis services with
+// certificates of a shared CA, either an internal PKI the restserver creates
+// or one an operator provides.
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+// Services the internal PKI issues certificates to. A service's name is also
+// the name its certificate is valid for, which clients verify regardless of
+// the address they dial, e.g. a VM's changing IP.
+const (
+	ServiceRESTServer  = "restserver"
+	ServiceCDPServer   = "cdpserver"
+	ServiceNoVNCServer = "novncserver"
+	ServiceAgent       = "agent"
+)
+
+var services = []string{ServiceRESTServer, ServiceCDPServer, ServiceNoVNCServer, ServiceAgent}
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+	// Certificates expiring sooner are reissued by EnsurePKI.
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// Files returns the CA, certificate and key files service uses under c.
+// Explicitly configured files win over those of the PKI dir.
+func Files(c config.MutualTLSConfig, service string) (caFile, certFile, keyFile string) {
+	caFile, certFile, keyFile = c.CAFile, c.CertFile, c.KeyFile
+	if c.PKIDir != "" {
+		if caFile == "" {
+			caFile = filepath.Join(c.PKIDir, caCertFile)
+		}
+		if certFile == "" {
+			certFile = filepath.Join(c.PKIDir, service+".crt")
+		}
+		if keyFile == "" {
+			keyFile = filepath.Join(c.PKIDir, service+".key")
+		}
+	}
+	return caFile, certFile, keyFile
+}
+
+// EnsurePKI creates an internal PKI in dir: a CA and a certificate for every
+// service. Existing certificates are kept until they are about to expire.
+func EnsurePKI(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create pki dir: %w", err)
+	}
+	caCert, caKey, err := loadCA(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		caCert, caKey, err = createCA(dir)
+	}
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		certFile := filepath.Join(dir, service+".crt")
+		if cert, err := loadCert(certFile); err == nil && valid(cert, caCert) {
+			continue
+		}
+		if err := issue(dir, service, caCert, caKey); err != nil {
+			return fmt.Errorf("failed to issue certificate for %s: %w", service, err)
+		}
+	}
+	return nil
+}
+
+// ServerConfig returns the TLS configuration of a service accepting only
+// clients with a certificate of the CA.
+func ServerConfig(c config.MutualTLSConfig, service string) (*tls.Config, error) {
+	caFile, certFile, keyFile := Files(c, service)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	pool, err := LoadCAPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientConfig returns the TLS configuration of service calling server,
+// which must present a certificate of the CA for server's name.
+func ClientConfig(c config.MutualTLSConfig, service string, server string) (*tls.Config, error) {
+	caFile, certFile, keyFile := Files(c, service)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	pool, err := LoadCAPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   server,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Transport returns an HTTP transport of service calling server over mutual
+// TLS.
+func Transport(c config.MutualTLSConfig, service string, server string) (*http.Transport, error) {
+	tlsConfig, err := ClientConfig(c, service, server)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// LoadCAPool reads the CA certificates in caFile.
+func LoadCAPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in CA file %s", caFile)
+	}
+	return pool, nil
+}
+
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, err := loadCert(filepath.Join(dir, caCertFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no key in %s", caKeyFile)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA key: %w", err)
+	}
+	return cert, key, nil
+}
+
+func createCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "arrakis internal CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA: %w", err)
+	}
+	if err := writePEM(filepath.Join(dir, caKeyFile), "EC PRIVATE KEY", mustMarshalKey(key), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(filepath.Join(dir, caCertFile), "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// issue writes a key and a certificate for service signed by the CA. The
+// certificate serves and authenticates as the service, and is also valid for
+// localhost.
+func issue(dir string, service string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: service},
+		DNSNames:     []string{service, "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, service+".key"), "EC PRIVATE KEY", mustMarshalKey(key), 0600); err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, service+".crt"), "CERTIFICATE", der, 0644)
+}
+
+// valid reports whether cert is signed by the CA and not about to expire.
+func valid(cert *x509.Certificate, caCert *x509.Certificate) bool {
+	if cert.CheckSignatureFrom(caCert) != nil {
+		return false
+	}
+	return time.Now().Add(renewBefore).Before(cert.NotAfter)
+}
+
+func loadCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func writePEM(path string, blockType string, der []byte, mode os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, mode); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func mustMarshalKey(key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
+
+func serialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
@@ -0,0 +1,111 @@
+package mtls
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+func TestEnsurePKI(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pki")
+	if err := EnsurePKI(dir); err != nil {
+		t.Fatalf("EnsurePKI failed: %v", err)
+	}
+	agentCert, err := os.ReadFile(filepath.Join(dir, "agent.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "ca.key")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("CA key mode = %v, %v, want 0600", info.Mode(), err)
+	}
+
+	// Valid certificates are kept.
+	if err := EnsurePKI(dir); err != nil {
+		t.Fatalf("EnsurePKI of an existing PKI failed: %v", err)
+	}
+	again, _ := os.ReadFile(filepath.Join(dir, "agent.crt"))
+	if !bytes.Equal(agentCert, again) {
+		t.Error("EnsurePKI reissued a valid certificate")
+	}
+
+	// Missing ones are issued.
+	os.Remove(filepath.Join(dir, "cdpserver.crt"))
+	if err := EnsurePKI(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cdpserver.crt")); err != nil {
+		t.Errorf("Missing certificate not reissued: %v", err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	ca, cert, key := Files(config.MutualTLSConfig{PKIDir: "/pki", CertFile: "/custom.crt"}, ServiceAgent)
+	if ca != "/pki/ca.crt" || cert != "/custom.crt" || key != "/pki/agent.key" {
+		t.Errorf("Files = %s, %s, %s", ca, cert, key)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	if err := EnsurePKI(dir); err != nil {
+		t.Fatal(err)
+	}
+	c := config.MutualTLSConfig{PKIDir: dir}
+
+	serverConfig, err := ServerConfig(c, ServiceAgent)
+	if err != nil {
+		t.Fatalf("ServerConfig failed: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = serverConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The agent's certificate is verified for its service name although
+	// dialed by address.
+	transport, err := Transport(c, ServiceRESTServer, ServiceAgent)
+	if err != nil {
+		t.Fatalf("Transport failed: %v", err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Mutually authenticated request failed: %v", err)
+	}
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if body.String() != ServiceRESTServer {
+		t.Errorf("Client authenticated as %q, want %q", body.String(), ServiceRESTServer)
+	}
+
+	// Expecting another service fails.
+	transport, _ = Transport(c, ServiceRESTServer, ServiceCDPServer)
+	if _, err := (&http.Client{Transport: transport}).Get(srv.URL); err == nil {
+		t.Error("Accepted the certificate of another service")
+	}
+
+	// So does calling without a client certificate.
+	clientConfig, _ := ClientConfig(c, ServiceRESTServer, ServiceAgent)
+	clientConfig.Certificates = nil
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	if _, err := anonymous.Get(srv.URL); err == nil {
+		t.Error("Accepted a client without a certificate")
+	}
+
+	// And trusting a different CA.
+	other := t.TempDir()
+	if err := EnsurePKI(other); err != nil {
+		t.Fatal(err)
+	}
+	transport, _ = Transport(config.MutualTLSConfig{PKIDir: other}, ServiceRESTServer, ServiceAgent)
+	if _, err := (&http.Client{Transport: transport}).Get(srv.URL); err == nil {
+		t.Error("Accepted a server of another CA")
+	}
+}
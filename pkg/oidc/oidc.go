@@ -0,0 +1,377 @@
+// Package oidc validates JWTs issued by an OpenID Connect provider, so that
+// enterprises can authenticate arrakis users with their SSO instead of static
+// API tokens.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const (
+	defaultRefreshInterval = time.Hour
+	// minRefreshInterval bounds how often an unknown key ID triggers a
+	// refetch, so that forged tokens can't hammer the provider.
+	minRefreshInterval = 30 * time.Second
+	defaultTenantClaim = "tenant"
+	defaultRolesClaim  = "roles"
+	// clockSkew is tolerated when checking exp, nbf and iat.
+	clockSkew = time.Minute
+)
+
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrUnknownKey     = errors.New("token signed with an unknown key")
+	ErrBadSignature   = errors.New("invalid token signature")
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Subject string
+	Tenant  string
+	Roles   []string
+	// Admin is set if the caller has one of the configured admin roles.
+	Admin bool
+}
+
+// HasRole reports whether the identity has any of roles.
+func (id *Identity) HasRole(roles ...string) bool {
+	for _, want := range roles {
+		for _, have := range id.Roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity of the request ctx belongs to, or nil if it
+// wasn't authenticated with OIDC.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// Verifier validates tokens of one provider, caching its signing keys.
+type Verifier struct {
+	config config.OIDCConfig
+	keys   *keySet
+	now    func() time.Time
+}
+
+// NewVerifier returns a verifier for c. Keys are fetched on first use, so that
+// a provider outage doesn't prevent services from starting.
+func NewVerifier(c config.OIDCConfig) (*Verifier, error) {
+	if c.Issuer == "" {
+		return nil, fmt.Errorf("oidc auth requires an issuer")
+	}
+	if c.Audience == "" {
+		return nil, fmt.Errorf("oidc auth requires an audience")
+	}
+	if c.JWKSRefreshInterval <= 0 {
+		c.JWKSRefreshInterval = defaultRefreshInterval
+	}
+	if c.TenantClaim == "" {
+		c.TenantClaim = defaultTenantClaim
+	}
+	if c.RolesClaim == "" {
+		c.RolesClaim = defaultRolesClaim
+	}
+	return &Verifier{
+		config: c,
+		keys:   &keySet{issuer: c.Issuer, url: c.JWKSURL, refreshInterval: c.JWKSRefreshInterval},
+		now:    time.Now,
+	}, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks token's signature and standard claims and returns the identity
+// it carries.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	key, err := v.keys.get(ctx, h.Kid, v.now())
+	if err != nil {
+		return nil, err
+	}
+	// Keys published for one algorithm must not verify tokens claiming
+	// another.
+	if key.alg != "" && key.alg != h.Alg {
+		return nil, fmt.Errorf("key %q is for %s, not %s", h.Kid, key.alg, h.Alg)
+	}
+	if err := verifySignature(h.Alg, key.key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	id := &Identity{
+		Subject: stringClaim(claims, "sub"),
+		Tenant:  stringClaim(claims, v.config.TenantClaim),
+		Roles:   listClaim(claims, v.config.RolesClaim),
+	}
+	if len(v.config.RequiredRoles) > 0 && !id.HasRole(v.config.RequiredRoles...) {
+		return nil, fmt.Errorf("token has none of the roles %v", v.config.RequiredRoles)
+	}
+	id.Admin = id.HasRole(v.config.AdminRoles...)
+	return id, nil
+}
+
+func (v *Verifier) checkClaims(claims map[string]any) error {
+	if iss := stringClaim(claims, "iss"); iss != v.config.Issuer {
+		return fmt.Errorf("unexpected issuer %q", iss)
+	}
+	audience := listClaim(claims, "aud")
+	found := false
+	for _, aud := range audience {
+		if aud == v.config.Audience {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("token is not for audience %q", v.config.Audience)
+	}
+
+	now := v.now()
+	exp, ok := timeClaim(claims, "exp")
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.After(exp.Add(clockSkew)) {
+		return fmt.Errorf("token expired at %s", exp.Format(time.RFC3339))
+	}
+	if nbf, ok := timeClaim(claims, "nbf"); ok && now.Add(clockSkew).Before(nbf) {
+		return fmt.Errorf("token not valid before %s", nbf.Format(time.RFC3339))
+	}
+	if iat, ok := timeClaim(claims, "iat"); ok && now.Add(clockSkew).Before(iat) {
+		return fmt.Errorf("token issued in the future")
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+// ecdsaCurves are the curves of the ES algorithms.
+var ecdsaCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+			return ErrBadSignature
+		}
+	case strings.HasPrefix(alg, "PS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPSS(pub, hash, digest, signature, nil) != nil {
+			return ErrBadSignature
+		}
+	case strings.HasPrefix(alg, "ES"):
+		// Each ES algorithm is tied to a curve, e.g. ES256 to P-256.
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != ecdsaCurves[alg] {
+			return ErrBadSignature
+		}
+		// JWS encodes ECDSA signatures as the fixed size concatenation r || s.
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return ErrBadSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrBadSignature
+		}
+	default:
+		// Notably rejects "none" and HMAC algorithms.
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	return nil
+}
+
+// claim looks up a claim by its dotted path.
+func claim(claims map[string]any, path string) any {
+	var value any = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+	return value
+}
+
+func stringClaim(claims map[string]any, path string) string {
+	s, _ := claim(claims, path).(string)
+	return s
+}
+
+// listClaim returns a claim that is either a list of strings or a single,
+// space separated string as used for OAuth scopes.
+func listClaim(claims map[string]any, path string) []string {
+	switch value := claim(claims, path).(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		var list []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func timeClaim(claims map[string]any, name string) (time.Time, bool) {
+	seconds, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// keySet caches a provider's signing keys by key ID.
+type keySet struct {
+	issuer          string
+	url             string
+	refreshInterval time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]signingKey
+	fetchedAt time.Time
+	// fetchErr is the error of the last fetch, returned until the next one
+	// while there are no keys to serve with.
+	fetchErr error
+	// fetching is closed once the fetch in progress, if any, is done.
+	fetching chan struct{}
+}
+
+// get returns the key kid, refetching the keys when they are stale or kid is
+// unknown. The lock isn't held while fetching, and callers needing the keys
+// meanwhile wait for the fetch in progress rather than starting their own.
+func (s *keySet) get(ctx context.Context, kid string, now time.Time) (signingKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stale := now.Sub(s.fetchedAt) > s.refreshInterval
+	_, known := s.keys[kid]
+	if stale || (!known && now.Sub(s.fetchedAt) > minRefreshInterval) {
+		if fetching := s.fetching; fetching != nil {
+			s.mu.Unlock()
+			select {
+			case <-fetching:
+				s.mu.Lock()
+			case <-ctx.Done():
+				s.mu.Lock()
+				return signingKey{}, ctx.Err()
+			}
+		} else {
+			s.fetching = make(chan struct{})
+			s.mu.Unlock()
+			// The fetch serves the callers waiting for it too, so it isn't
+			// canceled with this one.
+			keys, err := s.fetch(context.WithoutCancel(ctx))
+			s.mu.Lock()
+			if err != nil {
+				// Keep serving with the cached keys while the provider is down.
+				s.fetchErr = err
+			} else {
+				s.keys, s.fetchErr = keys, nil
+			}
+			// Failures count too, to back off from an unreachable provider.
+			s.fetchedAt = now
+			close(s.fetching)
+			s.fetching = nil
+		}
+	}
+	if s.keys == nil && s.fetchErr != nil {
+		return signingKey{}, fmt.Errorf("failed to fetch signing keys: %v", s.fetchErr)
+	}
+
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, nil
+		}
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return signingKey{}, ErrUnknownKey
+	}
+	return key, nil
+}
@@ -0,0 +1,255 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+type provider struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newProvider(t *testing.T) *provider {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &provider{rsaKey: rsaKey, ecKey: ecKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   p.server.URL,
+			"jwks_uri": p.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jwk{
+			{Kty: "RSA", Kid: "rsa", Use: "sig", Alg: "RS256", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{Kty: "RSA", Kid: "rsa-any", Use: "sig", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecKey.X.FillBytes(make([]byte, 32))), Y: b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (p *provider) sign(t *testing.T, alg string, kid string, claims map[string]any) string {
+	t.Helper()
+	h, _ := json.Marshal(header{Alg: alg, Kid: kid})
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, p.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "PS256":
+		var err error
+		signature, err = rsa.SignPSS(rand.Reader, p.rsaKey, crypto.SHA256, digest[:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256", "ES384":
+		// The P-256 key signs ES384 tokens too, which must be rejected.
+		signedDigest := digest[:]
+		if alg == "ES384" {
+			d := sha512.Sum384([]byte(signed))
+			signedDigest = d[:]
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, p.ecKey, signedDigest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(signature)
+}
+
+func (p *provider) claims(extra map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss": p.server.URL,
+		"aud": []string{"arrakis", "other"},
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return claims
+}
+
+func TestVerify(t *testing.T) {
+	p := newProvider(t)
+	v, err := NewVerifier(config.OIDCConfig{
+		Issuer:      p.server.URL,
+		Audience:    "arrakis",
+		TenantClaim: "org",
+		RolesClaim:  "realm_access.roles",
+		AdminRoles:  []string{"arrakis-admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	valid := p.claims(map[string]any{
+		"org":          "acme",
+		"realm_access": map[string]any{"roles": []string{"user", "arrakis-admin"}},
+	})
+	for _, alg := range []string{"RS256", "PS256", "ES256"} {
+		kid := map[string]string{"RS256": "rsa", "PS256": "rsa-any", "ES256": "ec"}[alg]
+		id, err := v.Verify(ctx, p.sign(t, alg, kid, valid))
+		if err != nil {
+			t.Fatalf("%s: Verify() = %v", alg, err)
+		}
+		if id.Subject != "alice" || id.Tenant != "acme" || !id.Admin || !id.HasRole("user") {
+			t.Errorf("%s: Verify() = %+v", alg, id)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", p.sign(t, "RS256", "rsa", p.claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}))},
+		{"wrong audience", p.sign(t, "RS256", "rsa", p.claims(map[string]any{"aud": "someone-else"}))},
+		{"wrong issuer", p.sign(t, "RS256", "rsa", p.claims(map[string]any{"iss": "https://evil"}))},
+		{"not yet valid", p.sign(t, "RS256", "rsa", p.claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()}))},
+		{"unknown key", p.sign(t, "RS256", "nope", valid)},
+		{"key of another type", p.sign(t, "RS256", "ec", valid)},
+		{"key for another algorithm", p.sign(t, "PS256", "rsa", valid)},
+		{"curve of another algorithm", p.sign(t, "ES384", "ec", valid)},
+		{"unsigned", strings.Join(strings.Split(p.sign(t, "RS256", "rsa", valid), ".")[:2], ".") + "."},
+		{"malformed", "not-a-jwt"},
+	}
+	for _, test := range tests {
+		if _, err := v.Verify(ctx, test.token); err == nil {
+			t.Errorf("%s: Verify() succeeded, want error", test.name)
+		}
+	}
+
+	// Tampering with the claims invalidates the signature.
+	parts := strings.Split(p.sign(t, "RS256", "rsa", valid), ".")
+	tampered, _ := json.Marshal(p.claims(map[string]any{"org": "other"}))
+	if _, err := v.Verify(ctx, parts[0]+"."+b64(tampered)+"."+parts[2]); err != ErrBadSignature {
+		t.Errorf("tampered: Verify() = %v, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestRequiredRoles(t *testing.T) {
+	p := newProvider(t)
+	v, err := NewVerifier(config.OIDCConfig{
+		Issuer:        p.server.URL,
+		Audience:      "arrakis",
+		JWKSURL:       p.server.URL + "/keys",
+		RequiredRoles: []string{"sandbox-user"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := v.Verify(ctx, p.sign(t, "RS256", "rsa", p.claims(map[string]any{"roles": "viewer"}))); err == nil {
+		t.Error("Verify() accepted a token without a required role")
+	}
+	id, err := v.Verify(ctx, p.sign(t, "RS256", "rsa", p.claims(map[string]any{"roles": "viewer sandbox-user"})))
+	if err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+	if id.Admin {
+		t.Error("Verify() granted admin without admin roles configured")
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != nil {
+		t.Error("FromContext() of an unauthenticated context should be nil")
+	}
+	id := &Identity{Subject: "alice"}
+	if got := FromContext(NewContext(context.Background(), id)); got != id {
+		t.Errorf("FromContext() = %v, want %v", got, id)
+	}
+}
+
+func TestKeyFetchBackoff(t *testing.T) {
+	p := newProvider(t)
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	failing.Store(true)
+	release := make(chan struct{})
+	keys := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		p.server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer keys.Close()
+	s := &keySet{issuer: p.server.URL, url: keys.URL + "/keys", refreshInterval: time.Hour}
+	ctx := context.Background()
+	now := time.Now()
+
+	// Concurrent callers share a single fetch of the keys.
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := s.get(ctx, "rsa", now)
+			errs <- err
+		}()
+	}
+	for fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err == nil {
+			t.Error("get() succeeded with the provider down")
+		}
+	}
+	// A failed first fetch is retried only after minRefreshInterval.
+	if _, err := s.get(ctx, "rsa", now.Add(time.Second)); err == nil || fetches.Load() != 1 {
+		t.Errorf("get() during the backoff = %v after %d fetches, want the last error after 1", err, fetches.Load())
+	}
+	failing.Store(false)
+	if _, err := s.get(ctx, "rsa", now.Add(minRefreshInterval+time.Second)); err != nil || fetches.Load() != 2 {
+		t.Errorf("get() after the backoff = %v after %d fetches, want the key after 2", err, fetches.Load())
+	}
+}
@@ -0,0 +1,165 @@
+// Package ratelimit protects the host from bursts of expensive API calls, e.g.
+// an orchestrator retrying VM creations in a loop. Each kind of call is
+// limited by token buckets, one across all callers and one per tenant, and by
+// how many may be in progress at once. Calls over a limit are told how long to
+// wait before retrying.
+package ratelimit
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const (
+	// maxIdleTenants is how many tenants are tracked before those whose
+	// bucket has refilled are forgotten.
+	maxIdleTenants = 1024
+	// inFlightRetryAfter is when to retry calls rejected for too many calls
+	// being in progress, which can't be known.
+	inFlightRetryAfter = time.Second
+)
+
+// bucket is a token bucket, refilled at rate tokens per second up to burst.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time, rate float64, burst float64) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// wait returns how long until the bucket holds a token, 0 if it does.
+func (b *bucket) wait(rate float64) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// Limiter limits a kind of call. The nil Limiter admits every call.
+type Limiter struct {
+	rate, burst             float64
+	tenantRate, tenantBurst float64
+	maxInFlight             int
+	now                     func() time.Time
+
+	mu       sync.Mutex
+	global   bucket
+	tenants  map[string]*bucket
+	inFlight int
+}
+
+// New returns a limiter enforcing c, or nil if c doesn't limit anything.
+func New(c config.RateLimit) *Limiter {
+	if c.PerSecond <= 0 && c.PerTenantPerSecond <= 0 && c.MaxInFlight <= 0 {
+		return nil
+	}
+	l := &Limiter{
+		rate:        c.PerSecond,
+		burst:       burst(c.PerSecond, c.Burst),
+		tenantRate:  c.PerTenantPerSecond,
+		tenantBurst: burst(c.PerTenantPerSecond, c.PerTenantBurst),
+		maxInFlight: c.MaxInFlight,
+		now:         time.Now,
+		tenants:     make(map[string]*bucket),
+	}
+	l.global = bucket{tokens: l.burst, last: l.now()}
+	return l
+}
+
+// burst defaults to the rate rounded up, so that a second's worth of calls
+// can be made at once.
+func burst(rate float64, burst int) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	return math.Max(1, math.Ceil(rate))
+}
+
+// Acquire admits a call of tenant, which must call release once it is done.
+// Calls that aren't admitted get how long to wait before retrying instead.
+// Calls without a tenant are only subject to the limits across tenants.
+func (l *Limiter) Acquire(tenant string) (release func(), retryAfter time.Duration, ok bool) {
+	if l == nil {
+		return func() {}, 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxInFlight > 0 && l.inFlight >= l.maxInFlight {
+		return nil, inFlightRetryAfter, false
+	}
+	now := l.now()
+	if l.rate > 0 {
+		l.global.refill(now, l.rate, l.burst)
+		retryAfter = l.global.wait(l.rate)
+	}
+	var tb *bucket
+	if l.tenantRate > 0 && tenant != "" {
+		tb = l.tenantBucket(tenant, now)
+		if wait := tb.wait(l.tenantRate); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	// Only take tokens once every bucket has one, so that a tenant over its
+	// limit doesn't use up those of the others.
+	if retryAfter > 0 {
+		return nil, retryAfter, false
+	}
+	if l.rate > 0 {
+		l.global.tokens--
+	}
+	if tb != nil {
+		tb.tokens--
+	}
+
+	l.inFlight++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.inFlight--
+			l.mu.Unlock()
+		})
+	}, 0, true
+}
+
+func (l *Limiter) tenantBucket(tenant string, now time.Time) *bucket {
+	b, ok := l.tenants[tenant]
+	if !ok {
+		if len(l.tenants) >= maxIdleTenants {
+			l.forgetIdleTenants(now)
+		}
+		b = &bucket{tokens: l.tenantBurst, last: now}
+		l.tenants[tenant] = b
+	}
+	b.refill(now, l.tenantRate, l.tenantBurst)
+	return b
+}
+
+// forgetIdleTenants drops the buckets that have refilled, which are the same
+// as new ones.
+func (l *Limiter) forgetIdleTenants(now time.Time) {
+	for tenant, b := range l.tenants {
+		b.refill(now, l.tenantRate, l.tenantBurst)
+		if b.tokens >= l.tenantBurst {
+			delete(l.tenants, tenant)
+		}
+	}
+}
+
+// RetryAfter formats d for the Retry-After header, in whole seconds rounded
+// up so that clients don't retry too early.
+func RetryAfter(d time.Duration) string {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
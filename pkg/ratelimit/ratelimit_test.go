@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+func newTestLimiter(t *testing.T, c config.RateLimit) (*Limiter, *time.Time) {
+	t.Helper()
+	l := New(c)
+	if l == nil {
+		t.Fatalf("New(%v) = nil", c)
+	}
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	l.global.last = now
+	return l, &now
+}
+
+func TestNilLimiter(t *testing.T) {
+	l := New(config.RateLimit{})
+	if l != nil {
+		t.Fatalf("New of no limit = %v, want nil", l)
+	}
+	release, _, ok := l.Acquire("acme")
+	if !ok {
+		t.Fatal("nil limiter rejected a call")
+	}
+	release()
+}
+
+func TestBurstAndRefill(t *testing.T) {
+	l, now := newTestLimiter(t, config.RateLimit{PerSecond: 2, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if _, _, ok := l.Acquire(""); !ok {
+			t.Fatalf("call %d of the burst rejected", i)
+		}
+	}
+	_, retryAfter, ok := l.Acquire("")
+	if ok {
+		t.Fatal("call over the burst admitted")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("retryAfter = %v, want 500ms", retryAfter)
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if _, _, ok := l.Acquire(""); !ok {
+		t.Fatal("call after refill rejected")
+	}
+	if _, _, ok := l.Acquire(""); ok {
+		t.Fatal("second call after refilling one token admitted")
+	}
+}
+
+func TestPerTenant(t *testing.T) {
+	l, _ := newTestLimiter(t, config.RateLimit{PerSecond: 3, PerTenantPerSecond: 1})
+	if _, _, ok := l.Acquire("acme"); !ok {
+		t.Fatal("first call of acme rejected")
+	}
+	for i := 0; i < 3; i++ {
+		if _, retryAfter, ok := l.Acquire("acme"); ok || retryAfter != time.Second {
+			t.Fatalf("call over the tenant limit = %v, %v", retryAfter, ok)
+		}
+	}
+	// Rejected calls of acme didn't use up the tokens of others.
+	for _, tenant := range []string{"globex", "initech"} {
+		if _, _, ok := l.Acquire(tenant); !ok {
+			t.Fatalf("call of %s rejected", tenant)
+		}
+	}
+	if _, _, ok := l.Acquire("umbrella"); ok {
+		t.Fatal("call over the global limit admitted")
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	l, _ := newTestLimiter(t, config.RateLimit{MaxInFlight: 1})
+	release, _, ok := l.Acquire("acme")
+	if !ok {
+		t.Fatal("first call rejected")
+	}
+	if _, retryAfter, ok := l.Acquire("globex"); ok || retryAfter != inFlightRetryAfter {
+		t.Fatalf("call over the in flight limit = %v, %v", retryAfter, ok)
+	}
+	release()
+	release()
+	if _, _, ok := l.Acquire("globex"); !ok {
+		t.Fatal("call after release rejected")
+	}
+	if l.inFlight != 1 {
+		t.Errorf("inFlight = %d after releasing twice, want 1", l.inFlight)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                       "1",
+		300 * time.Millisecond:  "1",
+		time.Second:             "1",
+		1500 * time.Millisecond: "2",
+	} {
+		if got := RetryAfter(d); got != want {
+			t.Errorf("RetryAfter(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
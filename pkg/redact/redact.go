@@ -0,0 +1,162 @@
+// Package redact masks credentials, e.g. Authorization headers, cookies and
+// API keys, in what the services write to disk: their logs and the CDP
+// traffic the cdpserver records.
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+// Mask replaces what is redacted.
+const Mask = "[REDACTED]"
+
+// defaultPatterns mask the credentials of HTTP headers, as JSON fields, the
+// way CDP's Network events carry them, and as text, bearer tokens, tokens in
+// query strings and API keys of well-known providers. They don't match
+// quotes, so that JSON stays valid once redacted.
+var defaultPatterns = []string{
+	`(?i)"(?:authorization|proxy-authorization|cookie|set-cookie|x-api-key|api[_-]?key)"\s*:\s*"((?:[^"\\]|\\.)*)"`,
+	// Without \b, as headers follow the escaped newlines of JSON strings.
+	`(?i)(?:authorization|cookie|x-api-key)\s*[:=]\s*([^\r\n"\\]+)`,
+	`(?i)\bbearer\s+([A-Za-z0-9._~+/-]+=*)`,
+	`(?i)[?&](?:token|access_token|api_key|apikey|password)=([^&\s"#\\]+)`,
+	`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{20,}`,
+	`\bAKIA[0-9A-Z]{16}\b`,
+	`\bgh[pousr]_[A-Za-z0-9]{36,}\b`,
+	`\bxox[abposr]-[A-Za-z0-9-]{10,}`,
+	`\bAIza[0-9A-Za-z_-]{35}\b`,
+}
+
+// Redactor masks the text matched by its patterns: that of a pattern's first
+// capture group or, without one, the whole match.
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// New returns a Redactor with the default patterns, unless cfg turns them
+// off, and those of cfg.
+func New(cfg config.RedactionConfig) (*Redactor, error) {
+	var patterns []string
+	if !cfg.NoDefaults {
+		patterns = append(patterns, defaultPatterns...)
+	}
+	r := &Redactor{}
+	for _, p := range append(patterns, cfg.Patterns...) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %v", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// String returns s redacted.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, re := range r.patterns {
+		s = mask(re, s)
+	}
+	return s
+}
+
+// Bytes returns b redacted, b itself if nothing was.
+func (r *Redactor) Bytes(b []byte) []byte {
+	if r == nil {
+		return b
+	}
+	s := string(b)
+	if redacted := r.String(s); redacted != s {
+		return []byte(redacted)
+	}
+	return b
+}
+
+func mask(re *regexp.Regexp, s string) string {
+	matches := re.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 {
+			start, end = m[2], m[3]
+		}
+		if start < 0 || start == end {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(Mask)
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Hook is a logrus hook redacting the message and the string and error fields
+// of every entry before it is written.
+type Hook struct {
+	redactor atomic.Pointer[Redactor]
+}
+
+// NewHook returns a Hook redacting with r. Add it with log.AddHook.
+func NewHook(r *Redactor) *Hook {
+	h := &Hook{}
+	h.Set(r)
+	return h
+}
+
+// Set replaces the Redactor of the hook, e.g. when the config is reloaded.
+func (h *Hook) Set(r *Redactor) {
+	h.redactor.Store(r)
+}
+
+func (h *Hook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *Hook) Fire(entry *log.Entry) error {
+	r := h.redactor.Load()
+	if r == nil {
+		return nil
+	}
+	entry.Message = r.String(entry.Message)
+	// The fields may be shared with the entry this one was derived from, so
+	// they are copied rather than redacted in place.
+	var data log.Fields
+	for key, value := range entry.Data {
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case error:
+			s = v.Error()
+		default:
+			continue
+		}
+		if redacted := r.String(s); redacted != s {
+			if data == nil {
+				data = make(log.Fields, len(entry.Data))
+				for k, v := range entry.Data {
+					data[k] = v
+				}
+			}
+			data[key] = redacted
+		}
+	}
+	if data != nil {
+		entry.Data = data
+	}
+	return nil
+}
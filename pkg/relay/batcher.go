@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const (
+	defaultMaxBatchBytes = 64 * 1024
+)
+
+// frameBatcher coalesces small VNC reads into larger binary WebSocket frames.
+// Data is held back for at most the flush interval, Nagle style, or until the
+// pending batch reaches the configured size. It is the only writer of data
+// frames on the connection it wraps.
+type frameBatcher struct {
+	conn     *websocket.Conn
+	interval time.Duration
+	maxBytes int
+
+	lock  sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	err   error
+}
+
+func newFrameBatcher(conn *websocket.Conn, cfg config.BatchingConfig) *frameBatcher {
+	maxBytes := cfg.MaxBatchBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBatchBytes
+	}
+	return &frameBatcher{
+		conn:     conn,
+		interval: cfg.FlushInterval,
+		maxBytes: maxBytes,
+	}
+}
+
+// Write queues data to be sent to the client. With batching disabled the data
+// is sent immediately as its own frame. It returns the first write error seen
+// on the connection, including errors from background flushes.
+func (b *frameBatcher) Write(data []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+	if b.interval <= 0 {
+		b.err = b.conn.WriteMessage(websocket.BinaryMessage, data)
+		return b.err
+	}
+
+	b.buf = append(b.buf, data...)
+	if len(b.buf) >= b.maxBytes {
+		b.stopTimerLocked()
+		b.err = b.flushLocked()
+		return b.err
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.interval, b.timerFlush)
+	}
+	return nil
+}
+
+// Close flushes any pending data and stops the flush timer.
+func (b *frameBatcher) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.stopTimerLocked()
+	if b.err != nil {
+		return b.err
+	}
+	b.err = b.flushLocked()
+	return b.err
+}
+
+func (b *frameBatcher) timerFlush() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.timer = nil
+	if b.err == nil {
+		b.err = b.flushLocked()
+	}
+}
+
+func (b *frameBatcher) stopTimerLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+func (b *frameBatcher) flushLocked() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	err := b.conn.WriteMessage(websocket.BinaryMessage, b.buf)
+	b.buf = b.buf[:0]
+	return err
+}
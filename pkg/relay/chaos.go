@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+// chaosAction is what the relay should do with a message after fault
+// injection.
+type chaosAction int
+
+const (
+	chaosForward chaosAction = iota
+	chaosDrop
+	chaosClose
+)
+
+// Chaos injects latency, drops and mid-stream closures into relayed messages
+// according to a schedule. It is meant for testing clients against flaky
+// sandbox links and must never be enabled in production. A nil *Chaos injects
+// nothing.
+type Chaos struct {
+	schedule []config.ChaosPhase
+	period   time.Duration
+	start    time.Time
+}
+
+// NewChaos returns a fault injector for cfg, or nil if chaos is disabled.
+func NewChaos(cfg config.ChaosConfig) *Chaos {
+	if !cfg.Enabled || len(cfg.Schedule) == 0 {
+		return nil
+	}
+
+	var period time.Duration
+	for _, phase := range cfg.Schedule {
+		if phase.Duration == 0 {
+			// An open-ended phase stops the schedule from cycling.
+			period = 0
+			break
+		}
+		period += phase.Duration
+	}
+
+	log.Warnf("Chaos mode enabled, relays will inject faults: %v", cfg)
+	return &Chaos{
+		schedule: cfg.Schedule,
+		period:   period,
+		start:    time.Now(),
+	}
+}
+
+// phase returns the schedule entry in effect at now.
+func (c *Chaos) phase(now time.Time) config.ChaosPhase {
+	elapsed := now.Sub(c.start)
+	if c.period > 0 {
+		elapsed %= c.period
+	}
+	for _, phase := range c.schedule {
+		if phase.Duration == 0 || elapsed < phase.Duration {
+			return phase
+		}
+		elapsed -= phase.Duration
+	}
+	return c.schedule[len(c.schedule)-1]
+}
+
+// apply delays the caller by the current phase's latency and decides the fate
+// of the message about to be forwarded.
+func (c *Chaos) apply() chaosAction {
+	if c == nil {
+		return chaosForward
+	}
+
+	phase := c.phase(time.Now())
+	delay := phase.Latency
+	if phase.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(phase.Jitter)))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	if phase.CloseRate > 0 && rand.Float64() < phase.CloseRate {
+		log.Infof("Chaos: closing session mid-stream")
+		return chaosClose
+	}
+	if phase.DropRate > 0 && rand.Float64() < phase.DropRate {
+		log.Debugf("Chaos: dropping message")
+		return chaosDrop
+	}
+	return chaosForward
+}
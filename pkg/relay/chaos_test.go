@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+func TestNewChaosDisabled(t *testing.T) {
+	if c := NewChaos(config.ChaosConfig{Schedule: []config.ChaosPhase{{DropRate: 1}}}); c != nil {
+		t.Errorf("NewChaos with enabled=false = %v, want nil", c)
+	}
+	var c *Chaos
+	if action := c.apply(); action != chaosForward {
+		t.Errorf("nil Chaos apply() = %d, want forward", action)
+	}
+}
+
+func TestChaosPhase(t *testing.T) {
+	c := NewChaos(config.ChaosConfig{
+		Enabled: true,
+		Schedule: []config.ChaosPhase{
+			{Duration: 10 * time.Second},
+			{Duration: 5 * time.Second, DropRate: 1},
+		},
+	})
+
+	tests := []struct {
+		offset time.Duration
+		drop   float64
+	}{
+		{0, 0},
+		{9 * time.Second, 0},
+		{10 * time.Second, 1},
+		{14 * time.Second, 1},
+		// The schedule cycles.
+		{15 * time.Second, 0},
+		{26 * time.Second, 1},
+	}
+	for _, test := range tests {
+		if got := c.phase(c.start.Add(test.offset)).DropRate; got != test.drop {
+			t.Errorf("phase at %s has drop rate %v, want %v", test.offset, got, test.drop)
+		}
+	}
+}
+
+func TestChaosOpenEndedPhase(t *testing.T) {
+	c := NewChaos(config.ChaosConfig{
+		Enabled: true,
+		Schedule: []config.ChaosPhase{
+			{Duration: time.Second},
+			{CloseRate: 1},
+		},
+	})
+	if got := c.phase(c.start.Add(time.Hour)).CloseRate; got != 1 {
+		t.Errorf("phase after an hour has close rate %v, want 1", got)
+	}
+	if action := c.apply(); action != chaosForward {
+		t.Errorf("apply() in first phase = %d, want forward", action)
+	}
+}
+
+func TestChaosApply(t *testing.T) {
+	drop := NewChaos(config.ChaosConfig{Enabled: true, Schedule: []config.ChaosPhase{{DropRate: 1}}})
+	if action := drop.apply(); action != chaosDrop {
+		t.Errorf("apply() with drop rate 1 = %d, want drop", action)
+	}
+
+	close := NewChaos(config.ChaosConfig{Enabled: true, Schedule: []config.ChaosPhase{{CloseRate: 1, DropRate: 1}}})
+	if action := close.apply(); action != chaosClose {
+		t.Errorf("apply() with close rate 1 = %d, want close", action)
+	}
+
+	latency := NewChaos(config.ChaosConfig{Enabled: true, Schedule: []config.ChaosPhase{{Latency: 20 * time.Millisecond}}})
+	start := time.Now()
+	latency.apply()
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("apply() with 20ms latency returned after %s", elapsed)
+	}
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const (
+	defaultKeepaliveInterval = 30 * time.Second
+	defaultKeepaliveTimeout  = 10 * time.Second
+)
+
+// Keepalive pings the peer of conn every interval of cfg and sets the read
+// deadline of conn so that reads fail once a pong is more than the timeout
+// late. A relay reading from a dead peer, which would otherwise wait
+// forever, then returns. It returns a func stopping the pings, to call once
+// the connection is done with.
+func Keepalive(conn *websocket.Conn, cfg config.WebSocketKeepaliveConfig) (stop func()) {
+	if cfg.Disabled {
+		return func() {}
+	}
+	interval, timeout := cfg.Interval, cfg.Timeout
+	if interval <= 0 {
+		interval = defaultKeepaliveInterval
+	}
+	if timeout <= 0 {
+		timeout = defaultKeepaliveTimeout
+	}
+
+	conn.SetReadDeadline(time.Now().Add(interval + timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(interval + timeout))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// WriteControl may be called concurrently with the relay's
+				// writes.
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+					log.Debugf("Failed to ping %s: %v", conn.RemoteAddr(), err)
+					return
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+// dialPeer connects to a WebSocket peer that reads until the connection
+// closes, answering pings unless silent, like a peer whose network went
+// away.
+func dialPeer(t *testing.T, silent bool) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if silent {
+			conn.SetPingHandler(func(string) error { return nil })
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readFor reads from conn until it fails or d passed, returning the error.
+func readFor(conn *websocket.Conn, d time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func TestKeepaliveDetectsDeadPeer(t *testing.T) {
+	conn := dialPeer(t, true)
+	stop := Keepalive(conn, config.WebSocketKeepaliveConfig{Interval: 50 * time.Millisecond, Timeout: 50 * time.Millisecond})
+	defer stop()
+	if err := readFor(conn, 2*time.Second); err == nil {
+		t.Fatal("read from a peer not answering pings didn't fail")
+	}
+}
+
+func TestKeepaliveKeepsLivePeer(t *testing.T) {
+	conn := dialPeer(t, false)
+	stop := Keepalive(conn, config.WebSocketKeepaliveConfig{Interval: 50 * time.Millisecond, Timeout: 50 * time.Millisecond})
+	defer stop()
+	if err := readFor(conn, 500*time.Millisecond); err != nil {
+		t.Fatalf("read from a peer answering pings failed: %v", err)
+	}
+	stop()
+}
+
+func TestKeepaliveDisabled(t *testing.T) {
+	conn := dialPeer(t, true)
+	Keepalive(conn, config.WebSocketKeepaliveConfig{Disabled: true, Interval: 50 * time.Millisecond})()
+	if err := readFor(conn, 300*time.Millisecond); err != nil {
+		t.Fatalf("read failed with keepalive disabled: %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+// Package relay implements the data path shared by the guest proxies: copying
+// messages between a client WebSocket and an upstream, which is either another
+// WebSocket (CDP) or a raw TCP stream (VNC).
+package relay
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const (
+	vncReadBufferSize = 4096
+)
+
+// Filter inspects a message of the client before it is relayed upstream. It
+// returns false to drop the message, with a reply to send the client instead
+// unless reply is nil.
+type Filter func(messageType int, data []byte) (reply []byte, forward bool)
+
+// Direction of a relayed message.
+type Direction int
+
+const (
+	// FromClient messages were sent by the client, whether or not they were
+	// relayed upstream.
+	FromClient Direction = iota
+	// ToClient messages were written to the client, from upstream or as a
+	// filter's reply.
+	ToClient
+)
+
+// Tap observes the messages of a relay. It must not keep data.
+type Tap func(direction Direction, messageType int, data []byte)
+
+// Prober sends messages of its own upstream alongside a relay, e.g. to
+// measure its latency, and consumes upstream's replies to them.
+type Prober interface {
+	// Run sends probes with send until stop is closed.
+	Run(send func(messageType int, data []byte) error, stop <-chan struct{})
+	// Consume reports whether a message of upstream answers a probe, in
+	// which case it isn't relayed to the client.
+	Consume(messageType int, data []byte) bool
+	// Relayed is told how long the relay held a message of the client, from
+	// reading it to writing it upstream.
+	Relayed(d time.Duration)
+}
+
+// WebSockets proxies messages in both directions between a client and an
+// upstream WebSocket connection, injecting faults if chaos is non-nil. It
+// returns as soon as either direction stops; closing the connections is left
+// to the caller.
+func WebSockets(clientConn *websocket.Conn, upstreamConn *websocket.Conn, chaos *Chaos) {
+	FilteredWebSockets(clientConn, upstreamConn, chaos, nil, nil)
+}
+
+// Taps returns a Tap showing messages to those of taps that aren't nil, in
+// order, nil if none is.
+func Taps(taps ...Tap) Tap {
+	var list []Tap
+	for _, tap := range taps {
+		if tap != nil {
+			list = append(list, tap)
+		}
+	}
+	switch len(list) {
+	case 0:
+		return nil
+	case 1:
+		return list[0]
+	}
+	return func(direction Direction, messageType int, data []byte) {
+		for _, tap := range list {
+			tap(direction, messageType, data)
+		}
+	}
+}
+
+// Probers returns a Prober running those of probers that aren't nil, nil if
+// none is. A message of upstream is consumed by the first that consumes it.
+func Probers(probers ...Prober) Prober {
+	var list proberList
+	for _, p := range probers {
+		if p != nil {
+			list = append(list, p)
+		}
+	}
+	switch len(list) {
+	case 0:
+		return nil
+	case 1:
+		return list[0]
+	}
+	return list
+}
+
+type proberList []Prober
+
+func (l proberList) Run(send func(messageType int, data []byte) error, stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, p := range l {
+		wg.Add(1)
+		go func(p Prober) {
+			defer wg.Done()
+			p.Run(send, stop)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (l proberList) Consume(messageType int, data []byte) bool {
+	for _, p := range l {
+		if p.Consume(messageType, data) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l proberList) Relayed(d time.Duration) {
+	for _, p := range l {
+		p.Relayed(d)
+	}
+}
+
+// FilteredWebSockets is WebSockets, passing the client's messages through
+// filter first if it is non-nil, and showing the messages to tap if it is
+// non-nil.
+func FilteredWebSockets(clientConn *websocket.Conn, upstreamConn *websocket.Conn, chaos *Chaos, filter Filter, tap Tap) {
+	ProbedWebSockets(clientConn, upstreamConn, chaos, filter, tap, nil)
+}
+
+// ProbedWebSockets is FilteredWebSockets, also running prober for as long as
+// the relay if it is non-nil.
+func ProbedWebSockets(clientConn *websocket.Conn, upstreamConn *websocket.Conn, chaos *Chaos, filter Filter, tap Tap, prober Prober) {
+	done := make(chan struct{})
+	var doneOnce sync.Once // Ensure channel is closed only once
+	// Probes and the client's messages are both written upstream.
+	var upstreamWriteMu sync.Mutex
+	writeUpstream := func(messageType int, data []byte) error {
+		upstreamWriteMu.Lock()
+		defer upstreamWriteMu.Unlock()
+		return upstreamConn.WriteMessage(messageType, data)
+	}
+	// Filter replies and upstream messages are both written to the client.
+	var clientWriteMu sync.Mutex
+	writeClient := func(messageType int, data []byte) error {
+		clientWriteMu.Lock()
+		defer clientWriteMu.Unlock()
+		if tap != nil {
+			tap(ToClient, messageType, data)
+		}
+		return clientConn.WriteMessage(messageType, data)
+	}
+
+	// Client -> Upstream
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Panic in client->upstream proxy: %v", r)
+			}
+			doneOnce.Do(func() { close(done) })
+		}()
+		for {
+			messageType, data, err := clientConn.ReadMessage()
+			if err != nil {
+				log.Debugf("Client connection closed: %v", err)
+				return
+			}
+			read := time.Now()
+			switch chaos.apply() {
+			case chaosClose:
+				return
+			case chaosDrop:
+				continue
+			}
+			if tap != nil {
+				tap(FromClient, messageType, data)
+			}
+			if filter != nil {
+				reply, forward := filter(messageType, data)
+				if !forward {
+					if reply != nil {
+						if err := writeClient(messageType, reply); err != nil {
+							log.Debugf("Failed to write to client: %v", err)
+							return
+						}
+					}
+					continue
+				}
+			}
+			if err := writeUpstream(messageType, data); err != nil {
+				log.Debugf("Failed to write to upstream: %v", err)
+				return
+			}
+			if prober != nil {
+				prober.Relayed(time.Since(read))
+			}
+		}
+	}()
+
+	// Upstream -> Client
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Panic in upstream->client proxy: %v", r)
+			}
+			doneOnce.Do(func() { close(done) })
+		}()
+		for {
+			messageType, data, err := upstreamConn.ReadMessage()
+			if err != nil {
+				log.Debugf("Upstream connection closed: %v", err)
+				return
+			}
+			switch chaos.apply() {
+			case chaosClose:
+				return
+			case chaosDrop:
+				continue
+			}
+			if prober != nil && prober.Consume(messageType, data) {
+				continue
+			}
+			if err := writeClient(messageType, data); err != nil {
+				log.Debugf("Failed to write to client: %v", err)
+				return
+			}
+		}
+	}()
+
+	if prober != nil {
+		go prober.Run(writeUpstream, done)
+	}
+
+	// Wait for either connection to close
+	<-done
+}
+
+// VNC proxies between a websockify style client and a raw RFB stream. Reads
+// from the VNC server are coalesced into frames according to batching, and
+// faults are injected if chaos is non-nil. It returns as soon as either
+// direction stops; closing the connections is left to the caller.
+func VNC(conn *websocket.Conn, vncConn net.Conn, batching config.BatchingConfig, chaos *Chaos) {
+	done := make(chan struct{})
+	var doneOnce sync.Once
+
+	// Handle WebSocket to VNC direction
+	go func() {
+		defer doneOnce.Do(func() { close(done) })
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				log.Printf("WebSocket read error: %v", err)
+				return
+			}
+
+			// Handle both binary and text messages (websockify protocol). Text
+			// messages are forwarded as is.
+			if messageType != websocket.BinaryMessage && messageType != websocket.TextMessage {
+				continue
+			}
+			switch chaos.apply() {
+			case chaosClose:
+				return
+			case chaosDrop:
+				continue
+			}
+			if _, err := vncConn.Write(message); err != nil {
+				log.Printf("VNC write error: %v", err)
+				return
+			}
+		}
+	}()
+
+	// Handle VNC to WebSocket direction
+	go func() {
+		defer doneOnce.Do(func() { close(done) })
+
+		batcher := newFrameBatcher(conn, batching)
+		// Deliver whatever is still pending before tearing down.
+		defer batcher.Close()
+
+		buffer := make([]byte, vncReadBufferSize)
+		for {
+			n, err := vncConn.Read(buffer)
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("VNC read error: %v", err)
+				}
+				return
+			}
+			switch chaos.apply() {
+			case chaosClose:
+				return
+			case chaosDrop:
+				continue
+			}
+			if err := batcher.Write(buffer[:n]); err != nil {
+				log.Printf("WebSocket write error: %v", err)
+				return
+			}
+		}
+	}()
+
+	// Wait for either direction to close
+	<-done
+}
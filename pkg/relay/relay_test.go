@@ -0,0 +1,79 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeProber struct {
+	consumes string
+	relayed  int
+}
+
+func (p *fakeProber) Run(send func(messageType int, data []byte) error, stop <-chan struct{}) {
+	send(1, []byte(p.consumes))
+	<-stop
+}
+
+func (p *fakeProber) Consume(messageType int, data []byte) bool {
+	return string(data) == p.consumes
+}
+
+func (p *fakeProber) Relayed(d time.Duration) {
+	p.relayed++
+}
+
+func TestProbers(t *testing.T) {
+	if p := Probers(nil, nil); p != nil {
+		t.Errorf("Probers(nil, nil) = %v, want nil", p)
+	}
+	a := &fakeProber{consumes: "a"}
+	if p := Probers(nil, a); p != a {
+		t.Errorf("Probers(nil, a) = %v, want a", p)
+	}
+
+	b := &fakeProber{consumes: "b"}
+	p := Probers(a, b)
+	for data, want := range map[string]bool{"a": true, "b": true, "c": false} {
+		if got := p.Consume(1, []byte(data)); got != want {
+			t.Errorf("Consume(%s) = %t, want %t", data, got, want)
+		}
+	}
+	p.Relayed(time.Millisecond)
+	if a.relayed != 1 || b.relayed != 1 {
+		t.Errorf("relayed %d and %d times, want once each", a.relayed, b.relayed)
+	}
+
+	sent := make(chan string, 2)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		p.Run(func(messageType int, data []byte) error {
+			sent <- string(data)
+			return nil
+		}, stop)
+		close(done)
+	}()
+	got := map[string]bool{<-sent: true, <-sent: true}
+	if !got["a"] || !got["b"] {
+		t.Errorf("sent %v, want a and b", got)
+	}
+	close(stop)
+	<-done
+}
+
+func TestTaps(t *testing.T) {
+	if tap := Taps(nil, nil); tap != nil {
+		t.Error("Taps(nil, nil) != nil")
+	}
+	var seen []string
+	tapper := func(name string) Tap {
+		return func(direction Direction, messageType int, data []byte) {
+			seen = append(seen, name+":"+string(data))
+		}
+	}
+	Taps(tapper("a"), nil, tapper("b"))(ToClient, 1, []byte("m"))
+	if len(seen) != 2 || seen[0] != "a:m" || seen[1] != "b:m" {
+		t.Errorf("seen %v, want a:m then b:m", seen)
+	}
+}
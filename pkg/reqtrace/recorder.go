@@ -0,0 +1,184 @@
+package reqtrace
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/oidc"
+)
+
+const (
+	defaultSlowThreshold = 2 * time.Second
+	defaultSlowRequests  = 100
+)
+
+// Request describes a completed API call.
+type Request struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Tenant     string    `json:"tenant,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+	// PhasesMs is the time spent per phase, see the Phase constants.
+	PhasesMs map[string]int64 `json:"phasesMs,omitempty"`
+}
+
+// Recorder logs every request it sees and keeps the most recent slow ones.
+type Recorder struct {
+	threshold time.Duration
+
+	mu   sync.Mutex
+	slow []Request
+	next int
+	full bool
+}
+
+// NewRecorder returns a recorder configured by c.
+func NewRecorder(c config.RequestLogConfig) *Recorder {
+	threshold := c.SlowThreshold
+	if threshold == 0 {
+		threshold = defaultSlowThreshold
+	}
+	size := c.SlowRequests
+	if size <= 0 {
+		size = defaultSlowRequests
+	}
+	return &Recorder{threshold: threshold, slow: make([]Request, size)}
+}
+
+// Middleware logs and traces the requests served by next. Used with
+// mux.Router.Use it logs the matched route template rather than the path, so
+// that calls are easy to aggregate.
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, trace := NewContext(r.Context())
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		rec.observe(r, start, sw.status(), trace)
+	})
+}
+
+func (rec *Recorder) observe(r *http.Request, start time.Time, status int, trace *Trace) {
+	duration := time.Since(start)
+	req := Request{
+		Time:       start,
+		Method:     r.Method,
+		Route:      r.URL.Path,
+		Path:       r.URL.Path,
+		Status:     status,
+		DurationMs: duration.Milliseconds(),
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			req.Route = template
+		}
+	}
+	if id := oidc.FromContext(r.Context()); id != nil {
+		req.Tenant = id.Tenant
+	}
+
+	logger := log.WithFields(log.Fields{
+		"method":     req.Method,
+		"route":      req.Route,
+		"status":     req.Status,
+		"durationMs": req.DurationMs,
+		"tenant":     req.Tenant,
+	})
+	// WebSocket sessions last as long as the user keeps them open.
+	if rec.threshold < 0 || duration < rec.threshold || status == http.StatusSwitchingProtocols {
+		// Health checks are polled by supervisors and would drown the log.
+		if strings.HasSuffix(req.Route, "/health") && status == http.StatusOK {
+			logger.Debug("API call")
+		} else {
+			logger.Info("API call")
+		}
+		return
+	}
+
+	phases := trace.Phases()
+	req.PhasesMs = make(map[string]int64, len(phases))
+	for phase, d := range phases {
+		req.PhasesMs[phase] = d.Milliseconds()
+		logger = logger.WithField(phase+"Ms", d.Milliseconds())
+	}
+	logger.Warnf("Slow API call, took longer than %s", rec.threshold)
+
+	rec.mu.Lock()
+	rec.slow[rec.next] = req
+	rec.next = (rec.next + 1) % len(rec.slow)
+	if rec.next == 0 {
+		rec.full = true
+	}
+	rec.mu.Unlock()
+}
+
+// Slow returns the kept slow requests, most recent first.
+func (rec *Recorder) Slow() []Request {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	n := rec.next
+	if rec.full {
+		n = len(rec.slow)
+	}
+	requests := make([]Request, 0, n)
+	for i := 1; i <= n; i++ {
+		requests = append(requests, rec.slow[(rec.next-i+len(rec.slow))%len(rec.slow)])
+	}
+	return requests
+}
+
+// statusWriter records the status of a response. It supports hijacking for
+// the WebSocket endpoints and flushing for streamed responses.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer doesn't support hijacking")
+	}
+	// A hijacked connection switched protocols.
+	w.code = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
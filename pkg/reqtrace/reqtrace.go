@@ -0,0 +1,98 @@
+// Package reqtrace logs API calls and keeps the slowest ones, together with a
+// breakdown of the time they spent in the phases of VM management that are
+// usually to blame: cloud-hypervisor API calls, network setup and disk copies.
+package reqtrace
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Phases of a request timed separately.
+const (
+	PhaseCHVAPI   = "chv_api"
+	PhaseNetwork  = "network_setup"
+	PhaseDiskCopy = "disk_copy"
+)
+
+// Trace accumulates the time a request spent per phase. It is safe for
+// concurrent use, e.g. by goroutines serving parts of the same request.
+type Trace struct {
+	mu     sync.Mutex
+	phases map[string]time.Duration
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying a new trace.
+func NewContext(ctx context.Context) (context.Context, *Trace) {
+	t := &Trace{phases: make(map[string]time.Duration)}
+	return context.WithValue(ctx, contextKey{}, t), t
+}
+
+// FromContext returns the trace of ctx, or nil if the request isn't traced.
+func FromContext(ctx context.Context) *Trace {
+	t, _ := ctx.Value(contextKey{}).(*Trace)
+	return t
+}
+
+// Add adds d to phase. It does nothing on a nil trace.
+func (t *Trace) Add(phase string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.phases[phase] += d
+	t.mu.Unlock()
+}
+
+// Phases returns a copy of the time spent per phase.
+func (t *Trace) Phases() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	phases := make(map[string]time.Duration, len(t.phases))
+	for phase, d := range t.phases {
+		phases[phase] = d
+	}
+	return phases
+}
+
+// Start times phase of the request ctx belongs to until the returned function
+// is first called, so that it can also be deferred to cover early returns. It
+// is cheap for untraced requests.
+//
+//	done := reqtrace.Start(ctx, reqtrace.PhaseDiskCopy)
+//	err := copyFile(src, dst)
+//	done()
+func Start(ctx context.Context, phase string) func() {
+	t := FromContext(ctx)
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.Add(phase, time.Since(start)) })
+	}
+}
+
+// Transport attributes the time of every round trip made with a request's
+// context to phase, e.g. for the cloud-hypervisor API client.
+func Transport(base http.RoundTripper, phase string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripper{base: base, phase: phase}
+}
+
+type roundTripper struct {
+	base  http.RoundTripper
+	phase string
+}
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	defer Start(req.Context(), rt.phase)()
+	return rt.base.RoundTrip(req)
+}
@@ -0,0 +1,63 @@
+package reqtrace
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+func TestStartWithoutTrace(t *testing.T) {
+	// Untraced requests, e.g. from housekeeping, must not panic.
+	Start(httptest.NewRequest(http.MethodGet, "/", nil).Context(), PhaseDiskCopy)()
+}
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecorder(config.RequestLogConfig{SlowThreshold: 20 * time.Millisecond, SlowRequests: 2})
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	}))
+	defer backend.Close()
+	client := &http.Client{Transport: Transport(nil, PhaseCHVAPI)}
+
+	r := mux.NewRouter()
+	r.Use(rec.Middleware)
+	r.HandleFunc("/v1/vms/{name}", func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, backend.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	r.HandleFunc("/v1/health", func(w http.ResponseWriter, r *http.Request) {})
+
+	serve := func(target string) {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	serve("/v1/health")
+	if got := rec.Slow(); len(got) != 0 {
+		t.Fatalf("Slow() = %v after a fast request, want none", got)
+	}
+
+	serve("/v1/vms/a")
+	serve("/v1/vms/b")
+	serve("/v1/vms/c")
+	got := rec.Slow()
+	if len(got) != 2 || got[0].Path != "/v1/vms/c" || got[1].Path != "/v1/vms/b" {
+		t.Fatalf("Slow() = %+v, want the last two slow requests, most recent first", got)
+	}
+	if got[0].Route != "/v1/vms/{name}" || got[0].Status != http.StatusAccepted {
+		t.Errorf("Slow()[0] = %+v, want route /v1/vms/{name} and status 202", got[0])
+	}
+	if got[0].PhasesMs[PhaseCHVAPI] < 30 {
+		t.Errorf("Slow()[0].PhasesMs = %v, want at least 30ms of %s", got[0].PhasesMs, PhaseCHVAPI)
+	}
+}
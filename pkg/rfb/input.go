@@ -0,0 +1,335 @@
+package rfb
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Types of input events.
+const (
+	// InputKey presses and releases Key, a key or a combination such as
+	// "ctrl+c".
+	InputKey = "key"
+	// InputKeyDown and InputKeyUp press or release Key alone, e.g. to hold
+	// shift across clicks.
+	InputKeyDown = "keyDown"
+	InputKeyUp   = "keyUp"
+	// InputText types Text.
+	InputText = "text"
+	// InputMove moves the pointer to X, Y.
+	InputMove = "move"
+	// InputClick clicks Button Count times, at X, Y if set.
+	InputClick = "click"
+	// InputMouseDown and InputMouseUp press or release Button, at X, Y if set,
+	// e.g. to drag.
+	InputMouseDown = "mouseDown"
+	InputMouseUp   = "mouseUp"
+	// InputScroll scrolls DeltaX and DeltaY wheel steps, at X, Y if set.
+	// Positive values scroll right and down.
+	InputScroll = "scroll"
+	// InputWait pauses for DurationMs.
+	InputWait = "wait"
+)
+
+const (
+	// MaxInputEvents bounds the events of one sequence.
+	MaxInputEvents = 1000
+	// MaxInputText bounds the characters typed by one sequence.
+	MaxInputText = 10000
+	// MaxInputDuration bounds the waits and delays of one sequence.
+	MaxInputDuration = time.Minute
+	// maxRepeat bounds the clicks and wheel steps of one event.
+	maxRepeat = 100
+)
+
+// InputEvent is one step of an input sequence, see the Input* types.
+type InputEvent struct {
+	Type string `json:"type"`
+	Key  string `json:"key,omitempty"`
+	Text string `json:"text,omitempty"`
+	// X and Y default to the pointer's last position, 0, 0 at first.
+	X *int `json:"x,omitempty"`
+	Y *int `json:"y,omitempty"`
+	// Button is "left" (default), "middle" or "right".
+	Button string `json:"button,omitempty"`
+	// Count of clicks, 1 by default.
+	Count      int `json:"count,omitempty"`
+	DeltaX     int `json:"deltaX,omitempty"`
+	DeltaY     int `json:"deltaY,omitempty"`
+	DurationMs int `json:"durationMs,omitempty"`
+}
+
+// InputRequest is a sequence of input events to inject into a desktop.
+type InputRequest struct {
+	Events []InputEvent `json:"events"`
+	// DelayMs is paused for between events, e.g. for applications that miss
+	// fast input.
+	DelayMs int `json:"delayMs,omitempty"`
+}
+
+// InputResponse reports an injected sequence.
+type InputResponse struct {
+	Events int `json:"events"`
+	// Width and Height of the desktop the pointer positions are within.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// buttonMasks are the pointer event bits of the buttons. Wheel steps are
+// clicks of buttons 4 to 7.
+var buttonMasks = map[string]uint8{
+	"":       1 << 0,
+	"left":   1 << 0,
+	"middle": 1 << 1,
+	"right":  1 << 2,
+}
+
+const (
+	wheelUp    = 1 << 3
+	wheelDown  = 1 << 4
+	wheelLeft  = 1 << 5
+	wheelRight = 1 << 6
+)
+
+// Validate checks a sequence before any of it is injected, so that an invalid
+// event doesn't leave it half done.
+func (req InputRequest) Validate() error {
+	if len(req.Events) == 0 {
+		return fmt.Errorf("no events")
+	}
+	if len(req.Events) > MaxInputEvents {
+		return fmt.Errorf("%d events, at most %d are allowed", len(req.Events), MaxInputEvents)
+	}
+	if req.DelayMs < 0 {
+		return fmt.Errorf("delayMs must not be negative")
+	}
+	duration := time.Duration(req.DelayMs) * time.Millisecond * time.Duration(len(req.Events)-1)
+	text := 0
+	for i, event := range req.Events {
+		if err := event.validate(); err != nil {
+			return fmt.Errorf("event %d: %v", i, err)
+		}
+		duration += time.Duration(event.DurationMs) * time.Millisecond
+		text += utf8.RuneCountInString(event.Text)
+	}
+	if duration > MaxInputDuration {
+		return fmt.Errorf("waits and delays add up to %s, at most %s is allowed", duration, MaxInputDuration)
+	}
+	if text > MaxInputText {
+		return fmt.Errorf("%d characters of text, at most %d are allowed", text, MaxInputText)
+	}
+	return nil
+}
+
+func (e InputEvent) validate() error {
+	if (e.X != nil && *e.X < 0) || (e.Y != nil && *e.Y < 0) {
+		return fmt.Errorf("negative position")
+	}
+	if e.Count < 0 || e.Count > maxRepeat || abs(e.DeltaX) > maxRepeat || abs(e.DeltaY) > maxRepeat {
+		return fmt.Errorf("count and deltas must be within %d", maxRepeat)
+	}
+	switch e.Type {
+	case InputKey, InputKeyDown, InputKeyUp:
+		keys, err := ParseKeys(e.Key)
+		if err != nil {
+			return err
+		}
+		if e.Type != InputKey && len(keys) != 1 {
+			return fmt.Errorf("%s takes a single key", e.Type)
+		}
+	case InputText:
+		if e.Text == "" || !utf8.ValidString(e.Text) {
+			return fmt.Errorf("text must be non-empty UTF-8")
+		}
+	case InputMove:
+		if e.X == nil || e.Y == nil {
+			return fmt.Errorf("move needs x and y")
+		}
+	case InputClick, InputMouseDown, InputMouseUp:
+		if _, ok := buttonMasks[e.Button]; !ok {
+			return fmt.Errorf("unknown button %q", e.Button)
+		}
+	case InputScroll:
+		if e.DeltaX == 0 && e.DeltaY == 0 {
+			return fmt.Errorf("scroll needs deltaX or deltaY")
+		}
+	case InputWait:
+		if e.DurationMs <= 0 {
+			return fmt.Errorf("wait needs a positive durationMs")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", e.Type)
+	}
+	return nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// player injects the events of a sequence, tracking the pointer and the keys
+// held down.
+type player struct {
+	c       *Client
+	x, y    int
+	buttons uint8
+	held    []uint32
+}
+
+// Play injects a sequence validated with Validate. Keys and buttons it left
+// pressed are released at the end, also when it fails or ctx is done
+// midway. It returns how many events were injected.
+func (c *Client) Play(ctx context.Context, req InputRequest) (int, error) {
+	p := &player{c: c}
+	defer p.releaseAll()
+	for i, event := range req.Events {
+		if i > 0 && req.DelayMs > 0 {
+			if err := sleep(ctx, time.Duration(req.DelayMs)*time.Millisecond); err != nil {
+				return i, err
+			}
+		}
+		if err := p.play(ctx, event); err != nil {
+			return i, fmt.Errorf("event %d: %v", i, err)
+		}
+	}
+	return len(req.Events), nil
+}
+
+func (p *player) play(ctx context.Context, e InputEvent) error {
+	switch e.Type {
+	case InputKey:
+		keys, _ := ParseKeys(e.Key)
+		for _, key := range keys {
+			if err := p.c.KeyEvent(key, true); err != nil {
+				return err
+			}
+		}
+		for i := len(keys) - 1; i >= 0; i-- {
+			if err := p.c.KeyEvent(keys[i], false); err != nil {
+				return err
+			}
+		}
+	case InputKeyDown:
+		keys, _ := ParseKeys(e.Key)
+		p.held = append(p.held, keys[0])
+		return p.c.KeyEvent(keys[0], true)
+	case InputKeyUp:
+		keys, _ := ParseKeys(e.Key)
+		for i, held := range p.held {
+			if held == keys[0] {
+				p.held = append(p.held[:i], p.held[i+1:]...)
+				break
+			}
+		}
+		return p.c.KeyEvent(keys[0], false)
+	case InputText:
+		for _, r := range e.Text {
+			if err := p.c.KeyEvent(RuneKeysym(r), true); err != nil {
+				return err
+			}
+			if err := p.c.KeyEvent(RuneKeysym(r), false); err != nil {
+				return err
+			}
+		}
+	case InputMove:
+		return p.moveTo(e)
+	case InputClick:
+		if err := p.moveTo(e); err != nil {
+			return err
+		}
+		count := e.Count
+		if count == 0 {
+			count = 1
+		}
+		for i := 0; i < count; i++ {
+			if err := p.click(buttonMasks[e.Button]); err != nil {
+				return err
+			}
+		}
+	case InputMouseDown, InputMouseUp:
+		if err := p.moveTo(e); err != nil {
+			return err
+		}
+		if e.Type == InputMouseDown {
+			p.buttons |= buttonMasks[e.Button]
+		} else {
+			p.buttons &^= buttonMasks[e.Button]
+		}
+		return p.c.PointerEvent(p.buttons, p.x, p.y)
+	case InputScroll:
+		if err := p.moveTo(e); err != nil {
+			return err
+		}
+		steps := []struct {
+			delta         int
+			back, forward uint8
+		}{{e.DeltaY, wheelUp, wheelDown}, {e.DeltaX, wheelLeft, wheelRight}}
+		for _, step := range steps {
+			wheel := step.forward
+			if step.delta < 0 {
+				wheel = step.back
+			}
+			for i := 0; i < abs(step.delta); i++ {
+				if err := p.click(wheel); err != nil {
+					return err
+				}
+			}
+		}
+	case InputWait:
+		return sleep(ctx, time.Duration(e.DurationMs)*time.Millisecond)
+	}
+	return nil
+}
+
+// moveTo moves the pointer to the event's position, if it has one.
+func (p *player) moveTo(e InputEvent) error {
+	if e.X == nil && e.Y == nil {
+		return nil
+	}
+	x, y := p.x, p.y
+	if e.X != nil {
+		x = *e.X
+	}
+	if e.Y != nil {
+		y = *e.Y
+	}
+	if x >= p.c.Width || y >= p.c.Height {
+		return fmt.Errorf("position %d,%d is outside the %dx%d desktop", x, y, p.c.Width, p.c.Height)
+	}
+	p.x, p.y = x, y
+	return p.c.PointerEvent(p.buttons, p.x, p.y)
+}
+
+// click presses and releases the buttons of mask.
+func (p *player) click(mask uint8) error {
+	if err := p.c.PointerEvent(p.buttons|mask, p.x, p.y); err != nil {
+		return err
+	}
+	return p.c.PointerEvent(p.buttons&^mask, p.x, p.y)
+}
+
+// releaseAll releases the keys and buttons left pressed.
+func (p *player) releaseAll() {
+	for i := len(p.held) - 1; i >= 0; i-- {
+		p.c.KeyEvent(p.held[i], false)
+	}
+	if p.buttons != 0 {
+		p.c.PointerEvent(0, p.x, p.y)
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
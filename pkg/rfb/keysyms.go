@@ -0,0 +1,107 @@
+package rfb
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// keysyms of the keys named in input sequences, by lowercased X keysym name,
+// plus a few aliases.
+var keysyms = map[string]uint32{
+	"backspace": 0xff08,
+	"tab":       0xff09,
+	"return":    0xff0d,
+	"enter":     0xff0d,
+	"escape":    0xff1b,
+	"esc":       0xff1b,
+	"delete":    0xffff,
+	"insert":    0xff63,
+	"home":      0xff50,
+	"left":      0xff51,
+	"up":        0xff52,
+	"right":     0xff53,
+	"down":      0xff54,
+	"page_up":   0xff55,
+	"pageup":    0xff55,
+	"page_down": 0xff56,
+	"pagedown":  0xff56,
+	"end":       0xff57,
+	"menu":      0xff67,
+	"space":     0x0020,
+	"shift":     0xffe1,
+	"shift_l":   0xffe1,
+	"shift_r":   0xffe2,
+	"ctrl":      0xffe3,
+	"control":   0xffe3,
+	"control_l": 0xffe3,
+	"control_r": 0xffe4,
+	"caps_lock": 0xffe5,
+	"meta":      0xffe7,
+	"alt":       0xffe9,
+	"alt_l":     0xffe9,
+	"alt_r":     0xffea,
+	"super":     0xffeb,
+	"super_l":   0xffeb,
+	"super_r":   0xffec,
+	"cmd":       0xffeb,
+	"win":       0xffeb,
+}
+
+// Keysym returns the X keysym of a key: a name such as "Return", "Page_Up",
+// "ctrl" or "F5", case-insensitively, or a single character.
+func Keysym(key string) (uint32, error) {
+	if r, size := utf8.DecodeRuneInString(key); size == len(key) && r != utf8.RuneError {
+		return RuneKeysym(r), nil
+	}
+	name := strings.ToLower(key)
+	if keysym, ok := keysyms[name]; ok {
+		return keysym, nil
+	}
+	var n int
+	if _, err := fmt.Sscanf(name, "f%d", &n); err == nil && fmt.Sprintf("f%d", n) == name && n >= 1 && n <= 24 {
+		return 0xffbe + uint32(n-1), nil
+	}
+	return 0, fmt.Errorf("unknown key %q", key)
+}
+
+// RuneKeysym returns the X keysym typing r.
+func RuneKeysym(r rune) uint32 {
+	switch {
+	case r == '\n':
+		return keysyms["return"]
+	case r == '\t':
+		return keysyms["tab"]
+	case (r >= 0x20 && r <= 0x7e) || (r >= 0xa0 && r <= 0xff):
+		// Latin-1 keysyms are the characters' code points.
+		return uint32(r)
+	default:
+		return 0x01000000 + uint32(r)
+	}
+}
+
+// ParseKeys parses a key combination such as "ctrl+shift+t" into the keysyms
+// to press in order, and release in reverse. A lone "+" is the plus key.
+func ParseKeys(combo string) ([]uint32, error) {
+	if combo == "" {
+		return nil, fmt.Errorf("no key")
+	}
+	var parts []string
+	switch {
+	case combo == "+":
+		parts = []string{"+"}
+	case strings.HasSuffix(combo, "++"):
+		parts = append(strings.Split(strings.TrimSuffix(combo, "++"), "+"), "+")
+	default:
+		parts = strings.Split(combo, "+")
+	}
+	var keys []uint32
+	for _, part := range parts {
+		keysym, err := Keysym(part)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, keysym)
+	}
+	return keys, nil
+}
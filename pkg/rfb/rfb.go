@@ -0,0 +1,366 @@
+// Package rfb is a minimal client of the RFB (VNC) protocol, enough to inject
+// keyboard and mouse input into a desktop and capture its screen without a
+// VNC client library. It connects as a shared client, so that viewers
+// already connected stay, and only asks for framebuffer updates to capture.
+package rfb
+
+import (
+	"context"
+	"crypto/des"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"net"
+	"time"
+)
+
+// Security types.
+const (
+	securityNone    = 1
+	securityVNCAuth = 2
+)
+
+// Client to server messages.
+const (
+	msgSetPixelFormat           = 0
+	msgSetEncodings             = 2
+	msgFramebufferUpdateRequest = 3
+	msgKeyEvent                 = 4
+	msgPointerEvent             = 5
+)
+
+// Server to client messages.
+const (
+	msgFramebufferUpdate   = 0
+	msgSetColourMapEntries = 1
+	msgBell                = 2
+	msgServerCutText       = 3
+)
+
+// encodingRaw sends rectangles as uncompressed pixels, the one encoding every
+// server supports.
+const encodingRaw = 0
+
+// handshakeTimeout bounds the handshake with an unresponsive server.
+const handshakeTimeout = 10 * time.Second
+
+// Client is a connection to a VNC server, past the handshake.
+type Client struct {
+	conn net.Conn
+	// Width and Height of the framebuffer, which pointer positions are within.
+	Width  int
+	Height int
+	// Name of the desktop.
+	Name string
+}
+
+// Dial connects to the VNC server at addr, authenticating with password if
+// the server requires VNC authentication.
+func Dial(ctx context.Context, addr string, password string) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(handshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	c := &Client{conn: conn}
+	if err := c.handshake(password); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("RFB handshake with %s failed: %v", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *Client) handshake(password string) error {
+	banner := make([]byte, 12)
+	if _, err := io.ReadFull(c.conn, banner); err != nil {
+		return err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(banner), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return fmt.Errorf("unsupported protocol version %q", banner)
+	}
+	// 3.3 and 3.7 as is, anything later as 3.8, the latest the spec defines.
+	switch {
+	case minor >= 8:
+		minor = 8
+	case minor >= 7:
+		minor = 7
+	default:
+		minor = 3
+	}
+	if _, err := fmt.Fprintf(c.conn, "RFB 003.%03d\n", minor); err != nil {
+		return err
+	}
+
+	var security uint32
+	if minor == 3 {
+		// The server picks the security type.
+		if err := binary.Read(c.conn, binary.BigEndian, &security); err != nil {
+			return err
+		}
+		if security == 0 {
+			return c.readFailure()
+		}
+	} else {
+		var count uint8
+		if err := binary.Read(c.conn, binary.BigEndian, &count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return c.readFailure()
+		}
+		offered := make([]byte, count)
+		if _, err := io.ReadFull(c.conn, offered); err != nil {
+			return err
+		}
+		for _, t := range offered {
+			if t == securityNone || (t == securityVNCAuth && security != securityNone) {
+				security = uint32(t)
+			}
+		}
+		if security == 0 {
+			return fmt.Errorf("no supported security type among %v", offered)
+		}
+		if _, err := c.conn.Write([]byte{byte(security)}); err != nil {
+			return err
+		}
+	}
+
+	switch security {
+	case securityNone:
+		// Only 3.8 reports the result of no authentication.
+		if minor < 8 {
+			break
+		}
+		if err := c.readSecurityResult(minor); err != nil {
+			return err
+		}
+	case securityVNCAuth:
+		challenge := make([]byte, 16)
+		if _, err := io.ReadFull(c.conn, challenge); err != nil {
+			return err
+		}
+		if _, err := c.conn.Write(vncAuthResponse(password, challenge)); err != nil {
+			return err
+		}
+		if err := c.readSecurityResult(minor); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported security type %d", security)
+	}
+
+	// Shared, so that other clients aren't disconnected.
+	if _, err := c.conn.Write([]byte{1}); err != nil {
+		return err
+	}
+	var serverInit struct {
+		Width       uint16
+		Height      uint16
+		PixelFormat [16]byte
+		NameLength  uint32
+	}
+	if err := binary.Read(c.conn, binary.BigEndian, &serverInit); err != nil {
+		return err
+	}
+	if serverInit.NameLength > 1<<16 {
+		return fmt.Errorf("desktop name of %d bytes", serverInit.NameLength)
+	}
+	name := make([]byte, serverInit.NameLength)
+	if _, err := io.ReadFull(c.conn, name); err != nil {
+		return err
+	}
+	c.Width, c.Height, c.Name = int(serverInit.Width), int(serverInit.Height), string(name)
+	return nil
+}
+
+// readSecurityResult fails unless authentication succeeded.
+func (c *Client) readSecurityResult(minor int) error {
+	var result uint32
+	if err := binary.Read(c.conn, binary.BigEndian, &result); err != nil {
+		return err
+	}
+	if result == 0 {
+		return nil
+	}
+	if minor >= 8 {
+		return c.readFailure()
+	}
+	return fmt.Errorf("authentication failed")
+}
+
+// readFailure returns the reason the server sent for failing the handshake.
+func (c *Client) readFailure() error {
+	var length uint32
+	if err := binary.Read(c.conn, binary.BigEndian, &length); err != nil || length > 1<<16 {
+		return fmt.Errorf("server refused the connection")
+	}
+	reason := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, reason); err != nil {
+		return fmt.Errorf("server refused the connection")
+	}
+	return fmt.Errorf("server refused the connection: %s", reason)
+}
+
+// vncAuthResponse encrypts the challenge of VNC authentication with DES,
+// keyed with the first 8 bytes of password with the bits of each byte
+// reversed.
+func vncAuthResponse(password string, challenge []byte) []byte {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		key[i] = bits.Reverse8(b)
+	}
+	// A key of 8 bytes is always valid.
+	block, _ := des.NewCipher(key)
+	response := make([]byte, len(challenge))
+	for i := 0; i+8 <= len(challenge); i += 8 {
+		block.Encrypt(response[i:i+8], challenge[i:i+8])
+	}
+	return response
+}
+
+// KeyEvent presses or releases the key of an X keysym.
+func (c *Client) KeyEvent(keysym uint32, down bool) error {
+	msg := make([]byte, 8)
+	msg[0] = msgKeyEvent
+	if down {
+		msg[1] = 1
+	}
+	binary.BigEndian.PutUint32(msg[4:], keysym)
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+// PointerEvent moves the pointer to x, y with the buttons of mask pressed,
+// bit 0 being the left button.
+func (c *Client) PointerEvent(mask uint8, x int, y int) error {
+	msg := make([]byte, 6)
+	msg[0] = msgPointerEvent
+	msg[1] = mask
+	binary.BigEndian.PutUint16(msg[2:], uint16(x))
+	binary.BigEndian.PutUint16(msg[4:], uint16(y))
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Capture returns the whole framebuffer. It switches the connection to 32-bit
+// true colour pixels sent raw, so it shouldn't be shared with a viewer.
+func (c *Client) Capture(ctx context.Context) (*image.RGBA, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	// 32 bits per pixel, depth 24, little-endian, true colour, 8 bits per
+	// channel with red in the third byte, green in the second and blue in
+	// the first.
+	msg := []byte{
+		msgSetPixelFormat, 0, 0, 0,
+		32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0,
+		msgSetEncodings, 0, 0, 1, 0, 0, 0, encodingRaw,
+		msgFramebufferUpdateRequest, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint16(msg[34:], uint16(c.Width))
+	binary.BigEndian.PutUint16(msg[36:], uint16(c.Height))
+	if _, err := c.conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	for {
+		var msgType uint8
+		if err := binary.Read(c.conn, binary.BigEndian, &msgType); err != nil {
+			return nil, err
+		}
+		switch msgType {
+		case msgFramebufferUpdate:
+			return c.readFramebufferUpdate()
+		case msgSetColourMapEntries:
+			var header struct {
+				Padding    uint8
+				FirstColor uint16
+				Colors     uint16
+			}
+			if err := binary.Read(c.conn, binary.BigEndian, &header); err != nil {
+				return nil, err
+			}
+			if _, err := io.CopyN(io.Discard, c.conn, 6*int64(header.Colors)); err != nil {
+				return nil, err
+			}
+		case msgBell:
+		case msgServerCutText:
+			var header struct {
+				Padding [3]byte
+				Length  uint32
+			}
+			if err := binary.Read(c.conn, binary.BigEndian, &header); err != nil {
+				return nil, err
+			}
+			if _, err := io.CopyN(io.Discard, c.conn, int64(header.Length)); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected message type %d", msgType)
+		}
+	}
+}
+
+// readFramebufferUpdate reads the rectangles of an update into an image of
+// the framebuffer.
+func (c *Client) readFramebufferUpdate() (*image.RGBA, error) {
+	var header struct {
+		Padding uint8
+		Rects   uint16
+	}
+	if err := binary.Read(c.conn, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, c.Width, c.Height))
+	// What no rectangle covers is opaque black.
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	for i := 0; i < int(header.Rects); i++ {
+		var rect struct {
+			X, Y, Width, Height uint16
+			Encoding            int32
+		}
+		if err := binary.Read(c.conn, binary.BigEndian, &rect); err != nil {
+			return nil, err
+		}
+		if rect.Encoding != encodingRaw {
+			return nil, fmt.Errorf("unrequested encoding %d", rect.Encoding)
+		}
+		x, y, w, h := int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height)
+		if x+w > c.Width || y+h > c.Height {
+			return nil, fmt.Errorf("rectangle %dx%d at %d,%d is outside the %dx%d desktop", w, h, x, y, c.Width, c.Height)
+		}
+		row := make([]byte, 4*w)
+		for j := 0; j < h; j++ {
+			if _, err := io.ReadFull(c.conn, row); err != nil {
+				return nil, err
+			}
+			for k := 0; k < w; k++ {
+				pixel := img.PixOffset(x+k, y+j)
+				img.Pix[pixel+0] = row[4*k+2]
+				img.Pix[pixel+1] = row[4*k+1]
+				img.Pix[pixel+2] = row[4*k+0]
+				img.Pix[pixel+3] = 0xff
+			}
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,169 @@
+package rfb
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/testharness"
+)
+
+func intPtr(n int) *int {
+	return &n
+}
+
+// waitForEvents waits for the desktop to have received n events.
+func waitForEvents(t *testing.T, desktop *testharness.FakeDesktop, n int) []testharness.DesktopEvent {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(desktop.Events()) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return desktop.Events()
+}
+
+func TestDial(t *testing.T) {
+	desktop, err := testharness.NewFakeDesktop("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desktop.Close()
+
+	c, err := Dial(context.Background(), desktop.Addr(), "secret")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if c.Width != desktop.Width || c.Height != desktop.Height || c.Name != "fake" {
+		t.Errorf("desktop = %dx%d %q", c.Width, c.Height, c.Name)
+	}
+	if shared := desktop.Shared(); len(shared) != 1 || !shared[0] {
+		t.Errorf("shared = %v, want the desktop shared", shared)
+	}
+
+	if _, err := Dial(context.Background(), desktop.Addr(), "wrong"); err == nil {
+		t.Errorf("Dial with a wrong password succeeded")
+	}
+}
+
+func TestCapture(t *testing.T) {
+	desktop, err := testharness.NewFakeDesktop("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desktop.Close()
+	desktop.Width, desktop.Height = 40, 30
+	screen := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	screen.Set(3, 4, color.RGBA{R: 0x12, G: 0x34, B: 0x56, A: 0xff})
+	screen.Set(39, 29, color.RGBA{R: 0xff, A: 0xff})
+	desktop.Screen = screen
+
+	c, err := Dial(context.Background(), desktop.Addr(), "")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	img, err := c.Capture(ctx)
+	if err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	if img.Bounds() != screen.Bounds() {
+		t.Fatalf("captured %v, want %v", img.Bounds(), screen.Bounds())
+	}
+	for _, p := range []image.Point{{0, 0}, {3, 4}, {39, 29}} {
+		want := screen.RGBAAt(p.X, p.Y)
+		want.A = 0xff
+		if got := img.RGBAAt(p.X, p.Y); got != want {
+			t.Errorf("pixel at %v = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestPlay(t *testing.T) {
+	desktop, err := testharness.NewFakeDesktop("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desktop.Close()
+	c, err := Dial(context.Background(), desktop.Addr(), "")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	req := InputRequest{Events: []InputEvent{
+		{Type: InputText, Text: "hi"},
+		{Type: InputKey, Key: "ctrl+s"},
+		{Type: InputClick, X: intPtr(10), Y: intPtr(20), Button: "right"},
+		{Type: InputScroll, DeltaY: -1},
+		// Left held down, released at the end.
+		{Type: InputMouseDown, X: intPtr(30)},
+	}}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	n, err := c.Play(context.Background(), req)
+	if err != nil || n != len(req.Events) {
+		t.Fatalf("Play = %d, %v", n, err)
+	}
+
+	want := []testharness.DesktopEvent{
+		{Key: 'h', Down: true}, {Key: 'h'}, {Key: 'i', Down: true}, {Key: 'i'},
+		{Key: 0xffe3, Down: true}, {Key: 's', Down: true}, {Key: 's'}, {Key: 0xffe3},
+		{X: 10, Y: 20}, {Buttons: 4, X: 10, Y: 20}, {X: 10, Y: 20},
+		{Buttons: 8, X: 10, Y: 20}, {X: 10, Y: 20},
+		{X: 30, Y: 20}, {Buttons: 1, X: 30, Y: 20},
+		{X: 30, Y: 20},
+	}
+	if got := waitForEvents(t, desktop, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("events =\n%v\nwant\n%v", got, want)
+	}
+
+	outside := InputRequest{Events: []InputEvent{{Type: InputMove, X: intPtr(desktop.Width), Y: intPtr(0)}}}
+	if _, err := c.Play(context.Background(), outside); err == nil {
+		t.Errorf("moving outside the desktop succeeded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, req := range []InputRequest{
+		{},
+		{Events: []InputEvent{{Type: "jump"}}},
+		{Events: []InputEvent{{Type: InputKey, Key: "hyper"}}},
+		{Events: []InputEvent{{Type: InputKeyDown, Key: "ctrl+c"}}},
+		{Events: []InputEvent{{Type: InputMove, X: intPtr(1)}}},
+		{Events: []InputEvent{{Type: InputClick, Button: "fourth"}}},
+		{Events: []InputEvent{{Type: InputWait, DurationMs: int(2 * MaxInputDuration / time.Millisecond)}}},
+		{Events: []InputEvent{{Type: InputClick, X: intPtr(-1)}}},
+	} {
+		if err := req.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", req)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	for combo, want := range map[string][]uint32{
+		"Return":       {0xff0d},
+		"ctrl+shift+t": {0xffe3, 0xffe1, 't'},
+		"ctrl++":       {0xffe3, '+'},
+		"+":            {'+'},
+		"F5":           {0xffc2},
+		"é":            {0xe9},
+		"€":            {0x010020ac},
+	} {
+		if got, err := ParseKeys(combo); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseKeys(%q) = %x, %v, want %x", combo, got, err, want)
+		}
+	}
+	for _, combo := range []string{"", "ctrl+", "F25", "hyper"} {
+		if _, err := ParseKeys(combo); err == nil {
+			t.Errorf("ParseKeys(%q) succeeded", combo)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Package secheaders sets the security headers of the web UIs the services
+// serve, e.g. the noVNC client and the terminal, and controls which sites may
+// embed them in an iframe.
+package secheaders
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Set sets the security headers of a page on h. csp is the page's
+// Content-Security-Policy, without frame-ancestors: only the page's own
+// origin and embedAllowedOrigins may frame it.
+func Set(h http.Header, csp string, embedAllowedOrigins []string) {
+	ancestors := append([]string{"'self'"}, embedAllowedOrigins...)
+	h.Set("Content-Security-Policy", strings.TrimSuffix(strings.TrimSpace(csp), ";")+"; frame-ancestors "+strings.Join(ancestors, " "))
+	// X-Frame-Options can't list origins, it is left to frame-ancestors when
+	// other sites may embed the page.
+	if len(embedAllowedOrigins) == 0 {
+		h.Set("X-Frame-Options", "SAMEORIGIN")
+	}
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("Permissions-Policy", "camera=(), microphone=(), geolocation=()")
+}
+
+// Nonce returns a random nonce allowing a page's inline scripts with
+// 'nonce-<nonce>' in its policy.
+func Nonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to generate nonce: %v", err))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// ValidateOrigins checks origins allowed to embed pages: http(s) origins
+// without a path, whose host may start with a "*." wildcard, e.g.
+// "https://*.example.com".
+func ValidateOrigins(origins []string) error {
+	for _, origin := range origins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" ||
+			(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil ||
+			strings.ContainsAny(origin, " ;,'\"") || strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+			return fmt.Errorf("invalid embed origin %q, expected e.g. https://app.example.com", origin)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package secheaders
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	h := http.Header{}
+	Set(h, "default-src 'self';", nil)
+	if got := h.Get("Content-Security-Policy"); got != "default-src 'self'; frame-ancestors 'self'" {
+		t.Errorf("Content-Security-Policy = %q", got)
+	}
+	if h.Get("X-Frame-Options") != "SAMEORIGIN" || h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("headers = %v", h)
+	}
+
+	h = http.Header{}
+	Set(h, "default-src 'self'", []string{"https://app.example.com", "https://*.example.org"})
+	if got := h.Get("Content-Security-Policy"); got != "default-src 'self'; frame-ancestors 'self' https://app.example.com https://*.example.org" {
+		t.Errorf("Content-Security-Policy = %q", got)
+	}
+	if h.Get("X-Frame-Options") != "" {
+		t.Errorf("X-Frame-Options = %q with embedding allowed, want none", h.Get("X-Frame-Options"))
+	}
+}
+
+func TestValidateOrigins(t *testing.T) {
+	if err := ValidateOrigins([]string{"https://app.example.com", "http://localhost:3000", "https://*.example.org"}); err != nil {
+		t.Errorf("ValidateOrigins() = %v", err)
+	}
+	for _, origin := range []string{"*", "app.example.com", "https://example.com/path", "https://a.com; script-src *", "javascript:alert(1)", "https://a.*.com"} {
+		if err := ValidateOrigins([]string{origin}); err == nil {
+			t.Errorf("ValidateOrigins(%q) succeeded", origin)
+		}
+	}
+}
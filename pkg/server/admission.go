@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/server/admission"
+)
+
+const (
+	// Statuses reported for VMs that went through the queue but don't exist
+	// yet.
+	queueStatusQueued   = "queued"
+	queueStatusStarting = "starting"
+	// Bounds each POST to a queued VM's callback URL.
+	queueCallbackTimeout = 30 * time.Second
+)
+
+// newAdmissionController sizes an admission controller from the host's CPUs
+// and memory and the configured overcommit ratios.
+func newAdmissionController(cfg config.AdmissionConfig) (*admission.Controller, error) {
+	memoryKB, err := hostMemoryKB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host memory: %w", err)
+	}
+	host := admission.Resources{
+		VCPUs:    int64(runtime.NumCPU()),
+		MemoryMB: memoryKB / 1024,
+	}
+	capacity := admission.Capacity(host, cfg.CPUOvercommit, cfg.MemoryOvercommit)
+	log.WithFields(log.Fields{
+		"host":     host.String(),
+		"capacity": capacity.String(),
+	}).Info("VM admission enabled")
+	return admission.NewController(capacity)
+}
+
+// admissionRequest describes what a new VM reserves, which matches how
+// createVM sizes it. It is charged to the VM's owner.
+func (s *Server) admissionRequest(req *serverapi.StartVMRequest) (admission.Request, error) {
+	memoryMB, err := calculateGuestMemorySizeInMB(s.config.GuestMemPercentage)
+	if err != nil {
+		return admission.Request{}, fmt.Errorf("failed to calculate guest memory size: %w", err)
+	}
+	return admission.Request{
+		Name:     req.GetVmName(),
+		Tenant:   req.GetOwner(),
+		Priority: int(req.GetPriority()),
+		Resources: admission.Resources{
+			VCPUs:    int64(calculateVCPUCount()),
+			MemoryMB: int64(memoryMB),
+		},
+	}, nil
+}
+
+// admitVM reserves resources for a new VM or fails with ResourceExhausted.
+func (s *Server) admitVM(req *serverapi.StartVMRequest) error {
+	admissionReq, err := s.admissionRequest(req)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := s.admission.Admit(admissionReq); err != nil {
+		if errors.Is(err, admission.ErrInsufficientCapacity) {
+			s.noteQuotaExceeded(admissionReq.Name, admissionReq.Tenant, err)
+			return status.Errorf(codes.ResourceExhausted, "can't admit vm %s: %v", admissionReq.Name, err)
+		}
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	return nil
+}
+
+// startAdmittedVM starts a VM whose resources are reserved, releasing them if
+// the VM doesn't come up.
+func (s *Server) startAdmittedVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
+	vmName := req.GetVmName()
+	resp, err := s.launchVM(ctx, req)
+	if err != nil && s.getVMAtomic(vmName) == nil {
+		s.admission.Release(vmName)
+	}
+	return resp, err
+}
+
+// QueueVM starts a VM once the admission controller has capacity for it
+// instead of rejecting it. Queued VMs are started by priority and, within a
+// priority, fairly across owners. It returns right away with the VM's
+// position in the queue; if the request has a callback URL, the outcome of starting the
+// VM is POSTed to it as a VmQueueEvent.
+func (s *Server) QueueVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
+	vmName := req.GetVmName()
+	if vmName == "" {
+		return nil, status.Error(codes.InvalidArgument, "vmName is required")
+	}
+	if s.getVMAtomic(vmName) != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "vm %s already exists", vmName)
+	}
+	if err := s.CheckCordon(vmName); err != nil {
+		return nil, err
+	}
+	if _, err := s.objectMounts(req.GetObjectMounts()); err != nil {
+		return nil, err
+	}
+	if err := s.checkArch(req.GetArch()); err != nil {
+		return nil, err
+	}
+	if _, err := s.pickHypervisor(req.GetHypervisor()); err != nil {
+		return nil, err
+	}
+	if err := s.applyTenantPolicy(req); err != nil {
+		return nil, err
+	}
+	logger := log.WithField("vmName", vmName)
+
+	// Without an admission policy nothing ever waits.
+	ready := make(chan struct{})
+	close(ready)
+	var admitted <-chan struct{} = ready
+	if s.admission != nil {
+		admissionReq, err := s.admissionRequest(req)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		ticket, err := s.admission.Enqueue(admissionReq)
+		if err != nil {
+			if errors.Is(err, admission.ErrInsufficientCapacity) {
+				s.noteQuotaExceeded(vmName, admissionReq.Tenant, err)
+				return nil, status.Errorf(codes.ResourceExhausted, "can't queue vm %s: %v", vmName, err)
+			}
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+		admitted = ticket.Admitted()
+	}
+
+	// Position 0 means the VM was admitted right away and is starting.
+	position, _ := s.queuePosition(vmName)
+	queueStatus := queueStatusQueued
+	if position == 0 {
+		queueStatus = queueStatusStarting
+	}
+	logger.WithField("position", position).Infof("VM queued")
+
+	go func() {
+		<-admitted
+		logger.Infof("VM admitted from queue")
+
+		var resp *serverapi.StartVMResponse
+		var err error
+		if s.admission != nil {
+			resp, err = s.startAdmittedVM(context.Background(), req)
+		} else {
+			resp, err = s.launchVM(context.Background(), req)
+		}
+		if err != nil {
+			logger.WithError(err).Error("Failed to start queued VM")
+		}
+		if callbackURL := req.GetCallbackUrl(); callbackURL != "" {
+			notifyQueueCallback(callbackURL, vmName, resp, err)
+		}
+	}()
+
+	return &serverapi.StartVMResponse{
+		VmName:        serverapi.PtrString(vmName),
+		Status:        serverapi.PtrString(queueStatus),
+		QueuePosition: serverapi.PtrInt32(int32(position)),
+	}, nil
+}
+
+// queuePosition returns the 1-based position of a VM waiting for admission.
+func (s *Server) queuePosition(vmName string) (int, bool) {
+	if s.admission == nil {
+		return 0, false
+	}
+	return s.admission.Position(vmName)
+}
+
+// cancelQueuedVM removes a VM that is still waiting for admission from the
+// queue.
+func (s *Server) cancelQueuedVM(vmName string) bool {
+	if s.admission == nil {
+		return false
+	}
+	for _, ticket := range s.admission.Queued() {
+		if ticket.Name == vmName {
+			return s.admission.Cancel(ticket)
+		}
+	}
+	return false
+}
+
+// notifyQueueCallback POSTs the outcome of starting a queued VM to url.
+func notifyQueueCallback(url string, vmName string, resp *serverapi.StartVMResponse, startErr error) {
+	logger := log.WithFields(log.Fields{
+		"vmName":      vmName,
+		"callbackUrl": url,
+	})
+
+	event := serverapi.VmQueueEvent{
+		VmName: serverapi.PtrString(vmName),
+		Status: serverapi.PtrString("started"),
+		Vm:     resp,
+	}
+	if startErr != nil {
+		event.Status = serverapi.PtrString("failed")
+		event.Error = serverapi.PtrString(startErr.Error())
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal queue callback")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queueCallbackTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		logger.WithError(err).Error("Invalid queue callback URL")
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		logger.WithError(err).Warn("Queue callback failed")
+		return
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode >= http.StatusBadRequest {
+		logger.WithField("status", httpResp.StatusCode).Warn("Queue callback rejected")
+	}
+}
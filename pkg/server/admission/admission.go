@@ -0,0 +1,341 @@
+package admission
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrInsufficientCapacity is returned when admitting a VM would take the
+// reserved resources past the host's capacity.
+var ErrInsufficientCapacity = errors.New("insufficient capacity")
+
+// Resources are the vCPUs and memory reserved for a VM.
+type Resources struct {
+	VCPUs    int64
+	MemoryMB int64
+}
+
+func (r Resources) String() string {
+	return fmt.Sprintf("%d vCPUs, %d MB", r.VCPUs, r.MemoryMB)
+}
+
+func (r Resources) add(o Resources) Resources {
+	return Resources{VCPUs: r.VCPUs + o.VCPUs, MemoryMB: r.MemoryMB + o.MemoryMB}
+}
+
+func (r Resources) sub(o Resources) Resources {
+	return Resources{VCPUs: r.VCPUs - o.VCPUs, MemoryMB: r.MemoryMB - o.MemoryMB}
+}
+
+// Capacity returns the resources that may be reserved on a host with the
+// given resources when each is overcommitted by its ratio, e.g. a CPU ratio
+// of 4 allows reserving 4 vCPUs per host CPU. A ratio of 0 leaves that
+// resource unlimited.
+func Capacity(host Resources, cpuRatio float64, memoryRatio float64) Resources {
+	return Resources{
+		VCPUs:    int64(float64(host.VCPUs) * cpuRatio),
+		MemoryMB: int64(float64(host.MemoryMB) * memoryRatio),
+	}
+}
+
+// Request asks for resources for a VM. Queued requests are admitted highest
+// Priority first. Among equal priorities the Tenant holding the fewest
+// reservations goes first, so one tenant's burst of creations can't hold up
+// everyone else's.
+type Request struct {
+	Name      string
+	Tenant    string
+	Priority  int
+	Resources Resources
+}
+
+// Ticket is a VM waiting in the queue for its resources.
+type Ticket struct {
+	Request
+	// Enqueued is when the ticket joined the queue.
+	Enqueued time.Time
+	admitted chan struct{}
+}
+
+// Admitted is closed once the ticket's resources have been reserved.
+func (t *Ticket) Admitted() <-chan struct{} {
+	return t.admitted
+}
+
+// Controller reserves resources for VMs against a fixed capacity. VMs that
+// don't fit can wait in a queue and are admitted as reservations are
+// released.
+type Controller struct {
+	capacity Resources
+	reserved map[string]Request
+	used     Resources
+	// queue holds the waiting tickets in arrival order.
+	queue []*Ticket
+	mutex sync.Mutex
+}
+
+// NewController creates a controller for the given capacity, where a zero
+// field means that resource is unlimited.
+func NewController(capacity Resources) (*Controller, error) {
+	if capacity.VCPUs < 0 || capacity.MemoryMB < 0 {
+		return nil, fmt.Errorf("invalid capacity: %v", capacity)
+	}
+	return &Controller{
+		capacity: capacity,
+		reserved: make(map[string]Request),
+	}, nil
+}
+
+// Capacity returns the resources that can be reserved.
+func (c *Controller) Capacity() Resources {
+	return c.capacity
+}
+
+// Used returns the resources currently reserved.
+func (c *Controller) Used() Resources {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.used
+}
+
+// fits reports whether r can be reserved now. The caller must hold the mutex.
+func (c *Controller) fits(r Resources) bool {
+	projected := c.used.add(r)
+	if c.capacity.VCPUs > 0 && projected.VCPUs > c.capacity.VCPUs {
+		return false
+	}
+	if c.capacity.MemoryMB > 0 && projected.MemoryMB > c.capacity.MemoryMB {
+		return false
+	}
+	return true
+}
+
+// exceedsCapacity reports whether r could never be reserved, even on an
+// otherwise idle host.
+func (c *Controller) exceedsCapacity(r Resources) bool {
+	return (c.capacity.VCPUs > 0 && r.VCPUs > c.capacity.VCPUs) ||
+		(c.capacity.MemoryMB > 0 && r.MemoryMB > c.capacity.MemoryMB)
+}
+
+// checkName rejects names that already hold or wait for a reservation. The
+// caller must hold the mutex.
+func (c *Controller) checkName(name string) error {
+	if _, exists := c.reserved[name]; exists {
+		return fmt.Errorf("resources already reserved for %s", name)
+	}
+	for _, t := range c.queue {
+		if t.Name == name {
+			return fmt.Errorf("%s is already queued", name)
+		}
+	}
+	return nil
+}
+
+// Admit reserves resources for req right away. Requests may not jump the
+// queue, so this fails with ErrInsufficientCapacity while a request of the
+// same or higher priority is waiting, even if req would fit.
+func (c *Controller) Admit(req Request) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.check(req); err != nil {
+		return err
+	}
+	c.reserve(req)
+	return nil
+}
+
+// Check reports whether Admit would admit req right now, without reserving
+// anything.
+func (c *Controller) Check(req Request) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.check(req)
+}
+
+// check must be called with the mutex held.
+func (c *Controller) check(req Request) error {
+	if err := c.checkName(req.Name); err != nil {
+		return err
+	}
+	ahead := 0
+	for _, t := range c.queue {
+		if t.Priority >= req.Priority {
+			ahead++
+		}
+	}
+	if ahead > 0 || !c.fits(req.Resources) {
+		return fmt.Errorf(
+			"%w: need %v, %v of %v reserved, %d queued ahead",
+			ErrInsufficientCapacity, req.Resources, c.used, c.capacity, ahead,
+		)
+	}
+	return nil
+}
+
+// Enqueue adds req to the queue. The returned ticket is admitted immediately
+// if it is next in line and fits.
+func (c *Controller) Enqueue(req Request) (*Ticket, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.checkName(req.Name); err != nil {
+		return nil, err
+	}
+	if c.exceedsCapacity(req.Resources) {
+		return nil, fmt.Errorf("%w: need %v, capacity is %v", ErrInsufficientCapacity, req.Resources, c.capacity)
+	}
+	t := &Ticket{
+		Request:  req,
+		Enqueued: time.Now(),
+		admitted: make(chan struct{}),
+	}
+	c.queue = append(c.queue, t)
+	c.schedule()
+	return t, nil
+}
+
+// Position returns the 1-based position of name in the queue, assuming no
+// reservations are released before it is admitted.
+func (c *Controller) Position(name string) (int, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, t := range c.order() {
+		if t.Name == name {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// Queued returns the tickets waiting in the queue in the order they would be
+// admitted.
+func (c *Controller) Queued() []*Ticket {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order()
+}
+
+// Cancel removes a ticket from the queue. It returns false if the ticket was
+// already admitted, in which case the caller must Release its reservation.
+func (c *Controller) Cancel(t *Ticket) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, queued := range c.queue {
+		if queued == t {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			// Whatever was blocked behind the ticket may fit now.
+			c.schedule()
+			return true
+		}
+	}
+	return false
+}
+
+// Release frees the reservation held by name and admits queued VMs that fit.
+func (c *Controller) Release(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	req, exists := c.reserved[name]
+	if !exists {
+		return
+	}
+	delete(c.reserved, name)
+	c.used = c.used.sub(req.Resources)
+	c.schedule()
+}
+
+// Rename moves the reservation held by oldName to newName.
+func (c *Controller) Rename(oldName string, newName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if req, exists := c.reserved[oldName]; exists {
+		delete(c.reserved, oldName)
+		req.Name = newName
+		c.reserved[newName] = req
+	}
+}
+
+// Transfer charges the reservation held by name to tenant from now on.
+func (c *Controller) Transfer(name string, tenant string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if req, exists := c.reserved[name]; exists {
+		req.Tenant = tenant
+		c.reserved[name] = req
+	}
+}
+
+// reserve records a reservation. The caller must hold the mutex.
+func (c *Controller) reserve(req Request) {
+	c.reserved[req.Name] = req
+	c.used = c.used.add(req.Resources)
+}
+
+// tenantCounts returns the number of reservations each tenant holds. The
+// caller must hold the mutex.
+func (c *Controller) tenantCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, req := range c.reserved {
+		counts[req.Tenant]++
+	}
+	return counts
+}
+
+// next returns the index in queue of the ticket to admit next given the
+// reservations each tenant holds: the highest priority, then the tenant with
+// the fewest reservations, then the earliest arrival.
+func next(queue []*Ticket, counts map[string]int) int {
+	best := 0
+	for i, t := range queue[1:] {
+		b := queue[best]
+		switch {
+		case t.Priority != b.Priority:
+			if t.Priority > b.Priority {
+				best = i + 1
+			}
+		case counts[t.Tenant] < counts[b.Tenant]:
+			best = i + 1
+		}
+	}
+	return best
+}
+
+// order returns the queue in the order it would be admitted if every ticket
+// fit. The caller must hold the mutex.
+func (c *Controller) order() []*Ticket {
+	counts := c.tenantCounts()
+	remaining := append([]*Ticket{}, c.queue...)
+	ordered := make([]*Ticket, 0, len(remaining))
+	for len(remaining) > 0 {
+		i := next(remaining, counts)
+		t := remaining[i]
+		ordered = append(ordered, t)
+		counts[t.Tenant]++
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return ordered
+}
+
+// schedule admits the next ticket for as long as it fits. Tickets further back
+// are not admitted around one that doesn't fit, so large VMs can't starve.
+// The caller must hold the mutex.
+func (c *Controller) schedule() {
+	for len(c.queue) > 0 {
+		i := next(c.queue, c.tenantCounts())
+		t := c.queue[i]
+		if !c.fits(t.Resources) {
+			return
+		}
+		c.queue = append(c.queue[:i], c.queue[i+1:]...)
+		c.reserve(t.Request)
+		close(t.admitted)
+	}
+}
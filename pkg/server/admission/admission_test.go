@@ -0,0 +1,224 @@
+package admission
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var small = Resources{VCPUs: 2, MemoryMB: 1024}
+
+func req(name string, r Resources) Request {
+	return Request{Name: name, Resources: r}
+}
+
+func admitted(t *Ticket) bool {
+	select {
+	case <-t.Admitted():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	got := Capacity(Resources{VCPUs: 8, MemoryMB: 16384}, 4, 1.5)
+	if want := (Resources{VCPUs: 32, MemoryMB: 24576}); got != want {
+		t.Errorf("Capacity = %v, want %v", got, want)
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	c, err := NewController(Resources{VCPUs: 4, MemoryMB: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		if err := c.Admit(req(name, small)); err != nil {
+			t.Fatalf("Admit(%s) failed: %v", name, err)
+		}
+	}
+	if err := c.Admit(req("c", small)); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("Admit past the CPU capacity returned %v", err)
+	}
+	if err := c.Admit(req("a", Resources{})); err == nil {
+		t.Error("Admitted a name that already holds a reservation")
+	}
+
+	c.Release("a")
+	if err := c.Admit(req("c", small)); err != nil {
+		t.Errorf("Admit after a release failed: %v", err)
+	}
+	if got := c.Used(); got != (Resources{VCPUs: 4, MemoryMB: 2048}) {
+		t.Errorf("Used = %v", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c, err := NewController(Resources{VCPUs: 2, MemoryMB: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check(req("a", small)); err != nil {
+		t.Fatalf("Check(a) = %v, want nil", err)
+	}
+	// Checking reserves nothing.
+	if used := c.Used(); used != (Resources{}) {
+		t.Errorf("Used() = %v after Check, want nothing", used)
+	}
+	if err := c.Admit(req("a", small)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check(req("b", small)); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("Check(b) = %v, want %v", err, ErrInsufficientCapacity)
+	}
+	if err := c.Check(req("a", Resources{})); err == nil {
+		t.Error("Check(a) succeeded for a name that is already reserved")
+	}
+}
+
+func TestUnlimitedResource(t *testing.T) {
+	c, err := NewController(Resources{MemoryMB: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Admit(req("a", Resources{VCPUs: 1000, MemoryMB: 2048})); err != nil {
+		t.Errorf("Admit with unlimited vCPUs failed: %v", err)
+	}
+	if err := c.Admit(req("b", Resources{MemoryMB: 1})); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("Admit past the memory capacity returned %v", err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	c, err := NewController(Resources{VCPUs: 4, MemoryMB: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := c.Enqueue(req("a", Resources{VCPUs: 4, MemoryMB: 1024}))
+	if err != nil || !admitted(first) {
+		t.Fatalf("Enqueue on an idle host = %v, %v, want admitted", first, err)
+	}
+	second, err := c.Enqueue(req("b", small))
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := c.Enqueue(req("c", small))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admitted(second) || admitted(third) {
+		t.Fatal("Queued VMs admitted past capacity")
+	}
+	if pos, ok := c.Position("c"); !ok || pos != 2 {
+		t.Errorf("Position(c) = %d, %v, want 2", pos, ok)
+	}
+	if err := c.Admit(req("d", Resources{})); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("Admit jumped the queue: %v", err)
+	}
+	if _, err := c.Enqueue(req("e", Resources{VCPUs: 5})); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("Enqueued a VM that can never fit: %v", err)
+	}
+
+	c.Release("a")
+	if !admitted(second) || !admitted(third) {
+		t.Error("Queued VMs not admitted after a release")
+	}
+	if _, ok := c.Position("b"); ok {
+		t.Error("Admitted VM still queued")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	c, err := NewController(Resources{VCPUs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Admit(req("a", Resources{VCPUs: 3})); err != nil {
+		t.Fatal(err)
+	}
+	blocked, _ := c.Enqueue(req("b", Resources{VCPUs: 2}))
+	behind, _ := c.Enqueue(req("c", Resources{VCPUs: 1}))
+	if admitted(behind) {
+		t.Fatal("VM admitted ahead of the queue")
+	}
+
+	if !c.Cancel(blocked) {
+		t.Fatal("Cancel of a queued ticket failed")
+	}
+	if !admitted(behind) {
+		t.Error("VM behind a cancelled ticket not admitted")
+	}
+	if c.Cancel(behind) {
+		t.Error("Cancel of an admitted ticket succeeded")
+	}
+
+	c.Rename("c", "d")
+	c.Release("d")
+	if got := c.Used(); got != (Resources{VCPUs: 3}) {
+		t.Errorf("Used after releasing a renamed reservation = %v", got)
+	}
+}
+
+func TestPriorityAndFairness(t *testing.T) {
+	c, err := NewController(Resources{VCPUs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := Resources{VCPUs: 1}
+	holders := []string{"b0", "b1"}
+	for _, name := range holders {
+		if err := c.Admit(Request{Name: name, Tenant: "batch", Resources: one}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queued := []Request{
+		{Name: "batch-1", Tenant: "batch", Resources: one},
+		{Name: "batch-2", Tenant: "batch", Resources: one},
+		{Name: "other-1", Tenant: "other", Resources: one},
+		{Name: "urgent", Tenant: "batch", Priority: 10, Resources: one},
+	}
+	for _, r := range queued {
+		if _, err := c.Enqueue(r); err != nil {
+			t.Fatalf("Enqueue(%s) failed: %v", r.Name, err)
+		}
+	}
+
+	// Highest priority first, then the tenant holding fewer reservations,
+	// then arrival order.
+	want := "urgent other-1 batch-1 batch-2"
+	var order []string
+	for _, ticket := range c.Queued() {
+		order = append(order, ticket.Name)
+	}
+	if got := strings.Join(order, " "); got != want {
+		t.Errorf("Queue order = %q, want %q", got, want)
+	}
+	if pos, _ := c.Position("other-1"); pos != 2 {
+		t.Errorf("Position(other-1) = %d, want 2", pos)
+	}
+
+	if err := c.Admit(Request{Name: "interactive", Priority: 20}); err != nil {
+		t.Errorf("Higher priority Admit blocked by the queue: %v", err)
+	}
+	if err := c.Admit(Request{Name: "late", Priority: 10}); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("Admit jumped a request of equal priority: %v", err)
+	}
+
+	var admittedOrder []string
+	for len(c.Queued()) > 0 {
+		next := c.Queued()[0]
+		c.Release(holders[0])
+		holders = append(holders[1:], next.Name)
+		if !admitted(next) {
+			t.Fatalf("%s not admitted after a release", next.Name)
+		}
+		admittedOrder = append(admittedOrder, next.Name)
+	}
+	if got := strings.Join(admittedOrder, " "); got != want {
+		t.Errorf("Admitted %q, want %q", got, want)
+	}
+}
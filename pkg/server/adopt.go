@@ -0,0 +1,315 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gvisor.dev/gvisor/pkg/cleanup"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/adoption"
+	"github.com/abshkbh/arrakis/pkg/server/hypervisor"
+	"github.com/abshkbh/arrakis/pkg/server/store"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+	"github.com/abshkbh/arrakis/pkg/server/workdir"
+)
+
+// adoptAgentTimeout is how long adopting a running VM waits for its guest
+// agent, which VMs created outside of arrakis may not run.
+const adoptAgentTimeout = 5 * time.Second
+
+// chvVMStatus maps the state cloud-hypervisor reports for its VM to the
+// status of a VM.
+func chvVMStatus(state string) (vmStatus, bool) {
+	switch state {
+	case "Created":
+		return vmStatusCreated, true
+	case "Running":
+		return vmStatusRunning, true
+	case "Paused":
+		return vmStatusPaused, true
+	case "Shutdown":
+		return vmStatusStopped, true
+	}
+	return 0, false
+}
+
+// AdoptVM registers a VM running in a cloud-hypervisor process started
+// outside of arrakis, found by its API socket or its PID, as a managed VM,
+// so that it doesn't have to be recreated. Its disks and network are
+// discovered from the VM's config: the first writable disk becomes its
+// stateful disk, and its first NIC, which must be a tap<id> device with the
+// guest IP in the bridge subnet, is moved to the bridge. What can't be
+// carried over is listed in the response's warnings.
+func (s *Server) AdoptVM(ctx context.Context, req *serverapi.AdoptVMRequest) (*serverapi.AdoptVMResponse, error) {
+	return s.adoptVM(ctx, req, nil)
+}
+
+// adoptVM adopts the VM of req. With a restored record, the VM is one this
+// server managed before it restarted: it keeps its ID, owner, creation time
+// and state dir.
+func (s *Server) adoptVM(ctx context.Context, req *serverapi.AdoptVMRequest, restored *store.VM) (*serverapi.AdoptVMResponse, error) {
+	vmName := req.GetVmName()
+	if vmName == "" {
+		return nil, status.Error(codes.InvalidArgument, "vmName is required")
+	}
+	if err := validateVMName(vmName); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if s.getVMAtomic(vmName) != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "vm %s already exists", vmName)
+	}
+	logger := log.WithField("vmName", vmName)
+
+	socketPath := req.GetApiSocket()
+	pid := int(req.GetPid())
+	if socketPath == "" && pid == 0 {
+		return nil, status.Error(codes.InvalidArgument, "one of apiSocket or pid is required")
+	}
+	if socketPath == "" {
+		args, err := adoption.ProcessArgs(pid)
+		if err != nil {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		socketPath = adoption.SocketFromArgs(args)
+		if socketPath == "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "process %d doesn't serve the cloud-hypervisor API on a socket path", pid)
+		}
+	}
+	socketPID, err := adoption.SocketPID(socketPath)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to reach the API socket: %v", err)
+	}
+	if pid != 0 && pid != socketPID {
+		return nil, status.Errorf(codes.InvalidArgument, "api socket %s is served by process %d, not %d", socketPath, socketPID, pid)
+	}
+	pid = socketPID
+	if s.vmBySocket(socketPath) != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "the VM of %s is already managed", socketPath)
+	}
+
+	var warnings []string
+	args, err := adoption.ProcessArgs(pid)
+	if err != nil {
+		warnings = append(warnings, err.Error())
+	}
+
+	h, err := s.pickHypervisor(hypervisor.CloudHypervisor)
+	if err != nil {
+		return nil, err
+	}
+	vmm := connectVMM(h, socketPath)
+	if err := waitForServer(ctx, vmm, 5*time.Second); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s doesn't serve the cloud-hypervisor API: %v", socketPath, err)
+	}
+	info, _, err := vmm.(*chvVMM).client.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to get the VM of %s, was it created? %v", socketPath, err)
+	}
+	vmStatus, ok := chvVMStatus(info.GetState())
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm is %s", info.GetState())
+	}
+	vmConfig := info.GetConfig()
+	payload := vmConfig.GetPayload()
+
+	nets := vmConfig.GetNet()
+	if len(nets) == 0 || nets[0].GetTap() == "" {
+		return nil, status.Error(codes.FailedPrecondition, "vm has no tap device to reach it through")
+	}
+	for _, extra := range nets[1:] {
+		warnings = append(warnings, fmt.Sprintf("NIC %s isn't managed", extra.GetTap()))
+	}
+	var guestIP *net.IPNet
+	if ip := req.GetIp(); ip != "" {
+		addr, subnet, err := net.ParseCIDR(ip)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid ip %q, expected CIDR notation: %v", ip, err)
+		}
+		subnet.IP = addr
+		guestIP = subnet
+	} else {
+		guestIP, err = extractGuestIPFromCmdline(payload.GetCmdline())
+		if err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "failed to find the guest IP, pass ip: %v", err)
+		}
+	}
+
+	var rootfsPath, statefulDiskPath string
+	for _, disk := range vmConfig.GetDisks() {
+		switch {
+		case disk.GetReadonly() && rootfsPath == "":
+			rootfsPath = disk.GetPath()
+		case !disk.GetReadonly() && statefulDiskPath == "":
+			statefulDiskPath = disk.GetPath()
+		default:
+			warnings = append(warnings, fmt.Sprintf("disk %s isn't managed", disk.GetPath()))
+		}
+	}
+	if statefulDiskPath == "" {
+		warnings = append(warnings, "vm has no writable disk and can't be snapshotted")
+	}
+
+	cleanup := cleanup.Make(func() {
+		logger.Info("adopt VM clean up done")
+	})
+	defer cleanup.Clean()
+
+	layout := workdir.New(s.config.StateDir, vmName)
+	vmStateDir := layout.Root
+	if restored == nil {
+		if _, err := os.Stat(vmStateDir); !os.IsNotExist(err) {
+			return nil, status.Errorf(codes.AlreadyExists, "state dir %s already exists", vmStateDir)
+		}
+		if err := layout.Create(); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create vm state dir: %v", err)
+		}
+		cleanup.Add(func() {
+			if err := os.RemoveAll(vmStateDir); err != nil {
+				logger.WithError(err).Errorf("failed to remove vm state dir: %s", vmStateDir)
+			}
+		})
+	}
+
+	if err := s.ipAllocator.ClaimIP(guestIP.IP); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to claim guest IP %s: %v", guestIP, err)
+	}
+	cleanup.Add(func() {
+		s.ipAllocator.FreeIP(guestIP.IP)
+	})
+
+	var cid uint32
+	var vsockPath string
+	if vsock, ok := vmConfig.GetVsockOk(); ok {
+		cid = uint32(vsock.GetCid())
+		vsockPath = vsock.GetSocket()
+		if err := s.cidAllocator.ClaimCID(cid); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "failed to claim vsock CID: %v", err)
+		}
+		cleanup.Add(func() {
+			if err := s.cidAllocator.FreeCID(cid); err != nil {
+				logger.WithError(err).Errorf("failed to free CID: %d", cid)
+			}
+		})
+	} else {
+		warnings = append(warnings, "vm has no vsock device")
+	}
+
+	if restored != nil {
+		// Forward from newly allocated host ports, the server lost track of
+		// the ones it forwarded from before.
+		if err := s.network.RemovePortForwards(guestIP.IP.String()); err != nil {
+			logger.WithError(err).Warn("Failed to remove the port forwards of the restored VM")
+		}
+	}
+	portForwards, err := s.setupPortForwardsToVM(guestIP.IP.String(), s.config.PortForwards)
+	if err != nil {
+		s.network.RemovePortForwards(guestIP.IP.String())
+		return nil, status.Errorf(codes.Internal, "failed to forward ports to VM: %v", err)
+	}
+	cleanup.Add(func() {
+		s.network.RemovePortForwards(guestIP.IP.String())
+	})
+
+	// Last, as the device can't be handed back once it is on the bridge.
+	tapDevice, err := s.fountain.AdoptTapDevice(nets[0].GetTap())
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to adopt tap device: %v", err)
+	}
+
+	process, _ := os.FindProcess(pid)
+	vm := &vm{
+		id:               newVMID(),
+		name:             vmName,
+		owner:            req.GetOwner(),
+		stateDirPath:     vmStateDir,
+		apiSocketPath:    socketPath,
+		hypervisor:       h,
+		vmm:              vmm,
+		process:          process,
+		ip:               guestIP,
+		tapDevice:        tapDevice,
+		status:           vmStatus,
+		portForwards:     portForwards,
+		vsockPath:        vsockPath,
+		cid:              cid,
+		statefulDiskPath: statefulDiskPath,
+		agent:            s.agent,
+		timeline:         openTimeline(vmStateDir),
+		audit:            s.audit,
+		createdAt:        time.Now(),
+		launch: launchSource{
+			adopted:   true,
+			kernel:    payload.GetKernel(),
+			rootfs:    rootfsPath,
+			initramfs: payload.GetInitramfs(),
+		},
+	}
+	if len(args) > 0 {
+		vm.launch.vmmBinary = args[0]
+		vm.launch.vmmArgs = args
+	}
+	action, summary := "adopted", "VM adopted"
+	if restored != nil {
+		vm.id = restored.ID
+		vm.createdAt = restored.Created
+		action, summary = "restored", "VM restored after the server restarted"
+	}
+	vm.attributePortForwards(vm.owner)
+
+	s.lock.Lock()
+	s.vms[vmName] = vm
+	s.vmIDs[vm.id] = vm
+	s.lock.Unlock()
+	cleanup.Release()
+	s.recordVM(ctx, vm)
+	vm.record(timeline.KindLifecycle, action, summary, map[string]string{"pid": strconv.Itoa(pid)})
+	logger.WithFields(log.Fields{
+		"vmId":      vm.id,
+		"pid":       pid,
+		"apiSocket": socketPath,
+		"restored":  restored != nil,
+	}).Info("Adopted VM")
+
+	if vmStatus == vmStatusRunning {
+		agentCtx, cancel := context.WithTimeout(ctx, adoptAgentTimeout)
+		err := waitForCmdServerReady(agentCtx, s.agent, guestIP.IP.String())
+		cancel()
+		if err != nil {
+			warnings = append(warnings, "guest agent isn't reachable, commands and files won't work")
+		}
+	}
+
+	return &serverapi.AdoptVMResponse{
+		VmName:        serverapi.PtrString(vmName),
+		VmId:          serverapi.PtrString(vm.id),
+		Status:        serverapi.PtrString(vmStatus.String()),
+		Ip:            serverapi.PtrString(guestIP.String()),
+		TapDeviceName: serverapi.PtrString(tapDevice.Name),
+		PortForwards:  convertPortForward(portForwards),
+		StatefulDisk:  serverapi.PtrString(statefulDiskPath),
+		Warnings:      warnings,
+	}, nil
+}
+
+// vmBySocket returns the VM whose VMM serves its API on socketPath, or nil.
+func (s *Server) vmBySocket(socketPath string) *vm {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, vm := range s.vms {
+		vm.lock.RLock()
+		match := vm.apiSocketPath == socketPath
+		vm.lock.RUnlock()
+		if match {
+			return vm
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Package adoption finds the process of a cloud-hypervisor VMM started
+// outside of arrakis, from its API socket or from its PID, so that the VM it
+// runs can be managed like any other.
+package adoption
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// apiSocketFlag is the cloud-hypervisor flag naming its API socket.
+const apiSocketFlag = "--api-socket"
+
+// SocketFromArgs returns the API socket on the command line of a
+// cloud-hypervisor process, or "" if it has none. The socket is given as
+// "--api-socket <path>", "--api-socket=<path>" or with the "path=<path>" and
+// "fd=<fd>" options, of which only paths can be reached.
+func SocketFromArgs(args []string) string {
+	for i, arg := range args {
+		var value string
+		switch {
+		case arg == apiSocketFlag && i+1 < len(args):
+			value = args[i+1]
+		case strings.HasPrefix(arg, apiSocketFlag+"="):
+			value = strings.TrimPrefix(arg, apiSocketFlag+"=")
+		default:
+			continue
+		}
+		if !strings.Contains(value, "=") {
+			return value
+		}
+		for _, option := range strings.Split(value, ",") {
+			if p, ok := strings.CutPrefix(option, "path="); ok {
+				return p
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// ProcessArgs returns the command line of the process pid.
+func ProcessArgs(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command line of process %d: %w", pid, err)
+	}
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("process %d has no command line", pid)
+	}
+	return strings.Split(string(data), "\x00"), nil
+}
+
+// SocketPID returns the PID of the process serving the unix socket at
+// socketPath, as the kernel reports it for a connection to it.
+func SocketPID(socketPath string) (int, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to %s: %w", socketPath, err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.UnixConn).SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, fmt.Errorf("failed to get the peer of %s: %w", socketPath, credErr)
+	}
+	return int(cred.Pid), nil
+}
+
+// Reap waits for the process, which isn't a child of the server and so can't
+// be waited for, to exit, and kills it after timeout.
+func Reap(process *os.Process, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !alive(process.Pid) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := process.Kill(); err != nil && alive(process.Pid) {
+		return fmt.Errorf("failed to kill VM process: %w", err)
+	}
+	return fmt.Errorf("VM process was force killed after timeout")
+}
+
+func alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,82 @@
+package adoption
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSocketFromArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"cloud-hypervisor", "--api-socket", "/run/vm.sock"}, "/run/vm.sock"},
+		{[]string{"cloud-hypervisor", "--api-socket=/run/vm.sock", "--kernel", "vmlinux"}, "/run/vm.sock"},
+		{[]string{"cloud-hypervisor", "--api-socket", "path=/run/vm.sock"}, "/run/vm.sock"},
+		{[]string{"cloud-hypervisor", "--api-socket", "fd=3"}, ""},
+		{[]string{"cloud-hypervisor", "--kernel", "vmlinux"}, ""},
+		{[]string{"cloud-hypervisor", "--api-socket"}, ""},
+	} {
+		if got := SocketFromArgs(tc.args); got != tc.want {
+			t.Errorf("SocketFromArgs(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestProcessArgs(t *testing.T) {
+	args, err := ProcessArgs(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) == 0 || args[0] != os.Args[0] {
+		t.Errorf("ProcessArgs() = %q, want %q", args, os.Args)
+	}
+}
+
+func TestSocketPID(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	pid, err := SocketPID(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("SocketPID() = %d, want %d", pid, os.Getpid())
+	}
+	if _, err := SocketPID(filepath.Join(t.TempDir(), "missing.sock")); err == nil {
+		t.Error("SocketPID() of a missing socket succeeded")
+	}
+}
+
+func TestReap(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skip("sleep not available:", err)
+	}
+	// Reap the child in the background like init would for an adopted VMM.
+	go cmd.Wait()
+	if err := Reap(cmd.Process, 200*time.Millisecond); err == nil {
+		t.Error("Reap() of a running process = nil, want it force killed")
+	}
+	if err := Reap(cmd.Process, time.Second); err != nil {
+		t.Errorf("Reap() of an exited process = %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/agentupdate"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+)
+
+const (
+	agentUpdateTimeout = 2 * time.Minute
+	// How often WaitVMReady polls the guest's service health.
+	vmReadyPollInterval = 500 * time.Millisecond
+)
+
+// dialVsock connects to a vsock port inside the guest through the unix socket
+// cloud-hypervisor exposes for the VM's vsock device.
+func dialVsock(ctx context.Context, vsockPath string, port uint32) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", vsockPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to vsock socket %s: %w", vsockPath, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+
+	// Read the reply a byte at a time so that nothing sent by the guest after
+	// it is consumed here.
+	var reply strings.Builder
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		reply.WriteByte(buf[0])
+	}
+	if !strings.HasPrefix(reply.String(), "OK") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected response to CONNECT %d: %s", port, reply.String())
+	}
+	return conn, nil
+}
+
+// UpdateAgent pushes a signed guest agent binary, version of agent, to a
+// running VM. The guest verifies the signature, swaps the binary in and
+// restarts the agent.
+func (s *Server) UpdateAgent(ctx context.Context, vmName string, agent string, version string, binary []byte, signature string) (*serverapi.VmAgentUpdateResponse, error) {
+	logger := log.WithFields(log.Fields{"vmName": vmName, "agent": agent})
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.RLock()
+	vmStatus := vm.status
+	vsockPath := vm.vsockPath
+	vm.lock.RUnlock()
+	if vmStatus != vmStatusRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is %s, not running", vmName, vmStatus)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, agentUpdateTimeout)
+	defer cancel()
+	conn, err := dialVsock(ctx, vsockPath, agentupdate.Port)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to reach agent updater: %v", err)
+	}
+	defer conn.Close()
+
+	logger.Infof("Pushing %d byte agent binary", len(binary))
+	result, err := agentupdate.Send(conn, agent, version, binary, signature)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	logger.WithField("version", result.Version).Info("Guest agent updated")
+
+	return &serverapi.VmAgentUpdateResponse{
+		Agent:   serverapi.PtrString(result.Agent),
+		Version: serverapi.PtrString(result.Version),
+	}, nil
+}
+
+// VMCapabilities lists what the guest image of a VM supports, as reported by
+// its agent. Capabilities served on a forwarded guest port include the host
+// port to reach them on.
+func (s *Server) VMCapabilities(ctx context.Context, vmName string) (*serverapi.VmCapabilitiesResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.RLock()
+	vmIP := vm.ip.IP.String()
+	hostPorts := make(map[int32]int32, len(vm.portForwards))
+	for _, pf := range vm.portForwards {
+		hostPorts[pf.guestPort] = pf.hostPort
+	}
+	vm.lock.RUnlock()
+
+	url := s.agent.url(vmIP, "/capabilities")
+	client := s.agent.client(30 * time.Second)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, status.Errorf(codes.Internal, "request failed with status: %d", resp.StatusCode)
+	}
+
+	var agentResp cmdserver.CapabilitiesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&agentResp); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	}
+
+	apiResp := &serverapi.VmCapabilitiesResponse{
+		Capabilities: make([]serverapi.VmCapability, len(agentResp.Capabilities)),
+	}
+	for i, c := range agentResp.Capabilities {
+		capability := serverapi.VmCapability{
+			Name:        serverapi.PtrString(c.Name),
+			Description: serverapi.PtrString(c.Description),
+			Version:     serverapi.PtrString(c.Version),
+			Protocol:    serverapi.PtrString(c.Protocol),
+			Available:   serverapi.PtrBool(c.Available),
+			Error:       serverapi.PtrString(c.Error),
+		}
+		if c.Port != 0 {
+			capability.GuestPort = serverapi.PtrString(strconv.Itoa(c.Port))
+			if hostPort, ok := hostPorts[int32(c.Port)]; ok {
+				capability.HostPort = serverapi.PtrString(strconv.Itoa(int(hostPort)))
+			}
+		}
+		apiResp.Capabilities[i] = capability
+	}
+	return apiResp, nil
+}
+
+// guestServices returns the health of the services declared in the guest
+// image, as last probed by its agent.
+func (v *vm) guestServices(ctx context.Context) ([]cmdserver.ServiceHealth, error) {
+	v.lock.RLock()
+	vmIP := v.ip.IP.String()
+	v.lock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	services, err := cmdserver.FetchServices(ctx, v.agent.client(0), v.agent.url(vmIP, "/services"))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get guest services: %v", err)
+	}
+	return services, nil
+}
+
+// VMServices reports the health of the services in a VM, e.g. Chrome or the
+// VNC server, so that proxies can explain why one is unavailable.
+func (s *Server) VMServices(ctx context.Context, vmName string) (*serverapi.VmServicesResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	services, err := vm.guestServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.lock.RLock()
+	hostPorts := make(map[int32]int32, len(vm.portForwards))
+	for _, pf := range vm.portForwards {
+		hostPorts[pf.guestPort] = pf.hostPort
+	}
+	vm.lock.RUnlock()
+
+	apiResp := &serverapi.VmServicesResponse{
+		Services: make([]serverapi.VmService, len(services)),
+	}
+	for i, h := range services {
+		service := serverapi.VmService{
+			Name:   serverapi.PtrString(h.Name),
+			Port:   serverapi.PtrInt32(int32(h.Port)),
+			State:  serverapi.PtrString(string(h.State)),
+			Reason: serverapi.PtrString(h.Reason),
+			Since:  serverapi.PtrTime(h.Since),
+		}
+		if hostPort, ok := hostPorts[int32(h.Port)]; ok {
+			service.HostPort = serverapi.PtrString(strconv.Itoa(int(hostPort)))
+		}
+		apiResp.Services[i] = service
+	}
+	return apiResp, nil
+}
+
+// WaitVMReady blocks until the agent of a VM answers and every service it
+// declares is up, and returns their health. If ctx expires first the error
+// lists what was still not ready.
+func (s *Server) WaitVMReady(ctx context.Context, vmName string) ([]serverapi.VmService, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	ticker := time.NewTicker(vmReadyPollInterval)
+	defer ticker.Stop()
+	for {
+		var notReady []string
+		resp, err := s.VMServices(ctx, vmName)
+		if err != nil {
+			notReady = append(notReady, fmt.Sprintf("agent: %v", status.Convert(err).Message()))
+		} else {
+			for _, service := range resp.Services {
+				if service.GetState() == string(cmdserver.ServiceUp) {
+					continue
+				}
+				notReady = append(notReady, cmdserver.ServiceHealth{
+					Name:   service.GetName(),
+					State:  cmdserver.ServiceState(service.GetState()),
+					Reason: service.GetReason(),
+				}.String())
+			}
+			if len(notReady) == 0 {
+				return resp.Services, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, status.Errorf(codes.DeadlineExceeded, "vm %s not ready: %s", vmName, strings.Join(notReady, "; "))
+		case <-ticker.C:
+		}
+	}
+}
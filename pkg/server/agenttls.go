@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/mtls"
+)
+
+// agentPort is where the guest agent serves its API.
+const agentPort = 4031
+
+// agentEndpoint reaches the guest agents, over mutual TLS when configured.
+type agentEndpoint struct {
+	scheme    string
+	tlsConfig *tls.Config // nil without mutual TLS
+	transport http.RoundTripper
+}
+
+// newAgentEndpoint returns the endpoint of the guest agents. With mutual TLS
+// the agents' certificates are verified for the agent service rather than
+// their VM's address.
+func newAgentEndpoint(c config.MutualTLSConfig) (*agentEndpoint, error) {
+	if !c.Enabled() {
+		return &agentEndpoint{scheme: "http", transport: http.DefaultTransport}, nil
+	}
+	transport, err := mtls.Transport(c, mtls.ServiceRESTServer, mtls.ServiceAgent)
+	if err != nil {
+		return nil, err
+	}
+	return &agentEndpoint{scheme: "https", tlsConfig: transport.TLSClientConfig, transport: transport}, nil
+}
+
+// url returns the URL of path on the agent of the VM at vmIP.
+func (a *agentEndpoint) url(vmIP string, path string) string {
+	return fmt.Sprintf("%s://%s:%d%s", a.scheme, vmIP, agentPort, path)
+}
+
+// client returns an HTTP client for the agents bounded by timeout, or
+// unbounded for 0.
+func (a *agentEndpoint) client(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: a.transport, Timeout: timeout}
+}
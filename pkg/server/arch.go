@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/server/arch"
+)
+
+// archFilename records the architecture of the snapshotted VM in a snapshot,
+// as cloud-hypervisor can only restore it on a host of the same one.
+const archFilename = "arch"
+
+// applyArchConfig returns config with the artifacts configured for the host's
+// architecture in place of the top-level ones.
+func applyArchConfig(cfg config.ServerConfig, hostArch string) (config.ServerConfig, error) {
+	var archConfig config.ArchConfig
+	for name, c := range cfg.Architectures {
+		a, err := arch.Parse(name)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid architectures: %w", err)
+		}
+		if a == hostArch {
+			archConfig = c
+		}
+	}
+	for _, override := range []struct {
+		value string
+		field *string
+	}{
+		{archConfig.ChvBinPath, &cfg.ChvBinPath},
+		{archConfig.FirecrackerBinPath, &cfg.FirecrackerBinPath},
+		{archConfig.KernelPath, &cfg.KernelPath},
+		{archConfig.RootfsPath, &cfg.RootfsPath},
+		{archConfig.InitramfsPath, &cfg.InitramfsPath},
+	} {
+		if override.value != "" {
+			*override.field = override.value
+		}
+	}
+	return cfg, nil
+}
+
+// checkArch refuses VMs asking for an architecture other than the host's.
+func (s *Server) checkArch(name string) error {
+	if name == "" {
+		return nil
+	}
+	a, err := arch.Parse(name)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := arch.Check(a, s.arch); err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return nil
+}
+
+// checkSnapshotArch refuses to restore a snapshot taken on a host of another
+// architecture. Snapshots taken before the architecture was recorded are
+// assumed to match.
+func (s *Server) checkSnapshotArch(snapshotID string) error {
+	data, err := os.ReadFile(path.Join(s.config.StateDir, "snapshots", snapshotID, archFilename))
+	if err != nil {
+		return nil
+	}
+	if err := arch.Check(string(data), s.arch); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "snapshot %s: %v", snapshotID, err)
+	}
+	return nil
+}
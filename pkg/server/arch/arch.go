@@ -0,0 +1,51 @@
+// Package arch names the CPU architectures guests can run on. KVM only runs
+// guests of the host's own architecture, so a host serves a single one and
+// picks the kernel and rootfs built for it.
+package arch
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Architectures, named as the kernel and cloud-hypervisor name them.
+const (
+	AMD64 = "x86_64"
+	ARM64 = "aarch64"
+)
+
+// Parse returns the architecture named name, accepting Go's names for them
+// too, e.g. "arm64" for ARM64.
+func Parse(name string) (string, error) {
+	switch name {
+	case AMD64, "amd64":
+		return AMD64, nil
+	case ARM64, "arm64":
+		return ARM64, nil
+	}
+	return "", fmt.Errorf("unsupported architecture: %q", name)
+}
+
+// Host returns the architecture of the host, or an error if guests can't run
+// on it.
+func Host() (string, error) {
+	return Parse(runtime.GOARCH)
+}
+
+// Console returns the serial device guests of the architecture log to: the
+// 8250 UART on x86_64 and the PL011 one cloud-hypervisor emulates on aarch64.
+func Console(a string) string {
+	if a == ARM64 {
+		return "ttyAMA0"
+	}
+	return "ttyS0"
+}
+
+// Check returns an error if a guest of the architecture guest can't run on a
+// host of the architecture host.
+func Check(guest string, host string) error {
+	if guest != host {
+		return fmt.Errorf("%s guests can't run on this %s host", guest, host)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package arch
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for name, want := range map[string]string{
+		"x86_64":  AMD64,
+		"amd64":   AMD64,
+		"aarch64": ARM64,
+		"arm64":   ARM64,
+	} {
+		if got, err := Parse(name); err != nil || got != want {
+			t.Errorf("Parse(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"", "riscv64", "X86_64"} {
+		if got, err := Parse(name); err == nil {
+			t.Errorf("Parse(%q) = %q, want an error", name, got)
+		}
+	}
+}
+
+func TestHost(t *testing.T) {
+	got, err := Host()
+	switch runtime.GOARCH {
+	case "amd64":
+		if err != nil || got != AMD64 {
+			t.Errorf("Host() = %q, %v, want %q", got, err, AMD64)
+		}
+	case "arm64":
+		if err != nil || got != ARM64 {
+			t.Errorf("Host() = %q, %v, want %q", got, err, ARM64)
+		}
+	default:
+		if err == nil {
+			t.Errorf("Host() = %q on %s, want an error", got, runtime.GOARCH)
+		}
+	}
+}
+
+func TestConsole(t *testing.T) {
+	if got := Console(AMD64); got != "ttyS0" {
+		t.Errorf("Console(%q) = %q", AMD64, got)
+	}
+	if got := Console(ARM64); got != "ttyAMA0" {
+		t.Errorf("Console(%q) = %q", ARM64, got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := Check(ARM64, ARM64); err != nil {
+		t.Errorf("Check(%q, %q) = %v", ARM64, ARM64, err)
+	}
+	if err := Check(ARM64, AMD64); err == nil {
+		t.Errorf("Check(%q, %q) = nil, want an error", ARM64, AMD64)
+	}
+}
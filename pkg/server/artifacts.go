@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+)
+
+const (
+	defaultArtifactUploadTimeout = 2 * time.Minute
+)
+
+// listGuestArtifacts asks the agent in the guest for its artifacts.
+func (v *vm) listGuestArtifacts(ctx context.Context) ([]cmdserver.Artifact, error) {
+	v.lock.RLock()
+	vmIP := v.ip.IP.String()
+	v.lock.RUnlock()
+
+	client := v.agent.client(30 * time.Second)
+	req, err := http.NewRequestWithContext(ctx, "GET", v.agent.url(vmIP, "/artifacts"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status: %d", resp.StatusCode)
+	}
+
+	var agentResp cmdserver.ArtifactsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&agentResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return agentResp.Artifacts, nil
+}
+
+// openGuestArtifact streams one artifact from the guest. The caller must
+// close the returned response body.
+func (v *vm) openGuestArtifact(ctx context.Context, artifactPath string) (*http.Response, error) {
+	v.lock.RLock()
+	vmIP := v.ip.IP.String()
+	v.lock.RUnlock()
+
+	artifactURL := v.agent.url(vmIP, "/artifacts/"+(&url.URL{Path: artifactPath}).EscapedPath())
+	req, err := http.NewRequestWithContext(ctx, "GET", artifactURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	// No client timeout, artifacts can be large; ctx bounds the transfer.
+	resp, err := v.agent.client(0).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, status.Errorf(codes.NotFound, "artifact not found: %s", artifactPath)
+		}
+		return nil, fmt.Errorf("request failed with status: %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// VMArtifacts lists the artifacts the guest has produced so far.
+func (s *Server) VMArtifacts(ctx context.Context, vmName string) (*serverapi.VmArtifactsResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	artifacts, err := vm.listGuestArtifacts(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list artifacts: %v", err)
+	}
+
+	converted := convertArtifacts(artifacts)
+	for i, artifact := range artifacts {
+		if result, ok := s.scans.get(vm.id, artifact.Path, artifact.SHA256); ok {
+			converted[i].Scan = convertScanResult(result)
+		}
+	}
+	return &serverapi.VmArtifactsResponse{
+		Artifacts: converted,
+	}, nil
+}
+
+func convertArtifacts(artifacts []cmdserver.Artifact) []serverapi.VmArtifact {
+	converted := make([]serverapi.VmArtifact, len(artifacts))
+	for i, artifact := range artifacts {
+		converted[i] = serverapi.VmArtifact{
+			Path:        serverapi.PtrString(artifact.Path),
+			Size:        serverapi.PtrInt64(artifact.Size),
+			ModTime:     serverapi.PtrTime(artifact.ModTime),
+			ContentType: serverapi.PtrString(artifact.ContentType),
+			Sha256:      serverapi.PtrString(artifact.SHA256),
+		}
+	}
+	return converted
+}
+
+// VMArtifact opens one artifact of a VM for reading. The caller must close
+// the returned response body. When artifacts are scanned, the artifact is
+// scanned in full first and refused if quarantined.
+func (s *Server) VMArtifact(ctx context.Context, vmName string, artifactPath string) (*http.Response, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	resp, err := vm.openGuestArtifact(ctx, artifactPath)
+	if err == nil {
+		vm.record(timeline.KindDownload, "artifact", "Downloaded artifact "+artifactPath, map[string]string{"path": artifactPath})
+	}
+	if err != nil || s.scanner == nil || !s.config.Scan.Artifacts {
+		return resp, err
+	}
+
+	file, result, err := s.scanArtifact(ctx, vm, artifactPath, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if s.scanPolicy().Blocks(result) {
+		removeTempFile(file)
+		return nil, status.Errorf(codes.PermissionDenied, "artifact is quarantined: %s", describeScan(artifactPath, result))
+	}
+	resp.Body = tempFileBody{file}
+	resp.Header.Set(scanVerdictHeader, result.Verdict)
+	return resp, nil
+}
+
+// uploadArtifacts copies the artifacts of a running VM to the artifact store,
+// if one is configured. It is called before a VM is stopped or destroyed;
+// failures are logged and never block the shutdown. It returns the artifacts
+// found, how many of them were uploaded and what went wrong.
+func (s *Server) uploadArtifacts(ctx context.Context, vm *vm) ([]cmdserver.Artifact, int, []error) {
+	if s.artifactStore == nil {
+		return nil, 0, nil
+	}
+	vm.lock.RLock()
+	vmStatus := vm.status
+	vm.lock.RUnlock()
+	if vmStatus != vmStatusRunning {
+		return nil, 0, nil
+	}
+
+	logger := log.WithField("vmName", vm.name)
+	timeout := s.config.Artifacts.UploadTimeout
+	if timeout == 0 {
+		timeout = defaultArtifactUploadTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	artifacts, err := vm.listGuestArtifacts(ctx)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to list artifacts, none will be uploaded")
+		return nil, 0, []error{fmt.Errorf("failed to list artifacts: %w", err)}
+	}
+
+	uploaded := 0
+	var failed []error
+	for _, artifact := range artifacts {
+		if err := s.uploadArtifact(ctx, vm, artifact); err != nil {
+			logger.WithField("artifact", artifact.Path).WithError(err).Warn("Failed to upload artifact")
+			failed = append(failed, fmt.Errorf("failed to upload %s: %w", artifact.Path, err))
+			continue
+		}
+		uploaded++
+	}
+	if len(artifacts) > 0 {
+		logger.Infof("Uploaded %d of %d artifacts", uploaded, len(artifacts))
+	}
+	return artifacts, uploaded, failed
+}
+
+func (s *Server) uploadArtifact(ctx context.Context, vm *vm, artifact cmdserver.Artifact) error {
+	key, err := s.putArtifact(ctx, vm, artifact)
+	if key != "" {
+		s.indexRecording(vm, artifact, key)
+	}
+	return err
+}
+
+// validArtifactPath reports whether p, as reported by the guest, is a clean
+// relative path, which can't reach the keys of other VMs once joined to the
+// VM's name.
+func validArtifactPath(p string) bool {
+	return p != "" && p != "." && path.Clean(p) == p && !path.IsAbs(p) && !strings.HasPrefix(p, "..")
+}
+
+// putArtifact copies an artifact to the artifact store and returns its key,
+// or "" if it couldn't be stored.
+func (s *Server) putArtifact(ctx context.Context, vm *vm, artifact cmdserver.Artifact) (string, error) {
+	if !validArtifactPath(artifact.Path) {
+		return "", fmt.Errorf("invalid artifact path %q", artifact.Path)
+	}
+	resp, err := vm.openGuestArtifact(ctx, artifact.Path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	key := path.Join(vm.name, artifact.Path)
+	body := io.LimitReader(resp.Body, artifact.Size)
+	if s.scanner == nil || !s.config.Scan.Artifacts {
+		if err := s.artifactStore.Put(ctx, key, body, artifact.Size); err != nil {
+			return "", err
+		}
+		return key, nil
+	}
+
+	file, result, err := s.scanArtifact(ctx, vm, artifact.Path, body)
+	if err != nil {
+		return "", err
+	}
+	defer removeTempFile(file)
+	if s.scanPolicy().Blocks(result) {
+		key = path.Join(quarantinePrefix, key)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := s.artifactStore.Put(ctx, key, file, info.Size()); err != nil {
+		return "", err
+	}
+	if err := s.putScanResult(ctx, key, result); err != nil {
+		return key, fmt.Errorf("failed to upload scan: %w", err)
+	}
+	return key, nil
+}
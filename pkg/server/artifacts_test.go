@@ -0,0 +1,25 @@
+package server
+
+import "testing"
+
+func TestValidArtifactPath(t *testing.T) {
+	for p, want := range map[string]bool{
+		"screenshot.png":          true,
+		"out/report.pdf":          true,
+		"":                        false,
+		".":                       false,
+		"..":                      false,
+		"../other-vm/secret":      false,
+		"..hidden":                false,
+		"/etc/passwd":             false,
+		"out/../../other-vm/file": false,
+		"out//report.pdf":         false,
+		"./report.pdf":            false,
+		"out/report.pdf/":         false,
+		"out/./report.pdf":        false,
+	} {
+		if got := validArtifactPath(p); got != want {
+			t.Errorf("validArtifactPath(%q) = %v, want %v", p, got, want)
+		}
+	}
+}
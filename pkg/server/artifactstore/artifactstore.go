@@ -0,0 +1,172 @@
+package artifactstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Store persists VM artifacts outside the VM.
+type Store interface {
+	// Put stores the size bytes read from r under key, a slash separated path.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Delete removes what is stored under key. Deleting a missing key is not
+	// an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// New returns the store for uploadURL, which must be a file:// or http(s)://
+// URL. Keys are appended to the URL's path.
+func New(uploadURL string, headers map[string]string) (Store, error) {
+	u, err := url.Parse(uploadURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact upload url %q: %w", uploadURL, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("artifact upload url %q has no path", uploadURL)
+		}
+		return &dirStore{dir: u.Path}, nil
+	case "http", "https":
+		return &httpStore{base: u, headers: headers, client: &http.Client{}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported artifact upload url scheme %q", u.Scheme)
+	}
+}
+
+// cleanKey rejects keys that could escape the store's root.
+func cleanKey(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || clean != "/"+key {
+		return "", fmt.Errorf("invalid artifact key %q", key)
+	}
+	return strings.TrimPrefix(clean, "/"), nil
+}
+
+// dirStore copies artifacts into a local directory.
+type dirStore struct {
+	dir string
+}
+
+func (s *dirStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", dest, err)
+	}
+
+	tmp := dest + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	n, err := io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("got %d of %d bytes", n, size)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", dest, err)
+	}
+	return os.Rename(tmp, dest)
+}
+
+func (s *dirStore) Delete(ctx context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(key))); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// httpStore uploads artifacts with HTTP PUT, which object stores such as S3
+// and GCS accept directly.
+type httpStore struct {
+	base    *url.URL
+	headers map[string]string
+	client  *http.Client
+}
+
+func (s *httpStore) url(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	target := *s.base
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + key
+	target.RawPath = ""
+	return target.String(), nil
+}
+
+func (s *httpStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	target, err := s.url(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, r)
+	if err != nil {
+		return fmt.Errorf("failed to create upload request: %w", err)
+	}
+	req.ContentLength = size
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("upload of %s failed with status %d: %s", key, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Delete sends an HTTP DELETE, which object stores accept like PUT.
+func (s *httpStore) Delete(ctx context.Context, key string) error {
+	target, err := s.url(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, target, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create delete request: %w", err)
+	}
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("delete of %s failed with status %d: %s", key, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
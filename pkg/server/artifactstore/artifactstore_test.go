@@ -0,0 +1,104 @@
+package artifactstore
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := New("file://"+dir, nil)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	if err := store.Put(context.Background(), "foo/shots/1.png", strings.NewReader("png"), 3); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "foo", "shots", "1.png"))
+	if err != nil || string(content) != "png" {
+		t.Errorf("Stored artifact = %q, %v", content, err)
+	}
+
+	if err := store.Put(context.Background(), "foo/short", strings.NewReader("ab"), 3); err == nil {
+		t.Error("Put of a truncated artifact succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo", "short")); !os.IsNotExist(err) {
+		t.Errorf("Truncated artifact was stored: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := store.Delete(context.Background(), "foo/shots/1.png"); err != nil {
+			t.Errorf("Delete #%d failed: %v", i+1, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo", "shots", "1.png")); !os.IsNotExist(err) {
+		t.Errorf("Deleted artifact still exists: %v", err)
+	}
+}
+
+func TestHTTPStore(t *testing.T) {
+	var gotPath, gotAuth, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			gotPath = r.URL.Path
+			if strings.Contains(r.URL.Path, "missing") {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+			}
+			return
+		}
+		if r.Method != http.MethodPut {
+			t.Errorf("Upload used %s, want PUT", r.Method)
+		}
+		body, _ := io.ReadAll(r.Body)
+		gotPath, gotAuth, gotBody = r.URL.Path, r.Header.Get("Authorization"), string(body)
+		if strings.Contains(r.URL.Path, "denied") {
+			http.Error(w, "AccessDenied", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	store, err := New(server.URL+"/bucket/arrakis/", map[string]string{"Authorization": "Bearer t"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := store.Put(context.Background(), "foo/report.json", strings.NewReader("{}"), 2); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if gotPath != "/bucket/arrakis/foo/report.json" || gotAuth != "Bearer t" || gotBody != "{}" {
+		t.Errorf("Upload went to %q with auth %q and body %q", gotPath, gotAuth, gotBody)
+	}
+
+	err = store.Put(context.Background(), "foo/denied", strings.NewReader("x"), 1)
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("Put with a failing upload returned %v", err)
+	}
+
+	if err := store.Delete(context.Background(), "foo/report.json"); err != nil || gotPath != "/bucket/arrakis/foo/report.json" {
+		t.Errorf("Delete = %v, sent to %q", err, gotPath)
+	}
+	if err := store.Delete(context.Background(), "foo/missing"); err != nil {
+		t.Errorf("Delete of a missing key = %v", err)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, u := range []string{"s3://bucket", "file://", "::"} {
+		if _, err := New(u, nil); err == nil {
+			t.Errorf("New(%q) succeeded, want an error", u)
+		}
+	}
+
+	store, _ := New("file://"+t.TempDir(), nil)
+	for _, key := range []string{"../escape", "foo/../../escape", ""} {
+		if err := store.Put(context.Background(), key, strings.NewReader(""), 0); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+	}
+}
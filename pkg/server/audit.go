@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/embedtoken"
+	"github.com/abshkbh/arrakis/pkg/server/audit"
+)
+
+const (
+	// auditDirname keeps the audit records and batches in the state dir.
+	auditDirname         = "audit"
+	defaultAuditInterval = 5 * time.Minute
+)
+
+// newAuditLog opens the audit log of the config, nil if the export is
+// disabled.
+func newAuditLog(cfg config.AuditExportConfig, stateDir string) (*audit.Log, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	var key ed25519.PrivateKey
+	var publicKey ed25519.PublicKey
+	var err error
+	switch {
+	case cfg.KeyFile != "":
+		if key, err = embedtoken.ReadPrivateKey(cfg.KeyFile); err != nil {
+			return nil, err
+		}
+		publicKey = key.Public().(ed25519.PublicKey)
+	case cfg.KMS.PublicKeyFile != "":
+		if publicKey, err = embedtoken.ReadPublicKey(cfg.KMS.PublicKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	signer, err := audit.NewSigner(key, cfg.KMS.Command, cfg.KMS.URL, cfg.KMS.Headers, cfg.KMS.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if publicKey == nil {
+		return nil, errors.New("signing audit batches with a KMS needs its public_key_file")
+	}
+	return audit.Open(audit.Options{
+		Dir:        path.Join(stateDir, auditDirname),
+		Signer:     signer,
+		PublicKey:  publicKey,
+		MaxRecords: cfg.MaxRecords,
+	})
+}
+
+// SealAuditPeriodically seals the audit records into batches every interval
+// until ctx is done. Records not sealed yet survive restarts.
+func (s *Server) SealAuditPeriodically(ctx context.Context) {
+	if s.audit == nil {
+		return
+	}
+	interval := s.config.AuditExport.Interval
+	if interval <= 0 {
+		interval = defaultAuditInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sealed, err := s.audit.Seal(ctx)
+			if err != nil {
+				log.WithError(err).Warn("Failed to seal audit records, retrying next time")
+			}
+			if sealed > 0 {
+				log.WithField("batches", sealed).Info("Sealed audit records")
+			}
+		}
+	}
+}
+
+// AuditBatches lists the sealed batches of a tenant after seq after.
+func (s *Server) AuditBatches(tenant string, after uint64) (audit.Listing, error) {
+	if s.audit == nil {
+		return audit.Listing{}, status.Error(codes.Unimplemented, "audit export isn't enabled on this host")
+	}
+	batches, err := s.audit.Batches(tenant, after)
+	if err != nil {
+		return audit.Listing{}, err
+	}
+	return audit.Listing{Tenant: tenant, KeyID: s.audit.Key().KeyID, Batches: batches}, nil
+}
+
+// AuditBatch returns a sealed batch of a tenant as it was saved, for its
+// hash to be checked.
+func (s *Server) AuditBatch(tenant string, seq uint64) ([]byte, error) {
+	if s.audit == nil {
+		return nil, status.Error(codes.Unimplemented, "audit export isn't enabled on this host")
+	}
+	batch, err := s.audit.Batch(tenant, seq)
+	if errors.Is(err, audit.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "audit batch %d not found", seq)
+	}
+	return batch, err
+}
+
+// AuditKey returns the public key audit batches are verified with.
+func (s *Server) AuditKey() (audit.KeyInfo, error) {
+	if s.audit == nil {
+		return audit.KeyInfo{}, status.Error(codes.Unimplemented, "audit export isn't enabled on this host")
+	}
+	return s.audit.Key(), nil
+}
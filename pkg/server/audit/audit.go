@@ -0,0 +1,424 @@
+// Package audit exports the activity of sandboxes as batches of records,
+// chained by hash and signed, one chain per tenant, so that tenants can prove
+// to reviewers that the records they hand over weren't altered, removed or
+// reordered since the host sealed them.
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxRecords bounds the records of a batch, more are sealed in the
+// batches after.
+const DefaultMaxRecords = 1000
+
+const (
+	pendingFilename = "pending.jsonl"
+	tenantsDirname  = "tenants"
+	batchSuffix     = ".json"
+)
+
+// ErrNotFound is returned for batches that don't exist.
+var ErrNotFound = errors.New("audit batch not found")
+
+// Options configure a log.
+type Options struct {
+	// Dir holds the records not sealed yet and the batches.
+	Dir       string
+	Signer    Signer
+	PublicKey ed25519.PublicKey
+	// MaxRecords bounds the records of a batch, DefaultMaxRecords if 0.
+	MaxRecords int
+}
+
+// head is the last batch of a tenant.
+type head struct {
+	seq  uint64
+	hash string
+	// lastID is the ID of the last record sealed.
+	lastID uint64
+}
+
+// Log appends records to a file until they are sealed into batches. All
+// methods are safe on a nil Log, which records nothing.
+type Log struct {
+	opts  Options
+	keyID string
+
+	// sealMu serializes sealing, which signs without holding mu.
+	sealMu sync.Mutex
+
+	mu      sync.Mutex
+	pending []Record
+	heads   map[string]head
+	nextID  uint64
+}
+
+// Open opens the log in opts.Dir, creating it if needed. Records of the
+// pending file that were already sealed, by a seal interrupted before it
+// could compact the file, are dropped.
+func Open(opts Options) (*Log, error) {
+	if opts.Signer == nil || len(opts.PublicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("audit batches need a signer and its public key")
+	}
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = DefaultMaxRecords
+	}
+	if err := os.MkdirAll(filepath.Join(opts.Dir, tenantsDirname), 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{opts: opts, keyID: KeyID(opts.PublicKey), heads: map[string]head{}, nextID: 1}
+	if err := l.loadHeads(); err != nil {
+		return nil, err
+	}
+	for _, h := range l.heads {
+		l.nextID = max(l.nextID, h.lastID+1)
+	}
+	if err := l.loadPending(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// loadHeads reads the last batch of every tenant.
+func (l *Log) loadHeads() error {
+	dirs, err := os.ReadDir(filepath.Join(l.opts.Dir, tenantsDirname))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		tenant, ok := decodeTenant(dir.Name())
+		if !dir.IsDir() || !ok {
+			continue
+		}
+		seqs, err := l.seqs(tenant)
+		if err != nil {
+			return err
+		}
+		if len(seqs) == 0 {
+			continue
+		}
+		seq := seqs[len(seqs)-1]
+		data, err := os.ReadFile(l.batchPath(tenant, seq))
+		if err != nil {
+			return err
+		}
+		b, p, err := ParseBatch(data)
+		if err != nil {
+			return fmt.Errorf("batch %d of tenant %q: %w", seq, tenant, err)
+		}
+		h := head{seq: p.Seq, hash: b.Hash}
+		if n := len(p.Records); n > 0 {
+			h.lastID = p.Records[n-1].ID
+		}
+		l.heads[tenant] = h
+	}
+	return nil
+}
+
+// loadPending reads the records not sealed yet. A line cut short by a crash
+// is skipped.
+func (l *Log) loadPending() error {
+	f, err := os.Open(filepath.Join(l.opts.Dir, pendingFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		l.nextID = max(l.nextID, r.ID+1)
+		if r.ID > l.heads[r.Tenant].lastID {
+			l.pending = append(l.pending, r)
+		}
+	}
+	return scanner.Err()
+}
+
+// Key returns the key batches are verified with.
+func (l *Log) Key() KeyInfo {
+	if l == nil {
+		return KeyInfo{}
+	}
+	return KeyInfo{
+		KeyID:     l.keyID,
+		Algorithm: AlgorithmEd25519,
+		PublicKey: base64.StdEncoding.EncodeToString(l.opts.PublicKey),
+	}
+}
+
+// PublicKey returns the key batches are verified with, nil for a nil log.
+func (l *Log) PublicKey() ed25519.PublicKey {
+	if l == nil {
+		return nil
+	}
+	return l.opts.PublicKey
+}
+
+// Append saves a record until it's sealed, numbering it and timing it now
+// unless it's timed.
+func (l *Log) Append(r Record) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.ID = l.nextID
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(l.opts.Dir, pendingFilename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.nextID++
+	l.pending = append(l.pending, r)
+	return nil
+}
+
+// Seal signs the pending records into the next batches of their tenants and
+// returns how many batches it saved. Records it fails to seal stay pending
+// for the next seal.
+func (l *Log) Seal(ctx context.Context) (int, error) {
+	if l == nil {
+		return 0, nil
+	}
+	l.sealMu.Lock()
+	defer l.sealMu.Unlock()
+
+	l.mu.Lock()
+	byTenant := map[string][]Record{}
+	for _, r := range l.pending {
+		byTenant[r.Tenant] = append(byTenant[r.Tenant], r)
+	}
+	heads := make(map[string]head, len(l.heads))
+	for tenant, h := range l.heads {
+		heads[tenant] = h
+	}
+	l.mu.Unlock()
+	if len(byTenant) == 0 {
+		return 0, nil
+	}
+
+	tenants := make([]string, 0, len(byTenant))
+	for tenant := range byTenant {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	sealed := 0
+	var errs []error
+	now := time.Now().UTC()
+	for _, tenant := range tenants {
+		records := byTenant[tenant]
+		for len(records) > 0 {
+			n := min(len(records), l.opts.MaxRecords)
+			h := heads[tenant]
+			b, err := l.sign(ctx, Payload{
+				Tenant:   tenant,
+				Seq:      h.seq + 1,
+				Time:     now,
+				PrevHash: h.hash,
+				Records:  records[:n],
+			})
+			if err == nil {
+				err = l.save(tenant, h.seq+1, b)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to seal batch %d of tenant %q: %w", h.seq+1, tenant, err))
+				break
+			}
+			heads[tenant] = head{seq: h.seq + 1, hash: b.Hash, lastID: records[n-1].ID}
+			records = records[n:]
+			sealed++
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.heads = heads
+	pending := l.pending[:0]
+	for _, r := range l.pending {
+		if r.ID > heads[r.Tenant].lastID {
+			pending = append(pending, r)
+		}
+	}
+	l.pending = pending
+	if err := l.compact(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to compact pending records: %w", err))
+	}
+	return sealed, errors.Join(errs...)
+}
+
+// sign hashes and signs p, checking the signature so that a misconfigured
+// signer fails the seal rather than the verifications.
+func (l *Log) sign(ctx context.Context, p Payload) (Batch, error) {
+	payload, err := encodeJSON(p)
+	if err != nil {
+		return Batch{}, err
+	}
+	sum := sha256.Sum256(payload)
+	signature, err := l.opts.Signer.Sign(ctx, sum[:])
+	if err != nil {
+		return Batch{}, err
+	}
+	b := Batch{
+		Payload:   payload,
+		Hash:      hex.EncodeToString(sum[:]),
+		KeyID:     l.keyID,
+		Algorithm: AlgorithmEd25519,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	}
+	if err := verifySignature(b, l.opts.PublicKey); err != nil {
+		return Batch{}, fmt.Errorf("the signer doesn't sign with key %s: %w", l.keyID, err)
+	}
+	return b, nil
+}
+
+// save writes a batch, never replacing one.
+func (l *Log) save(tenant string, seq uint64, b Batch) error {
+	data, err := encodeJSON(b)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(l.opts.Dir, tenantsDirname, encodeTenant(tenant)), 0755); err != nil {
+		return err
+	}
+	path := l.batchPath(tenant, seq)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	// A hard link fails rather than replace a batch already sealed.
+	defer os.Remove(tmp)
+	return os.Link(tmp, path)
+}
+
+// compact rewrites the pending file with the records still pending. The
+// caller must hold mu.
+func (l *Log) compact() error {
+	var buf []byte
+	for _, r := range l.pending {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	path := filepath.Join(l.opts.Dir, pendingFilename)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Batches lists the batches of tenant after seq after, oldest first.
+func (l *Log) Batches(tenant string, after uint64) ([]BatchInfo, error) {
+	if l == nil {
+		return nil, nil
+	}
+	seqs, err := l.seqs(tenant)
+	if err != nil {
+		return nil, err
+	}
+	infos := []BatchInfo{}
+	for _, seq := range seqs {
+		if seq <= after {
+			continue
+		}
+		data, err := os.ReadFile(l.batchPath(tenant, seq))
+		if err != nil {
+			return nil, err
+		}
+		b, p, err := ParseBatch(data)
+		if err != nil {
+			return nil, fmt.Errorf("batch %d of tenant %q: %w", seq, tenant, err)
+		}
+		infos = append(infos, BatchInfo{Seq: p.Seq, Time: p.Time, Records: len(p.Records), Hash: b.Hash, PrevHash: p.PrevHash})
+	}
+	return infos, nil
+}
+
+// Batch returns a batch of tenant as saved.
+func (l *Log) Batch(tenant string, seq uint64) ([]byte, error) {
+	if l == nil {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(l.batchPath(tenant, seq))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// seqs returns the sequence numbers of the batches of tenant, in order.
+func (l *Log) seqs(tenant string) ([]uint64, error) {
+	files, err := os.ReadDir(filepath.Join(l.opts.Dir, tenantsDirname, encodeTenant(tenant)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, f := range files {
+		name, ok := strings.CutSuffix(f.Name(), batchSuffix)
+		if !ok {
+			continue
+		}
+		if seq, err := strconv.ParseUint(name, 10, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (l *Log) batchPath(tenant string, seq uint64) string {
+	return filepath.Join(l.opts.Dir, tenantsDirname, encodeTenant(tenant), fmt.Sprintf("%08d%s", seq, batchSuffix))
+}
+
+// encodeTenant names the directory of a tenant's batches. The prefix keeps
+// the name of the empty tenant, of VMs without an owner, from being empty.
+func encodeTenant(tenant string) string {
+	return "t" + base64.RawURLEncoding.EncodeToString([]byte(tenant))
+}
+
+func decodeTenant(name string) (string, bool) {
+	encoded, ok := strings.CutPrefix(name, "t")
+	if !ok {
+		return "", false
+	}
+	tenant, err := base64.RawURLEncoding.DecodeString(encoded)
+	return string(tenant), err == nil
+}
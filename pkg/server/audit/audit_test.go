@@ -0,0 +1,226 @@
+package audit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLog(t *testing.T, dir string, maxRecords int) (*Log, ed25519.PrivateKey) {
+	t.Helper()
+	publicKey, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(Options{Dir: dir, Signer: KeySigner{Key: key}, PublicKey: publicKey, MaxRecords: maxRecords})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, key
+}
+
+func appendRecords(t *testing.T, l *Log, tenant string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := l.Append(Record{Tenant: tenant, VM: "vm1", Kind: "exec", Action: "command", Summary: "Ran <cmd> & more"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readBatches(t *testing.T, l *Log, tenant string) [][]byte {
+	t.Helper()
+	infos, err := l.Batches(tenant, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batches [][]byte
+	for _, info := range infos {
+		data, err := l.Batch(tenant, info.Seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, data)
+	}
+	return batches
+}
+
+func TestSealAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	l, key := newTestLog(t, dir, 2)
+	appendRecords(t, l, "acme", 3)
+	appendRecords(t, l, "", 1)
+	if n, err := l.Seal(context.Background()); err != nil || n != 3 {
+		t.Fatalf("Seal = %d, %v, want 3 batches", n, err)
+	}
+	appendRecords(t, l, "acme", 1)
+
+	// The next batches chain to those sealed before a restart.
+	l, err := Open(Options{Dir: dir, Signer: KeySigner{Key: key}, PublicKey: key.Public().(ed25519.PublicKey), MaxRecords: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := l.Seal(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Seal after reopening = %d, %v, want 1 batch", n, err)
+	}
+	if n, err := l.Seal(context.Background()); err != nil || n != 0 {
+		t.Fatalf("Seal without records = %d, %v, want none", n, err)
+	}
+
+	batches := readBatches(t, l, "acme")
+	payloads, err := Verify(batches, l.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	for _, p := range payloads {
+		for _, r := range p.Records {
+			ids = append(ids, r.ID)
+		}
+	}
+	if len(payloads) != 3 || len(ids) != 4 || ids[3] != 5 {
+		t.Fatalf("sealed %d batches of records %v, want 3 batches of records 1, 2, 3 and 5", len(payloads), ids)
+	}
+	if _, err := Verify(readBatches(t, l, ""), l.PublicKey()); err != nil {
+		t.Errorf("Verify of the batches without a tenant: %v", err)
+	}
+	// A suffix of the chain verifies too.
+	if _, err := Verify(batches[1:], l.PublicKey()); err != nil {
+		t.Errorf("Verify of later batches: %v", err)
+	}
+	if _, err := l.Batch("acme", 4); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Batch of a missing batch = %v, want ErrNotFound", err)
+	}
+
+	tampered := strings.Replace(string(batches[0]), "Ran", "Did not run", 1)
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+	for name, tc := range map[string]struct {
+		batches [][]byte
+		key     ed25519.PublicKey
+	}{
+		"altered":   {[][]byte{[]byte(tampered), batches[1]}, l.PublicKey()},
+		"removed":   {[][]byte{batches[0], batches[2]}, l.PublicKey()},
+		"reordered": {[][]byte{batches[1], batches[0]}, l.PublicKey()},
+		"short key": {batches, l.PublicKey()[:16]},
+		"other key": {batches, otherKey},
+	} {
+		if _, err := Verify(tc.batches, tc.key); !errors.Is(err, ErrTampered) {
+			t.Errorf("%s: Verify = %v, want ErrTampered", name, err)
+		}
+	}
+}
+
+func TestSealInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	l, key := newTestLog(t, dir, 0)
+	appendRecords(t, l, "acme", 2)
+	pending, err := os.ReadFile(filepath.Join(dir, pendingFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Seal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// As if the server stopped before compacting the pending records, with
+	// a line cut short.
+	if err := os.WriteFile(filepath.Join(dir, pendingFilename), append(pending, `{"id":3,`...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(Options{Dir: dir, Signer: KeySigner{Key: key}, PublicKey: key.Public().(ed25519.PublicKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, "acme", 1)
+	if _, err := l.Seal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	payloads, err := Verify(readBatches(t, l, "acme"), l.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 2 || len(payloads[1].Records) != 1 || payloads[1].Records[0].ID != 3 {
+		t.Fatalf("batches after an interrupted seal = %+v, want the new record alone in the second", payloads)
+	}
+}
+
+func TestSigners(t *testing.T) {
+	publicKey, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Digest string `json:"digest"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		digest, _ := base64.StdEncoding.DecodeString(req.Digest)
+		if r.Header.Get("Authorization") != "Bearer kms" || len(digest) != 32 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest))})
+	}))
+	defer srv.Close()
+
+	signer, err := NewSigner(nil, nil, srv.URL, map[string]string{"Authorization": "Bearer kms"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(Options{Dir: t.TempDir(), Signer: signer, PublicKey: publicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, "acme", 1)
+	if _, err := l.Seal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(readBatches(t, l, "acme"), publicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// A signer of another key fails the seal and keeps the records pending.
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+	l, err = Open(Options{Dir: t.TempDir(), Signer: signer, PublicKey: otherKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, "acme", 1)
+	if n, err := l.Seal(context.Background()); err == nil || n != 0 {
+		t.Fatalf("Seal with the wrong key = %d, %v, want an error", n, err)
+	}
+	if len(l.pending) != 1 {
+		t.Errorf("%d records pending after a failed seal, want 1", len(l.pending))
+	}
+
+	command, err := NewSigner(nil, []string{"sh", "-c", "cat >/dev/null; echo not-base64"}, "", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := command.Sign(context.Background(), make([]byte, 32)); err == nil {
+		t.Error("Sign of a command printing garbage succeeded")
+	}
+	if _, err := NewSigner(key, nil, srv.URL, nil, 0); err == nil {
+		t.Error("NewSigner of a key and a url succeeded")
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	if err := l.Append(Record{}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := l.Seal(context.Background()); n != 0 || err != nil {
+		t.Fatalf("Seal = %d, %v", n, err)
+	}
+	if _, err := l.Batch("", 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Batch = %v, want ErrNotFound", err)
+	}
+}
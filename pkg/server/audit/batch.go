@@ -0,0 +1,176 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AlgorithmEd25519 signs the SHA-256 hash of a batch's payload with ed25519.
+const AlgorithmEd25519 = "ed25519"
+
+// ErrTampered is returned by Verify for batches that were altered, removed,
+// reordered or not signed by the key.
+var ErrTampered = errors.New("audit batches failed verification")
+
+// Record is an entry of a VM's timeline, as exported.
+type Record struct {
+	// ID increases with every record of the host, across tenants.
+	ID     uint64    `json:"id"`
+	Time   time.Time `json:"time"`
+	Tenant string    `json:"tenant,omitempty"`
+	VM     string    `json:"vm"`
+	VMID   string    `json:"vmId,omitempty"`
+	Kind   string    `json:"kind"`
+	Action string    `json:"action"`
+	// Summary and Details are those of the timeline entry.
+	Summary string            `json:"summary"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Payload is what a batch seals: the next records of a tenant, linked to the
+// batch before.
+type Payload struct {
+	Tenant string `json:"tenant"`
+	// Seq numbers the batches of the tenant from 1.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// PrevHash is the hash of batch Seq-1, "" for the first one.
+	PrevHash string   `json:"prevHash"`
+	Records  []Record `json:"records"`
+}
+
+// Batch is a signed payload, as saved and downloaded. Payload holds the
+// exact bytes that were hashed.
+type Batch struct {
+	Payload json.RawMessage `json:"payload"`
+	// Hash is the hex SHA-256 of Payload.
+	Hash      string `json:"hash"`
+	KeyID     string `json:"keyId"`
+	Algorithm string `json:"algorithm"`
+	// Signature is the base64 signature of the hash's bytes.
+	Signature string `json:"signature"`
+}
+
+// BatchInfo lists a batch without its records.
+type BatchInfo struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Records  int       `json:"records"`
+	Hash     string    `json:"hash"`
+	PrevHash string    `json:"prevHash"`
+}
+
+// Listing lists the batches of a tenant.
+type Listing struct {
+	Tenant  string      `json:"tenant"`
+	KeyID   string      `json:"keyId"`
+	Batches []BatchInfo `json:"batches"`
+}
+
+// KeyInfo is the public key batches are verified with.
+type KeyInfo struct {
+	KeyID     string `json:"keyId"`
+	Algorithm string `json:"algorithm"`
+	// PublicKey is base64 encoded.
+	PublicKey string `json:"publicKey"`
+}
+
+// KeyID identifies a public key by the first 8 bytes of its SHA-256, in hex.
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// encodeJSON marshals v without escaping HTML, so that the payload of a
+// batch is saved byte for byte as it was hashed.
+func encodeJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// ParseBatch parses a batch and its payload.
+func ParseBatch(data []byte) (Batch, Payload, error) {
+	var b Batch
+	var p Payload
+	if err := json.Unmarshal(data, &b); err != nil {
+		return b, p, fmt.Errorf("invalid batch: %w", err)
+	}
+	if err := json.Unmarshal(b.Payload, &p); err != nil {
+		return b, p, fmt.Errorf("invalid batch payload: %w", err)
+	}
+	return b, p, nil
+}
+
+// verifySignature checks the hash and signature of b.
+func verifySignature(b Batch, key ed25519.PublicKey) error {
+	sum := sha256.Sum256(b.Payload)
+	if hex.EncodeToString(sum[:]) != b.Hash {
+		return errors.New("the payload doesn't match its hash")
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+	if b.Algorithm != AlgorithmEd25519 {
+		return fmt.Errorf("unsupported algorithm %q", b.Algorithm)
+	}
+	signature, err := base64.StdEncoding.DecodeString(b.Signature)
+	if err != nil || !ed25519.Verify(key, sum[:], signature) {
+		return fmt.Errorf("invalid signature by key %s", b.KeyID)
+	}
+	return nil
+}
+
+// Verify checks that batches are consecutive batches of one tenant, each
+// signed by key and linked to the one before, and returns their payloads.
+// Batches may start anywhere in the chain, the first one of the tenant must
+// then link to nothing.
+func Verify(batches [][]byte, key ed25519.PublicKey) ([]Payload, error) {
+	payloads := make([]Payload, 0, len(batches))
+	var prev Batch
+	var lastID uint64
+	for i, data := range batches {
+		b, p, err := ParseBatch(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: batch %d: %v", ErrTampered, i+1, err)
+		}
+		if err := verifySignature(b, key); err != nil {
+			return nil, fmt.Errorf("%w: batch %d: %v", ErrTampered, p.Seq, err)
+		}
+		if i == 0 {
+			if p.Seq == 0 || (p.Seq == 1) != (p.PrevHash == "") {
+				return nil, fmt.Errorf("%w: batch %d doesn't start a chain", ErrTampered, p.Seq)
+			}
+		} else {
+			first := payloads[0]
+			switch {
+			case p.Tenant != first.Tenant:
+				return nil, fmt.Errorf("%w: batch %d is of tenant %q, not %q", ErrTampered, p.Seq, p.Tenant, first.Tenant)
+			case p.Seq != payloads[i-1].Seq+1:
+				return nil, fmt.Errorf("%w: batch %d follows batch %d", ErrTampered, p.Seq, payloads[i-1].Seq)
+			case p.PrevHash != prev.Hash:
+				return nil, fmt.Errorf("%w: batch %d isn't linked to batch %d", ErrTampered, p.Seq, payloads[i-1].Seq)
+			}
+		}
+		for _, r := range p.Records {
+			if r.ID <= lastID || r.Tenant != p.Tenant {
+				return nil, fmt.Errorf("%w: batch %d holds record %d out of order", ErrTampered, p.Seq, r.ID)
+			}
+			lastID = r.ID
+		}
+		payloads = append(payloads, p)
+		prev = b
+	}
+	return payloads, nil
+}
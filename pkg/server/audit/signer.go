@@ -0,0 +1,132 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultSignerTimeout = 30 * time.Second
+
+// Signer signs the SHA-256 hashes of batches with ed25519.
+type Signer interface {
+	Sign(ctx context.Context, digest []byte) ([]byte, error)
+}
+
+// NewSigner returns the signer using key, running command or posting to url,
+// e.g. to have a KMS sign without the key leaving it. Exactly one must be
+// set.
+func NewSigner(key ed25519.PrivateKey, command []string, url string, headers map[string]string, timeout time.Duration) (Signer, error) {
+	if timeout <= 0 {
+		timeout = defaultSignerTimeout
+	}
+	set := 0
+	for _, ok := range []bool{key != nil, len(command) > 0, url != ""} {
+		if ok {
+			set++
+		}
+	}
+	switch {
+	case set != 1:
+		return nil, errors.New("audit batches are signed with a key file, a command or a url, exactly one must be set")
+	case key != nil:
+		return KeySigner{Key: key}, nil
+	case len(command) > 0:
+		return &CommandSigner{Args: command, Timeout: timeout}, nil
+	default:
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return nil, fmt.Errorf("the url of a signer must be http or https")
+		}
+		return &HTTPSigner{URL: url, Headers: headers, Client: &http.Client{Timeout: timeout}}, nil
+	}
+}
+
+// KeySigner signs with a local key.
+type KeySigner struct {
+	Key ed25519.PrivateKey
+}
+
+func (s KeySigner) Sign(_ context.Context, digest []byte) ([]byte, error) {
+	return ed25519.Sign(s.Key, digest), nil
+}
+
+// CommandSigner runs a script with the digest on its stdin, which prints the
+// base64 signature, e.g. a wrapper of the CLI of a KMS. Exiting non-zero is
+// a failure.
+type CommandSigner struct {
+	Args    []string
+	Timeout time.Duration
+}
+
+func (c *CommandSigner) Sign(ctx context.Context, digest []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Stdin = bytes.NewReader(digest)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return decodeSignature(stdout.String())
+}
+
+// HTTPSigner posts {"digest": "<base64>"} to a signing service, e.g. in
+// front of a KMS, which answers {"signature": "<base64>"}.
+type HTTPSigner struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+func (h *HTTPSigner) Sign(ctx context.Context, digest []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"digest": base64.StdEncoding.EncodeToString(digest)})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range h.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("signer responded %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var signed struct {
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&signed); err != nil {
+		return nil, fmt.Errorf("invalid signer response: %w", err)
+	}
+	return decodeSignature(signed.Signature)
+}
+
+func decodeSignature(s string) ([]byte, error) {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	if len(signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature of %d bytes", len(signature))
+	}
+	return signature, nil
+}
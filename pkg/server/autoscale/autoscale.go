@@ -0,0 +1,262 @@
+// Package autoscale recommends adding or removing worker hosts from how
+// utilized a host is and how many VMs wait for its admission, and runs a
+// script or webhook provisioning hosts when a recommendation holds.
+package autoscale
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions recommended.
+const (
+	ActionScaleUp   = "scale_up"
+	ActionScaleDown = "scale_down"
+	ActionNone      = "none"
+)
+
+const (
+	defaultScaleUpPercent   = 80
+	defaultScaleDownPercent = 20
+	defaultQueueDepth       = 5
+	defaultQueueWait        = 30 * time.Second
+	defaultSustain          = 2 * time.Minute
+	defaultCooldown         = 10 * time.Minute
+	// maxEvents bounds the recommendations kept for Status.
+	maxEvents = 20
+)
+
+// Signals describe the load of a host.
+type Signals struct {
+	// CPUPercent is how busy the host's CPUs were since the last sample.
+	CPUPercent    float64 `json:"cpuPercent"`
+	MemoryPercent float64 `json:"memoryPercent"`
+	// DiskPercent is how full the filesystem of the state dir is.
+	DiskPercent float64 `json:"diskPercent"`
+	// ReservedVCPUPercent and ReservedMemoryPercent are the shares of the
+	// admission capacity reserved by VMs, 0 without admission.
+	ReservedVCPUPercent   float64 `json:"reservedVcpuPercent"`
+	ReservedMemoryPercent float64 `json:"reservedMemoryPercent"`
+	VMs                   int     `json:"vms"`
+	Creating              int     `json:"creating"`
+	// Queued VMs wait for admission, the oldest for OldestQueuedSeconds.
+	Queued              int     `json:"queued"`
+	OldestQueuedSeconds float64 `json:"oldestQueuedSeconds"`
+	Cordoned            bool    `json:"cordoned"`
+}
+
+// Utilization is the share of the host's most utilized resource.
+func (s Signals) Utilization() float64 {
+	return max(s.CPUPercent, s.MemoryPercent, s.DiskPercent, s.ReservedVCPUPercent, s.ReservedMemoryPercent)
+}
+
+// Policy decides what signals call for, zero fields are defaulted.
+type Policy struct {
+	// ScaleUpPercent is the utilization at which more hosts are needed.
+	ScaleUpPercent float64
+	// QueueDepth and QueueWait are the VMs waiting for admission, and how
+	// long the oldest of them waited, at which more hosts are needed.
+	QueueDepth int
+	QueueWait  time.Duration
+	// ScaleDownPercent is the utilization under which the host can be
+	// removed, if no VM is waiting or being created.
+	ScaleDownPercent float64
+	// Sustain is how long the signals must call for an action before it is
+	// recommended.
+	Sustain time.Duration
+	// Cooldown separates recommendations, giving the hosts provisioned time
+	// to take load.
+	Cooldown time.Duration
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.ScaleUpPercent <= 0 {
+		p.ScaleUpPercent = defaultScaleUpPercent
+	}
+	if p.ScaleDownPercent <= 0 {
+		p.ScaleDownPercent = defaultScaleDownPercent
+	}
+	if p.QueueDepth <= 0 {
+		p.QueueDepth = defaultQueueDepth
+	}
+	if p.QueueWait <= 0 {
+		p.QueueWait = defaultQueueWait
+	}
+	if p.Sustain <= 0 {
+		p.Sustain = defaultSustain
+	}
+	if p.Cooldown <= 0 {
+		p.Cooldown = defaultCooldown
+	}
+	return p
+}
+
+// Evaluate returns the action signals call for and why.
+func (p Policy) Evaluate(s Signals) (string, []string) {
+	var reasons []string
+	for _, r := range []struct {
+		name    string
+		percent float64
+	}{
+		{"cpu", s.CPUPercent},
+		{"memory", s.MemoryPercent},
+		{"disk", s.DiskPercent},
+		{"reserved vcpus", s.ReservedVCPUPercent},
+		{"reserved memory", s.ReservedMemoryPercent},
+	} {
+		if r.percent >= p.ScaleUpPercent {
+			reasons = append(reasons, fmt.Sprintf("%s at %.0f%%", r.name, r.percent))
+		}
+	}
+	if s.Queued >= p.QueueDepth {
+		reasons = append(reasons, fmt.Sprintf("%d VMs waiting for admission", s.Queued))
+	}
+	if s.Queued > 0 && s.OldestQueuedSeconds >= p.QueueWait.Seconds() {
+		reasons = append(reasons, fmt.Sprintf("a VM waiting for admission for %.0fs", s.OldestQueuedSeconds))
+	}
+	if len(reasons) > 0 {
+		return ActionScaleUp, reasons
+	}
+	if utilization := s.Utilization(); utilization <= p.ScaleDownPercent && s.Queued == 0 && s.Creating == 0 && !s.Cordoned {
+		return ActionScaleDown, []string{fmt.Sprintf("utilization at %.0f%%", utilization)}
+	}
+	return ActionNone, nil
+}
+
+// Event is a recommendation to add or remove hosts.
+type Event struct {
+	Action  string    `json:"action"`
+	Host    string    `json:"host"`
+	Reasons []string  `json:"reasons"`
+	Signals Signals   `json:"signals"`
+	Time    time.Time `json:"time"`
+	// HookError is why the hook failed to act on the recommendation.
+	HookError string `json:"hookError,omitempty"`
+}
+
+// Status is the state of a scaler.
+type Status struct {
+	// Enabled reports whether recommendations are emitted. The signals are
+	// evaluated either way.
+	Enabled     bool    `json:"enabled"`
+	Host        string  `json:"host"`
+	Signals     Signals `json:"signals"`
+	Utilization float64 `json:"utilization"`
+	// Action is what the signals call for now, recommended once it held
+	// for Sustain, since Since.
+	Action  string     `json:"action"`
+	Reasons []string   `json:"reasons,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	// ObservedAt is when the signals were sampled, nil before the first
+	// sample.
+	ObservedAt *time.Time `json:"observedAt,omitempty"`
+	// Events are the latest recommendations, oldest first.
+	Events []Event `json:"events"`
+}
+
+// Scaler turns the signals observed on a host into recommendations, sent to
+// a hook and to emit.
+type Scaler struct {
+	policy  Policy
+	enabled bool
+	host    string
+	hook    Hook // nil if recommendations aren't acted upon
+	emit    func(Event)
+
+	mu       sync.Mutex
+	signals  Signals
+	observed time.Time
+	action   string
+	reasons  []string
+	since    time.Time // Of action
+	last     time.Time // Of the last recommendation
+	events   []Event
+}
+
+// New returns a scaler of host. Unless enabled it only evaluates the signals.
+// hook and emit may be nil.
+func New(policy Policy, enabled bool, host string, hook Hook, emit func(Event)) *Scaler {
+	return &Scaler{
+		policy:  policy.withDefaults(),
+		enabled: enabled,
+		host:    host,
+		hook:    hook,
+		emit:    emit,
+		action:  ActionNone,
+	}
+}
+
+// Observe evaluates the signals sampled at now and, if they called for the
+// same action for long enough and the last recommendation is older than the
+// cooldown, recommends it: the hook is run and the event emitted. It returns
+// the event recommended, if any.
+func (s *Scaler) Observe(ctx context.Context, now time.Time, signals Signals) *Event {
+	action, reasons := s.policy.Evaluate(signals)
+
+	s.mu.Lock()
+	s.signals, s.observed, s.reasons = signals, now, reasons
+	if action != s.action {
+		s.action, s.since = action, now
+	}
+	if !s.enabled || action == ActionNone || now.Sub(s.since) < s.policy.Sustain ||
+		(!s.last.IsZero() && now.Sub(s.last) < s.policy.Cooldown) {
+		s.mu.Unlock()
+		return nil
+	}
+	s.last = now
+	s.mu.Unlock()
+
+	e := Event{Action: action, Host: s.host, Reasons: reasons, Signals: signals, Time: now}
+	logger := log.WithFields(log.Fields{
+		"action":      action,
+		"utilization": signals.Utilization(),
+		"queued":      signals.Queued,
+	})
+	logger.Infof("Autoscaling recommended: %v", reasons)
+	if s.hook != nil {
+		if err := s.hook.Run(ctx, e); err != nil {
+			logger.WithError(err).Warn("Autoscaling hook failed")
+			e.HookError = err.Error()
+		}
+	}
+	if s.emit != nil {
+		s.emit(e)
+	}
+
+	s.mu.Lock()
+	s.events = append(s.events, e)
+	if len(s.events) > maxEvents {
+		s.events = s.events[len(s.events)-maxEvents:]
+	}
+	s.mu.Unlock()
+	return &e
+}
+
+// Status returns the signals last observed, what they call for and the
+// latest recommendations.
+func (s *Scaler) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Status{
+		Enabled:     s.enabled,
+		Host:        s.host,
+		Signals:     s.signals,
+		Utilization: s.signals.Utilization(),
+		Action:      s.action,
+		Reasons:     s.reasons,
+		Events:      append([]Event{}, s.events...),
+	}
+	if !s.observed.IsZero() {
+		observed := s.observed
+		st.ObservedAt = &observed
+	}
+	if s.action != ActionNone {
+		since := s.since
+		st.Since = &since
+	}
+	return st
+}
@@ -0,0 +1,170 @@
+package autoscale
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluate(t *testing.T) {
+	p := Policy{}.withDefaults()
+	for _, tc := range []struct {
+		name    string
+		signals Signals
+		action  string
+		reasons int
+	}{
+		{"busy", Signals{CPUPercent: 50, ReservedMemoryPercent: 90, DiskPercent: 85}, ActionScaleUp, 2},
+		{"queue depth", Signals{CPUPercent: 50, Queued: 5}, ActionScaleUp, 1},
+		{"queue wait", Signals{CPUPercent: 50, Queued: 1, OldestQueuedSeconds: 31}, ActionScaleUp, 1},
+		{"steady", Signals{CPUPercent: 50, Queued: 1, OldestQueuedSeconds: 5}, ActionNone, 0},
+		{"idle", Signals{CPUPercent: 5, MemoryPercent: 15, VMs: 2}, ActionScaleDown, 1},
+		{"idle but creating", Signals{CPUPercent: 5, Creating: 1}, ActionNone, 0},
+		{"idle but cordoned", Signals{Cordoned: true}, ActionNone, 0},
+	} {
+		action, reasons := p.Evaluate(tc.signals)
+		if action != tc.action || len(reasons) != tc.reasons {
+			t.Errorf("%s: Evaluate = %s %q, want %s with %d reasons", tc.name, action, reasons, tc.action, tc.reasons)
+		}
+	}
+}
+
+type recordingHook struct {
+	events []Event
+	err    error
+}
+
+func (h *recordingHook) Run(_ context.Context, e Event) error {
+	h.events = append(h.events, e)
+	return h.err
+}
+
+func TestScaler(t *testing.T) {
+	hook := &recordingHook{}
+	var emitted []Event
+	s := New(Policy{Sustain: time.Minute, Cooldown: 10 * time.Minute}, true, "host1", hook, func(e Event) { emitted = append(emitted, e) })
+	busy := Signals{CPUPercent: 95}
+	now := time.Now()
+
+	// Recommended once the signals held for Sustain.
+	if e := s.Observe(context.Background(), now, busy); e != nil {
+		t.Errorf("recommended %+v right away", e)
+	}
+	if st := s.Status(); st.Action != ActionScaleUp || st.Since == nil || !st.Since.Equal(now) || st.Utilization != 95 {
+		t.Errorf("status = %+v", st)
+	}
+	e := s.Observe(context.Background(), now.Add(time.Minute), busy)
+	if e == nil || e.Action != ActionScaleUp || e.Host != "host1" || len(e.Reasons) != 1 {
+		t.Fatalf("recommendation = %+v", e)
+	}
+	if len(hook.events) != 1 || len(emitted) != 1 {
+		t.Errorf("hook ran %d times and %d events emitted, want 1", len(hook.events), len(emitted))
+	}
+
+	// Not again within the cooldown, whatever the action.
+	if e := s.Observe(context.Background(), now.Add(5*time.Minute), busy); e != nil {
+		t.Errorf("recommended %+v within the cooldown", e)
+	}
+	s.Observe(context.Background(), now.Add(6*time.Minute), Signals{})
+	if e := s.Observe(context.Background(), now.Add(8*time.Minute), Signals{}); e != nil {
+		t.Errorf("recommended %+v within the cooldown", e)
+	}
+	hook.err = context.DeadlineExceeded
+	e = s.Observe(context.Background(), now.Add(11*time.Minute), Signals{})
+	if e == nil || e.Action != ActionScaleDown || e.HookError == "" {
+		t.Fatalf("recommendation = %+v", e)
+	}
+	if st := s.Status(); len(st.Events) != 2 || st.Events[1].HookError == "" {
+		t.Errorf("events = %+v", st.Events)
+	}
+
+	// Disabled scalers only evaluate.
+	s = New(Policy{Sustain: time.Minute}, false, "host1", hook, nil)
+	s.Observe(context.Background(), now, busy)
+	if e := s.Observe(context.Background(), now.Add(time.Hour), busy); e != nil {
+		t.Errorf("disabled scaler recommended %+v", e)
+	}
+	if st := s.Status(); st.Enabled || st.Action != ActionScaleUp || len(st.Events) != 0 {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	if _, err := NewHook([]string{"true"}, "http://host", nil, 0); err == nil {
+		t.Error("hook with a command and a url created")
+	}
+	if hook, err := NewHook(nil, "", nil, 0); hook != nil || err != nil {
+		t.Errorf("NewHook() = %v, %v, want none", hook, err)
+	}
+	e := Event{Action: ActionScaleUp, Host: "host1", Reasons: []string{"cpu at 95%"}}
+
+	received := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var got Event
+		json.NewDecoder(r.Body).Decode(&got)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		received <- got
+	}))
+	defer srv.Close()
+	hook, err := NewHook(nil, srv.URL, map[string]string{"Authorization": "Bearer token"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.Run(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got.Action != ActionScaleUp || got.Host != "host1" {
+		t.Errorf("webhook received %+v", got)
+	}
+	hook, _ = NewHook(nil, srv.URL, nil, 0)
+	if err := hook.Run(context.Background(), e); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Run = %v, want the webhook's refusal", err)
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	hook, err = NewHook([]string{"sh", "-c", `echo "$ARRAKIS_SCALE_ACTION $ARRAKIS_HOST" > ` + out + ` && cat >> ` + out}, "", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.Run(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(out)
+	if !strings.HasPrefix(string(data), "scale_up host1\n{") || !strings.Contains(string(data), `"reasons":["cpu at 95%"]`) {
+		t.Errorf("command got %q", data)
+	}
+	hook, _ = NewHook([]string{"sh", "-c", "echo no capacity >&2; exit 3"}, "", nil, 0)
+	if err := hook.Run(context.Background(), e); err == nil || !strings.Contains(err.Error(), "no capacity") {
+		t.Errorf("Run = %v, want the command's failure", err)
+	}
+}
+
+func TestHostUsage(t *testing.T) {
+	busy, idle, err := parseCPUTimes(strings.NewReader("cpu  100 10 50 800 40 5 5 0 30 0\ncpu0 1 1 1 1 1 1 1 1 0 0\n"))
+	if err != nil || busy != 170 || idle != 840 {
+		t.Errorf("parseCPUTimes = %d, %d, %v, want 170, 840", busy, idle, err)
+	}
+	percent, err := parseMemoryPercent(strings.NewReader("MemTotal:       16000000 kB\nMemFree:         1000000 kB\nMemAvailable:    4000000 kB\n"))
+	if err != nil || percent != 75 {
+		t.Errorf("parseMemoryPercent = %g, %v, want 75", percent, err)
+	}
+	if _, err := parseMemoryPercent(strings.NewReader("MemTotal: 1 kB\n")); err == nil {
+		t.Error("parsed meminfo without MemAvailable")
+	}
+	var sampler CPUSampler
+	if _, err := sampler.Percent(); err != nil {
+		t.Skipf("no /proc/stat: %v", err)
+	}
+	if percent, err := sampler.Percent(); err != nil || percent < 0 || percent > 100 {
+		t.Errorf("Percent = %g, %v", percent, err)
+	}
+}
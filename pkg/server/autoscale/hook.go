@@ -0,0 +1,104 @@
+package autoscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = time.Minute
+
+// Hook acts on recommendations, e.g. by provisioning or draining worker
+// hosts.
+type Hook interface {
+	Run(ctx context.Context, e Event) error
+}
+
+// NewHook returns the hook running command or posting to url. It returns nil
+// if neither is set.
+func NewHook(command []string, url string, headers map[string]string, timeout time.Duration) (Hook, error) {
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	switch {
+	case len(command) > 0 && url != "":
+		return nil, errors.New("a hook can be a command or a url, not both")
+	case len(command) > 0:
+		return &Command{Args: command, Timeout: timeout}, nil
+	case url != "":
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return nil, fmt.Errorf("the url of a hook must be http or https")
+		}
+		return &HTTP{URL: url, Headers: headers, Client: &http.Client{Timeout: timeout}}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Command runs a script with the event as JSON on its stdin, and its action
+// and host in $ARRAKIS_SCALE_ACTION and $ARRAKIS_HOST. Exiting non-zero is a
+// failure.
+type Command struct {
+	Args    []string
+	Timeout time.Duration
+}
+
+func (c *Command) Run(ctx context.Context, e Event) error {
+	input, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Env = append(os.Environ(), "ARRAKIS_SCALE_ACTION="+e.Action, "ARRAKIS_HOST="+e.Host)
+	cmd.Stdin = bytes.NewReader(input)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// HTTP posts events as JSON to a webhook, e.g. of a cluster autoscaler or
+// an infrastructure pipeline.
+type HTTP struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+func (h *HTTP) Run(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range h.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook responded %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package autoscale
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CPUSampler measures how busy the host's CPUs are between samples, from
+// /proc/stat.
+type CPUSampler struct {
+	mu         sync.Mutex
+	busy, idle uint64 // Of the last sample
+}
+
+// Percent returns how busy the CPUs were since the last call, or since boot
+// on the first.
+func (c *CPUSampler) Percent() (float64, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	busy, idle, err := parseCPUTimes(f)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dBusy, dIdle := busy-c.busy, idle-c.idle
+	c.busy, c.idle = busy, idle
+	if dBusy+dIdle == 0 {
+		return 0, nil
+	}
+	return 100 * float64(dBusy) / float64(dBusy+dIdle), nil
+}
+
+// parseCPUTimes returns the busy and idle jiffies of the "cpu" line of
+// /proc/stat.
+func parseCPUTimes(r io.Reader) (uint64, uint64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		var busy, idle uint64
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid cpu time %q", field)
+			}
+			switch i {
+			case 3, 4: // idle and iowait
+				idle += v
+			case 8, 9: // guest and guest_nice, already counted in user and nice
+			default:
+				busy += v
+			}
+		}
+		return busy, idle, nil
+	}
+	return 0, 0, fmt.Errorf("no cpu line")
+}
+
+// MemoryPercent returns how much of the host's memory is unavailable to new
+// VMs, from /proc/meminfo.
+func MemoryPercent() (float64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseMemoryPercent(f)
+}
+
+func parseMemoryPercent(r io.Reader) (float64, error) {
+	var total, available int64 = 0, -1
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = v
+		case "MemAvailable:":
+			available = v
+		}
+	}
+	if total <= 0 || available < 0 {
+		return 0, fmt.Errorf("no MemTotal or MemAvailable")
+	}
+	return 100 * float64(total-available) / float64(total), nil
+}
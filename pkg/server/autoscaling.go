@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/metrics"
+	"github.com/abshkbh/arrakis/pkg/server/autoscale"
+	"github.com/abshkbh/arrakis/pkg/server/notify"
+)
+
+const defaultAutoscalingInterval = 30 * time.Second
+
+// newAutoscaler returns the scaler of the config, sending its
+// recommendations to notifier too.
+func newAutoscaler(cfg config.AutoscalingConfig, host string, notifier *notify.Notifier) (*autoscale.Scaler, error) {
+	hook, err := autoscale.NewHook(cfg.Hook.Command, cfg.Hook.URL, cfg.Hook.Headers, cfg.Hook.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	policy := autoscale.Policy{
+		ScaleUpPercent:   cfg.ScaleUp.UtilizationPercent,
+		QueueDepth:       cfg.ScaleUp.QueueDepth,
+		QueueWait:        cfg.ScaleUp.QueueWait,
+		ScaleDownPercent: cfg.ScaleDown.UtilizationPercent,
+		Sustain:          cfg.Sustain,
+		Cooldown:         cfg.Cooldown,
+	}
+	return autoscale.New(policy, cfg.Enabled, host, hook, func(e autoscale.Event) {
+		kind := notify.KindScaleUp
+		if e.Action == autoscale.ActionScaleDown {
+			kind = notify.KindScaleDown
+		}
+		details := map[string]string{"action": e.Action}
+		if e.HookError != "" {
+			details["hookError"] = e.HookError
+		}
+		notifier.Notify(notify.Event{
+			Kind:    kind,
+			Host:    host,
+			Message: strings.Join(e.Reasons, ", "),
+			Time:    e.Time,
+			Details: details,
+		})
+	}), nil
+}
+
+// autoscalingSignals samples how utilized the host is and how many VMs wait
+// for it.
+func (s *Server) autoscalingSignals() autoscale.Signals {
+	st := s.HostStatus()
+	signals := autoscale.Signals{
+		VMs:                 int(st.GetVms()),
+		Creating:            int(st.GetCreating()),
+		Queued:              int(st.GetQueued()),
+		OldestQueuedSeconds: st.GetOldestQueuedSeconds(),
+		Cordoned:            st.GetCordoned(),
+	}
+	if st.Capacity != nil {
+		if capacity := st.Capacity.GetVcpus(); capacity > 0 {
+			signals.ReservedVCPUPercent = 100 * float64(st.Reserved.GetVcpus()) / float64(capacity)
+		}
+		if capacity := st.Capacity.GetMemoryMb(); capacity > 0 {
+			signals.ReservedMemoryPercent = 100 * float64(st.Reserved.GetMemoryMb()) / float64(capacity)
+		}
+	}
+	var err error
+	if signals.CPUPercent, err = s.cpuSampler.Percent(); err != nil {
+		log.WithError(err).Debug("Failed to sample CPU usage")
+	}
+	if signals.MemoryPercent, err = autoscale.MemoryPercent(); err != nil {
+		log.WithError(err).Debug("Failed to sample memory usage")
+	}
+	if signals.DiskPercent, err = diskUsagePercent(s.config.StateDir); err != nil {
+		log.WithError(err).Debug("Failed to sample disk usage")
+	}
+	return signals
+}
+
+// Autoscaling returns the signals last sampled, what they call for and the
+// latest recommendations.
+func (s *Server) Autoscaling() autoscale.Status {
+	return s.autoscaler.Status()
+}
+
+// EvaluateAutoscalingPeriodically samples the signals every interval until
+// ctx is done, recommending adding or removing hosts when they call for it.
+func (s *Server) EvaluateAutoscalingPeriodically(ctx context.Context) {
+	interval := s.config.Autoscaling.Interval
+	if interval <= 0 {
+		interval = defaultAutoscalingInterval
+	}
+	// The CPU usage of the first sample is since boot.
+	s.autoscaler.Observe(ctx, time.Now(), s.autoscalingSignals())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.autoscaler.Observe(ctx, now, s.autoscalingSignals())
+		}
+	}
+}
+
+// AutoscalingMetrics returns the gauges of the autoscaling signals for
+// Prometheus.
+func (s *Server) AutoscalingMetrics() []metrics.Gauge {
+	st := s.Autoscaling()
+	utilization := metrics.Gauge{
+		Name: "arrakis_host_utilization_percent",
+		Help: "Utilization of the host's resources.",
+	}
+	for _, r := range []struct {
+		name    string
+		percent float64
+	}{
+		{"cpu", st.Signals.CPUPercent},
+		{"memory", st.Signals.MemoryPercent},
+		{"disk", st.Signals.DiskPercent},
+		{"reserved_vcpus", st.Signals.ReservedVCPUPercent},
+		{"reserved_memory", st.Signals.ReservedMemoryPercent},
+	} {
+		utilization.Samples = append(utilization.Samples, metrics.Sample{
+			Labels: map[string]string{"resource": r.name},
+			Value:  r.percent,
+		})
+	}
+	var recommendation float64
+	switch st.Action {
+	case autoscale.ActionScaleUp:
+		recommendation = 1
+	case autoscale.ActionScaleDown:
+		recommendation = -1
+	}
+	return []metrics.Gauge{
+		utilization,
+		metrics.NewGauge("arrakis_autoscaling_action", "1 if the signals call for more hosts, -1 for fewer, 0 otherwise.", recommendation),
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/bootprogress"
+)
+
+const (
+	// bootStatusCreating is the status of a VM that is still being created,
+	// before it is registered.
+	bootStatusCreating = "creating"
+	// bootServicesTimeout bounds how long a boot waits for the image's
+	// services before it is reported as failed.
+	bootServicesTimeout = 5 * time.Minute
+)
+
+// startBoot starts recording the boot of vmName, which can be followed before
+// the VM is registered.
+func (s *Server) startBoot(vmName string) *bootprogress.Progress {
+	progress := bootprogress.New(vmName)
+	s.lock.Lock()
+	s.boots[vmName] = progress
+	s.lock.Unlock()
+	return progress
+}
+
+// endBoot stops tracking a boot once the VM is registered, or failed.
+func (s *Server) endBoot(vmName string, progress *bootprogress.Progress) {
+	s.lock.Lock()
+	if s.boots[vmName] == progress {
+		delete(s.boots, vmName)
+	}
+	s.lock.Unlock()
+}
+
+// bootProgress returns the progress of the latest boot of vmName, whether
+// the VM is registered yet or not.
+func (s *Server) bootProgress(vmName string) *bootprogress.Progress {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if progress, ok := s.boots[vmName]; ok {
+		return progress
+	}
+	if vm, ok := s.vms[vmName]; ok {
+		vm.lock.RLock()
+		defer vm.lock.RUnlock()
+		return vm.bootProgress
+	}
+	return nil
+}
+
+// watchBootServices completes a boot once the services the image declares are
+// healthy.
+func (s *Server) watchBootServices(vmName string, progress *bootprogress.Progress) {
+	ctx, cancel := context.WithTimeout(context.Background(), bootServicesTimeout)
+	defer cancel()
+	if _, err := s.WaitVMReady(ctx, vmName); err != nil {
+		log.WithField("vmName", vmName).WithError(err).Warn("VM services did not become healthy")
+		err = fmt.Errorf("services not healthy: %s", status.Convert(err).Message())
+		progress.Fail(err)
+		owner := ""
+		if vm := s.getVMAtomic(vmName); vm != nil {
+			owner = vm.getOwner()
+		}
+		s.noteVMFailure(vmName, owner, err)
+		return
+	}
+	progress.Reach(bootprogress.PhaseServicesHealthy)
+}
+
+// BootEvents returns the boot phases a VM reached so far and a channel of
+// those to come, closed once the boot completes or fails. The returned
+// function must be called once the caller stops reading.
+func (s *Server) BootEvents(ctx context.Context, vmName string) ([]bootprogress.Event, <-chan bootprogress.Event, func(), error) {
+	progress := s.bootProgress(vmName)
+	if progress == nil {
+		return nil, nil, nil, status.Error(codes.NotFound, fmt.Sprintf("no boot in progress or recorded for vm: %s", vmName))
+	}
+	past, events, stop := progress.Subscribe()
+	return past, events, stop, nil
+}
+
+func convertBootProgress(progress *bootprogress.Progress) *serverapi.VmBootProgress {
+	if progress == nil {
+		return nil
+	}
+	events := progress.Events()
+	resp := &serverapi.VmBootProgress{
+		Phase:  serverapi.PtrString(string(progress.Current())),
+		Events: make([]serverapi.VmBootEvent, 0, len(events)),
+	}
+	for _, e := range events {
+		event := serverapi.VmBootEvent{
+			Phase:     serverapi.PtrString(string(e.Phase)),
+			Time:      serverapi.PtrTime(e.Time),
+			ElapsedMs: serverapi.PtrInt64(e.ElapsedMs),
+		}
+		if e.Error != "" {
+			event.Error = serverapi.PtrString(e.Error)
+			resp.Error = serverapi.PtrString(e.Error)
+		}
+		resp.Events = append(resp.Events, event)
+	}
+	return resp
+}
@@ -0,0 +1,164 @@
+// Package bootprogress records the phases a VM goes through between being
+// created and being ready, so that UIs can show what is happening instead of
+// a spinner.
+package bootprogress
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Phase is a milestone of a VM's boot.
+type Phase string
+
+const (
+	// PhaseDiskPrepared is reached once the VM's stateful disk is created or
+	// copied from a snapshot.
+	PhaseDiskPrepared Phase = "disk_prepared"
+	// PhaseVMMStarted is reached once cloud-hypervisor answers on its API
+	// socket.
+	PhaseVMMStarted Phase = "vmm_started"
+	// PhaseKernelBooted is reached once the guest's network stack answers,
+	// or a snapshot has been restored.
+	PhaseKernelBooted Phase = "kernel_booted"
+	// PhaseAgentUp is reached once the guest agent answers.
+	PhaseAgentUp Phase = "agent_up"
+	// PhaseServicesHealthy is reached once every service the image declares
+	// is up. It completes the boot.
+	PhaseServicesHealthy Phase = "services_healthy"
+	// PhaseFailed ends a boot that didn't complete.
+	PhaseFailed Phase = "failed"
+)
+
+// Event records when a VM reached a phase.
+type Event struct {
+	VM    string    `json:"vmName"`
+	Phase Phase     `json:"phase"`
+	Time  time.Time `json:"time"`
+	// ElapsedMs is the time since the boot started.
+	ElapsedMs int64 `json:"elapsedMs"`
+	// Error is why the boot failed, for PhaseFailed.
+	Error string `json:"error,omitempty"`
+}
+
+// Progress is the boot progress of one VM. All methods are safe on a nil
+// Progress, which records nothing.
+type Progress struct {
+	vm      string
+	started time.Time
+
+	mu     sync.Mutex
+	events []Event
+	done   bool
+	subs   map[chan Event]struct{}
+}
+
+// New starts recording the boot of vm.
+func New(vm string) *Progress {
+	return &Progress{vm: vm, started: time.Now(), subs: make(map[chan Event]struct{})}
+}
+
+// Reach records that the VM reached phase. Phases already reached, and any
+// after the boot completed or failed, are ignored.
+func (p *Progress) Reach(phase Phase) {
+	p.record(phase, "")
+}
+
+// Fail ends the boot with err.
+func (p *Progress) Fail(err error) {
+	p.record(PhaseFailed, err.Error())
+}
+
+func (p *Progress) record(phase Phase, errMsg string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	for _, e := range p.events {
+		if e.Phase == phase {
+			return
+		}
+	}
+	now := time.Now()
+	event := Event{VM: p.vm, Phase: phase, Time: now, ElapsedMs: now.Sub(p.started).Milliseconds(), Error: errMsg}
+	p.events = append(p.events, event)
+	p.done = phase == PhaseServicesHealthy || phase == PhaseFailed
+	for ch := range p.subs {
+		// Subscribers get a buffer large enough for every phase.
+		ch <- event
+		if p.done {
+			close(ch)
+		}
+	}
+	if p.done {
+		p.subs = nil
+	}
+}
+
+// Events returns the phases reached so far, in order.
+func (p *Progress) Events() []Event {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Event(nil), p.events...)
+}
+
+// Current returns the latest phase reached, or "" if none was.
+func (p *Progress) Current() Phase {
+	if p == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.events) == 0 {
+		return ""
+	}
+	return p.events[len(p.events)-1].Phase
+}
+
+// Subscribe returns the events so far and a channel of those to come, which
+// is closed once the boot completes or fails. The returned function stops
+// the subscription.
+func (p *Progress) Subscribe() ([]Event, <-chan Event, func()) {
+	ch := make(chan Event, 8)
+	if p == nil {
+		close(ch)
+		return nil, ch, func() {}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	past := append([]Event(nil), p.events...)
+	if p.done {
+		close(ch)
+		return past, ch, func() {}
+	}
+	p.subs[ch] = struct{}{}
+	return past, ch, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.subs[ch]; ok {
+			delete(p.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying p.
+func NewContext(ctx context.Context, p *Progress) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the progress of the boot ctx belongs to, or nil.
+func FromContext(ctx context.Context) *Progress {
+	p, _ := ctx.Value(contextKey{}).(*Progress)
+	return p
+}
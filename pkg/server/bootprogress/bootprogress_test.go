@@ -0,0 +1,90 @@
+package bootprogress
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func phases(events []Event) []Phase {
+	var list []Phase
+	for _, e := range events {
+		list = append(list, e.Phase)
+	}
+	return list
+}
+
+func TestProgress(t *testing.T) {
+	p := New("foo")
+	p.Reach(PhaseVMMStarted)
+	past, ch, _ := p.Subscribe()
+	if len(past) != 1 || past[0].Phase != PhaseVMMStarted || past[0].VM != "foo" {
+		t.Fatalf("Subscribe() past = %+v, want vmm_started of foo", past)
+	}
+
+	p.Reach(PhaseDiskPrepared)
+	p.Reach(PhaseDiskPrepared) // Ignored, already reached.
+	p.Reach(PhaseKernelBooted)
+	p.Reach(PhaseAgentUp)
+	p.Reach(PhaseServicesHealthy)
+	p.Fail(errors.New("too late")) // Ignored, the boot completed.
+
+	var streamed []Event
+	for e := range ch {
+		streamed = append(streamed, e)
+	}
+	want := []Phase{PhaseDiskPrepared, PhaseKernelBooted, PhaseAgentUp, PhaseServicesHealthy}
+	if got := phases(streamed); len(got) != len(want) {
+		t.Fatalf("streamed %v, want %v", got, want)
+	}
+	for i, phase := range want {
+		if streamed[i].Phase != phase {
+			t.Errorf("streamed[%d] = %s, want %s", i, streamed[i].Phase, phase)
+		}
+	}
+	if p.Current() != PhaseServicesHealthy || len(p.Events()) != 5 {
+		t.Errorf("Current() = %s with %d events, want services_healthy with 5", p.Current(), len(p.Events()))
+	}
+
+	// Subscribing to a finished boot replays it and ends right away.
+	past, ch, _ = p.Subscribe()
+	if _, open := <-ch; open || len(past) != 5 {
+		t.Errorf("Subscribe() after completion = %d events and an open channel", len(past))
+	}
+}
+
+func TestFail(t *testing.T) {
+	p := New("foo")
+	_, ch, _ := p.Subscribe()
+	p.Fail(errors.New("boom"))
+	e := <-ch
+	if e.Phase != PhaseFailed || e.Error != "boom" {
+		t.Errorf("event = %+v, want a failure with error boom", e)
+	}
+	if _, open := <-ch; open {
+		t.Error("channel still open after the boot failed")
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	p := New("foo")
+	_, ch, stop := p.Subscribe()
+	stop()
+	if _, open := <-ch; open {
+		t.Error("channel still open after unsubscribing")
+	}
+	p.Reach(PhaseAgentUp) // Must not send on the closed channel.
+}
+
+func TestNil(t *testing.T) {
+	var p *Progress
+	p.Reach(PhaseAgentUp)
+	p.Fail(errors.New("boom"))
+	if p.Current() != "" || p.Events() != nil {
+		t.Error("nil Progress recorded events")
+	}
+	FromContext(context.Background()).Reach(PhaseAgentUp)
+	if got := FromContext(NewContext(context.Background(), New("foo"))); got == nil {
+		t.Error("FromContext() = nil, want the progress")
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+)
+
+// browserRestartTimeout bounds restarting a browser, which waits for a
+// profile being seeded.
+const browserRestartTimeout = 2 * time.Minute
+
+// SeedBrowserProfile installs a zipped Chrome user-data-dir of size bytes in
+// a running VM and restarts Chrome with it, e.g. to start from a golden
+// profile with bookmarks, extensions and logins. Profiles are scanned like
+// uploaded files.
+func (s *Server) SeedBrowserProfile(ctx context.Context, vmName string, archive io.Reader, size int64) (*serverapi.VmBrowserProfileResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	vmStatus := vm.status
+	vmIP := vm.ip.IP.String()
+	vm.lock.RUnlock()
+	if vmStatus != vmStatusRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is %s, browser profiles can only be seeded while running", vmName, vmStatus)
+	}
+	if size <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "the zipped profile is required")
+	}
+	if size > cmdserver.MaxBrowserProfileArchiveSize {
+		return nil, status.Errorf(codes.InvalidArgument, "zipped profiles are limited to %d bytes", int64(cmdserver.MaxBrowserProfileArchiveSize))
+	}
+	logger := log.WithField("vmName", vmName)
+
+	resp := &serverapi.VmBrowserProfileResponse{}
+	if s.scanner != nil && s.config.Scan.Uploads {
+		file, err := os.CreateTemp("", "arrakis-scan-")
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create temp file: %v", err)
+		}
+		defer removeTempFile(file)
+		if _, err := io.Copy(file, io.LimitReader(archive, size)); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to receive profile: %v", err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to receive profile: %v", err)
+		}
+		result := s.scanner.Scan(ctx, file.Name())
+		logScan(logger, result)
+		if s.scanPolicy().Blocks(result) {
+			return nil, status.Errorf(codes.PermissionDenied, "profile is quarantined: %s", describeScan("profile", result))
+		}
+		resp.Scan = convertScanResult(result)
+		archive = file
+	}
+
+	// No client timeout, profiles can be large; ctx bounds the transfer.
+	seeded, err := cmdserver.SeedBrowserProfile(ctx, s.agent.client(0), s.agent.url(vmIP, "/browser/profile"), io.LimitReader(archive, size), size)
+	if err != nil {
+		logger.WithError(err).Error("Failed to seed browser profile")
+		if errors.Is(err, cmdserver.ErrInvalidProfile) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to seed browser profile: %v", err)
+	}
+	logger.WithField("files", seeded.Files).Info("Seeded browser profile")
+	resp.Files = serverapi.PtrInt32(int32(seeded.Files))
+	resp.Bytes = serverapi.PtrInt64(seeded.Bytes)
+	return resp, nil
+}
+
+// RestartBrowser restarts the browser browserID of a running VM, "" being
+// the default one, starting it if it isn't running, e.g. after Chrome
+// crashed.
+func (s *Server) RestartBrowser(ctx context.Context, vmName string, browserID string) error {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	vmStatus := vm.status
+	vmIP := vm.ip.IP.String()
+	vm.lock.RUnlock()
+	if vmStatus != vmStatusRunning {
+		return status.Errorf(codes.FailedPrecondition, "vm %s is %s, browsers can only be restarted while running", vmName, vmStatus)
+	}
+	if _, err := cmdserver.BrowserUnitOf(browserID); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	logger := log.WithFields(log.Fields{"vmName": vmName, "browser": browserID})
+	err := cmdserver.RestartBrowser(ctx, s.agent.client(browserRestartTimeout), s.agent.url(vmIP, "/browser/restart"), browserID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to restart browser")
+		if errors.Is(err, cmdserver.ErrInvalidBrowser) {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		return status.Errorf(codes.Internal, "failed to restart browser: %v", err)
+	}
+	logger.Info("Restarted browser")
+	return nil
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/version"
+)
+
+// Host capabilities, i.e. the subsystems a host may or may not have.
+const (
+	capabilitySnapshots  = "snapshots"
+	capabilityGPU        = "gpu"
+	capabilityVsockAgent = "vsock_agent"
+	capabilityNoVNC      = "novnc"
+	capabilityCDPProxy   = "cdp_proxy"
+	capabilityTunnels    = "tunnels"
+)
+
+// hypervisorVersionTimeout bounds running a hypervisor binary for its
+// version.
+const hypervisorVersionTimeout = 5 * time.Second
+
+// HostCapabilities lists the subsystems of the host, whether they are enabled
+// and their versions, so that clients can degrade gracefully on hosts
+// deployed differently. Subsystems in the guest report the version of the
+// guest service in the capabilities of each VM instead, as it depends on its
+// image.
+func (s *Server) HostCapabilities(ctx context.Context) *serverapi.HostCapabilitiesResponse {
+	capabilities := []serverapi.HostCapability{
+		{
+			Name:    serverapi.PtrString(capabilitySnapshots),
+			Enabled: serverapi.PtrBool(true),
+			Version: serverapi.PtrString(version.Version),
+		},
+		disabledCapability(capabilityGPU, "GPU passthrough isn't supported"),
+		{
+			// The agent is updated over vsock, which only VMs created with a
+			// vsock device have.
+			Name:    serverapi.PtrString(capabilityVsockAgent),
+			Enabled: serverapi.PtrBool(true),
+			Version: serverapi.PtrString(version.Version),
+		},
+		guestServiceCapability(capabilityNoVNC, config.ServiceProxyNoVNC, s.config.PortForwards),
+		guestServiceCapability(capabilityCDPProxy, config.ServiceProxyCDP, s.config.PortForwards),
+	}
+	if len(s.config.PortForwards) > 0 {
+		capabilities = append(capabilities, serverapi.HostCapability{
+			Name:    serverapi.PtrString(capabilityTunnels),
+			Enabled: serverapi.PtrBool(true),
+			Version: serverapi.PtrString(version.Version),
+		})
+	} else {
+		capabilities = append(capabilities, disabledCapability(capabilityTunnels, "no port forwards are configured"))
+	}
+
+	names := make([]string, 0, len(s.hypervisors))
+	for name := range s.hypervisors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := serverapi.HostCapability{
+			Name:    serverapi.PtrString("hypervisor_" + strings.ReplaceAll(name, "-", "_")),
+			Enabled: serverapi.PtrBool(true),
+		}
+		if v, err := s.hypervisorVersion(ctx, name); err == nil {
+			c.Version = serverapi.PtrString(v)
+		} else {
+			c.Reason = serverapi.PtrString("failed to get version: " + err.Error())
+		}
+		capabilities = append(capabilities, c)
+	}
+
+	return &serverapi.HostCapabilitiesResponse{
+		ServerVersion: serverapi.PtrString(version.Version),
+		Arch:          serverapi.PtrString(s.arch),
+		Capabilities:  capabilities,
+	}
+}
+
+func disabledCapability(name string, reason string) serverapi.HostCapability {
+	return serverapi.HostCapability{
+		Name:    serverapi.PtrString(name),
+		Enabled: serverapi.PtrBool(false),
+		Reason:  serverapi.PtrString(reason),
+	}
+}
+
+// guestServiceCapability is enabled when a guest service of proxy is
+// reachable from the host, i.e. a port forward declares one.
+func guestServiceCapability(name string, proxy string, portForwards []config.PortForwardConfig) serverapi.HostCapability {
+	for _, pf := range portForwards {
+		if service := pf.ServiceOf(); service != nil && service.Proxy == proxy {
+			return serverapi.HostCapability{
+				Name:    serverapi.PtrString(name),
+				Enabled: serverapi.PtrBool(true),
+			}
+		}
+	}
+	return disabledCapability(name, "no port forward declares a service of the "+proxy+" proxy")
+}
+
+// hypervisorVersion returns the version the binary of the hypervisor name
+// reports, which is cached once known.
+func (s *Server) hypervisorVersion(ctx context.Context, name string) (string, error) {
+	if v, ok := s.hypervisorVersions.Load(name); ok {
+		return v.(string), nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, hypervisorVersionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, s.hypervisors[name].Command("").Path, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	v, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	s.hypervisorVersions.Store(name, v)
+	return v, nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/chvapi"
+	"github.com/abshkbh/arrakis/pkg/server/arch"
+	"github.com/abshkbh/arrakis/pkg/server/hypervisor"
+)
+
+// cloudHypervisor runs VMs in Cloud Hypervisor, the default hypervisor, which
+// alone supports hotplugging devices.
+type cloudHypervisor struct {
+	bin string
+}
+
+func (h *cloudHypervisor) Name() string {
+	return hypervisor.CloudHypervisor
+}
+
+func (h *cloudHypervisor) Command(socketPath string) *exec.Cmd {
+	return exec.Command(h.bin, "--api-socket", socketPath)
+}
+
+func (h *cloudHypervisor) Connect(client *http.Client) hypervisor.VMM {
+	configuration := chvapi.NewConfiguration()
+	configuration.HTTPClient = client
+	configuration.Servers = chvapi.ServerConfigurations{
+		{
+			URL: "http://localhost/api/v1",
+		},
+	}
+	return &chvVMM{client: chvapi.NewAPIClient(configuration)}
+}
+
+func (h *cloudHypervisor) KernelArgs(a string) []string {
+	return []string{"console=" + arch.Console(a)}
+}
+
+// SnapshotNetwork reads the config.json Cloud Hypervisor saves with a
+// snapshot.
+func (h *cloudHypervisor) SnapshotNetwork(dir string) (string, string, error) {
+	data, err := os.ReadFile(path.Join(dir, "config.json"))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config VMConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if config.Net == nil || len(*config.Net) == 0 {
+		return "", "", fmt.Errorf("no network configuration found")
+	}
+
+	if config.Payload.Cmdline == nil {
+		return "", "", fmt.Errorf("no cmdline found")
+	}
+	return (*config.Net)[0].Tap, *config.Payload.Cmdline, nil
+}
+
+type chvVMM struct {
+	client *chvapi.APIClient
+}
+
+// chvClient returns the Cloud Hypervisor API client of the VM, nil if it runs
+// on another hypervisor.
+func (v *vm) chvClient() *chvapi.APIClient {
+	if vmm, ok := v.vmm.(*chvVMM); ok {
+		return vmm.client
+	}
+	return nil
+}
+
+// checkResponse turns a failed call or an error status into an error, with
+// the body of the response if there is one.
+func checkResponse(what string, resp *http.Response, err error) error {
+	if err != nil {
+		if resp != nil && resp.Body != nil {
+			body, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("failed to %s: %d: %s: %w", what, resp.StatusCode, string(body), err)
+		}
+		return fmt.Errorf("failed to %s: %w", what, err)
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to %s. bad status: %d: %s", what, resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+func (v *chvVMM) Ping(ctx context.Context) (string, error) {
+	resp, _, err := v.client.DefaultAPI.VmmPingGet(ctx).Execute()
+	if err != nil {
+		return "", err
+	}
+	return resp.GetBuildVersion(), nil
+}
+
+func (v *chvVMM) Create(ctx context.Context, config hypervisor.VMConfig) error {
+	// Match virtio-blk queues to vCPUs.
+	numBlockDeviceQueues := config.VCPUs
+	var disks []chvapi.DiskConfig
+	for _, disk := range config.Disks {
+		disks = append(disks, chvapi.DiskConfig{Path: disk.Path, Readonly: Bool(disk.ReadOnly), NumQueues: &numBlockDeviceQueues})
+	}
+	vmConfig := chvapi.VmConfig{
+		Payload: chvapi.PayloadConfig{
+			Kernel:    String(config.Kernel),
+			Cmdline:   String(config.Cmdline),
+			Initramfs: String(config.Initramfs),
+		},
+		Disks:   disks,
+		Cpus:    &chvapi.CpusConfig{BootVcpus: config.VCPUs, MaxVcpus: config.VCPUs},
+		Memory:  &chvapi.MemoryConfig{Size: int64(config.MemoryMB) * 1024 * 1024},
+		Serial:  chvapi.NewConsoleConfig(serialPortMode),
+		Console: chvapi.NewConsoleConfig(consolePortMode),
+		Net: []chvapi.NetConfig{
+			{Tap: String(config.Tap), NumQueues: Int32(numNetDeviceQueues), QueueSize: Int32(netDeviceQueueSizeBytes), Id: String(netDeviceId)},
+		},
+		Vsock: &chvapi.VsockConfig{Cid: int64(config.VsockCID), Socket: config.VsockPath},
+	}
+	log.Info("Calling CreateVM")
+	resp, err := v.client.DefaultAPI.CreateVM(ctx).VmConfig(vmConfig).Execute()
+	return checkResponse("create VM", resp, err)
+}
+
+func (v *chvVMM) Boot(ctx context.Context) error {
+	resp, err := v.client.DefaultAPI.BootVM(ctx).Execute()
+	return checkResponse("boot VM", resp, err)
+}
+
+func (v *chvVMM) Shutdown(ctx context.Context) error {
+	resp, err := v.client.DefaultAPI.ShutdownVM(ctx).Execute()
+	return checkResponse("shutdown VM", resp, err)
+}
+
+func (v *chvVMM) Pause(ctx context.Context) error {
+	resp, err := v.client.DefaultAPI.PauseVM(ctx).Execute()
+	return checkResponse("pause VM", resp, err)
+}
+
+func (v *chvVMM) Resume(ctx context.Context) error {
+	resp, err := v.client.DefaultAPI.ResumeVM(ctx).Execute()
+	return checkResponse("resume VM", resp, err)
+}
+
+func (v *chvVMM) Snapshot(ctx context.Context, dir string) error {
+	// The API expects a "file://" URL.
+	destinationURL := fmt.Sprintf("file://%s", dir)
+	resp, err := v.client.DefaultAPI.VmSnapshotPut(ctx).VmSnapshotConfig(chvapi.VmSnapshotConfig{
+		DestinationUrl: &destinationURL,
+	}).Execute()
+	return checkResponse("create snapshot", resp, err)
+}
+
+func (v *chvVMM) Restore(ctx context.Context, dir string) error {
+	resp, err := v.client.DefaultAPI.VmRestorePut(ctx).RestoreConfig(chvapi.RestoreConfig{
+		SourceUrl: fmt.Sprintf("file://%s", dir),
+	}).Execute()
+	return checkResponse("restore from snapshot", resp, err)
+}
+
+func (v *chvVMM) Delete(ctx context.Context) error {
+	resp, err := v.client.DefaultAPI.DeleteVM(ctx).Execute()
+	if err := checkResponse("delete VM", resp, err); err != nil {
+		return err
+	}
+	resp, err = v.client.DefaultAPI.ShutdownVMM(ctx).Execute()
+	return checkResponse("shutdown VMM", resp, err)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+)
+
+// cordonFilename keeps the cordon in the state dir, so that a host restarted
+// during maintenance stays cordoned.
+const cordonFilename = "cordon.json"
+
+// hostCordon is why and since when the host refuses new VMs.
+type hostCordon struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// CordonedError refuses to create a VM on a cordoned host.
+type CordonedError struct {
+	Reason string
+	Since  time.Time
+}
+
+func (e *CordonedError) Error() string {
+	if e.Reason == "" {
+		return "host is cordoned"
+	}
+	return fmt.Sprintf("host is cordoned: %s", e.Reason)
+}
+
+// GRPCStatus makes the refusal Unavailable.
+func (e *CordonedError) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, e.Error())
+}
+
+// loadCordon returns the cordon recorded in the state dir, nil if the host
+// isn't cordoned.
+func loadCordon(stateDir string) (*hostCordon, error) {
+	data, err := os.ReadFile(path.Join(stateDir, cordonFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cordon: %w", err)
+	}
+	var cordon hostCordon
+	if err := json.Unmarshal(data, &cordon); err != nil {
+		return nil, fmt.Errorf("failed to parse cordon: %w", err)
+	}
+	return &cordon, nil
+}
+
+// CordonHost stops the host from accepting new VMs, with reason reported to
+// the clients refused. VMs already on the host keep running and can still be
+// stopped, started and snapshotted. Cordoning a cordoned host updates the
+// reason.
+func (s *Server) CordonHost(reason string) (*serverapi.HostCordonResponse, error) {
+	s.lock.Lock()
+	cordon := &hostCordon{Reason: reason, Since: time.Now().UTC()}
+	if s.cordon != nil {
+		cordon.Since = s.cordon.Since
+	}
+	data, err := json.Marshal(cordon)
+	if err == nil {
+		filePath := path.Join(s.config.StateDir, cordonFilename)
+		if err = os.WriteFile(filePath+".tmp", data, 0644); err == nil {
+			err = os.Rename(filePath+".tmp", filePath)
+		}
+	}
+	if err != nil {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.Internal, "failed to record cordon: %v", err)
+	}
+	s.cordon = cordon
+	s.lock.Unlock()
+
+	log.WithField("reason", reason).Info("Host cordoned, new VMs are refused")
+	return s.HostCordon(), nil
+}
+
+// UncordonHost lets the host accept new VMs again.
+func (s *Server) UncordonHost() (*serverapi.HostCordonResponse, error) {
+	s.lock.Lock()
+	err := os.Remove(path.Join(s.config.StateDir, cordonFilename))
+	if err != nil && !os.IsNotExist(err) {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.Internal, "failed to remove cordon: %v", err)
+	}
+	wasCordoned := s.cordon != nil
+	s.cordon = nil
+	s.lock.Unlock()
+
+	if wasCordoned {
+		log.Info("Host uncordoned, new VMs are accepted")
+	}
+	return s.HostCordon(), nil
+}
+
+// HostCordon reports whether the host is cordoned, and the VMs still on it.
+func (s *Server) HostCordon() *serverapi.HostCordonResponse {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	resp := &serverapi.HostCordonResponse{
+		Cordoned: serverapi.PtrBool(s.cordon != nil),
+		Vms:      serverapi.PtrInt32(int32(len(s.vms))),
+	}
+	if s.cordon != nil {
+		resp.Reason = serverapi.PtrString(s.cordon.Reason)
+		resp.Since = serverapi.PtrTime(s.cordon.Since)
+	}
+	return resp
+}
+
+// CheckCordon returns a CordonedError if the host is cordoned, unless vmName
+// is a VM already on the host, which may still be booted.
+func (s *Server) CheckCordon(vmName string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.cordon == nil {
+		return nil
+	}
+	if _, ok := s.vms[vmName]; ok && vmName != "" {
+		return nil
+	}
+	return &CordonedError{Reason: s.cordon.Reason, Since: s.cordon.Since}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+)
+
+// desktopAppsTimeout bounds the agent driving a desktop's apps.
+const desktopAppsTimeout = 30 * time.Second
+
+// desktopVMIP returns the IP of the running VM vmName, whose desktop's apps
+// are to be driven.
+func (s *Server) desktopVMIP(vmName string) (string, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return "", status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	vmStatus := vm.status
+	vmIP := vm.ip.IP.String()
+	vm.lock.RUnlock()
+	if vmStatus != vmStatusRunning {
+		return "", status.Errorf(codes.FailedPrecondition, "vm %s is %s, desktop apps can only be driven while running", vmName, vmStatus)
+	}
+	return vmIP, nil
+}
+
+// desktopAppsError converts an error of the agent driving a desktop's apps.
+func desktopAppsError(err error, action string) error {
+	if errors.Is(err, cmdserver.ErrInvalidDesktopRequest) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Errorf(codes.Internal, "failed to %s: %v", action, err)
+}
+
+// OpenURL opens a URL in a running VM with its desktop's default handler,
+// e.g. the default browser, for images whose browser doesn't expose the
+// DevTools protocol.
+func (s *Server) OpenURL(ctx context.Context, vmName string, req cmdserver.OpenURLRequest) error {
+	vmIP, err := s.desktopVMIP(vmName)
+	if err != nil {
+		return err
+	}
+	if err := req.Validate(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	logger := log.WithFields(log.Fields{"vmName": vmName, "url": req.URL})
+	if err := cmdserver.OpenURL(ctx, s.agent.client(desktopAppsTimeout), s.agent.url(vmIP, "/open-url"), req); err != nil {
+		logger.WithError(err).Error("Failed to open url")
+		return desktopAppsError(err, "open url")
+	}
+	logger.Info("Opened url")
+	return nil
+}
+
+// Clipboard returns the text of the clipboard of a desktop of a running VM,
+// display being nil for the default one.
+func (s *Server) Clipboard(ctx context.Context, vmName string, display *int) (cmdserver.ClipboardContent, error) {
+	vmIP, err := s.desktopVMIP(vmName)
+	if err != nil {
+		return cmdserver.ClipboardContent{}, err
+	}
+	agentURL := s.agent.url(vmIP, "/clipboard")
+	if display != nil {
+		if _, err := cmdserver.DesktopPort(*display); err != nil {
+			return cmdserver.ClipboardContent{}, status.Error(codes.InvalidArgument, err.Error())
+		}
+		agentURL += "?" + url.Values{"display": {strconv.Itoa(*display)}}.Encode()
+	}
+
+	c, err := cmdserver.FetchClipboard(ctx, s.agent.client(desktopAppsTimeout), agentURL)
+	if err != nil {
+		log.WithField("vmName", vmName).WithError(err).Error("Failed to read clipboard")
+		return cmdserver.ClipboardContent{}, desktopAppsError(err, "read clipboard")
+	}
+	return c, nil
+}
+
+// SetClipboard puts text on the clipboard of a desktop of a running VM.
+func (s *Server) SetClipboard(ctx context.Context, vmName string, c cmdserver.ClipboardContent) error {
+	vmIP, err := s.desktopVMIP(vmName)
+	if err != nil {
+		return err
+	}
+	if err := c.Validate(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	logger := log.WithField("vmName", vmName)
+	if err := cmdserver.SetClipboard(ctx, s.agent.client(desktopAppsTimeout), s.agent.url(vmIP, "/clipboard"), c); err != nil {
+		logger.WithError(err).Error("Failed to write clipboard")
+		return desktopAppsError(err, "write clipboard")
+	}
+	logger.WithField("bytes", len(c.Text)).Info("Wrote clipboard")
+	return nil
+}
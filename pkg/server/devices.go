@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/chvapi"
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/fountain"
+	"github.com/abshkbh/arrakis/pkg/server/workdir"
+)
+
+// Kinds of extra devices.
+const (
+	deviceKindDisk = "disk"
+	deviceKindNIC  = "nic"
+)
+
+// maxExtraDevices bounds the extra devices of a VM.
+const maxExtraDevices = 8
+
+// device is an extra device of a VM, beyond its rootfs, stateful disk and
+// primary NIC.
+type device struct {
+	// id is the device's ID in cloud-hypervisor.
+	id       string
+	kind     string
+	path     string
+	readonly bool
+	// blank is set for disks created for the VM in its state dir.
+	blank bool
+	tap   *fountain.TapDevice
+	mac   string
+	// bdf is the device's PCI address in the guest.
+	bdf string
+}
+
+// validateDeviceRequest checks a device request before anything is created
+// for it.
+func (s *Server) validateDeviceRequest(req serverapi.VmDeviceRequest) error {
+	switch req.GetKind() {
+	case deviceKindDisk:
+		if (req.GetPath() == "") == (req.GetSizeMb() <= 0) {
+			return status.Error(codes.InvalidArgument, "a disk needs either a path or a sizeMb")
+		}
+		if req.GetPath() != "" && !s.diskPathAllowed(req.GetPath()) {
+			return status.Errorf(codes.InvalidArgument, "disk %s is not in a directory listed in devices.disk_dirs", req.GetPath())
+		}
+		if req.HasMac() {
+			return status.Error(codes.InvalidArgument, "mac is only supported for NICs")
+		}
+	case deviceKindNIC:
+		if req.GetPath() != "" || req.GetSizeMb() != 0 || req.GetReadonly() {
+			return status.Error(codes.InvalidArgument, "path, sizeMb and readonly are only supported for disks")
+		}
+		if req.HasMac() {
+			if _, err := net.ParseMAC(req.GetMac()); err != nil {
+				return status.Errorf(codes.InvalidArgument, "invalid mac %q", req.GetMac())
+			}
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "unsupported device kind %q, only %q and %q are", req.GetKind(), deviceKindDisk, deviceKindNIC)
+	}
+	return nil
+}
+
+// diskPathAllowed reports whether a disk image is in one of the directories
+// configured to hold them.
+func (s *Server) diskPathAllowed(diskPath string) bool {
+	resolved, err := filepath.EvalSymlinks(diskPath)
+	if err != nil {
+		return false
+	}
+	for _, dir := range s.config.Devices.DiskDirs {
+		dir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(dir, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+// attachDevice adds a device to a VM, cold if it hasn't booted yet and hot
+// otherwise.
+func (s *Server) attachDevice(ctx context.Context, vm *vm, req serverapi.VmDeviceRequest) (device, error) {
+	if err := s.validateDeviceRequest(req); err != nil {
+		return device{}, err
+	}
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	client := vm.chvClient()
+	if client == nil {
+		return device{}, status.Errorf(codes.FailedPrecondition, "vm %s runs on %s, which can't attach devices", vm.name, vm.hypervisor.Name())
+	}
+	if len(vm.devices) >= maxExtraDevices {
+		return device{}, status.Errorf(codes.ResourceExhausted, "vm %s already has %d extra devices", vm.name, maxExtraDevices)
+	}
+	vm.nextDeviceID++
+	d := device{
+		id:       fmt.Sprintf("%s%d", req.GetKind(), vm.nextDeviceID),
+		kind:     req.GetKind(),
+		readonly: req.GetReadonly(),
+	}
+	logger := log.WithFields(log.Fields{"vmName": vm.name, "device": d.id})
+
+	var info *chvapi.PciDeviceInfo
+	switch d.kind {
+	case deviceKindDisk:
+		d.path = req.GetPath()
+		if d.path == "" {
+			d.blank = true
+			d.path = workdir.Layout{Root: vm.stateDirPath}.Disk(d.id + ".img")
+			if err := createStatefulDisk(d.path, req.GetSizeMb()); err != nil {
+				os.Remove(d.path)
+				return device{}, status.Errorf(codes.Internal, "failed to create disk: %v", err)
+			}
+		}
+		var err error
+		info, _, err = client.DefaultAPI.VmAddDiskPut(ctx).DiskConfig(chvapi.DiskConfig{
+			Path:     d.path,
+			Readonly: Bool(d.readonly),
+			Id:       String(d.id),
+		}).Execute()
+		if err != nil {
+			if d.blank {
+				os.Remove(d.path)
+			}
+			return device{}, status.Errorf(codes.Internal, "failed to add disk: %v", err)
+		}
+	case deviceKindNIC:
+		tap, err := s.fountain.CreateTapDevice(nil)
+		if err != nil {
+			return device{}, status.Errorf(codes.Internal, "failed to create tap device: %v", err)
+		}
+		d.tap = tap
+		netConfig := chvapi.NetConfig{
+			Tap:       String(tap.Name),
+			NumQueues: Int32(numNetDeviceQueues),
+			QueueSize: Int32(netDeviceQueueSizeBytes),
+			Id:        String(d.id),
+		}
+		if req.HasMac() {
+			netConfig.Mac = String(req.GetMac())
+		}
+		info, _, err = client.DefaultAPI.VmAddNetPut(ctx).NetConfig(netConfig).Execute()
+		if err != nil {
+			if err := s.fountain.DestroyTapDevice(tap); err != nil {
+				logger.WithError(err).Errorf("failed to delete tap device: %s", tap)
+			}
+			return device{}, status.Errorf(codes.Internal, "failed to add NIC: %v", err)
+		}
+		d.mac = req.GetMac()
+	}
+	// Devices added before boot get their address when the VM boots.
+	if info != nil {
+		d.bdf = info.GetBdf()
+	}
+	vm.devices = append(vm.devices, d)
+	logger.WithField("kind", d.kind).Info("Attached device")
+	return d, nil
+}
+
+// releaseDevices frees the host side of a destroyed VM's devices. Blank disks
+// go with its state dir.
+func (s *Server) releaseDevices(vm *vm) {
+	for _, d := range vm.devices {
+		if d.tap == nil {
+			continue
+		}
+		if err := s.fountain.DestroyTapDevice(d.tap); err != nil {
+			log.WithError(err).Errorf("failed to delete tap device: %s", d.tap)
+		}
+	}
+}
+
+// snapshotBlocker returns why a VM's devices can't be carried by a snapshot,
+// or "" if they can: restores only recreate the primary NIC and stateful
+// disk.
+func (v *vm) snapshotBlocker() string {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	for _, d := range v.devices {
+		if d.kind == deviceKindNIC || d.blank {
+			return fmt.Sprintf("snapshots can't carry the extra %s %s", d.kind, d.id)
+		}
+	}
+	return ""
+}
+
+// VMDevices lists the extra devices of a VM.
+func (s *Server) VMDevices(ctx context.Context, vmName string) (*serverapi.VmDevicesResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	defer vm.lock.RUnlock()
+	return &serverapi.VmDevicesResponse{
+		VmName:  serverapi.PtrString(vm.name),
+		Devices: convertDevices(vm.devices),
+	}, nil
+}
+
+// AttachDevice hot-plugs a disk or NIC into a running VM.
+func (s *Server) AttachDevice(ctx context.Context, vmName string, req serverapi.VmDeviceRequest) (*serverapi.VmDevice, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	vmState := vm.status
+	vm.lock.RUnlock()
+	if vmState != vmStatusRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "devices can only be attached to running VMs, vm %s is %s", vmName, vmState)
+	}
+
+	d, err := s.attachDevice(ctx, vm, req)
+	if err != nil {
+		return nil, err
+	}
+	converted := convertDevices([]device{d})
+	return &converted[0], nil
+}
+
+// DetachDevice hot-unplugs an extra device from a running VM. Blank disks are
+// deleted with it.
+func (s *Server) DetachDevice(ctx context.Context, vmName string, id string) error {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	if vm.status != vmStatusRunning {
+		return status.Errorf(codes.FailedPrecondition, "devices can only be detached from running VMs, vm %s is %s", vmName, vm.status)
+	}
+	i := -1
+	for j, d := range vm.devices {
+		if d.id == id {
+			i = j
+		}
+	}
+	if i < 0 {
+		return status.Errorf(codes.NotFound, "vm %s has no device %s", vmName, id)
+	}
+	d := vm.devices[i]
+
+	resp, err := vm.chvClient().DefaultAPI.VmRemoveDevicePut(ctx).VmRemoveDevice(chvapi.VmRemoveDevice{Id: String(id)}).Execute()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to remove device: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		return status.Errorf(codes.Internal, "failed to remove device. bad status: %v", resp)
+	}
+	vm.devices = append(vm.devices[:i], vm.devices[i+1:]...)
+
+	if d.tap != nil {
+		if err := s.fountain.DestroyTapDevice(d.tap); err != nil {
+			log.WithError(err).Errorf("failed to delete tap device: %s", d.tap)
+		}
+	}
+	if d.blank {
+		if err := os.Remove(d.path); err != nil {
+			log.WithError(err).Errorf("failed to delete disk: %s", d.path)
+		}
+	}
+	log.WithFields(log.Fields{"vmName": vmName, "device": id}).Info("Detached device")
+	return nil
+}
+
+func convertDevices(devices []device) []serverapi.VmDevice {
+	converted := make([]serverapi.VmDevice, 0, len(devices))
+	for _, d := range devices {
+		device := serverapi.VmDevice{
+			Id:   serverapi.PtrString(d.id),
+			Kind: serverapi.PtrString(d.kind),
+		}
+		if d.bdf != "" {
+			device.PciBdf = serverapi.PtrString(d.bdf)
+		}
+		switch d.kind {
+		case deviceKindDisk:
+			device.Path = serverapi.PtrString(d.path)
+			device.Readonly = serverapi.PtrBool(d.readonly)
+		case deviceKindNIC:
+			device.Tap = serverapi.PtrString(d.tap.Name)
+			if d.mac != "" {
+				device.Mac = serverapi.PtrString(d.mac)
+			}
+		}
+		converted = append(converted, device)
+	}
+	return converted
+}
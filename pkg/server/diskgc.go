@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/diskgc"
+)
+
+const (
+	defaultDiskGCInterval    = time.Hour
+	defaultDiskGCGracePeriod = 10 * time.Minute
+)
+
+// diskGCPolicy returns the configured garbage collection policy.
+func (s *Server) diskGCPolicy() diskgc.Policy {
+	c := s.config.DiskGC
+	policy := diskgc.Policy{
+		MaxBytes:          c.MaxStateDirSizeInMB * 1024 * 1024,
+		SnapshotRetention: c.SnapshotRetention,
+		SnapshotMaxAge:    c.SnapshotMaxAge,
+		GracePeriod:       c.GracePeriod,
+	}
+	if policy.GracePeriod == 0 {
+		policy.GracePeriod = defaultDiskGCGracePeriod
+	}
+	return policy
+}
+
+// CollectGarbage reclaims the disk of the state dir that the policy allows:
+// state dirs of VMs that no longer exist, snapshots past their retention and,
+// while the state dir is over its size, the oldest snapshots. With dryRun it
+// only reports what it would reclaim.
+func (s *Server) CollectGarbage(ctx context.Context, dryRun bool) (*serverapi.HostGCResponse, error) {
+	// Snapshots and restores hold gcLock for reading so that the snapshot
+	// they use isn't reclaimed under them.
+	s.gcLock.Lock()
+	defer s.gcLock.Unlock()
+
+	// VMs are renamed and registered under s.lock, hold it so that no state
+	// dir changes owners while deciding what to reclaim.
+	s.lock.RLock()
+	live := make(map[string]bool, len(s.vms))
+	for name := range s.vms {
+		live[name] = true
+	}
+	policy := s.diskGCPolicy()
+	policy.Pinned = make(map[string]bool, len(s.deleted))
+	for _, deleted := range s.deleted {
+		policy.Pinned[deleted.SnapshotID] = true
+	}
+	for id := range s.transfers {
+		policy.Pinned[id] = true
+	}
+	result, err := diskgc.Collect(s.config.StateDir, live, policy, dryRun)
+	s.lock.RUnlock()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to collect garbage: %v", err)
+	}
+
+	logger := log.WithFields(log.Fields{
+		"reclaimedBytes": result.ReclaimedBytes,
+		"stateDirBytes":  result.StateDirBytes,
+		"dryRun":         dryRun,
+	})
+	for _, item := range result.Reclaimed {
+		logger.WithFields(log.Fields{
+			"path":   item.Path,
+			"bytes":  item.Bytes,
+			"reason": item.Reason,
+		}).Info("Reclaimed state dir entry")
+		if item.Kind == diskgc.KindSnapshot && !dryRun {
+			s.forgetSnapshot(ctx, item.Name)
+		}
+	}
+	for _, msg := range result.Errors {
+		logger.Warn(msg)
+	}
+	if result.OverLimit {
+		logger.Warnf("State dir is still over its %d MB limit", s.config.DiskGC.MaxStateDirSizeInMB)
+	}
+
+	resp := &serverapi.HostGCResponse{
+		Reclaimed:      make([]serverapi.HostGCItem, len(result.Reclaimed)),
+		ReclaimedBytes: serverapi.PtrInt64(result.ReclaimedBytes),
+		StateDirBytes:  serverapi.PtrInt64(result.StateDirBytes),
+		OverLimit:      serverapi.PtrBool(result.OverLimit),
+		DryRun:         serverapi.PtrBool(result.DryRun),
+		Errors:         result.Errors,
+	}
+	for i, item := range result.Reclaimed {
+		resp.Reclaimed[i] = serverapi.HostGCItem{
+			Kind:    serverapi.PtrString(string(item.Kind)),
+			Name:    serverapi.PtrString(item.Name),
+			Path:    serverapi.PtrString(item.Path),
+			Bytes:   serverapi.PtrInt64(item.Bytes),
+			ModTime: serverapi.PtrTime(item.ModTime),
+			Reason:  serverapi.PtrString(item.Reason),
+		}
+	}
+	return resp, nil
+}
+
+// CollectGarbagePeriodically runs CollectGarbage every configured interval
+// until ctx is done.
+func (s *Server) CollectGarbagePeriodically(ctx context.Context) {
+	interval := s.config.DiskGC.Interval
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = defaultDiskGCInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.CollectGarbage(ctx, false); err != nil {
+				log.WithError(err).Error("Failed to collect garbage")
+			}
+		}
+	}
+}
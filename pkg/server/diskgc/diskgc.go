@@ -0,0 +1,239 @@
+package diskgc
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// SnapshotsDir is the directory below the state dir that holds snapshots.
+// Every other directory in the state dir belongs to a VM of the same name.
+const SnapshotsDir = "snapshots"
+
+// Kind is what a reclaimable entry of the state dir is.
+type Kind string
+
+const (
+	// KindVM is the state directory of a VM.
+	KindVM Kind = "vm"
+	// KindSnapshot is a snapshot directory.
+	KindSnapshot Kind = "snapshot"
+)
+
+// Policy decides what is reclaimed. Zero values disable a limit.
+type Policy struct {
+	// MaxBytes is the most disk the state dir may use. Beyond it the oldest
+	// snapshots are reclaimed until it fits.
+	MaxBytes int64
+	// SnapshotRetention is how many of the newest snapshots are kept.
+	SnapshotRetention int
+	// SnapshotMaxAge reclaims snapshots last written longer ago than this.
+	SnapshotMaxAge time.Duration
+	// GracePeriod protects entries written more recently than this, e.g. the
+	// state dir of a VM that is still being created.
+	GracePeriod time.Duration
+	// Pinned snapshots are never reclaimed, nor counted against the
+	// retention, e.g. those of deleted VMs that can still be undeleted.
+	Pinned map[string]bool
+}
+
+// Entry is a directory in the state dir.
+type Entry struct {
+	Kind    Kind      `json:"kind"`
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Bytes   int64     `json:"bytes"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Inventory is what the state dir holds.
+type Inventory struct {
+	VMs       []Entry
+	Snapshots []Entry
+	// TotalBytes is the disk used by everything in the state dir.
+	TotalBytes int64
+}
+
+// Item is an entry chosen to be reclaimed.
+type Item struct {
+	Entry
+	Reason string `json:"reason"`
+}
+
+// Result reports a collection.
+type Result struct {
+	Reclaimed      []Item `json:"reclaimed"`
+	ReclaimedBytes int64  `json:"reclaimedBytes"`
+	// StateDirBytes is the disk the state dir uses after the collection.
+	StateDirBytes int64 `json:"stateDirBytes"`
+	// OverLimit is set if the state dir is still larger than the policy
+	// allows, because what's left belongs to live VMs or is too recent.
+	OverLimit bool     `json:"overLimit"`
+	DryRun    bool     `json:"dryRun"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// Scan takes the inventory of stateDir.
+func Scan(stateDir string) (Inventory, error) {
+	var inv Inventory
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		return inv, fmt.Errorf("failed to read state dir: %w", err)
+	}
+	for _, e := range entries {
+		entryPath := filepath.Join(stateDir, e.Name())
+		if !e.IsDir() {
+			inv.TotalBytes += diskUsage(entryPath)
+			continue
+		}
+		if e.Name() == SnapshotsDir {
+			snapshots, err := os.ReadDir(entryPath)
+			if err != nil {
+				return inv, fmt.Errorf("failed to read snapshots dir: %w", err)
+			}
+			for _, snapshot := range snapshots {
+				if !snapshot.IsDir() {
+					continue
+				}
+				entry := scanEntry(KindSnapshot, snapshot.Name(), filepath.Join(entryPath, snapshot.Name()))
+				inv.Snapshots = append(inv.Snapshots, entry)
+			}
+			inv.TotalBytes += diskUsage(entryPath)
+			continue
+		}
+		entry := scanEntry(KindVM, e.Name(), entryPath)
+		inv.VMs = append(inv.VMs, entry)
+		inv.TotalBytes += entry.Bytes
+	}
+	return inv, nil
+}
+
+// scanEntry sizes a directory. Its modification time is that of the most
+// recently modified file in it, so that a snapshot being written counts as
+// recent.
+func scanEntry(kind Kind, name string, dir string) Entry {
+	entry := Entry{Kind: kind, Name: name, Path: dir}
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entry.Bytes += allocated(info)
+		if info.ModTime().After(entry.ModTime) {
+			entry.ModTime = info.ModTime()
+		}
+		return nil
+	})
+	return entry
+}
+
+// diskUsage is the disk used by everything at path.
+func diskUsage(path string) int64 {
+	var total int64
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += allocated(info)
+		}
+		return nil
+	})
+	return total
+}
+
+// allocated is the disk a file uses, which for sparse stateful disks is far
+// less than their size.
+func allocated(info fs.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
+
+// Plan chooses what to reclaim from inv under policy. VMs in live are never
+// reclaimed, nor is anything modified within the grace period. It returns the
+// items to reclaim and the disk the state dir would use after reclaiming them.
+func Plan(inv Inventory, live map[string]bool, policy Policy, now time.Time) ([]Item, int64) {
+	var items []Item
+	remaining := inv.TotalBytes
+	settled := func(e Entry) bool {
+		return now.Sub(e.ModTime) >= policy.GracePeriod
+	}
+	reclaim := func(e Entry, reason string) {
+		items = append(items, Item{Entry: e, Reason: reason})
+		remaining -= e.Bytes
+	}
+
+	for _, e := range inv.VMs {
+		if !live[e.Name] && settled(e) {
+			reclaim(e, "not owned by any VM")
+		}
+	}
+
+	// Newest first.
+	var snapshots []Entry
+	for _, e := range inv.Snapshots {
+		if !policy.Pinned[e.Name] {
+			snapshots = append(snapshots, e)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ModTime.After(snapshots[j].ModTime)
+	})
+	var kept []Entry
+	for i, e := range snapshots {
+		switch {
+		case !settled(e):
+			kept = append(kept, e)
+		case policy.SnapshotRetention > 0 && i >= policy.SnapshotRetention:
+			reclaim(e, fmt.Sprintf("beyond the %d most recent snapshots", policy.SnapshotRetention))
+		case policy.SnapshotMaxAge > 0 && now.Sub(e.ModTime) > policy.SnapshotMaxAge:
+			reclaim(e, fmt.Sprintf("older than %s", policy.SnapshotMaxAge))
+		default:
+			kept = append(kept, e)
+		}
+	}
+
+	// Make room by reclaiming the oldest snapshots left.
+	for i := len(kept) - 1; i >= 0 && policy.MaxBytes > 0 && remaining > policy.MaxBytes; i-- {
+		if settled(kept[i]) {
+			reclaim(kept[i], fmt.Sprintf("state dir over its %d byte limit", policy.MaxBytes))
+		}
+	}
+	return items, remaining
+}
+
+// Collect reclaims what Plan chooses from stateDir, or with dryRun only
+// reports it.
+func Collect(stateDir string, live map[string]bool, policy Policy, dryRun bool) (Result, error) {
+	result := Result{DryRun: dryRun}
+	inv, err := Scan(stateDir)
+	if err != nil {
+		return result, err
+	}
+
+	items, _ := Plan(inv, live, policy, time.Now())
+	result.StateDirBytes = inv.TotalBytes
+	result.Reclaimed = []Item{}
+	for _, item := range items {
+		if !dryRun {
+			if err := os.RemoveAll(item.Path); err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("failed to remove %s: %v", item.Path, err))
+				continue
+			}
+		}
+		result.Reclaimed = append(result.Reclaimed, item)
+		result.ReclaimedBytes += item.Bytes
+		result.StateDirBytes -= item.Bytes
+	}
+	result.OverLimit = policy.MaxBytes > 0 && result.StateDirBytes > policy.MaxBytes
+	return result, nil
+}
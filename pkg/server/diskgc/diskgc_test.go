@@ -0,0 +1,132 @@
+package diskgc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeEntry creates dir holding size bytes, last modified at modTime.
+func makeEntry(t *testing.T, dir string, size int, modTime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "data")
+	if err := os.WriteFile(file, []byte(strings.Repeat("x", size)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{file, dir} {
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func names(items []Item) string {
+	var out []string
+	for _, item := range items {
+		out = append(out, string(item.Kind)+":"+item.Name)
+	}
+	return strings.Join(out, " ")
+}
+
+func TestPlan(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	inv := Inventory{
+		VMs: []Entry{
+			{Kind: KindVM, Name: "live", Bytes: 100, ModTime: now.Add(-time.Hour)},
+			{Kind: KindVM, Name: "dead", Bytes: 100, ModTime: now.Add(-time.Hour)},
+			{Kind: KindVM, Name: "creating", Bytes: 100, ModTime: now},
+		},
+		Snapshots: []Entry{
+			{Kind: KindSnapshot, Name: "s1", Bytes: 100, ModTime: now.Add(-4 * time.Hour)},
+			{Kind: KindSnapshot, Name: "s2", Bytes: 100, ModTime: now.Add(-3 * time.Hour)},
+			{Kind: KindSnapshot, Name: "s3", Bytes: 100, ModTime: now.Add(-2 * time.Hour)},
+			{Kind: KindSnapshot, Name: "s4", Bytes: 100, ModTime: now.Add(-time.Minute)},
+		},
+		TotalBytes: 700,
+	}
+	live := map[string]bool{"live": true}
+
+	items, remaining := Plan(inv, live, Policy{GracePeriod: 10 * time.Minute}, now)
+	if got := names(items); got != "vm:dead" || remaining != 600 {
+		t.Errorf("Plan without limits = %q, %d", got, remaining)
+	}
+
+	// Snapshots still being written count towards retention but are kept.
+	items, _ = Plan(inv, live, Policy{SnapshotRetention: 2, GracePeriod: 10 * time.Minute}, now)
+	if got := names(items); got != "vm:dead snapshot:s2 snapshot:s1" {
+		t.Errorf("Plan with retention = %q", got)
+	}
+
+	items, _ = Plan(inv, live, Policy{SnapshotMaxAge: 150 * time.Minute}, now)
+	if got := names(items); got != "vm:dead vm:creating snapshot:s2 snapshot:s1" {
+		t.Errorf("Plan with max age = %q", got)
+	}
+
+	items, remaining = Plan(inv, live, Policy{MaxBytes: 450, GracePeriod: 10 * time.Minute}, now)
+	if got := names(items); got != "vm:dead snapshot:s1 snapshot:s2" || remaining != 400 {
+		t.Errorf("Plan with a size limit = %q, %d", got, remaining)
+	}
+
+	// Pinned snapshots are kept and leave room for the others.
+	pinned := map[string]bool{"s3": true}
+	items, _ = Plan(inv, live, Policy{SnapshotRetention: 2, MaxBytes: 250, GracePeriod: 10 * time.Minute, Pinned: pinned}, now)
+	if got := names(items); got != "vm:dead snapshot:s1 snapshot:s2" {
+		t.Errorf("Plan with pinned snapshots = %q", got)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	stateDir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	makeEntry(t, filepath.Join(stateDir, "live"), 4096, old)
+	makeEntry(t, filepath.Join(stateDir, "dead"), 4096, old)
+	makeEntry(t, filepath.Join(stateDir, SnapshotsDir, "s1"), 4096, old.Add(-time.Hour))
+	makeEntry(t, filepath.Join(stateDir, SnapshotsDir, "s2"), 4096, old)
+	if err := os.WriteFile(filepath.Join(stateDir, "usage.json"), []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := Policy{SnapshotRetention: 1, GracePeriod: time.Minute}
+	live := map[string]bool{"live": true}
+	dry, err := Collect(stateDir, live, policy, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(dry.Reclaimed); got != "vm:dead snapshot:s1" || dry.ReclaimedBytes == 0 {
+		t.Errorf("Dry run reclaimed %q, %d bytes", got, dry.ReclaimedBytes)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "dead")); err != nil {
+		t.Errorf("Dry run removed files: %v", err)
+	}
+
+	result, err := Collect(stateDir, live, policy, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ReclaimedBytes != dry.ReclaimedBytes || result.StateDirBytes != dry.StateDirBytes {
+		t.Errorf("Collect = %+v, want what the dry run reported %+v", result, dry)
+	}
+	for _, p := range []string{"dead", filepath.Join(SnapshotsDir, "s1")} {
+		if _, err := os.Stat(filepath.Join(stateDir, p)); !os.IsNotExist(err) {
+			t.Errorf("%s not reclaimed: %v", p, err)
+		}
+	}
+	for _, p := range []string{"live", "usage.json", filepath.Join(SnapshotsDir, "s2")} {
+		if _, err := os.Stat(filepath.Join(stateDir, p)); err != nil {
+			t.Errorf("%s reclaimed: %v", p, err)
+		}
+	}
+
+	result, err = Collect(stateDir, live, Policy{MaxBytes: 1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OverLimit {
+		t.Errorf("Collect = %+v, want over the limit with only live VMs left", result)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/disksearch"
+)
+
+const (
+	defaultDiskSearchLimit = 1000
+	maxDiskSearchLimit     = 10000
+)
+
+// SearchVMDisk finds the files matching glob that a stopped VM wrote to its
+// disk, e.g. to recover artifacts without booting it. The disk is mounted
+// read-only on the host and the VM can't be started until the search is
+// done. Files of the VM's image aren't searched.
+func (s *Server) SearchVMDisk(ctx context.Context, vmName string, glob string, limit int) (*serverapi.VmDiskSearchResponse, error) {
+	if glob == "" {
+		return nil, status.Error(codes.InvalidArgument, "glob is required")
+	}
+	if limit == 0 {
+		limit = defaultDiskSearchLimit
+	}
+	if limit < 0 || limit > maxDiskSearchLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %d", maxDiskSearchLimit)
+	}
+	if _, err := disksearch.Match(glob, "/"); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid glob %q: %v", glob, err)
+	}
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	// Booting takes the lock, so the disk can't be written under the search.
+	vm.lock.RLock()
+	defer vm.lock.RUnlock()
+	if vm.status != vmStatusStopped && vm.status != vmStatusCreated {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is %s, its disk can only be searched while it is stopped", vmName, vm.status)
+	}
+
+	workDir, err := os.MkdirTemp("", "arrakis-disksearch-")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create mount point: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+	mountPoint := path.Join(workDir, "disk")
+	if err := mountStatefulDisk(vm.statefulDiskPath, mountPoint); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount disk: %v", err)
+	}
+	defer unmountStatefulDisk(mountPoint)
+
+	resp := &serverapi.VmDiskSearchResponse{
+		VmName:  serverapi.PtrString(vm.name),
+		Glob:    serverapi.PtrString(glob),
+		Matches: []serverapi.VmDiskFile{},
+	}
+	layer := path.Join(mountPoint, statefulDiskUpperDir)
+	if _, err := os.Stat(layer); os.IsNotExist(err) {
+		// The VM never booted far enough to write anything.
+		return resp, nil
+	}
+	results, truncated, err := disksearch.Search(layer, glob, limit)
+	if err != nil {
+		log.WithField("vmName", vmName).WithError(err).Error("Failed to search disk")
+		return nil, status.Errorf(codes.Internal, "failed to search disk: %v", err)
+	}
+	for _, r := range results {
+		resp.Matches = append(resp.Matches, serverapi.VmDiskFile{
+			Path:       serverapi.PtrString(r.Path),
+			Size:       serverapi.PtrInt64(r.Size),
+			Dir:        serverapi.PtrBool(r.Dir),
+			ModifiedAt: serverapi.PtrTime(time.Unix(r.ModTime, 0)),
+		})
+	}
+	resp.Truncated = serverapi.PtrBool(truncated)
+	return resp, nil
+}
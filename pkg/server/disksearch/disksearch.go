@@ -0,0 +1,77 @@
+// Package disksearch finds files by glob in a VM's disk mounted on the host,
+// e.g. to recover artifacts from a stopped VM without booting it.
+package disksearch
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Result is a file that matched.
+type Result struct {
+	// Path is the path in the guest, e.g. "/home/elara/out.tar".
+	Path    string
+	Size    int64
+	Dir     bool
+	ModTime int64
+}
+
+// Match reports whether the guest path p matches glob. Globs with a "/" are
+// matched against the whole path, e.g. "/home/*/out/*.tar", others against
+// the file name only, e.g. "*.log".
+func Match(glob string, p string) (bool, error) {
+	if strings.Contains(glob, "/") {
+		return path.Match(glob, p)
+	}
+	return path.Match(glob, path.Base(p))
+}
+
+// Search returns up to limit files under root matching glob, by their path
+// in the guest, and whether more matched. Overlay whiteouts, which record
+// deleted files, are skipped.
+func Search(root string, glob string, limit int) ([]Result, bool, error) {
+	if _, err := Match(glob, "/"); err != nil {
+		return nil, false, fmt.Errorf("invalid glob %q: %w", glob, err)
+	}
+
+	var results []Result
+	truncated := false
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		guestPath := "/" + filepath.ToSlash(rel)
+		if matched, _ := Match(glob, guestPath); !matched {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode()&fs.ModeCharDevice != 0 && st.Rdev == 0 {
+			return nil
+		}
+		if len(results) == limit {
+			truncated = true
+			return filepath.SkipAll
+		}
+		result := Result{Path: guestPath, Dir: d.IsDir(), ModTime: info.ModTime().Unix()}
+		if info.Mode().IsRegular() {
+			result.Size = info.Size()
+		}
+		results = append(results, result)
+		return nil
+	})
+	return results, truncated, err
+}
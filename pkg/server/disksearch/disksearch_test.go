@@ -0,0 +1,64 @@
+package disksearch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		glob, path string
+		want       bool
+	}{
+		{"*.log", "/var/log/app.log", true},
+		{"*.log", "/var/log/app.txt", false},
+		{"/home/*/out/*.tar", "/home/elara/out/build.tar", true},
+		{"/home/*/out/*.tar", "/home/elara/src/out/build.tar", false},
+		{"/home/elara", "/home/elara", true},
+	} {
+		if got, err := Match(tc.glob, tc.path); err != nil || got != tc.want {
+			t.Errorf("Match(%q, %q) = %v, %v, want %v", tc.glob, tc.path, got, err, tc.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"home/elara/a.log":     "aaa",
+		"home/elara/b.log":     "b",
+		"home/elara/notes.txt": "n",
+		"var/log/c.log":        "cc",
+	} {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, truncated, err := Search(root, "*.log", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated || len(results) != 3 || results[0].Path != "/home/elara/a.log" || results[0].Size != 3 {
+		t.Errorf("Search = %+v, %v", results, truncated)
+	}
+
+	results, truncated, err = Search(root, "*.log", 2)
+	if err != nil || len(results) != 2 || !truncated {
+		t.Errorf("Search with a limit = %+v, %v, %v", results, truncated, err)
+	}
+
+	results, _, err = Search(root, "/home/elara", 10)
+	if err != nil || len(results) != 1 || !results[0].Dir {
+		t.Errorf("Search of a directory = %+v, %v", results, err)
+	}
+
+	if _, _, err := Search(root, "[", 10); err == nil {
+		t.Error("Search accepted an invalid glob")
+	}
+}
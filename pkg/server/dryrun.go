@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+)
+
+// What a VM start would do.
+const (
+	dryRunActionCreate  = "create"
+	dryRunActionRestore = "restore"
+	dryRunActionBoot    = "boot"
+)
+
+// DryRunVM checks a start request the way StartVM would, against the host's
+// admission capacity, the kernel, rootfs and snapshot it needs, and the free
+// IPs and host ports, and returns the fully resolved spec it would launch.
+// Nothing is created or reserved, so a valid dry run doesn't guarantee that
+// the start succeeds. Problems are reported in the response rather than as
+// an error so that callers see all of them at once.
+func (s *Server) DryRunVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.DryRunVMResponse, error) {
+	vmName := s.ResolveVMName(req.GetVmName())
+	if vmName == "" {
+		return nil, status.Error(codes.InvalidArgument, "vmName is required")
+	}
+
+	var problems []string
+	addProblem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	resp := &serverapi.DryRunVMResponse{
+		VmName:         serverapi.PtrString(vmName),
+		Owner:          serverapi.PtrString(req.GetOwner()),
+		StatefulSizeMb: serverapi.PtrInt32(s.config.StatefulSizeInMB),
+		NetworkBackend: serverapi.PtrString(s.network.Name()),
+		Arch:           serverapi.PtrString(s.arch),
+	}
+	if err := s.checkArch(req.GetArch()); err != nil {
+		addProblem("%s", status.Convert(err).Message())
+	}
+
+	existing := s.getVMAtomic(vmName)
+	switch {
+	case existing != nil:
+		// Starting an existing VM boots it again with what it was created
+		// with.
+		resp.Action = serverapi.PtrString(dryRunActionBoot)
+		existing.lock.RLock()
+		vmState := existing.status
+		existingHypervisor := existing.hypervisor.Name()
+		existing.lock.RUnlock()
+		if vmState == vmStatusRunning || vmState == vmStatusPaused {
+			addProblem("vm %s is already %s", vmName, vmState)
+		}
+		resp.Hypervisor = serverapi.PtrString(existingHypervisor)
+		if name := req.GetHypervisor(); name != "" && name != existingHypervisor {
+			addProblem("vm %s already exists on %s", vmName, existingHypervisor)
+		}
+	case req.GetSnapshotId() != "":
+		resp.Action = serverapi.PtrString(dryRunActionRestore)
+		resp.SnapshotId = serverapi.PtrString(req.GetSnapshotId())
+		snapshotPath := path.Join(s.config.StateDir, "snapshots", req.GetSnapshotId())
+		if _, err := os.Stat(snapshotPath); err != nil {
+			addProblem("snapshot %s not found", req.GetSnapshotId())
+		} else if err := s.checkSnapshotArch(req.GetSnapshotId()); err != nil {
+			addProblem("%s", status.Convert(err).Message())
+		} else if err := s.checkSnapshotHypervisor(req.GetSnapshotId(), req.GetHypervisor()); err != nil {
+			addProblem("%s", status.Convert(err).Message())
+		} else if h, err := s.snapshotHypervisor(req.GetSnapshotId()); err == nil {
+			resp.Hypervisor = serverapi.PtrString(h.Name())
+		}
+	default:
+		resp.Action = serverapi.PtrString(dryRunActionCreate)
+		if h, err := s.pickHypervisor(req.GetHypervisor()); err != nil {
+			addProblem("%s", status.Convert(err).Message())
+		} else {
+			resp.Hypervisor = serverapi.PtrString(h.Name())
+		}
+		kernelPath, rootfsPath, initramfsPath := req.GetKernel(), req.GetRootfs(), req.GetInitramfs()
+		if kernelPath == "" {
+			kernelPath = s.config.KernelPath
+		}
+		if rootfsPath == "" {
+			rootfsPath = s.config.RootfsPath
+		}
+		if initramfsPath == "" {
+			initramfsPath = s.config.InitramfsPath
+		}
+		resp.Kernel = serverapi.PtrString(kernelPath)
+		resp.Rootfs = serverapi.PtrString(rootfsPath)
+		resp.Initramfs = serverapi.PtrString(initramfsPath)
+		for _, file := range []struct{ what, path string }{
+			{"kernel", kernelPath},
+			{"rootfs", rootfsPath},
+			{"initramfs", initramfsPath},
+		} {
+			if _, err := os.Stat(file.path); err != nil {
+				addProblem("%s %s not found", file.what, file.path)
+			}
+		}
+	}
+
+	if existing == nil {
+		if _, queued := s.queuePosition(vmName); queued {
+			addProblem("vm %s is already queued", vmName)
+		} else if s.bootProgress(vmName) != nil {
+			addProblem("vm %s is already being created", vmName)
+		}
+	}
+
+	resp.Vcpus = serverapi.PtrInt32(calculateVCPUCount())
+	if memoryMB, err := calculateGuestMemorySizeInMB(s.config.GuestMemPercentage); err != nil {
+		addProblem("failed to calculate guest memory size: %v", err)
+	} else {
+		resp.MemoryMb = serverapi.PtrInt32(memoryMB)
+	}
+
+	// Existing VMs already hold their reservation, IP and ports.
+	if existing == nil {
+		if err := s.checkTenantQuota(req); err != nil {
+			addProblem("%v", err)
+		}
+		if s.admission != nil {
+			admissionReq, err := s.admissionRequest(req)
+			if err == nil {
+				err = s.admission.Check(admissionReq)
+			}
+			if err != nil {
+				addProblem("admission: %v", err)
+			}
+		}
+		if s.ipAllocator.Available() == 0 {
+			addProblem("no guest IPs left in %s", s.config.BridgeSubnet)
+		}
+
+		specs, err := expandPortForwards(s.config.PortForwards)
+		if err != nil {
+			addProblem("port forwards: %v", err)
+		}
+		if available := s.portAllocator.Available(); available < len(specs) {
+			addProblem("port forwards need %d host ports, %d are free", len(specs), available)
+		}
+		resp.PortForwards = make([]serverapi.PortForward, 0, len(specs))
+		for _, spec := range specs {
+			resp.PortForwards = append(resp.PortForwards, serverapi.PortForward{
+				GuestPort:   serverapi.PtrString(strconv.FormatInt(spec.port, 10)),
+				Description: serverapi.PtrString(spec.portForwardDesc),
+				Service:     convertPortForwardService(spec.service, int32(spec.port)),
+			})
+		}
+	}
+
+	if _, err := s.vmKernelArgs(req); err != nil {
+		addProblem("kernel args: %s", status.Convert(err).Message())
+	} else if existing == nil && req.GetSnapshotId() != "" && len(req.GetKernelArgs()) > 0 {
+		addProblem("kernelArgs can't be changed when restoring a snapshot")
+	}
+
+	if len(req.GetDevices()) > 0 {
+		if existing != nil {
+			addProblem("vm %s already exists, devices can only be added when it is created", vmName)
+		} else if req.GetSnapshotId() != "" {
+			addProblem("devices can't be added when restoring a snapshot")
+		}
+		if len(req.GetDevices()) > maxExtraDevices {
+			addProblem("%d devices requested, at most %d are supported", len(req.GetDevices()), maxExtraDevices)
+		}
+		for i, d := range req.GetDevices() {
+			if err := s.validateDeviceRequest(d); err != nil {
+				addProblem("device %d: %s", i, status.Convert(err).Message())
+			}
+		}
+	}
+
+	if policy, err := s.egressPolicy(req.Egress, time.Now()); err != nil {
+		addProblem("egress: %s", status.Convert(err).Message())
+	} else if policy != nil && existing != nil {
+		addProblem("vm %s already exists, its egress can only be restricted when it is created", vmName)
+	}
+
+	mounts, err := s.objectMounts(req.GetObjectMounts())
+	if err != nil {
+		addProblem("object mounts: %s", status.Convert(err).Message())
+	}
+	for _, mount := range mounts {
+		resp.ObjectMounts = append(resp.ObjectMounts, mount.Name)
+	}
+
+	resp.Valid = serverapi.PtrBool(len(problems) == 0)
+	resp.Problems = problems
+	return resp, nil
+}
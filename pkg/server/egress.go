@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/egress"
+	"github.com/abshkbh/arrakis/pkg/server/hostnet"
+)
+
+const (
+	// egressEnforceInterval is how late egress may be blocked or allowed
+	// once a window opens or closes or an enable runs out.
+	egressEnforceInterval          = 5 * time.Second
+	defaultEgressEnableDuration    = 10 * time.Minute
+	defaultMaxEgressEnableDuration = time.Hour
+)
+
+// egressPolicy returns the egress policy a VM is launched with, or nil if its
+// egress isn't restricted.
+func (s *Server) egressPolicy(req *serverapi.EgressPolicy, now time.Time) (*egress.Policy, error) {
+	if req == nil || (!req.GetRestricted() && len(req.GetWindows()) == 0) {
+		return nil, nil
+	}
+	if s.network.Name() == hostnet.BackendExternal {
+		return nil, status.Errorf(codes.FailedPrecondition, "egress can't be restricted: %v", hostnet.ErrEgressControlUnsupported)
+	}
+	windows := make([]egress.Window, 0, len(req.GetWindows()))
+	for _, w := range req.GetWindows() {
+		windows = append(windows, egress.Window{Start: w.GetStart(), End: w.GetEnd()})
+	}
+	policy, err := egress.NewPolicy(windows, now)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return policy, nil
+}
+
+// restrictEgress puts a VM under an egress policy. It's applied before the VM
+// boots so that it never reaches out unless allowed.
+func (s *Server) restrictEgress(vm *vm, policy *egress.Policy) error {
+	if policy == nil {
+		return nil
+	}
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	vm.egressPolicy = policy
+	if err := s.enforceEgress(vm, time.Now()); err != nil {
+		return status.Errorf(codes.Internal, "failed to restrict egress: %v", err)
+	}
+	return nil
+}
+
+// enforceEgress blocks or allows the egress of a VM as its policy says at
+// now. The caller must hold the VM's lock.
+func (s *Server) enforceEgress(vm *vm, now time.Time) error {
+	blocked := vm.egressPolicy != nil && !vm.egressPolicy.Allowed(now)
+	if blocked == vm.egressBlocked {
+		return nil
+	}
+	guestIP := vm.ip.IP.String()
+	var err error
+	if blocked {
+		err = s.network.BlockEgress(guestIP)
+	} else {
+		err = s.network.AllowEgress(guestIP)
+	}
+	if err != nil {
+		return err
+	}
+	vm.egressBlocked = blocked
+	log.WithFields(log.Fields{"vmName": vm.name, "blocked": blocked}).Info("Changed VM egress")
+	return nil
+}
+
+// releaseEgress lifts the egress block of a VM being destroyed, so that it
+// doesn't outlive the VM and cut off the next one to get its IP.
+func (s *Server) releaseEgress(vm *vm) {
+	vm.lock.Lock()
+	restricted := vm.egressPolicy != nil
+	vm.egressPolicy = nil
+	vm.egressBlocked = false
+	vm.lock.Unlock()
+	if !restricted {
+		return
+	}
+	if err := s.network.AllowEgress(vm.ip.IP.String()); err != nil {
+		log.WithError(err).Errorf("failed to remove egress block of IP: %s", vm.ip.String())
+	}
+}
+
+// EnforceEgressPeriodically opens and closes the egress of restricted VMs as
+// their windows and enables start and run out, until ctx is done.
+func (s *Server) EnforceEgressPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(egressEnforceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.lock.RLock()
+			vms := make([]*vm, 0, len(s.vms))
+			for _, vm := range s.vms {
+				vms = append(vms, vm)
+			}
+			s.lock.RUnlock()
+
+			for _, vm := range vms {
+				vm.lock.Lock()
+				if vm.egressPolicy != nil {
+					vm.egressPolicy.Prune(now)
+					if err := s.enforceEgress(vm, now); err != nil {
+						log.WithField("vmName", vm.name).WithError(err).Error("Failed to enforce egress policy")
+					}
+				}
+				vm.lock.Unlock()
+			}
+		}
+	}
+}
+
+// VMNetwork returns the egress policy of a VM and whether it currently
+// allows egress.
+func (s *Server) VMNetwork(ctx context.Context, vmName string) (*serverapi.VmNetworkResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	defer vm.lock.RUnlock()
+	return convertEgressPolicy(vm, time.Now()), nil
+}
+
+// EnableVMNetwork allows a VM with restricted egress to reach beyond the host
+// for duration, or the configured default if 0, replacing any earlier
+// enable.
+func (s *Server) EnableVMNetwork(ctx context.Context, vmName string, duration time.Duration) (*serverapi.VmNetworkResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if duration == 0 {
+		duration = s.config.Egress.DefaultEnableDuration
+		if duration == 0 {
+			duration = defaultEgressEnableDuration
+		}
+	}
+	maxDuration := s.config.Egress.MaxEnableDuration
+	if maxDuration == 0 {
+		maxDuration = defaultMaxEgressEnableDuration
+	}
+	if duration < 0 || duration > maxDuration {
+		return nil, status.Errorf(codes.InvalidArgument, "egress can be enabled for up to %s", maxDuration)
+	}
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	if vm.egressPolicy == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "egress of vm %s isn't restricted", vmName)
+	}
+	now := time.Now()
+	vm.egressPolicy.EnabledUntil = now.Add(duration)
+	if err := s.enforceEgress(vm, now); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to enable egress: %v", err)
+	}
+	log.WithFields(log.Fields{"vmName": vmName, "until": vm.egressPolicy.EnabledUntil}).Info("Enabled VM egress")
+	return convertEgressPolicy(vm, now), nil
+}
+
+// DisableVMNetwork cuts a VM off from beyond the host, ending its enable and
+// current window, if any. VMs whose egress wasn't restricted become so, with
+// no windows.
+func (s *Server) DisableVMNetwork(ctx context.Context, vmName string) (*serverapi.VmNetworkResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	if s.network.Name() == hostnet.BackendExternal {
+		return nil, status.Errorf(codes.FailedPrecondition, "egress can't be disabled: %v", hostnet.ErrEgressControlUnsupported)
+	}
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+	now := time.Now()
+	if vm.egressPolicy == nil {
+		vm.egressPolicy = &egress.Policy{}
+	}
+	vm.egressPolicy.EnabledUntil = time.Time{}
+	vm.egressPolicy.Prune(now)
+	windows := vm.egressPolicy.Windows[:0]
+	for _, w := range vm.egressPolicy.Windows {
+		if w.Start.After(now) {
+			windows = append(windows, w)
+		}
+	}
+	vm.egressPolicy.Windows = windows
+	if err := s.enforceEgress(vm, now); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to disable egress: %v", err)
+	}
+	log.WithField("vmName", vmName).Info("Disabled VM egress")
+	return convertEgressPolicy(vm, now), nil
+}
+
+// convertEgressPolicy describes the egress of a VM. The caller must hold the
+// VM's lock.
+func convertEgressPolicy(vm *vm, now time.Time) *serverapi.VmNetworkResponse {
+	resp := &serverapi.VmNetworkResponse{
+		VmName:        serverapi.PtrString(vm.name),
+		Restricted:    serverapi.PtrBool(vm.egressPolicy != nil),
+		EgressAllowed: serverapi.PtrBool(!vm.egressBlocked),
+	}
+	policy := vm.egressPolicy
+	if policy == nil {
+		return resp
+	}
+	if now.Before(policy.EnabledUntil) {
+		resp.EnabledUntil = serverapi.PtrTime(policy.EnabledUntil)
+	}
+	for _, w := range policy.Windows {
+		if w.End.After(now) {
+			resp.Windows = append(resp.Windows, serverapi.EgressWindow{
+				Start: serverapi.PtrTime(w.Start),
+				End:   serverapi.PtrTime(w.End),
+			})
+		}
+	}
+	if next := policy.NextChange(now); !next.IsZero() {
+		resp.NextChange = serverapi.PtrTime(next)
+	}
+	return resp
+}
@@ -0,0 +1,108 @@
+// Package egress decides when a VM whose egress is restricted may reach
+// beyond the host: during the windows declared for it, or for a while after
+// it was explicitly enabled, e.g. to fetch dependencies and then run
+// isolated.
+package egress
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MaxWindows bounds the windows of a policy.
+const MaxWindows = 16
+
+// Window is a period during which egress is allowed.
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (w Window) contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// Policy is the egress policy of a restricted VM. The zero value allows no
+// egress.
+type Policy struct {
+	// Windows are sorted by start and don't overlap.
+	Windows []Window
+	// EnabledUntil is when an explicit enable runs out.
+	EnabledUntil time.Time
+}
+
+// NewPolicy returns a policy allowing egress during windows, which must
+// each end after they start and after now. Overlapping windows are merged.
+func NewPolicy(windows []Window, now time.Time) (*Policy, error) {
+	if len(windows) > MaxWindows {
+		return nil, fmt.Errorf("%d egress windows, at most %d are supported", len(windows), MaxWindows)
+	}
+	sorted := make([]Window, 0, len(windows))
+	for _, w := range windows {
+		if !w.End.After(w.Start) {
+			return nil, fmt.Errorf("egress window %s - %s ends before it starts", w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339))
+		}
+		if !w.End.After(now) {
+			return nil, fmt.Errorf("egress window %s - %s is over", w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339))
+		}
+		sorted = append(sorted, w)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Before(sorted[j].Start) })
+
+	p := &Policy{}
+	for _, w := range sorted {
+		if n := len(p.Windows); n > 0 && !w.Start.After(p.Windows[n-1].End) {
+			if w.End.After(p.Windows[n-1].End) {
+				p.Windows[n-1].End = w.End
+			}
+			continue
+		}
+		p.Windows = append(p.Windows, w)
+	}
+	return p, nil
+}
+
+// Allowed reports whether egress is allowed at now.
+func (p *Policy) Allowed(now time.Time) bool {
+	if now.Before(p.EnabledUntil) {
+		return true
+	}
+	for _, w := range p.Windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextChange returns when Allowed next changes after now, or the zero time if
+// it never does.
+func (p *Policy) NextChange(now time.Time) time.Time {
+	allowed := p.Allowed(now)
+	var changes []time.Time
+	if now.Before(p.EnabledUntil) {
+		changes = append(changes, p.EnabledUntil)
+	}
+	for _, w := range p.Windows {
+		changes = append(changes, w.Start, w.End)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Before(changes[j]) })
+	for _, t := range changes {
+		if t.After(now) && p.Allowed(t) != allowed {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Prune drops the windows that are over at now.
+func (p *Policy) Prune(now time.Time) {
+	windows := p.Windows[:0]
+	for _, w := range p.Windows {
+		if w.End.After(now) {
+			windows = append(windows, w)
+		}
+	}
+	p.Windows = windows
+}
@@ -0,0 +1,65 @@
+package egress
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return now.Add(time.Duration(minutes) * time.Minute) }
+
+	p, err := NewPolicy([]Window{
+		{Start: at(30), End: at(40)},
+		{Start: at(-5), End: at(10)},
+		{Start: at(5), End: at(15)},
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Windows) != 2 || !p.Windows[0].End.Equal(at(15)) {
+		t.Fatalf("Windows = %+v, want the overlapping ones merged", p.Windows)
+	}
+
+	for minutes, want := range map[int]bool{0: true, 14: true, 15: false, 29: false, 30: true, 40: false} {
+		if got := p.Allowed(at(minutes)); got != want {
+			t.Errorf("Allowed(+%dm) = %v, want %v", minutes, got, want)
+		}
+	}
+	if got := p.NextChange(now); !got.Equal(at(15)) {
+		t.Errorf("NextChange(now) = %v, want +15m", got)
+	}
+	if got := p.NextChange(at(40)); !got.IsZero() {
+		t.Errorf("NextChange after the last window = %v, want none", got)
+	}
+
+	// An explicit enable bridges the gap between the windows.
+	p.EnabledUntil = at(35)
+	if !p.Allowed(at(20)) {
+		t.Error("Not allowed while enabled")
+	}
+	if got := p.NextChange(now); !got.Equal(at(40)) {
+		t.Errorf("NextChange(now) while enabled = %v, want +40m", got)
+	}
+
+	p.Prune(at(20))
+	if len(p.Windows) != 1 {
+		t.Errorf("Prune kept %+v", p.Windows)
+	}
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	now := time.Now()
+	for name, windows := range map[string][]Window{
+		"reversed": {{Start: now.Add(time.Hour), End: now}},
+		"over":     {{Start: now.Add(-time.Hour), End: now}},
+		"too many": make([]Window, MaxWindows+1),
+	} {
+		if _, err := NewPolicy(windows, now); err == nil {
+			t.Errorf("NewPolicy(%s) succeeded", name)
+		}
+	}
+	if p, err := NewPolicy(nil, now); err != nil || p.Allowed(now) {
+		t.Errorf("NewPolicy(nil) = %+v, %v, want a policy allowing nothing", p, err)
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/arch"
+	"github.com/abshkbh/arrakis/pkg/server/hypervisor"
+	"github.com/abshkbh/arrakis/pkg/server/operations"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+	"github.com/abshkbh/arrakis/pkg/server/vmarchive"
+	"github.com/abshkbh/arrakis/pkg/server/workdir"
+)
+
+// VMExport is an archive of a VM, ready to be streamed.
+type VMExport struct {
+	// Filename is a name to save the archive as.
+	Filename string
+	manifest vmarchive.Manifest
+	dir      string
+	s        *Server
+}
+
+// WriteTo writes the archive to w.
+func (e *VMExport) WriteTo(w io.Writer) error {
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			paths = append(paths, path.Join(e.dir, entry.Name()))
+		}
+	}
+	return vmarchive.Write(w, e.manifest, paths)
+}
+
+// Close removes what was set aside for the archive.
+func (e *VMExport) Close() {
+	e.s.endTransfer(path.Base(e.dir))
+}
+
+// beginTransfer creates the snapshot dir id for an export or import, which
+// garbage collection leaves alone until endTransfer removes it.
+func (s *Server) beginTransfer(id string) (string, error) {
+	s.lock.Lock()
+	s.transfers[id] = true
+	s.lock.Unlock()
+	dir := path.Join(s.config.StateDir, "snapshots", id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		s.endTransfer(id)
+		return "", err
+	}
+	return dir, nil
+}
+
+func (s *Server) endTransfer(id string) {
+	if err := os.RemoveAll(path.Join(s.config.StateDir, "snapshots", id)); err != nil {
+		log.WithField("snapshotId", id).WithError(err).Warn("Failed to remove transfer dir")
+	}
+	s.lock.Lock()
+	delete(s.transfers, id)
+	s.lock.Unlock()
+}
+
+// ExportVM archives a VM to move it to another host with ImportVM. The
+// archive holds its stateful disk and spec, and with memory, a snapshot of
+// the running VM so that it carries on where it left off on import.
+// Without memory, the VM must be stopped, so that its disk is consistent.
+// The archive is prepared on disk before it is streamed, the VM can change
+// as soon as ExportVM returns.
+func (s *Server) ExportVM(ctx context.Context, vmName string, memory bool) (*VMExport, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	logger := log.WithField("vmName", vmName)
+
+	spec, err := s.VMSpec(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to marshal spec: %v", err)
+	}
+
+	vm.lock.RLock()
+	manifest := vmarchive.Manifest{
+		VMName:     vm.name,
+		VMID:       vm.id,
+		Owner:      vm.owner,
+		Arch:       s.arch,
+		Hypervisor: vm.hypervisor.Name(),
+		Memory:     memory,
+		Spec:       specJSON,
+		ExportedAt: time.Now().UTC(),
+	}
+	vmStatus := vm.status
+	vm.lock.RUnlock()
+
+	id := "export-" + newVMID()
+	if memory {
+		if vmStatus != vmStatusRunning && vmStatus != vmStatusPaused {
+			return nil, status.Errorf(codes.FailedPrecondition, "vm %s is %s, export it without memory", vmName, vmStatus)
+		}
+		s.lock.Lock()
+		s.transfers[id] = true
+		s.lock.Unlock()
+		s.snapshotting.Add(1)
+		_, err := s.snapshotVM(ctx, vmName, id)
+		s.snapshotting.Add(-1)
+		if err != nil {
+			s.endTransfer(id)
+			return nil, err
+		}
+		// The snapshot only lives as long as the export.
+		s.forgetSnapshot(ctx, id)
+	} else {
+		dir, err := s.beginTransfer(id)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create export dir: %v", err)
+		}
+		// Hold the VM's lock so that it isn't booted while its disk is copied.
+		vm.lock.RLock()
+		if vm.status != vmStatusStopped && vm.status != vmStatusCreated {
+			err = status.Errorf(codes.FailedPrecondition, "vm %s is %s, stop it or export it with memory", vmName, vm.status)
+		} else if vm.statefulDiskPath == "" {
+			err = status.Errorf(codes.FailedPrecondition, "vm %s has no stateful disk", vmName)
+		} else {
+			operations.SetProgress(ctx, "copying stateful disk")
+			err = copyFile(vm.statefulDiskPath, path.Join(dir, statefulDiskFilename))
+		}
+		vm.lock.RUnlock()
+		if err != nil {
+			s.endTransfer(id)
+			if _, ok := status.FromError(err); !ok {
+				err = status.Errorf(codes.Internal, "failed to copy stateful disk: %v", err)
+			}
+			return nil, err
+		}
+	}
+
+	logger.WithFields(log.Fields{"memory": memory, "exportId": id}).Info("Prepared VM export")
+	vm.record(timeline.KindDownload, "export", "VM exported", map[string]string{"memory": strconv.FormatBool(memory)})
+	return &VMExport{
+		Filename: vmName + ".tar.gz",
+		manifest: manifest,
+		dir:      path.Join(s.config.StateDir, "snapshots", id),
+		s:        s,
+	}, nil
+}
+
+// defaultMaxImportSizeInMB bounds the archives VMs are imported from unless
+// configured.
+const defaultMaxImportSizeInMB = 64 << 10
+
+// MaxImportSize is the size in bytes the archives VMs are imported from may
+// be, uploaded and extracted.
+func (s *Server) MaxImportSize() int64 {
+	if s.config.Import.MaxSizeInMB > 0 {
+		return s.config.Import.MaxSizeInMB << 20
+	}
+	return defaultMaxImportSizeInMB << 20
+}
+
+// importedDiskKey carries the stateful disk of an imported VM to createVM.
+type importedDiskKey struct{}
+
+// importedDisk returns the stateful disk a VM created with ctx is imported
+// with, or "" if it gets a new one.
+func importedDisk(ctx context.Context) string {
+	p, _ := ctx.Value(importedDiskKey{}).(string)
+	return p
+}
+
+// ImportVM recreates a VM from an archive of ExportVM read from r, named
+// vmName, or as in the archive if empty. VMs exported with memory are
+// restored from their snapshot and keep their IP, which must be free on this
+// host; others boot the host's kernel and rootfs with their stateful disk.
+func (s *Server) ImportVM(ctx context.Context, r io.Reader, vmName string, owner string) (*serverapi.ImportVMResponse, error) {
+	if vmName != "" {
+		if err := validateVMName(vmName); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if s.getVMAtomic(vmName) != nil {
+			return nil, status.Errorf(codes.AlreadyExists, "vm %s already exists", vmName)
+		}
+	}
+	// Refused before the archive is read.
+	if err := s.CheckCordon(""); err != nil {
+		return nil, err
+	}
+
+	id := "import-" + newVMID()
+	dir, err := s.beginTransfer(id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create import dir: %v", err)
+	}
+	defer s.endTransfer(id)
+
+	operations.SetProgress(ctx, "extracting archive")
+	manifest, err := vmarchive.Extract(r, dir, s.MaxImportSize())
+	if errors.Is(err, vmarchive.ErrTooLarge) || errors.As(err, new(*http.MaxBytesError)) {
+		return nil, status.Errorf(codes.OutOfRange, "archive larger than %d bytes", s.MaxImportSize())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid archive: %v", err)
+	}
+	if vmName == "" {
+		vmName = manifest.VMName
+		if err := validateVMName(vmName); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "archive: %v", err)
+		}
+		if s.getVMAtomic(vmName) != nil {
+			return nil, status.Errorf(codes.AlreadyExists, "vm %s already exists, import it under another name", vmName)
+		}
+	}
+	if err := arch.Check(manifest.Arch, s.arch); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "archive: %v", err)
+	}
+	if owner == "" {
+		owner = manifest.Owner
+	}
+	logger := log.WithFields(log.Fields{
+		"vmName": vmName,
+		"from":   manifest.VMName,
+		"memory": manifest.Memory,
+	})
+	logger.Info("Importing VM")
+
+	req := &serverapi.StartVMRequest{
+		VmName:     serverapi.PtrString(vmName),
+		Hypervisor: serverapi.PtrString(manifest.Hypervisor),
+	}
+	if owner != "" {
+		req.SetOwner(owner)
+	}
+	if manifest.Memory {
+		// The snapshot's config names the files the VMM opens on restore, as
+		// root, so they are replaced by this host's and the new VM's. Only
+		// Cloud Hypervisor's config can be rewritten, Firecracker's is in
+		// its binary state.
+		h, err := s.snapshotHypervisor(id)
+		if err != nil {
+			return nil, err
+		}
+		if h.Name() != hypervisor.CloudHypervisor {
+			return nil, status.Errorf(codes.FailedPrecondition, "VMs of %s can only be imported without memory", h.Name())
+		}
+		layout := workdir.New(s.config.StateDir, vmName)
+		if err := vmarchive.RelocateCHVConfig(dir, vmarchive.HostPaths{
+			Kernel:       s.config.KernelPath,
+			Initramfs:    s.config.InitramfsPath,
+			Rootfs:       s.config.RootfsPath,
+			StatefulDisk: layout.Disk(statefulDiskFilename),
+			VsockSocket:  layout.VsockSocket(),
+		}); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid archive: %v", err)
+		}
+		req.SetSnapshotId(id)
+	} else {
+		if _, err := os.Stat(path.Join(dir, statefulDiskFilename)); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid archive: it has no stateful disk")
+		}
+		ctx = context.WithValue(ctx, importedDiskKey{}, path.Join(dir, statefulDiskFilename))
+	}
+	resp, err := s.StartVM(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Imported VM")
+	return &serverapi.ImportVMResponse{
+		VmName:        resp.VmName,
+		VmId:          resp.VmId,
+		Ip:            resp.Ip,
+		Status:        resp.Status,
+		TapDeviceName: resp.TapDeviceName,
+		PortForwards:  resp.PortForwards,
+		Memory:        serverapi.PtrBool(manifest.Memory),
+		ExportedFrom:  serverapi.PtrString(manifest.VMName),
+	}, nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+)
+
+const (
+	// Bounds probing whether a guest listens on an exposed port.
+	exposureProbeTimeout = 500 * time.Millisecond
+)
+
+// attributePortForwards records who the VM's port forwards were set up for.
+func (v *vm) attributePortForwards(createdBy string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for i := range v.portForwards {
+		v.portForwards[i].createdBy = createdBy
+	}
+}
+
+// VMExposure reports the host ports through which a VM can be reached, who
+// they were set up for and when, and whether the guest accepts connections on
+// them, so that operators can audit what each sandbox exposes.
+func (s *Server) VMExposure(ctx context.Context, vmName string) (*serverapi.VmExposureResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.RLock()
+	vmIP := vm.ip.IP.String()
+	portForwards := append([]portForward(nil), vm.portForwards...)
+	vm.lock.RUnlock()
+
+	resp := &serverapi.VmExposureResponse{
+		VmName:   serverapi.PtrString(vmName),
+		Ip:       serverapi.PtrString(vmIP),
+		Exposure: make([]serverapi.VmExposedPort, len(portForwards)),
+	}
+	var wg sync.WaitGroup
+	for i, pf := range portForwards {
+		resp.Exposure[i] = serverapi.VmExposedPort{
+			Kind:        serverapi.PtrString("port_forward"),
+			HostPort:    serverapi.PtrInt32(pf.hostPort),
+			GuestPort:   serverapi.PtrInt32(pf.guestPort),
+			Description: serverapi.PtrString(pf.description),
+			CreatedBy:   serverapi.PtrString(pf.createdBy),
+			CreatedAt:   serverapi.PtrTime(pf.createdAt),
+		}
+		wg.Add(1)
+		go func(exposed *serverapi.VmExposedPort, guestPort int32) {
+			defer wg.Done()
+			exposed.Listening = serverapi.PtrBool(probePort(ctx, vmIP, guestPort))
+		}(&resp.Exposure[i], pf.guestPort)
+	}
+	wg.Wait()
+	return resp, nil
+}
+
+// probePort reports whether something in the guest accepts TCP connections
+// on port.
+func probePort(ctx context.Context, ip string, port int32) bool {
+	dialer := net.Dialer{Timeout: exposureProbeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, fmt.Sprint(port)))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,19 @@
+package server
+
+// Features reports which optional features the server has configured, by
+// name, for clients to probe before relying on them.
+func (s *Server) Features() map[string]bool {
+	return map[string]bool{
+		"admission":        s.admission != nil,
+		"artifact_uploads": s.artifactStore != nil,
+		"scan":             s.scanner != nil,
+		"ocr":              s.ocr != nil,
+		"notifications":    s.notifier != nil,
+		"soft_delete":      s.config.SoftDelete.Retention > 0,
+		"async_operations": true,
+		"host_cordon":      true,
+		"vm_ids":           true,
+		"list_revisions":   true,
+		"audit_export":     s.audit != nil,
+	}
+}
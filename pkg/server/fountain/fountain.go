@@ -108,6 +108,28 @@ func (f *Fountain) claimID(id int32) error {
 	return nil
 }
 
+// IsAllocated reports whether the tap device with the given name was created
+// by the fountain and not destroyed since.
+func (f *Fountain) IsAllocated(deviceName string) bool {
+	var id int32
+	if _, err := fmt.Sscanf(deviceName, "tap%d", &id); err != nil || deviceName != fmt.Sprintf("tap%d", id) {
+		return false
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if id < f.lowID || id > f.highID {
+		return false
+	}
+	for _, i := range f.available {
+		if i == id {
+			return false
+		}
+	}
+	return true
+}
+
 // CreateTapDevice creates a new tap device with an auto-allocated ID and returns a TapDevice
 // If id is provided, it will attempt to claim that specific ID instead of auto-allocating
 func (f *Fountain) CreateTapDevice(id *int32) (*TapDevice, error) {
@@ -163,6 +185,31 @@ func (f *Fountain) CreateTapDevice(id *int32) (*TapDevice, error) {
 	}, nil
 }
 
+// AdoptTapDevice takes over the existing tap device deviceName, e.g. of a VM
+// started outside of the fountain, claiming its ID and adding it to the
+// bridge. Only devices named "tap<id>" can be adopted.
+func (f *Fountain) AdoptTapDevice(deviceName string) (*TapDevice, error) {
+	var id int32
+	if _, err := fmt.Sscanf(deviceName, "tap%d", &id); err != nil || deviceName != fmt.Sprintf("tap%d", id) {
+		return nil, fmt.Errorf("tap device %s isn't named tap<id>", deviceName)
+	}
+	if err := f.claimID(id); err != nil {
+		return nil, err
+	}
+
+	if output, err := exec.Command(
+		"ip", "l", "set", "dev", deviceName, "master", f.bridgeDevice,
+	).CombinedOutput(); err != nil {
+		_ = f.freeTapID(id)
+		return nil, fmt.Errorf("failed to add: %v to: %v: %s %w", deviceName, f.bridgeDevice, output, err)
+	}
+
+	return &TapDevice{
+		Name: deviceName,
+		ID:   id,
+	}, nil
+}
+
 // DestroyTapDevice destroys a tap device and frees its ID.
 func (f *Fountain) DestroyTapDevice(device *TapDevice) error {
 	log.WithFields(log.Fields{
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+)
+
+const (
+	// guestEventsWait is how long a fetch of guest events waits in the agent
+	// for a new one.
+	guestEventsWait = 30 * time.Second
+	// guestEventsRetry is how long following guest events waits after the
+	// agent couldn't be reached, e.g. while it restarts.
+	guestEventsRetry = 2 * time.Second
+)
+
+// fetchGuestEvents asks the agent in the guest for the events reported after
+// seq, waiting up to wait for one.
+func (v *vm) fetchGuestEvents(ctx context.Context, seq uint64, wait time.Duration) (cmdserver.GuestEventsResponse, error) {
+	var events cmdserver.GuestEventsResponse
+	v.lock.RLock()
+	vmIP := v.ip.IP.String()
+	v.lock.RUnlock()
+
+	query := url.Values{"after": {strconv.FormatUint(seq, 10)}}
+	if wait > 0 {
+		query.Set("wait", wait.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", v.agent.url(vmIP, "/events?"+query.Encode()), nil)
+	if err != nil {
+		return events, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := v.agent.client(wait + 30*time.Second).Do(req)
+	if err != nil {
+		return events, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return events, fmt.Errorf("request failed with status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		return events, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return events, nil
+}
+
+// VMEvents returns the events workloads in a VM reported after seq through
+// the guest agent, e.g. their progress.
+func (s *Server) VMEvents(ctx context.Context, vmName string, seq uint64) (*cmdserver.GuestEventsResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	events, err := vm.fetchGuestEvents(ctx, seq, 0)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get guest events: %v", err)
+	}
+	return &events, nil
+}
+
+// FollowVMEvents streams the events workloads in a VM report after seq, as
+// they are reported, until ctx is done or the VM is destroyed, which closes
+// the channel. A restarted agent numbers its events from 1 again, which is
+// noticed once it has nothing newer than seq, and followed from its start.
+func (s *Server) FollowVMEvents(ctx context.Context, vmName string, seq uint64) (<-chan cmdserver.GuestEvent, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	events := make(chan cmdserver.GuestEvent)
+	go func() {
+		defer close(events)
+		for ctx.Err() == nil && s.getVMAtomic(vmName) == vm {
+			resp, err := vm.fetchGuestEvents(ctx, seq, guestEventsWait)
+			if err != nil {
+				select {
+				case <-ctx.Done():
+				case <-time.After(guestEventsRetry):
+				}
+				continue
+			}
+			if len(resp.Events) == 0 && seq > 0 {
+				latest, err := vm.fetchGuestEvents(ctx, 0, 0)
+				if err == nil && len(latest.Events) > 0 && latest.Events[len(latest.Events)-1].Seq < seq {
+					seq = 0
+				}
+				continue
+			}
+			for _, event := range resp.Events {
+				select {
+				case events <- event:
+					seq = event.Seq
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
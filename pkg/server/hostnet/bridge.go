@@ -0,0 +1,96 @@
+package hostnet
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// run executes a command, including its output in the error.
+func run(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to execute command '%s %s': %s %w",
+			name, strings.Join(args, " "), strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// linkExists reports whether a network device exists.
+func linkExists(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+// defaultInterface returns the device of the host's default route.
+func defaultInterface() (string, error) {
+	output, err := exec.Command("ip", "-o", "route", "show", "default").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get default route: %w", err)
+	}
+	fields := strings.Fields(string(output))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" {
+			return fields[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("no default route")
+}
+
+// deleteTapDevices deletes all tap devices, which VMs of a previous run left
+// behind.
+func deleteTapDevices() error {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("failed to list interfaces: %v", err)
+	}
+	for _, iface := range interfaces {
+		if !strings.HasPrefix(iface.Name, "tap") {
+			continue
+		}
+		if err := run("ip", "link", "delete", iface.Name); err != nil {
+			log.Warnf("failed to delete tap device %s: %v", iface.Name, err)
+			continue
+		}
+		log.Infof("deleted tap device: %s", iface.Name)
+	}
+	return nil
+}
+
+// deleteBridge deletes the bridge if it exists.
+func deleteBridge(bridge string) error {
+	if !linkExists(bridge) {
+		return nil
+	}
+	if err := run("ip", "link", "delete", bridge); err != nil {
+		return fmt.Errorf("failed to delete bridge %s: %w", bridge, err)
+	}
+	log.Infof("deleted bridge: %s", bridge)
+	return nil
+}
+
+// setupBridge creates the bridge, unless it exists, and enables forwarding
+// between it and hostInterface.
+func setupBridge(c Config, hostInterface string) error {
+	var commands [][]string
+	if !linkExists(c.Bridge) {
+		commands = append(commands,
+			[]string{"ip", "l", "add", c.Bridge, "type", "bridge"},
+			[]string{"ip", "l", "set", c.Bridge, "up"},
+			[]string{"ip", "a", "add", c.BridgeAddress, "dev", c.Bridge, "scope", "host"},
+		)
+	}
+	commands = append(commands,
+		[]string{"sysctl", "-w", fmt.Sprintf("net.ipv4.conf.%s.forwarding=1", hostInterface)},
+		[]string{"sysctl", "-w", fmt.Sprintf("net.ipv4.conf.%s.forwarding=1", c.Bridge)},
+	)
+	for _, cmd := range commands {
+		if err := run(cmd[0], cmd[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package hostnet
+
+import "fmt"
+
+// External is the backend for hosts whose networking is managed by an
+// outside system. It changes nothing on the host: the bridge, its address,
+// NAT and forwarding are expected to be in place, and port forwards, if any,
+// are up to that system.
+type External struct{}
+
+func (External) Name() string {
+	return BackendExternal
+}
+
+func (External) Cleanup(c Config) error {
+	return nil
+}
+
+func (External) Setup(c Config) error {
+	if !linkExists(c.Bridge) {
+		return fmt.Errorf("bridge %s doesn't exist, it must be set up by the external network", c.Bridge)
+	}
+	return nil
+}
+
+func (External) ForwardPort(hostPort int32, guestIP string, guestPort int32) error {
+	return ErrPortForwardingUnsupported
+}
+
+func (External) RemovePortForwards(guestIP string) error {
+	return nil
+}
+
+func (External) BlockEgress(guestIP string) error {
+	return ErrEgressControlUnsupported
+}
+
+func (External) AllowEgress(guestIP string) error {
+	return nil
+}
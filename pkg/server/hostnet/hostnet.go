@@ -0,0 +1,87 @@
+package hostnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Backends that can be selected with New.
+const (
+	// BackendIPTables sets up the bridge with NAT and port forwards as
+	// legacy iptables rules. It is the default.
+	BackendIPTables = "iptables"
+	// BackendNFTables sets up the bridge with NAT and port forwards in a
+	// dedicated nftables table, which it replaces wholesale on startup.
+	BackendNFTables = "nftables"
+	// BackendExternal leaves networking to an outside system, e.g. a CNI
+	// plugin or a host's own firewall management. The bridge must exist and
+	// route the subnet; the server only attaches tap devices to it.
+	BackendExternal = "external"
+)
+
+// ErrPortForwardingUnsupported is returned by backends that can't forward
+// host ports to guests.
+var ErrPortForwardingUnsupported = errors.New("port forwarding is not supported by this network backend")
+
+// ErrEgressControlUnsupported is returned by backends that can't block the
+// egress of guests.
+var ErrEgressControlUnsupported = errors.New("egress control is not supported by this network backend")
+
+// Config describes the bridge VMs are attached to.
+type Config struct {
+	// Bridge is the name of the bridge device.
+	Bridge string
+	// BridgeAddress is the address of the bridge, the guests' gateway, e.g.
+	// "10.20.1.1/24".
+	BridgeAddress string
+	// Subnet is the bridge subnet guests get their addresses from, e.g.
+	// "10.20.1.0/24".
+	Subnet string
+}
+
+// Backend sets up the host side of guest networking: the bridge, NAT of
+// guest traffic, port forwards from the host to guests and blocks of their
+// egress.
+type Backend interface {
+	// Name is the name the backend is selected by.
+	Name() string
+	// Cleanup removes what a previous run of the server left behind.
+	Cleanup(c Config) error
+	// Setup prepares the host for VMs to be attached to the bridge.
+	Setup(c Config) error
+	// ForwardPort forwards TCP connections to hostPort to guestIP:guestPort.
+	ForwardPort(hostPort int32, guestIP string, guestPort int32) error
+	// RemovePortForwards removes all port forwards to guestIP.
+	RemovePortForwards(guestIP string) error
+	// BlockEgress drops the traffic guestIP sends through the host, except
+	// replies on forwarded ports. Connections it already has are cut too.
+	BlockEgress(guestIP string) error
+	// AllowEgress undoes BlockEgress. It succeeds if guestIP isn't blocked.
+	AllowEgress(guestIP string) error
+}
+
+// New returns the backend of the given name. An empty name selects
+// BackendIPTables.
+func New(name string) (Backend, error) {
+	switch name {
+	case "", BackendIPTables:
+		return &IPTables{}, nil
+	case BackendNFTables:
+		return &NFTables{}, nil
+	case BackendExternal:
+		return External{}, nil
+	default:
+		return nil, fmt.Errorf("unknown network backend %q: use %s, %s or %s",
+			name, BackendIPTables, BackendNFTables, BackendExternal)
+	}
+}
+
+// inSubnet returns a matcher for the addresses of subnet.
+func inSubnet(subnet string) (func(ip net.IP) bool, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridge subnet: %w", err)
+	}
+	return ipNet.Contains, nil
+}
@@ -0,0 +1,105 @@
+package hostnet
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	for name, want := range map[string]string{
+		"":         BackendIPTables,
+		"iptables": BackendIPTables,
+		"nftables": BackendNFTables,
+		"external": BackendExternal,
+	} {
+		backend, err := New(name)
+		if err != nil {
+			t.Fatalf("New(%q) failed: %v", name, err)
+		}
+		if backend.Name() != want {
+			t.Errorf("New(%q) = %s, want %s", name, backend.Name(), want)
+		}
+	}
+	if _, err := New("pf"); err == nil {
+		t.Error("New of an unknown backend succeeded")
+	}
+}
+
+func TestDNATDestination(t *testing.T) {
+	for rule, want := range map[string]net.IP{
+		"-A PREROUTING -p tcp -m tcp --dport 3000 -j DNAT --to-destination 10.20.1.2:5901": net.ParseIP("10.20.1.2"),
+		"-A PREROUTING -p tcp -j DNAT --to-destination 10.20.1.3":                          net.ParseIP("10.20.1.3"),
+		"-A PREROUTING -p tcp --dport 22 -j ACCEPT":                                        nil,
+		"-P PREROUTING ACCEPT": nil,
+	} {
+		if got := dnatDestination(rule); !got.Equal(want) {
+			t.Errorf("dnatDestination(%q) = %v, want %v", rule, got, want)
+		}
+	}
+}
+
+func TestNFTForwardHandles(t *testing.T) {
+	listing := `table ip arrakis {
+	chain prerouting { # handle 1
+		type nat hook prerouting priority dstnat; policy accept;
+		tcp dport 3000 dnat to 10.20.1.2:5901 # handle 4
+		tcp dport 3001 dnat to 10.20.1.20:5901 # handle 5
+		tcp dport 3002 dnat to 10.20.1.2:9223 # handle 6
+	}
+}
+`
+	if got, want := nftForwardHandles(listing, "10.20.1.2"), []string{"4", "6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nftForwardHandles = %v, want %v", got, want)
+	}
+	if got := nftForwardHandles(listing, "10.20.1.3"); len(got) != 0 {
+		t.Errorf("nftForwardHandles of an unknown guest = %v", got)
+	}
+}
+
+func TestNFTRuleset(t *testing.T) {
+	ruleset := nftRuleset(Config{Bridge: "br0", BridgeAddress: "10.20.1.1/24", Subnet: "10.20.1.0/24"}, "eth0")
+	for _, want := range []string{
+		"delete table ip arrakis",
+		`ip saddr 10.20.1.0/24 oifname "eth0" masquerade`,
+		"ip daddr 10.20.1.0/24 accept",
+	} {
+		if !strings.Contains(ruleset, want) {
+			t.Errorf("Ruleset lacks %q:\n%s", want, ruleset)
+		}
+	}
+}
+
+func TestEgressBlockSource(t *testing.T) {
+	rule := "-A " + strings.Join(egressBlockRule("10.20.1.2"), " ")
+	for rule, want := range map[string]net.IP{
+		rule:                                   net.ParseIP("10.20.1.2"),
+		"-A FORWARD -s 10.20.1.0/24 -j ACCEPT": nil,
+		"-A FORWARD -s 10.20.1.3/32 -m conntrack --ctstate INVALID -j DROP":   nil,
+		"-A PREROUTING -s 10.20.1.3/32 -m conntrack ! --ctstate DNAT -j DROP": nil,
+		"-A FORWARD -s 10.20.1.4/32 -m conntrack ! --ctstate DNAT -j DROP":    net.ParseIP("10.20.1.4"),
+	} {
+		if got := egressBlockSource(rule); !got.Equal(want) {
+			t.Errorf("egressBlockSource(%q) = %v, want %v", rule, got, want)
+		}
+	}
+}
+
+func TestNFTCommentHandles(t *testing.T) {
+	listing := `table ip arrakis {
+	chain forward { # handle 3
+		type filter hook forward priority filter; policy accept;
+		ip saddr 10.20.1.2 ct status & dnat == 0 drop comment "egress-block 10.20.1.2" # handle 7
+		ip saddr 10.20.1.20 ct status & dnat == 0 drop comment "egress-block 10.20.1.20" # handle 8
+		ip saddr 10.20.1.0/24 accept # handle 9
+	}
+}
+`
+	if got, want := nftCommentHandles(listing, nftEgressComment("10.20.1.2")), []string{"7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nftCommentHandles = %v, want %v", got, want)
+	}
+	if got := nftCommentHandles(listing, nftEgressComment("10.20.1.3")); len(got) != 0 {
+		t.Errorf("nftCommentHandles of an unblocked guest = %v", got)
+	}
+}
@@ -0,0 +1,217 @@
+package hostnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IPTables is the legacy iptables backend. The bridge subnet's NAT and
+// forwarding rules go into the built-in chains, as do port forwards.
+type IPTables struct{}
+
+func (*IPTables) Name() string {
+	return BackendIPTables
+}
+
+func (b *IPTables) Cleanup(c Config) error {
+	if err := deleteTapDevices(); err != nil {
+		return fmt.Errorf("failed to cleanup tap devices: %w", err)
+	}
+	if err := deleteBridge(c.Bridge); err != nil {
+		return fmt.Errorf("failed to cleanup bridge: %w", err)
+	}
+	contains, err := inSubnet(c.Subnet)
+	if err != nil {
+		return err
+	}
+	log.Infof("Cleaning up iptables rules for subnet: %s", c.Subnet)
+	if err := removeDNATRules(contains); err != nil {
+		return fmt.Errorf("failed to cleanup iptables rules: %w", err)
+	}
+	if err := removeEgressBlocks(contains); err != nil {
+		return fmt.Errorf("failed to cleanup iptables rules: %w", err)
+	}
+	return nil
+}
+
+func (b *IPTables) Setup(c Config) error {
+	output, err := exec.Command("iptables-save").Output()
+	if err != nil {
+		return fmt.Errorf("failed to run iptables-save: %w", err)
+	}
+	backupFile := fmt.Sprintf("/tmp/iptables-backup-%s.rules", time.Now().Format(time.UnixDate))
+	if err := os.WriteFile(backupFile, output, 0644); err != nil {
+		return fmt.Errorf("failed to save iptables-save to: %v: %w", backupFile, err)
+	}
+
+	hostInterface, err := defaultInterface()
+	if err != nil {
+		return err
+	}
+	if linkExists(c.Bridge) {
+		log.Info("networking already setup")
+		return nil
+	}
+	if err := setupBridge(c, hostInterface); err != nil {
+		return err
+	}
+	for _, args := range [][]string{
+		{"-t", "nat", "-A", "POSTROUTING", "-s", c.Subnet, "-o", hostInterface, "-j", "MASQUERADE"},
+		{"-t", "filter", "-I", "FORWARD", "-s", c.Subnet, "-j", "ACCEPT"},
+		{"-t", "filter", "-I", "FORWARD", "-d", c.Subnet, "-j", "ACCEPT"},
+	} {
+		if err := run("iptables", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *IPTables) ForwardPort(hostPort int32, guestIP string, guestPort int32) error {
+	return run(
+		"iptables",
+		"-t",
+		"nat",
+		"-A",
+		"PREROUTING",
+		"-p",
+		"tcp",
+		"--dport",
+		strconv.Itoa(int(hostPort)),
+		"-j",
+		"DNAT",
+		"--to-destination",
+		fmt.Sprintf("%s:%d", guestIP, guestPort),
+	)
+}
+
+func (b *IPTables) RemovePortForwards(guestIP string) error {
+	ip := net.ParseIP(guestIP)
+	if ip == nil {
+		return fmt.Errorf("invalid guest IP: %s", guestIP)
+	}
+	log.Infof("deleting all iptables rules for IP: %s", guestIP)
+	return removeDNATRules(ip.Equal)
+}
+
+// egressBlockRule is the FORWARD rule blocking the egress of guestIP. Replies
+// on forwarded ports are told apart by their connection having been DNATed.
+func egressBlockRule(guestIP string) []string {
+	return []string{"FORWARD", "-s", guestIP + "/32", "-m", "conntrack", "!", "--ctstate", "DNAT", "-j", "DROP"}
+}
+
+func (b *IPTables) BlockEgress(guestIP string) error {
+	if net.ParseIP(guestIP) == nil {
+		return fmt.Errorf("invalid guest IP: %s", guestIP)
+	}
+	rule := egressBlockRule(guestIP)
+	if exec.Command("iptables", append([]string{"-t", "filter", "-C"}, rule...)...).Run() == nil {
+		return nil
+	}
+	// Ahead of the bridge subnet's ACCEPT rules.
+	return run("iptables", append([]string{"-t", "filter", "-I"}, rule...)...)
+}
+
+func (b *IPTables) AllowEgress(guestIP string) error {
+	ip := net.ParseIP(guestIP)
+	if ip == nil {
+		return fmt.Errorf("invalid guest IP: %s", guestIP)
+	}
+	return removeEgressBlocks(ip.Equal)
+}
+
+// removeEgressBlocks deletes the egress blocks of the guest addresses
+// matching match.
+func removeEgressBlocks(match func(ip net.IP) bool) error {
+	output, err := exec.Command("iptables", "-t", "filter", "-S", "FORWARD").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list iptables rules: %w", err)
+	}
+
+	var finalErr error
+	for _, rule := range strings.Split(string(output), "\n") {
+		guestIP := egressBlockSource(rule)
+		if guestIP == nil || !match(guestIP) {
+			continue
+		}
+		log.Infof("deleting rule: %s", rule)
+		args := append([]string{"-t", "filter", "-D"}, strings.Fields(rule)[1:]...)
+		if err := run("iptables", args...); err != nil {
+			log.Warnf("error deleting iptables rule %q: %v", rule, err)
+			finalErr = errors.Join(finalErr, err)
+		}
+	}
+	return finalErr
+}
+
+// egressBlockSource returns the guest address of an egress block as
+// `iptables -S` prints it, or nil for other rules.
+func egressBlockSource(rule string) net.IP {
+	fields := strings.Fields(rule)
+	if len(fields) < 2 || fields[0] != "-A" || fields[1] != "FORWARD" || !strings.HasSuffix(rule, "--ctstate DNAT -j DROP") {
+		return nil
+	}
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "-s" {
+			ip, _, err := net.ParseCIDR(fields[i+1])
+			if err != nil {
+				return net.ParseIP(fields[i+1])
+			}
+			return ip
+		}
+	}
+	return nil
+}
+
+// removeDNATRules deletes the port forwards to the guest addresses matching
+// match.
+func removeDNATRules(match func(ip net.IP) bool) error {
+	output, err := exec.Command("iptables", "-t", "nat", "-S", "PREROUTING").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list iptables rules: %w", err)
+	}
+
+	var finalErr error
+	for _, rule := range strings.Split(string(output), "\n") {
+		guestIP := dnatDestination(rule)
+		if guestIP == nil || !match(guestIP) {
+			continue
+		}
+		log.Infof("deleting rule: %s", rule)
+		// Deleting by specification removes the first matching rule.
+		args := append([]string{"-t", "nat", "-D"}, strings.Fields(rule)[1:]...)
+		if err := run("iptables", args...); err != nil {
+			log.Warnf("error deleting iptables rule %q: %v", rule, err)
+			finalErr = errors.Join(finalErr, err)
+		}
+	}
+	return finalErr
+}
+
+// dnatDestination returns the guest address of a DNAT rule as `iptables -S`
+// prints it, or nil for other rules.
+func dnatDestination(rule string) net.IP {
+	if !strings.HasPrefix(rule, "-A ") {
+		return nil
+	}
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] != "--to-destination" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(fields[i+1])
+		if err != nil {
+			host = fields[i+1]
+		}
+		return net.ParseIP(host)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package hostnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// nftTable is the table of the nftables backend. Everything the server sets
+// up lives in it, so deleting it undoes the server's firewall changes.
+const nftTable = "arrakis"
+
+// NFTables is the nftables backend. It keeps its rules in a table of its own
+// rather than the iptables compatibility tables. Hosts whose forward policy
+// is to drop must still accept the bridge subnet in their own tables.
+type NFTables struct{}
+
+func (*NFTables) Name() string {
+	return BackendNFTables
+}
+
+func (b *NFTables) Cleanup(c Config) error {
+	if err := deleteTapDevices(); err != nil {
+		return fmt.Errorf("failed to cleanup tap devices: %w", err)
+	}
+	if err := deleteBridge(c.Bridge); err != nil {
+		return fmt.Errorf("failed to cleanup bridge: %w", err)
+	}
+	// Declaring the table first makes deleting it succeed if it's missing.
+	if err := nft(fmt.Sprintf("table ip %s\ndelete table ip %s\n", nftTable, nftTable)); err != nil {
+		return fmt.Errorf("failed to delete nftables table: %w", err)
+	}
+	return nil
+}
+
+func (b *NFTables) Setup(c Config) error {
+	hostInterface, err := defaultInterface()
+	if err != nil {
+		return err
+	}
+	if err := setupBridge(c, hostInterface); err != nil {
+		return err
+	}
+	if err := nft(nftRuleset(c, hostInterface)); err != nil {
+		return fmt.Errorf("failed to set up nftables table: %w", err)
+	}
+	return nil
+}
+
+func (b *NFTables) ForwardPort(hostPort int32, guestIP string, guestPort int32) error {
+	return run("nft", "add", "rule", "ip", nftTable, "prerouting",
+		"tcp", "dport", fmt.Sprint(hostPort), "dnat", "to", fmt.Sprintf("%s:%d", guestIP, guestPort))
+}
+
+func (b *NFTables) RemovePortForwards(guestIP string) error {
+	output, err := exec.Command("nft", "-a", "list", "chain", "ip", nftTable, "prerouting").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list nftables rules: %w", err)
+	}
+	var finalErr error
+	for _, handle := range nftForwardHandles(string(output), guestIP) {
+		if err := run("nft", "delete", "rule", "ip", nftTable, "prerouting", "handle", handle); err != nil {
+			log.Warnf("error deleting nftables rule %s for IP %s: %v", handle, guestIP, err)
+			finalErr = errors.Join(finalErr, err)
+		}
+	}
+	return finalErr
+}
+
+// nftEgressComment tags the rule blocking the egress of guestIP, to find it
+// again.
+func nftEgressComment(guestIP string) string {
+	return "egress-block " + guestIP
+}
+
+func (b *NFTables) BlockEgress(guestIP string) error {
+	if net.ParseIP(guestIP) == nil {
+		return fmt.Errorf("invalid guest IP: %s", guestIP)
+	}
+	handles, err := b.egressBlockHandles(guestIP)
+	if err != nil {
+		return err
+	}
+	if len(handles) > 0 {
+		return nil
+	}
+	// Inserted ahead of the bridge subnet's accept rules. Replies on
+	// forwarded ports belong to DNATed connections.
+	return run("nft", "insert", "rule", "ip", nftTable, "forward",
+		"ip", "saddr", guestIP, "ct", "status", "&", "dnat", "==", "0", "drop",
+		"comment", fmt.Sprintf("%q", nftEgressComment(guestIP)))
+}
+
+func (b *NFTables) AllowEgress(guestIP string) error {
+	handles, err := b.egressBlockHandles(guestIP)
+	if err != nil {
+		return err
+	}
+	var finalErr error
+	for _, handle := range handles {
+		if err := run("nft", "delete", "rule", "ip", nftTable, "forward", "handle", handle); err != nil {
+			log.Warnf("error deleting nftables rule %s for IP %s: %v", handle, guestIP, err)
+			finalErr = errors.Join(finalErr, err)
+		}
+	}
+	return finalErr
+}
+
+func (b *NFTables) egressBlockHandles(guestIP string) ([]string, error) {
+	output, err := exec.Command("nft", "-a", "list", "chain", "ip", nftTable, "forward").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables rules: %w", err)
+	}
+	return nftCommentHandles(string(output), nftEgressComment(guestIP)), nil
+}
+
+// nftCommentHandles returns the handles of the rules with the given comment
+// in the output of `nft -a list chain`.
+func nftCommentHandles(listing string, comment string) []string {
+	var handles []string
+	tag := fmt.Sprintf("comment %q", comment)
+	for _, line := range strings.Split(listing, "\n") {
+		line = strings.TrimSpace(line)
+		if m := nftHandleRegexp.FindStringSubmatch(line); m != nil && strings.Contains(line, tag+" #") {
+			handles = append(handles, m[1])
+		}
+	}
+	return handles
+}
+
+// nftRuleset returns the script that replaces the backend's table.
+func nftRuleset(c Config, hostInterface string) string {
+	return fmt.Sprintf(`table ip %[1]s
+delete table ip %[1]s
+table ip %[1]s {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr %[2]s oifname "%[3]s" masquerade
+	}
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		ip saddr %[2]s accept
+		ip daddr %[2]s accept
+	}
+}
+`, nftTable, c.Subnet, hostInterface)
+}
+
+var nftHandleRegexp = regexp.MustCompile(`# handle (\d+)$`)
+
+// nftForwardHandles returns the handles of the rules forwarding to guestIP in
+// the output of `nft -a list chain`.
+func nftForwardHandles(listing string, guestIP string) []string {
+	var handles []string
+	for _, line := range strings.Split(listing, "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		forwards := false
+		for i := 0; i+2 < len(fields); i++ {
+			if fields[i] != "dnat" || fields[i+1] != "to" {
+				continue
+			}
+			host, _, err := net.SplitHostPort(fields[i+2])
+			if err != nil {
+				host = fields[i+2]
+			}
+			forwards = host == guestIP
+		}
+		if m := nftHandleRegexp.FindStringSubmatch(line); forwards && m != nil {
+			handles = append(handles, m[1])
+		}
+	}
+	return handles
+}
+
+// nft runs an nftables script.
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %w", strings.TrimSpace(stderr.String()), err)
+	}
+	return nil
+}
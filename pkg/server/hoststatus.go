@@ -0,0 +1,110 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/metrics"
+	"github.com/abshkbh/arrakis/pkg/server/operations"
+)
+
+// HostStatus reports how busy the host is: VMs being created, waiting for
+// admission and being snapshotted, and the background operations in
+// progress. Autoscalers can use it to add hosts before creations queue up.
+func (s *Server) HostStatus() *serverapi.HostStatusResponse {
+	s.lock.RLock()
+	vms, creating := len(s.vms), len(s.boots)
+	s.lock.RUnlock()
+
+	resp := &serverapi.HostStatusResponse{
+		Vms:          serverapi.PtrInt32(int32(vms)),
+		Creating:     serverapi.PtrInt32(int32(creating)),
+		Snapshotting: serverapi.PtrInt32(s.snapshotting.Load()),
+		Queued:       serverapi.PtrInt32(0),
+	}
+	if cordon := s.HostCordon(); cordon.GetCordoned() {
+		resp.Cordoned = serverapi.PtrBool(true)
+		resp.CordonReason = cordon.Reason
+	}
+
+	running := map[string]int32{operationCreateVM: 0, operationSnapshotVM: 0}
+	for _, op := range s.operations.List() {
+		if op.Status == operations.StatusRunning {
+			running[op.Kind]++
+		}
+	}
+	resp.SetOperations(running)
+
+	if s.admission == nil {
+		return resp
+	}
+	queued := s.admission.Queued()
+	resp.Queued = serverapi.PtrInt32(int32(len(queued)))
+	var oldest float64
+	for _, t := range queued {
+		if waited := time.Since(t.Enqueued).Seconds(); waited > oldest {
+			oldest = waited
+		}
+	}
+	resp.OldestQueuedSeconds = serverapi.PtrFloat64(oldest)
+	capacity, used := s.admission.Capacity(), s.admission.Used()
+	resp.Capacity = &serverapi.HostResources{
+		Vcpus:    serverapi.PtrInt64(capacity.VCPUs),
+		MemoryMb: serverapi.PtrInt64(capacity.MemoryMB),
+	}
+	resp.Reserved = &serverapi.HostResources{
+		Vcpus:    serverapi.PtrInt64(used.VCPUs),
+		MemoryMb: serverapi.PtrInt64(used.MemoryMB),
+	}
+	return resp
+}
+
+// HostMetrics returns the gauges of a host status for Prometheus.
+func HostMetrics(st *serverapi.HostStatusResponse) []metrics.Gauge {
+	gauges := []metrics.Gauge{
+		metrics.NewGauge("arrakis_vms", "VMs on the host.", float64(st.GetVms())),
+		metrics.NewGauge("arrakis_vms_creating", "VMs being created or restored.", float64(st.GetCreating())),
+		metrics.NewGauge("arrakis_vms_snapshotting", "Snapshots being taken.", float64(st.GetSnapshotting())),
+		metrics.NewGauge("arrakis_creation_queue_depth", "VMs waiting for admission.", float64(st.GetQueued())),
+		metrics.NewGauge("arrakis_creation_queue_oldest_seconds", "How long the longest waiting VM has waited for admission.", st.GetOldestQueuedSeconds()),
+		labeled("arrakis_operations_running", "Background operations in progress.", "kind", st.GetOperations()),
+		labeled("arrakis_proxy_sessions", "Sessions in progress through the REST server.", "kind", st.GetSessions()),
+		metrics.NewGauge("arrakis_host_cordoned", "1 if the host refuses new VMs.", boolGauge(st.GetCordoned())),
+	}
+	if st.Capacity != nil {
+		gauges = append(gauges,
+			metrics.NewGauge("arrakis_capacity_vcpus", "vCPUs that may be reserved, 0 if unlimited.", float64(st.Capacity.GetVcpus())),
+			metrics.NewGauge("arrakis_capacity_memory_megabytes", "Memory that may be reserved, 0 if unlimited.", float64(st.Capacity.GetMemoryMb())),
+			metrics.NewGauge("arrakis_reserved_vcpus", "vCPUs reserved by VMs.", float64(st.Reserved.GetVcpus())),
+			metrics.NewGauge("arrakis_reserved_memory_megabytes", "Memory reserved by VMs.", float64(st.Reserved.GetMemoryMb())),
+		)
+	}
+	return gauges
+}
+
+// labeled returns a gauge with a sample per key of values, labeled with
+// label.
+func labeled(name string, help string, label string, values map[string]int32) metrics.Gauge {
+	g := metrics.Gauge{Name: name, Help: help}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		g.Samples = append(g.Samples, metrics.Sample{
+			Labels: map[string]string{label: key},
+			Value:  float64(values[key]),
+		})
+	}
+	return g
+}
+
+// boolGauge is 1 for true and 0 for false.
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/server/hypervisor"
+)
+
+// hypervisorFilename records the hypervisor of the snapshotted VM in a
+// snapshot, as only that one can restore it.
+const hypervisorFilename = "hypervisor"
+
+// newHypervisors returns the hypervisors VMs can run on: Cloud Hypervisor,
+// and those whose binary is configured.
+func newHypervisors(cfg config.ServerConfig) (map[string]hypervisor.Hypervisor, error) {
+	hypervisors := map[string]hypervisor.Hypervisor{
+		hypervisor.CloudHypervisor: &cloudHypervisor{bin: cfg.ChvBinPath},
+	}
+	if cfg.FirecrackerBinPath != "" {
+		hypervisors[hypervisor.Firecracker] = hypervisor.NewFirecracker(cfg.FirecrackerBinPath)
+	}
+	if cfg.Hypervisor != "" && hypervisors[cfg.Hypervisor] == nil {
+		return nil, fmt.Errorf("invalid hypervisor: %q isn't supported or has no binary configured", cfg.Hypervisor)
+	}
+	return hypervisors, nil
+}
+
+// pickHypervisor returns the hypervisor named name, or the default one if
+// name is empty.
+func (s *Server) pickHypervisor(name string) (hypervisor.Hypervisor, error) {
+	if name == "" {
+		name = s.config.Hypervisor
+	}
+	if name == "" {
+		name = hypervisor.CloudHypervisor
+	}
+	h, ok := s.hypervisors[name]
+	if !ok {
+		switch name {
+		case hypervisor.CloudHypervisor, hypervisor.Firecracker:
+			return nil, status.Errorf(codes.FailedPrecondition, "hypervisor %s isn't configured on this host", name)
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported hypervisor: %q", name)
+	}
+	return h, nil
+}
+
+// snapshotHypervisor returns the hypervisor a snapshot was taken with.
+// Snapshots taken before it was recorded are Cloud Hypervisor's.
+func (s *Server) snapshotHypervisor(snapshotID string) (hypervisor.Hypervisor, error) {
+	name := hypervisor.CloudHypervisor
+	if data, err := os.ReadFile(path.Join(s.config.StateDir, "snapshots", snapshotID, hypervisorFilename)); err == nil {
+		name = string(data)
+	}
+	h, err := s.pickHypervisor(name)
+	if err != nil {
+		return nil, status.Errorf(status.Code(err), "snapshot %s: %s", snapshotID, status.Convert(err).Message())
+	}
+	return h, nil
+}
+
+// checkSnapshotHypervisor refuses to restore a snapshot with another
+// hypervisor than the one it was taken with.
+func (s *Server) checkSnapshotHypervisor(snapshotID string, name string) error {
+	h, err := s.snapshotHypervisor(snapshotID)
+	if err != nil {
+		return err
+	}
+	if name != "" && name != h.Name() {
+		return status.Errorf(codes.FailedPrecondition, "snapshot %s was taken with %s and can't be restored with %s", snapshotID, h.Name(), name)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package hypervisor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+)
+
+// Files of a Firecracker snapshot.
+const (
+	firecrackerStateFile  = "vmstate"
+	firecrackerMemoryFile = "memory"
+	// firecrackerConfigFile holds the VM config at the time of the snapshot,
+	// as Firecracker's own state file can't be read outside of it.
+	firecrackerConfigFile = "firecracker.json"
+)
+
+// firecrackerKernelArgs are those Firecracker's guests need: it only emulates
+// a serial port on ttyS0, exits when the guest reboots with reboot=k and
+// exposes devices over MMIO rather than PCI.
+var firecrackerKernelArgs = []string{"console=ttyS0", "reboot=k", "panic=1", "pci=off"}
+
+// FirecrackerHypervisor runs VMs in Firecracker, which starts faster and
+// emulates fewer devices than Cloud Hypervisor. Devices can't be hotplugged.
+type FirecrackerHypervisor struct {
+	bin string
+}
+
+func NewFirecracker(bin string) *FirecrackerHypervisor {
+	return &FirecrackerHypervisor{bin: bin}
+}
+
+func (h *FirecrackerHypervisor) Name() string {
+	return Firecracker
+}
+
+func (h *FirecrackerHypervisor) Command(socketPath string) *exec.Cmd {
+	return exec.Command(h.bin, "--api-sock", socketPath)
+}
+
+func (h *FirecrackerHypervisor) Connect(client *http.Client) VMM {
+	return &firecrackerVMM{client: client}
+}
+
+func (h *FirecrackerHypervisor) KernelArgs(arch string) []string {
+	return append([]string(nil), firecrackerKernelArgs...)
+}
+
+// firecrackerConfig is the part of Firecracker's VM config, as GET /vm/config
+// returns it, that snapshots are restored with.
+type firecrackerConfig struct {
+	BootSource struct {
+		BootArgs string `json:"boot_args"`
+	} `json:"boot-source"`
+	NetworkInterfaces []struct {
+		HostDevName string `json:"host_dev_name"`
+	} `json:"network-interfaces"`
+}
+
+func (h *FirecrackerHypervisor) SnapshotNetwork(dir string) (string, string, error) {
+	data, err := os.ReadFile(path.Join(dir, firecrackerConfigFile))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read config file: %w", err)
+	}
+	var config firecrackerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	if len(config.NetworkInterfaces) == 0 {
+		return "", "", fmt.Errorf("no network configuration found")
+	}
+	return config.NetworkInterfaces[0].HostDevName, config.BootSource.BootArgs, nil
+}
+
+type firecrackerVMM struct {
+	client *http.Client
+}
+
+// call sends a request to the Firecracker API and decodes the response into
+// out, if not nil.
+func (v *firecrackerVMM) call(ctx context.Context, method string, endpoint string, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost"+endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var fault struct {
+			FaultMessage string `json:"fault_message"`
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &fault) == nil && fault.FaultMessage != "" {
+			return fmt.Errorf("%s %s: %d: %s", method, endpoint, resp.StatusCode, fault.FaultMessage)
+		}
+		return fmt.Errorf("%s %s: %d: %s", method, endpoint, resp.StatusCode, string(data))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (v *firecrackerVMM) Ping(ctx context.Context) (string, error) {
+	var info struct {
+		VmmVersion string `json:"vmm_version"`
+	}
+	if err := v.call(ctx, http.MethodGet, "/", nil, &info); err != nil {
+		return "", err
+	}
+	return info.VmmVersion, nil
+}
+
+// firecrackerPut is a PUT configuring part of a VM before it boots.
+type firecrackerPut struct {
+	endpoint string
+	body     any
+}
+
+func (v *firecrackerVMM) Create(ctx context.Context, config VMConfig) error {
+	bootSource := map[string]any{
+		"kernel_image_path": config.Kernel,
+		"boot_args":         config.Cmdline,
+	}
+	if config.Initramfs != "" {
+		bootSource["initrd_path"] = config.Initramfs
+	}
+	calls := []firecrackerPut{
+		{"/machine-config", map[string]any{
+			"vcpu_count":   config.VCPUs,
+			"mem_size_mib": config.MemoryMB,
+		}},
+		{"/boot-source", bootSource},
+	}
+	// The initramfs mounts the disks, Firecracker mustn't pick a root device.
+	for i, disk := range config.Disks {
+		id := fmt.Sprintf("disk%d", i)
+		calls = append(calls, firecrackerPut{"/drives/" + id, map[string]any{
+			"drive_id":       id,
+			"path_on_host":   disk.Path,
+			"is_root_device": false,
+			"is_read_only":   disk.ReadOnly,
+		}})
+	}
+	if config.Tap != "" {
+		calls = append(calls, firecrackerPut{"/network-interfaces/net0", map[string]any{
+			"iface_id":      "net0",
+			"host_dev_name": config.Tap,
+		}})
+	}
+	if config.VsockPath != "" {
+		calls = append(calls, firecrackerPut{"/vsock", map[string]any{
+			"guest_cid": config.VsockCID,
+			"uds_path":  config.VsockPath,
+		}})
+	}
+	for _, c := range calls {
+		if err := v.call(ctx, http.MethodPut, c.endpoint, c.body, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *firecrackerVMM) action(ctx context.Context, action string) error {
+	return v.call(ctx, http.MethodPut, "/actions", map[string]string{"action_type": action}, nil)
+}
+
+func (v *firecrackerVMM) Boot(ctx context.Context) error {
+	return v.action(ctx, "InstanceStart")
+}
+
+// Shutdown asks the guest to reboot, which with reboot=k makes Firecracker
+// exit. The VM can't be booted again.
+func (v *firecrackerVMM) Shutdown(ctx context.Context) error {
+	return v.action(ctx, "SendCtrlAltDel")
+}
+
+func (v *firecrackerVMM) setState(ctx context.Context, state string) error {
+	return v.call(ctx, http.MethodPatch, "/vm", map[string]string{"state": state}, nil)
+}
+
+func (v *firecrackerVMM) Pause(ctx context.Context) error {
+	return v.setState(ctx, "Paused")
+}
+
+func (v *firecrackerVMM) Resume(ctx context.Context) error {
+	return v.setState(ctx, "Resumed")
+}
+
+func (v *firecrackerVMM) Snapshot(ctx context.Context, dir string) error {
+	var config json.RawMessage
+	if err := v.call(ctx, http.MethodGet, "/vm/config", nil, &config); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(dir, firecrackerConfigFile), config, 0644); err != nil {
+		return err
+	}
+	return v.call(ctx, http.MethodPut, "/snapshot/create", map[string]string{
+		"snapshot_type": "Full",
+		"snapshot_path": path.Join(dir, firecrackerStateFile),
+		"mem_file_path": path.Join(dir, firecrackerMemoryFile),
+	}, nil)
+}
+
+func (v *firecrackerVMM) Restore(ctx context.Context, dir string) error {
+	return v.call(ctx, http.MethodPut, "/snapshot/load", map[string]any{
+		"snapshot_path": path.Join(dir, firecrackerStateFile),
+		"mem_backend": map[string]string{
+			"backend_type": "File",
+			"backend_path": path.Join(dir, firecrackerMemoryFile),
+		},
+		"resume_vm": false,
+	}, nil)
+}
+
+// Delete shuts the guest down, as Firecracker has no API to delete a VM or
+// exit. The VMM process exits with the guest, or is killed once it doesn't,
+// so a guest that is already down isn't an error.
+func (v *firecrackerVMM) Delete(ctx context.Context) error {
+	v.Shutdown(ctx)
+	return nil
+}
@@ -0,0 +1,175 @@
+package hypervisor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeCall struct {
+	Method string
+	Path   string
+	Body   map[string]any
+}
+
+// fakeFirecracker serves the Firecracker API, recording the calls made to it.
+type fakeFirecracker struct {
+	mu     sync.Mutex
+	calls  []fakeCall
+	config string
+}
+
+func (f *fakeFirecracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	call := fakeCall{Method: r.Method, Path: r.URL.Path}
+	if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+		if err := json.Unmarshal(data, &call.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/":
+		w.Write([]byte(`{"id":"anonymous-instance","state":"Not started","vmm_version":"1.10.1","app_name":"Firecracker"}`))
+	case r.Method == http.MethodGet && r.URL.Path == "/vm/config":
+		w.Write([]byte(f.config))
+	case r.URL.Path == "/actions" && call.Body["action_type"] == "SendCtrlAltDel":
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"fault_message":"The requested operation is not supported after starting the microVM."}`))
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newFakeFirecracker(t *testing.T) (*fakeFirecracker, VMM) {
+	t.Helper()
+	fake := &fakeFirecracker{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "tcp", srv.Listener.Addr().String())
+		},
+	}}
+	return fake, NewFirecracker("/usr/bin/firecracker").Connect(client)
+}
+
+func TestFirecrackerCreate(t *testing.T) {
+	fake, vmm := newFakeFirecracker(t)
+	ctx := context.Background()
+	if version, err := vmm.Ping(ctx); err != nil || version != "1.10.1" {
+		t.Fatalf("Ping() = %q, %v", version, err)
+	}
+	err := vmm.Create(ctx, VMConfig{
+		Kernel:    "/images/vmlinux.bin",
+		Initramfs: "/images/initramfs.cpio.gz",
+		Cmdline:   "console=ttyS0 reboot=k",
+		VCPUs:     2,
+		MemoryMB:  1024,
+		Disks: []Disk{
+			{Path: "/images/rootfs.img", ReadOnly: true},
+			{Path: "/state/foo/stateful.img"},
+		},
+		Tap:       "tap0",
+		VsockCID:  3,
+		VsockPath: "/state/foo/vsock.sock",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vmm.Boot(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []fakeCall{
+		{Method: "GET", Path: "/"},
+		{Method: "PUT", Path: "/machine-config", Body: map[string]any{"vcpu_count": 2.0, "mem_size_mib": 1024.0}},
+		{Method: "PUT", Path: "/boot-source", Body: map[string]any{
+			"kernel_image_path": "/images/vmlinux.bin",
+			"initrd_path":       "/images/initramfs.cpio.gz",
+			"boot_args":         "console=ttyS0 reboot=k",
+		}},
+		{Method: "PUT", Path: "/drives/disk0", Body: map[string]any{
+			"drive_id": "disk0", "path_on_host": "/images/rootfs.img", "is_root_device": false, "is_read_only": true,
+		}},
+		{Method: "PUT", Path: "/drives/disk1", Body: map[string]any{
+			"drive_id": "disk1", "path_on_host": "/state/foo/stateful.img", "is_root_device": false, "is_read_only": false,
+		}},
+		{Method: "PUT", Path: "/network-interfaces/net0", Body: map[string]any{"iface_id": "net0", "host_dev_name": "tap0"}},
+		{Method: "PUT", Path: "/vsock", Body: map[string]any{"guest_cid": 3.0, "uds_path": "/state/foo/vsock.sock"}},
+		{Method: "PUT", Path: "/actions", Body: map[string]any{"action_type": "InstanceStart"}},
+	}
+	if !reflect.DeepEqual(fake.calls, want) {
+		t.Errorf("calls =\n%+v\nwant\n%+v", fake.calls, want)
+	}
+}
+
+func TestFirecrackerErrors(t *testing.T) {
+	_, vmm := newFakeFirecracker(t)
+	err := vmm.Shutdown(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "not supported after starting") {
+		t.Errorf("Shutdown() = %v, want the fault message", err)
+	}
+	// The guest being down already doesn't keep the VM from being deleted.
+	if err := vmm.Delete(context.Background()); err != nil {
+		t.Errorf("Delete() = %v", err)
+	}
+}
+
+func TestFirecrackerSnapshot(t *testing.T) {
+	fake, vmm := newFakeFirecracker(t)
+	fake.config = `{"boot-source":{"kernel_image_path":"/images/vmlinux.bin","boot_args":"console=ttyS0 guest_ip=\"10.20.1.2/24\""},` +
+		`"network-interfaces":[{"iface_id":"net0","host_dev_name":"tap7"}]}`
+	dir := t.TempDir()
+	ctx := context.Background()
+	if err := vmm.Pause(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := vmm.Snapshot(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := vmm.Restore(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []fakeCall{
+		{Method: "PATCH", Path: "/vm", Body: map[string]any{"state": "Paused"}},
+		{Method: "GET", Path: "/vm/config"},
+		{Method: "PUT", Path: "/snapshot/create", Body: map[string]any{
+			"snapshot_type": "Full",
+			"snapshot_path": filepath.Join(dir, "vmstate"),
+			"mem_file_path": filepath.Join(dir, "memory"),
+		}},
+		{Method: "PUT", Path: "/snapshot/load", Body: map[string]any{
+			"snapshot_path": filepath.Join(dir, "vmstate"),
+			"mem_backend":   map[string]any{"backend_type": "File", "backend_path": filepath.Join(dir, "memory")},
+			"resume_vm":     false,
+		}},
+	}
+	if !reflect.DeepEqual(fake.calls, want) {
+		t.Errorf("calls =\n%+v\nwant\n%+v", fake.calls, want)
+	}
+
+	tap, cmdline, err := NewFirecracker("").SnapshotNetwork(dir)
+	if err != nil || tap != "tap7" || cmdline != `console=ttyS0 guest_ip="10.20.1.2/24"` {
+		t.Errorf("SnapshotNetwork() = %q, %q, %v", tap, cmdline, err)
+	}
+	if _, _, err := NewFirecracker("").SnapshotNetwork(t.TempDir()); err == nil {
+		t.Error("SnapshotNetwork() of a dir without a snapshot succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "firecracker.json")); err != nil {
+		t.Error(err)
+	}
+}
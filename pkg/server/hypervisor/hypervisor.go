@@ -0,0 +1,74 @@
+// Package hypervisor abstracts the VMMs VMs run in, so that hosts where Cloud
+// Hypervisor isn't available, or lacks a device, can run VMs with another
+// one. Each VM runs in a VMM process of its own, driven through the API the
+// process serves on a unix socket.
+package hypervisor
+
+import (
+	"context"
+	"net/http"
+	"os/exec"
+)
+
+// Names of the hypervisors.
+const (
+	CloudHypervisor = "cloud-hypervisor"
+	Firecracker     = "firecracker"
+)
+
+// Hypervisor runs VMs in VMM processes.
+type Hypervisor interface {
+	// Name of the hypervisor, e.g. "firecracker".
+	Name() string
+	// Command returns the command running a VMM that serves its API on
+	// socketPath.
+	Command(socketPath string) *exec.Cmd
+	// Connect returns the VMM whose API client reaches.
+	Connect(client *http.Client) VMM
+	// KernelArgs returns the args the guests of an architecture need on their
+	// kernel command line, e.g. which serial device to log to.
+	KernelArgs(arch string) []string
+	// SnapshotNetwork returns the tap device and the kernel command line of
+	// the VM a snapshot in dir was taken of.
+	SnapshotNetwork(dir string) (tap string, cmdline string, err error)
+}
+
+// VMM controls the VM of a VMM process.
+type VMM interface {
+	// Ping returns the version of the VMM once its API is up.
+	Ping(ctx context.Context) (string, error)
+	// Create configures the VM without booting it.
+	Create(ctx context.Context, config VMConfig) error
+	Boot(ctx context.Context) error
+	// Shutdown powers the VM off.
+	Shutdown(ctx context.Context) error
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
+	// Snapshot saves the paused VM into dir.
+	Snapshot(ctx context.Context, dir string) error
+	// Restore loads the snapshot in dir into a VMM with no VM yet, paused.
+	Restore(ctx context.Context, dir string) error
+	// Delete deletes the VM and lets the VMM process exit.
+	Delete(ctx context.Context) error
+}
+
+// VMConfig is what a VM is created with.
+type VMConfig struct {
+	Kernel    string
+	Initramfs string
+	Cmdline   string
+	VCPUs     int32
+	MemoryMB  int32
+	// Disks in the order the guest sees them, the rootfs first.
+	Disks []Disk
+	Tap   string
+	// VsockCID and VsockPath set up the vsock device, whose host side is a
+	// unix socket taking "CONNECT <port>" to reach a port of the guest.
+	VsockCID  uint32
+	VsockPath string
+}
+
+type Disk struct {
+	Path     string
+	ReadOnly bool
+}
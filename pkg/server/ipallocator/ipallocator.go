@@ -68,6 +68,13 @@ func (a *IPAllocator) AllocateIP() (*net.IPNet, error) {
 	}, nil
 }
 
+// Available returns the number of IPs that can still be allocated.
+func (a *IPAllocator) Available() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return len(a.available)
+}
+
 func (a *IPAllocator) FreeIP(ip net.IP) error {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
@@ -99,3 +106,20 @@ func (a *IPAllocator) ClaimIP(ip net.IP) error {
 	}
 	return nil
 }
+
+// IsAllocated reports whether ip is in the subnet and not available, which
+// includes the reserved gateway address.
+func (a *IPAllocator) IsAllocated(ip net.IP) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if !a.subnet.Contains(ip) {
+		return false
+	}
+	for _, availIP := range a.available {
+		if availIP.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+// Package kernelargs validates and merges the kernel command line of VMs, so
+// that boot args can be customized per VM instead of per kernel artifact.
+package kernelargs
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// MaxLength is the longest command line the kernel accepts on x86_64 and aarch64
+	// (COMMAND_LINE_SIZE).
+	MaxLength = 2048
+	// maxArgLength bounds a single argument.
+	maxArgLength = 256
+	// initSeparator separates the kernel's args from those passed to init.
+	initSeparator = "--"
+)
+
+// Key returns the name of an arg, e.g. "console" for "console=ttyS0". Flags
+// such as "quiet" are their own key.
+func Key(arg string) string {
+	key, _, _ := strings.Cut(arg, "=")
+	return key
+}
+
+// Validate checks that arg is a single well-formed argument: printable ASCII
+// without whitespace, except inside a double quoted value as in
+// `key="a value"`.
+func Validate(arg string) error {
+	if arg == "" {
+		return fmt.Errorf("empty kernel arg")
+	}
+	if len(arg) > maxArgLength {
+		return fmt.Errorf("kernel arg %.32q... is longer than %d bytes", arg, maxArgLength)
+	}
+	for _, c := range arg {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("kernel arg %q has characters other than printable ASCII", arg)
+		}
+	}
+	key, value, hasValue := strings.Cut(arg, "=")
+	if key == "" || strings.ContainsAny(key, " \"") {
+		return fmt.Errorf("kernel arg %q has an invalid name", arg)
+	}
+	if !hasValue || !strings.Contains(value, "\"") {
+		if strings.Contains(value, " ") {
+			return fmt.Errorf("kernel arg %q has spaces outside of quotes", arg)
+		}
+		return nil
+	}
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' || strings.Count(value, "\"") != 2 {
+		return fmt.Errorf("kernel arg %q must quote its whole value", arg)
+	}
+	return nil
+}
+
+// Merge returns base with extra applied: each arg of extra replaces the args
+// of base with the same key, or is appended. Args after a "--" in extra are
+// passed to init as they are. Args with a reserved key can't be set.
+func Merge(base []string, extra []string, reserved ...string) ([]string, error) {
+	kernelArgs, initArgs := extra, []string(nil)
+	for i, arg := range extra {
+		if arg == initSeparator {
+			kernelArgs, initArgs = extra[:i], extra[i+1:]
+			break
+		}
+	}
+
+	overridden := make(map[string]bool, len(kernelArgs))
+	for _, arg := range kernelArgs {
+		if err := Validate(arg); err != nil {
+			return nil, err
+		}
+		key := Key(arg)
+		for _, r := range reserved {
+			if key == r {
+				return nil, fmt.Errorf("kernel arg %s is set by the server", key)
+			}
+		}
+		overridden[key] = true
+	}
+	for _, arg := range initArgs {
+		if err := Validate(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	var merged []string
+	for _, arg := range base {
+		if !overridden[Key(arg)] {
+			merged = append(merged, arg)
+		}
+	}
+	merged = append(merged, kernelArgs...)
+	if len(initArgs) > 0 {
+		merged = append(merged, initSeparator)
+		merged = append(merged, initArgs...)
+	}
+	if length := len(Join(merged)); length > MaxLength {
+		return nil, fmt.Errorf("kernel command line is %d bytes, longer than %d", length, MaxLength)
+	}
+	return merged, nil
+}
+
+// Join returns args as a command line.
+func Join(args []string) string {
+	return strings.Join(args, " ")
+}
@@ -0,0 +1,50 @@
+package kernelargs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, arg := range []string{"quiet", "console=hvc0", "systemd.unit=rescue.target", `foo="a b"`, "cgroup_no_v1=all"} {
+		if err := Validate(arg); err != nil {
+			t.Errorf("Validate(%q) = %v", arg, err)
+		}
+	}
+	for _, arg := range []string{"", "a b", "=x", "foo=a b", `foo="a`, `foo=a"b"`, `foo="a"b"`, "foo=\x01", "é", strings.Repeat("a", 300)} {
+		if err := Validate(arg); err == nil {
+			t.Errorf("Validate(%q) = nil, want an error", arg)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := []string{"console=ttyS0", `gateway_ip="10.0.0.1"`, `guest_ip="10.0.0.2"`}
+	reserved := []string{"gateway_ip", "guest_ip"}
+
+	got, err := Merge(base, []string{"quiet", "console=hvc0", "console=ttyS1", "--", "single"}, reserved...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `gateway_ip="10.0.0.1" guest_ip="10.0.0.2" quiet console=hvc0 console=ttyS1 -- single`
+	if Join(got) != want {
+		t.Errorf("Merge() = %q, want %q", Join(got), want)
+	}
+
+	if got, err := Merge(base, nil, reserved...); err != nil || Join(got) != Join(base) {
+		t.Errorf("Merge() without args = %q, %v", Join(got), err)
+	}
+	if _, err := Merge(base, []string{"guest_ip=10.0.0.3"}, reserved...); err == nil {
+		t.Error("Merge() overrode a reserved arg")
+	}
+	if _, err := Merge(base, []string{"a b"}, reserved...); err == nil {
+		t.Error("Merge() accepted an invalid arg")
+	}
+	long := make([]string, 20)
+	for i := range long {
+		long[i] = "x" + strings.Repeat("a", 200)
+	}
+	if _, err := Merge(base, long, reserved...); err == nil {
+		t.Error("Merge() accepted a command line over the kernel's limit")
+	}
+}
@@ -0,0 +1,130 @@
+// Package listrevision numbers the versions of a listing, so that pollers can
+// ask for what changed since the version they last saw. Revisions are derived
+// from the listing's content: a listing that didn't change keeps its revision.
+package listrevision
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRemoved is how many removed keys are remembered. Changes since a
+// revision older than the removals forgotten can't be told.
+const maxRemoved = 1000
+
+// Tracker follows a listing of entries identified by their keys.
+type Tracker struct {
+	lock     sync.Mutex
+	revision uint64
+	// floor is the oldest revision changes can be told since.
+	floor   uint64
+	entries map[string]entry
+	removed map[string]uint64
+}
+
+type entry struct {
+	content  string
+	revision uint64
+}
+
+// Changes are the entries changed since a revision.
+type Changes struct {
+	// Revision is the current revision.
+	Revision uint64
+	// Changed are the keys of the entries added or changed since, in order.
+	Changed []string
+	// Removed are the keys of the entries removed since, in order.
+	Removed []string
+}
+
+// New returns a tracker of an empty listing. Its revisions start at the
+// current time, so that revisions handed out before a restart are older
+// than any after it, and their changes can't be told.
+func New() *Tracker {
+	now := uint64(time.Now().UnixMicro())
+	return &Tracker{
+		revision: now,
+		floor:    now,
+		entries:  make(map[string]entry),
+		removed:  make(map[string]uint64),
+	}
+}
+
+// Update records the current listing, the content of each entry by its key,
+// and returns its revision, which is new if anything changed.
+func (t *Tracker) Update(listing map[string]string) uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.update(listing)
+	return t.revision
+}
+
+// Delta records the current listing like Update and returns the changes to it
+// after revision since, a revision Update or Delta returned. It returns false
+// if they can't be told: since is from before a restart or from the future,
+// or removals after it were forgotten.
+func (t *Tracker) Delta(listing map[string]string, since uint64) (Changes, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.update(listing)
+	if since < t.floor || since > t.revision {
+		return Changes{Revision: t.revision}, false
+	}
+	changes := Changes{Revision: t.revision}
+	for key, e := range t.entries {
+		if e.revision > since {
+			changes.Changed = append(changes.Changed, key)
+		}
+	}
+	for key, revision := range t.removed {
+		if revision > since {
+			changes.Removed = append(changes.Removed, key)
+		}
+	}
+	sort.Strings(changes.Changed)
+	sort.Strings(changes.Removed)
+	return changes, true
+}
+
+func (t *Tracker) update(listing map[string]string) {
+	next := t.revision + 1
+	changed := false
+	for key, content := range listing {
+		if e, ok := t.entries[key]; ok && e.content == content {
+			continue
+		}
+		t.entries[key] = entry{content: content, revision: next}
+		delete(t.removed, key)
+		changed = true
+	}
+	for key := range t.entries {
+		if _, ok := listing[key]; !ok {
+			delete(t.entries, key)
+			t.removed[key] = next
+			changed = true
+		}
+	}
+	if changed {
+		t.revision = next
+		t.pruneRemoved()
+	}
+}
+
+// pruneRemoved forgets the oldest removals beyond maxRemoved.
+func (t *Tracker) pruneRemoved() {
+	if len(t.removed) <= maxRemoved {
+		return
+	}
+	keys := make([]string, 0, len(t.removed))
+	for key := range t.removed {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return t.removed[keys[i]] < t.removed[keys[j]] })
+	for _, key := range keys[:len(keys)-maxRemoved] {
+		if t.removed[key] > t.floor {
+			t.floor = t.removed[key]
+		}
+		delete(t.removed, key)
+	}
+}
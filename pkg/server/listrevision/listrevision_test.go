@@ -0,0 +1,58 @@
+package listrevision
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	tr := New()
+	r1 := tr.Update(map[string]string{"a": "1", "b": "1"})
+	if r := tr.Update(map[string]string{"a": "1", "b": "1"}); r != r1 {
+		t.Errorf("unchanged listing got revision %d, want %d", r, r1)
+	}
+
+	changes, ok := tr.Delta(map[string]string{"a": "2", "c": "1"}, r1)
+	if !ok || changes.Revision <= r1 {
+		t.Fatalf("Delta() = %+v, %t", changes, ok)
+	}
+	if !reflect.DeepEqual(changes.Changed, []string{"a", "c"}) || !reflect.DeepEqual(changes.Removed, []string{"b"}) {
+		t.Errorf("Delta() = %+v, want a and c changed, b removed", changes)
+	}
+	r2 := changes.Revision
+
+	changes, ok = tr.Delta(map[string]string{"a": "2", "b": "1", "c": "1"}, r2)
+	if !ok || !reflect.DeepEqual(changes.Changed, []string{"b"}) || changes.Removed != nil {
+		t.Errorf("Delta() after re-adding b = %+v, %t", changes, ok)
+	}
+	if changes, ok := tr.Delta(map[string]string{"a": "2", "b": "1", "c": "1"}, changes.Revision); !ok || changes.Changed != nil {
+		t.Errorf("Delta() of the current revision = %+v, %t, want no changes", changes, ok)
+	}
+}
+
+func TestDeltaUnknownRevision(t *testing.T) {
+	tr := New()
+	r := tr.Update(map[string]string{"a": "1"})
+	for _, since := range []uint64{0, r + 1} {
+		if changes, ok := tr.Delta(map[string]string{"a": "1"}, since); ok || changes.Revision != r {
+			t.Errorf("Delta(%d) = %+v, %t, want a full listing", since, changes, ok)
+		}
+	}
+}
+
+func TestDeltaForgottenRemovals(t *testing.T) {
+	tr := New()
+	listing := make(map[string]string)
+	for i := 0; i <= maxRemoved; i++ {
+		listing[fmt.Sprint(i)] = "x"
+	}
+	r := tr.Update(listing)
+	for i := 0; i <= maxRemoved; i++ {
+		delete(listing, fmt.Sprint(i))
+		tr.Update(listing)
+	}
+	if _, ok := tr.Delta(listing, r); ok {
+		t.Errorf("Delta() succeeded with removals forgotten")
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+)
+
+const (
+	// Bounds mounting a bucket in the guest, which includes rclone listing it.
+	objectMountTimeout = 30 * time.Second
+)
+
+// objectMounts returns the configured mounts a VM gets: those it asks for by
+// name and the default ones.
+func (s *Server) objectMounts(names []string) ([]cmdserver.ObjectMount, error) {
+	requested := make(map[string]bool, len(names))
+	for _, name := range names {
+		requested[name] = true
+	}
+
+	var mounts []cmdserver.ObjectMount
+	for _, c := range s.config.ObjectMounts {
+		if !c.Default && !requested[c.Name] {
+			continue
+		}
+		delete(requested, c.Name)
+		mount := cmdserver.ObjectMount{
+			Name:            c.Name,
+			Endpoint:        c.Endpoint,
+			Region:          c.Region,
+			Bucket:          c.Bucket,
+			Prefix:          c.Prefix,
+			AccessKeyID:     c.AccessKeyID,
+			SecretAccessKey: c.SecretAccessKey,
+			MountPath:       c.MountPath,
+		}
+		if err := mount.Validate(); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "misconfigured object mount: %v", err)
+		}
+		mounts = append(mounts, mount)
+	}
+	for name := range requested {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown object mount: %s", name)
+	}
+	return mounts, nil
+}
+
+// mountObjects asks the agent of a booted VM to mount the buckets. A bucket
+// that fails to mount doesn't fail the VM, its error is reported instead.
+func (s *Server) mountObjects(ctx context.Context, vm *vm, mounts []cmdserver.ObjectMount) []serverapi.VmObjectMount {
+	if len(mounts) == 0 {
+		return nil
+	}
+	vm.lock.RLock()
+	vmName := vm.name
+	url := s.agent.url(vm.ip.IP.String(), "/mounts")
+	vm.lock.RUnlock()
+
+	result := make([]serverapi.VmObjectMount, len(mounts))
+	for i, mount := range mounts {
+		result[i] = serverapi.VmObjectMount{
+			Name:      serverapi.PtrString(mount.Name),
+			MountPath: serverapi.PtrString(mount.MountPath),
+			Source:    serverapi.PtrString(mount.Location()),
+			State:     serverapi.PtrString("active"),
+		}
+		mountCtx, cancel := context.WithTimeout(ctx, objectMountTimeout)
+		err := cmdserver.RequestMount(mountCtx, s.agent.client(0), url, mount)
+		cancel()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"vmName": vmName,
+				"mount":  mount.Name,
+			}).WithError(err).Warn("Failed to mount bucket")
+			result[i].State = serverapi.PtrString("failed")
+			result[i].Error = serverapi.PtrString(err.Error())
+		}
+	}
+	return result
+}
+
+// VMObjectMounts reports the buckets mounted in a VM and whether they are
+// still being served.
+func (s *Server) VMObjectMounts(ctx context.Context, vmName string) (*serverapi.VmObjectMountsResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	vmIP := vm.ip.IP.String()
+	vm.lock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", s.agent.url(vmIP, "/mounts"), nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create request: %v", err)
+	}
+	resp, err := s.agent.client(0).Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, status.Errorf(codes.Internal, "request failed with status: %d", resp.StatusCode)
+	}
+
+	var agentResp cmdserver.MountsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&agentResp); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode response: %v", err)
+	}
+	apiResp := &serverapi.VmObjectMountsResponse{
+		Mounts: make([]serverapi.VmObjectMount, len(agentResp.Mounts)),
+	}
+	for i, m := range agentResp.Mounts {
+		apiResp.Mounts[i] = serverapi.VmObjectMount{
+			Name:      serverapi.PtrString(m.Name),
+			MountPath: serverapi.PtrString(m.MountPath),
+			Source:    serverapi.PtrString(m.Source),
+			State:     serverapi.PtrString(m.State),
+		}
+	}
+	return apiResp, nil
+}
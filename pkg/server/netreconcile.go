@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/hostnet"
+	"github.com/abshkbh/arrakis/pkg/server/netreconcile"
+)
+
+const defaultNetworkReconcileInterval = 5 * time.Minute
+
+// expectedNetwork describes the network resources the server accounts for.
+func (s *Server) expectedNetwork() (netreconcile.Expected, error) {
+	_, subnet, err := net.ParseCIDR(s.config.BridgeSubnet)
+	if err != nil {
+		return netreconcile.Expected{}, fmt.Errorf("invalid bridge subnet: %w", err)
+	}
+	expected := netreconcile.Expected{
+		Bridge:        s.config.BridgeName,
+		BridgeAddress: s.config.BridgeIP,
+		Subnet:        subnet,
+		IPTables:      s.network.Name() == hostnet.BackendIPTables,
+		TapInUse:      s.fountain.IsAllocated,
+		IPInUse:       s.ipAllocator.IsAllocated,
+		PortInUse:     s.portAllocator.IsAllocated,
+	}
+	// The nftables backend replaces its table wholesale so it can't pile up
+	// duplicates, and an external network owns the bridge's addresses.
+	if s.network.Name() == hostnet.BackendExternal {
+		expected.BridgeAddress = ""
+	}
+	return expected, nil
+}
+
+// ReconcileNetwork removes the tap devices, port forwards, duplicate bridge
+// subnet rules and bridge addresses that no VM accounts for, e.g. left behind
+// by a crashed VM. With dryRun it only reports them.
+func (s *Server) ReconcileNetwork(ctx context.Context, dryRun bool) (*serverapi.HostNetworkReconcileResponse, error) {
+	expected, err := s.expectedNetwork()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	result, err := netreconcile.Reconcile(netreconcile.System{}, expected, dryRun)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reconcile network: %v", err)
+	}
+
+	for _, r := range result.Stale {
+		log.WithFields(log.Fields{
+			"kind":   r.Kind,
+			"name":   r.Name,
+			"reason": r.Reason,
+			"dryRun": dryRun,
+		}).Info("Stale network resource")
+	}
+	for _, msg := range result.Errors {
+		log.Warn(msg)
+	}
+
+	resp := &serverapi.HostNetworkReconcileResponse{
+		Stale:   make([]serverapi.HostNetworkResource, len(result.Stale)),
+		Removed: serverapi.PtrInt32(int32(result.Removed)),
+		DryRun:  serverapi.PtrBool(result.DryRun),
+		Errors:  result.Errors,
+	}
+	for i, r := range result.Stale {
+		resp.Stale[i] = serverapi.HostNetworkResource{
+			Kind:   serverapi.PtrString(string(r.Kind)),
+			Name:   serverapi.PtrString(r.Name),
+			Reason: serverapi.PtrString(r.Reason),
+		}
+	}
+	return resp, nil
+}
+
+// ReconcileNetworkPeriodically runs ReconcileNetwork every configured
+// interval until ctx is done.
+func (s *Server) ReconcileNetworkPeriodically(ctx context.Context) {
+	interval := s.config.NetworkReconcile.Interval
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = defaultNetworkReconcileInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.ReconcileNetwork(ctx, false); err != nil {
+				log.WithError(err).Error("Failed to reconcile network")
+			}
+		}
+	}
+}
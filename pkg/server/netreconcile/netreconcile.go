@@ -0,0 +1,331 @@
+package netreconcile
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Kind is the kind of a network resource on the host.
+type Kind string
+
+const (
+	// KindTapDevice is a tap device attached to the bridge.
+	KindTapDevice Kind = "tap_device"
+	// KindPortForward is a DNAT rule forwarding a host port to a guest.
+	KindPortForward Kind = "port_forward"
+	// KindDuplicateRule is a copy of a bridge subnet rule, added each time
+	// the bridge was recreated.
+	KindDuplicateRule Kind = "duplicate_rule"
+	// KindBridgeAddress is an address on the bridge.
+	KindBridgeAddress Kind = "bridge_address"
+	// KindEgressBlock is a rule dropping the egress of a guest.
+	KindEgressBlock Kind = "egress_block"
+)
+
+// Resource is a stale network resource.
+type Resource struct {
+	Kind Kind `json:"kind"`
+	// Name is the device, iptables rule or address.
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+
+	// Where the resource lives, to remove it.
+	device string
+	table  string
+}
+
+// Expected describes the network resources that should exist. The InUse
+// functions consult the allocators, which hand out devices, addresses and
+// ports before they are set up and take them back after they are torn down,
+// so that resources of VMs being created or destroyed are never stale.
+type Expected struct {
+	Bridge string
+	// BridgeAddress is the configured address of the bridge, e.g.
+	// "10.20.1.1/24". Empty leaves the bridge's addresses alone.
+	BridgeAddress string
+	// Subnet is the bridge subnet guests get their addresses from.
+	Subnet *net.IPNet
+	// IPTables is set when the port forwards and bridge subnet rules are
+	// iptables rules the server manages.
+	IPTables  bool
+	TapInUse  func(name string) bool
+	IPInUse   func(ip net.IP) bool
+	PortInUse func(port int32) bool
+}
+
+// Host reads and changes the host's network state.
+type Host interface {
+	// BridgePorts lists the devices attached to the bridge.
+	BridgePorts(bridge string) ([]string, error)
+	// BridgeAddresses lists the IPv4 addresses of the bridge in CIDR form.
+	BridgeAddresses(bridge string) ([]string, error)
+	// Rules lists the rules of a chain as `iptables -S` prints them.
+	Rules(table string, chain string) ([]string, error)
+	// Remove deletes a resource.
+	Remove(r Resource) error
+}
+
+// Result reports a reconciliation.
+type Result struct {
+	Stale []Resource `json:"stale"`
+	// Removed counts the stale resources deleted, always 0 for dry runs.
+	Removed int      `json:"removed"`
+	DryRun  bool     `json:"dryRun"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// Find lists the resources on host that expected doesn't account for.
+func Find(host Host, expected Expected) ([]Resource, error) {
+	var stale []Resource
+
+	ports, err := host.BridgePorts(expected.Bridge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bridge ports: %w", err)
+	}
+	for _, port := range ports {
+		if strings.HasPrefix(port, "tap") && !expected.TapInUse(port) {
+			stale = append(stale, Resource{
+				Kind:   KindTapDevice,
+				Name:   port,
+				Reason: "not used by any VM",
+				device: port,
+			})
+		}
+	}
+
+	if expected.IPTables {
+		rules, err := findStaleRules(host, expected)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, rules...)
+	}
+
+	if expected.BridgeAddress == "" {
+		return stale, nil
+	}
+	addresses, err := host.BridgeAddresses(expected.Bridge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bridge addresses: %w", err)
+	}
+	for _, address := range addresses {
+		if address != expected.BridgeAddress {
+			stale = append(stale, Resource{
+				Kind:   KindBridgeAddress,
+				Name:   address,
+				Reason: fmt.Sprintf("not the configured bridge address %s", expected.BridgeAddress),
+				device: expected.Bridge,
+			})
+		}
+	}
+	return stale, nil
+}
+
+// findStaleRules lists the port forwards and egress blocks no VM accounts for
+// and the duplicates of the bridge subnet's rules.
+func findStaleRules(host Host, expected Expected) ([]Resource, error) {
+	var stale []Resource
+	rules, err := host.Rules("nat", "PREROUTING")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list port forwards: %w", err)
+	}
+	for _, rule := range rules {
+		hostPort, guestIP, ok := parseDNAT(rule)
+		if !ok || !expected.Subnet.Contains(guestIP) {
+			continue
+		}
+		reason := ""
+		if !expected.IPInUse(guestIP) {
+			reason = fmt.Sprintf("forwards to %s which no VM has", guestIP)
+		} else if !expected.PortInUse(hostPort) {
+			reason = fmt.Sprintf("host port %d is not allocated", hostPort)
+		}
+		if reason != "" {
+			stale = append(stale, Resource{Kind: KindPortForward, Name: rule, Reason: reason, table: "nat"})
+		}
+	}
+
+	rules, err = host.Rules("filter", "FORWARD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list egress blocks: %w", err)
+	}
+	for _, rule := range rules {
+		// A block left on a free address would cut off the next VM to get it.
+		if guestIP := parseEgressBlock(rule); guestIP != nil && expected.Subnet.Contains(guestIP) && !expected.IPInUse(guestIP) {
+			stale = append(stale, Resource{
+				Kind:   KindEgressBlock,
+				Name:   rule,
+				Reason: fmt.Sprintf("blocks %s which no VM has", guestIP),
+				table:  "filter",
+			})
+		}
+	}
+
+	for _, chain := range []struct{ table, name string }{
+		{"nat", "POSTROUTING"},
+		{"filter", "FORWARD"},
+	} {
+		rules, err := host.Rules(chain.table, chain.name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s rules: %w", chain.name, err)
+		}
+		seen := make(map[string]bool)
+		for _, rule := range rules {
+			if !strings.Contains(rule, expected.Subnet.String()) {
+				continue
+			}
+			if seen[rule] {
+				stale = append(stale, Resource{
+					Kind:   KindDuplicateRule,
+					Name:   rule,
+					Reason: "duplicate of an earlier rule",
+					table:  chain.table,
+				})
+			}
+			seen[rule] = true
+		}
+	}
+
+	return stale, nil
+}
+
+// Reconcile removes the stale resources on host, or with dryRun only reports
+// them.
+func Reconcile(host Host, expected Expected, dryRun bool) (Result, error) {
+	result := Result{DryRun: dryRun, Stale: []Resource{}}
+	stale, err := Find(host, expected)
+	if err != nil {
+		return result, err
+	}
+	result.Stale = append(result.Stale, stale...)
+	if dryRun {
+		return result, nil
+	}
+	for _, r := range stale {
+		if err := host.Remove(r); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("failed to remove %s %s: %v", r.Kind, r.Name, err))
+			continue
+		}
+		result.Removed++
+	}
+	return result, nil
+}
+
+// parseDNAT extracts the host port and guest IP of a DNAT rule, e.g.
+// "-A PREROUTING -p tcp -m tcp --dport 3000 -j DNAT --to-destination 10.20.1.2:5901".
+func parseDNAT(rule string) (int32, net.IP, bool) {
+	fields := strings.Fields(rule)
+	var hostPort int32
+	var guestIP net.IP
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "--dport":
+			port, err := strconv.ParseInt(fields[i+1], 10, 32)
+			if err != nil {
+				return 0, nil, false
+			}
+			hostPort = int32(port)
+		case "--to-destination":
+			host, _, err := net.SplitHostPort(fields[i+1])
+			if err != nil {
+				host = fields[i+1]
+			}
+			guestIP = net.ParseIP(host)
+		}
+	}
+	return hostPort, guestIP, hostPort != 0 && guestIP != nil
+}
+
+// parseEgressBlock extracts the guest IP of a rule blocking its egress, e.g.
+// "-A FORWARD -s 10.20.1.2/32 -m conntrack ! --ctstate DNAT -j DROP".
+func parseEgressBlock(rule string) net.IP {
+	if !strings.HasPrefix(rule, "-A FORWARD ") || !strings.HasSuffix(rule, "--ctstate DNAT -j DROP") {
+		return nil
+	}
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "-s" {
+			ip, _, err := net.ParseCIDR(fields[i+1])
+			if err != nil {
+				return net.ParseIP(fields[i+1])
+			}
+			return ip
+		}
+	}
+	return nil
+}
+
+// System is the host this process runs on.
+type System struct{}
+
+func (System) BridgePorts(bridge string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join("/sys/class/net", bridge, "brif"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]string, len(entries))
+	for i, e := range entries {
+		ports[i] = e.Name()
+	}
+	return ports, nil
+}
+
+func (System) BridgeAddresses(bridge string) ([]string, error) {
+	output, err := exec.Command("ip", "-o", "-4", "addr", "show", "dev", bridge).Output()
+	if err != nil {
+		// The bridge doesn't exist yet.
+		return nil, nil
+	}
+	var addresses []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "inet" {
+				addresses = append(addresses, fields[i+1])
+			}
+		}
+	}
+	return addresses, nil
+}
+
+func (System) Rules(table string, chain string) ([]string, error) {
+	output, err := exec.Command("iptables", "-t", table, "-S", chain).Output()
+	if err != nil {
+		return nil, err
+	}
+	var rules []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			rules = append(rules, line)
+		}
+	}
+	return rules, nil
+}
+
+func (System) Remove(r Resource) error {
+	var args []string
+	switch r.Kind {
+	case KindTapDevice:
+		args = []string{"ip", "link", "delete", r.device}
+	case KindBridgeAddress:
+		args = []string{"ip", "addr", "del", r.Name, "dev", r.device}
+	case KindPortForward, KindDuplicateRule, KindEgressBlock:
+		// Deleting by specification removes the first matching rule.
+		fields := strings.Fields(r.Name)
+		args = append([]string{"iptables", "-t", r.table, "-D"}, fields[1:]...)
+	default:
+		return fmt.Errorf("unknown resource kind: %s", r.Kind)
+	}
+	if output, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s %w", strings.Join(args, " "), output, err)
+	}
+	return nil
+}
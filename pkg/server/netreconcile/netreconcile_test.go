@@ -0,0 +1,111 @@
+package netreconcile
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+type fakeHost struct {
+	ports     []string
+	addresses []string
+	rules     map[string][]string
+	removed   []string
+	fail      string
+}
+
+func (f *fakeHost) BridgePorts(bridge string) ([]string, error) { return f.ports, nil }
+
+func (f *fakeHost) BridgeAddresses(bridge string) ([]string, error) { return f.addresses, nil }
+
+func (f *fakeHost) Rules(table string, chain string) ([]string, error) {
+	return f.rules[table+"/"+chain], nil
+}
+
+func (f *fakeHost) Remove(r Resource) error {
+	if r.Name == f.fail {
+		return errors.New("busy")
+	}
+	f.removed = append(f.removed, r.Name)
+	return nil
+}
+
+func TestReconcile(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.20.1.0/24")
+	expected := Expected{
+		Bridge:        "br0",
+		BridgeAddress: "10.20.1.1/24",
+		Subnet:        subnet,
+		IPTables:      true,
+		TapInUse:      func(name string) bool { return name == "tap0" },
+		IPInUse:       func(ip net.IP) bool { return ip.Equal(net.ParseIP("10.20.1.2")) },
+		PortInUse:     func(port int32) bool { return port == 3000 },
+	}
+	masquerade := "-A POSTROUTING -s 10.20.1.0/24 -o eth0 -j MASQUERADE"
+	host := &fakeHost{
+		ports:     []string{"tap0", "tap1", "eth1"},
+		addresses: []string{"10.20.1.1/24", "10.30.1.1/24"},
+		rules: map[string][]string{
+			"nat/PREROUTING": {
+				"-A PREROUTING -p tcp -m tcp --dport 3000 -j DNAT --to-destination 10.20.1.2:5901",
+				"-A PREROUTING -p tcp -m tcp --dport 3001 -j DNAT --to-destination 10.20.1.2:9223",
+				"-A PREROUTING -p tcp -m tcp --dport 3002 -j DNAT --to-destination 10.20.1.3:5901",
+				"-A PREROUTING -p tcp -m tcp --dport 8080 -j DNAT --to-destination 192.168.1.5:80",
+			},
+			"nat/POSTROUTING": {masquerade, masquerade, "-A POSTROUTING -o eth0 -j MASQUERADE"},
+			"filter/FORWARD": {
+				"-A FORWARD -s 10.20.1.2/32 -m conntrack ! --ctstate DNAT -j DROP",
+				"-A FORWARD -s 10.20.1.3/32 -m conntrack ! --ctstate DNAT -j DROP",
+				"-A FORWARD -d 10.20.1.0/24 -j ACCEPT",
+				"-A FORWARD -s 10.20.1.0/24 -j ACCEPT",
+			},
+		},
+	}
+
+	dry, err := Reconcile(host, expected, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range dry.Stale {
+		got = append(got, string(r.Kind))
+	}
+	want := "tap_device port_forward port_forward egress_block duplicate_rule bridge_address"
+	if strings.Join(got, " ") != want || len(host.removed) != 0 {
+		t.Fatalf("Dry run found %v and removed %v, want %s", got, host.removed, want)
+	}
+	if !strings.Contains(dry.Stale[1].Reason, "port 3001") || !strings.Contains(dry.Stale[2].Reason, "10.20.1.3") {
+		t.Errorf("Port forward reasons = %q, %q", dry.Stale[1].Reason, dry.Stale[2].Reason)
+	}
+
+	host.fail = "tap1"
+	result, err := Reconcile(host, expected, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 5 || len(result.Errors) != 1 || len(host.removed) != 5 {
+		t.Errorf("Reconcile = %+v, removed %v", result, host.removed)
+	}
+
+	// Without iptables and the bridge address to manage only taps are stale.
+	expected.IPTables = false
+	expected.BridgeAddress = ""
+	stale, err := Find(host, expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].Kind != KindTapDevice {
+		t.Errorf("Find = %+v, want the stale tap only", stale)
+	}
+}
+
+func TestParseDNAT(t *testing.T) {
+	port, ip, ok := parseDNAT("-A PREROUTING -p tcp -m tcp --dport 3000 -j DNAT --to-destination 10.20.1.2:5901")
+	if !ok || port != 3000 || !ip.Equal(net.ParseIP("10.20.1.2")) {
+		t.Errorf("parseDNAT = %d, %v, %v", port, ip, ok)
+	}
+	if _, _, ok := parseDNAT("-A PREROUTING -j ACCEPT"); ok {
+		t.Error("Parsed a rule that isn't a port forward")
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/server/notify"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+)
+
+const (
+	defaultDiskUsagePercent  = 90
+	defaultDiskCheckInterval = time.Minute
+)
+
+// newNotifier returns the notifier of the config, nil if no webhook is
+// configured.
+func newNotifier(cfg config.NotificationsConfig) (*notify.Notifier, error) {
+	rules := make([]notify.Rule, len(cfg.Rules))
+	for i, r := range cfg.Rules {
+		rules[i] = notify.Rule{
+			Events:   r.Events,
+			URL:      r.URL,
+			Format:   r.Format,
+			Template: r.Template,
+			Headers:  r.Headers,
+			Cooldown: r.Cooldown,
+		}
+	}
+	return notify.New(rules)
+}
+
+// notify sends an event about this host.
+func (s *Server) notify(e notify.Event) {
+	e.Host = s.host
+	s.notifier.Notify(e)
+}
+
+// noteVMFailure counts a failed start or boot of a VM and notifies that it's
+// crash-looping once it failed too often.
+// Requests that are rejected, rather than VMs that fail, aren't counted.
+func (s *Server) noteVMFailure(vmName string, owner string, err error) {
+	if code := status.Code(err); code != codes.Unknown && code != codes.Internal {
+		return
+	}
+	failures, looping := s.crashLoops.Fail(vmName, time.Now())
+	if !looping {
+		return
+	}
+	log.WithFields(log.Fields{
+		"vmName":   vmName,
+		"failures": failures,
+	}).Warn("VM is crash-looping")
+	if vm := s.getVMAtomic(vmName); vm != nil {
+		vm.record(timeline.KindHealth, "crash_looping", fmt.Sprintf("VM failed %d times in a row", failures), map[string]string{"error": err.Error()})
+	}
+	s.notify(notify.Event{
+		Kind:    notify.KindCrashLooping,
+		VM:      vmName,
+		Owner:   owner,
+		Message: fmt.Sprintf("failed to start %d times recently, last: %v", failures, err),
+		Details: map[string]string{
+			"failures": strconv.Itoa(failures),
+			"window":   s.crashLoops.Window().String(),
+			"error":    err.Error(),
+		},
+	})
+}
+
+// noteQuotaExceeded notifies that a VM of owner was turned away for lack of
+// capacity.
+func (s *Server) noteQuotaExceeded(vmName string, owner string, err error) {
+	s.notify(notify.Event{
+		Kind:    notify.KindQuotaExceeded,
+		VM:      vmName,
+		Owner:   owner,
+		Message: err.Error(),
+	})
+}
+
+// diskUsagePercent returns how full the filesystem of dir is.
+func diskUsagePercent(dir string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	if st.Blocks == 0 {
+		return 0, nil
+	}
+	// Blocks reserved for root aren't available to the server either.
+	used := st.Blocks - st.Bfree
+	return 100 * float64(used) / float64(used+st.Bavail), nil
+}
+
+// CheckDisk notifies if the filesystem of the state dir is nearly full.
+func (s *Server) CheckDisk() {
+	threshold := s.config.Notifications.DiskUsagePercent
+	if threshold <= 0 {
+		threshold = defaultDiskUsagePercent
+	}
+	usage, err := diskUsagePercent(s.config.StateDir)
+	if err != nil {
+		log.WithError(err).Warn("Failed to check disk usage")
+		return
+	}
+	if usage < threshold {
+		return
+	}
+	s.notify(notify.Event{
+		Kind:    notify.KindDiskFull,
+		Message: fmt.Sprintf("%s is %.1f%% full", s.config.StateDir, usage),
+		Details: map[string]string{
+			"path":         s.config.StateDir,
+			"usagePercent": strconv.FormatFloat(usage, 'f', 1, 64),
+		},
+	})
+}
+
+// CheckDiskPeriodically checks the disk usage until ctx is done, if
+// notifications are configured.
+func (s *Server) CheckDiskPeriodically(ctx context.Context) {
+	if s.notifier == nil {
+		return
+	}
+	interval := s.config.Notifications.DiskCheckInterval
+	if interval <= 0 {
+		interval = defaultDiskCheckInterval
+	}
+	s.CheckDisk()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.CheckDisk()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package notify
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultCrashLoopFailures = 3
+	defaultCrashLoopWindow   = 10 * time.Minute
+)
+
+// CrashLoops tells VMs that keep failing to start or boot, i.e. that are
+// crash-looping.
+type CrashLoops struct {
+	failures int
+	window   time.Duration
+
+	mu   sync.Mutex
+	byVM map[string][]time.Time // of the failures within the window
+}
+
+// NewCrashLoops returns a detector of VMs failing failures times within
+// window, which default to 3 and 10m.
+func NewCrashLoops(failures int, window time.Duration) *CrashLoops {
+	if failures <= 0 {
+		failures = defaultCrashLoopFailures
+	}
+	if window <= 0 {
+		window = defaultCrashLoopWindow
+	}
+	return &CrashLoops{
+		failures: failures,
+		window:   window,
+		byVM:     make(map[string][]time.Time),
+	}
+}
+
+// Fail notes that vmName failed at now, and returns how often it failed
+// within the window and whether that makes it crash-looping.
+func (c *CrashLoops) Fail(vmName string, now time.Time) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	recent := c.byVM[vmName][:0]
+	for _, t := range c.byVM[vmName] {
+		if now.Sub(t) < c.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	c.byVM[vmName] = recent
+	return len(recent), len(recent) >= c.failures
+}
+
+// Window returns the time within which failures count.
+func (c *CrashLoops) Window() time.Duration {
+	return c.window
+}
+
+// Forget drops the failures of a VM, e.g. once it's destroyed.
+func (c *CrashLoops) Forget(vmName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.byVM, vmName)
+}
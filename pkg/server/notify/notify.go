@@ -0,0 +1,233 @@
+// Package notify sends operational events, such as a VM crash-looping or the
+// host's disk filling up, to Slack-compatible or other HTTP webhooks, with
+// their text rendered through templates.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of events.
+const (
+	KindCrashLooping  = "vm_crash_looping"
+	KindDiskFull      = "host_disk_full"
+	KindQuotaExceeded = "quota_exceeded"
+	// KindScaleUp and KindScaleDown recommend adding or removing hosts.
+	KindScaleUp   = "scale_up_recommended"
+	KindScaleDown = "scale_down_recommended"
+)
+
+// Formats of the requests to webhooks.
+const (
+	// FormatSlack posts {"text": <text>}, which Slack's incoming webhooks
+	// and the services compatible with them accept.
+	FormatSlack = "slack"
+	// FormatJSON posts the event with its text.
+	FormatJSON = "json"
+)
+
+const (
+	defaultTemplate = "[{{.Host}}] {{.Kind}}{{if .VM}} {{.VM}}{{end}}: {{.Message}}"
+	defaultCooldown = 10 * time.Minute
+	sendTimeout     = 30 * time.Second
+)
+
+var kinds = map[string]bool{
+	KindCrashLooping:  true,
+	KindDiskFull:      true,
+	KindQuotaExceeded: true,
+	KindScaleUp:       true,
+	KindScaleDown:     true,
+}
+
+// Event is something operators should hear about.
+type Event struct {
+	Kind    string            `json:"kind"`
+	Host    string            `json:"host"`
+	VM      string            `json:"vm,omitempty"`
+	Owner   string            `json:"owner,omitempty"`
+	Message string            `json:"message"`
+	Time    time.Time         `json:"time"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// subject is what an event is about, events of a kind about the same subject
+// are sent once per cooldown.
+func (e Event) subject() string {
+	switch {
+	case e.VM != "":
+		return "vm/" + e.VM
+	case e.Owner != "":
+		return "owner/" + e.Owner
+	}
+	return "host/" + e.Host
+}
+
+// Rule sends some events to a webhook.
+type Rule struct {
+	// Events are the kinds of events sent, every kind if empty.
+	Events   []string
+	URL      string
+	Format   string // FormatSlack if empty
+	Template string // of the event's text, a Go text/template of Event
+	Headers  map[string]string
+	Cooldown time.Duration
+}
+
+type rule struct {
+	Rule
+	events   map[string]bool
+	template *template.Template
+}
+
+// Notifier sends events to the webhooks of its rules.
+type Notifier struct {
+	rules  []*rule
+	client *http.Client
+
+	mu   sync.Mutex
+	sent map[string]time.Time // by rule, kind and subject
+}
+
+// New returns a notifier sending events by rules, or nil if there are none.
+func New(rules []Rule) (*Notifier, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	n := &Notifier{
+		client: &http.Client{Timeout: sendTimeout},
+		sent:   make(map[string]time.Time),
+	}
+	for i, r := range rules {
+		compiled := &rule{Rule: r, events: make(map[string]bool)}
+		if compiled.Format == "" {
+			compiled.Format = FormatSlack
+		}
+		if compiled.Format != FormatSlack && compiled.Format != FormatJSON {
+			return nil, fmt.Errorf("rules[%d].format must be %s or %s", i, FormatSlack, FormatJSON)
+		}
+		if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("rules[%d].url must be an http or https URL", i)
+		}
+		for _, kind := range r.Events {
+			if !kinds[kind] {
+				return nil, fmt.Errorf("rules[%d] has unknown event %q", i, kind)
+			}
+			compiled.events[kind] = true
+		}
+		text := r.Template
+		if text == "" {
+			text = defaultTemplate
+		}
+		tmpl, err := template.New(fmt.Sprintf("rules[%d]", i)).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of rules[%d]: %w", i, err)
+		}
+		compiled.template = tmpl
+		if compiled.Cooldown <= 0 {
+			compiled.Cooldown = defaultCooldown
+		}
+		n.rules = append(n.rules, compiled)
+	}
+	return n, nil
+}
+
+// Notify sends e to the webhooks of the rules it matches in the background,
+// unless they got an event of its kind about its subject within their
+// cooldown. Failures are logged.
+func (n *Notifier) Notify(e Event) {
+	if n == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for i, r := range n.rules {
+		if len(r.events) > 0 && !r.events[e.Kind] {
+			continue
+		}
+		if !n.due(fmt.Sprintf("%d/%s/%s", i, e.Kind, e.subject()), e.Time, r.Cooldown) {
+			continue
+		}
+		go func(r *rule) {
+			if err := n.send(r, e); err != nil {
+				log.WithFields(log.Fields{
+					"kind":    e.Kind,
+					"subject": e.subject(),
+				}).WithError(err).Warn("Failed to send notification")
+			}
+		}(r)
+	}
+}
+
+// due reports whether an event with key may be sent at now, noting it's sent
+// if so.
+func (n *Notifier) due(key string, now time.Time, cooldown time.Duration) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if last, ok := n.sent[key]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	n.sent[key] = now
+	return true
+}
+
+// render returns the text of e by the template of r.
+func (r *rule) render(e Event) (string, error) {
+	var text strings.Builder
+	if err := r.template.Execute(&text, e); err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
+
+func (n *Notifier) send(r *rule, e Event) error {
+	text, err := r.render(e)
+	if err != nil {
+		return fmt.Errorf("failed to render template: %w", err)
+	}
+	var payload any = struct {
+		Text string `json:"text"`
+	}{text}
+	if r.Format == FormatJSON {
+		payload = struct {
+			Event
+			Text string `json:"text"`
+		}{e, text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range r.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type request struct {
+	header http.Header
+	body   map[string]any
+}
+
+func webhook(t *testing.T) (*httptest.Server, <-chan request) {
+	t.Helper()
+	requests := make(chan request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		requests <- request{header: r.Header, body: body}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func receive(t *testing.T, requests <-chan request) request {
+	t.Helper()
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification sent")
+	}
+	return request{}
+}
+
+func expectNone(t *testing.T, requests <-chan request) {
+	t.Helper()
+	select {
+	case r := <-requests:
+		t.Errorf("unexpected notification %v", r.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotifySlack(t *testing.T) {
+	srv, requests := webhook(t)
+	n, err := New([]Rule{{
+		Events:   []string{KindCrashLooping},
+		URL:      srv.URL,
+		Template: "{{.VM}} on {{.Host}} failed {{.Details.failures}} times",
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	e := Event{Kind: KindCrashLooping, Host: "host1", VM: "vm1", Time: now, Details: map[string]string{"failures": "3"}}
+	n.Notify(e)
+	r := receive(t, requests)
+	if r.body["text"] != "vm1 on host1 failed 3 times" {
+		t.Errorf("text = %v", r.body["text"])
+	}
+	if r.header.Get("Authorization") != "Bearer token" {
+		t.Errorf("headers = %v", r.header)
+	}
+
+	// Within the cooldown only other VMs are notified about.
+	e.Time = now.Add(time.Minute)
+	n.Notify(e)
+	expectNone(t, requests)
+	e.VM = "vm2"
+	n.Notify(e)
+	receive(t, requests)
+
+	// Kinds the rule doesn't list aren't sent.
+	n.Notify(Event{Kind: KindDiskFull, Host: "host1", Time: now})
+	expectNone(t, requests)
+
+	e.VM = "vm1"
+	e.Time = now.Add(defaultCooldown)
+	n.Notify(e)
+	receive(t, requests)
+}
+
+func TestNotifyJSON(t *testing.T) {
+	srv, requests := webhook(t)
+	n, err := New([]Rule{{URL: srv.URL, Format: FormatJSON}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(Event{Kind: KindQuotaExceeded, Host: "host1", Owner: "alice", Message: "out of memory"})
+	r := receive(t, requests)
+	if r.body["kind"] != KindQuotaExceeded || r.body["owner"] != "alice" || r.body["text"] != "[host1] quota_exceeded: out of memory" {
+		t.Errorf("body = %v", r.body)
+	}
+}
+
+func TestNewRejects(t *testing.T) {
+	for _, rules := range [][]Rule{
+		{{URL: "ftp://example.com"}},
+		{{URL: "http://example.com", Format: "xml"}},
+		{{URL: "http://example.com", Events: []string{"vm_exploded"}}},
+		{{URL: "http://example.com", Template: "{{.Kind"}},
+	} {
+		if _, err := New(rules); err == nil {
+			t.Errorf("New(%v) succeeded, want an error", rules)
+		}
+	}
+	if n, err := New(nil); n != nil || err != nil {
+		t.Errorf("New(nil) = %v, %v", n, err)
+	}
+	// A nil notifier drops events.
+	(*Notifier)(nil).Notify(Event{Kind: KindDiskFull})
+}
+
+func TestCrashLoops(t *testing.T) {
+	c := NewCrashLoops(3, time.Minute)
+	now := time.Now()
+	for i, want := range []bool{false, false, true} {
+		if _, looping := c.Fail("vm1", now.Add(time.Duration(i)*time.Second)); looping != want {
+			t.Errorf("failure %d: looping = %t, want %t", i+1, looping, want)
+		}
+	}
+	// Failures outside the window don't count.
+	if n, looping := c.Fail("vm1", now.Add(2*time.Minute)); n != 1 || looping {
+		t.Errorf("Fail after the window = %d, %t", n, looping)
+	}
+	c.Forget("vm1")
+	if n, _ := c.Fail("vm1", now.Add(2*time.Minute)); n != 1 {
+		t.Errorf("Fail after Forget = %d, want 1", n)
+	}
+}
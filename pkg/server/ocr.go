@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/rfb"
+	"github.com/abshkbh/arrakis/pkg/server/ocr"
+)
+
+// Sources of the screenshots OCR runs on.
+const (
+	ocrSourceDesktop = "desktop"
+	ocrSourceBrowser = "browser"
+)
+
+const (
+	// chromeDevToolsPort is where the guest image's forwarder serves the
+	// DevTools protocol of Chrome, see resources/arrakis-chrome-forwarder.service,
+	// unless the port forwards declare another port.
+	chromeDevToolsPort = 9223
+	// screenCaptureTimeout bounds capturing a VM's screen.
+	screenCaptureTimeout = 30 * time.Second
+)
+
+// VMOCR captures the desktop or browser page of a running VM and returns the
+// words the OCR engine finds on it, with their bounding boxes.
+func (s *Server) VMOCR(ctx context.Context, vmName string, req serverapi.VmOcrRequest) (*serverapi.VmOcrResponse, error) {
+	if s.ocr == nil {
+		return nil, status.Error(codes.Unimplemented, "no OCR engine is configured on this host")
+	}
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	vmStatus := vm.status
+	vmIP := vm.ip.IP.String()
+	devToolsPort := vm.devToolsPort()
+	vm.lock.RUnlock()
+	if vmStatus != vmStatusRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is %s, only running VMs can be captured", vmName, vmStatus)
+	}
+	if minConfidence := req.GetMinConfidence(); minConfidence < 0 || minConfidence > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "minConfidence must be between 0 and 100")
+	}
+
+	source := req.GetSource()
+	if source == "" {
+		source = ocrSourceDesktop
+	}
+	captureCtx, cancel := context.WithTimeout(ctx, screenCaptureTimeout)
+	defer cancel()
+	var screenshot []byte
+	switch source {
+	case ocrSourceDesktop:
+		display := cmdserver.DefaultDisplay
+		if req.Display != nil {
+			display = int(req.GetDisplay())
+		}
+		port, err := cmdserver.DesktopPort(display)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		screenshot, err = s.captureDesktop(captureCtx, net.JoinHostPort(vmIP, strconv.Itoa(port)))
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to capture display %d: %v", display, err)
+		}
+	case ocrSourceBrowser:
+		var err error
+		screenshot, err = captureBrowser(captureCtx, net.JoinHostPort(vmIP, strconv.Itoa(devToolsPort)), req.GetTarget())
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to capture the browser: %v", err)
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown source %q, must be %s or %s", source, ocrSourceDesktop, ocrSourceBrowser)
+	}
+	bounds, _, err := image.DecodeConfig(bytes.NewReader(screenshot))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "invalid screenshot: %v", err)
+	}
+
+	words, err := s.ocr.Recognize(ctx, screenshot, req.GetLanguage())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "OCR failed: %v", err)
+	}
+	kept := make([]ocr.Word, 0, len(words))
+	for _, word := range words {
+		if word.Confidence >= req.GetMinConfidence() {
+			kept = append(kept, word)
+		}
+	}
+	log.WithFields(log.Fields{"vmName": vmName, "source": source}).Infof("Extracted %d words", len(kept))
+
+	resp := &serverapi.VmOcrResponse{
+		Source: serverapi.PtrString(source),
+		Engine: serverapi.PtrString(s.ocr.Name()),
+		Width:  serverapi.PtrInt32(int32(bounds.Width)),
+		Height: serverapi.PtrInt32(int32(bounds.Height)),
+		Text:   serverapi.PtrString(ocr.Text(kept)),
+		Words:  make([]serverapi.VmOcrWord, len(kept)),
+	}
+	for i, word := range kept {
+		resp.Words[i] = serverapi.VmOcrWord{
+			Text:       serverapi.PtrString(word.Text),
+			X:          serverapi.PtrInt32(int32(word.X)),
+			Y:          serverapi.PtrInt32(int32(word.Y)),
+			Width:      serverapi.PtrInt32(int32(word.Width)),
+			Height:     serverapi.PtrInt32(int32(word.Height)),
+			Confidence: serverapi.PtrFloat64(word.Confidence),
+			Line:       serverapi.PtrInt32(int32(word.Line)),
+		}
+	}
+	return resp, nil
+}
+
+// captureDesktop returns a PNG of the desktop of the VNC server at addr.
+func (s *Server) captureDesktop(ctx context.Context, addr string) ([]byte, error) {
+	img, err := s.captureDesktopImage(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// captureDesktopImage returns the desktop of the VNC server at addr.
+func (s *Server) captureDesktopImage(ctx context.Context, addr string) (image.Image, error) {
+	password := s.config.VNCPassword
+	if password == "" {
+		password = cmdserver.DefaultVNCPassword
+	}
+	client, err := rfb.Dial(ctx, addr, password)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.Capture(ctx)
+}
+
+// devToolsPort returns the guest port serving the DevTools protocol of the
+// VM's default browser, as declared by its port forwards. The caller must
+// hold the VM's lock.
+func (v *vm) devToolsPort() int {
+	for _, pf := range v.portForwards {
+		if pf.service != nil && pf.service.Proxy == config.ServiceProxyCDP && pf.service.Name == config.DefaultBrowserService {
+			return int(pf.guestPort)
+		}
+	}
+	return chromeDevToolsPort
+}
+
+// captureBrowser returns a PNG of the page of the DevTools target targetID,
+// or of the first page if empty, of the Chrome at addr.
+func captureBrowser(ctx context.Context, addr string, targetID string) ([]byte, error) {
+	if targetID == "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://"+addr+"/json/list", nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("listing targets failed with status %d", resp.StatusCode)
+		}
+		var targets []struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil {
+			return nil, fmt.Errorf("failed to decode targets: %v", err)
+		}
+		for _, target := range targets {
+			if target.Type == "page" {
+				targetID = target.ID
+				break
+			}
+		}
+		if targetID == "" {
+			return nil, fmt.Errorf("no page is open")
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, "ws://"+addr+"/devtools/page/"+url.PathEscape(targetID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to target %s: %v", targetID, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+
+	const captureID = 1
+	if err := conn.WriteJSON(map[string]interface{}{
+		"id":     captureID,
+		"method": "Page.captureScreenshot",
+		"params": map[string]interface{}{"format": "png"},
+	}); err != nil {
+		return nil, err
+	}
+	for {
+		var msg struct {
+			ID     int `json:"id"`
+			Result struct {
+				Data string `json:"data"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return nil, err
+		}
+		// Skip the events the target sends meanwhile.
+		if msg.ID != captureID {
+			continue
+		}
+		if msg.Error != nil {
+			return nil, fmt.Errorf("Page.captureScreenshot failed: %s", msg.Error.Message)
+		}
+		return base64.StdEncoding.DecodeString(msg.Result.Data)
+	}
+}
@@ -0,0 +1,285 @@
+// Package ocr extracts the words of screenshots, with their bounding boxes,
+// through an OCR engine run on the host: tesseract, another command or an
+// HTTP service.
+package ocr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLanguage = "eng"
+	defaultTimeout  = time.Minute
+	// maxOutput bounds what is read of an engine's output.
+	maxOutput = 16 << 20
+)
+
+// Word is a word found on a screenshot.
+type Word struct {
+	Text string `json:"text"`
+	// X, Y, Width and Height of the word's bounding box, in pixels from the
+	// top left corner of the screenshot.
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Confidence of the engine in the word, from 0 to 100.
+	Confidence float64 `json:"confidence"`
+	// Line numbers the lines of text, words of a line share it.
+	Line int `json:"line"`
+}
+
+// Engine recognizes the words of PNG screenshots.
+type Engine interface {
+	// Name identifies the engine in responses.
+	Name() string
+	// Recognize returns the words of png in reading order. language is
+	// given as tesseract names languages, e.g. "eng" or "eng+deu".
+	Recognize(ctx context.Context, png []byte, language string) ([]Word, error)
+}
+
+// New returns the engine running the tesseract binary, running command with
+// the path of the screenshot appended as its last argument, or posting
+// screenshots to url. It returns nil if none is set. Requests naming no
+// language are recognized as language.
+func New(tesseract string, command []string, url string, headers map[string]string, language string, timeout time.Duration) (Engine, error) {
+	if language == "" {
+		language = defaultLanguage
+	}
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	set := 0
+	for _, s := range []bool{tesseract != "", len(command) > 0, url != ""} {
+		if s {
+			set++
+		}
+	}
+	switch {
+	case set > 1:
+		return nil, errors.New("an OCR engine can be tesseract, a command or a url, only one of them")
+	case tesseract != "":
+		return &Tesseract{Bin: tesseract, Language: language, Timeout: timeout}, nil
+	case len(command) > 0:
+		return &Command{Args: command, Language: language, Timeout: timeout}, nil
+	case url != "":
+		return &HTTP{URL: url, Headers: headers, Language: language, Client: &http.Client{Timeout: timeout}}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Text returns the text of words, a line of text per line.
+func Text(words []Word) string {
+	var text strings.Builder
+	for i, word := range words {
+		if i > 0 {
+			if word.Line != words[i-1].Line {
+				text.WriteByte('\n')
+			} else {
+				text.WriteByte(' ')
+			}
+		}
+		text.WriteString(word.Text)
+	}
+	return text.String()
+}
+
+// Tesseract runs the tesseract binary, reading its TSV output.
+type Tesseract struct {
+	Bin      string
+	Language string
+	Timeout  time.Duration
+}
+
+func (t *Tesseract) Name() string {
+	return "tesseract"
+}
+
+func (t *Tesseract) Recognize(ctx context.Context, png []byte, language string) ([]Word, error) {
+	if language == "" {
+		language = t.Language
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, t.Bin, "stdin", "stdout", "-l", language, "tsv")
+	cmd.Stdin = bytes.NewReader(png)
+	output, err := run(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTSV(output)
+}
+
+// ParseTSV reads the words of tesseract's TSV output, numbering lines in the
+// order they appear.
+func ParseTSV(tsv []byte) ([]Word, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(tsv))
+	scanner.Buffer(nil, maxOutput)
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "level\t") {
+		return nil, errors.New("output isn't tesseract's TSV")
+	}
+	words := []Word{}
+	line, lastLine := -1, ""
+	for scanner.Scan() {
+		// level, page_num, block_num, par_num, line_num, word_num, left,
+		// top, width, height, conf and text.
+		fields := strings.SplitN(scanner.Text(), "\t", 12)
+		if len(fields) < 12 || fields[0] != "5" {
+			continue
+		}
+		text := strings.TrimSpace(fields[11])
+		confidence, err := strconv.ParseFloat(fields[10], 64)
+		if text == "" || err != nil || confidence < 0 {
+			continue
+		}
+		var box [4]int
+		for i := range box {
+			if box[i], err = strconv.Atoi(fields[6+i]); err != nil {
+				return nil, fmt.Errorf("invalid bounding box in %q", scanner.Text())
+			}
+		}
+		if key := strings.Join(fields[1:5], "\t"); key != lastLine {
+			line, lastLine = line+1, key
+		}
+		words = append(words, Word{
+			Text:       text,
+			X:          box[0],
+			Y:          box[1],
+			Width:      box[2],
+			Height:     box[3],
+			Confidence: confidence,
+			Line:       line,
+		})
+	}
+	return words, scanner.Err()
+}
+
+// Command runs an OCR binary with the path of the screenshot appended and
+// the language in OCR_LANGUAGE, which must print {"words": [...]} as Words.
+type Command struct {
+	Args     []string
+	Language string
+	Timeout  time.Duration
+}
+
+func (c *Command) Name() string {
+	return c.Args[0]
+}
+
+func (c *Command) Recognize(ctx context.Context, png []byte, language string) ([]Word, error) {
+	if language == "" {
+		language = c.Language
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	file, err := os.CreateTemp("", "arrakis-ocr-*.png")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(png)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	args := append(append([]string{}, c.Args[1:]...), file.Name())
+	cmd := exec.CommandContext(ctx, c.Args[0], args...)
+	cmd.Env = append(os.Environ(), "OCR_LANGUAGE="+language)
+	output, err := run(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return parseWords(bytes.NewReader(output))
+}
+
+// HTTP posts screenshots to an OCR service, with the language as the
+// `language` query parameter, which must answer {"words": [...]} as Words.
+type HTTP struct {
+	URL      string
+	Headers  map[string]string
+	Language string
+	Client   *http.Client
+}
+
+func (h *HTTP) Name() string {
+	return h.URL
+}
+
+func (h *HTTP) Recognize(ctx context.Context, png []byte, language string) ([]Word, error) {
+	if language == "" {
+		language = h.Language
+	}
+	target, err := url.Parse(h.URL)
+	if err != nil {
+		return nil, err
+	}
+	query := target.Query()
+	query.Set("language", language)
+	target.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(png))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "image/png")
+	for name, value := range h.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("OCR service answered with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return parseWords(io.LimitReader(resp.Body, maxOutput))
+}
+
+// run runs cmd and returns its output, with its error output in the error if
+// it fails.
+func run(cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() > maxOutput {
+		return nil, fmt.Errorf("%d bytes of output, at most %d are read", stdout.Len(), maxOutput)
+	}
+	return stdout.Bytes(), nil
+}
+
+func parseWords(r io.Reader) ([]Word, error) {
+	var result struct {
+		Words []Word `json:"words"`
+	}
+	if err := json.NewDecoder(r).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid OCR output: %v", err)
+	}
+	if result.Words == nil {
+		return []Word{}, nil
+	}
+	return result.Words, nil
+}
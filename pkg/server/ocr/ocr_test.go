@@ -0,0 +1,136 @@
+package ocr
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const tsv = "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n" +
+	"1\t1\t0\t0\t0\t0\t0\t0\t1024\t768\t-1\t\n" +
+	"4\t1\t1\t1\t1\t0\t10\t20\t200\t16\t-1\t\n" +
+	"5\t1\t1\t1\t1\t1\t10\t20\t60\t16\t96.5\tHello\n" +
+	"5\t1\t1\t1\t1\t2\t80\t20\t130\t16\t91\tworld!\n" +
+	"5\t1\t1\t1\t1\t3\t220\t20\t5\t16\t95\t \n" +
+	"5\t1\t2\t1\t1\t1\t10\t60\t70\t14\t42.25\tSign in\n"
+
+func TestParseTSV(t *testing.T) {
+	words, err := ParseTSV([]byte(tsv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Word{
+		{Text: "Hello", X: 10, Y: 20, Width: 60, Height: 16, Confidence: 96.5, Line: 0},
+		{Text: "world!", X: 80, Y: 20, Width: 130, Height: 16, Confidence: 91, Line: 0},
+		{Text: "Sign in", X: 10, Y: 60, Width: 70, Height: 14, Confidence: 42.25, Line: 1},
+	}
+	if !reflect.DeepEqual(words, want) {
+		t.Errorf("ParseTSV() = %+v, want %+v", words, want)
+	}
+	if text := Text(words); text != "Hello world!\nSign in" {
+		t.Errorf("Text() = %q", text)
+	}
+
+	if _, err := ParseTSV([]byte("Hello world!")); err == nil {
+		t.Error("ParseTSV() accepted plain text")
+	}
+}
+
+func TestTesseract(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "tesseract")
+	// Echoes its args and stdin into files, and prints the TSV.
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\ncat > " + filepath.Join(dir, "stdin") + "\ncat " + filepath.Join(dir, "tsv") + "\n"
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tsv"), []byte(tsv), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := New(bin, nil, "", nil, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words, err := engine.Recognize(context.Background(), []byte("png"), "deu")
+	if err != nil {
+		t.Fatalf("Recognize() = %v", err)
+	}
+	if len(words) != 3 {
+		t.Errorf("Recognize() = %+v", words)
+	}
+	args, _ := os.ReadFile(filepath.Join(dir, "args"))
+	stdin, _ := os.ReadFile(filepath.Join(dir, "stdin"))
+	if string(args) != "stdin stdout -l deu tsv\n" || string(stdin) != "png" {
+		t.Errorf("tesseract ran with args %q and stdin %q", args, stdin)
+	}
+
+	failing, _ := New("false", nil, "", nil, "", 0)
+	if _, err := failing.Recognize(context.Background(), []byte("png"), ""); err == nil {
+		t.Error("Recognize() with a failing tesseract succeeded")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	engine, err := New("", []string{"sh", "-c", `printf '{"words": [{"text": "%s", "x": 1, "y": 2, "width": 3, "height": 4, "confidence": 90}]}' "$OCR_LANGUAGE:$(cat "$0")"`}, "", nil, "fra", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words, err := engine.Recognize(context.Background(), []byte("png"), "")
+	if err != nil {
+		t.Fatalf("Recognize() = %v", err)
+	}
+	want := []Word{{Text: "fra:png", X: 1, Y: 2, Width: 3, Height: 4, Confidence: 90}}
+	if !reflect.DeepEqual(words, want) {
+		t.Errorf("Recognize() = %+v, want %+v", words, want)
+	}
+
+	broken := &Command{Args: []string{"sh", "-c", "echo not json"}, Timeout: defaultTimeout}
+	if _, err := broken.Recognize(context.Background(), []byte("png"), ""); err == nil {
+		t.Error("Recognize() accepted output that isn't JSON")
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"words": []Word{{Text: r.URL.Query().Get("language") + ":" + string(body)}},
+		})
+	}))
+	defer server.Close()
+
+	engine, err := New("", nil, server.URL, map[string]string{"Authorization": "Bearer t"}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words, err := engine.Recognize(context.Background(), []byte("png"), "")
+	if err != nil || len(words) != 1 || words[0].Text != "eng:png" {
+		t.Errorf("Recognize() = %+v, %v", words, err)
+	}
+
+	unauthorized, _ := New("", nil, server.URL, nil, "", 0)
+	if _, err := unauthorized.Recognize(context.Background(), []byte("png"), ""); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Recognize() without credentials = %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if e, err := New("", nil, "", nil, "", 0); e != nil || err != nil {
+		t.Errorf("New() without an engine = %v, %v", e, err)
+	}
+	if _, err := New("tesseract", nil, "http://ocr", nil, "", 0); err == nil {
+		t.Error("New() accepted both tesseract and a url")
+	}
+}
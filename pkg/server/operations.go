@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/operations"
+)
+
+// Finished operations can be polled for this long.
+const operationRetention = time.Hour
+
+// Kinds of operations.
+const (
+	operationCreateVM   = "create_vm"
+	operationSnapshotVM = "snapshot_vm"
+)
+
+// StartVMAsync starts a VM like StartVM but returns at once with an operation
+// to poll for the result. With a positive readyTimeout the operation also
+// waits for the VM's services to be ready, like `wait=ready`.
+func (s *Server) StartVMAsync(ctx context.Context, req *serverapi.StartVMRequest, readyTimeout time.Duration) *serverapi.Operation {
+	vmName := req.GetVmName()
+	op := s.operations.Start(ctx, operationCreateVM, vmName, req.GetOwner(), func(ctx context.Context) (any, error) {
+		resp, err := s.StartVM(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if readyTimeout > 0 {
+			operations.SetProgress(ctx, "waiting for services")
+			readyCtx, cancel := context.WithTimeout(ctx, readyTimeout)
+			defer cancel()
+			services, err := s.WaitVMReady(readyCtx, vmName)
+			if err != nil {
+				return nil, fmt.Errorf("VM started but is not ready: %w", err)
+			}
+			resp.Services = services
+		}
+		return resp, nil
+	})
+	log.WithFields(log.Fields{"vmName": vmName, "operation": op.ID}).Info("Starting VM in the background")
+	return convertOperation(op)
+}
+
+// SnapshotVMAsync snapshots a VM like SnapshotVM in the background.
+func (s *Server) SnapshotVMAsync(ctx context.Context, vmName string, snapshotId string) (*serverapi.Operation, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	op := s.operations.Start(ctx, operationSnapshotVM, vmName, vm.getOwner(), func(ctx context.Context) (any, error) {
+		return s.SnapshotVM(ctx, vmName, snapshotId)
+	})
+	log.WithFields(log.Fields{"vmName": vmName, "operation": op.ID}).Info("Snapshotting VM in the background")
+	return convertOperation(op), nil
+}
+
+// GetOperation returns the state of an operation, and its result once it has
+// finished. Unless tenant is "", operations on other tenants' VMs aren't
+// found.
+func (s *Server) GetOperation(ctx context.Context, id string, tenant string) (*serverapi.Operation, error) {
+	op, err := s.operations.Get(id)
+	if err == nil && tenant != "" && op.Owner != tenant {
+		err = operations.ErrNotFound
+	}
+	if err != nil {
+		return nil, operationError(id, err)
+	}
+	return convertOperation(op), nil
+}
+
+// ListOperations returns the operations that are running or finished within
+// the retention period, most recent first, those of tenant unless it is "".
+func (s *Server) ListOperations(ctx context.Context, tenant string) *serverapi.ListOperationsResponse {
+	ops := s.operations.List()
+	resp := &serverapi.ListOperationsResponse{Operations: make([]serverapi.Operation, 0, len(ops))}
+	for _, op := range ops {
+		if tenant == "" || op.Owner == tenant {
+			resp.Operations = append(resp.Operations, *convertOperation(op))
+		}
+	}
+	return resp
+}
+
+// CancelOperation asks a running operation to stop. What it has done so far
+// is cleaned up, e.g. a VM being created is destroyed; a step in progress,
+// such as a disk copy, finishes first. Unless tenant is "", operations on
+// other tenants' VMs aren't found.
+func (s *Server) CancelOperation(ctx context.Context, id string, tenant string) (*serverapi.Operation, error) {
+	if op, err := s.operations.Get(id); err == nil && tenant != "" && op.Owner != tenant {
+		return nil, operationError(id, operations.ErrNotFound)
+	}
+	op, err := s.operations.Cancel(id)
+	if err != nil {
+		return nil, operationError(id, err)
+	}
+	log.WithField("operation", id).Info("Cancelling operation")
+	return convertOperation(op), nil
+}
+
+// CancelAllOperations cancels the running operations, e.g. before the server
+// shuts down.
+func (s *Server) CancelAllOperations() {
+	s.operations.CancelAll()
+}
+
+func operationError(id string, err error) error {
+	switch {
+	case errors.Is(err, operations.ErrNotFound):
+		return status.Error(codes.NotFound, fmt.Sprintf("operation not found: %s", id))
+	case errors.Is(err, operations.ErrFinished):
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("operation %s already finished", id))
+	}
+	return err
+}
+
+func convertOperation(op operations.Operation) *serverapi.Operation {
+	resp := &serverapi.Operation{
+		Id:        serverapi.PtrString(op.ID),
+		Kind:      serverapi.PtrString(op.Kind),
+		Target:    serverapi.PtrString(op.Target),
+		Status:    serverapi.PtrString(string(op.Status)),
+		CreatedAt: serverapi.PtrTime(op.Created),
+		UpdatedAt: serverapi.PtrTime(op.Updated),
+	}
+	if op.Progress != "" {
+		resp.Progress = serverapi.PtrString(op.Progress)
+	}
+	if op.Err != nil {
+		resp.Error = serverapi.PtrString(op.Err.Error())
+	}
+	switch result := op.Result.(type) {
+	case *serverapi.StartVMResponse:
+		resp.Vm = result
+	case *serverapi.VMSnapshotResponse:
+		resp.Snapshot = result
+	}
+	return resp
+}
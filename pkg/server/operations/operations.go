@@ -0,0 +1,230 @@
+// Package operations runs slow requests, such as creating a VM or taking a
+// snapshot, in the background so that callers can poll for their progress and
+// result instead of holding an HTTP request open for minutes.
+package operations
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status is the state of an operation.
+type Status string
+
+const (
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+var (
+	ErrNotFound = errors.New("operation not found")
+	ErrFinished = errors.New("operation already finished")
+)
+
+// Operation is a snapshot of the state of a background operation.
+type Operation struct {
+	ID string
+	// Kind is what the operation does, e.g. "create_vm", and Target what it
+	// does it to, e.g. a VM name.
+	Kind   string
+	Target string
+	// Owner is the tenant owning the target, if any.
+	Owner  string
+	Status Status
+	// Progress describes the step the operation is at.
+	Progress string
+	Created  time.Time
+	Updated  time.Time
+	// Result is what the operation's function returned on success.
+	Result any
+	// Err is set unless the operation is running or succeeded.
+	Err error
+}
+
+// Func does the work of an operation. It should stop when ctx is cancelled,
+// and can report its progress with SetProgress(ctx, ...).
+type Func func(ctx context.Context) (any, error)
+
+type operation struct {
+	Operation
+	manager *Manager
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Manager runs operations and keeps finished ones for a retention period.
+type Manager struct {
+	retention time.Duration
+	now       func() time.Time
+
+	mu         sync.Mutex
+	operations map[string]*operation
+}
+
+// NewManager returns a manager that forgets finished operations after
+// retention.
+func NewManager(retention time.Duration) *Manager {
+	return &Manager{
+		retention:  retention,
+		now:        time.Now,
+		operations: make(map[string]*operation),
+	}
+}
+
+type contextKey struct{}
+
+// SetProgress updates the progress of the operation ctx belongs to. It does
+// nothing outside of operations, e.g. for synchronous requests.
+func SetProgress(ctx context.Context, progress string) {
+	op, ok := ctx.Value(contextKey{}).(*operation)
+	if !ok {
+		return
+	}
+	m := op.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op.Progress = progress
+	op.Updated = m.now()
+}
+
+// Start runs fn in the background, detached from ctx's cancellation but not
+// from its values, and returns the new operation.
+func (m *Manager) Start(ctx context.Context, kind string, target string, owner string, fn Func) Operation {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	now := m.now()
+	op := &operation{
+		Operation: Operation{
+			ID:      newID(),
+			Kind:    kind,
+			Target:  target,
+			Owner:   owner,
+			Status:  StatusRunning,
+			Created: now,
+			Updated: now,
+		},
+		manager: m,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	ctx = context.WithValue(ctx, contextKey{}, op)
+
+	m.mu.Lock()
+	m.prune()
+	m.operations[op.ID] = op
+	snapshot := op.Operation
+	m.mu.Unlock()
+
+	go func() {
+		defer close(op.done)
+		defer cancel()
+		result, err := fn(ctx)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		op.Updated = m.now()
+		switch {
+		case err == nil:
+			op.Status = StatusSucceeded
+			op.Result = result
+		case ctx.Err() != nil:
+			op.Status = StatusCancelled
+			op.Err = err
+		default:
+			op.Status = StatusFailed
+			op.Err = err
+		}
+	}()
+	return snapshot
+}
+
+// Get returns the operation with id.
+func (m *Manager) Get(id string) (Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, ok := m.operations[id]
+	if !ok {
+		return Operation{}, ErrNotFound
+	}
+	return op.Operation, nil
+}
+
+// List returns all operations still kept, most recent first.
+func (m *Manager) List() []Operation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+	ops := make([]Operation, 0, len(m.operations))
+	for _, op := range m.operations {
+		ops = append(ops, op.Operation)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Created.After(ops[j].Created)
+	})
+	return ops
+}
+
+// Cancel asks a running operation to stop. The operation is marked as
+// cancelled once its function returns, which is what Wait is for.
+func (m *Manager) Cancel(id string) (Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, ok := m.operations[id]
+	if !ok {
+		return Operation{}, ErrNotFound
+	}
+	if op.Status != StatusRunning {
+		return op.Operation, ErrFinished
+	}
+	op.cancel()
+	return op.Operation, nil
+}
+
+// Wait blocks until the operation with id has finished or ctx is done, and
+// returns its final state.
+func (m *Manager) Wait(ctx context.Context, id string) (Operation, error) {
+	m.mu.Lock()
+	op, ok := m.operations[id]
+	m.mu.Unlock()
+	if !ok {
+		return Operation{}, ErrNotFound
+	}
+	select {
+	case <-op.done:
+	case <-ctx.Done():
+		return Operation{}, ctx.Err()
+	}
+	return m.Get(id)
+}
+
+// CancelAll cancels every running operation, e.g. on shutdown.
+func (m *Manager) CancelAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, op := range m.operations {
+		op.cancel()
+	}
+}
+
+// prune forgets operations that finished more than the retention period ago.
+// Must be called with mu held.
+func (m *Manager) prune() {
+	cutoff := m.now().Add(-m.retention)
+	for id, op := range m.operations {
+		if op.Status != StatusRunning && op.Updated.Before(cutoff) {
+			delete(m.operations, id)
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "op-" + hex.EncodeToString(b)
+}
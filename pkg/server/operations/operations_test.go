@@ -0,0 +1,96 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOperationSucceeds(t *testing.T) {
+	m := NewManager(time.Hour)
+	release := make(chan struct{})
+	op := m.Start(context.Background(), "create_vm", "foo", "acme", func(ctx context.Context) (any, error) {
+		SetProgress(ctx, "booting")
+		<-release
+		return "done", nil
+	})
+	if op.Status != StatusRunning || op.Kind != "create_vm" || op.Target != "foo" || op.Owner != "acme" {
+		t.Fatalf("Start() = %+v, want a running create_vm operation on foo of acme", op)
+	}
+
+	close(release)
+	final, err := m.Wait(context.Background(), op.ID)
+	if err != nil {
+		t.Fatalf("Wait() = %v", err)
+	}
+	if final.Status != StatusSucceeded || final.Result != "done" || final.Progress != "booting" {
+		t.Errorf("Wait() = %+v, want succeeded with result done", final)
+	}
+	if _, err := m.Cancel(op.ID); !errors.Is(err, ErrFinished) {
+		t.Errorf("Cancel() of a finished operation = %v, want %v", err, ErrFinished)
+	}
+}
+
+func TestOperationFailsAndCancels(t *testing.T) {
+	m := NewManager(time.Hour)
+	failed := m.Start(context.Background(), "snapshot_vm", "foo", "", func(ctx context.Context) (any, error) {
+		return nil, errors.New("boom")
+	})
+	cancelled := m.Start(context.Background(), "create_vm", "bar", "", func(ctx context.Context) (any, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if _, err := m.Cancel(cancelled.ID); err != nil {
+		t.Fatalf("Cancel() = %v", err)
+	}
+
+	for id, want := range map[string]Status{failed.ID: StatusFailed, cancelled.ID: StatusCancelled} {
+		op, err := m.Wait(context.Background(), id)
+		if err != nil {
+			t.Fatalf("Wait(%s) = %v", id, err)
+		}
+		if op.Status != want || op.Err == nil {
+			t.Errorf("Wait(%s) = %+v, want status %s with an error", id, op, want)
+		}
+	}
+	if _, err := m.Get("op-missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of an unknown id = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestRequestCancellationDoesNotCancelOperation(t *testing.T) {
+	m := NewManager(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	op := m.Start(ctx, "create_vm", "foo", "", func(ctx context.Context) (any, error) {
+		time.Sleep(10 * time.Millisecond)
+		return nil, ctx.Err()
+	})
+	cancel()
+	final, err := m.Wait(context.Background(), op.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final.Status != StatusSucceeded {
+		t.Errorf("operation = %+v, want it to outlive the request that started it", final)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	m := NewManager(time.Minute)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	op := m.Start(context.Background(), "create_vm", "foo", "", func(ctx context.Context) (any, error) {
+		return nil, nil
+	})
+	if _, err := m.Wait(context.Background(), op.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.List(); len(got) != 1 {
+		t.Fatalf("List() = %v, want the finished operation", got)
+	}
+	now = now.Add(2 * time.Minute)
+	if got := m.List(); len(got) != 0 {
+		t.Errorf("List() = %v after the retention period, want none", got)
+	}
+}
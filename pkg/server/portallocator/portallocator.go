@@ -68,3 +68,26 @@ func (a *PortAllocator) FreePort(port int32) error {
 	a.available = append(a.available, port)
 	return nil
 }
+
+// Available returns the number of ports that can still be allocated
+func (a *PortAllocator) Available() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return len(a.available)
+}
+
+// IsAllocated reports whether port is in the allocator's range and allocated
+func (a *PortAllocator) IsAllocated(port int32) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if port < a.lowPort || port > a.highPort {
+		return false
+	}
+	for _, p := range a.available {
+		if p == port {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+)
+
+const (
+	ptyDialTimeout = 30 * time.Second
+)
+
+// VMPTY opens an interactive PTY exec session in a VM running cmd, or a login
+// shell if cmd is empty. The returned connection speaks the protocol described
+// in pkg/cmdserver and is owned by the caller.
+func (s *Server) VMPTY(ctx context.Context, vmName string, cmd string, rows uint16, cols uint16) (*websocket.Conn, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.RLock()
+	vmIP := vm.ip.IP.String()
+	vmStatus := vm.status
+	vm.lock.RUnlock()
+	if vmStatus != vmStatusRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is not running", vmName)
+	}
+
+	query := url.Values{}
+	if cmd != "" {
+		query.Set("cmd", cmd)
+	}
+	if rows > 0 && cols > 0 {
+		query.Set("rows", strconv.Itoa(int(rows)))
+		query.Set("cols", strconv.Itoa(int(cols)))
+	}
+	scheme := "ws"
+	if vm.agent.tlsConfig != nil {
+		scheme = "wss"
+	}
+	ptyURL := url.URL{
+		Scheme:   scheme,
+		Host:     net.JoinHostPort(vmIP, strconv.Itoa(agentPort)),
+		Path:     "/cmd/pty",
+		RawQuery: query.Encode(),
+	}
+
+	dialer := websocket.Dialer{HandshakeTimeout: ptyDialTimeout, TLSClientConfig: vm.agent.tlsConfig}
+	conn, _, err := dialer.DialContext(ctx, ptyURL.String(), nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to open pty session: %v", err)
+	}
+	vm.record(timeline.KindExec, "terminal", "Opened a terminal", map[string]string{"command": cmd})
+	return conn, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/server/recordings"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+)
+
+const (
+	// recordingsFilename indexes the recordings in the artifact store.
+	recordingsFilename             = "recordings.json"
+	defaultRecordingsPurgeInterval = 10 * time.Minute
+)
+
+// indexRecording indexes an artifact uploaded to key in the artifact store
+// if it's a recording, for retention to purge it.
+func (s *Server) indexRecording(vm *vm, artifact cmdserver.Artifact, key string) {
+	kind := recordings.Kind(artifact.Path)
+	if kind == "" {
+		return
+	}
+	vm.lock.RLock()
+	owner := vm.owner
+	vm.lock.RUnlock()
+	s.recordings.Add(recordings.Recording{
+		Key:       key,
+		VM:        vm.name,
+		VMID:      vm.id,
+		Owner:     owner,
+		Kind:      kind,
+		Size:      artifact.Size,
+		CreatedAt: time.Now().UTC(),
+	})
+	s.saveRecordings()
+	vm.record(timeline.KindRecording, "uploaded", "Recording "+artifact.Path+" uploaded", map[string]string{
+		"path": artifact.Path,
+		"key":  key,
+		"kind": kind,
+		"size": strconv.FormatInt(artifact.Size, 10),
+	})
+}
+
+func (s *Server) saveRecordings() {
+	if err := s.recordings.Save(path.Join(s.config.StateDir, recordingsFilename)); err != nil {
+		log.WithError(err).Error("Failed to save recordings index")
+	}
+}
+
+// Recordings lists the recordings in the artifact store matching f.
+func (s *Server) Recordings(ctx context.Context, f recordings.Filter) recordings.Listing {
+	return s.recordings.List(f)
+}
+
+func (s *Server) recordingsPolicy() recordings.Policy {
+	return recordings.Policy{
+		MaxAge:           s.config.Recordings.MaxAge,
+		MaxSizePerVM:     s.config.Recordings.MaxSizePerVMInMB << 20,
+		MaxSizePerTenant: s.config.Recordings.MaxSizePerTenantInMB << 20,
+	}
+}
+
+// PurgeRecordings deletes the recordings the retention policy expires at
+// now from the artifact store, along with their scans, and returns them.
+// Recordings that fail to be deleted are retried on the next purge.
+func (s *Server) PurgeRecordings(ctx context.Context, now time.Time) recordings.Listing {
+	purged := recordings.Listing{Recordings: []recordings.Recording{}}
+	if s.artifactStore == nil {
+		return purged
+	}
+	for _, r := range s.recordings.Expired(s.recordingsPolicy(), now) {
+		logger := log.WithFields(log.Fields{"key": r.Key, "vmName": r.VM, "owner": r.Owner})
+		if err := s.artifactStore.Delete(ctx, r.Key); err != nil {
+			logger.WithError(err).Warn("Failed to purge recording")
+			continue
+		}
+		if err := s.artifactStore.Delete(ctx, r.Key+"."+scanResultFilename); err != nil {
+			logger.WithError(err).Warn("Failed to purge scan of recording")
+		}
+		s.recordings.Remove(r.Key)
+		purged.Recordings = append(purged.Recordings, r)
+		purged.TotalSize += r.Size
+	}
+	if len(purged.Recordings) > 0 {
+		log.WithFields(log.Fields{"recordings": len(purged.Recordings), "bytes": purged.TotalSize}).Info("Purged recordings")
+		s.saveRecordings()
+	}
+	return purged
+}
+
+// PurgeRecordingsPeriodically purges expired recordings, until ctx is done.
+func (s *Server) PurgeRecordingsPeriodically(ctx context.Context) {
+	interval := s.config.Recordings.PurgeInterval
+	if interval <= 0 {
+		interval = defaultRecordingsPurgeInterval
+	}
+	s.PurgeRecordings(ctx, time.Now())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.PurgeRecordings(ctx, now)
+		}
+	}
+}
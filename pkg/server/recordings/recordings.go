@@ -0,0 +1,214 @@
+// Package recordings indexes the recordings VMs leave in the artifact store,
+// such as screen recordings of CDP and VNC sessions, HARs and packet
+// captures, and picks the ones a retention policy expires.
+package recordings
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of recordings.
+const (
+	// KindVideo is a screen recording, e.g. of a CDP screencast or a VNC
+	// session.
+	KindVideo = "video"
+	// KindVNC is a VNC session recorded as a framebuffer stream.
+	KindVNC = "vnc"
+	KindHAR = "har"
+	// KindPcap is a packet capture.
+	KindPcap = "pcap"
+)
+
+var kindsByExt = map[string]string{
+	".webm":   KindVideo,
+	".mp4":    KindVideo,
+	".mkv":    KindVideo,
+	".fbs":    KindVNC,
+	".har":    KindHAR,
+	".pcap":   KindPcap,
+	".pcapng": KindPcap,
+}
+
+// Kind returns the kind of recording an artifact is by its extension, or ""
+// if it isn't one.
+func Kind(artifactPath string) string {
+	return kindsByExt[strings.ToLower(path.Ext(artifactPath))]
+}
+
+// Recording is a recording in the artifact store.
+type Recording struct {
+	// Key is where the recording is in the artifact store.
+	Key       string    `json:"key"`
+	VM        string    `json:"vmName"`
+	VMID      string    `json:"vmId"`
+	Owner     string    `json:"owner"`
+	Kind      string    `json:"kind"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Filter selects recordings. Empty fields match everything.
+type Filter struct {
+	VM    string
+	Owner string
+	Kind  string
+	// Since and Until bound when recordings were created.
+	Since time.Time
+	Until time.Time
+}
+
+func (f Filter) matches(r Recording) bool {
+	return (f.VM == "" || r.VM == f.VM) &&
+		(f.Owner == "" || r.Owner == f.Owner) &&
+		(f.Kind == "" || r.Kind == f.Kind) &&
+		(f.Since.IsZero() || !r.CreatedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || r.CreatedAt.Before(f.Until))
+}
+
+// Listing is the result of a filter, newest recordings first.
+type Listing struct {
+	Recordings []Recording `json:"recordings"`
+	TotalSize  int64       `json:"totalSize"`
+}
+
+// Policy bounds how long and how much recordings are kept. Zero fields
+// don't limit anything.
+type Policy struct {
+	MaxAge time.Duration
+	// MaxSizePerVM and MaxSizePerTenant bound the total size of the
+	// recordings of a VM and of an owner, in bytes. The oldest recordings
+	// past them expire.
+	MaxSizePerVM     int64
+	MaxSizePerTenant int64
+}
+
+// Index tracks the recordings in the artifact store.
+type Index struct {
+	mutex      sync.Mutex
+	recordings map[string]Recording
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{recordings: make(map[string]Recording)}
+}
+
+// Add indexes a recording, replacing any at the same key.
+func (i *Index) Add(r Recording) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.recordings[r.Key] = r
+}
+
+// Remove drops the recording at key from the index.
+func (i *Index) Remove(key string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	delete(i.recordings, key)
+}
+
+// List returns the recordings matching f.
+func (i *Index) List(f Filter) Listing {
+	listing := Listing{Recordings: []Recording{}}
+	for _, r := range i.sorted() {
+		if f.matches(r) {
+			listing.Recordings = append(listing.Recordings, r)
+			listing.TotalSize += r.Size
+		}
+	}
+	return listing
+}
+
+// sorted returns the recordings newest first.
+func (i *Index) sorted() []Recording {
+	i.mutex.Lock()
+	recordings := make([]Recording, 0, len(i.recordings))
+	for _, r := range i.recordings {
+		recordings = append(recordings, r)
+	}
+	i.mutex.Unlock()
+	sort.Slice(recordings, func(a, b int) bool {
+		if !recordings[a].CreatedAt.Equal(recordings[b].CreatedAt) {
+			return recordings[a].CreatedAt.After(recordings[b].CreatedAt)
+		}
+		return recordings[a].Key < recordings[b].Key
+	})
+	return recordings
+}
+
+// Expired returns the recordings p doesn't keep at now, oldest first.
+// Recordings are kept newest first until their VM's or their owner's would
+// be over size.
+func (i *Index) Expired(p Policy, now time.Time) []Recording {
+	var expired []Recording
+	vmSizes := make(map[string]int64)
+	tenantSizes := make(map[string]int64)
+	// Once over size, all older recordings expire too.
+	fullVMs := make(map[string]bool)
+	fullTenants := make(map[string]bool)
+	for _, r := range i.sorted() {
+		if p.MaxAge > 0 && now.Sub(r.CreatedAt) > p.MaxAge {
+			expired = append(expired, r)
+			continue
+		}
+		// VM names are reused, so a VM's recordings are those of its ID.
+		vm := r.VMID
+		if vm == "" {
+			vm = r.VM
+		}
+		if p.MaxSizePerVM > 0 && (fullVMs[vm] || vmSizes[vm]+r.Size > p.MaxSizePerVM) {
+			fullVMs[vm] = true
+			expired = append(expired, r)
+			continue
+		}
+		if p.MaxSizePerTenant > 0 && (fullTenants[r.Owner] || tenantSizes[r.Owner]+r.Size > p.MaxSizePerTenant) {
+			fullTenants[r.Owner] = true
+			expired = append(expired, r)
+			continue
+		}
+		vmSizes[vm] += r.Size
+		tenantSizes[r.Owner] += r.Size
+	}
+	sort.SliceStable(expired, func(a, b int) bool { return expired[a].CreatedAt.Before(expired[b].CreatedAt) })
+	return expired
+}
+
+// Save writes the index to path.
+func (i *Index) Save(path string) error {
+	data, err := json.Marshal(i.sorted())
+	if err != nil {
+		return fmt.Errorf("failed to marshal recordings: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write recordings: %w", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Load adds the recordings saved at path to the index. A missing file is not
+// an error.
+func (i *Index) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read recordings: %w", err)
+	}
+	var recordings []Recording
+	if err := json.Unmarshal(data, &recordings); err != nil {
+		return fmt.Errorf("failed to parse recordings %s: %w", path, err)
+	}
+	for _, r := range recordings {
+		i.Add(r)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package recordings
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func keys(recordings []Recording) []string {
+	var k []string
+	for _, r := range recordings {
+		k = append(k, r.Key)
+	}
+	return k
+}
+
+func TestKind(t *testing.T) {
+	for p, want := range map[string]string{
+		"session.webm":          KindVideo,
+		"vnc/session.FBS":       KindVNC,
+		"network/browser.har":   KindHAR,
+		"eth0.pcapng":           KindPcap,
+		"report.pdf":            "",
+		"browser.har.scan.json": "",
+	} {
+		if got := Kind(p); got != want {
+			t.Errorf("Kind(%q) = %q, want %q", p, got, want)
+		}
+	}
+}
+
+func testIndex(now time.Time) *Index {
+	index := NewIndex()
+	for _, r := range []Recording{
+		{Key: "a/old.har", VM: "a", VMID: "1", Owner: "acme", Kind: KindHAR, Size: 10, CreatedAt: now.Add(-48 * time.Hour)},
+		{Key: "a/1.webm", VM: "a", VMID: "1", Owner: "acme", Kind: KindVideo, Size: 60, CreatedAt: now.Add(-3 * time.Hour)},
+		{Key: "a/2.webm", VM: "a", VMID: "1", Owner: "acme", Kind: KindVideo, Size: 60, CreatedAt: now.Add(-2 * time.Hour)},
+		{Key: "b/1.pcap", VM: "b", VMID: "2", Owner: "acme", Kind: KindPcap, Size: 50, CreatedAt: now.Add(-1 * time.Hour)},
+		{Key: "c/1.pcap", VM: "c", VMID: "3", Owner: "globex", Kind: KindPcap, Size: 50, CreatedAt: now.Add(-1 * time.Hour)},
+	} {
+		index.Add(r)
+	}
+	return index
+}
+
+func TestList(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	index := testIndex(now)
+
+	listing := index.List(Filter{Owner: "acme"})
+	if want := []string{"b/1.pcap", "a/2.webm", "a/1.webm", "a/old.har"}; !reflect.DeepEqual(keys(listing.Recordings), want) {
+		t.Errorf("List(acme) = %v, want %v", keys(listing.Recordings), want)
+	}
+	if listing.TotalSize != 180 {
+		t.Errorf("TotalSize = %d, want 180", listing.TotalSize)
+	}
+	listing = index.List(Filter{Kind: KindVideo, Since: now.Add(-150 * time.Minute)})
+	if want := []string{"a/2.webm"}; !reflect.DeepEqual(keys(listing.Recordings), want) {
+		t.Errorf("List(video since) = %v, want %v", keys(listing.Recordings), want)
+	}
+	if listing := index.List(Filter{VM: "missing"}); listing.Recordings == nil || len(listing.Recordings) != 0 {
+		t.Errorf("List(missing) = %+v, want an empty list", listing)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	index := testIndex(now)
+
+	for name, tc := range map[string]struct {
+		policy Policy
+		want   []string
+	}{
+		"unlimited": {Policy{}, nil},
+		"age":       {Policy{MaxAge: 24 * time.Hour}, []string{"a/old.har"}},
+		"vm":        {Policy{MaxSizePerVM: 100}, []string{"a/old.har", "a/1.webm"}},
+		"tenant":    {Policy{MaxSizePerTenant: 120}, []string{"a/old.har", "a/1.webm"}},
+	} {
+		if got := keys(index.Expired(tc.policy, now)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Expired(%s) = %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	index := testIndex(now)
+	p := filepath.Join(t.TempDir(), "recordings.json")
+	if err := index.Save(p); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewIndex()
+	if err := loaded.Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.List(Filter{}), index.List(Filter{})) {
+		t.Errorf("Load = %+v, want %+v", loaded.List(Filter{}), index.List(Filter{}))
+	}
+	if err := NewIndex().Load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("Load of a missing file = %v", err)
+	}
+}
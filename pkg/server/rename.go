@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+	"github.com/abshkbh/arrakis/pkg/server/workdir"
+)
+
+// UpdateVM renames a VM and/or transfers it to a new owner, e.g. when a VM
+// claimed from a pool should reflect the identity of its new workload. Empty
+// arguments leave the corresponding attribute unchanged.
+//
+// A rename moves the VM's state directory and API socket and re-keys the VM
+// so that every name based route (REST paths, proxies, artifact uploads)
+// follows it. Port forwards are keyed by the VM's IP and are unaffected. The
+// whole update happens under the server lock so no request observes a VM
+// that is half renamed; on failure the VM keeps its old identity.
+func (s *Server) UpdateVM(ctx context.Context, vmName string, newName string, owner string) (*serverapi.VMResponse, error) {
+	logger := log.WithFields(log.Fields{
+		"vmName":  vmName,
+		"newName": newName,
+		"owner":   owner,
+	})
+	logger.Infof("received request to update VM")
+
+	if newName == vmName {
+		newName = ""
+	}
+	if newName != "" {
+		if err := validateVMName(newName); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	s.lock.Lock()
+	vm, exists := s.vms[vmName]
+	if !exists {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm not found: %s", vmName)
+	}
+	if newName != "" {
+		if _, taken := s.vms[newName]; taken {
+			s.lock.Unlock()
+			return nil, status.Errorf(codes.AlreadyExists, "vm %s already exists", newName)
+		}
+		if err := vm.rename(s.config.StateDir, newName); err != nil {
+			s.lock.Unlock()
+			logger.WithError(err).Error("Failed to rename VM")
+			return nil, err
+		}
+		delete(s.vms, vmName)
+		s.vms[newName] = vm
+		if s.admission != nil {
+			s.admission.Rename(vmName, newName)
+		}
+		vm.record(timeline.KindLifecycle, "renamed", "VM renamed to "+newName, map[string]string{"from": vmName, "to": newName})
+		vmName = newName
+	}
+	if owner != "" {
+		vm.setOwner(owner)
+		if s.admission != nil {
+			s.admission.Transfer(vmName, owner)
+		}
+		vm.record(timeline.KindLifecycle, "owner_changed", "VM transferred to "+owner, map[string]string{"owner": owner})
+	}
+	s.lock.Unlock()
+	s.recordVM(ctx, vm)
+
+	logger.Infof("VM updated")
+	info, err := s.ListVM(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return &serverapi.VMResponse{
+		Success: serverapi.PtrBool(true),
+		Vm:      info,
+	}, nil
+}
+
+func (v *vm) setOwner(owner string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.owner = owner
+}
+
+func (v *vm) getOwner() string {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.owner
+}
+
+// validateVMName rejects names that can't be used as a state directory.
+func validateVMName(name string) error {
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid vm name: %q", name)
+	}
+	return nil
+}
+
+// rename moves the VM's state under newName. The VMM keeps its open files and
+// bound sockets across the move, so only our paths change. The
+// caller must hold the server lock.
+func (v *vm) rename(stateDir string, newName string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	newStateDir := workdir.New(stateDir, newName).Root
+	if _, err := os.Stat(newStateDir); !os.IsNotExist(err) {
+		return status.Errorf(codes.AlreadyExists, "state dir %s already exists", newStateDir)
+	}
+	if err := os.Rename(v.stateDirPath, newStateDir); err != nil {
+		return status.Errorf(codes.Internal, "failed to move state dir: %v", err)
+	}
+
+	// Adopted VMs keep their sockets and disks where their VMM put them.
+	// The files of the working directory are named after their type, not
+	// the VM, so they move with it.
+	oldStateDir := v.stateDirPath
+	moved := func(p string) string {
+		return workdir.Layout{Root: oldStateDir}.Rebase(p, newStateDir)
+	}
+
+	v.name = newName
+	v.stateDirPath = newStateDir
+	v.timeline.SetPath(path.Join(newStateDir, timelineFilename))
+	v.apiSocketPath = moved(v.apiSocketPath)
+	v.vmm = connectVMM(v.hypervisor, v.apiSocketPath)
+	v.vsockPath = moved(v.vsockPath)
+	v.statefulDiskPath = moved(v.statefulDiskPath)
+	for i, d := range v.devices {
+		if d.blank {
+			v.devices[i].path = moved(d.path)
+		}
+	}
+	log.WithFields(log.Fields{
+		"from": oldStateDir,
+		"to":   newStateDir,
+	}).Info("moved VM state dir")
+	return nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+)
+
+// vmResetTimeout bounds resetting a VM, which waits for the workload
+// processes to exit and for the browser to restart.
+const vmResetTimeout = 2 * time.Minute
+
+// ResetVM brings a running VM back to a clean state without rebooting it, a
+// faster alternative to destroying and creating one for pooled sandboxes:
+// the agent kills the workload processes, empties the scratch paths and
+// restarts the browser on an empty profile. What kept the VM from being
+// clean is reported in the response rather than failing the request.
+func (s *Server) ResetVM(ctx context.Context, vmName string, req *serverapi.VmResetRequest) (*serverapi.VmResetResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	vmStatus := vm.status
+	vmIP := vm.ip.IP.String()
+	vm.lock.RUnlock()
+	if vmStatus != vmStatusRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is %s, only running VMs can be reset", vmName, vmStatus)
+	}
+	resetReq := cmdserver.ResetRequest{
+		ScratchPaths:       req.GetScratchPaths(),
+		KeepBrowserProfile: req.GetKeepBrowserProfile(),
+	}
+	if err := resetReq.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	logger := log.WithField("vmName", vmName)
+	reset, err := cmdserver.RequestReset(ctx, s.agent.client(vmResetTimeout), s.agent.url(vmIP, "/reset"), resetReq)
+	if err != nil {
+		logger.WithError(err).Error("Failed to reset VM")
+		if errors.Is(err, cmdserver.ErrInvalidReset) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to reset vm: %v", err)
+	}
+	logger = logger.WithFields(log.Fields{"killedProcesses": reset.KilledProcesses, "clean": reset.Clean})
+	if reset.Clean {
+		logger.Info("Reset VM")
+	} else {
+		logger.WithField("errors", reset.Errors).Warn("Reset VM, but it isn't clean")
+	}
+	return &serverapi.VmResetResponse{
+		KilledProcesses:     serverapi.PtrInt32(int32(reset.KilledProcesses)),
+		ClearedPaths:        reset.ClearedPaths,
+		BrowserProfileReset: serverapi.PtrBool(reset.BrowserProfileReset),
+		Clean:               serverapi.PtrBool(reset.Clean),
+		Errors:              reset.Errors,
+	}, nil
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/server/operations"
+	"github.com/abshkbh/arrakis/pkg/server/scan"
+)
+
+const (
+	// scanResultFilename holds the scan of a snapshot's stateful disk in the
+	// snapshot, and is the suffix of the scans uploaded next to artifacts.
+	scanResultFilename = "scan.json"
+	// quarantinePrefix is where flagged artifacts are uploaded in the
+	// artifact store, away from the VMs' clean ones.
+	quarantinePrefix = "quarantine"
+	// scanVerdictHeader carries the verdict of a scanned artifact download.
+	scanVerdictHeader = "X-Arrakis-Scan"
+)
+
+// newScanner returns the configured scanner, or nil if there is none.
+func newScanner(cfg config.ScanConfig) (scan.Scanner, error) {
+	if cfg.Snapshots && cfg.URL != "" {
+		return nil, fmt.Errorf("snapshots can only be scanned by a command scanner")
+	}
+	return scan.New(cfg.Command, cfg.URL, cfg.Headers, cfg.Timeout)
+}
+
+func (s *Server) scanPolicy() scan.Policy {
+	return scan.Policy{Quarantine: s.config.Scan.Quarantine, FailClosed: s.config.Scan.FailClosed}
+}
+
+// scanCache remembers the scans of artifacts, by VM ID then artifact path,
+// so that listings can show them.
+type scanCache struct {
+	lock    sync.Mutex
+	results map[string]map[string]scannedArtifact
+}
+
+type scannedArtifact struct {
+	sha256 string
+	result scan.Result
+}
+
+func (c *scanCache) put(vmID string, artifactPath string, sha string, result scan.Result) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.results == nil {
+		c.results = make(map[string]map[string]scannedArtifact)
+	}
+	if c.results[vmID] == nil {
+		c.results[vmID] = make(map[string]scannedArtifact)
+	}
+	c.results[vmID][artifactPath] = scannedArtifact{sha256: sha, result: result}
+}
+
+// get returns the scan of an artifact, unless it changed since.
+func (c *scanCache) get(vmID string, artifactPath string, sha string) (scan.Result, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	scanned, ok := c.results[vmID][artifactPath]
+	if !ok || scanned.sha256 != sha {
+		return scan.Result{}, false
+	}
+	return scanned.result, true
+}
+
+func (c *scanCache) forget(vmID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.results, vmID)
+}
+
+// scanArtifact copies an artifact read from body to a temporary file and
+// scans it. The caller must remove the file.
+func (s *Server) scanArtifact(ctx context.Context, vm *vm, artifactPath string, body io.Reader) (*os.File, scan.Result, error) {
+	file, err := os.CreateTemp("", "arrakis-scan-")
+	if err != nil {
+		return nil, scan.Result{}, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), body); err != nil {
+		removeTempFile(file)
+		return nil, scan.Result{}, fmt.Errorf("failed to copy artifact: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		removeTempFile(file)
+		return nil, scan.Result{}, err
+	}
+
+	result := s.scanner.Scan(ctx, file.Name())
+	s.scans.put(vm.id, artifactPath, hex.EncodeToString(hash.Sum(nil)), result)
+	logScan(log.WithFields(log.Fields{"vmName": vm.name, "artifact": artifactPath}), result)
+	return file, result, nil
+}
+
+// tempFileBody removes the temporary file it reads from once closed.
+type tempFileBody struct {
+	*os.File
+}
+
+func (b tempFileBody) Close() error {
+	removeTempFile(b.File)
+	return nil
+}
+
+func removeTempFile(file *os.File) {
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		log.WithError(err).Warnf("failed to remove %s", file.Name())
+	}
+}
+
+func logScan(logger *log.Entry, result scan.Result) {
+	switch result.Verdict {
+	case scan.VerdictFlagged:
+		logger.WithField("findings", result.Findings).Warn("Scan flagged content")
+	case scan.VerdictError:
+		logger.WithField("error", result.Error).Warn("Failed to scan content")
+	}
+}
+
+// scanUploads scans files before they are uploaded to a VM, and refuses
+// them if any is quarantined.
+func (s *Server) scanUploads(ctx context.Context, vmName string, files []serverapi.VmFileUploadRequestFilesInner) ([]serverapi.ScanResult, error) {
+	if s.scanner == nil || !s.config.Scan.Uploads {
+		return nil, nil
+	}
+	dir, err := os.MkdirTemp("", "arrakis-scan-")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	results := make([]serverapi.ScanResult, 0, len(files))
+	var quarantined []string
+	for i, file := range files {
+		// Named by index, the guest path may not be valid on the host.
+		p := path.Join(dir, fmt.Sprint(i))
+		if err := os.WriteFile(p, []byte(file.GetContent()), 0600); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to write %s for scanning: %v", file.GetPath(), err)
+		}
+		result := s.scanner.Scan(ctx, p)
+		logScan(log.WithFields(log.Fields{"vmName": vmName, "file": file.GetPath()}), result)
+		if s.scanPolicy().Blocks(result) {
+			quarantined = append(quarantined, describeScan(file.GetPath(), result))
+		}
+		converted := convertScanResult(result)
+		converted.Path = serverapi.PtrString(file.GetPath())
+		results = append(results, *converted)
+	}
+	if len(quarantined) > 0 {
+		return nil, status.Errorf(codes.PermissionDenied, "files are quarantined: %s", strings.Join(quarantined, "; "))
+	}
+	return results, nil
+}
+
+func describeScan(name string, result scan.Result) string {
+	if result.Verdict == scan.VerdictError {
+		return fmt.Sprintf("%s (scan failed: %s)", name, result.Error)
+	}
+	return fmt.Sprintf("%s (%s)", name, strings.Join(result.Findings, ", "))
+}
+
+// scanSnapshot scans the stateful disk of a new snapshot, if snapshots are
+// scanned, and records the result in the snapshot. Failing to scan is a
+// result too, which quarantines the snapshot if failing closed.
+func (s *Server) scanSnapshot(ctx context.Context, snapshotID string) *scan.Result {
+	if s.scanner == nil || !s.config.Scan.Snapshots {
+		return nil
+	}
+	operations.SetProgress(ctx, "scanning snapshot")
+	// Keep the snapshot from being reclaimed while it's mounted.
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+
+	logger := log.WithField("snapshotId", snapshotID)
+	snapshotDir := path.Join(s.config.StateDir, "snapshots", snapshotID)
+	result := s.scanStatefulDisk(ctx, path.Join(snapshotDir, statefulDiskFilename))
+	logScan(logger, result)
+
+	data, err := json.Marshal(result)
+	if err == nil {
+		err = os.WriteFile(path.Join(snapshotDir, scanResultFilename), data, 0644)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to save snapshot scan")
+	}
+	return &result
+}
+
+func (s *Server) scanStatefulDisk(ctx context.Context, image string) scan.Result {
+	failed := func(err error) scan.Result {
+		return scan.Result{Scanner: s.scanner.Name(), Verdict: scan.VerdictError, Error: err.Error(), ScannedAt: time.Now()}
+	}
+	mountPoint, err := os.MkdirTemp("", "arrakis-scan-")
+	if err != nil {
+		return failed(fmt.Errorf("failed to create mount point: %w", err))
+	}
+	defer os.RemoveAll(mountPoint)
+	if err := mountStatefulDisk(image, mountPoint); err != nil {
+		return failed(fmt.Errorf("failed to mount stateful disk: %w", err))
+	}
+	defer unmountStatefulDisk(mountPoint)
+
+	// Only the overlay's upper layer holds what the guest wrote.
+	target := path.Join(mountPoint, statefulDiskUpperDir)
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		target = mountPoint
+	}
+	return s.scanner.Scan(ctx, target)
+}
+
+// checkSnapshotScan refuses to restore a snapshot whose scan quarantines it.
+// Snapshots that weren't scanned can be restored.
+func (s *Server) checkSnapshotScan(snapshotID string) error {
+	data, err := os.ReadFile(path.Join(s.config.StateDir, "snapshots", snapshotID, scanResultFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read snapshot scan: %v", err)
+	}
+	var result scan.Result
+	if err := json.Unmarshal(data, &result); err != nil {
+		return status.Errorf(codes.Internal, "failed to decode snapshot scan: %v", err)
+	}
+	if s.scanPolicy().Blocks(result) {
+		return status.Errorf(codes.FailedPrecondition, "snapshot is quarantined: %s", describeScan(snapshotID, result))
+	}
+	return nil
+}
+
+// putScanResult uploads the scan of an artifact next to it in the artifact
+// store.
+func (s *Server) putScanResult(ctx context.Context, key string, result scan.Result) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return s.artifactStore.Put(ctx, key+"."+scanResultFilename, bytes.NewReader(data), int64(len(data)))
+}
+
+func convertScanResult(result scan.Result) *serverapi.ScanResult {
+	converted := &serverapi.ScanResult{
+		Scanner:   serverapi.PtrString(result.Scanner),
+		Verdict:   serverapi.PtrString(result.Verdict),
+		Findings:  result.Findings,
+		ScannedAt: serverapi.PtrTime(result.ScannedAt),
+	}
+	if result.Error != "" {
+		converted.Error = serverapi.PtrString(result.Error)
+	}
+	return converted
+}
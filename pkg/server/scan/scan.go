@@ -0,0 +1,200 @@
+// Package scan runs content leaving or entering VMs, such as artifacts,
+// uploaded files and snapshot disks, through a malware or secret scanner,
+// either a command or an HTTP service.
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Verdicts of a scan.
+const (
+	VerdictClean   = "clean"
+	VerdictFlagged = "flagged"
+	// VerdictError is given when the scanner failed, so the content is of
+	// unknown safety.
+	VerdictError = "error"
+)
+
+const (
+	defaultTimeout = 5 * time.Minute
+	// maxFindings bounds the findings kept from a scanner's output.
+	maxFindings = 100
+)
+
+// Result is the outcome of scanning one file or directory.
+type Result struct {
+	Scanner   string    `json:"scanner"`
+	Verdict   string    `json:"verdict"`
+	Findings  []string  `json:"findings,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ScannedAt time.Time `json:"scannedAt"`
+}
+
+// Scanner scans files.
+type Scanner interface {
+	// Name identifies the scanner in results.
+	Name() string
+	// Scan scans the file or directory at path. Failures are reported as
+	// VerdictError results.
+	Scan(ctx context.Context, path string) Result
+}
+
+// Policy decides what happens to flagged content.
+type Policy struct {
+	// Quarantine keeps flagged content from where it was headed.
+	Quarantine bool
+	// FailClosed treats content that couldn't be scanned as flagged.
+	FailClosed bool
+}
+
+// Blocks reports whether content with result r must be quarantined.
+func (p Policy) Blocks(r Result) bool {
+	if !p.Quarantine {
+		return false
+	}
+	return r.Verdict == VerdictFlagged || (r.Verdict == VerdictError && p.FailClosed)
+}
+
+// New returns the scanner running command, with the path to scan appended
+// as its last argument, or posting files to url. It returns nil if neither
+// is set.
+func New(command []string, url string, headers map[string]string, timeout time.Duration) (Scanner, error) {
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	switch {
+	case len(command) > 0 && url != "":
+		return nil, errors.New("a scanner can be a command or a url, not both")
+	case len(command) > 0:
+		return &Command{Args: command, Timeout: timeout}, nil
+	case url != "":
+		return &HTTP{URL: url, Headers: headers, Client: &http.Client{Timeout: timeout}}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func errorResult(name string, err error) Result {
+	return Result{Scanner: name, Verdict: VerdictError, Error: err.Error(), ScannedAt: time.Now()}
+}
+
+// Command runs a scanner binary, e.g. clamscan or trufflehog. Exit status 0
+// means clean and 1 flagged, with one finding per line of output. Any other
+// status is a failure.
+type Command struct {
+	Args    []string
+	Timeout time.Duration
+}
+
+func (c *Command) Name() string {
+	return c.Args[0]
+}
+
+func (c *Command) Scan(ctx context.Context, path string) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	args := append(append([]string{}, c.Args[1:]...), path)
+	cmd := exec.CommandContext(ctx, c.Args[0], args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return Result{Scanner: c.Name(), Verdict: VerdictClean, ScannedAt: time.Now()}
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return Result{Scanner: c.Name(), Verdict: VerdictFlagged, Findings: findings(&stdout), ScannedAt: time.Now()}
+	default:
+		return errorResult(c.Name(), fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String())))
+	}
+}
+
+func findings(output io.Reader) []string {
+	var lines []string
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() && len(lines) < maxFindings {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// HTTP posts files to a scanning service, which must answer with a JSON
+// object such as {"clean": false, "findings": ["Eicar-Signature"]}.
+// Directories can't be scanned over HTTP.
+type HTTP struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+func (h *HTTP) Name() string {
+	return h.URL
+}
+
+func (h *HTTP) Scan(ctx context.Context, path string) Result {
+	file, err := os.Open(path)
+	if err != nil {
+		return errorResult(h.Name(), err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return errorResult(h.Name(), err)
+	}
+	if info.IsDir() {
+		return errorResult(h.Name(), errors.New("directories can't be scanned over HTTP"))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, file)
+	if err != nil {
+		return errorResult(h.Name(), err)
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for name, value := range h.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return errorResult(h.Name(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errorResult(h.Name(), fmt.Errorf("scanner answered with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body))))
+	}
+
+	var verdict struct {
+		Clean    *bool    `json:"clean"`
+		Findings []string `json:"findings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil || verdict.Clean == nil {
+		return errorResult(h.Name(), fmt.Errorf("invalid scanner response: %v", err))
+	}
+	result := Result{Scanner: h.Name(), Verdict: VerdictClean, ScannedAt: time.Now()}
+	if !*verdict.Clean {
+		result.Verdict = VerdictFlagged
+		result.Findings = verdict.Findings
+		if len(result.Findings) > maxFindings {
+			result.Findings = result.Findings[:maxFindings]
+		}
+	}
+	return result
+}
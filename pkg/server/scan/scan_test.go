@@ -0,0 +1,112 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	clean := filepath.Join(dir, "clean.txt")
+	secret := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(clean, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secret, []byte("AKIASECRET"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return clean, secret
+}
+
+func TestCommand(t *testing.T) {
+	clean, secret := writeFiles(t)
+	scanner, err := New([]string{"sh", "-c", `if grep -q AKIA "$0"; then echo "aws key in $0"; exit 1; fi`}, "", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := scanner.Scan(context.Background(), clean); r.Verdict != VerdictClean {
+		t.Errorf("Scan(clean) = %+v", r)
+	}
+	r := scanner.Scan(context.Background(), secret)
+	if r.Verdict != VerdictFlagged || len(r.Findings) != 1 || !strings.Contains(r.Findings[0], "aws key") {
+		t.Errorf("Scan(secret) = %+v", r)
+	}
+
+	broken := &Command{Args: []string{"sh", "-c", "echo broken >&2; exit 2"}, Timeout: defaultTimeout}
+	if r := broken.Scan(context.Background(), clean); r.Verdict != VerdictError || !strings.Contains(r.Error, "broken") {
+		t.Errorf("Scan with a failing scanner = %+v", r)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	clean, secret := writeFiles(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		resp := map[string]interface{}{"clean": true}
+		if strings.Contains(string(body), "AKIA") {
+			resp = map[string]interface{}{"clean": false, "findings": []string{"aws key"}}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	scanner, err := New(nil, server.URL, map[string]string{"Authorization": "Bearer t"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := scanner.Scan(context.Background(), clean); r.Verdict != VerdictClean {
+		t.Errorf("Scan(clean) = %+v", r)
+	}
+	if r := scanner.Scan(context.Background(), secret); r.Verdict != VerdictFlagged || len(r.Findings) != 1 {
+		t.Errorf("Scan(secret) = %+v", r)
+	}
+	if r := scanner.Scan(context.Background(), filepath.Dir(clean)); r.Verdict != VerdictError {
+		t.Errorf("Scan(dir) = %+v", r)
+	}
+
+	unauthorized, _ := New(nil, server.URL, nil, 0)
+	if r := unauthorized.Scan(context.Background(), clean); r.Verdict != VerdictError {
+		t.Errorf("Scan without credentials = %+v", r)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if s, err := New(nil, "", nil, 0); s != nil || err != nil {
+		t.Errorf("New() without a scanner = %v, %v", s, err)
+	}
+	if _, err := New([]string{"clamscan"}, "http://scanner", nil, 0); err == nil {
+		t.Error("New() accepted both a command and a url")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	flagged := Result{Verdict: VerdictFlagged}
+	failed := Result{Verdict: VerdictError}
+	clean := Result{Verdict: VerdictClean}
+	for _, tc := range []struct {
+		policy                 Policy
+		flagged, failed, clean bool
+	}{
+		{Policy{}, false, false, false},
+		{Policy{Quarantine: true}, true, false, false},
+		{Policy{Quarantine: true, FailClosed: true}, true, true, false},
+	} {
+		if tc.policy.Blocks(flagged) != tc.flagged || tc.policy.Blocks(failed) != tc.failed || tc.policy.Blocks(clean) != tc.clean {
+			t.Errorf("%+v blocks flagged, failed, clean = %v, %v, %v", tc.policy,
+				tc.policy.Blocks(flagged), tc.policy.Blocks(failed), tc.policy.Blocks(clean))
+		}
+	}
+}
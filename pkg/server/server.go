@@ -18,19 +18,43 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/abshkbh/arrakis/out/gen/chvapi"
 	"github.com/abshkbh/arrakis/out/gen/serverapi"
 	"github.com/abshkbh/arrakis/pkg/cmdserver"
 	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/mtls"
+	"github.com/abshkbh/arrakis/pkg/reqtrace"
+	"github.com/abshkbh/arrakis/pkg/server/admission"
+	"github.com/abshkbh/arrakis/pkg/server/adoption"
+	"github.com/abshkbh/arrakis/pkg/server/arch"
+	"github.com/abshkbh/arrakis/pkg/server/artifactstore"
+	"github.com/abshkbh/arrakis/pkg/server/audit"
+	"github.com/abshkbh/arrakis/pkg/server/autoscale"
+	"github.com/abshkbh/arrakis/pkg/server/bootprogress"
 	"github.com/abshkbh/arrakis/pkg/server/cidallocator"
+	"github.com/abshkbh/arrakis/pkg/server/egress"
 	"github.com/abshkbh/arrakis/pkg/server/fountain"
+	"github.com/abshkbh/arrakis/pkg/server/hostnet"
+	"github.com/abshkbh/arrakis/pkg/server/hypervisor"
 	"github.com/abshkbh/arrakis/pkg/server/ipallocator"
+	"github.com/abshkbh/arrakis/pkg/server/kernelargs"
+	"github.com/abshkbh/arrakis/pkg/server/listrevision"
+	"github.com/abshkbh/arrakis/pkg/server/notify"
+	"github.com/abshkbh/arrakis/pkg/server/ocr"
+	"github.com/abshkbh/arrakis/pkg/server/operations"
 	"github.com/abshkbh/arrakis/pkg/server/portallocator"
+	"github.com/abshkbh/arrakis/pkg/server/recordings"
+	"github.com/abshkbh/arrakis/pkg/server/scan"
+	"github.com/abshkbh/arrakis/pkg/server/store"
+	"github.com/abshkbh/arrakis/pkg/server/tenantpolicy"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+	"github.com/abshkbh/arrakis/pkg/server/usage"
+	"github.com/abshkbh/arrakis/pkg/server/workdir"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"gvisor.dev/gvisor/pkg/cleanup"
@@ -92,6 +116,11 @@ type portForward struct {
 	hostPort    int32
 	guestPort   int32
 	description string
+	// service is what the guest serves on guestPort, nil if unknown.
+	service *config.PortForwardServiceConfig
+	// createdBy is the owner the VM was created or restored for.
+	createdBy string
+	createdAt time.Time
 }
 
 func String(s string) *string {
@@ -107,11 +136,17 @@ func Bool(b bool) *bool {
 }
 
 type vm struct {
-	lock          sync.RWMutex
-	name          string
+	lock sync.RWMutex
+	// id identifies the VM for as long as it exists, unlike its name which
+	// can change and be reused.
+	id   string
+	name string
+	// owner is the tenant or workload the VM currently belongs to.
+	owner         string
 	stateDirPath  string
 	apiSocketPath string
-	apiClient     *chvapi.APIClient
+	hypervisor    hypervisor.Hypervisor
+	vmm           hypervisor.VMM // drives the VM of the VMM process
 	process       *os.Process
 	ip            *net.IPNet
 	tapDevice     *fountain.TapDevice
@@ -124,6 +159,24 @@ type vm struct {
 	vsockPath        string
 	cid              uint32
 	statefulDiskPath string
+	agent            *agentEndpoint
+	// bootProgress records the phases of the VM's latest boot.
+	bootProgress *bootprogress.Progress
+	// timeline records what happened to the VM.
+	timeline *timeline.Journal
+	// audit exports the timeline, nil unless audit export is enabled.
+	audit     *audit.Log
+	createdAt time.Time
+	// launch records what the VM was launched from.
+	launch launchSource
+	// devices are the VM's extra disks and NICs, in the order they were
+	// attached.
+	devices      []device
+	nextDeviceID int
+	// egressPolicy restricts when the VM can reach beyond the host, nil if
+	// it always can. egressBlocked is whether its egress is blocked now.
+	egressPolicy  *egress.Policy
+	egressBlocked bool
 }
 
 // calculateVCPUCount returns an appropriate number of vCPUs based on host's CPU count.
@@ -143,22 +196,12 @@ func calculateVCPUCount() int32 {
 	return suggestedVCPUs
 }
 
-// calculateGuestMemorySizeInMB calculates the appropriate memory size for the guest.
-func calculateGuestMemorySizeInMB(memoryPercentage int32) (int32, error) {
-	if memoryPercentage <= 0 || memoryPercentage > 100 {
-		memoryPercentage = defaultGuestMemPercentage
-		log.Warnf(
-			"Invalid memory percentage provided: %d, using default of %d%%",
-			memoryPercentage,
-			defaultGuestMemPercentage,
-		)
-	}
-
-	var totalMemoryKB int64
+// hostMemoryKB returns the host's total memory as reported by /proc/meminfo,
+// or 0 if it isn't listed there.
+func hostMemoryKB() (int64, error) {
 	data, err := os.ReadFile("/proc/meminfo")
 	if err != nil {
-		log.Warn("Could not determine host memory size, using default of 4096 MB")
-		return minGuestMemoryMB, nil
+		return 0, err
 	}
 
 	lines := strings.Split(string(data), "\n")
@@ -168,12 +211,30 @@ func calculateGuestMemorySizeInMB(memoryPercentage int32) (int32, error) {
 			if len(fields) >= 2 {
 				memKB, err := strconv.ParseInt(fields[1], 10, 64)
 				if err == nil {
-					totalMemoryKB = memKB
-					break
+					return memKB, nil
 				}
 			}
 		}
 	}
+	return 0, nil
+}
+
+// calculateGuestMemorySizeInMB calculates the appropriate memory size for the guest.
+func calculateGuestMemorySizeInMB(memoryPercentage int32) (int32, error) {
+	if memoryPercentage <= 0 || memoryPercentage > 100 {
+		memoryPercentage = defaultGuestMemPercentage
+		log.Warnf(
+			"Invalid memory percentage provided: %d, using default of %d%%",
+			memoryPercentage,
+			defaultGuestMemPercentage,
+		)
+	}
+
+	totalMemoryKB, err := hostMemoryKB()
+	if err != nil {
+		log.Warn("Could not determine host memory size, using default of 4096 MB")
+		return minGuestMemoryMB, nil
+	}
 	if totalMemoryKB <= 0 {
 		return 0, fmt.Errorf("could not determine host memory size")
 	}
@@ -194,39 +255,37 @@ func calculateGuestMemorySizeInMB(memoryPercentage int32) (int32, error) {
 	return int32(suggestedMemoryKB / 1024), nil
 }
 
-func getKernelCmdLine(gatewayIP string, guestIP string) string {
-	return fmt.Sprintf(
-		"console=ttyS0 gateway_ip=\"%s\" guest_ip=\"%s\"",
-		gatewayIP,
-		guestIP,
+// reservedKernelArgs are set by the server for the guest to set up its
+// network, and can't be overridden.
+var reservedKernelArgs = []string{"gateway_ip", "guest_ip"}
+
+// getKernelCmdLine returns the kernel command line of a guest, with the extra
+// args the server and the VM ask for applied to the default one, which has
+// those the hypervisor needs.
+func getKernelCmdLine(hypervisorArgs []string, gatewayIP string, guestIP string, extra []string) (string, error) {
+	base := append(append([]string(nil), hypervisorArgs...),
+		fmt.Sprintf("gateway_ip=\"%s\"", gatewayIP),
+		fmt.Sprintf("guest_ip=\"%s\"", guestIP),
 	)
-}
-
-// bridgeExists checks if a bridge with the given name exists.
-func bridgeExists(bridgeName string) (bool, error) {
-	cmd := exec.Command("ip", "link", "show", "type", "bridge")
-	output, err := cmd.Output()
+	args, err := kernelargs.Merge(base, extra, reservedKernelArgs...)
 	if err != nil {
-		return false, fmt.Errorf("error executing command: %v", err)
+		return "", err
 	}
+	return kernelargs.Join(args), nil
+}
 
-	bridges := strings.Split(string(output), "\n")
-
-	for _, bridge := range bridges {
-		// Use regex to match exact bridge name followed by colon
-		// This prevents "br0" from matching "virbr0"
-		bridgePattern := fmt.Sprintf(`\b\d+:\s+%s:`, bridgeName)
-		matched, _ := regexp.MatchString(bridgePattern, bridge)
-		if matched {
-			return true, nil
-		}
+// vmKernelArgs returns the extra kernel args of a VM: the server's, then
+// those of the request, which override them.
+func (s *Server) vmKernelArgs(req *serverapi.StartVMRequest) ([]string, error) {
+	args := append(append([]string(nil), s.config.KernelArgs...), req.GetKernelArgs()...)
+	if _, err := kernelargs.Merge(nil, args, reservedKernelArgs...); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-
-	return false, nil
+	return args, nil
 }
 
-// setupSinglePortForward creates an iptables rule to forward a port and returns the port forward details
-func (s *Server) setupSinglePortForward(vmIP string, guestPort int64, description string, portForwardDesc string) (portForward, error) {
+// setupSinglePortForward forwards a host port to the VM and returns the port forward details
+func (s *Server) setupSinglePortForward(vmIP string, spec guestPortSpec) (portForward, error) {
 	hostPort, err := s.portAllocator.AllocatePort()
 	if err != nil {
 		return portForward{}, fmt.Errorf("failed to allocate port: %w", err)
@@ -244,33 +303,16 @@ func (s *Server) setupSinglePortForward(vmIP string, guestPort int64, descriptio
 		"Setting up port forward %d -> %s:%d (%s)",
 		hostPort,
 		vmIP,
-		guestPort,
-		description,
-	)
-
-	cmd := exec.Command(
-		"iptables",
-		"-t",
-		"nat",
-		"-A",
-		"PREROUTING",
-		"-p",
-		"tcp",
-		"--dport",
-		strconv.Itoa(int(hostPort)),
-		"-j",
-		"DNAT",
-		"--to-destination",
-		fmt.Sprintf("%s:%d", vmIP, guestPort),
+		spec.port,
+		spec.description,
 	)
 
-	err = cmd.Run()
-	if err != nil {
+	if err := s.network.ForwardPort(hostPort, vmIP, int32(spec.port)); err != nil {
 		return portForward{}, fmt.Errorf(
 			"error forwarding port %d->%s:%d: %w",
 			hostPort,
 			vmIP,
-			guestPort,
+			spec.port,
 			err,
 		)
 	}
@@ -278,19 +320,46 @@ func (s *Server) setupSinglePortForward(vmIP string, guestPort int64, descriptio
 	cleanup.Release()
 	return portForward{
 		hostPort:    hostPort,
-		guestPort:   int32(guestPort),
-		description: portForwardDesc,
+		guestPort:   int32(spec.port),
+		description: spec.portForwardDesc,
+		service:     spec.service,
+		createdAt:   time.Now(),
 	}, nil
 }
 
-// setupPortForwardsToVM forwards the given port forwards to the VM.
-func (s *Server) setupPortForwardsToVM(vmIP string, guestPorts []config.PortForwardConfig) ([]portForward, error) {
-	portForwards := make([]portForward, 0, len(guestPorts))
+// guestPortSpec is one guest port to forward, with ranges expanded.
+type guestPortSpec struct {
+	port        int64
+	description string
+	// portForwardDesc also names the range the port belongs to.
+	portForwardDesc string
+	service         *config.PortForwardServiceConfig
+}
+
+// expandPortForwards parses the configured port forwards, expanding ranges
+// (e.g. "6000-7000") into single ports, and checks the services they
+// declare.
+func expandPortForwards(guestPorts []config.PortForwardConfig) ([]guestPortSpec, error) {
+	var specs []guestPortSpec
+	services := make(map[string]bool)
 	for _, guestPortConfig := range guestPorts {
+		service := guestPortConfig.ServiceOf()
+		if service != nil {
+			if err := validatePortForwardService(*service); err != nil {
+				return nil, fmt.Errorf("invalid service of port %s: %w", guestPortConfig.Port, err)
+			}
+			if services[service.Name] {
+				return nil, fmt.Errorf("service %q is declared more than once", service.Name)
+			}
+			services[service.Name] = true
+		}
+
 		// Check if the port is a range (e.g., "6000-7000")
 		portRange := strings.Split(guestPortConfig.Port, "-")
 		if len(portRange) == 2 {
-			// Handle port range
+			if service != nil {
+				return nil, fmt.Errorf("port range %s can't declare a service", guestPortConfig.Port)
+			}
 			startPort, err := strconv.ParseInt(portRange[0], 10, 32)
 			if err != nil {
 				return nil, fmt.Errorf("invalid start port in range %s: %w", guestPortConfig.Port, err)
@@ -304,189 +373,44 @@ func (s *Server) setupPortForwardsToVM(vmIP string, guestPorts []config.PortForw
 				return nil, fmt.Errorf("invalid port range %s: start port must be less than end port", guestPortConfig.Port)
 			}
 
-			log.Infof(
-				"Setting up port range forward for ports %d-%d to %s (%s)",
-				startPort,
-				endPort,
-				vmIP,
-				guestPortConfig.Description,
-			)
-
-			// Forward each port in the range
 			for guestPort := startPort; guestPort <= endPort; guestPort++ {
-				portForwardDesc := fmt.Sprintf("%s (range %s)", guestPortConfig.Description, guestPortConfig.Port)
-				pf, err := s.setupSinglePortForward(vmIP, guestPort, guestPortConfig.Description, portForwardDesc)
-				if err != nil {
-					return nil, err
-				}
-				portForwards = append(portForwards, pf)
+				specs = append(specs, guestPortSpec{
+					port:            guestPort,
+					description:     guestPortConfig.Description,
+					portForwardDesc: fmt.Sprintf("%s (range %s)", guestPortConfig.Description, guestPortConfig.Port),
+				})
 			}
 		} else {
-			// Handle single port (existing logic)
 			guestPort, err := strconv.ParseInt(guestPortConfig.Port, 10, 32)
 			if err != nil {
 				return nil, fmt.Errorf("invalid guest port %s: %w", guestPortConfig.Port, err)
 			}
-
-			pf, err := s.setupSinglePortForward(vmIP, guestPort, guestPortConfig.Description, guestPortConfig.Description)
-			if err != nil {
-				return nil, err
-			}
-			portForwards = append(portForwards, pf)
-		}
-	}
-	return portForwards, nil
-}
-
-func cleanupAllIPTablesRulesForIP(ip string) error {
-	log.Infof("deleting all iptables rules for IP: %s", ip)
-	// First, list all rules in the NAT table PREROUTING chain.
-	cmd := exec.Command("iptables", "-t", "nat", "-L", "PREROUTING", "-n", "--line-numbers")
-	output, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("failed to list iptables rules: %w", err)
-	}
-
-	// Parse the output to find rule numbers that match our IP.
-	lines := strings.Split(string(output), "\n")
-	var ruleNumbers []int
-
-	// Skip the first two lines (headers).
-	for i := 2; i < len(lines); i++ {
-		line := lines[i]
-		if strings.Contains(line, "to:"+ip+":") {
-			log.Infof("deleting rule: %s", line)
-			// Extract the rule number (first field).
-			fields := strings.Fields(line)
-			if len(fields) > 0 {
-				ruleNum, err := strconv.Atoi(fields[0])
-				if err == nil {
-					ruleNumbers = append(ruleNumbers, ruleNum)
-				}
-			}
-		}
-	}
-
-	// Delete rules in reverse order to minimize the number of rules that need to be deleted.
-	sort.Sort(sort.Reverse(sort.IntSlice(ruleNumbers)))
-
-	var finalErr error
-	for _, ruleNum := range ruleNumbers {
-		cmd := exec.Command(
-			"iptables",
-			"-t",
-			"nat",
-			"-D",
-			"PREROUTING",
-			strconv.Itoa(ruleNum),
-		)
-
-		if err := cmd.Run(); err != nil {
-			log.Warnf("error deleting iptables rule %d for IP %s: %v", ruleNum, ip, err)
-			finalErr = errors.Join(
-				finalErr,
-				fmt.Errorf("failed to delete rule %d: %w", ruleNum, err),
-			)
-		}
-	}
-	return finalErr
-}
-
-func cleanupTapDevices() error {
-	// List all network interfaces.
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return fmt.Errorf("failed to list interfaces: %v", err)
-	}
-
-	for _, iface := range interfaces {
-		// Check if interface name starts with "tap".
-		if strings.HasPrefix(iface.Name, "tap") {
-			if err := exec.Command("ip", "link", "delete", iface.Name).Run(); err != nil {
-				log.Warnf("failed to delete tap device %s: %v", iface.Name, err)
-			}
-			log.Infof("deleted tap device: %s", iface.Name)
+			specs = append(specs, guestPortSpec{
+				port:            guestPort,
+				description:     guestPortConfig.Description,
+				portForwardDesc: guestPortConfig.Description,
+				service:         service,
+			})
 		}
 	}
-	return nil
-}
-
-func cleanupBridge() error {
-	// Check if br0 exists.
-	_, err := exec.Command("ip", "link", "show", "br0").CombinedOutput()
-	if err != nil {
-		// Bridge doesn't exist, nothing to do.
-		return nil
-	}
-
-	// Bridge exists, delete it
-	if err := exec.Command("ip", "link", "delete", "br0").Run(); err != nil {
-		return fmt.Errorf("failed to delete bridge br0: %v", err)
-	}
-	log.Info("deleted bridge: br0")
-	return nil
+	return specs, nil
 }
 
-// setupBridgeAndFirewall sets up a bridge and firewall rules for the given bridge name, IP address, and subnet.
-func setupBridgeAndFirewall(
-	backupFile string,
-	bridgeName string,
-	bridgeIP string,
-	bridgeSubnet string,
-) error {
-	output, err := exec.Command("iptables-save").Output()
-	if err != nil {
-		return fmt.Errorf("failed to run iptables-save: %w", err)
-	}
-
-	err = os.WriteFile(backupFile, output, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to save iptables-save to: %v: %w", backupFile, err)
-	}
-
-	// Get default network interface
-	output, err = exec.Command("sh", "-c", "ip r | grep default | awk '{print $5}'").Output()
-	if err != nil {
-		return fmt.Errorf("failed to get default network interface: %w", err)
-	}
-	hostDefaultNetworkInterface := strings.TrimSpace(string(output))
-
-	exists, err := bridgeExists(bridgeName)
+// setupPortForwardsToVM forwards the given port forwards to the VM.
+func (s *Server) setupPortForwardsToVM(vmIP string, guestPorts []config.PortForwardConfig) ([]portForward, error) {
+	specs, err := expandPortForwards(guestPorts)
 	if err != nil {
-		return fmt.Errorf("failed to detect if bridge exists: %w", err)
-	}
-
-	if exists {
-		log.Info("networking already setup")
-		return nil
+		return nil, err
 	}
-
-	// Setup bridge and firewall rules
-	commands := []struct {
-		name string
-		args []string
-	}{
-		{"ip", []string{"l", "add", bridgeName, "type", "bridge"}},
-		{"ip", []string{"l", "set", bridgeName, "up"}},
-		{"ip", []string{"a", "add", bridgeIP, "dev", bridgeName, "scope", "host"}},
-		{"iptables", []string{"-t", "nat", "-A", "POSTROUTING", "-s", bridgeSubnet, "-o", hostDefaultNetworkInterface, "-j", "MASQUERADE"}},
-		{"sysctl", []string{"-w", fmt.Sprintf("net.ipv4.conf.%s.forwarding=1", hostDefaultNetworkInterface)}},
-		{"sysctl", []string{"-w", fmt.Sprintf("net.ipv4.conf.%s.forwarding=1", bridgeName)}},
-		{"iptables", []string{"-t", "filter", "-I", "FORWARD", "-s", bridgeSubnet, "-j", "ACCEPT"}},
-		{"iptables", []string{"-t", "filter", "-I", "FORWARD", "-d", bridgeSubnet, "-j", "ACCEPT"}},
-	}
-
-	for _, cmd := range commands {
-		if err := exec.Command(cmd.name, cmd.args...).Run(); err != nil {
-			return fmt.Errorf("failed to execute command '%s %s': %w", cmd.name, strings.Join(cmd.args, " "), err)
+	portForwards := make([]portForward, 0, len(specs))
+	for _, spec := range specs {
+		pf, err := s.setupSinglePortForward(vmIP, spec)
+		if err != nil {
+			return nil, err
 		}
+		portForwards = append(portForwards, pf)
 	}
-
-	return nil
-}
-
-func getVmStateDirPath(stateDir string, vmName string) string {
-	return path.Join(stateDir, vmName)
+	return portForwards, nil
 }
 
 // copyFile copies a file from sourcePath to destPath.
@@ -520,10 +444,6 @@ func copyFile(sourcePath, destPath string) error {
 	return nil
 }
 
-func getVmSocketPath(vmStateDir string, vmName string) string {
-	return path.Join(vmStateDir, vmName+".sock")
-}
-
 func unixSocketClient(socketPath string) *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
@@ -535,18 +455,14 @@ func unixSocketClient(socketPath string) *http.Client {
 	}
 }
 
-func createApiClient(apiSocketPath string) *chvapi.APIClient {
-	configuration := chvapi.NewConfiguration()
-	configuration.HTTPClient = unixSocketClient(apiSocketPath)
-	configuration.Servers = chvapi.ServerConfigurations{
-		{
-			URL: "http://localhost/api/v1",
-		},
-	}
-	return chvapi.NewAPIClient(configuration)
+// connectVMM returns the VMM of h serving its API on apiSocketPath.
+func connectVMM(h hypervisor.Hypervisor, apiSocketPath string) hypervisor.VMM {
+	client := unixSocketClient(apiSocketPath)
+	client.Transport = reqtrace.Transport(client.Transport, reqtrace.PhaseCHVAPI)
+	return h.Connect(client)
 }
 
-func waitForServer(ctx context.Context, apiClient *chvapi.APIClient, timeout time.Duration) error {
+func waitForServer(ctx context.Context, vmm hypervisor.VMM, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
@@ -558,12 +474,9 @@ func waitForServer(ctx context.Context, apiClient *chvapi.APIClient, timeout tim
 				errCh <- ctx.Err()
 				return
 			default:
-				resp, r, err := apiClient.DefaultAPI.VmmPingGet(ctx).Execute()
+				version, err := vmm.Ping(ctx)
 				if err == nil {
-					log.WithFields(log.Fields{
-						"buildVersion": *resp.BuildVersion,
-						"statusCode":   r.StatusCode,
-					}).Info("cloud-hypervisor server up")
+					log.WithField("buildVersion", version).Info("VMM server up")
 					errCh <- nil
 					return
 				}
@@ -608,11 +521,42 @@ func convertPortForward(pfs []portForward) []serverapi.PortForward {
 			HostPort:    serverapi.PtrString(strconv.Itoa(int(pf.hostPort))),
 			GuestPort:   serverapi.PtrString(strconv.Itoa(int(pf.guestPort))),
 			Description: serverapi.PtrString(pf.description),
+			Service:     convertPortForwardService(pf.service, pf.guestPort),
 		})
 	}
 	return result
 }
 
+// convertPortForwardService converts the service served on guestPort to the
+// API format, nil if none.
+func convertPortForwardService(service *config.PortForwardServiceConfig, guestPort int32) *serverapi.PortForwardService {
+	if service == nil {
+		return nil
+	}
+	return &serverapi.PortForwardService{
+		Name:      serverapi.PtrString(service.Name),
+		Protocol:  serverapi.PtrString(service.Protocol),
+		GuestPort: serverapi.PtrString(strconv.Itoa(int(guestPort))),
+		Proxy:     serverapi.PtrString(service.Proxy),
+	}
+}
+
+// validatePortForwardService checks a service declared on a port forward.
+func validatePortForwardService(service config.PortForwardServiceConfig) error {
+	if service.Name == "" {
+		return errors.New("the service's name is required")
+	}
+	switch service.Proxy {
+	case "", config.ServiceProxyCDP, config.ServiceProxyNoVNC:
+	default:
+		return fmt.Errorf("unknown proxy %q, want %s or %s", service.Proxy, config.ServiceProxyCDP, config.ServiceProxyNoVNC)
+	}
+	if service.Protocol == "" {
+		return errors.New("the service's protocol is required")
+	}
+	return nil
+}
+
 type NetworkConfig struct {
 	Tap string `json:"tap"`
 }
@@ -646,58 +590,6 @@ func extractGuestIPFromCmdline(cmdline string) (*net.IPNet, error) {
 	return ipNet, nil
 }
 
-// Returns the tap device name and the guest IP address from the snapshot config.
-func parseNetworkDataFromSnapshotConfig(configPath string) (string, *net.IPNet, error) {
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return "", nil, fmt.Errorf("failed to read config file: %w", err)
-	}
-
-	var config VMConfig
-	if err := json.Unmarshal(data, &config); err != nil {
-		return "", nil, fmt.Errorf("failed to unmarshal config: %w", err)
-	}
-
-	if config.Net == nil || len(*config.Net) == 0 {
-		return "", nil, fmt.Errorf("no network configuration found")
-	}
-
-	if config.Payload.Cmdline == nil {
-		return "", nil, fmt.Errorf("no cmdline found")
-	}
-
-	guestIP, err := extractGuestIPFromCmdline(*config.Payload.Cmdline)
-	if err != nil {
-		return "", nil, fmt.Errorf("failed to extract guest IP from cmdline: %w", err)
-	}
-	return (*config.Net)[0].Tap, guestIP, nil
-}
-
-// getIPPrefix returns the IP prefix from the given CIDR taking into account the mask.
-func getIPPrefix(cidr string) (string, error) {
-	// Parse CIDR
-	_, ipNet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse CIDR: %w", err)
-	}
-
-	// Get the ones in the mask to determine how many octets to keep
-	ones, _ := ipNet.Mask.Size()
-
-	// Calculate how many complete octets we need
-	completeOctets := ones / 8
-
-	// Split IP into octets
-	octets := strings.Split(ipNet.IP.String(), ".")
-
-	// Take only the number of octets determined by the mask
-	if completeOctets > 0 && completeOctets <= len(octets) {
-		return strings.Join(octets[:completeOctets], "."), nil
-	}
-
-	return "", fmt.Errorf("invalid mask size: %d", ones)
-}
-
 func createStatefulDisk(path string, sizeInMB int32) error {
 	log.Infof("Creating stateful disk at %s with size %dMB", path, sizeInMB)
 	// A sparse file is created as we want to pack as many sandboxes on a server, by growing as
@@ -720,28 +612,61 @@ func createStatefulDisk(path string, sizeInMB int32) error {
 }
 
 func NewServer(config config.ServerConfig) (*Server, error) {
-	// Cleanup any existing resources.
-	if err := cleanupTapDevices(); err != nil {
-		return nil, fmt.Errorf("failed to cleanup tap devices: %w", err)
+	network, err := hostnet.New(config.NetworkBackend)
+	if err != nil {
+		return nil, err
+	}
+	netConfig := hostnet.Config{
+		Bridge:        config.BridgeName,
+		BridgeAddress: config.BridgeIP,
+		Subnet:        config.BridgeSubnet,
+	}
+	if network.Name() == hostnet.BackendExternal && len(config.PortForwards) > 0 {
+		log.Warnf("Ignoring port forwards, the %s network backend doesn't support them", network.Name())
+		config.PortForwards = nil
 	}
 
-	if err := cleanupBridge(); err != nil {
-		return nil, fmt.Errorf("failed to cleanup bridge: %w", err)
+	if err := os.MkdirAll(config.StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create vm state dir: %v err: %w", config.StateDir, err)
 	}
 
-	ipPrefix, err := getIPPrefix(config.BridgeSubnet)
+	host := storeHost(config)
+	metadata, err := store.Open(config.Store, config.StateDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get IP prefix: %w", err)
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	// The VMs this host left running, e.g. as a leader that stepped down,
+	// keep their network and are adopted once the server is set up.
+	running, gone := hostVMs(context.Background(), metadata, host, config.StateDir)
+	if len(running) == 0 {
+		// Cleanup any existing resources.
+		if err := network.Cleanup(netConfig); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Infof("Keeping the host network of %d VMs still running", len(running))
 	}
 
-	log.Infof("Cleaning up iptables rules for IP prefix: %s", ipPrefix)
-	if err := cleanupAllIPTablesRulesForIP(ipPrefix); err != nil {
-		return nil, fmt.Errorf("failed to cleanup iptables rules: %w", err)
+	if _, err := kernelargs.Merge(nil, config.KernelArgs, reservedKernelArgs...); err != nil {
+		return nil, fmt.Errorf("invalid kernel_args: %w", err)
+	}
+	if _, err := expandPortForwards(config.PortForwards); err != nil {
+		return nil, fmt.Errorf("invalid port_forwards: %w", err)
 	}
 
-	if err := os.MkdirAll(config.StateDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create vm state dir: %v err: %w", config.StateDir, err)
+	hostArch, err := arch.Host()
+	if err != nil {
+		return nil, err
+	}
+	config, err = applyArchConfig(config, hostArch)
+	if err != nil {
+		return nil, err
 	}
+	hypervisors, err := newHypervisors(config)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Serving %s guests", hostArch)
 
 	// Will be used to store snapshots.
 	snapshotsDir := path.Join(config.StateDir, "snapshots")
@@ -749,13 +674,8 @@ func NewServer(config config.ServerConfig) (*Server, error) {
 		return nil, fmt.Errorf("failed to create snapshots directory: %w", err)
 	}
 
-	ipBackupFile := fmt.Sprintf("/tmp/iptables-backup-%s.rules", time.Now().Format(time.UnixDate))
-	if err := setupBridgeAndFirewall(
-		ipBackupFile,
-		config.BridgeName,
-		config.BridgeIP,
-		config.BridgeSubnet,
-	); err != nil {
+	log.Infof("Setting up networking with the %s backend", network.Name())
+	if err := network.Setup(netConfig); err != nil {
 		return nil, fmt.Errorf("failed to setup networking on the host: %w", err)
 	}
 
@@ -777,15 +697,125 @@ func NewServer(config config.ServerConfig) (*Server, error) {
 		return nil, fmt.Errorf("failed to create CID allocator: %w", err)
 	}
 
+	var artifactStore artifactstore.Store
+	if config.Artifacts.UploadURL != "" {
+		artifactStore, err = artifactstore.New(config.Artifacts.UploadURL, config.Artifacts.UploadHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create artifact store: %w", err)
+		}
+	}
+
+	scanner, err := newScanner(config.Scan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scanner: %w", err)
+	}
+	ocrEngine, err := ocr.New(config.OCR.Tesseract, config.OCR.Command, config.OCR.URL, config.OCR.Headers, config.OCR.Language, config.OCR.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCR engine: %w", err)
+	}
+
+	notifier, err := newNotifier(config.Notifications)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create notifier: %w", err)
+	}
+
+	autoscaler, err := newAutoscaler(config.Autoscaling, host, notifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create autoscaler: %w", err)
+	}
+	tenants, err := newTenantPolicies(config.Tenants)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tenant policies: %w", err)
+	}
+	auditLog, err := newAuditLog(config.AuditExport, config.StateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	var admissionController *admission.Controller
+	if config.Admission.Enabled() {
+		admissionController, err = newAdmissionController(config.Admission)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create admission controller: %w", err)
+		}
+	}
+
+	if config.MTLS.PKIDir != "" {
+		if err := mtls.EnsurePKI(config.MTLS.PKIDir); err != nil {
+			return nil, fmt.Errorf("failed to create internal PKI: %w", err)
+		}
+	}
+	agent, err := newAgentEndpoint(config.MTLS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up mutual TLS with the guest agents: %w", err)
+	}
+
+	ledger := usage.NewLedger()
+	if err := ledger.Load(path.Join(config.StateDir, usageFilename)); err != nil {
+		log.WithError(err).Warn("Failed to load usage, starting afresh")
+	}
+
+	recordingsIndex := recordings.NewIndex()
+	if err := recordingsIndex.Load(path.Join(config.StateDir, recordingsFilename)); err != nil {
+		log.WithError(err).Warn("Failed to load recordings index, recordings so far won't be purged")
+	}
+
+	deleted, err := loadDeletedVMs(config.StateDir)
+	if err != nil {
+		log.WithError(err).Warn("Failed to load deleted VMs, they can't be undeleted")
+	}
+
+	cordon, err := loadCordon(config.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	if cordon != nil {
+		log.WithField("reason", cordon.Reason).Warn("Host is cordoned, new VMs are refused until it is uncordoned")
+	}
+
 	log.Infof("Server config: %+v", config)
-	return &Server{
+	s := &Server{
 		vms:           make(map[string]*vm),
+		vmIDs:         make(map[string]*vm),
+		boots:         make(map[string]*bootprogress.Progress),
+		deleted:       deleted,
+		cordon:        cordon,
+		transfers:     make(map[string]bool),
+		vmRevisions:   listrevision.New(),
 		fountain:      fountain.NewFountain(config.BridgeName),
 		ipAllocator:   ipAllocator,
 		portAllocator: portAllocator,
 		cidAllocator:  cidAllocator,
+		network:       network,
+		agent:         agent,
+		artifactStore: artifactStore,
+		scanner:       scanner,
+		ocr:           ocrEngine,
+		recordings:    recordingsIndex,
+		admission:     admissionController,
+		notifier:      notifier,
+		crashLoops:    notify.NewCrashLoops(config.Notifications.CrashLoopFailures, config.Notifications.CrashLoopWindow),
+		usage:         ledger,
+		usageMeter:    usageMeter{samples: make(map[*vm]*usageSample)},
+		operations:    operations.NewManager(operationRetention),
+		arch:          hostArch,
+		hypervisors:   hypervisors,
+		store:         metadata,
+		host:          host,
+		autoscaler:    autoscaler,
+		tenants:       tenants,
+		audit:         auditLog,
 		config:        config,
-	}, nil
+	}
+	s.restoreHostVMs(context.Background(), running, gone)
+	log.Infof("Restored %d VMs and %d snapshots from the store", len(s.vms), s.restoreHostSnapshots(context.Background()))
+
+	// Catch what the cleanup above misses, e.g. taps of a bridge that wasn't
+	// removed, or of VMs that couldn't be restored.
+	if _, err := s.ReconcileNetwork(context.Background(), false); err != nil {
+		log.WithError(err).Warn("Failed to reconcile network")
+	}
+	return s, nil
 }
 
 func (s *Server) getVMAtomic(vmName string) *vm {
@@ -801,10 +831,12 @@ func (s *Server) getVMAtomic(vmName string) *vm {
 
 func (s *Server) createVM(
 	ctx context.Context,
+	h hypervisor.Hypervisor,
 	vmName string,
 	kernelPath string,
 	initramfsPath string,
 	rootfsPath string,
+	kernelArgs []string,
 	forRestore bool,
 ) (*vm, error) {
 	cleanup := cleanup.Make(func() {
@@ -822,8 +854,9 @@ func (s *Server) createVM(
 		cleanup.Clean()
 	}()
 
-	vmStateDir := getVmStateDirPath(s.config.StateDir, vmName)
-	err := os.MkdirAll(vmStateDir, 0755)
+	layout := workdir.New(s.config.StateDir, vmName)
+	vmStateDir := layout.Root
+	err := layout.Create()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create vm state dir: %w", err)
 	}
@@ -835,17 +868,17 @@ func (s *Server) createVM(
 	log.Infof("CREATED: %v", vmStateDir)
 
 	// This will be cleaned up by the clean up function above nuking the directory.
-	apiSocketPath := getVmSocketPath(vmStateDir, vmName)
-	apiClient := createApiClient(apiSocketPath)
+	apiSocketPath := layout.APISocket()
+	vmm := connectVMM(h, apiSocketPath)
 
 	// This will be cleaned up by the clean up function above nuking the directory.
-	logFilePath := path.Join(vmStateDir, "log")
+	logFilePath := layout.VMMLog()
 	logFile, err := os.Create(logFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create log file: %w", err)
 	}
 
-	cmd := exec.Command(s.config.ChvBinPath, "--api-socket", apiSocketPath)
+	cmd := h.Command(apiSocketPath)
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
 	// Add VMs to a separate process group. Otherwise Ctrl-C goes to the VMs
@@ -864,10 +897,11 @@ func (s *Server) createVM(
 		reapProcess(cmd.Process, log.WithField("vmname", vmName), reapVmTimeout)
 	})
 
-	err = waitForServer(ctx, apiClient, 10*time.Second)
+	err = waitForServer(ctx, vmm, 10*time.Second)
 	if err != nil {
 		return nil, fmt.Errorf("error waiting for vm: %w", err)
 	}
+	bootprogress.FromContext(ctx).Reach(bootprogress.PhaseVMMStarted)
 	cleanup.Add(func() {
 		log.WithFields(log.Fields{"vmname": vmName, "action": "cleanup", "api": "createVM"}).Info("kill VMM process")
 		if err := cmd.Process.Kill(); err != nil {
@@ -882,10 +916,12 @@ func (s *Server) createVM(
 	var vsockPath string
 	var cid uint32
 	var statefulDiskPath string
-	// We only need to setup the network and call the chv create VM API if we are not restoring
+	// We only need to setup the network and call the VMM's create VM API if we are not restoring
 	// from a snapshot.
 	if !forRestore {
 		var err error
+		networkDone := reqtrace.Start(ctx, reqtrace.PhaseNetwork)
+		defer networkDone()
 		tapDevice, err = s.fountain.CreateTapDevice(nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create tap device: %w", err)
@@ -908,7 +944,7 @@ func (s *Server) createVM(
 
 		portForwards, err = s.setupPortForwardsToVM(guestIP.IP.String(), s.config.PortForwards)
 		if err != nil {
-			cleanupAllIPTablesRulesForIP(guestIP.IP.String())
+			s.network.RemovePortForwards(guestIP.IP.String())
 			return nil, fmt.Errorf("failed to forward ports to VM: %w", err)
 		}
 		cleanup.Add(func() {
@@ -920,10 +956,11 @@ func (s *Server) createVM(
 					"ip":     guestIP.String(),
 				},
 			).Info("deleting port forwards")
-			cleanupAllIPTablesRulesForIP(guestIP.IP.String())
+			s.network.RemovePortForwards(guestIP.IP.String())
 		})
+		networkDone()
 
-		vsockPath = path.Join(vmStateDir, "vsock.sock")
+		vsockPath = layout.VsockSocket()
 		cid, err = s.cidAllocator.AllocateCID()
 		if err != nil {
 			return nil, fmt.Errorf("failed to allocate CID: %w", err)
@@ -934,11 +971,18 @@ func (s *Server) createVM(
 			}
 		})
 
-		statefulDiskPath = path.Join(vmStateDir, statefulDiskFilename)
-		err = createStatefulDisk(statefulDiskPath, s.config.StatefulSizeInMB)
+		statefulDiskPath = layout.Disk(statefulDiskFilename)
+		diskDone := reqtrace.Start(ctx, reqtrace.PhaseDiskCopy)
+		if imported := importedDisk(ctx); imported != "" {
+			err = os.Rename(imported, statefulDiskPath)
+		} else {
+			err = createStatefulDisk(statefulDiskPath, s.config.StatefulSizeInMB)
+		}
+		diskDone()
 		if err != nil {
 			return nil, fmt.Errorf("failed to create stateful disk: %w", err)
 		}
+		bootprogress.FromContext(ctx).Reach(bootprogress.PhaseDiskPrepared)
 		cleanup.Add(func() {
 			if err := os.Remove(statefulDiskPath); err != nil {
 				log.WithError(err).Errorf("failed to remove stateful disk: %s", statefulDiskPath)
@@ -946,71 +990,42 @@ func (s *Server) createVM(
 		})
 
 		vcpus := calculateVCPUCount()
-		// Match virtio-blk queues to vCPUs.
-		numBlockDeviceQueues := vcpus
 		memorySizeMB, err := calculateGuestMemorySizeInMB(s.config.GuestMemPercentage)
 		if err != nil {
 			return nil, fmt.Errorf("failed to calculate guest memory size: %w", err)
 		}
 		log.Infof("Calculated vCPUs: %d, memory size: %d MB", vcpus, memorySizeMB)
-		vmConfig := chvapi.VmConfig{
-			Payload: chvapi.PayloadConfig{
-				Kernel:    String(kernelPath),
-				Cmdline:   String(getKernelCmdLine(s.config.BridgeIP, guestIP.String())),
-				Initramfs: String(initramfsPath),
-			},
-			Disks: []chvapi.DiskConfig{
-				{Path: rootfsPath, Readonly: Bool(true), NumQueues: &numBlockDeviceQueues},
-				{Path: statefulDiskPath, NumQueues: &numBlockDeviceQueues},
-			},
-			Cpus:    &chvapi.CpusConfig{BootVcpus: vcpus, MaxVcpus: vcpus},
-			Memory:  &chvapi.MemoryConfig{Size: int64(memorySizeMB) * 1024 * 1024},
-			Serial:  chvapi.NewConsoleConfig(serialPortMode),
-			Console: chvapi.NewConsoleConfig(consolePortMode),
-			Net: []chvapi.NetConfig{
-				{Tap: String(tapDevice.Name), NumQueues: Int32(numNetDeviceQueues), QueueSize: Int32(netDeviceQueueSizeBytes), Id: String(netDeviceId)},
-			},
-			Vsock: &chvapi.VsockConfig{Cid: int64(cid), Socket: vsockPath},
+		cmdline, err := getKernelCmdLine(h.KernelArgs(s.arch), s.config.BridgeIP, guestIP.String(), kernelArgs)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
-		log.Info("Calling CreateVM")
-		req := apiClient.DefaultAPI.CreateVM(ctx)
-		req = req.VmConfig(vmConfig)
-
-		resp, err := req.Execute()
+		err = vmm.Create(ctx, hypervisor.VMConfig{
+			Kernel:    kernelPath,
+			Initramfs: initramfsPath,
+			Cmdline:   cmdline,
+			VCPUs:     vcpus,
+			MemoryMB:  memorySizeMB,
+			Disks: []hypervisor.Disk{
+				{Path: rootfsPath, ReadOnly: true},
+				{Path: statefulDiskPath},
+			},
+			Tap:       tapDevice.Name,
+			VsockCID:  cid,
+			VsockPath: vsockPath,
+		})
 		if err != nil {
 			log.Errorf("CreateVM API call failed with error: %v", err)
-			if resp != nil {
-				log.Errorf("Response Status Code: %d", resp.StatusCode)
-				if resp.Body != nil {
-					body, readErr := io.ReadAll(resp.Body)
-					if readErr != nil {
-						log.Errorf("Failed to read response body: %v", readErr)
-					} else {
-						log.Errorf("Response Body: %s", string(body))
-					}
-				}
-			}
 			return nil, fmt.Errorf("failed to start VM: %w", err)
 		}
-		if resp.StatusCode != 204 {
-			log.Errorf("CreateVM returned unexpected status: %d", resp.StatusCode)
-			if resp.Body != nil {
-				body, readErr := io.ReadAll(resp.Body)
-				if readErr != nil {
-					log.Errorf("Failed to read response body: %v", readErr)
-				} else {
-					log.Errorf("Response Body: %s", string(body))
-				}
-			}
-			return nil, fmt.Errorf("failed to start VM. bad status: %v", resp)
-		}
 	}
 
 	vm := &vm{
+		id:               newVMID(),
 		name:             vmName,
 		stateDirPath:     vmStateDir,
 		apiSocketPath:    apiSocketPath,
-		apiClient:        apiClient,
+		hypervisor:       h,
+		vmm:              vmm,
 		process:          cmd.Process,
 		ip:               guestIP,
 		tapDevice:        tapDevice,
@@ -1019,11 +1034,24 @@ func (s *Server) createVM(
 		vsockPath:        vsockPath,
 		cid:              cid,
 		statefulDiskPath: statefulDiskPath,
+		agent:            s.agent,
+		bootProgress:     bootprogress.FromContext(ctx),
+		timeline:         openTimeline(vmStateDir),
+		audit:            s.audit,
+		createdAt:        time.Now(),
+		launch: launchSource{
+			kernel:    kernelPath,
+			rootfs:    rootfsPath,
+			initramfs: initramfsPath,
+			vmmBinary: cmd.Path,
+			vmmArgs:   cmd.Args,
+		},
 	}
-	log.Infof("Successfully created VM: %s", vmName)
+	log.WithField("vmId", vm.id).Infof("Successfully created VM: %s", vmName)
 
 	s.lock.Lock()
 	s.vms[vmName] = vm
+	s.vmIDs[vm.id] = vm
 	s.lock.Unlock()
 
 	cleanup.Release()
@@ -1036,12 +1064,8 @@ func (v *vm) boot(
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	resp, err := v.apiClient.DefaultAPI.BootVM(ctx).Execute()
-	if err != nil {
-		return fmt.Errorf("failed to boot VM resp.Body: %v: %w", resp.Body, err)
-	}
-	if resp.StatusCode != 204 {
-		return fmt.Errorf("failed to boot VM. bad status: %v", resp)
+	if err := v.vmm.Boot(ctx); err != nil {
+		return err
 	}
 
 	log.Infof("Successfully booted VM: %s", v.name)
@@ -1055,12 +1079,8 @@ func (v *vm) resume(
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	resp, err := v.apiClient.DefaultAPI.ResumeVM(ctx).Execute()
-	if err != nil {
-		return fmt.Errorf("failed to resume VM resp.Body: %v: %w", resp.Body, err)
-	}
-	if resp.StatusCode != 204 {
-		return fmt.Errorf("failed to resume VM. bad status: %v", resp)
+	if err := v.vmm.Resume(ctx); err != nil {
+		return err
 	}
 
 	log.Infof("Successfully resumed VM: %s", v.name)
@@ -1075,28 +1095,12 @@ func (v *vm) restore(
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	// The snapshot path is a "file://" URL.
-	req := v.apiClient.DefaultAPI.VmRestorePut(ctx)
-	req = req.RestoreConfig(chvapi.RestoreConfig{
-		SourceUrl: fmt.Sprintf("file://%s", snapshotPath),
-	})
-
-	resp, err := req.Execute()
-	if err != nil {
-		if resp != nil {
-			body, _ := io.ReadAll(resp.Body)
-			return fmt.Errorf("failed to restore from snapshot: %d: %s: %w", resp.StatusCode, string(body), err)
-		}
-		return fmt.Errorf("failed to restore from snapshot: %w", err)
-	}
-	if resp.StatusCode != 204 {
-		return fmt.Errorf("failed to restore from snapshot. bad status: %v", resp)
-	}
-	return nil
+	return v.vmm.Restore(ctx, snapshotPath)
 }
 
 func (v *vm) destroy(
 	ctx context.Context,
+	network hostnet.Backend,
 ) error {
 	v.lock.Lock()
 	defer v.lock.Unlock()
@@ -1105,45 +1109,31 @@ func (v *vm) destroy(
 
 	// Shutdown for a graceful exit before full deletion. Don't error out if this fails as we still
 	// want to try a deletion after this.
-	shutdownReq := v.apiClient.DefaultAPI.ShutdownVM(ctx)
-	resp, err := shutdownReq.Execute()
-	if err != nil {
+	if err := v.vmm.Shutdown(ctx); err != nil {
 		logger.Warnf("failed to shutdown VM before deleting: %v", err)
-	} else if resp.StatusCode >= 300 {
-		logger.Warnf("failed to shutdown VM before deleting. bad status: %v", resp)
-	}
-
-	deleteReq := v.apiClient.DefaultAPI.DeleteVM(ctx)
-	resp, err = deleteReq.Execute()
-	if err != nil {
-		return status.Error(codes.Internal, fmt.Sprintf("failed to delete VM: %v", err))
-	}
-
-	if resp.StatusCode >= 300 {
-		return status.Error(codes.Internal, fmt.Sprintf("failed to stop VM. bad status: %v", resp))
 	}
 
-	shutdownVMMReq := v.apiClient.DefaultAPI.ShutdownVMM(ctx)
-	resp, err = shutdownVMMReq.Execute()
-	if err != nil {
-		return status.Error(codes.Internal, fmt.Sprintf("failed to shutdown VMM: %v", err))
+	if err := v.vmm.Delete(ctx); err != nil {
+		return status.Error(codes.Internal, err.Error())
 	}
 
-	if resp.StatusCode >= 300 {
-		return status.Error(codes.Internal, fmt.Sprintf("failed to shutdown VMM. bad status: %v", resp))
+	// At this point `v.process` is guaranteed to be non-nil. The VMM of an
+	// adopted VM isn't our child and can't be waited for.
+	var err error
+	if v.launch.adopted {
+		err = adoption.Reap(v.process, reapVmTimeout)
+	} else {
+		err = reapProcess(v.process, logger, reapVmTimeout)
 	}
-
-	// At this point `v.process` is guaranteed to be non-nil.
-	err = reapProcess(v.process, logger, reapVmTimeout)
 	if err != nil {
 		logger.Warnf("failed to reap VM process: %v", err)
 	}
 
 	// This should be done at the very end in case we need to communicate with the VM during cleanup.
-	log.Infof("Deleting iptables rules for IP: %s", v.ip.String())
-	err = cleanupAllIPTablesRulesForIP(v.ip.IP.String())
+	log.Infof("Deleting port forwards for IP: %s", v.ip.String())
+	err = network.RemovePortForwards(v.ip.IP.String())
 	if err != nil {
-		logger.Warnf("failed to delete iptables rules: %v", err)
+		logger.Warnf("failed to delete port forwards: %v", err)
 	}
 
 	// Once deleted remove its directory and remove it from the internal store of VMs.
@@ -1160,12 +1150,8 @@ func (v *vm) pause(
 	v.lock.Lock()
 	defer v.lock.Unlock()
 
-	resp, err := v.apiClient.DefaultAPI.PauseVM(ctx).Execute()
-	if err != nil {
-		return fmt.Errorf("failed to pause VM resp.Body: %v: %w", resp.Body, err)
-	}
-	if resp.StatusCode != 204 {
-		return fmt.Errorf("failed to pause VM. bad status: %v", resp)
+	if err := v.vmm.Pause(ctx); err != nil {
+		return err
 	}
 
 	log.Infof("Successfully paused VM: %s", v.name)
@@ -1176,40 +1162,173 @@ func (v *vm) pause(
 type Server struct {
 	lock          sync.RWMutex
 	vms           map[string]*vm
+	vmIDs         map[string]*vm                    // vms by ID
+	boots         map[string]*bootprogress.Progress // VMs being created
+	deleted       map[string]*deletedVM             // VMs pending purge, by name
+	cordon        *hostCordon                       // nil unless new VMs are refused
+	transfers     map[string]bool                   // snapshot dirs of exports and imports in progress
+	vmRevisions   *listrevision.Tracker             // revisions of the VM listing
 	fountain      *fountain.Fountain
 	ipAllocator   *ipallocator.IPAllocator
 	portAllocator *portallocator.PortAllocator
 	cidAllocator  *cidallocator.CIDAllocator
+	network       hostnet.Backend
+	agent         *agentEndpoint
+	artifactStore artifactstore.Store   // nil unless artifact uploads are configured
+	admission     *admission.Controller // nil unless overcommit ratios are configured
+	scanner       scan.Scanner          // nil unless a scanner is configured
+	scans         scanCache
+	ocr           ocr.Engine // nil unless an OCR engine is configured
+	recordings    *recordings.Index
+	notifier      *notify.Notifier // nil unless notifications are configured
+	crashLoops    *notify.CrashLoops
+	autoscaler    *autoscale.Scaler
+	cpuSampler    autoscale.CPUSampler
+	tenants       *tenantpolicy.Set // policy bundles, by VM owner
+	audit         *audit.Log        // nil unless audit export is enabled
+	usage         *usage.Ledger
+	usageMeter    usageMeter
+	operations    *operations.Manager
+	snapshotting  atomic.Int32 // snapshots in progress
+	gcLock        sync.RWMutex // held for reading while a snapshot is in use
+	arch          string       // of the host, and so of every guest
+	hypervisors   map[string]hypervisor.Hypervisor
+	store         store.Store // metadata of VMs and snapshots
+	host          string      // recorded with VMs and snapshots in the store
 	config        config.ServerConfig
+
+	// hypervisorVersions caches the versions of the hypervisor binaries,
+	// by hypervisor.
+	hypervisorVersions sync.Map
 }
 
 func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
+	// An existing VM can be booted again by its ID.
+	vmName := s.ResolveVMName(req.GetVmName())
+	req.SetVmName(vmName)
+	if err := s.CheckCordon(vmName); err != nil {
+		return nil, err
+	}
+	if err := s.checkArch(req.GetArch()); err != nil {
+		return nil, err
+	}
+	if _, err := s.pickHypervisor(req.GetHypervisor()); err != nil {
+		return nil, err
+	}
+	if vmName != "" && s.getVMAtomic(vmName) == nil {
+		if err := s.applyTenantPolicy(req); err != nil {
+			return nil, err
+		}
+	}
+	if vmName != "" && s.admission != nil && s.getVMAtomic(vmName) == nil {
+		if err := s.admitVM(req); err != nil {
+			return nil, err
+		}
+		return s.startAdmittedVM(ctx, req)
+	}
+	return s.launchVM(ctx, req)
+}
+
+// launchVM creates, restores or boots a VM without checking admission, and
+// records the phases of its boot.
+func (s *Server) launchVM(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
 	vmName := req.GetVmName()
 	if vmName == "" {
 		return nil, fmt.Errorf("vmName is required")
 	}
+
+	progress := s.startBoot(vmName)
+	defer s.endBoot(vmName, progress)
+	resp, err := s.launch(bootprogress.NewContext(ctx, progress), req)
+	vm := s.getVMAtomic(vmName)
+	if err != nil {
+		progress.Fail(err)
+		owner := req.GetOwner()
+		if vm != nil {
+			vm.record(timeline.KindLifecycle, "start_failed", "VM failed to start", map[string]string{"error": err.Error()})
+			owner = vm.getOwner()
+		}
+		s.noteVMFailure(vmName, owner, err)
+		return nil, err
+	}
+	if vm != nil {
+		s.recordVM(ctx, vm)
+		if snapshotId := req.GetSnapshotId(); snapshotId != "" {
+			vm.record(timeline.KindLifecycle, "restored", "VM restored from snapshot "+snapshotId, map[string]string{"snapshotId": snapshotId})
+		} else {
+			vm.record(timeline.KindLifecycle, "started", "VM started", map[string]string{"hypervisor": vm.hypervisor.Name()})
+		}
+	}
+	if progress.Current() == bootprogress.PhaseAgentUp {
+		go s.watchBootServices(vmName, progress)
+	} else {
+		progress.Fail(fmt.Errorf("guest agent not ready"))
+	}
+	return resp, nil
+}
+
+func (s *Server) launch(ctx context.Context, req *serverapi.StartVMRequest) (*serverapi.StartVMResponse, error) {
+	vmName := req.GetVmName()
 	logger := log.WithField("vmName", vmName)
 
+	mounts, err := s.objectMounts(req.GetObjectMounts())
+	if err != nil {
+		return nil, err
+	}
+	kernelArgs, err := s.vmKernelArgs(req)
+	if err != nil {
+		return nil, err
+	}
+	egressPolicy, err := s.egressPolicy(req.Egress, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
 	if snapshotId := req.GetSnapshotId(); snapshotId != "" {
+		if len(req.GetKernelArgs()) > 0 {
+			return nil, status.Error(codes.InvalidArgument, "kernelArgs can't be changed when restoring a snapshot")
+		}
+		if len(req.GetDevices()) > 0 {
+			return nil, status.Error(codes.InvalidArgument, "devices can't be added when restoring a snapshot")
+		}
+		if err := s.checkSnapshotScan(snapshotId); err != nil {
+			return nil, err
+		}
+		if err := s.checkSnapshotArch(snapshotId); err != nil {
+			return nil, err
+		}
+		if err := s.checkSnapshotHypervisor(snapshotId, req.GetHypervisor()); err != nil {
+			return nil, err
+		}
 		logger.WithField("snapshotId", snapshotId).Infof("Restoring VM")
+		operations.SetProgress(ctx, "restoring snapshot")
 		vm, err := s.restoreVM(ctx, vmName, snapshotId)
 		if err != nil {
 			return nil, fmt.Errorf("failed to restore VM from snapshot: %w", err)
 		}
+		vm.setOwner(req.GetOwner())
+		vm.attributePortForwards(req.GetOwner())
+		if err := s.restrictEgress(vm, egressPolicy); err != nil {
+			return nil, err
+		}
+		// The restored kernel carries on where the snapshot left off.
+		bootprogress.FromContext(ctx).Reach(bootprogress.PhaseKernelBooted)
 
 		// Only mark the VM as ready when we can do things inside the sandbox via the API.
 		logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for cmd server to be ready")
-		if err := waitForCmdServerReady(ctx, vm.ip.IP.String()); err != nil {
+		if err := waitForCmdServerReady(ctx, s.agent, vm.ip.IP.String()); err != nil {
 			logger.WithError(err).Warnf("command server not ready")
 		}
 		logger.Infof("VM ready")
 
 		return &serverapi.StartVMResponse{
 			VmName:        serverapi.PtrString(vmName),
+			VmId:          serverapi.PtrString(vm.id),
 			Ip:            serverapi.PtrString(vm.ip.String()),
 			Status:        serverapi.PtrString(vm.status.String()),
 			TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
 			PortForwards:  convertPortForward(vm.portForwards),
+			ObjectMounts:  s.mountObjects(ctx, vm, mounts),
 		}, nil
 	}
 
@@ -1233,6 +1352,22 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 
 	vm := s.getVMAtomic(vmName)
 	if vm != nil {
+		if len(req.GetDevices()) > 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "vm %s already exists, attach devices to it once it runs instead", vmName)
+		}
+		if egressPolicy != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "vm %s already exists, restrict its egress once it runs instead", vmName)
+		}
+		if name := req.GetHypervisor(); name != "" && name != vm.hypervisor.Name() {
+			return nil, status.Errorf(codes.FailedPrecondition, "vm %s already exists on %s", vmName, vm.hypervisor.Name())
+		}
+		progress := bootprogress.FromContext(ctx)
+		vm.lock.Lock()
+		vm.bootProgress = progress
+		vm.lock.Unlock()
+		// The VMM and disk of an existing VM are already in place.
+		progress.Reach(bootprogress.PhaseVMMStarted)
+		progress.Reach(bootprogress.PhaseDiskPrepared)
 		err := vm.boot(ctx)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to boot existing VM: %v", err)
@@ -1246,25 +1381,41 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 			cleanup.Clean()
 		}()
 
-		var err error
-		vm, err = s.createVM(ctx, vmName, kernelPath, initramfsPath, rootfsPath, false)
+		h, err := s.pickHypervisor(req.GetHypervisor())
+		if err != nil {
+			return nil, err
+		}
+		operations.SetProgress(ctx, "creating VM")
+		vm, err = s.createVM(ctx, h, vmName, kernelPath, initramfsPath, rootfsPath, kernelArgs, false)
 		if err != nil {
 			logger.Errorf("failed to create VM: %v", err)
 			return nil, err
 		}
+		vm.setOwner(req.GetOwner())
+		vm.attributePortForwards(req.GetOwner())
 
 		cleanup.Add(func() {
 			logger.Info("shutting down VM")
-			resp, err := vm.apiClient.DefaultAPI.ShutdownVM(ctx).Execute()
-			if err != nil {
+			// Clean up even if the request, or operation, was cancelled.
+			if err := vm.vmm.Shutdown(context.WithoutCancel(ctx)); err != nil {
 				logger.WithError(err).Errorf("failed to shutdown VM: %v", err)
 			}
+		})
+
+		if err := s.restrictEgress(vm, egressPolicy); err != nil {
+			logger.WithError(err).Error("failed to restrict egress")
+			return nil, err
+		}
 
-			if resp.StatusCode != 204 {
-				logger.WithError(err).Errorf("failed to shutdown VM. bad status: %v", resp)
+		// Devices added before boot are cold-plugged.
+		for _, deviceReq := range req.GetDevices() {
+			if _, err := s.attachDevice(ctx, vm, deviceReq); err != nil {
+				logger.WithError(err).Error("failed to add device")
+				return nil, err
 			}
-		})
+		}
 
+		operations.SetProgress(ctx, "booting VM")
 		err = vm.boot(ctx)
 		if err != nil {
 			logger.Errorf("failed to boot VM: %v", err)
@@ -1275,7 +1426,8 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 
 	// Only mark the VM as ready when we can do things inside the sandbox via the API.
 	logger.WithField("vmIP", vm.ip.IP.String()).Infof("Waiting for cmd server to be ready")
-	err := waitForCmdServerReady(ctx, vm.ip.IP.String())
+	operations.SetProgress(ctx, "waiting for guest agent")
+	err = waitForCmdServerReady(ctx, s.agent, vm.ip.IP.String())
 	if err != nil {
 		logger.WithError(err).Warnf("command server not ready")
 	}
@@ -1283,15 +1435,17 @@ func (s *Server) StartVM(ctx context.Context, req *serverapi.StartVMRequest) (*s
 
 	return &serverapi.StartVMResponse{
 		VmName:        serverapi.PtrString(vmName),
+		VmId:          serverapi.PtrString(vm.id),
 		Ip:            serverapi.PtrString(vm.ip.String()),
 		Status:        serverapi.PtrString(vm.status.String()),
 		TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
 		PortForwards:  convertPortForward(vm.portForwards),
+		ObjectMounts:  s.mountObjects(ctx, vm, mounts),
 	}, nil
 }
 
 func (s *Server) StopVM(ctx context.Context, req *serverapi.VMRequest) (*serverapi.VMResponse, error) {
-	vmName := req.GetVmName()
+	vmName := s.ResolveVMName(req.GetVmName())
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to stop VM")
 
@@ -1300,23 +1454,28 @@ func (s *Server) StopVM(ctx context.Context, req *serverapi.VMRequest) (*servera
 		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
 	}
 
-	shutdown_req := vm.apiClient.DefaultAPI.ShutdownVM(ctx)
-	resp, err := shutdown_req.Execute()
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to stop VM: %v", err))
-	}
-
-	if resp.StatusCode != 200 && resp.StatusCode != 204 {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to stop VM. bad status: %v", resp))
+	s.uploadArtifacts(ctx, vm)
+	if err := vm.shutdown(ctx); err != nil {
+		return nil, err
 	}
-
-	vm.status = vmStatusStopped
+	s.recordVM(ctx, vm)
+	vm.record(timeline.KindLifecycle, "stopped", "VM stopped", nil)
 	logger.Infof("VM stopped")
 	return &serverapi.VMResponse{
 		Success: serverapi.PtrBool(true),
 	}, nil
 }
 
+// shutdown powers off the VM and marks it stopped.
+func (v *vm) shutdown(ctx context.Context) error {
+	if err := v.vmm.Shutdown(ctx); err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("failed to stop VM: %v", err))
+	}
+
+	v.status = vmStatusStopped
+	return nil
+}
+
 func (s *Server) destroyVM(ctx context.Context, vmName string) error {
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to destroy VM")
@@ -1325,7 +1484,10 @@ func (s *Server) destroyVM(ctx context.Context, vmName string) error {
 		return fmt.Errorf("vm %s not found", vmName)
 	}
 
-	err := vm.destroy(ctx)
+	s.uploadArtifacts(ctx, vm)
+	// Account for the VM's usage up to now while its tap device still exists.
+	s.sampleUsage(ctx, vm, time.Now())
+	err := vm.destroy(ctx, s.network)
 	if err != nil {
 		return fmt.Errorf("failed to destroy vm: %s: %w", vmName, err)
 	}
@@ -1334,6 +1496,9 @@ func (s *Server) destroyVM(ctx context.Context, vmName string) error {
 	if err != nil {
 		return fmt.Errorf("failed to destroy the tap device for vm: %s: %w", vmName, err)
 	}
+	s.releaseDevices(vm)
+	s.releaseEgress(vm)
+	s.scans.forget(vm.id)
 
 	err = s.ipAllocator.FreeIP(vm.ip.IP)
 	if err != nil {
@@ -1347,13 +1512,31 @@ func (s *Server) destroyVM(ctx context.Context, vmName string) error {
 
 	s.lock.Lock()
 	delete(s.vms, vmName)
+	delete(s.vmIDs, vm.id)
 	s.lock.Unlock()
+	s.forgetVM(ctx, vm.id)
+	s.crashLoops.Forget(vmName)
+
+	if s.admission != nil {
+		s.admission.Release(vmName)
+	}
 	return nil
 }
 
 func (s *Server) DestroyVM(ctx context.Context, req *serverapi.VMRequest) (*serverapi.VMResponse, error) {
-	vmName := req.GetVmName()
-	err := s.destroyVM(ctx, vmName)
+	vmName := s.ResolveVMName(req.GetVmName())
+	if s.cancelQueuedVM(vmName) {
+		log.WithField("vmName", vmName).Infof("removed VM from the queue")
+		return &serverapi.VMResponse{
+			Success: serverapi.PtrBool(true),
+		}, nil
+	}
+	var err error
+	if s.config.SoftDelete.Retention > 0 {
+		err = s.softDeleteVM(ctx, vmName)
+	} else {
+		err = s.destroyVM(ctx, vmName)
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to destroy vm: %s: %v", vmName, err)
 	}
@@ -1396,7 +1579,16 @@ func (s *Server) DestroyAllVMs(ctx context.Context) (*serverapi.DestroyAllVMsRes
 }
 
 func (s *Server) ListAllVMs(ctx context.Context) (*serverapi.ListAllVMsResponse, error) {
-	resp := &serverapi.ListAllVMsResponse{}
+	vms := s.listVMs()
+	revision := s.vmRevisions.Update(vmListing(vms))
+	return &serverapi.ListAllVMsResponse{
+		Vms:      vms,
+		Revision: serverapi.PtrString(strconv.FormatUint(revision, 10)),
+	}, nil
+}
+
+// listVMs lists the VMs and those pending purge, ordered by ID.
+func (s *Server) listVMs() []serverapi.ListAllVMsResponseVmsInner {
 	var vms []serverapi.ListAllVMsResponseVmsInner
 
 	s.lock.RLock()
@@ -1410,6 +1602,8 @@ func (s *Server) ListAllVMs(ctx context.Context) (*serverapi.ListAllVMsResponse,
 
 		vmInfo := serverapi.ListAllVMsResponseVmsInner{
 			VmName:        serverapi.PtrString(vm.name),
+			VmId:          serverapi.PtrString(vm.id),
+			Owner:         serverapi.PtrString(vm.owner),
 			Ip:            serverapi.PtrString(ipString),
 			Status:        serverapi.PtrString(vm.status.String()),
 			TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
@@ -1417,13 +1611,41 @@ func (s *Server) ListAllVMs(ctx context.Context) (*serverapi.ListAllVMsResponse,
 		}
 		vms = append(vms, vmInfo)
 	}
-	resp.Vms = vms
-	return resp, nil
+	for _, deleted := range s.deleted {
+		vms = append(vms, serverapi.ListAllVMsResponseVmsInner{
+			VmName:  serverapi.PtrString(deleted.Name),
+			VmId:    serverapi.PtrString(deleted.ID),
+			Owner:   serverapi.PtrString(deleted.Owner),
+			Status:  serverapi.PtrString(vmStatusDeletedPendingPurge),
+			PurgeAt: serverapi.PtrTime(deleted.PurgeAt),
+		})
+	}
+	// A stable order keeps the listing, and its ETag, the same while nothing
+	// changes.
+	sort.Slice(vms, func(i, j int) bool { return vms[i].GetVmId() < vms[j].GetVmId() })
+	return vms
 }
 
 func (s *Server) ListVM(ctx context.Context, vmName string) (*serverapi.ListVMResponse, error) {
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
+		if position, queued := s.queuePosition(vmName); queued {
+			return &serverapi.ListVMResponse{
+				VmName:        serverapi.PtrString(vmName),
+				Status:        serverapi.PtrString(queueStatusQueued),
+				QueuePosition: serverapi.PtrInt32(int32(position)),
+			}, nil
+		}
+		if progress := s.bootProgress(vmName); progress != nil {
+			return &serverapi.ListVMResponse{
+				VmName: serverapi.PtrString(vmName),
+				Status: serverapi.PtrString(bootStatusCreating),
+				Boot:   convertBootProgress(progress),
+			}, nil
+		}
+		if deleted := s.deletedVMStatus(vmName); deleted != nil {
+			return deleted, nil
+		}
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
@@ -1434,14 +1656,37 @@ func (s *Server) ListVM(ctx context.Context, vmName string) (*serverapi.ListVMRe
 
 	return &serverapi.ListVMResponse{
 		VmName:        serverapi.PtrString(vm.name),
+		VmId:          serverapi.PtrString(vm.id),
+		Owner:         serverapi.PtrString(vm.owner),
 		Ip:            serverapi.PtrString(ipString),
 		Status:        serverapi.PtrString(vm.status.String()),
 		TapDeviceName: serverapi.PtrString(vm.tapDevice.Name),
 		PortForwards:  convertPortForward(vm.portForwards),
+		Boot:          convertBootProgress(s.bootProgress(vmName)),
 	}, nil
 }
 
+// SnapshotVM snapshots a VM, then scans the snapshot's stateful disk if
+// snapshots are scanned. The VM is resumed before the scan.
 func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId string) (*serverapi.VMSnapshotResponse, error) {
+	s.snapshotting.Add(1)
+	defer s.snapshotting.Add(-1)
+	resp, err := s.snapshotVM(ctx, vmName, snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	details := map[string]string{"snapshotId": snapshotId}
+	if result := s.scanSnapshot(ctx, snapshotId); result != nil {
+		resp.Scan = convertScanResult(*result)
+		details["scanVerdict"] = result.Verdict
+	}
+	if vm := s.getVMAtomic(vmName); vm != nil {
+		vm.record(timeline.KindSnapshot, "created", "Snapshot "+snapshotId+" created", details)
+	}
+	return resp, nil
+}
+
+func (s *Server) snapshotVM(ctx context.Context, vmName string, snapshotId string) (*serverapi.VMSnapshotResponse, error) {
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to snapshot VM with ID: %s", snapshotId)
 
@@ -1449,7 +1694,12 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
+	if reason := vm.snapshotBlocker(); reason != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "can't snapshot vm %s: %s", vmName, reason)
+	}
 
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
 	snapshotsDir := path.Join(s.config.StateDir, "snapshots")
 	outputDir := path.Join(snapshotsDir, snapshotId)
 	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
@@ -1471,30 +1721,20 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 		cleanup.Clean()
 	}()
 
-	// Pause the VM first as this is a prerequisite for taking a snapshot as per the CHV API spec.
-	pauseReq := vm.apiClient.DefaultAPI.PauseVM(ctx)
-	resp, err := pauseReq.Execute()
-	if err != nil {
-		return nil, fmt.Errorf("failed to pause VM: %w", err)
-	}
-	if resp.StatusCode != 204 {
-		return nil, fmt.Errorf("failed to pause VM. bad status: %v", resp)
+	// Pause the VM first as this is a prerequisite for taking a snapshot with every hypervisor.
+	operations.SetProgress(ctx, "pausing VM")
+	if err := vm.vmm.Pause(ctx); err != nil {
+		return nil, err
 	}
 	logger.Info("VM paused successfully")
 	vm.status = vmStatusPaused
 
-	// Ensure we resume the VM even if snapshot fails.
+	// Ensure we resume the VM even if snapshot fails or is cancelled.
 	defer func() {
-		resumeReq := vm.apiClient.DefaultAPI.ResumeVM(ctx)
-		resp, err := resumeReq.Execute()
-		if err != nil {
+		if err := vm.vmm.Resume(context.WithoutCancel(ctx)); err != nil {
 			logger.Errorf("failed to resume VM: %v", err)
 			return
 		}
-		if resp.StatusCode != 204 {
-			logger.Errorf("failed to resume VM. bad status: %v", resp)
-			return
-		}
 		logger.Info("VM resumed successfully")
 		vm.status = vmStatusRunning
 	}()
@@ -1505,7 +1745,10 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 		"source":      vm.statefulDiskPath,
 		"destination": statefulDiskDest,
 	}).Info("copying stateful disk to snapshot directory")
-	err = copyFile(vm.statefulDiskPath, statefulDiskDest)
+	operations.SetProgress(ctx, "copying stateful disk")
+	diskDone := reqtrace.Start(ctx, reqtrace.PhaseDiskCopy)
+	err := copyFile(vm.statefulDiskPath, statefulDiskDest)
+	diskDone()
 	if err != nil {
 		logger.WithError(err).Error("failed to copy stateful disk")
 		return nil, fmt.Errorf("failed to copy stateful disk to snapshot directory: %w", err)
@@ -1523,34 +1766,28 @@ func (s *Server) SnapshotVM(ctx context.Context, vmName string, snapshotId strin
 		logger.WithError(err).Error("failed to write CID to file")
 		return nil, fmt.Errorf("failed to write CID to file: %w", err)
 	}
-
-	// The API expects a "file://" URL.
-	outputUrl := fmt.Sprintf("file://%s", outputDir)
-	snapshotConfig := chvapi.VmSnapshotConfig{
-		DestinationUrl: &outputUrl,
+	if err := os.WriteFile(path.Join(outputDir, vmIDFilename), []byte(vm.id), 0644); err != nil {
+		logger.WithError(err).Error("failed to write VM ID to file")
+		return nil, fmt.Errorf("failed to write VM ID to file: %w", err)
 	}
-	logger.WithField("destination", outputDir).Info("initiating VM snapshot")
-
-	snapshotReq := vm.apiClient.DefaultAPI.VmSnapshotPut(ctx)
-	snapshotReq = snapshotReq.VmSnapshotConfig(snapshotConfig)
-	resp, err = snapshotReq.Execute()
-	if err != nil {
-		if resp != nil {
-			body, _ := io.ReadAll(resp.Body)
-			return nil, fmt.Errorf("failed to create snapshot: %d: %s: %w", resp.StatusCode, string(body), err)
-		}
-		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+	if err := os.WriteFile(path.Join(outputDir, archFilename), []byte(s.arch), 0644); err != nil {
+		logger.WithError(err).Error("failed to write architecture to file")
+		return nil, fmt.Errorf("failed to write architecture to file: %w", err)
+	}
+	if err := os.WriteFile(path.Join(outputDir, hypervisorFilename), []byte(vm.hypervisor.Name()), 0644); err != nil {
+		logger.WithError(err).Error("failed to write hypervisor to file")
+		return nil, fmt.Errorf("failed to write hypervisor to file: %w", err)
 	}
-	if resp.StatusCode != 204 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to create snapshot: %d: %s", resp.StatusCode, string(body))
+
+	logger.WithField("destination", outputDir).Info("initiating VM snapshot")
+	operations.SetProgress(ctx, "snapshotting VM")
+	if err := vm.vmm.Snapshot(ctx, outputDir); err != nil {
+		return nil, err
 	}
 
 	cleanup.Release()
-	logger.WithFields(log.Fields{
-		"destination": outputDir,
-		"statusCode":  resp.StatusCode,
-	}).Info("VM snapshot created successfully")
+	s.recordSnapshot(ctx, snapshotId, vm)
+	logger.WithField("destination", outputDir).Info("VM snapshot created successfully")
 	return &serverapi.VMSnapshotResponse{
 		SnapshotId: serverapi.PtrString(snapshotId),
 	}, nil
@@ -1561,6 +1798,9 @@ func (s *Server) restoreVM(
 	vmName string,
 	snapshotId string,
 ) (*vm, error) {
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+
 	// Construct the snapshot path from the snapshot ID
 	snapshotPath := path.Join(s.config.StateDir, "snapshots", snapshotId)
 
@@ -1581,10 +1821,18 @@ func (s *Server) restoreVM(
 		cleanup.Clean()
 	}()
 
-	oldtapdeviceName, guestIP, err := parseNetworkDataFromSnapshotConfig(snapshotPath + "/config.json")
+	h, err := s.snapshotHypervisor(snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	oldtapdeviceName, cmdline, err := h.SnapshotNetwork(snapshotPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tap device from config: %w", err)
 	}
+	guestIP, err := extractGuestIPFromCmdline(cmdline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract guest IP from cmdline: %w", err)
+	}
 	oldTapDeviceID, err := parseTapDeviceId(oldtapdeviceName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse tap device ID: %w", err)
@@ -1599,7 +1847,9 @@ func (s *Server) restoreVM(
 		return nil, fmt.Errorf("failed to claim IP: %w", err)
 	}
 
+	networkDone := reqtrace.Start(ctx, reqtrace.PhaseNetwork)
 	oldTapDevice, err := s.fountain.CreateTapDevice(&oldTapDeviceID)
+	networkDone()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create tap device: %w", err)
 	}
@@ -1607,40 +1857,51 @@ func (s *Server) restoreVM(
 		logger.Errorf("TODO: destroy tap device: %s", oldTapDevice.Name)
 	})
 
-	vm, err := s.createVM(ctx, vmName, "", "", "", true)
+	vm, err := s.createVM(ctx, h, vmName, "", "", "", nil, true)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create VM for restore: %w", err)
 	}
 	// From this point on we need to clean up the VM if the restore fails.
 	cleanup.Add(func() {
-		err := s.destroyVM(ctx, vmName)
+		err := s.destroyVM(context.WithoutCancel(ctx), vmName)
 		logger.WithError(err).Errorf("failed to destroy VM during restore cleanup")
 	})
 	vm.tapDevice = oldTapDevice
 	vm.ip = guestIP
+	vm.launch.snapshotID = snapshotId
 
 	// Copy the stateful disk from the snapshot to the VM state directory.
 	sourcePath := path.Join(snapshotPath, statefulDiskFilename)
-	destPath := path.Join(vm.stateDirPath, statefulDiskFilename)
+	destPath := workdir.Layout{Root: vm.stateDirPath}.Disk(statefulDiskFilename)
 	logger.WithFields(log.Fields{
 		"source":      sourcePath,
 		"destination": destPath,
 	}).Info("copying stateful disk from snapshot")
+	diskDone := reqtrace.Start(ctx, reqtrace.PhaseDiskCopy)
 	err = copyFile(sourcePath, destPath)
+	diskDone()
 	if err != nil {
 		logger.WithError(err).Error("failed to copy stateful disk from snapshot")
 		return nil, fmt.Errorf("failed to copy stateful disk from snapshot: %w", err)
 	}
 	logger.Info("successfully copied stateful disk from snapshot")
+	// Snapshots taken before the working directory layout look for the disk
+	// at the root of the VM's directory.
+	if err := os.Symlink(path.Join(workdir.Disks, statefulDiskFilename), path.Join(vm.stateDirPath, statefulDiskFilename)); err != nil {
+		logger.WithError(err).Warn("failed to link the stateful disk where older snapshots expect it")
+	}
+	bootprogress.FromContext(ctx).Reach(bootprogress.PhaseDiskPrepared)
 
+	networkDone = reqtrace.Start(ctx, reqtrace.PhaseNetwork)
 	portForwards, err := s.setupPortForwardsToVM(guestIP.IP.String(), s.config.PortForwards)
+	networkDone()
 	if err != nil {
-		cleanupAllIPTablesRulesForIP(guestIP.IP.String())
+		s.network.RemovePortForwards(guestIP.IP.String())
 		return nil, fmt.Errorf("failed to forward ports to VM: %w", err)
 	}
 	cleanup.Add(func() {
 		logger.WithField("ip", guestIP.String()).Info("deleting port forwards")
-		cleanupAllIPTablesRulesForIP(guestIP.IP.String())
+		s.network.RemovePortForwards(guestIP.IP.String())
 	})
 	vm.portForwards = portForwards
 
@@ -1682,7 +1943,7 @@ func (s *Server) restoreVM(
 }
 
 func (s *Server) PauseVM(ctx context.Context, req *serverapi.VMRequest) (*serverapi.VMResponse, error) {
-	vmName := req.GetVmName()
+	vmName := s.ResolveVMName(req.GetVmName())
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to pause VM")
 
@@ -1695,6 +1956,8 @@ func (s *Server) PauseVM(ctx context.Context, req *serverapi.VMRequest) (*server
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to pause VM: %v", err))
 	}
+	s.recordVM(ctx, vm)
+	vm.record(timeline.KindLifecycle, "paused", "VM paused", nil)
 
 	return &serverapi.VMResponse{
 		Success: serverapi.PtrBool(true),
@@ -1702,7 +1965,7 @@ func (s *Server) PauseVM(ctx context.Context, req *serverapi.VMRequest) (*server
 }
 
 func (s *Server) ResumeVM(ctx context.Context, req *serverapi.VMRequest) (*serverapi.VMResponse, error) {
-	vmName := req.GetVmName()
+	vmName := s.ResolveVMName(req.GetVmName())
 	logger := log.WithField("vmName", vmName)
 	logger.Infof("received request to resume VM")
 
@@ -1717,24 +1980,27 @@ func (s *Server) ResumeVM(ctx context.Context, req *serverapi.VMRequest) (*serve
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to resume VM: %v", err))
 	}
+	s.recordVM(ctx, vm)
+	vm.record(timeline.KindLifecycle, "resumed", "VM resumed", nil)
 
 	return &serverapi.VMResponse{
 		Success: serverapi.PtrBool(true),
 	}, nil
 }
 
-func (s *Server) VMCommand(ctx context.Context, vmName string, cmd string, blocking bool) (*serverapi.VmCommandResponse, error) {
+// VMCommand runs cmd in the VM, its processes bounded by limits.
+func (s *Server) VMCommand(ctx context.Context, vmName string, cmd string, blocking bool, limits cmdserver.ExecLimits) (*serverapi.VmCommandResponse, error) {
 	vm := s.getVMAtomic(vmName)
 	if vm == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
-	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	url := s.agent.url(vm.ip.IP.String(), "")
+	client := s.agent.client(30 * time.Second)
 
-	return vm.handleRun(ctx, client, url, cmd, blocking)
+	resp, err := vm.handleRun(ctx, client, url, cmd, blocking, limits)
+	vm.recordCommand(cmd, blocking, resp, err)
+	return resp, err
 }
 
 func (s *Server) VMFileUpload(ctx context.Context, vmName string, files []serverapi.VmFileUploadRequestFilesInner) (*serverapi.VmFileUploadResponse, error) {
@@ -1743,11 +2009,14 @@ func (s *Server) VMFileUpload(ctx context.Context, vmName string, files []server
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
-	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	scans, err := s.scanUploads(ctx, vmName, files)
+	if err != nil {
+		return nil, err
 	}
 
+	url := s.agent.url(vm.ip.IP.String(), "")
+	client := s.agent.client(30 * time.Second)
+
 	reqBody := cmdserver.FilesPostRequest{
 		Files: make([]cmdserver.FilePostData, len(files)),
 	}
@@ -1780,16 +2049,14 @@ func (s *Server) VMFileUpload(ctx context.Context, vmName string, files []server
 		return nil, status.Errorf(codes.Internal, "request failed with status: %d", resp.StatusCode)
 	}
 
-	return &serverapi.VmFileUploadResponse{}, nil
+	return &serverapi.VmFileUploadResponse{Scans: scans}, nil
 }
 
-func (v *vm) handleRun(ctx context.Context, client *http.Client, baseURL string, cmd string, blocking bool) (*serverapi.VmCommandResponse, error) {
-	reqBody := struct {
-		Cmd      string `json:"cmd"`
-		Blocking bool   `json:"blocking"`
-	}{
+func (v *vm) handleRun(ctx context.Context, client *http.Client, baseURL string, cmd string, blocking bool, limits cmdserver.ExecLimits) (*serverapi.VmCommandResponse, error) {
+	reqBody := cmdserver.RunCmdRequest{
 		Cmd:      cmd,
 		Blocking: blocking,
+		Limits:   limits,
 	}
 
 	body, err := json.Marshal(reqBody)
@@ -1809,6 +2076,11 @@ func (v *vm) handleRun(ctx context.Context, client *http.Client, baseURL string,
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusBadRequest && !limits.IsZero() {
+		// E.g. limits the guest can't enforce.
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, status.Errorf(codes.InvalidArgument, "guest refused the command: %s", strings.TrimSpace(string(msg)))
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("request failed with status: %d", resp.StatusCode)
 	}
@@ -1818,10 +2090,18 @@ func (v *vm) handleRun(ctx context.Context, client *http.Client, baseURL string,
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	return &serverapi.VmCommandResponse{
+	apiResp := &serverapi.VmCommandResponse{
 		Output: serverapi.PtrString(cmdResp.Output),
 		Error:  serverapi.PtrString(cmdResp.Error),
-	}, nil
+	}
+	if e := cmdResp.LimitExceeded; e != nil {
+		apiResp.LimitExceeded = &serverapi.VmExecLimitExceeded{
+			Limit:   serverapi.PtrString(e.Limit),
+			Value:   serverapi.PtrInt64(e.Value),
+			Message: serverapi.PtrString(e.Message),
+		}
+	}
+	return apiResp, nil
 }
 
 func (s *Server) VMFileDownload(ctx context.Context, vmName string, paths string) (*serverapi.VmFileDownloadResponse, error) {
@@ -1830,10 +2110,8 @@ func (s *Server) VMFileDownload(ctx context.Context, vmName string, paths string
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
 	}
 
-	url := fmt.Sprintf("http://%s:4031", vm.ip.IP.String())
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	url := s.agent.url(vm.ip.IP.String(), "")
+	client := s.agent.client(30 * time.Second)
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url+"/files?paths="+paths, nil)
 	if err != nil {
@@ -1865,6 +2143,7 @@ func (s *Server) VMFileDownload(ctx context.Context, vmName string, paths string
 			Error:   serverapi.PtrString(file.Error),
 		}
 	}
+	vm.record(timeline.KindDownload, "files", fmt.Sprintf("Downloaded %d files", len(cmdResp.Files)), map[string]string{"paths": paths})
 	return apiResp, nil
 }
 
@@ -1890,14 +2169,13 @@ func parseTapDeviceId(tapDeviceName string) (int32, error) {
 
 // waitForCmdServerReady checks if the command server in the guest VM is ready by sending a GET
 // request to it. Returns nil if the command server is ready, or an error if the timeout is reached.
-func waitForCmdServerReady(ctx context.Context, vmIP string) error {
+func waitForCmdServerReady(ctx context.Context, agent *agentEndpoint, vmIP string) error {
 	ctx, cancel := context.WithTimeout(ctx, cmdServerReadyTimeout)
 	defer cancel()
 
-	cmdServerURL := fmt.Sprintf("http://%s:4031/", vmIP)
-	client := &http.Client{
-		Timeout: 5 * time.Second, // Short timeout for individual requests
-	}
+	cmdServerURL := agent.url(vmIP, "/")
+	client := agent.client(5 * time.Second) // Short timeout for individual requests
+	progress := bootprogress.FromContext(ctx)
 
 	errCh := make(chan error, 1)
 	go func() {
@@ -1910,9 +2188,16 @@ func waitForCmdServerReady(ctx context.Context, vmIP string) error {
 				resp, err := client.Get(cmdServerURL)
 				if err == nil && resp.StatusCode == http.StatusOK {
 					resp.Body.Close()
+					progress.Reach(bootprogress.PhaseKernelBooted)
+					progress.Reach(bootprogress.PhaseAgentUp)
 					errCh <- nil
 					return
 				}
+				// A refused connection means the guest's network stack is
+				// up, just not the agent yet.
+				if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+					progress.Reach(bootprogress.PhaseKernelBooted)
+				}
 				if resp != nil {
 					resp.Body.Close()
 				}
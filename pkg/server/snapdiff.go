@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/snapdiff"
+)
+
+const (
+	// vmIDFilename records the ID of the snapshotted VM in a snapshot.
+	vmIDFilename = "vm_id"
+	// statefulDiskUpperDir is the overlay's upper layer in the stateful
+	// disk, as initramfs/init.sh sets it up.
+	statefulDiskUpperDir = "upper"
+	// maxSnapshotDiffChanges bounds the changes a diff reports.
+	maxSnapshotDiffChanges = 10000
+)
+
+// validateSnapshotID rejects IDs that can't be used as a snapshot directory.
+func validateSnapshotID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/\x00") {
+		return status.Errorf(codes.InvalidArgument, "invalid snapshot id: %q", id)
+	}
+	return nil
+}
+
+// SnapshotDiff lists the files that changed in the guest from the snapshot
+// baseID to snapshotID, e.g. to audit what an agent modified. The writable
+// layers of both are mounted read-only on the host and compared. Unless
+// tenant is "", snapshots not recorded as the tenant's aren't found.
+func (s *Server) SnapshotDiff(ctx context.Context, snapshotID string, baseID string, tenant string) (*serverapi.SnapshotDiffResponse, error) {
+	if baseID == "" {
+		return nil, status.Error(codes.InvalidArgument, "base snapshot is required")
+	}
+	for _, id := range []string{snapshotID, baseID} {
+		if err := validateSnapshotID(id); err != nil {
+			return nil, err
+		}
+		if tenant == "" {
+			continue
+		}
+		if owner, ok := s.snapshotOwner(ctx, id); !ok || owner != tenant {
+			return nil, status.Errorf(codes.NotFound, "snapshot not found: %s", id)
+		}
+	}
+	logger := log.WithFields(log.Fields{"snapshotId": snapshotID, "base": baseID})
+
+	// Keep both snapshots from being reclaimed while they are mounted.
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+
+	snapshotsDir := path.Join(s.config.StateDir, "snapshots")
+	var vmIDs []string
+	for _, id := range []string{snapshotID, baseID} {
+		if _, err := os.Stat(path.Join(snapshotsDir, id, statefulDiskFilename)); err != nil {
+			return nil, status.Errorf(codes.NotFound, "snapshot not found: %s", id)
+		}
+		vmID, _ := os.ReadFile(path.Join(snapshotsDir, id, vmIDFilename))
+		vmIDs = append(vmIDs, string(vmID))
+	}
+
+	resp := &serverapi.SnapshotDiffResponse{
+		SnapshotId: serverapi.PtrString(snapshotID),
+		Base:       serverapi.PtrString(baseID),
+	}
+	switch {
+	case vmIDs[0] != "" && vmIDs[1] != "" && vmIDs[0] != vmIDs[1]:
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshots %s and %s are of different VMs", snapshotID, baseID)
+	case vmIDs[0] == "" || vmIDs[1] == "":
+		resp.Warnings = append(resp.Warnings, "snapshots taken before VM IDs were recorded can't be checked to be of the same VM")
+	default:
+		resp.VmId = serverapi.PtrString(vmIDs[0])
+	}
+
+	workDir, err := os.MkdirTemp("", "arrakis-snapdiff-")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create mount points: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	var layers []string
+	for i, id := range []string{baseID, snapshotID} {
+		mountPoint := path.Join(workDir, fmt.Sprint(i))
+		if err := mountStatefulDisk(path.Join(snapshotsDir, id, statefulDiskFilename), mountPoint); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to mount snapshot %s: %v", id, err)
+		}
+		defer unmountStatefulDisk(mountPoint)
+
+		layer := path.Join(mountPoint, statefulDiskUpperDir)
+		if _, err := os.Stat(layer); os.IsNotExist(err) {
+			// The guest never set up its overlay, nothing was written.
+			layer = path.Join(workDir, "empty")
+			if err := os.MkdirAll(layer, 0755); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to create empty layer: %v", err)
+			}
+		}
+		layers = append(layers, layer)
+	}
+
+	changes, err := snapdiff.Diff(layers[0], layers[1])
+	if err != nil {
+		logger.WithError(err).Error("Failed to diff snapshots")
+		return nil, status.Errorf(codes.Internal, "failed to diff snapshots: %v", err)
+	}
+	resp.Total = serverapi.PtrInt32(int32(len(changes)))
+	if len(changes) > maxSnapshotDiffChanges {
+		changes = changes[:maxSnapshotDiffChanges]
+		resp.Truncated = serverapi.PtrBool(true)
+	}
+	resp.Changes = make([]serverapi.SnapshotChange, 0, len(changes))
+	for _, c := range changes {
+		change := serverapi.SnapshotChange{
+			Path: serverapi.PtrString(c.Path),
+			Kind: serverapi.PtrString(c.Kind),
+			Type: serverapi.PtrString(c.Type),
+		}
+		if c.Type == snapdiff.TypeFile && c.Kind != snapdiff.KindDeleted {
+			change.Size = serverapi.PtrInt64(c.Size)
+		}
+		resp.Changes = append(resp.Changes, change)
+	}
+	logger.WithField("changes", len(changes)).Info("Diffed snapshots")
+	return resp, nil
+}
+
+// mountStatefulDisk mounts a copy of a stateful disk read-only. The journal
+// isn't replayed since the copy is taken while the guest has it mounted.
+func mountStatefulDisk(image string, mountPoint string) error {
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return err
+	}
+	cmd := exec.Command("mount", "-t", "ext4", "-o", "ro,loop,noload,nodev,nosuid,noexec", image, mountPoint)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w out: %s", err, string(out))
+	}
+	return nil
+}
+
+func unmountStatefulDisk(mountPoint string) {
+	if out, err := exec.Command("umount", mountPoint).CombinedOutput(); err != nil {
+		log.WithError(err).Errorf("failed to unmount %s: %s", mountPoint, string(out))
+	}
+}
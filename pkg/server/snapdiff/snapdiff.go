@@ -0,0 +1,197 @@
+// Package snapdiff compares the writable layers of two snapshots of a VM,
+// to audit what changed in the guest between them. Guests run on an overlay
+// of the read-only rootfs, so their writable layer holds exactly the files
+// they created, changed or deleted.
+package snapdiff
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// Kinds of changes.
+const (
+	KindAdded    = "added"
+	KindModified = "modified"
+	KindDeleted  = "deleted"
+)
+
+// Types of entries.
+const (
+	TypeFile    = "file"
+	TypeDir     = "dir"
+	TypeSymlink = "symlink"
+	TypeOther   = "other"
+	// typeWhiteout is how an overlay's upper layer records the deletion of
+	// a file of the lower layer: a character device numbered 0/0.
+	typeWhiteout = "whiteout"
+)
+
+// Entry is a file of a writable layer.
+type Entry struct {
+	Type string
+	Size int64
+	Mode fs.FileMode
+	// Target is the target of a symlink.
+	Target string
+}
+
+// Change is a difference between two layers, as seen from the guest.
+type Change struct {
+	// Path is the path in the guest, e.g. "/etc/hosts".
+	Path string
+	Kind string
+	// Type is the type of the file after the change, or before it for
+	// deletions.
+	Type string
+	// Size is the size of regular files after the change.
+	Size int64
+}
+
+// Scan lists the entries of the layer at root by their path in the guest.
+func Scan(root string) (map[string]Entry, error) {
+	entries := make(map[string]Entry)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		entry := Entry{Type: entryType(info), Mode: info.Mode().Perm()}
+		switch entry.Type {
+		case TypeFile:
+			entry.Size = info.Size()
+		case TypeSymlink:
+			if entry.Target, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		entries["/"+filepath.ToSlash(rel)] = entry
+		return nil
+	})
+	return entries, err
+}
+
+func entryType(info fs.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode.IsRegular():
+		return TypeFile
+	case mode.IsDir():
+		return TypeDir
+	case mode&fs.ModeSymlink != 0:
+		return TypeSymlink
+	case mode&fs.ModeCharDevice != 0:
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Rdev == 0 {
+			return typeWhiteout
+		}
+	}
+	return TypeOther
+}
+
+// Diff returns the changes from the layer at baseRoot to the one at
+// targetRoot, sorted by path. Files in both layers are compared by type,
+// permissions and content.
+func Diff(baseRoot string, targetRoot string) ([]Change, error) {
+	base, err := Scan(baseRoot)
+	if err != nil {
+		return nil, err
+	}
+	target, err := Scan(targetRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for p, t := range target {
+		b, inBase := base[p]
+		switch {
+		case t.Type == typeWhiteout:
+			if inBase && b.Type != typeWhiteout {
+				changes = append(changes, Change{Path: p, Kind: KindDeleted, Type: b.Type})
+			} else if !inBase {
+				// Deleted from the rootfs, whose type the layer doesn't say.
+				changes = append(changes, Change{Path: p, Kind: KindDeleted, Type: TypeOther})
+			}
+		case !inBase || b.Type == typeWhiteout:
+			changes = append(changes, Change{Path: p, Kind: KindAdded, Type: t.Type, Size: t.Size})
+		default:
+			same, err := sameEntry(filepath.Join(baseRoot, p), b, filepath.Join(targetRoot, p), t)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				changes = append(changes, Change{Path: p, Kind: KindModified, Type: t.Type, Size: t.Size})
+			}
+		}
+	}
+	// Files of the base layer missing from the target one were created
+	// after the rootfs and have since been deleted.
+	for p, b := range base {
+		if _, inTarget := target[p]; !inTarget && b.Type != typeWhiteout {
+			changes = append(changes, Change{Path: p, Kind: KindDeleted, Type: b.Type})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+func sameEntry(basePath string, b Entry, targetPath string, t Entry) (bool, error) {
+	if b.Type != t.Type || b.Mode != t.Mode || b.Size != t.Size || b.Target != t.Target {
+		return false, nil
+	}
+	if t.Type != TypeFile {
+		return true, nil
+	}
+	return sameContent(basePath, targetPath)
+}
+
+// sameContent compares two files of the same size.
+func sameContent(a string, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		doneA := errors.Is(errA, io.EOF) || errors.Is(errA, io.ErrUnexpectedEOF)
+		doneB := errors.Is(errB, io.EOF) || errors.Is(errB, io.ErrUnexpectedEOF)
+		if errA != nil && !doneA {
+			return false, errA
+		}
+		if errB != nil && !doneB {
+			return false, errB
+		}
+		if doneA || doneB {
+			return doneA == doneB, nil
+		}
+	}
+}
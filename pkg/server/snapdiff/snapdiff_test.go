@@ -0,0 +1,82 @@
+package snapdiff
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeLayer(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestDiff(t *testing.T) {
+	base := writeLayer(t, map[string]string{
+		"etc/hosts":       "127.0.0.1 localhost",
+		"home/elara/a.py": "print(1)",
+		"home/elara/b.py": "print(2)",
+		"tmp/scratch":     "x",
+	})
+	target := writeLayer(t, map[string]string{
+		"etc/hosts":       "127.0.0.1 localhost",
+		"home/elara/a.py": "print(3)",
+		"home/elara/b.py": "print(2)",
+		"home/elara/c.py": "print(4)",
+	})
+	if err := os.Symlink("a.py", filepath.Join(target, "home/elara/link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(target, "home/elara/b.py"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := Diff(base, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Path: "/home/elara/a.py", Kind: KindModified, Type: TypeFile, Size: 8},
+		{Path: "/home/elara/b.py", Kind: KindModified, Type: TypeFile, Size: 8},
+		{Path: "/home/elara/c.py", Kind: KindAdded, Type: TypeFile, Size: 8},
+		{Path: "/home/elara/link", Kind: KindAdded, Type: TypeSymlink},
+		{Path: "/tmp", Kind: KindDeleted, Type: TypeDir},
+		{Path: "/tmp/scratch", Kind: KindDeleted, Type: TypeFile},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Diff =\n%+v\nwant\n%+v", changes, want)
+	}
+
+	if changes, err := Diff(base, base); err != nil || len(changes) != 0 {
+		t.Errorf("Diff of a layer with itself = %+v, %v", changes, err)
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	dir := t.TempDir()
+	big := make([]byte, 200*1024)
+	other := make([]byte, len(big))
+	other[len(other)-1] = 1
+	for name, content := range map[string][]byte{"a": big, "b": big, "c": other} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if same, err := sameContent(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil || !same {
+		t.Errorf("sameContent(a, b) = %v, %v", same, err)
+	}
+	if same, err := sameContent(filepath.Join(dir, "a"), filepath.Join(dir, "c")); err != nil || same {
+		t.Errorf("sameContent(a, c) = %v, %v", same, err)
+	}
+}
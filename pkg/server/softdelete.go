@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+)
+
+const (
+	// deletedVMsFilename is where VMs pending purge are recorded, in the
+	// state dir, so that they can still be undeleted after a restart.
+	deletedVMsFilename = "deleted-vms.json"
+	// vmStatusDeletedPendingPurge is the status of a deleted VM that can
+	// still be undeleted.
+	vmStatusDeletedPendingPurge = "DELETED_PENDING_PURGE"
+	// deletedVMsPurgeInterval is how often expired deleted VMs are purged.
+	deletedVMsPurgeInterval = time.Minute
+)
+
+// deletedVM is a VM that was deleted but can be undeleted from its snapshot
+// until PurgeAt.
+type deletedVM struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner,omitempty"`
+	SnapshotID string    `json:"snapshotId"`
+	DeletedAt  time.Time `json:"deletedAt"`
+	PurgeAt    time.Time `json:"purgeAt"`
+	// undeleting is set while the VM is being restored.
+	undeleting bool
+}
+
+// loadDeletedVMs returns the deleted VMs recorded in the state dir. A missing
+// file is not an error.
+func loadDeletedVMs(stateDir string) (map[string]*deletedVM, error) {
+	deleted := make(map[string]*deletedVM)
+	data, err := os.ReadFile(path.Join(stateDir, deletedVMsFilename))
+	if os.IsNotExist(err) {
+		return deleted, nil
+	}
+	if err != nil {
+		return deleted, fmt.Errorf("failed to read deleted VMs: %w", err)
+	}
+	var list []*deletedVM
+	if err := json.Unmarshal(data, &list); err != nil {
+		return deleted, fmt.Errorf("failed to parse deleted VMs: %w", err)
+	}
+	for _, d := range list {
+		deleted[d.Name] = d
+	}
+	return deleted, nil
+}
+
+// saveDeletedVMs records the deleted VMs in the state dir. The caller must
+// hold the server lock.
+func (s *Server) saveDeletedVMs() {
+	list := make([]*deletedVM, 0, len(s.deleted))
+	for _, d := range s.deleted {
+		list = append(list, d)
+	}
+	data, err := json.Marshal(list)
+	if err == nil {
+		filePath := path.Join(s.config.StateDir, deletedVMsFilename)
+		if err = os.WriteFile(filePath+".tmp", data, 0644); err == nil {
+			err = os.Rename(filePath+".tmp", filePath)
+		}
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to save deleted VMs")
+	}
+}
+
+// softDeleteVM snapshots a VM before destroying it, so that it can be
+// undeleted until the retention period is over. VMs that aren't running
+// can't be snapshotted and are destroyed right away.
+func (s *Server) softDeleteVM(ctx context.Context, vmName string) error {
+	logger := log.WithField("vmName", vmName)
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	vm.lock.RLock()
+	id, owner, vmState := vm.id, vm.owner, vm.status
+	vm.lock.RUnlock()
+
+	if vmState == vmStatusPaused {
+		// Snapshots pause the VM themselves.
+		if err := vm.resume(ctx); err != nil {
+			return status.Errorf(codes.Internal, "failed to resume VM before deleting it: %v", err)
+		}
+	} else if vmState != vmStatusRunning {
+		logger.Warnf("Destroying %s VM right away, only running VMs can be undeleted", vmState)
+		return s.destroyVM(ctx, vmName)
+	}
+	if reason := vm.snapshotBlocker(); reason != "" {
+		logger.Warnf("Destroying VM right away, %s", reason)
+		return s.destroyVM(ctx, vmName)
+	}
+
+	snapshotID := "deleted-" + id
+	// Deleted VMs' snapshots only come back as the VM, no need to scan them.
+	if _, err := s.snapshotVM(ctx, vmName, snapshotID); err != nil {
+		return status.Errorf(codes.Internal, "failed to snapshot VM before deleting it: %v", err)
+	}
+	if err := s.destroyVM(ctx, vmName); err != nil {
+		s.removeDeletedVMSnapshot(snapshotID)
+		return err
+	}
+
+	now := time.Now()
+	deleted := &deletedVM{
+		ID:         id,
+		Name:       vmName,
+		Owner:      owner,
+		SnapshotID: snapshotID,
+		DeletedAt:  now,
+		PurgeAt:    now.Add(s.config.SoftDelete.Retention),
+	}
+	s.lock.Lock()
+	// A VM deleted again under the same name replaces the older one.
+	replaced := s.deleted[vmName]
+	s.deleted[vmName] = deleted
+	s.saveDeletedVMs()
+	s.lock.Unlock()
+	if replaced != nil {
+		s.removeDeletedVMSnapshot(replaced.SnapshotID)
+	}
+
+	logger.WithFields(log.Fields{
+		"vmId":    id,
+		"purgeAt": deleted.PurgeAt,
+	}).Info("VM deleted, pending purge")
+	return nil
+}
+
+// UndeleteVM restores a deleted VM from its snapshot, under its old name, ID
+// and owner, if its retention period isn't over. Unless tenant is empty, VMs
+// deleted by other tenants are not found.
+func (s *Server) UndeleteVM(ctx context.Context, vmName string, tenant string) (*serverapi.StartVMResponse, error) {
+	logger := log.WithField("vmName", vmName)
+	logger.Info("received request to undelete VM")
+
+	s.lock.Lock()
+	deleted, ok := s.deleted[vmName]
+	switch {
+	case !ok, tenant != "" && deleted.Owner != tenant:
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "no deleted vm pending purge: %s", vmName)
+	case deleted.undeleting:
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is already being undeleted", vmName)
+	}
+	if _, exists := s.vms[vmName]; exists {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.AlreadyExists, "vm %s already exists", vmName)
+	}
+	deleted.undeleting = true
+	s.lock.Unlock()
+
+	req := serverapi.NewStartVMRequest()
+	req.SetVmName(vmName)
+	req.SetSnapshotId(deleted.SnapshotID)
+	if deleted.Owner != "" {
+		req.SetOwner(deleted.Owner)
+	}
+	resp, err := s.StartVM(ctx, req)
+
+	s.lock.Lock()
+	deleted.undeleting = false
+	if err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	// The VM was created with a new ID, give it back the one it had.
+	vm, ok := s.vms[vmName]
+	var newID string
+	if ok {
+		vm.lock.Lock()
+		newID = vm.id
+		delete(s.vmIDs, vm.id)
+		vm.id = deleted.ID
+		s.vmIDs[vm.id] = vm
+		vm.lock.Unlock()
+	}
+	delete(s.deleted, vmName)
+	s.saveDeletedVMs()
+	s.lock.Unlock()
+	if ok {
+		s.forgetVM(ctx, newID)
+		s.recordVM(ctx, vm)
+		vm.record(timeline.KindLifecycle, "undeleted", "VM undeleted", nil)
+	}
+	s.removeDeletedVMSnapshot(deleted.SnapshotID)
+
+	resp.VmId = serverapi.PtrString(deleted.ID)
+	logger.WithField("vmId", deleted.ID).Info("VM undeleted")
+	return resp, nil
+}
+
+// PurgeVM destroys a VM without keeping it to be undeleted, or purges a
+// deleted VM before its retention period is over.
+func (s *Server) PurgeVM(ctx context.Context, vmName string) (*serverapi.VMResponse, error) {
+	if s.getVMAtomic(vmName) != nil {
+		if err := s.destroyVM(ctx, vmName); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to destroy vm: %s: %v", vmName, err)
+		}
+		return &serverapi.VMResponse{Success: serverapi.PtrBool(true)}, nil
+	}
+
+	s.lock.Lock()
+	deleted, ok := s.deleted[vmName]
+	if !ok || deleted.undeleting {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "vm not found: %s", vmName)
+	}
+	delete(s.deleted, vmName)
+	s.saveDeletedVMs()
+	s.lock.Unlock()
+	s.removeDeletedVMSnapshot(deleted.SnapshotID)
+	log.WithFields(log.Fields{"vmName": vmName, "vmId": deleted.ID}).Info("Purged deleted VM")
+	return &serverapi.VMResponse{Success: serverapi.PtrBool(true)}, nil
+}
+
+// purgeExpiredVMs purges the deleted VMs whose retention period is over.
+func (s *Server) purgeExpiredVMs(now time.Time) {
+	var expired []*deletedVM
+	s.lock.Lock()
+	for name, deleted := range s.deleted {
+		if !deleted.undeleting && !now.Before(deleted.PurgeAt) {
+			expired = append(expired, deleted)
+			delete(s.deleted, name)
+		}
+	}
+	if len(expired) > 0 {
+		s.saveDeletedVMs()
+	}
+	s.lock.Unlock()
+
+	for _, deleted := range expired {
+		s.removeDeletedVMSnapshot(deleted.SnapshotID)
+		log.WithFields(log.Fields{"vmName": deleted.Name, "vmId": deleted.ID}).Info("Purged deleted VM")
+	}
+}
+
+// PurgeDeletedVMsPeriodically purges deleted VMs once their retention period
+// is over, until ctx is done.
+func (s *Server) PurgeDeletedVMsPeriodically(ctx context.Context) {
+	s.purgeExpiredVMs(time.Now())
+	ticker := time.NewTicker(deletedVMsPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.purgeExpiredVMs(now)
+		}
+	}
+}
+
+func (s *Server) removeDeletedVMSnapshot(snapshotID string) {
+	snapshotPath := path.Join(s.config.StateDir, "snapshots", snapshotID)
+	if err := os.RemoveAll(snapshotPath); err != nil {
+		log.WithError(err).Errorf("failed to remove snapshot of deleted VM: %s", snapshotPath)
+		return
+	}
+	s.forgetSnapshot(context.Background(), snapshotID)
+}
+
+// deletedVMStatus returns the status of a deleted VM pending purge, or nil if
+// there is none named vmName.
+func (s *Server) deletedVMStatus(vmName string) *serverapi.ListVMResponse {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	deleted, ok := s.deleted[vmName]
+	if !ok {
+		return nil
+	}
+	return convertDeletedVM(deleted)
+}
+
+func convertDeletedVM(deleted *deletedVM) *serverapi.ListVMResponse {
+	return &serverapi.ListVMResponse{
+		VmName:  serverapi.PtrString(deleted.Name),
+		VmId:    serverapi.PtrString(deleted.ID),
+		Owner:   serverapi.PtrString(deleted.Owner),
+		Status:  serverapi.PtrString(vmStatusDeletedPendingPurge),
+		PurgeAt: serverapi.PtrTime(deleted.PurgeAt),
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUndeleteVMOfOtherTenant(t *testing.T) {
+	s := &Server{
+		vms:   map[string]*vm{},
+		vmIDs: map[string]*vm{},
+		deleted: map[string]*deletedVM{
+			"sandbox": {ID: "id-1", Name: "sandbox", Owner: "globex", SnapshotID: "snap-1"},
+		},
+	}
+
+	if got := s.ResolveVMName("id-1"); got != "sandbox" {
+		t.Fatalf("ResolveVMName(id) = %q, want %q", got, "sandbox")
+	}
+	if owner, ok := s.VMOwner("sandbox"); !ok || owner != "globex" {
+		t.Fatalf("VMOwner() = %q, %v, want %q, true", owner, ok, "globex")
+	}
+
+	_, err := s.UndeleteVM(context.Background(), "sandbox", "acme")
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("UndeleteVM() as other tenant error = %v, want NotFound", err)
+	}
+	if s.deleted["sandbox"].undeleting {
+		t.Error("UndeleteVM() as other tenant started restoring the VM")
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+)
+
+// cgroupRoot is where the unified (v2) cgroup hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// launchSource is what a VM was launched from.
+type launchSource struct {
+	// snapshotID is set for VMs restored from a snapshot, which carry the
+	// kernel and disks the snapshotted VM was created with.
+	snapshotID string
+	// adopted is set for VMs whose VMM was started outside of arrakis.
+	adopted   bool
+	kernel    string
+	rootfs    string
+	initramfs string
+	// vmmBinary and vmmArgs are the VMM's command line.
+	vmmBinary string
+	vmmArgs   []string
+}
+
+// VMSpec returns the configuration a VM effectively runs with: what it was
+// launched from, the VMM process and its cgroup limits, and the VM config as
+// Cloud Hypervisor reports it, e.g. to find out why two VMs behave
+// differently. Parts that can't be read are listed in warnings rather than
+// failing the request.
+func (s *Server) VMSpec(ctx context.Context, vmName string) (*serverapi.VmSpecResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+
+	vm.lock.RLock()
+	resp := &serverapi.VmSpecResponse{
+		VmName:    serverapi.PtrString(vm.name),
+		VmId:      serverapi.PtrString(vm.id),
+		Owner:     serverapi.PtrString(vm.owner),
+		Status:    serverapi.PtrString(vm.status.String()),
+		CreatedAt: serverapi.PtrTime(vm.createdAt),
+		Arch:      serverapi.PtrString(s.arch),
+		Provenance: &serverapi.VmSpecProvenance{
+			Source:    serverapi.PtrString("image"),
+			Kernel:    serverapi.PtrString(vm.launch.kernel),
+			Rootfs:    serverapi.PtrString(vm.launch.rootfs),
+			Initramfs: serverapi.PtrString(vm.launch.initramfs),
+		},
+		Vmm: &serverapi.VmSpecVmm{
+			Hypervisor: serverapi.PtrString(vm.hypervisor.Name()),
+			Binary:     serverapi.PtrString(vm.launch.vmmBinary),
+			Args:       vm.launch.vmmArgs,
+			ApiSocket:  serverapi.PtrString(vm.apiSocketPath),
+		},
+		Network: &serverapi.VmSpecNetwork{
+			Backend: serverapi.PtrString(s.network.Name()),
+			Bridge:  serverapi.PtrString(s.config.BridgeName),
+			Gateway: serverapi.PtrString(s.config.BridgeIP),
+		},
+		PortForwards: convertPortForward(vm.portForwards),
+		Vsock: &serverapi.VmSpecVsock{
+			Cid:    serverapi.PtrInt64(int64(vm.cid)),
+			Socket: serverapi.PtrString(vm.vsockPath),
+		},
+		StatefulDisk: serverapi.PtrString(vm.statefulDiskPath),
+		Devices:      convertDevices(vm.devices),
+	}
+	if vm.launch.snapshotID != "" {
+		resp.Provenance = &serverapi.VmSpecProvenance{
+			Source:     serverapi.PtrString("snapshot"),
+			SnapshotId: serverapi.PtrString(vm.launch.snapshotID),
+		}
+	}
+	if vm.launch.adopted {
+		resp.Provenance.Source = serverapi.PtrString("adopted")
+	}
+	if vm.ip != nil {
+		resp.Network.Ip = serverapi.PtrString(vm.ip.String())
+	}
+	if vm.tapDevice != nil {
+		resp.Network.Tap = serverapi.PtrString(vm.tapDevice.Name)
+	}
+	var pid int
+	if vm.process != nil {
+		pid = vm.process.Pid
+		resp.Vmm.Pid = serverapi.PtrInt32(int32(pid))
+	}
+	apiClient := vm.chvClient()
+	hypervisorName := vm.hypervisor.Name()
+	vm.lock.RUnlock()
+
+	var warnings []string
+	if pid != 0 {
+		cgroup, err := processCgroup(pid)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("cgroup: %v", err))
+		} else {
+			resp.Cgroup = cgroup
+		}
+	}
+
+	if apiClient == nil {
+		warnings = append(warnings, fmt.Sprintf("%s doesn't report the VM config", hypervisorName))
+		resp.Warnings = warnings
+		return resp, nil
+	}
+	info, _, err := apiClient.DefaultAPI.VmInfoGet(ctx).Execute()
+	if err != nil {
+		log.WithField("vmName", vmName).WithError(err).Warn("Failed to get VM info from cloud-hypervisor")
+		warnings = append(warnings, fmt.Sprintf("cloud-hypervisor: %v", err))
+		resp.Warnings = warnings
+		return resp, nil
+	}
+	config := info.GetConfig()
+	resp.Vmm.State = serverapi.PtrString(info.GetState())
+	payload := config.GetPayload()
+	resp.Kernel = serverapi.PtrString(payload.GetKernel())
+	resp.Initramfs = serverapi.PtrString(payload.GetInitramfs())
+	resp.KernelCmdline = serverapi.PtrString(payload.GetCmdline())
+	cpus := config.GetCpus()
+	resp.Vcpus = serverapi.PtrInt32(cpus.GetBootVcpus())
+	memory := config.GetMemory()
+	resp.MemoryMb = serverapi.PtrInt64(memory.GetSize() / (1024 * 1024))
+	for _, disk := range config.GetDisks() {
+		resp.Disks = append(resp.Disks, serverapi.VmSpecDisk{
+			Path:     serverapi.PtrString(disk.GetPath()),
+			Readonly: serverapi.PtrBool(disk.GetReadonly()),
+		})
+	}
+	for _, net := range config.GetNet() {
+		if net.GetTap() == resp.Network.GetTap() && net.HasMac() {
+			resp.Network.Mac = serverapi.PtrString(net.GetMac())
+		}
+	}
+	// The config as cloud-hypervisor has it, with every default it filled in.
+	if data, err := json.Marshal(config); err == nil {
+		var raw map[string]interface{}
+		if err := json.Unmarshal(data, &raw); err == nil {
+			resp.VmmConfig = raw
+		}
+	}
+	resp.Warnings = warnings
+	return resp, nil
+}
+
+// processCgroup returns the cgroup v2 of the process pid and its CPU and
+// memory limits.
+func processCgroup(pid int) (*serverapi.VmSpecCgroup, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cgroupPath string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The unified hierarchy is listed as "0::<path>".
+		if p, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			cgroupPath = p
+			break
+		}
+	}
+	if cgroupPath == "" {
+		return nil, fmt.Errorf("process %d is not in a cgroup v2", pid)
+	}
+
+	cgroup := &serverapi.VmSpecCgroup{Path: serverapi.PtrString(cgroupPath)}
+	readLimit := func(file string) *string {
+		data, err := os.ReadFile(path.Join(cgroupRoot, cgroupPath, file))
+		if err != nil {
+			return nil
+		}
+		return serverapi.PtrString(strings.TrimSpace(string(data)))
+	}
+	cgroup.MemoryMax = readLimit("memory.max")
+	cgroup.CpuMax = readLimit("cpu.max")
+	cgroup.PidsMax = readLimit("pids.max")
+	return cgroup, nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+)
+
+const (
+	defaultStopHookTimeout = 30 * time.Second
+	// Where graceful stops save the guest's journal, relative to the
+	// artifacts directory.
+	stopLogsArtifact = "logs/journal.log"
+	// Only the tail of the hook's output is reported.
+	maxStopHookOutput = 4096
+)
+
+// StopVMGracefully prepares a running VM before stopping it: it runs the
+// configured on-stop hook, saves the guest's journal and collects the
+// artifacts, uploading them if a store is configured. What was captured is
+// returned as a summary. Failures while preparing are reported in the summary
+// and never prevent the stop.
+func (s *Server) StopVMGracefully(ctx context.Context, vmName string) (*serverapi.VMResponse, error) {
+	logger := log.WithField("vmName", vmName)
+	logger.Infof("received request to stop VM gracefully")
+
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Errorf(codes.NotFound, "vm %s not found", vmName)
+	}
+	vm.lock.RLock()
+	vmStatus := vm.status
+	vm.lock.RUnlock()
+	if vmStatus != vmStatusRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "vm %s is not running", vmName)
+	}
+
+	start := time.Now()
+	summary := serverapi.VmStopSummary{}
+	var errs []string
+
+	if hook := s.config.Stop.Hook; hook != "" {
+		timeout := s.config.Stop.HookTimeout
+		if timeout == 0 {
+			timeout = defaultStopHookTimeout
+		}
+		output, err := vm.runGuestCommand(ctx, hook, timeout)
+		if len(output) > maxStopHookOutput {
+			output = output[len(output)-maxStopHookOutput:]
+		}
+		summary.Hook = serverapi.PtrString(hook)
+		summary.HookOutput = serverapi.PtrString(output)
+		if err != nil {
+			logger.WithError(err).Warn("On-stop hook failed")
+			summary.HookError = serverapi.PtrString(err.Error())
+		}
+	}
+
+	if s.config.Stop.CollectLogs {
+		logsPath := path.Join(cmdserver.ArtifactsDir, stopLogsArtifact)
+		cmd := fmt.Sprintf("mkdir -p %s && journalctl -b --no-pager > %s 2>&1", path.Dir(logsPath), logsPath)
+		if _, err := vm.runGuestCommand(ctx, cmd, defaultStopHookTimeout); err != nil {
+			logger.WithError(err).Warn("Failed to save guest logs")
+			errs = append(errs, fmt.Sprintf("failed to save guest logs: %v", err))
+		} else {
+			summary.Logs = serverapi.PtrString(stopLogsArtifact)
+		}
+	}
+
+	var artifacts []cmdserver.Artifact
+	if s.artifactStore != nil {
+		var uploaded int
+		var failed []error
+		artifacts, uploaded, failed = s.uploadArtifacts(ctx, vm)
+		summary.Uploaded = serverapi.PtrInt32(int32(uploaded))
+		for _, err := range failed {
+			errs = append(errs, err.Error())
+		}
+	} else {
+		var err error
+		artifacts, err = vm.listGuestArtifacts(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to list artifacts: %v", err))
+		}
+	}
+	summary.Artifacts = convertArtifacts(artifacts)
+	summary.Errors = errs
+
+	if err := vm.shutdown(ctx); err != nil {
+		return nil, err
+	}
+	s.recordVM(ctx, vm)
+	vm.record(timeline.KindLifecycle, "stopped", "VM stopped gracefully", map[string]string{"artifacts": strconv.Itoa(len(artifacts))})
+	summary.Duration = serverapi.PtrString(time.Since(start).Round(time.Millisecond).String())
+	logger.WithField("artifacts", len(artifacts)).Infof("VM stopped gracefully")
+
+	return &serverapi.VMResponse{
+		Success:     serverapi.PtrBool(true),
+		StopSummary: &summary,
+	}, nil
+}
+
+// runGuestCommand runs cmd in the guest and waits at most timeout for it to
+// finish. It returns the command's combined output.
+func (v *vm) runGuestCommand(ctx context.Context, cmd string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	v.lock.RLock()
+	url := v.agent.url(v.ip.IP.String(), "")
+	v.lock.RUnlock()
+	client := v.agent.client(timeout)
+
+	resp, err := v.handleRun(ctx, client, url, cmd, true, cmdserver.ExecLimits{})
+	if err != nil {
+		return "", err
+	}
+	if resp.GetError() != "" {
+		return resp.GetOutput(), fmt.Errorf("%s", resp.GetError())
+	}
+	return resp.GetOutput(), nil
+}
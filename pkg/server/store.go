@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/server/adoption"
+	"github.com/abshkbh/arrakis/pkg/server/store"
+	"github.com/abshkbh/arrakis/pkg/server/workdir"
+)
+
+// storeHost is the host recorded with the VMs and snapshots of this server:
+// its ID in an active/standby pair, else its hostname.
+func storeHost(c config.ServerConfig) string {
+	if c.LeaderElection.ID != "" {
+		return c.LeaderElection.ID
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// hostVMs splits the VMs this host recorded between those whose VMM still
+// serves its API, e.g. left running by a leader that stepped down, and those
+// that didn't survive a restart of the host.
+func hostVMs(ctx context.Context, metadata store.Store, host string, stateDir string) (running []store.VM, gone []store.VM) {
+	vms, err := metadata.ListVMs(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list stored VMs")
+		return nil, nil
+	}
+	for _, vm := range vms {
+		if vm.Host != host {
+			continue
+		}
+		if _, err := adoption.SocketPID(workdir.New(stateDir, vm.Name).APISocket()); err != nil {
+			gone = append(gone, vm)
+		} else {
+			running = append(running, vm)
+		}
+	}
+	return running, gone
+}
+
+// restoreHostVMs adopts the VMs of this host that are still running and
+// drops the others from the store.
+func (s *Server) restoreHostVMs(ctx context.Context, running []store.VM, gone []store.VM) {
+	for _, record := range running {
+		req := &serverapi.AdoptVMRequest{
+			VmName:    serverapi.PtrString(record.Name),
+			ApiSocket: serverapi.PtrString(workdir.New(s.config.StateDir, record.Name).APISocket()),
+			Owner:     serverapi.PtrString(record.Owner),
+		}
+		if _, err := s.adoptVM(ctx, req, &record); err != nil {
+			log.WithField("vmName", record.Name).WithError(err).Warn("Failed to restore running VM, leaving it unmanaged")
+			gone = append(gone, record)
+		}
+	}
+	for _, record := range gone {
+		s.forgetVM(ctx, record.ID)
+	}
+}
+
+// restoreHostSnapshots drops the snapshots this host recorded whose
+// directory is gone, e.g. removed while the server was down, and returns how
+// many are left.
+func (s *Server) restoreHostSnapshots(ctx context.Context) int {
+	snapshots, err := s.store.ListSnapshots(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list stored snapshots")
+		return 0
+	}
+	restored := 0
+	for _, snapshot := range snapshots {
+		if snapshot.Host != s.host {
+			continue
+		}
+		if _, err := os.Stat(path.Join(s.config.StateDir, "snapshots", snapshot.ID)); os.IsNotExist(err) {
+			s.forgetSnapshot(ctx, snapshot.ID)
+			continue
+		}
+		restored++
+	}
+	return restored
+}
+
+// recordVM saves the current metadata of vm. Failures are logged rather than
+// returned, the store is a record and doesn't hold up managing VMs.
+func (s *Server) recordVM(ctx context.Context, vm *vm) {
+	vm.lock.RLock()
+	record := store.VM{
+		ID:         vm.id,
+		Name:       vm.name,
+		Owner:      vm.owner,
+		Status:     vm.status.String(),
+		Arch:       s.arch,
+		Hypervisor: vm.hypervisor.Name(),
+		Host:       s.host,
+		Created:    vm.createdAt,
+		Updated:    time.Now(),
+	}
+	vm.lock.RUnlock()
+	if err := s.store.PutVM(context.WithoutCancel(ctx), record); err != nil {
+		log.WithField("vmName", record.Name).WithError(err).Warn("Failed to store VM")
+	}
+}
+
+func (s *Server) forgetVM(ctx context.Context, id string) {
+	if err := s.store.DeleteVM(context.WithoutCancel(ctx), id); err != nil {
+		log.WithField("vmId", id).WithError(err).Warn("Failed to remove VM from the store")
+	}
+}
+
+// recordSnapshot saves the metadata of the snapshot snapshotID of vm.
+func (s *Server) recordSnapshot(ctx context.Context, snapshotID string, vm *vm) {
+	vm.lock.RLock()
+	record := store.Snapshot{
+		ID:         snapshotID,
+		VMID:       vm.id,
+		VMName:     vm.name,
+		Owner:      vm.owner,
+		Arch:       s.arch,
+		Hypervisor: vm.hypervisor.Name(),
+		Host:       s.host,
+		Created:    time.Now(),
+	}
+	vm.lock.RUnlock()
+	if err := s.store.PutSnapshot(context.WithoutCancel(ctx), record); err != nil {
+		log.WithField("snapshotId", snapshotID).WithError(err).Warn("Failed to store snapshot")
+	}
+}
+
+// snapshotOwner returns the owner recorded with the snapshot id, unless it
+// wasn't recorded.
+func (s *Server) snapshotOwner(ctx context.Context, id string) (string, bool) {
+	snapshots, err := s.store.ListSnapshots(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list stored snapshots")
+		return "", false
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == id {
+			return snapshot.Owner, true
+		}
+	}
+	return "", false
+}
+
+func (s *Server) forgetSnapshot(ctx context.Context, id string) {
+	if err := s.store.DeleteSnapshot(context.WithoutCancel(ctx), id); err != nil {
+		log.WithField("snapshotId", id).WithError(err).Warn("Failed to remove snapshot from the store")
+	}
+}
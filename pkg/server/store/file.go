@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// storeFilename is where the file backend keeps the metadata, in the state
+// dir.
+const storeFilename = "store.json"
+
+// fileStore keeps the metadata in memory and rewrites its file on every
+// change.
+type fileStore struct {
+	path string
+
+	mu        sync.Mutex
+	vms       map[string]VM
+	snapshots map[string]Snapshot
+}
+
+// fileContent is the content of the store's file.
+type fileContent struct {
+	VMs       []VM       `json:"vms"`
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+func openFile(path string) (*fileStore, error) {
+	s := &fileStore{
+		path:      path,
+		vms:       make(map[string]VM),
+		snapshots: make(map[string]Snapshot),
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	var content fileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("failed to parse store: %w", err)
+	}
+	for _, vm := range content.VMs {
+		s.vms[vm.ID] = vm
+	}
+	for _, snapshot := range content.Snapshots {
+		s.snapshots[snapshot.ID] = snapshot
+	}
+	return s, nil
+}
+
+func (s *fileStore) PutVM(ctx context.Context, vm VM) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vms[vm.ID] = vm
+	return s.save()
+}
+
+func (s *fileStore) DeleteVM(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.vms[id]; !ok {
+		return nil
+	}
+	delete(s.vms, id)
+	return s.save()
+}
+
+func (s *fileStore) ListVMs(ctx context.Context) ([]VM, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedVMs(), nil
+}
+
+func (s *fileStore) PutSnapshot(ctx context.Context, snapshot Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[snapshot.ID] = snapshot
+	return s.save()
+}
+
+func (s *fileStore) DeleteSnapshot(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.snapshots[id]; !ok {
+		return nil
+	}
+	delete(s.snapshots, id)
+	return s.save()
+}
+
+func (s *fileStore) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedSnapshots(), nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// sortedVMs returns the VMs by ID. The caller must hold the mutex.
+func (s *fileStore) sortedVMs() []VM {
+	vms := make([]VM, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	sort.Slice(vms, func(i, j int) bool { return vms[i].ID < vms[j].ID })
+	return vms
+}
+
+// sortedSnapshots returns the snapshots by ID. The caller must hold the
+// mutex.
+func (s *fileStore) sortedSnapshots() []Snapshot {
+	snapshots := make([]Snapshot, 0, len(s.snapshots))
+	for _, snapshot := range s.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots
+}
+
+// save replaces the file atomically. The caller must hold the mutex.
+func (s *fileStore) save() error {
+	data, err := json.Marshal(fileContent{VMs: s.sortedVMs(), Snapshots: s.sortedSnapshots()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal store: %w", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	return os.Rename(tmpPath, s.path)
+}
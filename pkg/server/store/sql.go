@@ -0,0 +1,151 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// dialect is what differs between the SQL backends. Queries are written with
+// "?" placeholders and the upsert syntax both SQLite and Postgres support.
+type dialect struct {
+	name   string
+	driver string
+	// numbered uses $1, $2... placeholders instead of "?".
+	numbered bool
+}
+
+var (
+	sqliteDialect   = dialect{name: BackendSQLite, driver: "sqlite3"}
+	postgresDialect = dialect{name: BackendPostgres, driver: "postgres", numbered: true}
+)
+
+// rebind rewrites the placeholders of query for the dialect.
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS vms (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		owner TEXT NOT NULL,
+		status TEXT NOT NULL,
+		arch TEXT NOT NULL,
+		hypervisor TEXT NOT NULL,
+		host TEXT NOT NULL,
+		created TIMESTAMP NOT NULL,
+		updated TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS vms_owner ON vms (owner)`,
+	`CREATE TABLE IF NOT EXISTS snapshots (
+		id TEXT PRIMARY KEY,
+		vm_id TEXT NOT NULL,
+		vm_name TEXT NOT NULL,
+		owner TEXT NOT NULL,
+		arch TEXT NOT NULL,
+		hypervisor TEXT NOT NULL,
+		host TEXT NOT NULL,
+		created TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS snapshots_vm_id ON snapshots (vm_id)`,
+}
+
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+func (s *sqlStore) migrate(ctx context.Context) error {
+	for _, stmt := range schema {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, args ...any) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(query), args...)
+	return err
+}
+
+func (s *sqlStore) PutVM(ctx context.Context, vm VM) error {
+	return s.exec(ctx, `INSERT INTO vms (id, name, owner, status, arch, hypervisor, host, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, owner = excluded.owner,
+			status = excluded.status, arch = excluded.arch, hypervisor = excluded.hypervisor,
+			host = excluded.host, created = excluded.created, updated = excluded.updated`,
+		vm.ID, vm.Name, vm.Owner, vm.Status, vm.Arch, vm.Hypervisor, vm.Host, vm.Created.UTC(), vm.Updated.UTC())
+}
+
+func (s *sqlStore) DeleteVM(ctx context.Context, id string) error {
+	return s.exec(ctx, `DELETE FROM vms WHERE id = ?`, id)
+}
+
+func (s *sqlStore) ListVMs(ctx context.Context) ([]VM, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, name, owner, status, arch, hypervisor, host, created, updated FROM vms ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var vms []VM
+	for rows.Next() {
+		var vm VM
+		if err := rows.Scan(&vm.ID, &vm.Name, &vm.Owner, &vm.Status, &vm.Arch, &vm.Hypervisor, &vm.Host, &vm.Created, &vm.Updated); err != nil {
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	return vms, rows.Err()
+}
+
+func (s *sqlStore) PutSnapshot(ctx context.Context, snapshot Snapshot) error {
+	return s.exec(ctx, `INSERT INTO snapshots (id, vm_id, vm_name, owner, arch, hypervisor, host, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET vm_id = excluded.vm_id, vm_name = excluded.vm_name,
+			owner = excluded.owner, arch = excluded.arch, hypervisor = excluded.hypervisor,
+			host = excluded.host, created = excluded.created`,
+		snapshot.ID, snapshot.VMID, snapshot.VMName, snapshot.Owner, snapshot.Arch, snapshot.Hypervisor, snapshot.Host, snapshot.Created.UTC())
+}
+
+func (s *sqlStore) DeleteSnapshot(ctx context.Context, id string) error {
+	return s.exec(ctx, `DELETE FROM snapshots WHERE id = ?`, id)
+}
+
+func (s *sqlStore) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, vm_id, vm_name, owner, arch, hypervisor, host, created FROM snapshots ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var snapshots []Snapshot
+	for rows.Next() {
+		var snapshot Snapshot
+		if err := rows.Scan(&snapshot.ID, &snapshot.VMID, &snapshot.VMName, &snapshot.Owner, &snapshot.Arch, &snapshot.Hypervisor, &snapshot.Host, &snapshot.Created); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, rows.Err()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
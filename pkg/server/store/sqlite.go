@@ -0,0 +1,4 @@
+package store
+
+// The SQLite driver needs cgo, builds without it fail to open the store.
+import _ "github.com/mattn/go-sqlite3"
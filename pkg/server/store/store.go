@@ -0,0 +1,138 @@
+// Package store keeps the metadata of VMs and snapshots, including the tenant
+// owning them, beyond the lifetime of the server. The SQL backends, SQLite
+// (the default) in the state dir and Postgres, which lets servers share it,
+// let operators query it with SQL, e.g.
+//
+//	SELECT owner, count(*) FROM vms GROUP BY owner;
+//
+// The file backend keeps it in a JSON file in the state dir instead.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+// Backends.
+const (
+	BackendFile     = "file"
+	BackendSQLite   = "sqlite"
+	BackendPostgres = "postgres"
+)
+
+// VM is the metadata of a VM.
+type VM struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Owner      string `json:"owner,omitempty"`
+	Status     string `json:"status"`
+	Arch       string `json:"arch"`
+	Hypervisor string `json:"hypervisor"`
+	// Host is the server running the VM.
+	Host    string    `json:"host"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Snapshot is the metadata of a snapshot.
+type Snapshot struct {
+	ID         string `json:"id"`
+	VMID       string `json:"vmId"`
+	VMName     string `json:"vmName"`
+	Owner      string `json:"owner,omitempty"`
+	Arch       string `json:"arch"`
+	Hypervisor string `json:"hypervisor"`
+	// Host is the server that took the snapshot.
+	Host    string    `json:"host"`
+	Created time.Time `json:"created"`
+}
+
+// Store persists VMs and snapshots. Puts insert or replace by ID, deletes of
+// unknown IDs do nothing.
+type Store interface {
+	PutVM(ctx context.Context, vm VM) error
+	DeleteVM(ctx context.Context, id string) error
+	ListVMs(ctx context.Context) ([]VM, error)
+	PutSnapshot(ctx context.Context, snapshot Snapshot) error
+	DeleteSnapshot(ctx context.Context, id string) error
+	ListSnapshots(ctx context.Context) ([]Snapshot, error)
+	Close() error
+}
+
+// Open opens the store configured by c, keeping files in stateDir.
+func Open(c config.StoreConfig, stateDir string) (Store, error) {
+	switch c.Backend {
+	case BackendFile:
+		return openFile(path.Join(stateDir, storeFilename))
+	case "", BackendSQLite:
+		dsn := c.DSN
+		if dsn == "" {
+			dsn = path.Join(stateDir, "arrakis.db")
+		}
+		s, err := openSQL(sqliteDialect, dsn)
+		if err != nil {
+			return nil, err
+		}
+		if c.Backend == "" {
+			if err := importFile(s, path.Join(stateDir, storeFilename)); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		return s, nil
+	case BackendPostgres:
+		if c.DSN == "" {
+			return nil, fmt.Errorf("dsn is required for the %s store", BackendPostgres)
+		}
+		return openSQL(postgresDialect, c.DSN)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", c.Backend)
+	}
+}
+
+// importFile moves the metadata the file backend, the default before SQLite,
+// kept at path into s, and renames the file so that it is only imported once.
+func importFile(s Store, path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	file, err := openFile(path)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	for _, vm := range file.vms {
+		if err := s.PutVM(ctx, vm); err != nil {
+			return fmt.Errorf("failed to import %s: %w", path, err)
+		}
+	}
+	for _, snapshot := range file.snapshots {
+		if err := s.PutSnapshot(ctx, snapshot); err != nil {
+			return fmt.Errorf("failed to import %s: %w", path, err)
+		}
+	}
+	if err := os.Rename(path, path+".imported"); err != nil {
+		return fmt.Errorf("failed to import %s: %w", path, err)
+	}
+	return nil
+}
+
+// openSQL opens a database with the driver of d.
+func openSQL(d dialect, dsn string) (Store, error) {
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s store: %w", d.name, err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	if err := s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create %s store schema: %w", d.name, err)
+	}
+	return s, nil
+}
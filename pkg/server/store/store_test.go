@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+func TestFileStore(t *testing.T) {
+	testStore(t, config.StoreConfig{Backend: BackendFile})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, config.StoreConfig{})
+}
+
+func testStore(t *testing.T, c config.StoreConfig) {
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	s, err := Open(c, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	vm := VM{ID: "vm-1", Name: "foo", Owner: "acme", Status: "RUNNING", Arch: "x86_64", Hypervisor: "cloud-hypervisor", Host: "a", Created: created, Updated: created}
+	if err := s.PutVM(ctx, vm); err != nil {
+		t.Fatal(err)
+	}
+	vm.Status = "STOPPED"
+	if err := s.PutVM(ctx, vm); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutVM(ctx, VM{ID: "vm-2", Name: "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteVM(ctx, "vm-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteVM(ctx, "unknown"); err != nil {
+		t.Errorf("DeleteVM(unknown) = %v", err)
+	}
+	snapshot := Snapshot{ID: "snap", VMID: "vm-1", VMName: "foo", Owner: "acme", Created: created}
+	if err := s.PutSnapshot(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// The metadata outlives the store.
+	s, err = Open(c, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vms, err := s.ListVMs(ctx)
+	if err != nil || !reflect.DeepEqual(vms, []VM{vm}) {
+		t.Errorf("ListVMs() = %+v, %v, want %+v", vms, err, vm)
+	}
+	snapshots, err := s.ListSnapshots(ctx)
+	if err != nil || !reflect.DeepEqual(snapshots, []Snapshot{snapshot}) {
+		t.Errorf("ListSnapshots() = %+v, %v, want %+v", snapshots, err, snapshot)
+	}
+	if err := s.DeleteSnapshot(ctx, "snap"); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots, _ := s.ListSnapshots(ctx); len(snapshots) != 0 {
+		t.Errorf("ListSnapshots() after delete = %+v", snapshots)
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	file, err := Open(config.StoreConfig{Backend: BackendFile}, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := VM{ID: "vm-1", Name: "foo", Owner: "acme", Created: time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)}
+	if err := file.PutVM(ctx, vm); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// The default backend takes over what the file backend kept, once.
+	for i := 0; i < 2; i++ {
+		s, err := Open(config.StoreConfig{}, stateDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vms, err := s.ListVMs(ctx); err != nil || len(vms) != 1 || vms[0].Name != "foo" {
+			t.Errorf("ListVMs() after import = %+v, %v, want %+v", vms, err, vm)
+		}
+		s.Close()
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, storeFilename)); !os.IsNotExist(err) {
+		t.Errorf("%s is still there after the import", storeFilename)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := Open(config.StoreConfig{Backend: "mysql"}, t.TempDir()); err == nil {
+		t.Error("Open accepted an unknown backend")
+	}
+	if _, err := Open(config.StoreConfig{Backend: BackendPostgres}, t.TempDir()); err == nil || !strings.Contains(err.Error(), "dsn") {
+		t.Errorf("Open(postgres) without a DSN = %v", err)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := `DELETE FROM vms WHERE id = ? AND owner = ?`
+	if got := sqliteDialect.rebind(query); got != query {
+		t.Errorf("sqlite rebind = %q", got)
+	}
+	if got, want := postgresDialect.rebind(query), `DELETE FROM vms WHERE id = $1 AND owner = $2`; got != want {
+		t.Errorf("postgres rebind = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+// Package tenantpolicy holds the policy bundles of tenants: the defaults and
+// limits applied to every VM a tenant creates.
+package tenantpolicy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when a tenant has as many VMs as its bundle
+// allows.
+var ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+// Bundle is the policy of a tenant's VMs. The zero value restricts nothing.
+type Bundle struct {
+	Tenant string
+	// RestrictEgress restricts the egress of the VMs when they are created.
+	RestrictEgress bool
+	// TTL is how long VMs live after they were created, 0 for ever.
+	TTL time.Duration
+	// MaxVMs bounds the VMs of the tenant, 0 doesn't.
+	MaxVMs int
+}
+
+// CheckQuota fails with ErrQuotaExceeded if a tenant having vms VMs can't
+// create another.
+func (b Bundle) CheckQuota(vms int) error {
+	if b.MaxVMs > 0 && vms >= b.MaxVMs {
+		return fmt.Errorf("%w: tenant %s has %d VMs, at most %d allowed", ErrQuotaExceeded, b.Tenant, vms, b.MaxVMs)
+	}
+	return nil
+}
+
+// ExpiresAt returns when a VM created at createdAt expires, zero if it
+// doesn't.
+func (b Bundle) ExpiresAt(createdAt time.Time) time.Time {
+	if b.TTL <= 0 || createdAt.IsZero() {
+		return time.Time{}
+	}
+	return createdAt.Add(b.TTL)
+}
+
+// Set is the bundles of the tenants, by tenant. A nil Set has none.
+type Set struct {
+	byTenant map[string]Bundle
+}
+
+// New checks bundles and returns their set.
+func New(bundles []Bundle) (*Set, error) {
+	s := &Set{byTenant: make(map[string]Bundle, len(bundles))}
+	for i, b := range bundles {
+		switch {
+		case b.Tenant == "":
+			return nil, fmt.Errorf("tenants[%d] needs a tenant", i)
+		case b.TTL < 0:
+			return nil, fmt.Errorf("tenants[%d].ttl must not be negative", i)
+		case b.MaxVMs < 0:
+			return nil, fmt.Errorf("tenants[%d].max_vms must not be negative", i)
+		}
+		if _, ok := s.byTenant[b.Tenant]; ok {
+			return nil, fmt.Errorf("tenants[%d] names tenant %s, like another bundle", i, b.Tenant)
+		}
+		s.byTenant[b.Tenant] = b
+	}
+	return s, nil
+}
+
+// For returns the bundle of tenant, the zero Bundle if it has none.
+func (s *Set) For(tenant string) Bundle {
+	if s == nil || tenant == "" {
+		return Bundle{}
+	}
+	return s.byTenant[tenant]
+}
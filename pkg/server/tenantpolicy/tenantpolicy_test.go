@@ -0,0 +1,56 @@
+package tenantpolicy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSet(t *testing.T) {
+	s, err := New([]Bundle{
+		{Tenant: "acme", RestrictEgress: true, TTL: time.Hour, MaxVMs: 2},
+		{Tenant: "globex"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme := s.For("acme")
+	if !acme.RestrictEgress || acme.MaxVMs != 2 {
+		t.Errorf("For(acme) = %+v", acme)
+	}
+	if b := s.For("initech"); b != (Bundle{}) {
+		t.Errorf("For(initech) = %+v, want none", b)
+	}
+	if b := (*Set)(nil).For("acme"); b != (Bundle{}) {
+		t.Errorf("nil For(acme) = %+v, want none", b)
+	}
+
+	if err := acme.CheckQuota(1); err != nil {
+		t.Errorf("CheckQuota(1) = %v", err)
+	}
+	if err := acme.CheckQuota(2); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("CheckQuota(2) = %v, want ErrQuotaExceeded", err)
+	}
+	if err := s.For("globex").CheckQuota(100); err != nil {
+		t.Errorf("unlimited CheckQuota = %v", err)
+	}
+
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := acme.ExpiresAt(created); !got.Equal(created.Add(time.Hour)) {
+		t.Errorf("ExpiresAt = %v", got)
+	}
+	if got := s.For("globex").ExpiresAt(created); !got.IsZero() {
+		t.Errorf("ExpiresAt without a TTL = %v, want never", got)
+	}
+
+	for _, bundles := range [][]Bundle{
+		{{}},
+		{{Tenant: "acme", TTL: -time.Second}},
+		{{Tenant: "acme", MaxVMs: -1}},
+		{{Tenant: "acme"}, {Tenant: "acme"}},
+	} {
+		if _, err := New(bundles); err == nil {
+			t.Errorf("New(%+v) succeeded, want an error", bundles)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/config"
+	"github.com/abshkbh/arrakis/pkg/server/tenantpolicy"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+)
+
+// tenantExpiryInterval is how late VMs may be destroyed once their tenant's
+// TTL ran out.
+const tenantExpiryInterval = 30 * time.Second
+
+// newTenantPolicies returns the policy bundles of the config.
+func newTenantPolicies(cfgs []config.TenantPolicyConfig) (*tenantpolicy.Set, error) {
+	bundles := make([]tenantpolicy.Bundle, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		bundles = append(bundles, tenantpolicy.Bundle{
+			Tenant:         cfg.Tenant,
+			RestrictEgress: cfg.RestrictEgress,
+			TTL:            cfg.TTL,
+			MaxVMs:         cfg.MaxVMs,
+		})
+	}
+	return tenantpolicy.New(bundles)
+}
+
+// applyTenantPolicy applies the policy bundle of the owner of a VM about to
+// be created to its request, and fails with ResourceExhausted if the owner
+// has as many VMs as its bundle allows.
+func (s *Server) applyTenantPolicy(req *serverapi.StartVMRequest) error {
+	if err := s.checkTenantQuota(req); err != nil {
+		s.noteQuotaExceeded(req.GetVmName(), req.GetOwner(), err)
+		return status.Errorf(codes.ResourceExhausted, "can't create vm %s: %v", req.GetVmName(), err)
+	}
+	if s.tenants.For(req.GetOwner()).RestrictEgress {
+		if req.Egress == nil {
+			req.Egress = &serverapi.EgressPolicy{}
+		}
+		req.Egress.Restricted = serverapi.PtrBool(true)
+	}
+	return nil
+}
+
+// checkTenantQuota checks that the owner of a VM about to be created may
+// create another.
+func (s *Server) checkTenantQuota(req *serverapi.StartVMRequest) error {
+	bundle := s.tenants.For(req.GetOwner())
+	if bundle.MaxVMs == 0 {
+		return nil
+	}
+	vms := 0
+	s.lock.RLock()
+	for _, vm := range s.vms {
+		if vm.getOwner() == bundle.Tenant {
+			vms++
+		}
+	}
+	s.lock.RUnlock()
+	return bundle.CheckQuota(vms)
+}
+
+// destroyExpiredVMs destroys the VMs whose tenant's TTL ran out by now.
+func (s *Server) destroyExpiredVMs(ctx context.Context, now time.Time) {
+	expired := make(map[string]*vm)
+	s.lock.RLock()
+	for name, vm := range s.vms {
+		vm.lock.RLock()
+		expiresAt := s.tenants.For(vm.owner).ExpiresAt(vm.createdAt)
+		vm.lock.RUnlock()
+		if !expiresAt.IsZero() && !now.Before(expiresAt) {
+			expired[name] = vm
+		}
+	}
+	s.lock.RUnlock()
+
+	for name, vm := range expired {
+		logger := log.WithFields(log.Fields{"vmName": name, "owner": vm.getOwner()})
+		vm.record(timeline.KindLifecycle, "expired", "VM reached its tenant's TTL", nil)
+		if _, err := s.DestroyVM(ctx, &serverapi.VMRequest{VmName: serverapi.PtrString(name)}); err != nil {
+			logger.WithError(err).Warn("Failed to destroy expired VM")
+			continue
+		}
+		logger.Info("Destroyed VM at its tenant's TTL")
+	}
+}
+
+// DestroyExpiredVMsPeriodically destroys the VMs whose tenant's TTL ran out,
+// until ctx is done.
+func (s *Server) DestroyExpiredVMsPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(tenantExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.destroyExpiredVMs(ctx, now)
+		}
+	}
+}
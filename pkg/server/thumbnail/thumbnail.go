@@ -0,0 +1,80 @@
+// Package thumbnail downscales screenshots of VMs into the JPEG thumbnails
+// streamed to dashboards watching a fleet of sandboxes.
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+)
+
+// Quality of the JPEG thumbnails, enough to tell what a page shows.
+const Quality = 70
+
+// Scale returns img scaled down to width, keeping its aspect ratio. Every
+// pixel of the thumbnail averages the pixels of img it covers, so that text
+// blurs rather than flickers between frames. Images no wider than width are
+// returned as is.
+func Scale(img image.Image, width int) image.Image {
+	sw, sh := img.Bounds().Dx(), img.Bounds().Dy()
+	if width <= 0 || sw <= width {
+		return img
+	}
+	src := toRGBA(img)
+	height := sh * width / sw
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// toRGBA returns img as an RGBA image whose bounds start at the origin.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// JPEG returns img scaled down to width and encoded as a JPEG, along with
+// its size.
+func JPEG(img image.Image, width int) ([]byte, image.Point, error) {
+	thumb := Scale(img, width)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: Quality}); err != nil {
+		return nil, image.Point{}, err
+	}
+	return buf.Bytes(), thumb.Bounds().Size(), nil
+}
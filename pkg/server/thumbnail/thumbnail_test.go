@@ -0,0 +1,53 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestScale(t *testing.T) {
+	// Black and white columns average to grey.
+	src := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			c := color.RGBA{0, 0, 0, 255}
+			if x%2 == 1 {
+				c = color.RGBA{255, 255, 255, 255}
+			}
+			src.SetRGBA(x, y, c)
+		}
+	}
+	thumb := Scale(src, 4)
+	if size := thumb.Bounds().Size(); size != (image.Point{4, 2}) {
+		t.Fatalf("size = %v, want 4x2", size)
+	}
+	if got := thumb.At(1, 1).(color.RGBA); got != (color.RGBA{127, 127, 127, 255}) {
+		t.Errorf("pixel = %v, want grey", got)
+	}
+
+	if Scale(src, 16) != image.Image(src) {
+		t.Error("narrower image scaled up")
+	}
+	// Sub-images are scaled from their own origin.
+	sub := src.SubImage(image.Rect(2, 0, 6, 4))
+	if size := Scale(sub, 2).Bounds().Size(); size != (image.Point{2, 2}) {
+		t.Errorf("size of the scaled sub-image = %v, want 2x2", size)
+	}
+}
+
+func TestJPEG(t *testing.T) {
+	data, size, err := JPEG(image.NewRGBA(image.Rect(0, 0, 1280, 800)), 320)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != (image.Point{320, 200}) {
+		t.Errorf("size = %v, want 320x200", size)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width != 320 || cfg.Height != 200 {
+		t.Errorf("decoded %+v, %v, want a 320x200 JPEG", cfg, err)
+	}
+}
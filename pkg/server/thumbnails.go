@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/server/thumbnail"
+)
+
+const (
+	defaultThumbnailWidth    = 320
+	maxThumbnailWidth        = 1280
+	defaultThumbnailInterval = 5 * time.Second
+	// minThumbnailInterval keeps dashboards from turning the stream into
+	// screen sharing, which the noVNC proxy is for.
+	minThumbnailInterval = time.Second
+	// thumbnailConcurrency bounds the VMs captured at once.
+	thumbnailConcurrency = 8
+)
+
+// ThumbnailOptions select what StreamThumbnails captures.
+type ThumbnailOptions struct {
+	// Source is "desktop", the default, or "browser", the first page of the
+	// VM's Chrome.
+	Source string
+	// Width of the thumbnails, 320 pixels by default.
+	Width int
+	// Interval between two captures of a VM, 5s by default.
+	Interval time.Duration
+	// VMs restricts the stream to the VMs named, every running VM if empty.
+	VMs []string
+	// Owner restricts the stream to the VMs of a tenant, if set.
+	Owner string
+}
+
+// Thumbnail is a downscaled screenshot of a running VM, or why it couldn't
+// be taken.
+type Thumbnail struct {
+	VMName     string    `json:"vmName"`
+	Source     string    `json:"source"`
+	CapturedAt time.Time `json:"capturedAt"`
+	Width      int       `json:"width,omitempty"`
+	Height     int       `json:"height,omitempty"`
+	// JPEG is the thumbnail, base64 encoded in JSON.
+	JPEG  []byte `json:"jpeg,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// StreamThumbnails captures every running VM, or those of opts.VMs, every
+// interval and sends their thumbnails on the returned channel, which is
+// closed once ctx is done. VMs started meanwhile join the stream. A capture
+// that fails is sent as a thumbnail with an Error, e.g. for VMs without a
+// desktop.
+func (s *Server) StreamThumbnails(ctx context.Context, opts ThumbnailOptions) (<-chan Thumbnail, error) {
+	if opts.Source == "" {
+		opts.Source = ocrSourceDesktop
+	}
+	if opts.Source != ocrSourceDesktop && opts.Source != ocrSourceBrowser {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown source %q, must be %s or %s", opts.Source, ocrSourceDesktop, ocrSourceBrowser)
+	}
+	if opts.Width == 0 {
+		opts.Width = defaultThumbnailWidth
+	}
+	if opts.Width < 0 || opts.Width > maxThumbnailWidth {
+		return nil, status.Errorf(codes.InvalidArgument, "width must be between 1 and %d", maxThumbnailWidth)
+	}
+	if opts.Interval == 0 {
+		opts.Interval = defaultThumbnailInterval
+	}
+	if opts.Interval < minThumbnailInterval {
+		return nil, status.Errorf(codes.InvalidArgument, "interval must be at least %s", minThumbnailInterval)
+	}
+	for _, name := range opts.VMs {
+		if vm := s.getVMAtomic(name); vm == nil || (opts.Owner != "" && vm.getOwner() != opts.Owner) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", name))
+		}
+	}
+
+	thumbnails := make(chan Thumbnail)
+	go func() {
+		defer close(thumbnails)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			s.captureThumbnails(ctx, opts, thumbnails)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return thumbnails, nil
+}
+
+// captureThumbnails captures the running VMs selected by opts once, sending
+// their thumbnails ordered by VM name.
+func (s *Server) captureThumbnails(ctx context.Context, opts ThumbnailOptions, thumbnails chan<- Thumbnail) {
+	type target struct {
+		name         string
+		ip           string
+		devToolsPort int
+	}
+	wanted := make(map[string]bool)
+	for _, name := range opts.VMs {
+		wanted[name] = true
+	}
+	var targets []target
+	s.lock.RLock()
+	for _, vm := range s.vms {
+		vm.lock.RLock()
+		if vm.status == vmStatusRunning && vm.ip != nil && (len(wanted) == 0 || wanted[vm.name]) && (opts.Owner == "" || vm.owner == opts.Owner) {
+			targets = append(targets, target{name: vm.name, ip: vm.ip.IP.String(), devToolsPort: vm.devToolsPort()})
+		}
+		vm.lock.RUnlock()
+	}
+	s.lock.RUnlock()
+	sort.Slice(targets, func(i, j int) bool { return targets[i].name < targets[j].name })
+
+	results := make([]Thumbnail, len(targets))
+	sem := make(chan struct{}, thumbnailConcurrency)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = s.captureThumbnail(ctx, t.name, t.ip, t.devToolsPort, opts)
+		}()
+	}
+	wg.Wait()
+
+	for _, thumb := range results {
+		select {
+		case thumbnails <- thumb:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// captureThumbnail captures the VM vmName at vmIP, whose browser serves the
+// DevTools protocol on devToolsPort.
+func (s *Server) captureThumbnail(ctx context.Context, vmName string, vmIP string, devToolsPort int, opts ThumbnailOptions) Thumbnail {
+	thumb := Thumbnail{VMName: vmName, Source: opts.Source}
+	captureCtx, cancel := context.WithTimeout(ctx, screenCaptureTimeout)
+	defer cancel()
+
+	var img image.Image
+	var err error
+	switch opts.Source {
+	case ocrSourceDesktop:
+		port, _ := cmdserver.DesktopPort(cmdserver.DefaultDisplay)
+		img, err = s.captureDesktopImage(captureCtx, net.JoinHostPort(vmIP, strconv.Itoa(port)))
+	case ocrSourceBrowser:
+		var screenshot []byte
+		screenshot, err = captureBrowser(captureCtx, net.JoinHostPort(vmIP, strconv.Itoa(devToolsPort)), "")
+		if err == nil {
+			img, err = png.Decode(bytes.NewReader(screenshot))
+		}
+	}
+	thumb.CapturedAt = time.Now()
+	if err != nil {
+		thumb.Error = fmt.Sprintf("failed to capture the %s: %v", opts.Source, err)
+		return thumb
+	}
+	data, size, err := thumbnail.JPEG(img, opts.Width)
+	if err != nil {
+		thumb.Error = fmt.Sprintf("failed to encode the thumbnail: %v", err)
+		return thumb
+	}
+	thumb.JPEG, thumb.Width, thumb.Height = data, size.X, size.Y
+	return thumb
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+	"github.com/abshkbh/arrakis/pkg/server/audit"
+	"github.com/abshkbh/arrakis/pkg/server/bootprogress"
+	"github.com/abshkbh/arrakis/pkg/server/timeline"
+)
+
+const (
+	// timelineFilename keeps a VM's timeline in its state directory.
+	timelineFilename = "timeline.jsonl"
+	// timelineServicesTimeout bounds asking the guest agent for the health of
+	// its services when listing a timeline.
+	timelineServicesTimeout = 5 * time.Second
+	// maxTimelineCommandLength truncates the commands recorded.
+	maxTimelineCommandLength = 1024
+)
+
+// openTimeline opens the timeline in a VM's state directory, starting an
+// empty one if it can't be read.
+func openTimeline(stateDir string) *timeline.Journal {
+	filePath := path.Join(stateDir, timelineFilename)
+	journal, err := timeline.Open(filePath, timeline.DefaultMaxEntries)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to read timeline %s, starting a new one", filePath)
+		journal = timeline.New(filePath, timeline.DefaultMaxEntries)
+	}
+	return journal
+}
+
+// record adds an entry to the VM's timeline and to the audit log of its
+// owner. Failing to save it is logged and never fails the operation recorded.
+func (v *vm) record(kind string, action string, summary string, details map[string]string) {
+	v.lock.RLock()
+	name, owner, id := v.name, v.owner, v.id
+	v.lock.RUnlock()
+	now := time.Now().UTC()
+	err := v.timeline.Record(timeline.Entry{
+		Time:    now,
+		Kind:    kind,
+		Action:  action,
+		Summary: summary,
+		Details: details,
+	})
+	if err != nil {
+		log.WithField("vmName", name).WithError(err).Warn("Failed to record timeline entry")
+	}
+	err = v.audit.Append(audit.Record{
+		Time:    now,
+		Tenant:  owner,
+		VM:      name,
+		VMID:    id,
+		Kind:    kind,
+		Action:  action,
+		Summary: summary,
+		Details: details,
+	})
+	if err != nil {
+		log.WithField("vmName", name).WithError(err).Warn("Failed to record audit record")
+	}
+}
+
+// recordCommand records a command run in the VM and how it went.
+func (v *vm) recordCommand(cmd string, blocking bool, resp *serverapi.VmCommandResponse, err error) {
+	if len(cmd) > maxTimelineCommandLength {
+		cmd = cmd[:maxTimelineCommandLength] + "..."
+	}
+	details := map[string]string{
+		"command":  cmd,
+		"blocking": strconv.FormatBool(blocking),
+	}
+	summary := "Ran command"
+	if err == nil && resp.GetError() != "" {
+		err = fmt.Errorf("%s", resp.GetError())
+	}
+	if err != nil {
+		summary = "Command failed"
+		details["error"] = err.Error()
+	}
+	if resp != nil && resp.LimitExceeded != nil {
+		summary = "Command exceeded its limits"
+		details["limit"] = resp.LimitExceeded.GetLimit()
+	}
+	v.record(timeline.KindExec, "command", summary, details)
+}
+
+// VMTimeline returns what happened to a VM in chronological order: its
+// lifecycle, the commands run and terminals opened in it, its recordings,
+// snapshots and downloads, and the health of its boot and services.
+func (s *Server) VMTimeline(ctx context.Context, vmName string, f timeline.Filter) (*serverapi.VmTimelineResponse, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	entries := timeline.Merge(f, vm.timeline.Entries(), bootTimeline(s.bootProgress(vmName)), vm.servicesTimeline(ctx))
+	resp := &serverapi.VmTimelineResponse{
+		VmName:  serverapi.PtrString(vmName),
+		Entries: make([]serverapi.VmTimelineEntry, len(entries)),
+	}
+	for i, e := range entries {
+		resp.Entries[i] = serverapi.VmTimelineEntry{
+			Time:    serverapi.PtrTime(e.Time),
+			Kind:    serverapi.PtrString(e.Kind),
+			Action:  serverapi.PtrString(e.Action),
+			Summary: serverapi.PtrString(e.Summary),
+		}
+		if len(e.Details) > 0 {
+			resp.Entries[i].Details = &e.Details
+		}
+	}
+	return resp, nil
+}
+
+// bootTimeline returns the phases the latest boot reached.
+func bootTimeline(progress *bootprogress.Progress) []timeline.Entry {
+	events := progress.Events()
+	entries := make([]timeline.Entry, 0, len(events))
+	for _, e := range events {
+		entry := timeline.Entry{
+			Time:    e.Time,
+			Kind:    timeline.KindHealth,
+			Action:  "boot_" + string(e.Phase),
+			Summary: fmt.Sprintf("Boot reached %s after %dms", e.Phase, e.ElapsedMs),
+		}
+		if e.Error != "" {
+			entry.Summary = fmt.Sprintf("Boot failed after %dms", e.ElapsedMs)
+			entry.Details = map[string]string{"error": e.Error}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// servicesTimeline returns when each service of a running VM entered its
+// current state, or nothing if the guest agent doesn't answer.
+func (v *vm) servicesTimeline(ctx context.Context) []timeline.Entry {
+	v.lock.RLock()
+	vmStatus := v.status
+	v.lock.RUnlock()
+	if vmStatus != vmStatusRunning {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timelineServicesTimeout)
+	defer cancel()
+	services, err := v.guestServices(ctx)
+	if err != nil {
+		log.WithField("vmName", v.name).WithError(err).Debug("Leaving service health out of the timeline")
+		return nil
+	}
+	entries := make([]timeline.Entry, 0, len(services))
+	for _, h := range services {
+		if h.Since.IsZero() {
+			continue
+		}
+		entry := timeline.Entry{
+			Time:    h.Since,
+			Kind:    timeline.KindHealth,
+			Action:  "service_" + string(h.State),
+			Summary: fmt.Sprintf("Service %s is %s", h.Name, h.State),
+			Details: map[string]string{
+				"service": h.Name,
+				"port":    strconv.Itoa(h.Port),
+			},
+		}
+		if h.Reason != "" {
+			entry.Details["reason"] = h.Reason
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,221 @@
+// Package timeline records what happens to a VM, such as its lifecycle,
+// commands, recordings, snapshots and downloads, so that a sandbox session can
+// be reconstructed from one place.
+package timeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kinds of entries.
+const (
+	KindLifecycle = "lifecycle"
+	KindExec      = "exec"
+	KindRecording = "recording"
+	KindSnapshot  = "snapshot"
+	KindDownload  = "download"
+	KindHealth    = "health"
+)
+
+// DefaultMaxEntries bounds the entries kept of a VM, the oldest are dropped.
+const DefaultMaxEntries = 1000
+
+// Entry is something that happened to a VM.
+type Entry struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Action within the kind, e.g. "started" or "stopped" for lifecycle
+	// entries.
+	Action  string            `json:"action"`
+	Summary string            `json:"summary"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Journal is the timeline of one VM, kept in memory and appended to a file
+// of JSON lines so that it survives restarts of the server. All methods are
+// safe on a nil Journal, which records nothing.
+type Journal struct {
+	mu         sync.Mutex
+	path       string
+	maxEntries int
+	entries    []Entry
+	// lines is how many entries the file holds, compacted once it holds
+	// twice maxEntries.
+	lines int
+}
+
+// New returns an empty journal saved to path, replacing what the file holds
+// once it's compacted.
+func New(path string, maxEntries int) *Journal {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &Journal{path: path, maxEntries: maxEntries}
+}
+
+// Open loads the journal at path, if any, keeping its last maxEntries
+// entries.
+func Open(path string, maxEntries int) (*Journal, error) {
+	j := New(path, maxEntries)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry Entry
+		// Skips a line cut short by a crash.
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		j.lines++
+		j.entries = append(j.entries, entry)
+		if len(j.entries) > j.maxEntries {
+			j.entries = j.entries[1:]
+		}
+	}
+	return j, scanner.Err()
+}
+
+// SetPath moves the journal's file to path, e.g. after the VM's state
+// directory was renamed along with its file.
+func (j *Journal) SetPath(path string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.path = path
+}
+
+// Record adds e, at the current time unless it has one.
+func (j *Journal) Record(e Entry) error {
+	if j == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, e)
+	if len(j.entries) > j.maxEntries {
+		j.entries = j.entries[len(j.entries)-j.maxEntries:]
+	}
+	if j.lines+1 >= 2*j.maxEntries {
+		return j.compact()
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	j.lines++
+	return nil
+}
+
+// compact rewrites the file with the entries in memory only.
+func (j *Journal) compact() error {
+	tmp := j.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, e := range j.entries {
+		if err := encoder.Encode(e); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", j.path, err)
+	}
+	j.lines = len(j.entries)
+	return nil
+}
+
+// Entries returns the entries recorded, oldest first.
+func (j *Journal) Entries() []Entry {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]Entry(nil), j.entries...)
+}
+
+// Filter selects entries. Empty fields match everything.
+type Filter struct {
+	Kinds []string
+	// Since and Until bound when entries happened.
+	Since time.Time
+	Until time.Time
+	// Limit keeps the latest Limit entries, all if 0.
+	Limit int
+}
+
+func (f Filter) matches(e Entry) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	if len(f.Kinds) == 0 {
+		return true
+	}
+	for _, kind := range f.Kinds {
+		if e.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge returns the entries of every list matching f in chronological
+// order, entries of the same time in the order given.
+func Merge(f Filter, lists ...[]Entry) []Entry {
+	merged := []Entry{}
+	for _, list := range lists {
+		for _, e := range list {
+			if f.matches(e) {
+				merged = append(merged, e)
+			}
+		}
+	}
+	sort.SliceStable(merged, func(a, b int) bool {
+		return merged[a].Time.Before(merged[b].Time)
+	})
+	if f.Limit > 0 && len(merged) > f.Limit {
+		merged = merged[len(merged)-f.Limit:]
+	}
+	return merged
+}
@@ -0,0 +1,98 @@
+package timeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timeline.jsonl")
+	j, err := Open(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{"started", "paused", "resumed", "stopped"} {
+		if err := j.Record(Entry{Kind: KindLifecycle, Action: action}); err != nil {
+			t.Fatalf("Record(%s) = %v", action, err)
+		}
+	}
+	entries := j.Entries()
+	if len(entries) != 3 || entries[0].Action != "paused" || entries[2].Action != "stopped" || entries[2].Time.IsZero() {
+		t.Errorf("Entries() = %+v, want the last 3", entries)
+	}
+
+	// Reopened, e.g. after a restart.
+	reopened, err := Open(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Entries(); len(got) != 3 || got[0].Action != "paused" {
+		t.Errorf("Entries() after reopening = %+v", got)
+	}
+
+	// The file is compacted rather than growing forever.
+	for i := 0; i < 10; i++ {
+		reopened.Record(Entry{Kind: KindExec, Action: "command"})
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines >= 6 {
+		t.Errorf("file holds %d entries, want fewer than 6", lines)
+	}
+
+	var none *Journal
+	if err := none.Record(Entry{Kind: KindExec}); err != nil || none.Entries() != nil {
+		t.Errorf("a nil journal recorded something")
+	}
+}
+
+func TestOpenSkipsTruncatedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timeline.jsonl")
+	content := `{"time":"2026-01-01T00:00:00Z","kind":"lifecycle","action":"started","summary":"VM started"}` + "\n" + `{"time":"2026-01-01T00:0`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := j.Entries(); len(entries) != 1 || entries[0].Action != "started" {
+		t.Errorf("Entries() = %+v", entries)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	at := func(minute int) time.Time {
+		return time.Date(2026, 1, 1, 0, minute, 0, 0, time.UTC)
+	}
+	journal := []Entry{
+		{Time: at(1), Kind: KindLifecycle, Action: "started"},
+		{Time: at(5), Kind: KindExec, Action: "command"},
+		{Time: at(9), Kind: KindLifecycle, Action: "stopped"},
+	}
+	health := []Entry{
+		{Time: at(2), Kind: KindHealth, Action: "agent_up"},
+		{Time: at(5), Kind: KindHealth, Action: "up"},
+	}
+
+	var actions []string
+	for _, e := range Merge(Filter{}, journal, health) {
+		actions = append(actions, e.Action)
+	}
+	if got := strings.Join(actions, ","); got != "started,agent_up,command,up,stopped" {
+		t.Errorf("Merge() = %s", got)
+	}
+
+	filtered := Merge(Filter{Kinds: []string{KindLifecycle, KindHealth}, Since: at(2), Until: at(9)}, journal, health)
+	if len(filtered) != 2 || filtered[0].Action != "agent_up" || filtered[1].Action != "up" {
+		t.Errorf("Merge() with a filter = %+v", filtered)
+	}
+	if latest := Merge(Filter{Limit: 1}, journal, health); len(latest) != 1 || latest[0].Action != "stopped" {
+		t.Errorf("Merge() with a limit = %+v", latest)
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/server/usage"
+)
+
+const (
+	usageFilename              = "usage.json"
+	defaultUsageSampleInterval = 30 * time.Second
+	defaultUsageRetention      = 90 * 24 * time.Hour
+	// Bounds reading the session totals from a guest.
+	guestSessionsTimeout = 2 * time.Second
+)
+
+// usageSample is the state of a VM when its usage was last sampled, against
+// which the next sample's usage is computed.
+type usageSample struct {
+	at       time.Time
+	rxBytes  uint64
+	txBytes  uint64
+	sessions map[string]float64
+}
+
+// usageMeter tracks the last sample of every VM. Samples are keyed by VM
+// rather than name so that renamed VMs keep accruing where they left off.
+type usageMeter struct {
+	lock    sync.Mutex
+	samples map[*vm]*usageSample
+}
+
+// AccountUsage samples the usage of every VM each sample interval until ctx
+// is done, then saves the ledger a last time.
+func (s *Server) AccountUsage(ctx context.Context) {
+	interval := s.config.Usage.SampleInterval
+	if interval == 0 {
+		interval = defaultUsageSampleInterval
+	}
+	retention := s.config.Usage.Retention
+	if retention == 0 {
+		retention = defaultUsageRetention
+	}
+	usagePath := path.Join(s.config.StateDir, usageFilename)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.usage.Save(usagePath); err != nil {
+				log.WithError(err).Error("Failed to save usage")
+			}
+			return
+		case now := <-ticker.C:
+			s.lock.RLock()
+			vms := make([]*vm, 0, len(s.vms))
+			for _, vm := range s.vms {
+				vms = append(vms, vm)
+			}
+			s.lock.RUnlock()
+
+			for _, vm := range vms {
+				s.sampleUsage(ctx, vm, now)
+			}
+			s.forgetUsage(vms)
+			s.usage.Prune(now.Add(-retention))
+			if err := s.usage.Save(usagePath); err != nil {
+				log.WithError(err).Error("Failed to save usage")
+			}
+		}
+	}
+}
+
+// sampleUsage records what a VM consumed since it was last sampled. The first
+// sample of a VM only sets the baseline.
+func (s *Server) sampleUsage(ctx context.Context, vm *vm, now time.Time) {
+	vm.lock.RLock()
+	vmName, owner, vmStatus := vm.name, vm.owner, vm.status
+	var tapName, vmIP string
+	if vm.tapDevice != nil {
+		tapName = vm.tapDevice.Name
+	}
+	if vm.ip != nil {
+		vmIP = vm.ip.IP.String()
+	}
+	vm.lock.RUnlock()
+
+	// The tap device's receive counters are what the guest sent.
+	current := &usageSample{
+		at:      now,
+		rxBytes: tapCounter(tapName, "tx_bytes"),
+		txBytes: tapCounter(tapName, "rx_bytes"),
+	}
+	if vmStatus == vmStatusRunning && vmIP != "" {
+		ctx, cancel := context.WithTimeout(ctx, guestSessionsTimeout)
+		totals, err := cmdserver.FetchSessionTotals(ctx, vm.agent.client(0), vm.agent.url(vmIP, "/sessions"))
+		cancel()
+		if err != nil {
+			log.WithField("vmName", vmName).WithError(err).Debug("Failed to read guest sessions")
+		} else {
+			current.sessions = totals.Seconds
+		}
+	}
+
+	s.usageMeter.lock.Lock()
+	defer s.usageMeter.lock.Unlock()
+	last, sampled := s.usageMeter.samples[vm]
+	if current.sessions == nil && sampled {
+		// Keep the previous totals so sessions aren't counted twice once the
+		// guest answers again.
+		current.sessions = last.sessions
+	}
+	s.usageMeter.samples[vm] = current
+	if !sampled {
+		return
+	}
+
+	elapsed := now.Sub(last.at)
+	var u usage.Usage
+	switch vmStatus {
+	case vmStatusRunning:
+		u.VCPUSeconds = float64(calculateVCPUCount()) * elapsed.Seconds()
+		u.MemoryGBHours = s.guestMemoryGB() * elapsed.Hours()
+	case vmStatusPaused:
+		u.MemoryGBHours = s.guestMemoryGB() * elapsed.Hours()
+	}
+	u.DiskGBHours = float64(s.config.StatefulSizeInMB) / 1024 * elapsed.Hours()
+	u.NetworkRxBytes = counterDelta(last.rxBytes, current.rxBytes)
+	u.NetworkTxBytes = counterDelta(last.txBytes, current.txBytes)
+	for kind, seconds := range current.sessions {
+		delta := seconds - last.sessions[kind]
+		if delta < 0 {
+			// The agent restarted and its totals started over.
+			delta = seconds
+		}
+		if err := u.AddSession(kind, time.Duration(delta*float64(time.Second))); err != nil {
+			log.WithField("vmName", vmName).WithError(err).Debug("Ignoring guest session")
+		}
+	}
+	s.usage.Record(now, vmName, owner, u)
+}
+
+// forgetUsage drops the samples of VMs that no longer exist.
+func (s *Server) forgetUsage(current []*vm) {
+	exists := make(map[*vm]bool, len(current))
+	for _, vm := range current {
+		exists[vm] = true
+	}
+	s.usageMeter.lock.Lock()
+	defer s.usageMeter.lock.Unlock()
+	for vm := range s.usageMeter.samples {
+		if !exists[vm] {
+			delete(s.usageMeter.samples, vm)
+		}
+	}
+}
+
+// guestMemoryGB is the memory every VM is given.
+func (s *Server) guestMemoryGB() float64 {
+	memoryMB, err := calculateGuestMemorySizeInMB(s.config.GuestMemPercentage)
+	if err != nil {
+		return 0
+	}
+	return float64(memoryMB) / 1024
+}
+
+// tapCounter reads one of a tap device's statistics, e.g. "rx_bytes".
+func tapCounter(tapName string, counter string) uint64 {
+	if tapName == "" {
+		return 0
+	}
+	data, err := os.ReadFile(path.Join("/sys/class/net", tapName, "statistics", counter))
+	if err != nil {
+		return 0
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// counterDelta returns how much a counter grew, treating a decrease as the
+// counter having been reset.
+func counterDelta(last uint64, current uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// RecordSession accounts a session a host side proxy relayed to a VM, e.g. a
+// CDP session.
+func (s *Server) RecordSession(ctx context.Context, vmName string, kind string, d time.Duration) error {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	owner := vm.owner
+	vm.lock.RUnlock()
+
+	var u usage.Usage
+	if err := u.AddSession(kind, d); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	s.usage.Record(time.Now(), vmName, owner, u)
+	return nil
+}
+
+// Usage reports the usage recorded for the VMs and owners matching q.
+func (s *Server) Usage(ctx context.Context, q usage.Query) usage.Report {
+	return s.usage.Query(q)
+}
@@ -0,0 +1,268 @@
+package usage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+)
+
+// BucketSize is the granularity usage is kept at. Queries are rounded out to
+// whole buckets.
+const BucketSize = time.Hour
+
+// Usage is the resources consumed by a VM, or a sum over VMs.
+type Usage struct {
+	// VCPUSeconds accrue while the VM is running.
+	VCPUSeconds float64 `json:"vcpuSeconds"`
+	// MemoryGBHours accrue while the VM is running or paused.
+	MemoryGBHours float64 `json:"memoryGbHours"`
+	// DiskGBHours accrue for the VM's stateful disk for as long as it exists.
+	DiskGBHours float64 `json:"diskGbHours"`
+	// Network bytes are from the guest's point of view.
+	NetworkRxBytes    uint64  `json:"networkRxBytes"`
+	NetworkTxBytes    uint64  `json:"networkTxBytes"`
+	CDPSessionMinutes float64 `json:"cdpSessionMinutes"`
+	VNCSessionMinutes float64 `json:"vncSessionMinutes"`
+}
+
+// Add accumulates o into u.
+func (u *Usage) Add(o Usage) {
+	u.VCPUSeconds += o.VCPUSeconds
+	u.MemoryGBHours += o.MemoryGBHours
+	u.DiskGBHours += o.DiskGBHours
+	u.NetworkRxBytes += o.NetworkRxBytes
+	u.NetworkTxBytes += o.NetworkTxBytes
+	u.CDPSessionMinutes += o.CDPSessionMinutes
+	u.VNCSessionMinutes += o.VNCSessionMinutes
+}
+
+// AddSession accounts a proxied session of the given kind.
+func (u *Usage) AddSession(kind string, d time.Duration) error {
+	switch kind {
+	case cmdserver.SessionCDP:
+		u.CDPSessionMinutes += d.Minutes()
+	case cmdserver.SessionVNC:
+		u.VNCSessionMinutes += d.Minutes()
+	default:
+		return fmt.Errorf("unknown session kind: %q", kind)
+	}
+	return nil
+}
+
+// Entry is the usage of one VM while it belonged to one tenant. A VM that
+// changed owners has an entry per owner.
+type Entry struct {
+	VM     string `json:"vmName"`
+	Tenant string `json:"owner"`
+	Usage
+}
+
+// Query selects usage. Empty fields match everything.
+type Query struct {
+	Tenant string
+	VM     string
+	From   time.Time
+	To     time.Time
+}
+
+// Report is the result of a query: usage per VM, per tenant and in total.
+type Report struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	VMs     []Entry   `json:"vms"`
+	Tenants []Entry   `json:"tenants"`
+	Total   Usage     `json:"total"`
+}
+
+type bucket struct {
+	Start  time.Time `json:"start"`
+	VM     string    `json:"vmName"`
+	Tenant string    `json:"owner"`
+	Usage  Usage     `json:"usage"`
+}
+
+type bucketKey struct {
+	start  time.Time
+	vm     string
+	tenant string
+}
+
+// Ledger accumulates usage in hourly buckets per VM and tenant.
+type Ledger struct {
+	buckets map[bucketKey]*bucket
+	mutex   sync.Mutex
+}
+
+// NewLedger returns an empty ledger.
+func NewLedger() *Ledger {
+	return &Ledger{
+		buckets: make(map[bucketKey]*bucket),
+	}
+}
+
+// Record adds usage consumed by vm, owned by tenant, at the given time.
+func (l *Ledger) Record(at time.Time, vm string, tenant string, u Usage) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := bucketKey{start: at.UTC().Truncate(BucketSize), vm: vm, tenant: tenant}
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{Start: key.start, VM: vm, Tenant: tenant}
+		l.buckets[key] = b
+	}
+	b.Usage.Add(u)
+}
+
+// Query sums the usage matching q. A zero To means now.
+func (l *Ledger) Query(q Query) Report {
+	from := q.From.UTC().Truncate(BucketSize)
+	to := q.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	to = to.UTC()
+
+	vms := make(map[[2]string]*Entry)
+	tenants := make(map[string]*Entry)
+	report := Report{From: from, To: to}
+
+	l.mutex.Lock()
+	for _, b := range l.buckets {
+		if b.Start.Before(from) || !b.Start.Before(to) {
+			continue
+		}
+		if (q.Tenant != "" && b.Tenant != q.Tenant) || (q.VM != "" && b.VM != q.VM) {
+			continue
+		}
+		vmKey := [2]string{b.VM, b.Tenant}
+		if vms[vmKey] == nil {
+			vms[vmKey] = &Entry{VM: b.VM, Tenant: b.Tenant}
+		}
+		vms[vmKey].Add(b.Usage)
+		if tenants[b.Tenant] == nil {
+			tenants[b.Tenant] = &Entry{Tenant: b.Tenant}
+		}
+		tenants[b.Tenant].Add(b.Usage)
+		report.Total.Add(b.Usage)
+	}
+	l.mutex.Unlock()
+
+	report.VMs = make([]Entry, 0, len(vms))
+	for _, e := range vms {
+		report.VMs = append(report.VMs, *e)
+	}
+	sort.Slice(report.VMs, func(i, j int) bool {
+		if report.VMs[i].Tenant != report.VMs[j].Tenant {
+			return report.VMs[i].Tenant < report.VMs[j].Tenant
+		}
+		return report.VMs[i].VM < report.VMs[j].VM
+	})
+	report.Tenants = make([]Entry, 0, len(tenants))
+	for _, e := range tenants {
+		report.Tenants = append(report.Tenants, *e)
+	}
+	sort.Slice(report.Tenants, func(i, j int) bool {
+		return report.Tenants[i].Tenant < report.Tenants[j].Tenant
+	})
+	return report
+}
+
+// Prune drops buckets that started before the given time.
+func (l *Ledger) Prune(before time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for key := range l.buckets {
+		if key.start.Before(before) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Save writes the ledger to path, replacing it atomically.
+func (l *Ledger) Save(path string) error {
+	l.mutex.Lock()
+	buckets := make([]bucket, 0, len(l.buckets))
+	for _, b := range l.buckets {
+		buckets = append(buckets, *b)
+	}
+	l.mutex.Unlock()
+
+	data, err := json.Marshal(buckets)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write usage: %w", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Load adds the usage saved at path to the ledger. A missing file is not an
+// error.
+func (l *Ledger) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read usage: %w", err)
+	}
+	var buckets []bucket
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		return fmt.Errorf("failed to parse usage %s: %w", path, err)
+	}
+	for _, b := range buckets {
+		l.Record(b.Start, b.VM, b.Tenant, b.Usage)
+	}
+	return nil
+}
+
+var csvHeader = []string{
+	"from", "to", "owner", "vm_name",
+	"vcpu_seconds", "memory_gb_hours", "disk_gb_hours",
+	"network_rx_bytes", "network_tx_bytes",
+	"cdp_session_minutes", "vnc_session_minutes",
+}
+
+// WriteCSV writes the report's per VM usage as CSV for chargeback, one row
+// per VM and owner.
+func (r Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', 4, 64)
+	}
+	for _, e := range r.VMs {
+		row := []string{
+			r.From.Format(time.RFC3339),
+			r.To.Format(time.RFC3339),
+			e.Tenant,
+			e.VM,
+			formatFloat(e.VCPUSeconds),
+			formatFloat(e.MemoryGBHours),
+			formatFloat(e.DiskGBHours),
+			strconv.FormatUint(e.NetworkRxBytes, 10),
+			strconv.FormatUint(e.NetworkTxBytes, 10),
+			formatFloat(e.CDPSessionMinutes),
+			formatFloat(e.VNCSessionMinutes),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
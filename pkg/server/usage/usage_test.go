@@ -0,0 +1,84 @@
+package usage
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+)
+
+func TestLedgerQuery(t *testing.T) {
+	l := NewLedger()
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	l.Record(day.Add(10*time.Minute), "vm1", "acme", Usage{VCPUSeconds: 60, NetworkRxBytes: 100})
+	l.Record(day.Add(20*time.Minute), "vm1", "acme", Usage{VCPUSeconds: 60})
+	l.Record(day.Add(90*time.Minute), "vm1", "globex", Usage{VCPUSeconds: 30})
+	l.Record(day.Add(30*time.Minute), "vm2", "acme", Usage{DiskGBHours: 2})
+	l.Record(day.Add(48*time.Hour), "vm2", "acme", Usage{DiskGBHours: 5})
+
+	report := l.Query(Query{Tenant: "acme", From: day.Add(5 * time.Minute), To: day.Add(24 * time.Hour)})
+	if !report.From.Equal(day) {
+		t.Errorf("From = %v, want rounded down to %v", report.From, day)
+	}
+	if len(report.VMs) != 2 {
+		t.Fatalf("VMs = %+v, want vm1 and vm2", report.VMs)
+	}
+	if vm1 := report.VMs[0]; vm1.VM != "vm1" || vm1.VCPUSeconds != 120 || vm1.NetworkRxBytes != 100 {
+		t.Errorf("vm1 = %+v", vm1)
+	}
+	if report.Total.DiskGBHours != 2 || report.Total.VCPUSeconds != 120 {
+		t.Errorf("Total = %+v", report.Total)
+	}
+
+	// A VM that changed owners is reported once per owner.
+	report = l.Query(Query{VM: "vm1", From: day, To: day.Add(24 * time.Hour)})
+	if len(report.VMs) != 2 || len(report.Tenants) != 2 {
+		t.Errorf("Report for a transferred VM = %+v", report)
+	}
+}
+
+func TestLedgerPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	at := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+
+	l := NewLedger()
+	u := Usage{MemoryGBHours: 1.5}
+	if err := u.AddSession(cmdserver.SessionVNC, 90*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.AddSession("ssh", time.Second); err == nil {
+		t.Error("Accounted an unknown session kind")
+	}
+	l.Record(at, "vm1", "acme", u)
+	l.Record(at.Add(-48*time.Hour), "vm1", "acme", u)
+	l.Prune(at.Add(-24 * time.Hour))
+	if err := l.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded := NewLedger()
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	report := loaded.Query(Query{To: at.Add(time.Hour)})
+	if report.Total.MemoryGBHours != 1.5 || report.Total.VNCSessionMinutes != 1.5 {
+		t.Errorf("Loaded total = %+v, want only the unpruned bucket", report.Total)
+	}
+
+	var csv strings.Builder
+	if err := report.WriteCSV(&csv); err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "from,to,owner,vm_name,") ||
+		!strings.Contains(lines[1], ",acme,vm1,0.0000,1.5000,") {
+		t.Errorf("CSV = %q", csv.String())
+	}
+
+	if err := NewLedger().Load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("Load of a missing file failed: %v", err)
+	}
+}
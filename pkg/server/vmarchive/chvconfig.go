@@ -0,0 +1,273 @@
+package vmarchive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// CHVConfigName is the file of a Cloud Hypervisor snapshot holding the VM's
+// config, which the VMM opens the VM's files from on restore.
+const CHVConfigName = "config.json"
+
+// HostPaths are the files of the importing host a VM restored from an
+// archive may open.
+type HostPaths struct {
+	Kernel       string
+	Initramfs    string
+	Rootfs       string
+	StatefulDisk string
+	VsockSocket  string
+}
+
+// chvConfigSections are the sections of a Cloud Hypervisor config. Those
+// mapped to false hold no path, the others are checked or rewritten by
+// RelocateCHVConfig.
+var chvConfigSections = map[string]bool{
+	"cpus":              false,
+	"memory":            true,
+	"payload":           true,
+	"rate_limit_groups": false,
+	"disks":             true,
+	"net":               true,
+	"rng":               true,
+	"balloon":           false,
+	"fs":                true,
+	"pmem":              true,
+	"serial":            true,
+	"console":           true,
+	"debug_console":     true,
+	"devices":           true,
+	"user_devices":      true,
+	"vdpa":              true,
+	"vsock":             true,
+	"pvpanic":           false,
+	"iommu":             false,
+	"sgx_epc":           true,
+	"numa":              false,
+	"watchdog":          false,
+	"platform":          false,
+	"tpm":               true,
+	"preserved_fds":     true,
+	"landlock_enable":   false,
+	"landlock_rules":    true,
+}
+
+// RelocateCHVConfig rewrites the config of the Cloud Hypervisor snapshot in
+// dir so that the restored VM opens the files in paths rather than those of
+// the exporting host, which anyone crafting an archive could point at any
+// file of this one, opened by the VMM as root. Configs with sections it
+// doesn't know, or with devices backed by other files, are rejected.
+func RelocateCHVConfig(dir string, paths HostPaths) error {
+	p := path.Join(dir, CHVConfigName)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", CHVConfigName, err)
+	}
+	// Numbers are kept as is, some don't fit in a float64.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var config map[string]any
+	if err := dec.Decode(&config); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", CHVConfigName, err)
+	}
+	if err := relocateCHVConfig(config, paths); err != nil {
+		return fmt.Errorf("%s: %w", CHVConfigName, err)
+	}
+	data, err = json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0644)
+}
+
+func relocateCHVConfig(config map[string]any, paths HostPaths) error {
+	for section, value := range config {
+		hasPaths, ok := chvConfigSections[section]
+		if !ok {
+			return fmt.Errorf("unknown section %q", section)
+		}
+		if !hasPaths || isEmpty(value) {
+			continue
+		}
+		var err error
+		switch section {
+		case "memory":
+			err = checkMemory(value)
+		case "payload":
+			err = relocatePayload(value, paths)
+		case "disks":
+			err = relocateDisks(value, paths)
+		case "net":
+			err = checkNet(value)
+		case "rng":
+			err = relocateRNG(value)
+		case "serial", "console", "debug_console":
+			err = checkConsole(value)
+		case "vsock":
+			err = relocateVsock(value, paths)
+		default:
+			// Shared directories, passthrough devices and the like, which
+			// exported VMs don't have.
+			err = fmt.Errorf("%s aren't supported", section)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", section, err)
+		}
+	}
+	return nil
+}
+
+// isEmpty reports whether v is null or an empty value.
+func isEmpty(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
+
+// object returns v as a JSON object.
+func object(v any) (map[string]any, error) {
+	o, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("not an object")
+	}
+	return o, nil
+}
+
+// objects returns v as a list of JSON objects.
+func objects(v any) ([]map[string]any, error) {
+	list, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("not a list")
+	}
+	var out []map[string]any
+	for _, item := range list {
+		o, err := object(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, nil
+}
+
+// checkFields rejects the fields of o that are set and not in allowed.
+func checkFields(o map[string]any, allowed ...string) error {
+	for field, value := range o {
+		if isEmpty(value) {
+			continue
+		}
+		known := false
+		for _, a := range allowed {
+			known = known || a == field
+		}
+		if !known {
+			return fmt.Errorf("%s isn't supported", field)
+		}
+	}
+	return nil
+}
+
+func checkMemory(v any) error {
+	memory, err := object(v)
+	if err != nil {
+		return err
+	}
+	// Memory zones may be backed by files.
+	if !isEmpty(memory["zones"]) {
+		return fmt.Errorf("zones aren't supported")
+	}
+	return nil
+}
+
+func relocatePayload(v any, paths HostPaths) error {
+	payload, err := object(v)
+	if err != nil {
+		return err
+	}
+	if err := checkFields(payload, "kernel", "initramfs", "cmdline"); err != nil {
+		return err
+	}
+	payload["kernel"] = paths.Kernel
+	payload["initramfs"] = nil
+	if paths.Initramfs != "" {
+		payload["initramfs"] = paths.Initramfs
+	}
+	return nil
+}
+
+// relocateDisks points the disks, the rootfs then the stateful disk as
+// created by the server, at those of the host and the VM.
+func relocateDisks(v any, paths HostPaths) error {
+	disks, err := objects(v)
+	if err != nil {
+		return err
+	}
+	if len(disks) != 2 {
+		return fmt.Errorf("got %d disks, want the rootfs and the stateful disk", len(disks))
+	}
+	for _, disk := range disks {
+		if !isEmpty(disk["vhost_user"]) || !isEmpty(disk["vhost_socket"]) {
+			return fmt.Errorf("vhost-user disks aren't supported")
+		}
+	}
+	disks[0]["path"] = paths.Rootfs
+	disks[0]["readonly"] = true
+	disks[1]["path"] = paths.StatefulDisk
+	return nil
+}
+
+func checkNet(v any) error {
+	nets, err := objects(v)
+	if err != nil {
+		return err
+	}
+	for _, net := range nets {
+		if !isEmpty(net["vhost_user"]) || !isEmpty(net["vhost_socket"]) {
+			return fmt.Errorf("vhost-user interfaces aren't supported")
+		}
+	}
+	return nil
+}
+
+func relocateRNG(v any) error {
+	rng, err := object(v)
+	if err != nil {
+		return err
+	}
+	rng["src"] = "/dev/urandom"
+	return nil
+}
+
+// checkConsole rejects consoles writing to a file or a socket.
+func checkConsole(v any) error {
+	console, err := object(v)
+	if err != nil {
+		return err
+	}
+	if !isEmpty(console["file"]) || !isEmpty(console["socket"]) {
+		return fmt.Errorf("consoles backed by files aren't supported")
+	}
+	return nil
+}
+
+func relocateVsock(v any, paths HostPaths) error {
+	vsock, err := object(v)
+	if err != nil {
+		return err
+	}
+	vsock["socket"] = paths.VsockSocket
+	return nil
+}
@@ -0,0 +1,101 @@
+package vmarchive
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testHostPaths = HostPaths{
+	Kernel:       "/var/lib/arrakis/vmlinux",
+	Rootfs:       "/var/lib/arrakis/rootfs.img",
+	StatefulDisk: "/var/lib/arrakis/state/foo/disks/stateful.img",
+	VsockSocket:  "/var/lib/arrakis/state/foo/sockets/vsock.sock",
+}
+
+// relocate writes config to a snapshot dir, relocates it and returns the
+// result.
+func relocate(t *testing.T, config string) (map[string]any, error) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, CHVConfigName), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RelocateCHVConfig(dir, testHostPaths); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, CHVConfigName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	return got, nil
+}
+
+func TestRelocateCHVConfig(t *testing.T) {
+	// The paths of the exporting host, or of a hostile archive.
+	got, err := relocate(t, `{
+		"cpus": {"boot_vcpus": 2, "max_vcpus": 2},
+		"memory": {"size": 18446744073709551615, "zones": null},
+		"payload": {"kernel": "/etc/shadow", "initramfs": "/root/.ssh/id_ed25519", "cmdline": "console=ttyS0 guest_ip=\"10.20.1.2/24\""},
+		"disks": [
+			{"path": "/dev/sda", "readonly": false, "num_queues": 2},
+			{"path": "/etc/passwd", "readonly": false}
+		],
+		"net": [{"tap": "tap0", "num_queues": 2}],
+		"rng": {"src": "/dev/sda"},
+		"serial": {"file": null, "mode": "Null"},
+		"console": {"file": null, "mode": "Off"},
+		"vsock": {"cid": 3, "socket": "/run/containerd/containerd.sock"},
+		"fs": null,
+		"devices": []
+	}`)
+	if err != nil {
+		t.Fatalf("RelocateCHVConfig() error = %v", err)
+	}
+	payload := got["payload"].(map[string]any)
+	if payload["kernel"] != testHostPaths.Kernel || payload["initramfs"] != nil {
+		t.Errorf("payload = %v", payload)
+	}
+	disks := got["disks"].([]any)
+	rootfs, stateful := disks[0].(map[string]any), disks[1].(map[string]any)
+	if rootfs["path"] != testHostPaths.Rootfs || rootfs["readonly"] != true || rootfs["num_queues"] != float64(2) {
+		t.Errorf("rootfs = %v", rootfs)
+	}
+	if stateful["path"] != testHostPaths.StatefulDisk {
+		t.Errorf("stateful disk = %v", stateful)
+	}
+	if src := got["rng"].(map[string]any)["src"]; src != "/dev/urandom" {
+		t.Errorf("rng src = %v", src)
+	}
+	if socket := got["vsock"].(map[string]any)["socket"]; socket != testHostPaths.VsockSocket {
+		t.Errorf("vsock socket = %v", socket)
+	}
+}
+
+func TestRelocateCHVConfigRejects(t *testing.T) {
+	disks := `"disks": [{"path": "a"}, {"path": "b"}]`
+	for name, config := range map[string]string{
+		"unknown section":     `{` + disks + `, "hostile": {"path": "/etc/shadow"}}`,
+		"shared directory":    `{` + disks + `, "fs": [{"tag": "root", "socket": "/run/virtiofsd.sock"}]}`,
+		"pmem":                `{` + disks + `, "pmem": [{"file": "/dev/mem"}]}`,
+		"passthrough device":  `{` + disks + `, "devices": [{"path": "/sys/bus/pci/devices/0000:00:01.0"}]}`,
+		"tpm":                 `{` + disks + `, "tpm": {"socket": "/run/swtpm.sock"}}`,
+		"memory zone file":    `{` + disks + `, "memory": {"size": 1, "zones": [{"id": "z", "file": "/dev/mem"}]}}`,
+		"firmware":            `{` + disks + `, "payload": {"firmware": "/etc/shadow"}}`,
+		"console file":        `{` + disks + `, "serial": {"mode": "File", "file": "/etc/cron.d/evil"}}`,
+		"vhost-user disk":     `{"disks": [{"path": "a"}, {"vhost_user": true, "vhost_socket": "/run/evil.sock"}]}`,
+		"vhost-user net":      `{` + disks + `, "net": [{"vhost_user": true, "vhost_socket": "/run/evil.sock"}]}`,
+		"third disk":          `{"disks": [{"path": "a"}, {"path": "b"}, {"path": "/dev/sda"}]}`,
+		"disks not a list":    `{"disks": {"path": "/dev/sda"}}`,
+		"not a config object": `[]`,
+	} {
+		if _, err := relocate(t, config); err == nil {
+			t.Errorf("%s: RelocateCHVConfig() succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Package vmarchive packs the disk of a VM, and optionally the snapshot of
+// its memory, into a single gzipped tar to move it to another host. The
+// archive starts with a manifest describing the VM, followed by the files,
+// which are all at the top level of the archive.
+package vmarchive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Version of the archive format.
+const Version = 1
+
+// ManifestName is the name of the manifest in the archive.
+const ManifestName = "manifest.json"
+
+// Manifest describes the exported VM.
+type Manifest struct {
+	Version    int       `json:"version"`
+	VMName     string    `json:"vmName"`
+	VMID       string    `json:"vmId"`
+	Owner      string    `json:"owner,omitempty"`
+	Arch       string    `json:"arch"`
+	Hypervisor string    `json:"hypervisor"`
+	ExportedAt time.Time `json:"exportedAt"`
+	// Memory is set when the archive holds a snapshot of the running VM,
+	// which is restored on import, rather than only its disk, which is booted
+	// from afresh.
+	Memory bool `json:"memory"`
+	// Spec is the VM's spec when it was exported, for reference.
+	Spec json.RawMessage `json:"spec,omitempty"`
+	// Files are the names of the files following the manifest.
+	Files []string `json:"files"`
+}
+
+// Write writes the archive of m and the files at paths, named by their base
+// name, to w.
+func Write(w io.Writer, m Manifest, paths []string) error {
+	m.Version = Version
+	m.Files = nil
+	for _, p := range paths {
+		m.Files = append(m.Files, path.Base(p))
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    ManifestName,
+		Mode:    0644,
+		Size:    int64(len(manifest)),
+		ModTime: m.ExportedAt,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := writeFile(tw, p); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeFile(tw *tar.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", p)
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    path.Base(p),
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", p, err)
+	}
+	return nil
+}
+
+// ErrTooLarge is returned for archives whose files add up to more than the
+// size they may extract to.
+var ErrTooLarge = errors.New("archive too large")
+
+// Extract extracts the archive read from r into the existing directory dir
+// and returns its manifest. Archives of another version, with anything but
+// the files the manifest lists, whose files are missing, or add up to more
+// than maxSize bytes, are rejected.
+func Extract(r io.Reader, dir string, maxSize int64) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a gzipped archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if hdr.Name != ManifestName {
+		return nil, fmt.Errorf("archive starts with %s instead of %s", hdr.Name, ManifestName)
+	}
+	var m Manifest
+	if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("unsupported archive version %d", m.Version)
+	}
+	expected := make(map[string]bool)
+	for _, name := range m.Files {
+		if !validName(name) || name == ManifestName {
+			return nil, fmt.Errorf("invalid file name %q in manifest", name)
+		}
+		expected[name] = true
+	}
+
+	var extracted int64
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !expected[hdr.Name] {
+			return nil, fmt.Errorf("unexpected entry %q in archive", hdr.Name)
+		}
+		delete(expected, hdr.Name)
+		n, err := extractFile(tr, path.Join(dir, hdr.Name), maxSize-extracted)
+		extracted += n
+		if err != nil {
+			return nil, err
+		}
+	}
+	for name := range expected {
+		return nil, fmt.Errorf("archive is missing %s", name)
+	}
+	return &m, nil
+}
+
+// validName reports whether name is a plain file name, which can't escape
+// the directory it is extracted to.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// extractFile extracts r to p, unless it is larger than budget bytes, and
+// returns how many bytes it extracted.
+func extractFile(r io.Reader, p string, budget int64) (int64, error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, budget+1))
+	if err != nil {
+		f.Close()
+		return n, fmt.Errorf("failed to extract %s: %w", path.Base(p), err)
+	}
+	if n > budget {
+		f.Close()
+		return n, fmt.Errorf("%w: %s doesn't fit in the size left", ErrTooLarge, path.Base(p))
+	}
+	return n, f.Close()
+}
@@ -0,0 +1,104 @@
+package vmarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"stateful.img": strings.Repeat("\x00", 4096) + "data",
+		"config.json":  `{"net":[]}`,
+	}
+	var paths []string
+	for name, content := range files {
+		p := filepath.Join(src, name)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+
+	m := Manifest{VMName: "foo", VMID: "id", Owner: "acme", Arch: "x86_64", Hypervisor: "cloud-hypervisor", Memory: true, ExportedAt: time.Now().UTC()}
+	var buf bytes.Buffer
+	if err := Write(&buf, m, paths); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	got, err := Extract(&buf, dst, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VMName != "foo" || got.Owner != "acme" || !got.Memory || got.Version != Version || len(got.Files) != 2 {
+		t.Errorf("Extract() manifest = %+v", got)
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(data) != content {
+			t.Errorf("extracted %s = %q, %v, want %q", name, data, err, content)
+		}
+	}
+}
+
+// archive builds a gzipped tar of a manifest listing files, followed by
+// entries.
+func archive(t *testing.T, m Manifest, entries ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	manifest, _ := json.Marshal(m)
+	tw.WriteHeader(&tar.Header{Name: ManifestName, Mode: 0644, Size: int64(len(manifest))})
+	tw.Write(manifest)
+	for _, hdr := range entries {
+		tw.WriteHeader(hdr)
+		if hdr.Size > 0 {
+			tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestExtractRejects(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"traversal in manifest": archive(t, Manifest{Version: Version, Files: []string{"../evil"}},
+			&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}),
+		"unlisted file": archive(t, Manifest{Version: Version, Files: []string{"stateful.img"}},
+			&tar.Header{Name: "stateful.img", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+			&tar.Header{Name: "extra", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}),
+		"symlink": archive(t, Manifest{Version: Version, Files: []string{"stateful.img"}},
+			&tar.Header{Name: "stateful.img", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}),
+		"missing file":  archive(t, Manifest{Version: Version, Files: []string{"stateful.img"}}),
+		"other version": archive(t, Manifest{Version: Version + 1}),
+		"not gzipped":   []byte("plain"),
+	} {
+		if _, err := Extract(bytes.NewReader(data), t.TempDir(), 1<<20); err == nil {
+			t.Errorf("%s: Extract() succeeded", name)
+		}
+	}
+}
+
+func TestExtractTooLarge(t *testing.T) {
+	data := archive(t, Manifest{Version: Version, Files: []string{"stateful.img", "state.json"}},
+		&tar.Header{Name: "stateful.img", Typeflag: tar.TypeReg, Mode: 0644, Size: 600},
+		&tar.Header{Name: "state.json", Typeflag: tar.TypeReg, Mode: 0644, Size: 600})
+	if _, err := Extract(bytes.NewReader(data), t.TempDir(), 1200); err != nil {
+		t.Fatalf("Extract() within the limit error = %v", err)
+	}
+	// Each file fits, not both.
+	if _, err := Extract(bytes.NewReader(data), t.TempDir(), 1000); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Extract() over the limit error = %v, want ErrTooLarge", err)
+	}
+}
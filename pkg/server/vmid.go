@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// newVMID returns a random (version 4) UUID to identify a VM for as long as
+// it exists, across renames, and never again once it is destroyed.
+func newVMID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ResolveVMName returns the current name of the VM nameOrID refers to, by
+// name or by ID. Names take precedence, so a VM named like another VM's ID
+// is still reachable by its name. Anything else is returned unchanged, for
+// the caller to report as not found.
+func (s *Server) ResolveVMName(nameOrID string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if _, ok := s.vms[nameOrID]; ok {
+		return nameOrID
+	}
+	vm, ok := s.vmIDs[nameOrID]
+	if !ok {
+		// Deleted VMs keep their ID until they are purged.
+		for _, deleted := range s.deleted {
+			if deleted.ID == nameOrID {
+				return deleted.Name
+			}
+		}
+		return nameOrID
+	}
+	vm.lock.RLock()
+	defer vm.lock.RUnlock()
+	return vm.name
+}
+
+// LiveVMName returns the current name of the VM with id, unless it was
+// destroyed, deleted or not found.
+func (s *Server) LiveVMName(id string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	vm, ok := s.vmIDs[id]
+	if !ok {
+		return "", false
+	}
+	vm.lock.RLock()
+	defer vm.lock.RUnlock()
+	return vm.name, true
+}
+
+// VMOwner returns the owner of the VM named name, deleted or not, unless it
+// wasn't found.
+func (s *Server) VMOwner(name string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if vm, ok := s.vms[name]; ok {
+		return vm.getOwner(), true
+	}
+	if deleted, ok := s.deleted[name]; ok {
+		return deleted.Owner, true
+	}
+	return "", false
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/out/gen/serverapi"
+)
+
+// vmListing keys the entries of a VM listing by VM ID for revision tracking.
+func vmListing(vms []serverapi.ListAllVMsResponseVmsInner) map[string]string {
+	listing := make(map[string]string, len(vms))
+	for _, vm := range vms {
+		content, _ := json.Marshal(vm)
+		listing[vm.GetVmId()] = string(content)
+	}
+	return listing
+}
+
+// ListVMChanges lists the VMs added or changed after revision since, a
+// revision returned by ListAllVMs or ListVMChanges, and the IDs of those no
+// longer listed. If the changes can't be told, e.g. since is from before a
+// restart, all VMs are listed and the response isn't a delta.
+func (s *Server) ListVMChanges(ctx context.Context, since string) (*serverapi.ListAllVMsResponse, error) {
+	sinceRevision, err := strconv.ParseUint(since, 10, 64)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid revision %q", since)
+	}
+
+	vms := s.listVMs()
+	changes, ok := s.vmRevisions.Delta(vmListing(vms), sinceRevision)
+	resp := &serverapi.ListAllVMsResponse{
+		Revision: serverapi.PtrString(strconv.FormatUint(changes.Revision, 10)),
+		Delta:    serverapi.PtrBool(ok),
+	}
+	if !ok {
+		resp.Vms = vms
+		return resp, nil
+	}
+	changed := make(map[string]bool, len(changes.Changed))
+	for _, id := range changes.Changed {
+		changed[id] = true
+	}
+	resp.Vms = []serverapi.ListAllVMsResponseVmsInner{}
+	for _, vm := range vms {
+		if changed[vm.GetVmId()] {
+			resp.Vms = append(resp.Vms, vm)
+		}
+	}
+	resp.Removed = changes.Removed
+	if resp.Removed == nil {
+		resp.Removed = []string{}
+	}
+	return resp, nil
+}
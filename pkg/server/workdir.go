@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/abshkbh/arrakis/pkg/server/workdir"
+)
+
+// WorkDir describes the working directory of a VM, see package workdir.
+type WorkDir struct {
+	VMName string `json:"vmName"`
+	Path   string `json:"path"`
+	// Dirs are the subdirectories of each type, with what they hold.
+	Dirs []workdir.Usage `json:"dirs"`
+}
+
+// vmLayout returns the working directory of vmName.
+func (s *Server) vmLayout(vmName string) (workdir.Layout, error) {
+	vm := s.getVMAtomic(vmName)
+	if vm == nil {
+		return workdir.Layout{}, status.Error(codes.NotFound, fmt.Sprintf("vm not found: %s", vmName))
+	}
+	vm.lock.RLock()
+	defer vm.lock.RUnlock()
+	return workdir.Layout{Root: vm.stateDirPath}, nil
+}
+
+// WorkDir returns the working directory of vmName.
+func (s *Server) WorkDir(ctx context.Context, vmName string) (*WorkDir, error) {
+	layout, err := s.vmLayout(vmName)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := layout.Usage()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to size working directory: %v", err)
+	}
+	return &WorkDir{VMName: vmName, Path: layout.Root, Dirs: usage}, nil
+}
+
+// CleanWorkDir empties the subdirectory of typ of the working directory of
+// vmName, one of workdir.Cleanable, returning what it held.
+func (s *Server) CleanWorkDir(ctx context.Context, vmName string, typ string) (workdir.Usage, error) {
+	layout, err := s.vmLayout(vmName)
+	if err != nil {
+		return workdir.Usage{}, err
+	}
+	usage, err := layout.Clean(typ)
+	if errors.Is(err, workdir.ErrUnknownType) || errors.Is(err, workdir.ErrNotCleanable) {
+		return workdir.Usage{}, status.Errorf(codes.InvalidArgument, "%v, must be one of %v", err, workdir.Cleanable)
+	}
+	if err != nil {
+		return workdir.Usage{}, status.Errorf(codes.Internal, "failed to clean %s: %v", typ, err)
+	}
+	log.WithFields(log.Fields{
+		"vmName": vmName,
+		"type":   typ,
+		"files":  usage.Files,
+		"bytes":  usage.Bytes,
+	}).Info("cleaned VM working directory")
+	return usage, nil
+}
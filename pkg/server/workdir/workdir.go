@@ -0,0 +1,186 @@
+// Package workdir lays out the working directory of a VM in the state dir:
+// one subdirectory per type of file, so that operators know where to look
+// and can clean up one type without touching the others.
+//
+//	<state_dir>/<vm>/
+//	  disks/       the stateful disk and extra block devices
+//	  logs/        the VMM's output
+//	  recordings/  sessions recorded on the host, e.g. by the cdpserver
+//	  artifacts/   artifacts kept on the host
+//	  sockets/     the VMM's API and vsock sockets
+//
+// Files describing the VM as a whole, e.g. its timeline, stay at the root.
+package workdir
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Types of the files of a working directory, each in its own subdirectory.
+const (
+	Disks      = "disks"
+	Logs       = "logs"
+	Recordings = "recordings"
+	Artifacts  = "artifacts"
+	Sockets    = "sockets"
+)
+
+// Types lists the subdirectories of a working directory.
+var Types = []string{Disks, Logs, Recordings, Artifacts, Sockets}
+
+// Cleanable are the types Clean removes: the others hold what the VM runs on.
+var Cleanable = []string{Logs, Recordings, Artifacts}
+
+// ErrUnknownType is returned for a type not in Types.
+var ErrUnknownType = errors.New("unknown working directory type")
+
+// ErrNotCleanable is returned when cleaning a type not in Cleanable.
+var ErrNotCleanable = errors.New("working directory type can't be cleaned")
+
+// Layout is the working directory of a VM.
+type Layout struct {
+	Root string
+}
+
+// New returns the layout of the working directory of vmName in stateDir.
+func New(stateDir string, vmName string) Layout {
+	return Layout{Root: filepath.Join(stateDir, vmName)}
+}
+
+// Dir returns the subdirectory of typ.
+func (l Layout) Dir(typ string) string {
+	return filepath.Join(l.Root, typ)
+}
+
+// Create creates the working directory and its subdirectories.
+func (l Layout) Create() error {
+	for _, typ := range Types {
+		if err := os.MkdirAll(l.Dir(typ), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// APISocket is where the VMM serves its API.
+func (l Layout) APISocket() string {
+	return filepath.Join(l.Dir(Sockets), "api.sock")
+}
+
+// VsockSocket is where the VMM exposes the guest's vsock.
+func (l Layout) VsockSocket() string {
+	return filepath.Join(l.Dir(Sockets), "vsock.sock")
+}
+
+// VMMLog receives the VMM's output.
+func (l Layout) VMMLog() string {
+	return filepath.Join(l.Dir(Logs), "vmm.log")
+}
+
+// Disk returns the path of the disk image name, e.g. "stateful.img".
+func (l Layout) Disk(name string) string {
+	return filepath.Join(l.Dir(Disks), name)
+}
+
+// Rebase returns where p, a path below the working directory, is once the
+// directory moved to root. Paths outside of it, e.g. the sockets of an
+// adopted VM, are returned as is.
+func (l Layout) Rebase(p string, root string) string {
+	rel, err := filepath.Rel(l.Root, p)
+	if p == "" || err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return p
+	}
+	return filepath.Join(root, rel)
+}
+
+// Usage is what a subdirectory of a working directory holds.
+type Usage struct {
+	Type  string `json:"type"`
+	Path  string `json:"path"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Usage returns what each subdirectory holds. Missing ones, e.g. of VMs
+// created before the layout, are empty.
+func (l Layout) Usage() ([]Usage, error) {
+	var usage []Usage
+	for _, typ := range Types {
+		u, err := l.usage(typ)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+func (l Layout) usage(typ string) (Usage, error) {
+	u := Usage{Type: typ, Path: l.Dir(typ)}
+	err := filepath.WalkDir(u.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			u.Files++
+			u.Bytes += info.Size()
+		}
+		return nil
+	})
+	return u, err
+}
+
+// Clean empties the subdirectory of typ, returning what it held. Logs are
+// truncated rather than removed, as the VMM keeps writing to its own.
+func (l Layout) Clean(typ string) (Usage, error) {
+	if !slices.Contains(Types, typ) {
+		return Usage{}, fmt.Errorf("%w: %q", ErrUnknownType, typ)
+	}
+	if !slices.Contains(Cleanable, typ) {
+		return Usage{}, fmt.Errorf("%w: %q", ErrNotCleanable, typ)
+	}
+	u, err := l.usage(typ)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	dir := l.Dir(typ)
+	if typ == Logs {
+		err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.Type().IsRegular() {
+				return os.Truncate(p, 0)
+			}
+			return nil
+		})
+		return u, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Usage{}, err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return Usage{}, err
+		}
+	}
+	return u, nil
+}
@@ -0,0 +1,88 @@
+package workdir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	stateDir := t.TempDir()
+	l := New(stateDir, "vm1")
+	if err := l.Create(); err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range Types {
+		if info, err := os.Stat(filepath.Join(stateDir, "vm1", typ)); err != nil || !info.IsDir() {
+			t.Errorf("%s not created: %v", typ, err)
+		}
+	}
+	if got, want := l.APISocket(), filepath.Join(stateDir, "vm1", "sockets", "api.sock"); got != want {
+		t.Errorf("APISocket() = %s, want %s", got, want)
+	}
+	if got, want := l.Disk("stateful.img"), filepath.Join(stateDir, "vm1", "disks", "stateful.img"); got != want {
+		t.Errorf("Disk() = %s, want %s", got, want)
+	}
+
+	moved := New(stateDir, "vm2")
+	if got := l.Rebase(l.VMMLog(), moved.Root); got != moved.VMMLog() {
+		t.Errorf("Rebase(VMMLog()) = %s, want %s", got, moved.VMMLog())
+	}
+	for _, p := range []string{"", "/run/adopted.sock", filepath.Join(stateDir, "vm10", "logs")} {
+		if got := l.Rebase(p, moved.Root); got != p {
+			t.Errorf("Rebase(%q) = %s, want it unchanged", p, got)
+		}
+	}
+}
+
+func TestClean(t *testing.T) {
+	l := New(t.TempDir(), "vm1")
+	if err := l.Create(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(l.VMMLog(), []byte("booted\n"), 0o644)
+	os.MkdirAll(filepath.Join(l.Dir(Recordings), "cdp"), 0o755)
+	os.WriteFile(filepath.Join(l.Dir(Recordings), "cdp", "session.ndjson"), []byte("{}\n{}\n"), 0o644)
+	os.WriteFile(l.Disk("stateful.img"), []byte("disk"), 0o644)
+
+	usage, err := l.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != len(Types) || usage[0].Type != Disks || usage[0].Files != 1 || usage[0].Bytes != 4 {
+		t.Fatalf("usage = %+v", usage)
+	}
+
+	cleaned, err := l.Clean(Logs)
+	if err != nil || cleaned.Files != 1 || cleaned.Bytes != 7 {
+		t.Fatalf("Clean(logs) = %+v, %v", cleaned, err)
+	}
+	// The VMM keeps its log open, it is truncated rather than removed.
+	if info, err := os.Stat(l.VMMLog()); err != nil || info.Size() != 0 {
+		t.Errorf("log not truncated: %v", err)
+	}
+
+	cleaned, err = l.Clean(Recordings)
+	if err != nil || cleaned.Files != 1 || cleaned.Bytes != 6 {
+		t.Fatalf("Clean(recordings) = %+v, %v", cleaned, err)
+	}
+	if entries, _ := os.ReadDir(l.Dir(Recordings)); len(entries) != 0 {
+		t.Errorf("recordings left: %v", entries)
+	}
+
+	if _, err := l.Clean(Disks); !errors.Is(err, ErrNotCleanable) {
+		t.Errorf("Clean(disks) = %v, want ErrNotCleanable", err)
+	}
+	if _, err := l.Clean("tmp"); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("Clean(tmp) = %v, want ErrUnknownType", err)
+	}
+	if _, err := os.Stat(l.Disk("stateful.img")); err != nil {
+		t.Errorf("disk removed: %v", err)
+	}
+
+	// Working directories of VMs created before the layout are empty.
+	if _, err := New(t.TempDir(), "old").Clean(Artifacts); err != nil {
+		t.Errorf("Clean(artifacts) of a missing directory = %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package sink
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultQueueSize     = 10000
+)
+
+// ForwarderOptions configure a forwarder, zero fields are defaulted.
+type ForwarderOptions struct {
+	// Name identifies the sink in logs.
+	Name string
+	// BatchSize bounds the records sent at once.
+	BatchSize int
+	// FlushInterval bounds how long records wait for their batch to fill.
+	FlushInterval time.Duration
+	// QueueSize bounds the records waiting to be sent, more are dropped so
+	// that a slow sink never holds up what produces them.
+	QueueSize int
+}
+
+// Stats count the records of a forwarder.
+type Stats struct {
+	Forwarded uint64
+	// Dropped were not queued because the queue was full or the forwarder
+	// closed.
+	Dropped uint64
+	// Failed were queued but could not be sent.
+	Failed uint64
+}
+
+// Forwarder queues records and sends them to a sink in batches in the
+// background.
+type Forwarder struct {
+	sink Sink
+	opts ForwarderOptions
+
+	// mu guards sending to queue against Close closing it.
+	mu     sync.RWMutex
+	closed bool
+	queue  chan Record
+	done   chan struct{}
+
+	forwarded atomic.Uint64
+	dropped   atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// NewForwarder starts forwarding to s.
+func NewForwarder(s Sink, opts ForwarderOptions) *Forwarder {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	f := &Forwarder{
+		sink:  s,
+		opts:  opts,
+		queue: make(chan Record, opts.QueueSize),
+		done:  make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// Forward queues r without blocking, and returns whether it was.
+func (f *Forwarder) Forward(r Record) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		f.dropped.Add(1)
+		return false
+	}
+	select {
+	case f.queue <- r:
+		return true
+	default:
+		f.dropped.Add(1)
+		return false
+	}
+}
+
+// Stats returns the counts of the records forwarded so far.
+func (f *Forwarder) Stats() Stats {
+	return Stats{
+		Forwarded: f.forwarded.Load(),
+		Dropped:   f.dropped.Load(),
+		Failed:    f.failed.Load(),
+	}
+}
+
+// Close sends the queued records and closes the sink.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.queue)
+	}
+	f.mu.Unlock()
+	<-f.done
+	return f.sink.Close()
+}
+
+func (f *Forwarder) run() {
+	defer close(f.done)
+	ticker := time.NewTicker(f.opts.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]Record, 0, f.opts.BatchSize)
+	for {
+		select {
+		case r, ok := <-f.queue:
+			if !ok {
+				f.flush(batch)
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) < f.opts.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		f.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush sends batch, retrying once.
+func (f *Forwarder) flush(batch []Record) {
+	if len(batch) == 0 {
+		return
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err = f.sink.Send(ctx, batch)
+		cancel()
+		if err == nil {
+			f.forwarded.Add(uint64(len(batch)))
+			return
+		}
+	}
+	f.failed.Add(uint64(len(batch)))
+	log.WithError(err).Warnf("failed to forward %d records to sink %s", len(batch), f.opts.Name)
+}
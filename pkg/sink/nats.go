@@ -0,0 +1,181 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsDialTimeout bounds connecting to a NATS server.
+const natsDialTimeout = 5 * time.Second
+
+// nats publishes records to a subject with the text protocol of NATS,
+// connecting on the first Send and again after failures.
+type nats struct {
+	url     *url.URL
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newNATS(u *url.URL, subject string) *nats {
+	return &nats{url: u, subject: subject}
+}
+
+// validSubject returns whether subject can be published to: dot-separated
+// non-empty tokens without whitespace or wildcards.
+func validSubject(subject string) bool {
+	if subject == "" {
+		return false
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *nats) Send(ctx context.Context, records []Record) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.send(ctx, records); err != nil {
+		n.closeLocked()
+		return err
+	}
+	return nil
+}
+
+func (n *nats) send(ctx context.Context, records []Record) error {
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", n.url.Host, err)
+		}
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(sendTimeout)
+	}
+	n.conn.SetDeadline(deadline)
+
+	w := bufio.NewWriter(n.conn)
+	for _, r := range records {
+		fmt.Fprintf(w, "PUB %s %d\r\n", n.subject, len(r.Value))
+		w.Write(r.Value)
+		w.WriteString("\r\n")
+	}
+	// The server answers the PING once it processed the PUBs before it.
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return n.awaitPong()
+}
+
+// connect dials the server, upgrading to TLS if it or the URL asks for it,
+// and authenticates with the URL's user and password, or token.
+func (n *nats) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: natsDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", n.url.Host)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(natsDialTimeout))
+	r := bufio.NewReader(conn)
+	line, err := readLine(r)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[len("INFO "):]), &info) != nil {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting %q", line)
+	}
+	if n.url.Scheme == "tls" || info.TLSRequired {
+		host, _, _ := net.SplitHostPort(n.url.Host)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	connect := map[string]any{"verbose": false, "pedantic": false, "lang": "go", "name": "arrakis"}
+	if user := n.url.User; user != nil {
+		if password, ok := user.Password(); ok {
+			connect["user"] = user.Username()
+			connect["pass"] = password
+		} else {
+			connect["auth_token"] = user.Username()
+		}
+	}
+	data, err := json.Marshal(connect)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", data); err != nil {
+		conn.Close()
+		return err
+	}
+	n.conn, n.r = conn, r
+	return n.awaitPong()
+}
+
+// awaitPong reads until the server's PONG, answering its PINGs.
+func (n *nats) awaitPong() error {
+	for {
+		line, err := readLine(n.r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(strings.Trim(strings.TrimSpace(line[len("-ERR"):]), "'"))
+		}
+		// +OK and INFO updates need no answer.
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (n *nats) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closeLocked()
+	return nil
+}
+
+func (n *nats) closeLocked() {
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn, n.r = nil, nil
+	}
+}
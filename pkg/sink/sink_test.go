@@ -0,0 +1,272 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type request struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// server records the requests it receives and answers them with status and
+// reply.
+func server(t *testing.T, status int, reply string) (*httptest.Server, <-chan request) {
+	t.Helper()
+	requests := make(chan request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{path: r.URL.Path, header: r.Header, body: body}
+		w.WriteHeader(status)
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+var records = []Record{
+	{Key: "vm1", Value: json.RawMessage(`{"a":1}`)},
+	{Key: "vm2", Value: json.RawMessage(`{"b":2}`)},
+}
+
+func TestWebhook(t *testing.T) {
+	srv, requests := server(t, http.StatusNoContent, "")
+	s, err := New(Options{Type: TypeWebhook, URL: srv.URL + "/events", Headers: map[string]string{"Authorization": "Bearer token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Send(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	r := <-requests
+	if r.path != "/events" || string(r.body) != `[{"a":1},{"b":2}]` ||
+		r.header.Get("Authorization") != "Bearer token" || r.header.Get("Content-Type") != "application/json" {
+		t.Errorf("request = %s %s %v", r.path, r.body, r.header)
+	}
+
+	srv, _ = server(t, http.StatusBadGateway, "down\n")
+	s, _ = New(Options{Type: TypeWebhook, URL: srv.URL})
+	if err := s.Send(context.Background(), records); err == nil || !strings.Contains(err.Error(), "502 Bad Gateway: down") {
+		t.Errorf("Send = %v, want the webhook's failure", err)
+	}
+}
+
+func TestKafka(t *testing.T) {
+	srv, requests := server(t, http.StatusOK, `{"offsets":[{"partition":0,"offset":1,"error_code":null,"error":null},{"partition":1,"offset":7,"error_code":null,"error":null}]}`)
+	s, err := New(Options{Type: TypeKafka, URL: srv.URL + "/", Topic: "cdp events"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Send(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	r := <-requests
+	if r.path != "/topics/cdp events" || r.header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" ||
+		string(r.body) != `{"records":[{"key":"vm1","value":{"a":1}},{"key":"vm2","value":{"b":2}}]}` {
+		t.Errorf("request = %s %s %v", r.path, r.body, r.header)
+	}
+
+	// Records can fail although the batch was accepted.
+	srv, _ = server(t, http.StatusOK, `{"offsets":[{"partition":0,"offset":1,"error_code":null,"error":null},{"error_code":50003,"error":"retriable"}]}`)
+	s, _ = New(Options{Type: TypeKafka, URL: srv.URL, Topic: "events"})
+	if err := s.Send(context.Background(), records); err == nil || !strings.Contains(err.Error(), "50003") {
+		t.Errorf("Send = %v, want the record's failure", err)
+	}
+}
+
+// fakeNATS is a NATS server accepting the credentials user:password and
+// recording the messages published to it.
+type fakeNATS struct {
+	listener net.Listener
+
+	mu        sync.Mutex
+	connects  []map[string]any
+	published []string
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeNATS{listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	return n
+}
+
+func (n *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"auth_required\":true}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+		verb, args, _ := strings.Cut(line, " ")
+		switch verb {
+		case "CONNECT":
+			var opts map[string]any
+			json.Unmarshal([]byte(args), &opts)
+			n.mu.Lock()
+			n.connects = append(n.connects, opts)
+			n.mu.Unlock()
+			if opts["user"] != "user" || opts["pass"] != "password" {
+				io.WriteString(conn, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+		case "PUB":
+			fields := strings.Fields(args)
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			n.mu.Lock()
+			n.published = append(n.published, fields[0]+" "+string(payload[:size]))
+			n.mu.Unlock()
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		}
+	}
+}
+
+func (n *fakeNATS) state() ([]map[string]any, []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]map[string]any(nil), n.connects...), append([]string(nil), n.published...)
+}
+
+func TestNATS(t *testing.T) {
+	server := newFakeNATS(t)
+	s, err := New(Options{Type: TypeNATS, URL: "nats://user:password@" + server.listener.Addr().String(), Subject: "arrakis.cdp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		if err := s.Send(context.Background(), records); err != nil {
+			t.Fatal(err)
+		}
+	}
+	connects, published := server.state()
+	if len(connects) != 1 || connects[0]["name"] != "arrakis" || connects[0]["verbose"] != false {
+		t.Errorf("connects = %v, want one reused connection", connects)
+	}
+	want := []string{`arrakis.cdp {"a":1}`, `arrakis.cdp {"b":2}`, `arrakis.cdp {"a":1}`, `arrakis.cdp {"b":2}`}
+	if strings.Join(published, "\n") != strings.Join(want, "\n") {
+		t.Errorf("published = %q, want %q", published, want)
+	}
+
+	s, _ = New(Options{Type: TypeNATS, URL: "nats://token@" + server.listener.Addr().String(), Subject: "arrakis.cdp"})
+	if err := s.Send(context.Background(), records); err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Errorf("Send = %v, want the server's error", err)
+	}
+	if connects, _ := server.state(); connects[len(connects)-1]["auth_token"] != "token" {
+		t.Errorf("connect = %v, want the token", connects[len(connects)-1])
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, opts := range []Options{
+		{Type: "syslog", URL: "http://host"},
+		{Type: TypeWebhook, URL: "host"},
+		{Type: TypeWebhook, URL: "ftp://host"},
+		{Type: TypeKafka, URL: "http://host"},
+		{Type: TypeNATS, URL: "http://host", Subject: "a"},
+		{Type: TypeNATS, URL: "nats://host"},
+		{Type: TypeNATS, URL: "nats://host", Subject: "a..b"},
+		{Type: TypeNATS, URL: "nats://host", Subject: "a.*"},
+		{Type: TypeNATS, URL: "nats://host", Subject: "a b"},
+	} {
+		if _, err := New(opts); err == nil {
+			t.Errorf("New(%+v) succeeded", opts)
+		}
+	}
+}
+
+// fakeSink records the batches sent to it, failing while fail is set.
+type fakeSink struct {
+	mu      sync.Mutex
+	fail    bool
+	batches [][]Record
+	closed  bool
+}
+
+func (s *fakeSink) Send(_ context.Context, records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	s.batches = append(s.batches, append([]Record(nil), records...))
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestForwarder(t *testing.T) {
+	s := &fakeSink{}
+	f := NewForwarder(s, ForwarderOptions{Name: "test", BatchSize: 2, FlushInterval: time.Hour, QueueSize: 3})
+	for i := 0; i < 3; i++ {
+		if !f.Forward(Record{Value: json.RawMessage(strconv.Itoa(i))}) {
+			t.Fatalf("record %d not queued", i)
+		}
+	}
+	// The first batch filled, the last record waits for the flush on Close.
+	for deadline := time.Now().Add(5 * time.Second); f.Stats().Forwarded < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Forward(Record{Value: json.RawMessage("3")}) {
+		t.Error("record queued after Close")
+	}
+	if len(s.batches) != 2 || len(s.batches[0]) != 2 || len(s.batches[1]) != 1 || !s.closed {
+		t.Errorf("batches = %v, closed = %t", s.batches, s.closed)
+	}
+	if stats := f.Stats(); stats != (Stats{Forwarded: 3, Dropped: 1}) {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// Records that can't be sent, even when retried, are counted as failed.
+	s = &fakeSink{fail: true}
+	f = NewForwarder(s, ForwarderOptions{FlushInterval: time.Hour})
+	f.Forward(Record{Value: json.RawMessage("0")})
+	f.Close()
+	if stats := f.Stats(); stats.Failed != 1 || stats.Forwarded != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
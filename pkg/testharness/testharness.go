@@ -0,0 +1,767 @@
+// Package testharness provides in-process fakes of the services the guest
+// proxies talk to: the arrakis REST API, a Chrome DevTools endpoint and a VNC
+// server. They let cdpserver and novncserver be exercised with `go test`
+// without booting real VMs.
+package testharness
+
+import (
+	"crypto/des"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/abshkbh/arrakis/pkg/cmdserver"
+	"github.com/abshkbh/arrakis/pkg/config"
+)
+
+const (
+	// ChromeForwardedPort is the guest port Chrome's DevTools endpoint is made
+	// available on. Fake Chrome embeds it in the URLs it returns, just like the
+	// real forwarder inside the guest does.
+	ChromeForwardedPort = "9223"
+	// RFBVersion is the protocol banner the fake VNC server greets clients with.
+	RFBVersion = "RFB 003.008\n"
+)
+
+// VM mirrors the subset of the REST API VM representation used by the proxies.
+type VM struct {
+	VMID         string        `json:"vmId,omitempty"`
+	VMName       string        `json:"vmName"`
+	Status       string        `json:"status"`
+	Owner        string        `json:"owner,omitempty"`
+	IP           string        `json:"ip"`
+	PortForwards []PortForward `json:"portForwards"`
+}
+
+type PortForward struct {
+	Description string              `json:"description"`
+	GuestPort   string              `json:"guestPort"`
+	HostPort    string              `json:"hostPort"`
+	Service     *PortForwardService `json:"service,omitempty"`
+}
+
+// PortForwardService mirrors the service descriptor of a port forward.
+type PortForwardService struct {
+	Name      string `json:"name"`
+	Protocol  string `json:"protocol"`
+	GuestPort string `json:"guestPort"`
+	Proxy     string `json:"proxy"`
+}
+
+// BrowserPortForward returns the port forward of the browser browserID of a
+// VM, served by chrome on guestPort. The default browser is named
+// config.DefaultBrowserService.
+func BrowserPortForward(browserID string, guestPort string, chrome *FakeChrome) PortForward {
+	description := "cdp:" + browserID
+	if browserID == config.DefaultBrowserService {
+		description = "cdp"
+	}
+	return PortForward{
+		Description: description,
+		GuestPort:   guestPort,
+		HostPort:    chrome.Port(),
+		Service: &PortForwardService{
+			Name:      browserID,
+			Protocol:  "cdp",
+			GuestPort: guestPort,
+			Proxy:     config.ServiceProxyCDP,
+		},
+	}
+}
+
+// FakeRESTAPI serves GET /v1/vms and /v1/vms/{name}/services from in-memory
+// state that tests can change at any time, and records the sessions POSTed to
+// /v1/vms/{name}/sessions and the browser restarts POSTed to
+// /v1/vms/{name}/browser/restart. Like the REST API, the VM list has an ETag and a
+// revision that change whenever it does, and `?since=<revision>&wait=<d>`
+// waits for the next change. Changes are always answered with the full list.
+type FakeRESTAPI struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	vms      []VM
+	services map[string][]cmdserver.ServiceHealth
+	sessions map[string][]cmdserver.SessionReport
+	requests int
+	revision int
+	changed  chan struct{} // Closed on the next change of the VM list
+	// notModified counts the VM list queries answered with a 304.
+	notModified int
+	restarts    map[string][]string
+	// onRestart is called with the browser restarts, if set.
+	onRestart func(vmName string, browserID string)
+}
+
+func NewFakeRESTAPI(vms ...VM) *FakeRESTAPI {
+	f := &FakeRESTAPI{vms: vms, changed: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/vms", func(w http.ResponseWriter, r *http.Request) {
+		if wait, err := time.ParseDuration(r.URL.Query().Get("wait")); err == nil {
+			f.lock.Lock()
+			unchanged := r.URL.Query().Get("since") == strconv.Itoa(f.revision)
+			changed := f.changed
+			f.lock.Unlock()
+			if unchanged {
+				select {
+				case <-changed:
+				case <-time.After(wait):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+
+		f.lock.Lock()
+		f.requests++
+		resp := struct {
+			VMs      []VM   `json:"vms"`
+			Revision string `json:"revision"`
+		}{VMs: append([]VM(nil), f.vms...), Revision: strconv.Itoa(f.revision)}
+		etag := fmt.Sprintf(`"%d"`, f.revision)
+		notModified := r.Header.Get("If-None-Match") == etag
+		if notModified {
+			f.notModified++
+		}
+		f.lock.Unlock()
+
+		w.Header().Set("ETag", etag)
+		if notModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/v1/vms/", func(w http.ResponseWriter, r *http.Request) {
+		if name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/vms/"), "/sessions"); ok && r.Method == http.MethodPost {
+			var report cmdserver.SessionReport
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				http.Error(w, `{"error":"invalid session report"}`, http.StatusBadRequest)
+				return
+			}
+			f.lock.Lock()
+			if f.sessions == nil {
+				f.sessions = make(map[string][]cmdserver.SessionReport)
+			}
+			f.sessions[name] = append(f.sessions[name], report)
+			f.lock.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/vms/"), "/browser/restart"); ok && r.Method == http.MethodPost {
+			var req cmdserver.BrowserRestartRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, `{"error":"invalid browser restart"}`, http.StatusBadRequest)
+				return
+			}
+			f.lock.Lock()
+			if f.restarts == nil {
+				f.restarts = make(map[string][]string)
+			}
+			f.restarts[name] = append(f.restarts[name], req.Browser)
+			onRestart := f.onRestart
+			f.lock.Unlock()
+			if onRestart != nil {
+				onRestart(name, req.Browser)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/vms/"), "/services")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.lock.Lock()
+		services, ok := f.services[name]
+		f.lock.Unlock()
+		if !ok {
+			http.Error(w, `{"error":"vm not found"}`, http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cmdserver.ServicesResponse{Services: services})
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// SetServices sets the service health reported for a VM.
+func (f *FakeRESTAPI) SetServices(vmName string, services ...cmdserver.ServiceHealth) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.services == nil {
+		f.services = make(map[string][]cmdserver.ServiceHealth)
+	}
+	f.services[vmName] = services
+}
+
+// Sessions returns the sessions reported for a VM.
+func (f *FakeRESTAPI) Sessions(vmName string) []cmdserver.SessionReport {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]cmdserver.SessionReport(nil), f.sessions[vmName]...)
+}
+
+// BrowserRestarts returns the IDs of the browsers of a VM restarted, in
+// order, "" being the default one.
+func (f *FakeRESTAPI) BrowserRestarts(vmName string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.restarts[vmName]...)
+}
+
+// OnBrowserRestart calls fn with every browser restart, e.g. to bring a
+// browser back up.
+func (f *FakeRESTAPI) OnBrowserRestart(fn func(vmName string, browserID string)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.onRestart = fn
+}
+
+// SetVMs replaces the VM list returned by the fake.
+func (f *FakeRESTAPI) SetVMs(vms ...VM) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.vms = vms
+	f.revision++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Requests returns how many times the VM list has been queried.
+func (f *FakeRESTAPI) Requests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+// NotModified returns how many VM list queries were answered with a 304
+// because the VMs didn't change since the caller's ETag.
+func (f *FakeRESTAPI) NotModified() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.notModified
+}
+
+// RunningVM returns a running VM whose CDP port forward points at chrome.
+func RunningVM(name string, chrome *FakeChrome) VM {
+	return VM{
+		VMID:   "id-" + name,
+		VMName: name,
+		Status: "RUNNING",
+		IP:     "10.20.1.2/24",
+		PortForwards: []PortForward{
+			BrowserPortForward(config.DefaultBrowserService, ChromeForwardedPort, chrome),
+		},
+	}
+}
+
+// FakeChrome emulates the Chrome DevTools HTTP and WebSocket endpoints. Every
+// WebSocket message received on /devtools/... is echoed back, except the
+// Page.captureScreenshot, Page.getLayoutMetrics, Browser.getVersion and
+// Network.enable commands, which are answered like Chrome does.
+type FakeChrome struct {
+	*httptest.Server
+
+	lock        sync.Mutex
+	connections int
+	lastPath    string
+	lastHeader  http.Header
+	screenshots []map[string]any
+	// networkEnabled are the sessions of the Network.enable commands.
+	networkEnabled []string
+}
+
+// FakeScreenshot is the image FakeChrome's pages answer Page.captureScreenshot
+// with.
+var FakeScreenshot = []byte("\x89PNG\r\n\x1a\nfake screenshot")
+
+// FakePageSize is the size, in CSS pixels, of FakeChrome's pages.
+var FakePageSize = image.Pt(1280, 3000)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+	EnableCompression: true,
+}
+
+func NewFakeChrome() *FakeChrome {
+	return NewFakeChromeWithTarget("fake")
+}
+
+// NewFakeChromeWithTarget returns a FakeChrome listing the page target
+// "<id>-page" and the browser target "<id>-browser", so that several fakes
+// list different targets.
+func NewFakeChromeWithTarget(id string) *FakeChrome {
+	f := &FakeChrome{}
+	f.Server = httptest.NewServer(f.handler(id))
+	return f
+}
+
+// NewStoppedFakeChrome returns a FakeChrome whose port refuses connections,
+// like a crashed Chrome, until Start is called.
+func NewStoppedFakeChrome() *FakeChrome {
+	f := &FakeChrome{}
+	f.Server = httptest.NewUnstartedServer(f.handler("fake"))
+	f.Listener.Close()
+	return f
+}
+
+// Start serves a FakeChrome returned by NewStoppedFakeChrome on its port.
+func (f *FakeChrome) Start() {
+	l, err := net.Listen("tcp", f.Listener.Addr().String())
+	if err != nil {
+		panic(fmt.Sprintf("testharness: failed to listen on %s: %v", f.Listener.Addr(), err))
+	}
+	f.Listener = l
+	f.Server.Start()
+}
+
+func (f *FakeChrome) handler(id string) http.Handler {
+	// URLs as seen from inside the guest, which the proxy is expected to
+	// rewrite.
+	internal := "127.0.0.1:" + ChromeForwardedPort
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/version", func(w http.ResponseWriter, r *http.Request) {
+		f.record(r)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"Browser":              "HeadlessChrome/120.0.0.0",
+			"Protocol-Version":     "1.3",
+			"webSocketDebuggerUrl": fmt.Sprintf("ws://%s/devtools/browser/%s-browser", internal, id),
+		})
+	})
+	list := func(w http.ResponseWriter, r *http.Request) {
+		f.record(r)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]map[string]string{
+			{
+				"id":                   id + "-page",
+				"type":                 "page",
+				"title":                "about:blank",
+				"url":                  "about:blank",
+				"devtoolsFrontendUrl":  fmt.Sprintf("/devtools/inspector.html?ws=%s/devtools/page/%s-page", internal, id),
+				"webSocketDebuggerUrl": fmt.Sprintf("ws://%s/devtools/page/%s-page", internal, id),
+			},
+		})
+	}
+	mux.HandleFunc("/json", list)
+	mux.HandleFunc("/json/list", list)
+	mux.HandleFunc("/devtools/", func(w http.ResponseWriter, r *http.Request) {
+		f.record(r)
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		f.lock.Lock()
+		f.connections++
+		f.lock.Unlock()
+
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if reply, ok := f.reply(data); ok {
+				data = reply
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	})
+	return mux
+}
+
+// reply returns Chrome's reply to the commands the fake doesn't echo.
+func (f *FakeChrome) reply(data []byte) ([]byte, bool) {
+	var cmd struct {
+		ID        int            `json:"id"`
+		Method    string         `json:"method"`
+		Params    map[string]any `json:"params"`
+		SessionID string         `json:"sessionId"`
+	}
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return nil, false
+	}
+	var result any
+	switch cmd.Method {
+	case "Page.captureScreenshot":
+		f.lock.Lock()
+		f.screenshots = append(f.screenshots, cmd.Params)
+		f.lock.Unlock()
+		result = map[string][]byte{"data": FakeScreenshot}
+	case "Page.getLayoutMetrics":
+		size := map[string]int{"x": 0, "y": 0, "width": FakePageSize.X, "height": FakePageSize.Y}
+		result = map[string]any{"cssContentSize": size}
+	case "Browser.getVersion":
+		result = map[string]string{"protocolVersion": "1.3", "product": "HeadlessChrome/120.0.0.0"}
+	case "Network.enable":
+		f.lock.Lock()
+		f.networkEnabled = append(f.networkEnabled, cmd.SessionID)
+		f.lock.Unlock()
+		result = struct{}{}
+	default:
+		return nil, false
+	}
+	reply := map[string]any{"id": cmd.ID, "result": result}
+	if cmd.SessionID != "" {
+		reply["sessionId"] = cmd.SessionID
+	}
+	out, _ := json.Marshal(reply)
+	return out, true
+}
+
+// NetworkEnabled returns the sessions the Network domain was enabled on, ""
+// for that of the connection's own target.
+func (f *FakeChrome) NetworkEnabled() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.networkEnabled...)
+}
+
+// Screenshots returns the params of the Page.captureScreenshot commands
+// received.
+func (f *FakeChrome) Screenshots() []map[string]any {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]map[string]any(nil), f.screenshots...)
+}
+
+func (f *FakeChrome) record(r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lastPath = r.URL.RequestURI()
+	f.lastHeader = r.Header.Clone()
+}
+
+// Port returns the port the fake is listening on.
+func (f *FakeChrome) Port() string {
+	_, port, _ := net.SplitHostPort(f.Listener.Addr().String())
+	return port
+}
+
+// Connections returns how many DevTools WebSockets have been accepted.
+func (f *FakeChrome) Connections() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.connections
+}
+
+// LastRequest returns the request URI and headers of the last request seen.
+func (f *FakeChrome) LastRequest() (string, http.Header) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastPath, f.lastHeader
+}
+
+// FakeVNC is a TCP server that sends an RFB version banner on connect and
+// then echoes everything it receives.
+type FakeVNC struct {
+	listener net.Listener
+
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func NewFakeVNC() (*FakeVNC, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+	f := &FakeVNC{listener: listener}
+	go f.serve()
+	return f, nil
+}
+
+func (f *FakeVNC) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.lock.Lock()
+		f.conns = append(f.conns, conn)
+		f.lock.Unlock()
+
+		go func() {
+			defer conn.Close()
+			if _, err := io.WriteString(conn, RFBVersion); err != nil {
+				return
+			}
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// Addr returns the host:port the fake is listening on.
+func (f *FakeVNC) Addr() string {
+	return f.listener.Addr().String()
+}
+
+// Close stops accepting connections and closes the ones already accepted.
+func (f *FakeVNC) Close() {
+	f.listener.Close()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+// DesktopEvent is a key or pointer event a FakeDesktop received.
+type DesktopEvent struct {
+	// Key is the keysym of a key event, 0 for pointer events.
+	Key  uint32
+	Down bool
+	// Buttons, X and Y of a pointer event.
+	Buttons uint8
+	X, Y    int
+}
+
+// FakeDesktop is an RFB 3.8 server of a Width x Height desktop that records
+// the key and pointer events its clients send, and sends Screen in raw
+// 32-bit pixels when asked for the framebuffer. With a password it requires
+// VNC authentication.
+type FakeDesktop struct {
+	listener net.Listener
+	password string
+	Width    int
+	Height   int
+	// Screen is what the desktop shows, black if nil.
+	Screen image.Image
+
+	lock   sync.Mutex
+	events []DesktopEvent
+	shared []bool
+}
+
+func NewFakeDesktop(password string) (*FakeDesktop, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+	f := &FakeDesktop{listener: listener, password: password, Width: 1024, Height: 768}
+	go f.serve()
+	return f, nil
+}
+
+func (f *FakeDesktop) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := f.handshake(conn); err != nil {
+				return
+			}
+			f.readEvents(conn)
+		}()
+	}
+}
+
+func (f *FakeDesktop) handshake(conn net.Conn) error {
+	version := make([]byte, 12)
+	if _, err := io.WriteString(conn, RFBVersion); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return err
+	}
+	security := byte(1)
+	if f.password != "" {
+		security = 2
+	}
+	if _, err := conn.Write([]byte{1, security}); err != nil {
+		return err
+	}
+	chosen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, chosen); err != nil || chosen[0] != security {
+		return fmt.Errorf("security type %v not offered", chosen)
+	}
+	result := []byte{0, 0, 0, 0}
+	if security == 2 {
+		challenge := []byte("0123456789abcdef")
+		if _, err := conn.Write(challenge); err != nil {
+			return err
+		}
+		response := make([]byte, 16)
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return err
+		}
+		if string(response) != string(vncAuthResponse(f.password, challenge)) {
+			reason := "wrong password"
+			result = append([]byte{0, 0, 0, 1, 0, 0, 0, byte(len(reason))}, reason...)
+		}
+	}
+	if _, err := conn.Write(result); err != nil || result[3] != 0 {
+		return fmt.Errorf("authentication failed")
+	}
+
+	clientInit := make([]byte, 1)
+	if _, err := io.ReadFull(conn, clientInit); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.shared = append(f.shared, clientInit[0] != 0)
+	f.lock.Unlock()
+	name := "fake"
+	serverInit := make([]byte, 24, 24+len(name))
+	binary.BigEndian.PutUint16(serverInit[0:], uint16(f.Width))
+	binary.BigEndian.PutUint16(serverInit[2:], uint16(f.Height))
+	binary.BigEndian.PutUint32(serverInit[20:], uint32(len(name)))
+	_, err := conn.Write(append(serverInit, name...))
+	return err
+}
+
+func (f *FakeDesktop) readEvents(conn net.Conn) {
+	msgType := make([]byte, 1)
+	// The client's pixel format: big-endian and the red, green and blue
+	// shifts. Only 32-bit true colour is supported.
+	bigEndian, shifts := false, [3]uint8{16, 8, 0}
+	for {
+		if _, err := io.ReadFull(conn, msgType); err != nil {
+			return
+		}
+		var event DesktopEvent
+		switch msgType[0] {
+		case 0:
+			msg := make([]byte, 19)
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				return
+			}
+			bigEndian = msg[5] != 0
+			shifts = [3]uint8{msg[13], msg[14], msg[15]}
+			continue
+		case 2:
+			msg := make([]byte, 3)
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				return
+			}
+			if _, err := io.CopyN(io.Discard, conn, 4*int64(binary.BigEndian.Uint16(msg[1:]))); err != nil {
+				return
+			}
+			continue
+		case 3:
+			msg := make([]byte, 9)
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				return
+			}
+			if err := f.sendScreen(conn, bigEndian, shifts); err != nil {
+				return
+			}
+			continue
+		case 4:
+			msg := make([]byte, 7)
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				return
+			}
+			event.Down = msg[0] != 0
+			event.Key = binary.BigEndian.Uint32(msg[3:])
+		case 5:
+			msg := make([]byte, 5)
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				return
+			}
+			event.Buttons = msg[0]
+			event.X = int(binary.BigEndian.Uint16(msg[1:]))
+			event.Y = int(binary.BigEndian.Uint16(msg[3:]))
+		default:
+			return
+		}
+		f.lock.Lock()
+		f.events = append(f.events, event)
+		f.lock.Unlock()
+	}
+}
+
+// sendScreen sends Screen as a framebuffer update of a single raw rectangle.
+func (f *FakeDesktop) sendScreen(conn net.Conn, bigEndian bool, shifts [3]uint8) error {
+	msg := make([]byte, 16, 16+4*f.Width*f.Height)
+	binary.BigEndian.PutUint16(msg[2:], 1)
+	binary.BigEndian.PutUint16(msg[8:], uint16(f.Width))
+	binary.BigEndian.PutUint16(msg[10:], uint16(f.Height))
+	pixel := make([]byte, 4)
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			var r, g, b uint32
+			if f.Screen != nil {
+				r, g, b, _ = f.Screen.At(x, y).RGBA()
+			}
+			value := (r>>8)<<shifts[0] | (g>>8)<<shifts[1] | (b>>8)<<shifts[2]
+			if bigEndian {
+				binary.BigEndian.PutUint32(pixel, value)
+			} else {
+				binary.LittleEndian.PutUint32(pixel, value)
+			}
+			msg = append(msg, pixel...)
+		}
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+// vncAuthResponse is the response of VNC authentication to challenge.
+func vncAuthResponse(password string, challenge []byte) []byte {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		key[i] = bits.Reverse8(b)
+	}
+	block, _ := des.NewCipher(key)
+	response := make([]byte, 16)
+	block.Encrypt(response[:8], challenge[:8])
+	block.Encrypt(response[8:], challenge[8:])
+	return response
+}
+
+// Addr returns the host:port the fake is listening on.
+func (f *FakeDesktop) Addr() string {
+	return f.listener.Addr().String()
+}
+
+// Events returns the events received so far.
+func (f *FakeDesktop) Events() []DesktopEvent {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]DesktopEvent(nil), f.events...)
+}
+
+// Shared reports, for every client that connected, whether it asked to share
+// the desktop with the other clients.
+func (f *FakeDesktop) Shared() []bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]bool(nil), f.shared...)
+}
+
+// Close stops accepting connections.
+func (f *FakeDesktop) Close() {
+	f.listener.Close()
+}
+
+// WebSocketURL converts an http(s) URL of a test server into a ws(s) one.
+func WebSocketURL(httpURL string) string {
+	return "ws" + strings.TrimPrefix(httpURL, "http")
+}
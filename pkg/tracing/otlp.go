@@ -0,0 +1,230 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abshkbh/arrakis/pkg/sink"
+)
+
+// maxResponseSize bounds the responses of collectors read.
+const maxResponseSize = 1 << 20
+
+// Options configure a tracer.
+type Options struct {
+	// Endpoint is the base URL of an OTLP/HTTP collector, e.g.
+	// http://otel-collector:4318. Spans are POSTed to its /v1/traces.
+	Endpoint string
+	// Headers are added to the requests to the collector, e.g. for
+	// authentication.
+	Headers map[string]string
+	// ServiceName is the service.name of the spans.
+	ServiceName string
+	// SampleRatio is the share of the traces started here, rather than by the
+	// client, that are exported. Traces started by clients are exported if
+	// they sampled them.
+	SampleRatio float64
+	// Forwarder batches the spans exported.
+	Forwarder sink.ForwarderOptions
+}
+
+// Validate checks the options before a tracer is created with them.
+func (opts Options) Validate() error {
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("the endpoint of a collector must be an http or https url, got %q", opts.Endpoint)
+	}
+	if opts.SampleRatio < 0 || opts.SampleRatio > 1 {
+		return errors.New("the sample ratio must be between 0 and 1")
+	}
+	if opts.ServiceName == "" {
+		return errors.New("spans need a service name")
+	}
+	return nil
+}
+
+// New returns a tracer exporting to the collector of opts.
+func New(opts Options) (*Tracer, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	c := &collector{
+		url:     strings.TrimSuffix(opts.Endpoint, "/") + "/v1/traces",
+		headers: opts.Headers,
+		service: opts.ServiceName,
+		client:  &http.Client{},
+	}
+	if opts.Forwarder.Name == "" {
+		opts.Forwarder.Name = "otlp"
+	}
+	return &Tracer{
+		exporter: &exporter{forwarder: sink.NewForwarder(c, opts.Forwarder)},
+		ratio:    opts.SampleRatio,
+	}, nil
+}
+
+// exporter queues spans for a collector.
+type exporter struct {
+	forwarder *sink.Forwarder
+}
+
+func (e *exporter) export(s *Span) {
+	value, err := json.Marshal(s.otlp())
+	if err != nil {
+		log.WithError(err).Warnf("Failed to encode span %s", s.name)
+		return
+	}
+	e.forwarder.Forward(sink.Record{Key: hex.EncodeToString(s.sc.TraceID[:]), Value: value})
+}
+
+func (e *exporter) close() error {
+	return e.forwarder.Close()
+}
+
+// Stats counts the spans exported.
+func (t *Tracer) Stats() sink.Stats {
+	if t == nil {
+		return sink.Stats{}
+	}
+	return t.exporter.forwarder.Stats()
+}
+
+// otlpSpan is a span in the JSON encoding of OTLP.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	// Code is 2 for errors.
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlp returns the span as OTLP encodes it, once ended.
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attrs),
+	}
+	if s.parent.IsValid() {
+		span.ParentSpanID = hex.EncodeToString(s.parent.SpanID[:])
+	}
+	if s.err != "" {
+		span.Status = &otlpStatus{Code: 2, Message: s.err}
+	}
+	return span
+}
+
+// otlpAttributes encodes attrs, sorted by key.
+func otlpAttributes(attrs map[string]any) []otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var encoded []otlpAttribute
+	for _, key := range keys {
+		var value map[string]any
+		switch v := attrs[key].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, otlpAttribute{Key: key, Value: value})
+	}
+	return encoded
+}
+
+// collector POSTs batches of spans to an OTLP/HTTP collector, as JSON.
+type collector struct {
+	url     string
+	headers map[string]string
+	service string
+	client  *http.Client
+}
+
+func (c *collector) Send(ctx context.Context, records []sink.Record) error {
+	spans := make([]json.RawMessage, len(records))
+	for i, r := range records {
+		spans[i] = r.Value
+	}
+	request := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": c.service}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/abshkbh/arrakis/pkg/tracing"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("collector responded %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+func (c *collector) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
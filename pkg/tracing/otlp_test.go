@@ -0,0 +1,253 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// otlpMessages are the fields of the messages of an OTLP/HTTP export of
+// spans, from opentelemetry-proto's collector/trace/v1/trace_service.proto,
+// trace/v1/trace.proto, resource/v1/resource.proto and common/v1/common.proto,
+// named as in the protobuf JSON mapping. Values are other messages, "[]" for
+// repeated fields, or the scalar types checked by checkOTLPScalar.
+var otlpMessages = map[string]map[string]string{
+	"ExportTraceServiceRequest": {
+		"resourceSpans": "[]ResourceSpans",
+	},
+	"ResourceSpans": {
+		"resource":   "Resource",
+		"scopeSpans": "[]ScopeSpans",
+		"schemaUrl":  "string",
+	},
+	"Resource": {
+		"attributes":             "[]KeyValue",
+		"droppedAttributesCount": "uint32",
+	},
+	"ScopeSpans": {
+		"scope":     "InstrumentationScope",
+		"spans":     "[]Span",
+		"schemaUrl": "string",
+	},
+	"InstrumentationScope": {
+		"name":                   "string",
+		"version":                "string",
+		"attributes":             "[]KeyValue",
+		"droppedAttributesCount": "uint32",
+	},
+	"Span": {
+		"traceId":                "traceId",
+		"spanId":                 "spanId",
+		"traceState":             "string",
+		"parentSpanId":           "spanId",
+		"flags":                  "uint32",
+		"name":                   "string",
+		"kind":                   "SpanKind",
+		"startTimeUnixNano":      "fixed64",
+		"endTimeUnixNano":        "fixed64",
+		"attributes":             "[]KeyValue",
+		"droppedAttributesCount": "uint32",
+		"droppedEventsCount":     "uint32",
+		"droppedLinksCount":      "uint32",
+		"status":                 "Status",
+	},
+	"KeyValue": {
+		"key":   "string",
+		"value": "AnyValue",
+	},
+	// AnyValue is a oneof, checked to set a single field.
+	"AnyValue": {
+		"stringValue": "string",
+		"boolValue":   "bool",
+		"intValue":    "int64",
+		"doubleValue": "double",
+	},
+	"Status": {
+		"message": "string",
+		"code":    "StatusCode",
+	},
+}
+
+var (
+	traceIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	spanIDPattern  = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+// checkOTLPScalar checks a value of a scalar type as the protobuf JSON
+// mapping encodes it, with OTLP's exception of hex encoded IDs.
+func checkOTLPScalar(typ string, value any) error {
+	switch typ {
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%v isn't a string", value)
+		}
+	case "bool":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%v isn't a bool", value)
+		}
+	case "double":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%v isn't a number", value)
+		}
+	case "uint32":
+		n, ok := value.(float64)
+		if !ok || n < 0 || n != float64(uint32(n)) {
+			return fmt.Errorf("%v isn't a uint32", value)
+		}
+	case "int64", "fixed64":
+		// 64-bit integers are strings of decimal digits.
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%v isn't a string", value)
+		}
+		var err error
+		if typ == "int64" {
+			_, err = strconv.ParseInt(s, 10, 64)
+		} else {
+			_, err = strconv.ParseUint(s, 10, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("%q isn't a %s: %v", s, typ, err)
+		}
+	case "traceId", "spanId":
+		pattern := traceIDPattern
+		if typ == "spanId" {
+			pattern = spanIDPattern
+		}
+		if s, ok := value.(string); !ok || !pattern.MatchString(s) {
+			return fmt.Errorf("%v isn't a hex encoded %s", value, typ)
+		}
+	case "SpanKind", "StatusCode":
+		// Enums are their numbers, SPAN_KIND_UNSPECIFIED to
+		// SPAN_KIND_CONSUMER and STATUS_CODE_UNSET to STATUS_CODE_ERROR.
+		limit := map[string]float64{"SpanKind": 5, "StatusCode": 2}[typ]
+		n, ok := value.(float64)
+		if !ok || n < 0 || n > limit || n != float64(int(n)) {
+			return fmt.Errorf("%v isn't a %s", value, typ)
+		}
+	default:
+		return fmt.Errorf("unknown type %s", typ)
+	}
+	return nil
+}
+
+// checkOTLP checks that value is a message of type typ, returning the
+// errors found at path and below.
+func checkOTLP(path string, typ string, value any) []error {
+	if elem, ok := strings.CutPrefix(typ, "[]"); ok {
+		list, ok := value.([]any)
+		if !ok {
+			return []error{fmt.Errorf("%s: %v isn't a list", path, value)}
+		}
+		var errs []error
+		for i, item := range list {
+			errs = append(errs, checkOTLP(fmt.Sprintf("%s[%d]", path, i), elem, item)...)
+		}
+		return errs
+	}
+	fields, ok := otlpMessages[typ]
+	if !ok {
+		if err := checkOTLPScalar(typ, value); err != nil {
+			return []error{fmt.Errorf("%s: %v", path, err)}
+		}
+		return nil
+	}
+	message, ok := value.(map[string]any)
+	if !ok {
+		return []error{fmt.Errorf("%s: %v isn't a %s", path, value, typ)}
+	}
+	var errs []error
+	if typ == "AnyValue" && len(message) != 1 {
+		errs = append(errs, fmt.Errorf("%s: AnyValue sets %d fields, want 1", path, len(message)))
+	}
+	for name, field := range message {
+		fieldType, ok := fields[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s has no field %q", path, typ, name))
+			continue
+		}
+		errs = append(errs, checkOTLP(path+"."+name, fieldType, field)...)
+	}
+	return errs
+}
+
+func TestOTLPSchema(t *testing.T) {
+	received := make(chan []byte, 2)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+	}))
+	defer collector.Close()
+	tracer, err := New(Options{Endpoint: collector.URL, ServiceName: "arrakis-test", SampleRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attributes of every type, a parent and an error.
+	ctx, root := tracer.Start(context.Background(), "proxy", KindServer)
+	root.SetAttribute("vm.name", "vm1")
+	root.SetAttribute("cdp.recorded", true)
+	root.SetAttribute("http.status_code", 101)
+	root.SetAttribute("ws.bytes", int64(1)<<40)
+	root.SetAttribute("latency.ratio", 0.5)
+	root.SetAttribute("peer", struct{ Host string }{"vm1"})
+	_, child := tracer.Start(ctx, "dial", KindClient)
+	child.SetError(errors.New("connection refused"))
+	child.End()
+	root.End()
+	tracer.Close()
+	close(received)
+
+	spans := 0
+	for body := range received {
+		var request map[string]any
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Fatalf("export isn't JSON: %v", err)
+		}
+		for _, err := range checkOTLP("request", "ExportTraceServiceRequest", request) {
+			t.Error(err)
+		}
+		for _, rs := range request["resourceSpans"].([]any) {
+			for _, ss := range rs.(map[string]any)["scopeSpans"].([]any) {
+				spans += len(ss.(map[string]any)["spans"].([]any))
+			}
+		}
+		if t.Failed() {
+			t.Logf("exported %s", body)
+		}
+	}
+	if spans != 2 {
+		t.Errorf("exported %d spans, want 2", spans)
+	}
+}
+
+func TestCheckOTLP(t *testing.T) {
+	// The checks catch what a collector would reject or misread.
+	for name, request := range map[string]string{
+		"unknown field":     `{"resourceSpans": [{"scopeSpans": [{"spans": [{"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736"}]}]}]}`,
+		"base64 trace ID":   `{"resourceSpans": [{"scopeSpans": [{"spans": [{"traceId": "S/kvNXezTaajzpKdDg5HNg=="}]}]}]}`,
+		"numeric timestamp": `{"resourceSpans": [{"scopeSpans": [{"spans": [{"startTimeUnixNano": 1700000000000000000}]}]}]}`,
+		"kind by name":      `{"resourceSpans": [{"scopeSpans": [{"spans": [{"kind": "SPAN_KIND_SERVER"}]}]}]}`,
+		"two values":        `{"resourceSpans": [{"resource": {"attributes": [{"key": "k", "value": {"stringValue": "a", "boolValue": true}}]}}]}`,
+		"numeric int":       `{"resourceSpans": [{"resource": {"attributes": [{"key": "k", "value": {"intValue": 1}}]}}]}`,
+	} {
+		var value any
+		if err := json.Unmarshal([]byte(request), &value); err != nil {
+			t.Fatal(err)
+		}
+		if errs := checkOTLP("request", "ExportTraceServiceRequest", value); len(errs) == 0 {
+			t.Errorf("%s: checkOTLP() found no errors", name)
+		}
+	}
+}
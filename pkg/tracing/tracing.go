@@ -0,0 +1,234 @@
+// Package tracing records OpenTelemetry spans of requests and exports them
+// over OTLP/HTTP, propagating W3C trace contexts in traceparent headers, so
+// that the time requests spend in arrakis can be correlated with the traces
+// of the clients that sent them.
+//
+// It doesn't use the OpenTelemetry Go SDK. The cdpserver only needs to start
+// spans, propagate traceparent headers and export the spans, which this does
+// in a few hundred lines. The exporter batches and retries through the same
+// pkg/sink forwarder as the cdpserver's event sinks. The SDK and its OTLP
+// exporter would bring a dozen modules into the build, pinning their own
+// gRPC and protobuf versions, for features that aren't used. The exporter
+// writes OTLP/JSON by hand, and its test checks the output against the
+// messages of the OTLP protos.
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader carries the W3C trace context of a request.
+const TraceparentHeader = "traceparent"
+
+// Kinds of spans, as numbered by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent returns the traceparent header of sc.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a traceparent header, of version 00 or of a later
+// one read as 00.
+func ParseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// decodeHex decodes s, which must be exactly the lowercase hex of len(dst)
+// bytes, into dst.
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// Extract returns a copy of ctx carrying the trace context of header, if it
+// has a valid one, as the parent of the spans started with it.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := ParseTraceparent(header.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject sets the traceparent header of the span ctx carries or, while not
+// tracing, passes on the trace context ctx was extracted with. It leaves
+// header alone if there is neither.
+func Inject(ctx context.Context, header http.Header) {
+	if span := FromContext(ctx); span != nil {
+		header.Set(TraceparentHeader, span.sc.Traceparent())
+		return
+	}
+	if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		header.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+// FromContext returns the span of ctx, nil if it has none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Tracer starts spans, exporting the sampled ones once ended. A nil tracer
+// starts no spans.
+type Tracer struct {
+	exporter *exporter
+	// ratio is the share of the traces started here that are sampled.
+	ratio float64
+}
+
+// Start starts a span named name as a child of the span of ctx, or of the
+// trace context ctx was extracted with. It returns a copy of ctx carrying the
+// span, which must be ended. The span is nil if t is.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: map[string]any{}}
+	if parent := FromContext(ctx); parent != nil {
+		span.parent = parent.sc
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		span.parent = remote
+	}
+	if span.parent.IsValid() {
+		span.sc.TraceID = span.parent.TraceID
+		span.sc.Sampled = span.parent.Sampled
+	} else {
+		putUint64s(span.sc.TraceID[:], rand.Uint64(), rand.Uint64())
+		span.sc.Sampled = rand.Float64() < t.ratio
+	}
+	putUint64s(span.sc.SpanID[:], rand.Uint64())
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// putUint64s fills b with the bytes of vs, never all zero.
+func putUint64s(b []byte, vs ...uint64) {
+	for i, v := range vs {
+		if v == 0 {
+			v = 1
+		}
+		for j := 0; j < 8; j++ {
+			b[8*i+j] = byte(v >> (8 * j))
+		}
+	}
+}
+
+// Close exports the spans ended and not yet exported.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.close()
+}
+
+// Span times an operation. Its methods do nothing on a nil span.
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   int
+	sc     SpanContext
+	parent SpanContext
+
+	mu    sync.Mutex
+	start time.Time
+	end   time.Time
+	attrs map[string]any
+	err   string // Of a failed span
+	ended bool
+}
+
+// Context returns the span's context, invalid for a nil span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute sets an attribute of the span, a string, bool, int, int64 or
+// float64.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// SetError marks the span failed with err, if not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End ends the span and queues it for export if sampled. Only the first call
+// counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sc.Sampled {
+		s.tracer.exporter.export(s)
+	}
+}
@@ -0,0 +1,150 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	const h = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(h)
+	if !ok || !sc.Sampled || sc.Traceparent() != h {
+		t.Errorf("ParseTraceparent(%q) = %+v, %t", h, sc, ok)
+	}
+	if sc, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future"); !ok || sc.Sampled {
+		t.Errorf("later version = %+v, %t, want read as 00", sc, ok)
+	}
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+	} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Errorf("parsed %q", invalid)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		received <- req
+	}))
+	defer collector.Close()
+	if _, err := New(Options{Endpoint: "grpc://collector:4317", ServiceName: "test"}); err == nil {
+		t.Error("tracer exporting over gRPC created")
+	}
+	tracer, err := New(Options{
+		Endpoint:    collector.URL + "/",
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		ServiceName: "arrakis-test",
+		SampleRatio: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Spans continue the trace of the request.
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := tracer.Start(Extract(context.Background(), header), "proxy", KindServer)
+	root.SetAttribute("vm.name", "vm1")
+	_, child := tracer.Start(ctx, "dial", KindClient)
+	child.SetError(errors.New("connection refused"))
+	child.End()
+	root.End()
+	root.End()
+	if root.Context().TraceID != child.Context().TraceID || root.Context().Traceparent()[:35] != "00-4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("spans of traces %s and %s", root.Context().Traceparent(), child.Context().Traceparent())
+	}
+	out := http.Header{}
+	Inject(ctx, out)
+	if out.Get(TraceparentHeader) != root.Context().Traceparent() {
+		t.Errorf("injected %q, want the span's", out.Get(TraceparentHeader))
+	}
+	tracer.Close()
+
+	req := <-received
+	data, _ := json.Marshal(req)
+	var decoded struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	json.Unmarshal(data, &decoded)
+	if len(decoded.ResourceSpans) != 1 || len(decoded.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("exported %s", data)
+	}
+	if attrs := decoded.ResourceSpans[0].Resource.Attributes; len(attrs) != 1 || attrs[0].Value["stringValue"] != "arrakis-test" {
+		t.Errorf("resource attributes = %+v", attrs)
+	}
+	spans := decoded.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	dial, proxy := spans[0], spans[1]
+	if proxy.Name != "proxy" || proxy.Kind != KindServer || proxy.ParentSpanID != "00f067aa0ba902b7" || proxy.Status != nil ||
+		len(proxy.Attributes) != 1 || proxy.Attributes[0].Value["stringValue"] != "vm1" {
+		t.Errorf("proxy span = %+v", proxy)
+	}
+	if dial.ParentSpanID != proxy.SpanID || dial.Status == nil || dial.Status.Code != 2 || dial.Status.Message != "connection refused" {
+		t.Errorf("dial span = %+v", dial)
+	}
+	if st := tracer.Stats(); st.Forwarded != 2 || st.Failed != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	tracer, err := New(Options{Endpoint: "http://127.0.0.1:1", ServiceName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracer.Close()
+	// Traces started here aren't sampled with a ratio of 0, but their
+	// context is propagated.
+	ctx, span := tracer.Start(context.Background(), "proxy", KindServer)
+	span.End()
+	out := http.Header{}
+	Inject(ctx, out)
+	if span.Context().Sampled || out.Get(TraceparentHeader) == "" {
+		t.Errorf("span %+v, injected %q", span.Context(), out.Get(TraceparentHeader))
+	}
+	// Those the client sampled are.
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if _, span := tracer.Start(Extract(context.Background(), header), "proxy", KindServer); !span.Context().Sampled {
+		t.Error("span of a sampled trace not sampled")
+	}
+
+	// Without a tracer, the client's context is passed on as is.
+	var none *Tracer
+	ctx, span = none.Start(Extract(context.Background(), header), "proxy", KindServer)
+	span.SetAttribute("vm.name", "vm1")
+	span.End()
+	out = http.Header{}
+	Inject(ctx, out)
+	if span != nil || out.Get(TraceparentHeader) != header.Get(TraceparentHeader) {
+		t.Errorf("span %v, injected %q", span, out.Get(TraceparentHeader))
+	}
+}
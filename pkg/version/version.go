@@ -0,0 +1,8 @@
+// Package version holds the build version of the arrakis binaries. It is set
+// at build time with
+//
+//	-ldflags "-X github.com/abshkbh/arrakis/pkg/version.Version=<version>"
+package version
+
+// Version is the version the binary was built from.
+var Version = "dev"
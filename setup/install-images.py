@@ -1,6 +1,7 @@
 #!/usr/bin/env python3
 
 import os
+import platform
 import requests
 import stat
 from pathlib import Path
@@ -34,24 +35,40 @@ def main():
     bin_dir = "resources/bin"
     ensure_directory_exists(bin_dir)
 
+    # Guests run on the host's architecture.
+    machine = platform.machine()
+    if machine in ("aarch64", "arm64"):
+        chv_asset = "cloud-hypervisor-static-aarch64"
+    elif machine in ("x86_64", "amd64"):
+        chv_asset = "cloud-hypervisor-static"
+    else:
+        print(f"Unsupported host architecture: {machine}")
+        exit(1)
+
     # Download files
     files_to_download = [
         {
-            "url": "https://github.com/abshkbh/arrakis-images/blob/main/guest/kernel/vmlinux.bin",
-            "destination": f"{bin_dir}/vmlinux.bin",
-            "executable": False
-        },
-        {
-            "url": "https://github.com/cloud-hypervisor/cloud-hypervisor/releases/download/v44.0/cloud-hypervisor-static",
+            "url": f"https://github.com/cloud-hypervisor/cloud-hypervisor/releases/download/v44.0/{chv_asset}",
             "destination": f"{bin_dir}/cloud-hypervisor",
             "executable": True
-        },
-        {
-            "url": "https://github.com/abshkbh/arrakis-images/blob/main/busybox",
-            "destination": f"{bin_dir}/busybox",
-            "executable": True
         }
     ]
+    if chv_asset == "cloud-hypervisor-static":
+        files_to_download += [
+            {
+                "url": "https://github.com/abshkbh/arrakis-images/blob/main/guest/kernel/vmlinux.bin",
+                "destination": f"{bin_dir}/vmlinux.bin",
+                "executable": False
+            },
+            {
+                "url": "https://github.com/abshkbh/arrakis-images/blob/main/busybox",
+                "destination": f"{bin_dir}/busybox",
+                "executable": True
+            }
+        ]
+    else:
+        print("No prebuilt aarch64 guest kernel or busybox, build them and set "
+              "architectures -> aarch64 in config.yaml")
 
     for file_info in files_to_download:
         try: